@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"errors"
+	"net/http"
+)
+
+// TunnelOperation is a request made on a tunnel after it is connected
+type TunnelOperation string
+
+const (
+	// OperationRead is a read request, receiving instructions from guacd
+	OperationRead TunnelOperation = "read"
+	// OperationWrite is a write request, sending instructions to guacd
+	OperationWrite TunnelOperation = "write"
+)
+
+// TunnelAuthorizer decides whether a read or write request may use a tunnel, given the
+// request and what is known about the tunnel. Returning an error refuses the request without
+// closing the tunnel. Errors which are not an ErrGuac are reported to the client as
+// ClientUnauthorized.
+type TunnelAuthorizer interface {
+	AuthorizeTunnel(r *http.Request, operation TunnelOperation, tunnel *TunnelInfo) error
+}
+
+// TunnelAuthorizerFunc adapts an ordinary function to the TunnelAuthorizer interface
+type TunnelAuthorizerFunc func(r *http.Request, operation TunnelOperation, tunnel *TunnelInfo) error
+
+// AuthorizeTunnel calls f(r, operation, tunnel)
+func (f TunnelAuthorizerFunc) AuthorizeTunnel(r *http.Request, operation TunnelOperation, tunnel *TunnelInfo) error {
+	return f(r, operation, tunnel)
+}
+
+// OwnerOnly returns a TunnelAuthorizer only letting the user a tunnel was opened for use it,
+// authenticating each request with authorizer, typically the Authorizer of the server.
+// Tunnels opened without an identity may be used by anyone.
+func OwnerOnly(authorizer Authorizer) TunnelAuthorizer {
+	return TunnelAuthorizerFunc(func(r *http.Request, _ TunnelOperation, tunnel *TunnelInfo) error {
+		if tunnel.Identity == nil {
+			return nil
+		}
+		_, identity, err := authorize(authorizer, r)
+		if err != nil {
+			return err
+		}
+		if identity == nil || identity.Subject != tunnel.Identity.Subject {
+			return ErrUnauthorized.NewError("Tunnel belongs to another user.")
+		}
+		return nil
+	})
+}
+
+// authorizeTunnel runs the TunnelAuthorizer of the server, if any, on a read or write request
+func (s *Server) authorizeTunnel(request *http.Request, operation TunnelOperation, tunnelUUID string, tunnel Tunnel) error {
+	if s.TunnelAuthorizer == nil {
+		return nil
+	}
+	info := &TunnelInfo{UUID: tunnelUUID, ConnectionID: tunnel.ConnectionID()}
+	if registered, ok := tunnel.(*LastAccessedTunnel); ok {
+		info = tunnelInfo(tunnelUUID, registered)
+	}
+	err := s.TunnelAuthorizer.AuthorizeTunnel(request, operation, info)
+	if err == nil {
+		return nil
+	}
+	s.log(registryLog, tunnel).Infof("Refused %v of tunnel %v: %v", operation, tunnelUUID, err)
+	var guacErr *ErrGuac
+	if errors.As(err, &guacErr) {
+		return err
+	}
+	return ErrUnauthorized.NewError(err.Error())
+}
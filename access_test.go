@@ -0,0 +1,83 @@
+package guac
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// userAuthorizer authenticates the user named in the Authorization header
+var userAuthorizer = AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+	if user := r.Header.Get("Authorization"); user != "" {
+		return &Identity{Subject: user}, nil
+	}
+	return nil, errors.New("no credentials")
+})
+
+func TestServer_TunnelAuthorizer(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: &strings.Builder{}}, uuid: tunnelUUID}, nil
+	})
+	server.Authorizer = userAuthorizer
+	server.TunnelAuthorizer = OwnerOnly(userAuthorizer)
+
+	write := func(user string) int {
+		request := httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader("3.nop;"))
+		request.Header.Set("Authorization", user)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	request := connectRequest("")
+	request.Header.Set("Authorization", "alice")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	if code := write("alice"); code != http.StatusOK {
+		t.Fatal("Expected the owner to write to the tunnel, got", code)
+	}
+	if code := write("mallory"); code != http.StatusForbidden {
+		t.Error("Expected another user to be refused, got", code)
+	}
+	if code := write(""); code != http.StatusForbidden {
+		t.Error("Expected an anonymous request to be refused, got", code)
+	}
+	if len(server.Tunnels()) != 1 {
+		t.Error("Expected a refused request to leave the tunnel open")
+	}
+}
+
+func TestServer_TunnelAuthorizerFunc(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: &strings.Builder{}}, uuid: tunnelUUID}, nil
+	})
+	var seen []TunnelOperation
+	server.TunnelAuthorizer = TunnelAuthorizerFunc(func(r *http.Request, operation TunnelOperation, tunnel *TunnelInfo) error {
+		seen = append(seen, operation)
+		if tunnel.UUID != tunnelUUID || tunnel.ConnectionID != "asdf" {
+			t.Errorf("Unexpected tunnel %+v", tunnel)
+		}
+		return errors.New("read only")
+	})
+	server.ServeHTTP(httptest.NewRecorder(), connectRequest(""))
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader("3.nop;")))
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected the write to be refused, got", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnelUUID+":0", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected the read to be refused, got", recorder.Code)
+	}
+	if len(seen) != 2 || seen[0] != OperationWrite || seen[1] != OperationRead {
+		t.Error("Expected both operations to be authorized, got", seen)
+	}
+}
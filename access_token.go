@@ -0,0 +1,172 @@
+package guac
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// AccessTokenHeader carries the token a client is given by a connect request, and must
+	// present on each read and write request of the tunnel when the server has AccessTokens.
+	// Responses carry a fresh token in it as the one presented nears expiry.
+	AccessTokenHeader = "Guacamole-Access-Token"
+	// DefaultAccessTokenTTL is how long access tokens are valid for when the TTL of
+	// AccessTokens is zero
+	DefaultAccessTokenTTL = 15 * time.Minute
+)
+
+// jwtHeader is the encoded header of every access token, which are HS256 JWTs
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// AccessClaims are the claims of an access token
+type AccessClaims struct {
+	// Tunnel is the UUID of the tunnel the token grants access to
+	Tunnel string `json:"tunnel"`
+	// Subject is the subject of the identity the tunnel was opened for, if any
+	Subject string `json:"sub,omitempty"`
+	// Name is the display name of the identity the tunnel was opened for, if any
+	Name     string `json:"name,omitempty"`
+	Issuer   string `json:"iss,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+// AccessTokens issues signed tokens granting access to a single tunnel, which clients must
+// present on each read and write request, so knowing or guessing the UUID of a tunnel is not
+// enough to use it. The tokens are JWTs signed with HMAC-SHA256, so any node of a cluster
+// sharing the key can verify them without state.
+type AccessTokens struct {
+	// Key signs and verifies tokens. It should be at least 32 random bytes.
+	Key []byte
+	// PreviousKeys optionally verifies tokens signed before the Key was rotated
+	PreviousKeys [][]byte
+	// TTL is how long tokens are valid for, DefaultAccessTokenTTL if zero
+	TTL time.Duration
+	// Issuer is optionally set as the iss claim of tokens, and required of the tokens verified
+	Issuer string
+}
+
+func (a *AccessTokens) ttl() time.Duration {
+	if a.TTL <= 0 {
+		return DefaultAccessTokenTTL
+	}
+	return a.TTL
+}
+
+// Issue returns a token granting access to the tunnel with the given UUID, opened for
+// identity, which may be nil
+func (a *AccessTokens) Issue(tunnelUUID string, identity *Identity) (string, error) {
+	if len(a.Key) == 0 {
+		return "", ErrServer.NewError("No key to sign access tokens with.")
+	}
+	now := time.Now()
+	claims := AccessClaims{Tunnel: tunnelUUID, Issuer: a.Issuer, IssuedAt: now.Unix(), Expiry: now.Add(a.ttl()).Unix()}
+	if identity != nil {
+		claims.Subject = identity.Subject
+		claims.Name = identity.DisplayName
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", ErrServer.NewError(err.Error())
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signToken(a.Key, signed)), nil
+}
+
+// Verify checks the signature, expiry and issuer of token, returning its claims
+func (a *AccessTokens) Verify(token string) (*AccessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errors.New("malformed access token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed access token")
+	}
+	signed := parts[0] + "." + parts[1]
+	valid := hmac.Equal(signature, signToken(a.Key, signed))
+	for _, key := range a.PreviousKeys {
+		valid = valid || hmac.Equal(signature, signToken(key, signed))
+	}
+	if !valid || len(a.Key) == 0 {
+		return nil, errors.New("invalid access token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed access token")
+	}
+	claims := &AccessClaims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.New("malformed access token")
+	}
+	if !time.Now().Before(time.Unix(claims.Expiry, 0)) {
+		return nil, errors.New("access token has expired")
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, errors.New("access token has the wrong issuer")
+	}
+	return claims, nil
+}
+
+func signToken(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// checkAccessToken requires a read or write request on the tunnel to present a valid access
+// token for it, when the server has AccessTokens. A token past half its lifetime is replaced
+// by a fresh one in the response.
+func (s *Server) checkAccessToken(response http.ResponseWriter, request *http.Request, tunnelUUID string, tunnel Tunnel) error {
+	if s.AccessTokens == nil {
+		return nil
+	}
+	token := request.Header.Get(AccessTokenHeader)
+	if token == "" {
+		return ErrUnauthorized.NewError("No access token.")
+	}
+	claims, err := s.AccessTokens.Verify(token)
+	if err == nil && claims.Tunnel != tunnelUUID {
+		err = errors.New("access token is for another tunnel")
+	}
+	var identity *Identity
+	if registered, ok := tunnel.(*LastAccessedTunnel); ok {
+		identity = registered.Identity()
+	}
+	if err == nil && identity != nil && claims.Subject != identity.Subject {
+		err = errors.New("access token is for another user")
+	}
+	if err != nil {
+		s.log(registryLog, tunnel).Infof("Refused access to tunnel %v: %v", tunnelUUID, err)
+		return ErrUnauthorized.NewError("Invalid access token.")
+	}
+
+	issued, expiry := time.Unix(claims.IssuedAt, 0), time.Unix(claims.Expiry, 0)
+	if time.Now().After(issued.Add(expiry.Sub(issued) / 2)) {
+		if fresh, err := s.AccessTokens.Issue(tunnelUUID, identity); err == nil {
+			response.Header().Set(AccessTokenHeader, fresh)
+		}
+	}
+	return nil
+}
+
+// issueAccessToken gives the client of a connect request the access token for its tunnel
+func (s *Server) issueAccessToken(response http.ResponseWriter, tunnelUUID string, identity *Identity) error {
+	if s.AccessTokens == nil {
+		return nil
+	}
+	token, err := s.AccessTokens.Issue(tunnelUUID, identity)
+	if err != nil {
+		return err
+	}
+	response.Header().Set(AccessTokenHeader, token)
+	return nil
+}
@@ -0,0 +1,79 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAccessTokens_Verify(t *testing.T) {
+	tokens := &AccessTokens{Key: []byte("0123456789abcdef0123456789abcdef"), Issuer: "guac"}
+	token, err := tokens.Issue("tunnel", &Identity{Subject: "alice", DisplayName: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Tunnel != "tunnel" || claims.Subject != "alice" || claims.Name != "Alice" || claims.Issuer != "guac" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	if _, err = tokens.Verify(token[:len(token)-2]); err == nil {
+		t.Error("Expected a tampered token to be refused")
+	}
+	rotated := &AccessTokens{Key: []byte("fedcba9876543210fedcba9876543210"), PreviousKeys: [][]byte{tokens.Key}}
+	if _, err = rotated.Verify(token); err != nil {
+		t.Error("Expected a token signed with a previous key to be accepted, got", err)
+	}
+	if _, err = (&AccessTokens{Key: rotated.Key}).Verify(token); err == nil {
+		t.Error("Expected a token signed with another key to be refused")
+	}
+	if _, err = (&AccessTokens{Key: tokens.Key, Issuer: "other"}).Verify(token); err == nil {
+		t.Error("Expected a token from another issuer to be refused")
+	}
+
+	expiring := &AccessTokens{Key: tokens.Key, TTL: time.Nanosecond}
+	token, _ = expiring.Issue("tunnel", nil)
+	if _, err = expiring.Verify(token); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Error("Expected an expired token to be refused, got", err)
+	}
+}
+
+func TestServer_AccessTokens(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: &strings.Builder{}}, uuid: tunnelUUID}, nil
+	})
+	server.AccessTokens = &AccessTokens{Key: []byte("0123456789abcdef0123456789abcdef")}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	token := recorder.Header().Get(AccessTokenHeader)
+	if token == "" {
+		t.Fatal("Expected the connect response to carry an access token")
+	}
+
+	write := func(token string) int {
+		request := httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader("3.nop;"))
+		request.Header.Set(AccessTokenHeader, token)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	if code := write(token); code != http.StatusOK {
+		t.Error("Expected a write with the token to succeed, got", code)
+	}
+	if code := write(""); code != http.StatusForbidden {
+		t.Error("Expected a write without a token to be refused, got", code)
+	}
+	other, _ := server.AccessTokens.Issue(uuid.New().String(), nil)
+	if code := write(other); code != http.StatusForbidden {
+		t.Error("Expected a token for another tunnel to be refused, got", code)
+	}
+}
@@ -0,0 +1,291 @@
+package guac
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultKillReason is what users are told when an administrator kills their tunnel without
+// giving a reason
+const DefaultKillReason = "The session was terminated by an administrator."
+
+// TunnelSummary describes an open tunnel to operators
+type TunnelSummary struct {
+	UUID         string    `json:"uuid"`
+	ConnectionID string    `json:"connection_id"`
+	Identity     *Identity `json:"identity,omitempty"`
+	Metadata     *Metadata `json:"metadata"`
+	Tags         Tags      `json:"tags,omitempty"`
+	Connected    time.Time `json:"connected"`
+	// Uptime is how long the tunnel has been open
+	Uptime time.Duration `json:"uptime"`
+	// Filters names the filters added to the tunnel by a Policy or AddTunnelFilter
+	Filters []string `json:"filters,omitempty"`
+	// Stats holds the statistics of the tunnel, including its last activity and the bytes it
+	// has carried
+	Stats TunnelStats `json:"stats"`
+}
+
+// Tunnels returns a summary of each open tunnel, oldest first
+func (s *Server) Tunnels() []TunnelSummary {
+	return s.TunnelsTagged(nil)
+}
+
+// TunnelsTagged returns a summary of each open tunnel whose tags match selector, oldest first
+func (s *Server) TunnelsTagged(selector Tags) []TunnelSummary {
+	now := time.Now()
+	var summaries []TunnelSummary
+	s.tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		if !tunnel.Tags().Matches(selector) {
+			return true
+		}
+		var filters []string
+		var filtered *FilteredTunnel
+		if AsTunnel(tunnel.Tunnel, &filtered) {
+			filters = filtered.FilterNames()
+		}
+		summaries = append(summaries, TunnelSummary{
+			UUID:         uuid,
+			ConnectionID: tunnel.ConnectionID(),
+			Identity:     tunnel.Identity(),
+			Metadata:     tunnel.Metadata(),
+			Tags:         tunnel.Tags(),
+			Connected:    tunnel.Created(),
+			Uptime:       now.Sub(tunnel.Created()),
+			Filters:      filters,
+			Stats:        tunnel.Stats(),
+		})
+		return true
+	})
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Connected.Before(summaries[j].Connected)
+	})
+	return summaries
+}
+
+// AddTunnelFilter adds the built-in filter with the given name, such as
+// PolicyNoClipboardUpload, to the open tunnel with the given UUID. It takes effect from the
+// next instruction. The tunnel must be a FilteredTunnel, as all are with LiveFilters.
+func (s *Server) AddTunnelFilter(tunnelUUID, name string) error {
+	filtered, err := s.filteredTunnel(tunnelUUID)
+	if err != nil {
+		return err
+	}
+	if !installPolicyFilter(filtered, name) {
+		return ErrClient.NewError("No such filter:", name)
+	}
+	s.log(registryLog, filtered).Infof("Added filter %v to tunnel %v.", name, tunnelUUID)
+	return nil
+}
+
+// RemoveTunnelFilter removes the filter with the given name from the open tunnel with the
+// given UUID, whether it was added by AddTunnelFilter or a Policy.
+func (s *Server) RemoveTunnelFilter(tunnelUUID, name string) error {
+	filtered, err := s.filteredTunnel(tunnelUUID)
+	if err != nil {
+		return err
+	}
+	if !filtered.RemoveFilters(name) {
+		return ErrResourceNotFound.NewError("Tunnel has no such filter:", name)
+	}
+	s.log(registryLog, filtered).Infof("Removed filter %v from tunnel %v.", name, tunnelUUID)
+	return nil
+}
+
+func (s *Server) filteredTunnel(tunnelUUID string) (*FilteredTunnel, error) {
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return nil, ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	var filtered *FilteredTunnel
+	if !AsTunnel(tunnel.Tunnel, &filtered) {
+		return nil, ErrUnsupported.NewError("Tunnel does not support filters.")
+	}
+	return filtered, nil
+}
+
+// AdminServer lets operators see what a Server is carrying:
+//
+//	GET /admin/tunnels
+//
+// responds with a JSON array of TunnelSummary objects, oldest first, and
+//
+//	DELETE /admin/tunnels?tunnel=<uuid>&reason=<message>
+//
+// kills the tunnel, telling its user the reason. Given tag=<key>:<value> selectors instead of
+// a tunnel, either request applies to every tunnel with all of those tags:
+//
+//	GET /admin/tunnels?tag=tenant:acme
+//	DELETE /admin/tunnels?tag=tenant:acme&reason=<message>
+//
+// lists the tunnels of tenant acme, and kills them. The filters of a tunnel are changed with
+//
+//	PUT /admin/tunnels?tunnel=<uuid>&filter=<name>
+//	DELETE /admin/tunnels?tunnel=<uuid>&filter=<name>
+//
+// which add and remove the built-in filter with that name. For a server with GuacdLogs,
+//
+//	GET /admin/tunnels?tunnel=<uuid>&journal
+//
+// responds with a JournalResponse of the diagnostics guacd sent about the tunnel, and
+//
+//	GET /admin/tunnels?tunnel=<uuid>&limits
+//
+// with the Limits in force on the tunnel. Given a BackendSet,
+//
+//	GET /admin/tunnels?backends
+//
+// responds with the BackendHealth of each of its guacd backends.
+type AdminServer struct {
+	// Server is the server whose tunnels are administered
+	Server *Server
+	// Backends is optionally the set of guacd backends the server's tunnels connect through
+	Backends *BackendSet
+	// Authorizer authenticates requests, which are all refused without one
+	Authorizer Authorizer
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := authorizeAdmin(a.Authorizer, r); err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+	selector, err := ParseTagSelector(r.URL.Query()["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("journal") {
+			a.serveJournal(w, r.URL.Query().Get("tunnel"))
+			return
+		}
+		if r.URL.Query().Has("backends") {
+			a.serveBackends(w)
+			return
+		}
+		if r.URL.Query().Has("limits") {
+			a.serveLimits(w, r.URL.Query().Get("tunnel"))
+			return
+		}
+	case http.MethodPut:
+		if err := a.Server.AddTunnelFilter(r.URL.Query().Get("tunnel"), r.URL.Query().Get("filter")); err != nil {
+			guacErr := asErrGuac(err)
+			http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodDelete:
+		if filter := r.URL.Query().Get("filter"); filter != "" {
+			if err := a.Server.RemoveTunnelFilter(r.URL.Query().Get("tunnel"), filter); err != nil {
+				guacErr := asErrGuac(err)
+				http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = DefaultKillReason
+		}
+		if len(selector) > 0 {
+			a.killTagged(w, selector, reason)
+			return
+		}
+		if err := a.Server.KillTunnel(r.URL.Query().Get("tunnel"), reason); err != nil {
+			guacErr := asErrGuac(err)
+			http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunnels := a.Server.TunnelsTagged(selector)
+	if tunnels == nil {
+		tunnels = []TunnelSummary{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(tunnels); err != nil {
+		a.Server.log(registryLog, nil).Debug("Failed to write tunnel list: ", err)
+	}
+}
+
+// JournalResponse is the journal of a tunnel as returned by an AdminServer
+type JournalResponse struct {
+	Entries []JournalEntry `json:"entries"`
+	// Dropped counts the older entries no longer kept
+	Dropped int64 `json:"dropped"`
+}
+
+func (a *AdminServer) serveJournal(w http.ResponseWriter, tunnelUUID string) {
+	entries, dropped, err := a.Server.TunnelJournal(tunnelUUID)
+	if err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+	if entries == nil {
+		entries = []JournalEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(JournalResponse{Entries: entries, Dropped: dropped}); err != nil {
+		a.Server.log(registryLog, nil).Debug("Failed to write tunnel journal: ", err)
+	}
+}
+
+func (a *AdminServer) serveLimits(w http.ResponseWriter, tunnelUUID string) {
+	limits, err := a.Server.EffectiveLimits(tunnelUUID)
+	if err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(limits); err != nil {
+		a.Server.log(registryLog, nil).Debug("Failed to write tunnel limits: ", err)
+	}
+}
+
+// KillTaggedResponse is the outcome of killing tunnels by tag through an AdminServer
+type KillTaggedResponse struct {
+	Killed int `json:"killed"`
+}
+
+func (a *AdminServer) killTagged(w http.ResponseWriter, selector Tags, reason string) {
+	killed, err := a.Server.KillTagged(selector, reason)
+	if err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(KillTaggedResponse{Killed: killed}); err != nil {
+		a.Server.log(registryLog, nil).Debug("Failed to write kill response: ", err)
+	}
+}
+
+func (a *AdminServer) serveBackends(w http.ResponseWriter) {
+	if a.Backends == nil {
+		http.Error(w, "No guacd backends.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(a.Backends.Health()); err != nil {
+		a.Server.log(registryLog, nil).Debug("Failed to write backend health: ", err)
+	}
+}
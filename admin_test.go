@@ -0,0 +1,147 @@
+package guac
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAdminServer(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		MetadataFromRequest(r).Set("tenant", "acme")
+		return &uuidTunnel{
+			fakeTunnel: fakeTunnel{writer: &strings.Builder{}},
+			uuid:       uuid.New().String(),
+		}, nil
+	})
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	id := recorder.Body.String()
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/tunnel?write:"+id, strings.NewReader("4.sync,1.1;")))
+
+	admin := &AdminServer{Server: server}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/tunnels", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected a server without an Authorizer to refuse, got", recorder.Code)
+	}
+
+	admin.Authorizer = adminAuthorizer
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/tunnels", nil))
+	var tunnels []struct {
+		UUID     string            `json:"uuid"`
+		Metadata map[string]string `json:"metadata"`
+		Uptime   time.Duration     `json:"uptime"`
+		Stats    struct {
+			BytesIn int64 `json:"bytes_in"`
+		} `json:"stats"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&tunnels); err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].UUID != id || tunnels[0].Metadata["tenant"] != "acme" || tunnels[0].Stats.BytesIn != 11 || tunnels[0].Uptime <= 0 {
+		t.Errorf("Unexpected tunnels %+v", tunnels)
+	}
+
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/tunnels", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected 405, got", recorder.Code)
+	}
+}
+
+func TestServer_KillTunnel(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.registerTunnel(tunnel, nil, nil)
+	var closed int
+	server.OnClose = func(*TunnelInfo) {
+		closed++
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// the read streams until the tunnel is killed
+	response, err := http.Get(httpServer.URL + "/tunnel?read:" + tunnel.GetUUID() + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	admin := &AdminServer{Server: server, Authorizer: adminAuthorizer}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/admin/tunnels?tunnel="+tunnel.GetUUID()+"&reason=Policy+violation", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatal("Expected 204, got", recorder.Code)
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "5.error,16.Policy violation,3.523;0.;" {
+		t.Errorf("Expected the client to be told why, got %q", body)
+	}
+	if server.tunnels.Len() != 0 || closed != 1 {
+		t.Errorf("Expected tunnel to be deregistered once, %v open and %v closed", server.tunnels.Len(), closed)
+	}
+	if err = server.KillTunnel(tunnel.GetUUID(), "again"); err == nil || asErrGuac(err).Status != ResourceNotFound {
+		t.Error("Expected ResourceNotFound killing a closed tunnel, got", err)
+	}
+}
+
+func TestAdminServer_Filters(t *testing.T) {
+	written := &strings.Builder{}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: written}, uuid: uuid.New().String()}, nil
+	})
+	server.LiveFilters = true
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	id := recorder.Body.String()
+
+	clipboard := "9.clipboard,1.0,10.text/plain;4.blob,1.0,4.aGk=;3.end,1.0;"
+	write := func() {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/tunnel?write:"+id, strings.NewReader(clipboard)))
+	}
+	admin := &AdminServer{Server: server, Authorizer: adminAuthorizer}
+	filter := func(method, name string) int {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(method, "/admin/tunnels?tunnel="+id+"&filter="+name, nil))
+		return recorder.Code
+	}
+
+	if code := filter(http.MethodPut, PolicyNoClipboardUpload); code != http.StatusNoContent {
+		t.Fatal("Expected 204, got", code)
+	}
+	if tunnels := server.Tunnels(); len(tunnels[0].Filters) != 1 || tunnels[0].Filters[0] != PolicyNoClipboardUpload {
+		t.Errorf("Expected filter to be listed, got %v", tunnels[0].Filters)
+	}
+	write()
+	if written.Len() != 0 {
+		t.Errorf("Expected clipboard to be dropped, got %q", written.String())
+	}
+
+	if code := filter(http.MethodDelete, PolicyNoClipboardUpload); code != http.StatusNoContent {
+		t.Fatal("Expected 204, got", code)
+	}
+	write()
+	if written.String() != clipboard {
+		t.Errorf("Expected clipboard to pass once the filter was removed, got %q", written.String())
+	}
+
+	if code := filter(http.MethodDelete, PolicyNoClipboardUpload); code != http.StatusNotFound {
+		t.Error("Expected 404 removing a filter which isn't installed, got", code)
+	}
+	if code := filter(http.MethodPut, "no-such-filter"); code != http.StatusBadRequest {
+		t.Error("Expected 400 for an unknown filter, got", code)
+	}
+}
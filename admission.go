@@ -0,0 +1,198 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxUtilization is the fraction of MaxTunnels in use above which an
+	// AdmissionController holds connects back when its MaxUtilization is zero
+	DefaultMaxUtilization = 0.9
+	// DefaultAdmissionQueueTimeout is how long a queued connect waits for capacity when the
+	// QueueTimeout of an AdmissionController is zero
+	DefaultAdmissionQueueTimeout = 10 * time.Second
+)
+
+// admissionPollInterval is how often the connect at the head of the queue checks for capacity
+const admissionPollInterval = 100 * time.Millisecond
+
+// AdmissionController protects the interactivity of the sessions a server is already carrying
+// by holding back connect requests while the server is overloaded, before they dial guacd.
+// A server is overloaded while the fraction of its MaxTunnels in use is above MaxUtilization,
+// or the load average per CPU is above MaxSystemLoad.
+//
+// Connects arriving while overloaded wait in a queue, in order, for the load to drop. A connect
+// is refused with ServerBusy if the queue is full or it waits longer than QueueTimeout, and
+// with ClientTimeout if the client gives up first.
+type AdmissionController struct {
+	// MaxUtilization is the fraction of MaxTunnels which may be in use, DefaultMaxUtilization
+	// if zero. It is ignored for servers without MaxTunnels.
+	MaxUtilization float64
+	// MaxSystemLoad is the load average per CPU above which connects are held back, ignored
+	// if zero
+	MaxSystemLoad float64
+	// SystemLoad returns the load average per CPU, read from /proc/loadavg if nil
+	SystemLoad func() float64
+	// MaxQueue is the number of connects which may wait, none if zero
+	MaxQueue int
+	// QueueTimeout is how long a connect may wait, DefaultAdmissionQueueTimeout if zero
+	QueueTimeout time.Duration
+
+	// turn is held by the connect at the head of the queue
+	turn     chan struct{}
+	turnOnce sync.Once
+
+	admitted, queued, rejected, timedOut atomic.Int64
+	waiting                              atomic.Int32
+}
+
+// AdmissionStats counts the decisions of an AdmissionController
+type AdmissionStats struct {
+	// Admitted counts connects allowed to dial guacd, including after waiting
+	Admitted int64 `json:"admitted"`
+	// Queued counts connects which had to wait
+	Queued int64 `json:"queued"`
+	// Rejected counts connects refused because the queue was full
+	Rejected int64 `json:"rejected"`
+	// TimedOut counts connects which waited too long, or whose client gave up
+	TimedOut int64 `json:"timed_out"`
+	// QueueDepth is the number of connects waiting now
+	QueueDepth int `json:"queue_depth"`
+}
+
+// Stats returns the decisions made so far
+func (a *AdmissionController) Stats() AdmissionStats {
+	return AdmissionStats{
+		Admitted:   a.admitted.Load(),
+		Queued:     a.queued.Load(),
+		Rejected:   a.rejected.Load(),
+		TimedOut:   a.timedOut.Load(),
+		QueueDepth: int(a.waiting.Load()),
+	}
+}
+
+// ServeHTTP responds to GET requests with the AdmissionStats as JSON
+func (a *AdmissionController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(a.Stats()); err != nil {
+		transportLog.Debug("Failed to write admission stats: ", err)
+	}
+}
+
+// overloaded returns why the server is overloaded, or an empty string if it isn't.
+// utilization is the fraction of the server's capacity in use, or zero if it has no limit.
+func (a *AdmissionController) overloaded(utilization float64) string {
+	max := a.MaxUtilization
+	if max <= 0 {
+		max = DefaultMaxUtilization
+	}
+	if utilization > max {
+		return "utilization " + strconv.FormatFloat(utilization, 'f', 2, 64)
+	}
+	if a.MaxSystemLoad > 0 {
+		load := a.SystemLoad
+		if load == nil {
+			load = systemLoad
+		}
+		if l := load(); l > a.MaxSystemLoad {
+			return "system load " + strconv.FormatFloat(l, 'f', 2, 64)
+		}
+	}
+	return ""
+}
+
+// admit returns once a connect may proceed, or an error if it may not, logging to log
+func (a *AdmissionController) admit(ctx context.Context, utilization func() float64, log *subsystemLogger) error {
+	reason := a.overloaded(utilization())
+	if reason == "" {
+		if a.waiting.Load() == 0 {
+			a.admitted.Add(1)
+			return nil
+		}
+		// connects already waiting go first, however much capacity there is now
+		reason = "connects are queued"
+	}
+
+	if int(a.waiting.Add(1)) > a.MaxQueue {
+		a.waiting.Add(-1)
+		a.rejected.Add(1)
+		log.Warnf("Refusing connect request, server is overloaded (%v).", reason)
+		return ErrServerBusy.NewError("Server is overloaded.")
+	}
+	defer a.waiting.Add(-1)
+	a.queued.Add(1)
+	log.Debugf("Queueing connect request, server is overloaded (%v).", reason)
+
+	timeout := a.QueueTimeout
+	if timeout <= 0 {
+		timeout = DefaultAdmissionQueueTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	a.turnOnce.Do(func() {
+		a.turn = make(chan struct{}, 1)
+		a.turn <- struct{}{}
+	})
+	select {
+	case <-a.turn:
+	case <-ctx.Done():
+		return a.abandon(ctx, log)
+	}
+	defer func() {
+		a.turn <- struct{}{}
+	}()
+
+	ticker := time.NewTicker(admissionPollInterval)
+	defer ticker.Stop()
+	for a.overloaded(utilization()) != "" {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return a.abandon(ctx, log)
+		}
+	}
+	a.admitted.Add(1)
+	return nil
+}
+
+func (a *AdmissionController) abandon(ctx context.Context, log *subsystemLogger) error {
+	a.timedOut.Add(1)
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Warn("Refusing connect request, timed out waiting for capacity.")
+		return ErrServerBusy.NewError("Timed out waiting for server capacity.")
+	}
+	return ErrClientTimeout.NewError("Connect request abandoned while queued.")
+}
+
+// systemLoad returns the one minute load average per CPU, or zero if it can't be read
+func systemLoad() float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return load / float64(runtime.NumCPU())
+}
@@ -0,0 +1,140 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdmissionController_Queue(t *testing.T) {
+	var load atomic.Value
+	load.Store(2.0)
+	admission := &AdmissionController{
+		MaxSystemLoad: 1,
+		SystemLoad:    func() float64 { return load.Load().(float64) },
+		MaxQueue:      1,
+	}
+	idle := func() float64 { return 0 }
+
+	done := make(chan error)
+	go func() {
+		done <- admission.admit(context.Background(), idle, transportLog)
+	}()
+	for admission.Stats().QueueDepth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := admission.admit(context.Background(), idle, transportLog); asErrGuac(err).Status != ServerBusy {
+		t.Errorf("Expected connect to be refused with a full queue, got %v", err)
+	}
+
+	load.Store(0.5)
+	if err := <-done; err != nil {
+		t.Errorf("Expected queued connect to be admitted once the load dropped, got %v", err)
+	}
+
+	stats := admission.Stats()
+	if stats.Admitted != 1 || stats.Queued != 1 || stats.Rejected != 1 || stats.QueueDepth != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestAdmissionController_QueueOrder(t *testing.T) {
+	var load atomic.Value
+	load.Store(2.0)
+	admission := &AdmissionController{
+		MaxSystemLoad: 1,
+		SystemLoad:    func() float64 { return load.Load().(float64) },
+		MaxQueue:      2,
+	}
+	idle := func() float64 { return 0 }
+
+	admitted := make(chan string, 2)
+	go func() {
+		if err := admission.admit(context.Background(), idle, transportLog); err == nil {
+			admitted <- "queued"
+		}
+	}()
+	for admission.Stats().QueueDepth != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	load.Store(0.5)
+	if err := admission.admit(context.Background(), idle, transportLog); err == nil {
+		admitted <- "arrived"
+	}
+	if first := <-admitted; first != "queued" {
+		t.Error("Expected the queued connect to be admitted before a later arrival, got", first)
+	}
+}
+
+func TestAdmissionController_Timeout(t *testing.T) {
+	admission := &AdmissionController{MaxQueue: 2, QueueTimeout: 10 * time.Millisecond}
+	full := func() float64 { return 1 }
+
+	if err := admission.admit(context.Background(), full, transportLog); asErrGuac(err).Status != ServerBusy {
+		t.Errorf("Expected queued connect to time out, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := admission.admit(ctx, full, transportLog); asErrGuac(err).Status != ClientTimeout {
+		t.Errorf("Expected abandoned connect to fail with ClientTimeout, got %v", err)
+	}
+
+	if stats := admission.Stats(); stats.TimedOut != 2 || stats.Admitted != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestServer_Admission(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.MaxTunnels = 2
+	server.Admission = &AdmissionController{MaxUtilization: 0.4}
+
+	for i, expected := range []int{http.StatusOK, ServerBusy.GetHTTPStatusCode()} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, connectRequest(""))
+		if recorder.Code != expected {
+			t.Errorf("Connect %v: expected %v, got %v", i, expected, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.Admission.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admission", nil))
+	var stats AdmissionStats
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Admitted != 1 || stats.Rejected != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestWebsocketServer_AdmissionResume(t *testing.T) {
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	wsServer.Admission = &AdmissionController{MaxSystemLoad: 1, SystemLoad: func() float64 { return 2 }}
+	httpServer := httptest.NewServer(wsServer)
+	defer httpServer.Close()
+
+	// without a Resumable there is nothing to resume, so the request is an ordinary connect
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"?resume=token&offset=0", nil)
+	if err == nil {
+		_, _, _ = ws.ReadMessage()
+		_ = ws.Close()
+	}
+	if stats := wsServer.Admission.Stats(); stats.Rejected != 1 || stats.Admitted != 0 {
+		t.Errorf("Expected the connect to go through admission, got %+v", stats)
+	}
+}
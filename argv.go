@@ -0,0 +1,54 @@
+package guac
+
+import (
+	"strings"
+)
+
+// RequiredFunc is given the parameter names guacd asked for in a "required" instruction and
+// returns the values it is able to supply. Names without a value are passed on to the client.
+type RequiredFunc func(names []string) map[string]string
+
+// RequiredFilter is a read Filter which answers guacd's "required" instruction, sent mid-session
+// by protocols such as RDP when credentials are missing or rejected, by sending the values
+// supplied by a RequiredFunc back to guacd as argv streams. This needs protocol version 1.1.0
+// or later, which Stream.Handshake negotiates automatically.
+type RequiredFilter struct {
+	writer StreamWriter
+	supply RequiredFunc
+}
+
+// NewRequiredFilter creates a filter which writes argv streams to the given writer, usually the
+// FilteredTunnel the filter is installed on.
+func NewRequiredFilter(writer StreamWriter, supply RequiredFunc) *RequiredFilter {
+	return &RequiredFilter{
+		writer: writer,
+		supply: supply,
+	}
+}
+
+// Filter answers "required" instructions, forwarding only the names which were not supplied
+func (f *RequiredFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	if instruction.Opcode != OpcodeRequired {
+		return instruction, nil
+	}
+
+	values := f.supply(instruction.Args)
+
+	var missing []string
+	for _, name := range instruction.Args {
+		value, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if err := f.writer.WriteStream("argv", strings.NewReader(value), "text/plain", name); err != nil {
+			return nil, err
+		}
+		filtersLog.Debugf("Supplied required parameter %q to guacd.", name)
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return NewInstruction(OpcodeRequired, missing...), nil
+}
@@ -0,0 +1,46 @@
+package guac
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRequiredFilter(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	filter := NewRequiredFilter(tunnel, func(names []string) map[string]string {
+		return map[string]string{"password": "hunter2"}
+	})
+
+	ins, err := filter.Filter(NewInstruction("required", "username", "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ins == nil || ins.String() != "8.required,8.username;" {
+		t.Errorf("unexpected forwarded instruction %v", ins)
+	}
+
+	want := "4.argv,2.63,10.text/plain,8.password;4.blob,2.63,12.aHVudGVyMg==;3.end,2.63;"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	if tunnel.streams.owns(NewInstruction("ack", "63", "OK", "0")) {
+		t.Error("expected ack after the argv stream ended to be forwarded")
+	}
+	if tunnel.streams.owns(NewInstruction("ack", "1", "OK", "0")) {
+		t.Error("expected client ack to be forwarded")
+	}
+}
+
+func TestCompareProtocolVersions(t *testing.T) {
+	if compareProtocolVersions("VERSION_1_1_0", "VERSION_1_5_0") >= 0 {
+		t.Error("expected 1.1.0 < 1.5.0")
+	}
+	if compareProtocolVersions("VERSION_1_5_0", "VERSION_1_5_0") != 0 {
+		t.Error("expected 1.5.0 == 1.5.0")
+	}
+	if compareProtocolVersions("VERSION_2_0_0", "VERSION_1_5_0") <= 0 {
+		t.Error("expected 2.0.0 > 1.5.0")
+	}
+}
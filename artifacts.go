@@ -0,0 +1,252 @@
+package guac
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Names of the entries of an artifacts archive
+const (
+	ArtifactSessionEntry    = "session.json"
+	ArtifactEventsEntry     = "events.json"
+	ArtifactFilesEntry      = "files.json"
+	ArtifactTranscriptEntry = "transcript.log"
+	ArtifactManifestEntry   = "manifest.json"
+	ArtifactSignatureEntry  = "manifest.sig"
+)
+
+// DefaultMaxTranscript is the number of bytes of transcript SessionArtifacts keeps when its
+// MaxTranscript is zero
+const DefaultMaxTranscript = 64 << 20
+
+// SessionArtifacts collects everything known about a session so it can be exported as a
+// single signed archive, for example for incident response. Its methods may be called while
+// the session runs: AddFileTransfer can be a FileFilter's OnComplete and the artifacts can be
+// the CaptureSink of a Capture, which keeps the transcript in memory up to MaxTranscript.
+type SessionArtifacts struct {
+	UUID         string            `json:"uuid"`
+	ConnectionID string            `json:"connection_id,omitempty"`
+	Identity     *Identity         `json:"identity,omitempty"`
+	Started      time.Time         `json:"started"`
+	Ended        time.Time         `json:"ended,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	// Recording refers to the guacd recording of the session, such as its path or URL
+	Recording string `json:"recording,omitempty"`
+	// MaxTranscript bounds the bytes of transcript kept, DefaultMaxTranscript if zero.
+	// Instructions captured past it are dropped and TranscriptTruncated is set.
+	MaxTranscript int64 `json:"-"`
+	// TranscriptTruncated is set once instructions were dropped from the transcript
+	TranscriptTruncated bool `json:"transcript_truncated,omitempty"`
+
+	lock       sync.Mutex
+	events     []*Event
+	files      []ArtifactFile
+	transcript bytes.Buffer
+}
+
+// ArtifactFile records a file transferred during a session
+type ArtifactFile struct {
+	Direction   string `json:"direction"`
+	Filename    string `json:"filename"`
+	Mimetype    string `json:"mimetype"`
+	Transferred int64  `json:"transferred"`
+	SHA256      string `json:"sha256"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ArtifactManifest lists the SHA-256 of every other entry of an archive, and is what the
+// archive's signature covers
+type ArtifactManifest struct {
+	UUID    string            `json:"uuid"`
+	Created time.Time         `json:"created"`
+	Entries map[string]string `json:"entries"`
+}
+
+// NewSessionArtifacts starts collecting the artifacts of the session with the given UUID
+func NewSessionArtifacts(uuid string) *SessionArtifacts {
+	return &SessionArtifacts{
+		UUID:    uuid,
+		Started: time.Now(),
+	}
+}
+
+// AddEvent records an event which happened during the session
+func (a *SessionArtifacts) AddEvent(event *Event) {
+	a.lock.Lock()
+	a.events = append(a.events, event)
+	a.lock.Unlock()
+}
+
+// AddFileTransfer records a completed or aborted file transfer
+func (a *SessionArtifacts) AddFileTransfer(transfer *FileTransfer, err error) {
+	file := ArtifactFile{
+		Direction:   transfer.Direction.String(),
+		Filename:    transfer.Filename,
+		Mimetype:    transfer.Mimetype,
+		Transferred: transfer.Transferred,
+		SHA256:      transfer.SHA256,
+	}
+	if err != nil {
+		file.Error = err.Error()
+	}
+	a.lock.Lock()
+	a.files = append(a.files, file)
+	a.lock.Unlock()
+}
+
+// Capture appends an instruction to the transcript, in the format of NewCaptureWriter,
+// unless the transcript would grow past MaxTranscript
+func (a *SessionArtifacts) Capture(at time.Time, direction Direction, instruction *Instruction) {
+	line := fmt.Sprintf("%v %v %v\n", at.UTC().Format(time.RFC3339Nano), direction, instruction)
+	max := a.MaxTranscript
+	if max <= 0 {
+		max = DefaultMaxTranscript
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.TranscriptTruncated || int64(a.transcript.Len()+len(line)) > max {
+		a.TranscriptTruncated = true
+		return
+	}
+	a.transcript.WriteString(line)
+}
+
+// ExportArtifacts writes the artifacts as a gzipped tar archive signed with key. Each part is
+// its own entry, followed by a manifest of their hashes and the signature of the manifest,
+// which VerifyArtifacts checks.
+func ExportArtifacts(w io.Writer, artifacts *SessionArtifacts, key ed25519.PrivateKey) error {
+	artifacts.lock.Lock()
+	defer artifacts.lock.Unlock()
+
+	if artifacts.Ended.IsZero() {
+		artifacts.Ended = time.Now()
+	}
+	entries := map[string][]byte{
+		ArtifactTranscriptEntry: artifacts.transcript.Bytes(),
+	}
+	var err error
+	for name, value := range map[string]interface{}{
+		ArtifactSessionEntry: artifacts,
+		ArtifactEventsEntry:  artifacts.events,
+		ArtifactFilesEntry:   artifacts.files,
+	} {
+		if entries[name], err = json.MarshalIndent(value, "", "  "); err != nil {
+			return err
+		}
+	}
+
+	manifest := &ArtifactManifest{
+		UUID:    artifacts.UUID,
+		Created: time.Now().UTC(),
+		Entries: map[string]string{},
+	}
+	names := make([]string, 0, len(entries))
+	for name, data := range entries {
+		sum := sha256.Sum256(data)
+		manifest.Entries[name] = hex.EncodeToString(sum[:])
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	write := func(name string, data []byte) error {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: manifest.Created,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+	for _, name := range names {
+		if err = write(name, entries[name]); err != nil {
+			return err
+		}
+	}
+	if err = write(ArtifactManifestEntry, manifestData); err != nil {
+		return err
+	}
+	if err = write(ArtifactSignatureEntry, ed25519.Sign(key, manifestData)); err != nil {
+		return err
+	}
+	if err = archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// VerifyArtifacts checks an archive written by ExportArtifacts was signed by one of the given
+// keys and has not been altered, returning its manifest.
+func VerifyArtifacts(r io.Reader, keys ...ed25519.PublicKey) (*ArtifactManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifacts archive: %w", err)
+	}
+	archive := tar.NewReader(gz)
+	entries := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifacts archive: %w", err)
+		}
+		if _, ok := entries[header.Name]; ok {
+			return nil, fmt.Errorf("artifacts archive repeats %q", header.Name)
+		}
+		if entries[header.Name], err = io.ReadAll(archive); err != nil {
+			return nil, fmt.Errorf("invalid artifacts archive: %w", err)
+		}
+	}
+
+	manifestData := entries[ArtifactManifestEntry]
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, manifestData, entries[ArtifactSignatureEntry]) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("artifacts archive signature is invalid")
+	}
+
+	manifest := &ArtifactManifest{}
+	if err = json.Unmarshal(manifestData, manifest); err != nil {
+		return nil, fmt.Errorf("invalid artifacts manifest: %w", err)
+	}
+	for name, data := range entries {
+		if name == ArtifactManifestEntry || name == ArtifactSignatureEntry {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if manifest.Entries[name] != hex.EncodeToString(sum[:]) {
+			return nil, fmt.Errorf("artifacts archive entry %q does not match its manifest", name)
+		}
+	}
+	if len(entries) != len(manifest.Entries)+2 {
+		return nil, errors.New("artifacts archive is missing entries listed in its manifest")
+	}
+	return manifest, nil
+}
@@ -0,0 +1,110 @@
+package guac
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportArtifacts(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifacts := NewSessionArtifacts("1")
+	artifacts.Identity = &Identity{Subject: "alice"}
+	artifacts.Recording = "/recordings/1"
+	artifacts.AddEvent(&Event{Type: EventConnect, UUID: "1"})
+	artifacts.AddFileTransfer(&FileTransfer{Direction: FromClient, Filename: "a.txt", SHA256: "abc"}, nil)
+	artifacts.AddFileTransfer(&FileTransfer{Direction: FromGuacd, Filename: "b.txt"}, errors.New("aborted"))
+	artifacts.Capture(time.Now(), FromGuacd, NewSyncInstruction(1))
+
+	archive := &bytes.Buffer{}
+	if err = ExportArtifacts(archive, artifacts, private); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := VerifyArtifacts(bytes.NewReader(archive.Bytes()), public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.UUID != "1" || len(manifest.Entries) != 4 {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+
+	entries := readArchive(t, archive.Bytes())
+	if !strings.Contains(string(entries[ArtifactFilesEntry]), `"error": "aborted"`) {
+		t.Errorf("Expected aborted transfer to be recorded, got %s", entries[ArtifactFilesEntry])
+	}
+	if !strings.Contains(string(entries[ArtifactSessionEntry]), `"recording": "/recordings/1"`) {
+		t.Errorf("Expected recording reference, got %s", entries[ArtifactSessionEntry])
+	}
+	if !strings.HasSuffix(string(entries[ArtifactTranscriptEntry]), " guacd 4.sync,1.1;\n") {
+		t.Errorf("Unexpected transcript %q", entries[ArtifactTranscriptEntry])
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err = VerifyArtifacts(bytes.NewReader(archive.Bytes()), other); err == nil {
+		t.Error("Expected archive signed with another key to be refused")
+	}
+
+	entries[ArtifactTranscriptEntry] = []byte("nothing happened\n")
+	if _, err = VerifyArtifacts(bytes.NewReader(writeArchive(t, entries)), public); err == nil {
+		t.Error("Expected altered archive to be refused")
+	}
+}
+
+func TestSessionArtifacts_MaxTranscript(t *testing.T) {
+	artifacts := NewSessionArtifacts("1")
+	artifacts.MaxTranscript = 100
+	for i := 0; i < 10; i++ {
+		artifacts.Capture(time.Now(), FromGuacd, NewSyncInstruction(int64(i)))
+	}
+	if size := artifacts.transcript.Len(); size == 0 || size > 100 {
+		t.Errorf("Expected transcript to be bounded, got %v bytes", size)
+	}
+	if !artifacts.TranscriptTruncated {
+		t.Error("Expected transcript to be marked truncated")
+	}
+}
+
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(gz)
+	entries := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name], _ = io.ReadAll(archive)
+	}
+}
+
+func writeArchive(t *testing.T, entries map[string][]byte) []byte {
+	out := &bytes.Buffer{}
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+	for name, data := range entries {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = archive.Write(data)
+	}
+	_ = archive.Close()
+	_ = gz.Close()
+	return out.Bytes()
+}
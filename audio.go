@@ -0,0 +1,98 @@
+package guac
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// AudioHandler consumes an audio stream sent by guacd. It runs in its own goroutine and must
+// read data until EOF or an error, since the tunnel blocks while the stream is not being read.
+type AudioHandler func(mimetype string, data io.Reader)
+
+// AudioFilter is a read Filter giving server-side code access to the audio streams of a
+// session. Each stream is passed to the handler, if any, and may also be muted, in which case
+// the client receives the stream but none of its data.
+type AudioFilter struct {
+	handler AudioHandler
+	muted   atomic.Bool
+
+	sync.Mutex
+	// streams holds the indices of the open audio streams
+	streams map[string]bool
+	taps    streamTaps
+}
+
+// NewAudioFilter creates a filter passing audio streams to handler, which may be nil
+func NewAudioFilter(handler AudioHandler) *AudioFilter {
+	return &AudioFilter{
+		handler: handler,
+		streams: map[string]bool{},
+	}
+}
+
+// SetMuted stops or resumes audio data reaching the client. It takes effect immediately,
+// including for streams which are already open.
+func (f *AudioFilter) SetMuted(muted bool) {
+	f.muted.Store(muted)
+}
+
+// Muted returns true if audio is not reaching the client
+func (f *AudioFilter) Muted() bool {
+	return f.muted.Load()
+}
+
+// Filter taps and mutes audio streams
+func (f *AudioFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	args := instruction.Args
+	if len(args) == 0 {
+		return instruction, nil
+	}
+
+	switch instruction.Opcode {
+	case OpcodeAudio:
+		if len(args) < 2 {
+			break
+		}
+		f.Lock()
+		f.streams[args[0]] = true
+		f.Unlock()
+
+		if f.handler != nil {
+			mimetype := args[1]
+			f.taps.open(args[0], func(data io.Reader) {
+				f.handler(mimetype, data)
+			})
+		}
+
+	case OpcodeBlob:
+		if !f.isAudio(args[0]) {
+			break
+		}
+		if len(args) >= 2 {
+			if _, err := f.taps.write(args[0], args[1]); err != nil {
+				filtersLog.Debugf("Audio handler for stream %v failed: %v", args[0], err)
+			}
+		}
+		if f.Muted() {
+			return nil, nil
+		}
+
+	case OpcodeEnd:
+		if !f.isAudio(args[0]) {
+			break
+		}
+		f.Lock()
+		delete(f.streams, args[0])
+		f.Unlock()
+		f.taps.close(args[0])
+	}
+
+	return instruction, nil
+}
+
+func (f *AudioFilter) isAudio(index string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.streams[index]
+}
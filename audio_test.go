@@ -0,0 +1,42 @@
+package guac
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestAudioFilter(t *testing.T) {
+	received := make(chan string)
+	filter := NewAudioFilter(func(mimetype string, data io.Reader) {
+		b, _ := io.ReadAll(data)
+		received <- mimetype + ":" + string(b)
+	})
+
+	filter.SetMuted(true)
+	for _, ins := range []*Instruction{
+		NewInstruction("audio", "1", "audio/L16;rate=44100,channels=2"),
+		NewInstruction("blob", "1", "aGk="),
+		NewInstruction("blob", "2", "aGk="),
+		NewInstruction("end", "1"),
+	} {
+		forwarded, err := filter.Filter(ins)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only the audio data is muted
+		if muted := ins.Opcode == "blob" && ins.Args[0] == "1"; muted != (forwarded == nil) {
+			t.Errorf("%v: unexpected result %v", ins, forwarded)
+		}
+	}
+
+	select {
+	case got := <-received:
+		if got != "audio/L16;rate=44100,channels=2:hi" {
+			t.Errorf("unexpected audio %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not receive audio")
+	}
+}
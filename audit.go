@@ -0,0 +1,306 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of audit events
+const (
+	// AuditConnect is emitted once a tunnel has connected
+	AuditConnect = "connect"
+	// AuditConnectFailed is emitted when a connect request fails
+	AuditConnectFailed = "connect_failed"
+	// AuditDisconnect is emitted once a tunnel has closed
+	AuditDisconnect = "disconnect"
+	// AuditFileTransfer is emitted by a FileFilter when a file transfer ends
+	AuditFileTransfer = "file_transfer"
+)
+
+// AuditEvent records a step of the lifecycle of a session for compliance. Its JSON encoding
+// is described by the "audit" schema of EventSchemas, and is only ever extended within a
+// schema version.
+type AuditEvent struct {
+	// SchemaVersion is the EventSchemaVersion the event conforms to
+	SchemaVersion int       `json:"schema_version"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	// Transport is "http" or "websocket"
+	Transport string `json:"transport"`
+	// UUID is the UUID of the tunnel, empty if connecting failed
+	UUID         string `json:"uuid,omitempty"`
+	ConnectionID string `json:"connection_id,omitempty"`
+	// Identity is the authenticated user, nil without an Authorizer
+	Identity   *Identity `json:"identity,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	// Protocol, TargetHost and TargetPort describe the remote desktop connected to, as the
+	// connect callback configured it
+	Protocol   string `json:"protocol,omitempty"`
+	TargetHost string `json:"target_host,omitempty"`
+	TargetPort string `json:"target_port,omitempty"`
+	// Status is the Guacamole status code of a failed connect
+	Status int `json:"status,omitempty"`
+	// Reason is why connecting failed or the tunnel closed
+	Reason string `json:"reason,omitempty"`
+	// Duration is how long the tunnel was open, in seconds
+	Duration float64 `json:"duration,omitempty"`
+	// BytesIn and BytesOut count the bytes from and to the client
+	BytesIn  int64 `json:"bytes_in,omitempty"`
+	BytesOut int64 `json:"bytes_out,omitempty"`
+	// File is the file transfer of an AuditFileTransfer event, whose Reason is why it was
+	// aborted, if it was
+	File *FileTransfer `json:"file,omitempty"`
+}
+
+// AuditSink receives audit events. It is called synchronously, so it should hand events off
+// rather than block. Errors are logged.
+type AuditSink interface {
+	Audit(event *AuditEvent) error
+}
+
+// AuditSinkFunc adapts an ordinary function to the AuditSink interface
+type AuditSinkFunc func(event *AuditEvent) error
+
+// Audit calls f(event)
+func (f AuditSinkFunc) Audit(event *AuditEvent) error {
+	return f(event)
+}
+
+// JSONAuditSink writes each audit event to a writer as a line of JSON, as expected by most log
+// shippers. It is safe for concurrent use.
+type JSONAuditSink struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONAuditSink creates a sink writing to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{encoder: json.NewEncoder(w)}
+}
+
+// Audit writes the event
+func (s *JSONAuditSink) Audit(event *AuditEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(event)
+}
+
+// emitAudit stamps the event and hands it to sink
+func emitAudit(sink AuditSink, event *AuditEvent) {
+	event.SchemaVersion = EventSchemaVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := sink.Audit(event); err != nil {
+		registryLog.Errorf("Unable to record %v audit event of tunnel %v: %v", event.Type, event.UUID, err)
+	}
+}
+
+// auditRecord gathers what the audit events of a tunnel report while it connects
+type auditRecord struct {
+	sync.Mutex
+	transport, remoteAddr string
+	identity              *Identity
+	protocol, host, port  string
+	connected             time.Time
+	// sink receives the disconnect of a tunnel registered with a Server whose Audit isn't the
+	// sink of the connect request, as with websockets registering tunnels with a Resumable
+	// server, if not nil
+	sink AuditSink
+	// bytesIn and bytesOut count the bytes of the tunnel, if counting
+	bytesIn, bytesOut atomic.Int64
+	counting          bool
+}
+
+// newAuditRecord creates the audit record of a connect request
+func newAuditRecord(r *http.Request, transport string, identity *Identity) *auditRecord {
+	return &auditRecord{transport: transport, remoteAddr: clientAddress(r), identity: identity}
+}
+
+type auditRecordKey struct{}
+
+// counted wraps tunnel to count its bytes into the record
+func (r *auditRecord) counted(tunnel Tunnel) Tunnel {
+	r.counting = true
+	return newCountingTunnel(tunnel, func(n int64) {
+		r.bytesIn.Add(n)
+	}, func(n int64) {
+		r.bytesOut.Add(n)
+	})
+}
+
+// withAuditRecord returns a copy of the connect request carrying a new audit record
+func withAuditRecord(r *http.Request, transport string, identity *Identity) (*http.Request, *auditRecord) {
+	record := newAuditRecord(r, transport, identity)
+	return r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, record)), record
+}
+
+// RecordAuditTarget records the protocol and target host of config as those of the tunnel
+// the connect request of ctx creates, for the audit log. Backend.Connect calls it, so only
+// connect callbacks reaching guacd some other way need to.
+func RecordAuditTarget(ctx context.Context, config *Config) {
+	record, ok := ctx.Value(auditRecordKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	record.Lock()
+	defer record.Unlock()
+	record.protocol = config.Protocol
+	record.host = config.Parameters["hostname"]
+	record.port = config.Parameters["port"]
+}
+
+// event returns an event of the given type filled in from the record
+func (r *auditRecord) event(eventType string, tunnel Tunnel) *AuditEvent {
+	r.Lock()
+	defer r.Unlock()
+	event := &AuditEvent{
+		Type:       eventType,
+		Transport:  r.transport,
+		Identity:   r.identity,
+		RemoteAddr: r.remoteAddr,
+		Protocol:   r.protocol,
+		TargetHost: r.host,
+		TargetPort: r.port,
+	}
+	if tunnel != nil {
+		event.UUID = tunnel.GetUUID()
+		event.ConnectionID = tunnel.ConnectionID()
+	}
+	return event
+}
+
+// failed returns the AuditConnectFailed event of the record
+func (r *auditRecord) failed(err error) *AuditEvent {
+	event := r.event(AuditConnectFailed, nil)
+	event.Status = asErrGuac(err).Status.GetGuacamoleStatusCode()
+	event.Reason = err.Error()
+	return event
+}
+
+// disconnected returns the AuditDisconnect event of the record for tunnel, which closed
+// because of cause, if known
+func (r *auditRecord) disconnected(tunnel Tunnel, cause error, killed *Instruction, bytesIn, bytesOut int64) *AuditEvent {
+	event := r.event(AuditDisconnect, tunnel)
+	event.Duration = time.Since(r.connected).Seconds()
+	event.BytesIn, event.BytesOut = bytesIn, bytesOut
+	switch {
+	case killed != nil && len(killed.Args) > 0:
+		event.Reason = "killed: " + killed.Args[0]
+	case cause == nil:
+		event.Reason = "closed"
+	case CloseReasonOf(cause) == CloseEOF:
+		event.Reason = "ended"
+	default:
+		event.Reason = cause.Error()
+		if reason := CloseReasonOf(cause); reason != CloseUnknown {
+			event.Reason = "guacd " + reason.String() + ": " + event.Reason
+		}
+	}
+	return event
+}
+
+// registeredDisconnected returns the AuditDisconnect event of the record for a tunnel
+// registered with a Server, which was closed because of cause, if known
+func (r *auditRecord) registeredDisconnected(tunnel *LastAccessedTunnel, cause error) *AuditEvent {
+	bytesIn, bytesOut := r.bytesIn.Load(), r.bytesOut.Load()
+	if !r.counting {
+		stats := tunnel.Stats()
+		bytesIn, bytesOut = stats.BytesIn, stats.BytesOut
+	}
+	return r.disconnected(tunnel, cause, tunnel.killedWith(), bytesIn, bytesOut)
+}
+
+// countingTunnel reports the bytes passing through the tunnel it wraps
+type countingTunnel struct {
+	*DelegatingTunnel
+}
+
+// newCountingTunnel wraps tunnel, calling in with the bytes written to it and out with those
+// read from it
+func newCountingTunnel(tunnel Tunnel, in, out func(n int64)) *countingTunnel {
+	t := &countingTunnel{DelegatingTunnel: NewDelegatingTunnel(tunnel)}
+	t.WrapReader = func(reader InstructionReader) InstructionReader {
+		return &byteCountingReader{InstructionReader: reader, count: out}
+	}
+	t.WrapWriter = func(writer io.Writer) io.Writer {
+		return byteCountingWriter{writer: writer, count: in}
+	}
+	return t
+}
+
+type byteCountingReader struct {
+	InstructionReader
+	count func(n int64)
+}
+
+func (r *byteCountingReader) ReadSome() ([]byte, error) {
+	data, err := r.InstructionReader.ReadSome()
+	r.count(int64(len(data)))
+	return data, err
+}
+
+type byteCountingWriter struct {
+	writer io.Writer
+	count  func(n int64)
+}
+
+func (w byteCountingWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	w.count(int64(n))
+	return n, err
+}
+
+// auditSchemaV1 describes AuditEvent
+const auditSchemaV1 = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "https://github.com/wwt/guac/schemas/audit/v1.json",
+  "title": "Session audit event",
+  "type": "object",
+  "required": ["schema_version", "type", "time", "transport"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "type": {"type": "string", "description": "connect, connect_failed, disconnect, address_rejected, file_transfer, or a type added later"},
+    "time": {"type": "string", "format": "date-time"},
+    "transport": {"type": "string", "description": "http or websocket"},
+    "uuid": {"type": "string", "description": "UUID of the tunnel"},
+    "connection_id": {"type": "string", "description": "ID guacd gave the connection"},
+    "identity": {
+      "type": "object",
+      "description": "the authenticated user",
+      "properties": {
+        "subject": {"type": "string"},
+        "display_name": {"type": "string"},
+        "groups": {"type": "array", "items": {"type": "string"}},
+        "expiry": {"type": "string", "format": "date-time"}
+      }
+    },
+    "remote_addr": {"type": "string", "description": "address of the client"},
+    "protocol": {"type": "string"},
+    "target_host": {"type": "string"},
+    "target_port": {"type": "string"},
+    "status": {"type": "integer", "description": "Guacamole status code of a failed connect"},
+    "reason": {"type": "string", "description": "why connecting failed or the tunnel closed"},
+    "duration": {"type": "number", "description": "seconds the tunnel was open"},
+    "bytes_in": {"type": "integer", "description": "bytes from the client"},
+    "bytes_out": {"type": "integer", "description": "bytes to the client"},
+    "file": {
+      "type": "object",
+      "description": "the file transfer of a file_transfer event",
+      "properties": {
+        "direction": {"type": "string", "description": "client for uploads, guacd for downloads"},
+        "stream": {"type": "string"},
+        "mimetype": {"type": "string"},
+        "filename": {"type": "string"},
+        "transferred": {"type": "integer", "description": "bytes transferred"},
+        "sha256": {"type": "string", "description": "hex encoded SHA-256 of a completed transfer"}
+      }
+    }
+  },
+  "additionalProperties": true
+}`
@@ -0,0 +1,112 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJSONAuditSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONAuditSink(&out)
+	emitAudit(sink, &AuditEvent{Type: AuditConnect, Transport: "http", UUID: "1"})
+	emitAudit(sink, &AuditEvent{Type: AuditDisconnect, Transport: "http", UUID: "1", Reason: "ended"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected a line per event, got", out.String())
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["schema_version"] != float64(EventSchemaVersion) || event["reason"] != "ended" || event["time"] == nil {
+		t.Error("Unexpected event", lines[1])
+	}
+}
+
+func TestServer_Audit(t *testing.T) {
+	var lock sync.Mutex
+	var events []*AuditEvent
+	backend := &Backend{Dialer: &farmDialer{}}
+	fail := false
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		if fail {
+			return nil, ErrUpstreamUnavailable.NewError("down")
+		}
+		config := NewGuacamoleConfiguration()
+		config.Protocol = "rdp"
+		config.Parameters = map[string]string{"hostname": "desktop-1", "port": "3389"}
+		stream, err := backend.Connect(r.Context(), config)
+		if err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	})
+	server.Authorizer = AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+		return &Identity{Subject: "alice"}, nil
+	})
+	server.Audit = AuditSinkFunc(func(event *AuditEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+		return nil
+	})
+
+	connect := func() string {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/?connect", bytes.NewReader(nil)))
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+	uuid := connect()
+	fail = true
+	connect()
+	if err := server.KillTunnel(uuid, "Session ended by an administrator."); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 3 {
+		t.Fatal("Expected three events, got", len(events))
+	}
+	connected, failed, disconnected := events[0], events[1], events[2]
+	if connected.Type != AuditConnect || connected.UUID != uuid || connected.Identity == nil || connected.Identity.Subject != "alice" ||
+		connected.Protocol != "rdp" || connected.TargetHost != "desktop-1" || connected.TargetPort != "3389" || connected.RemoteAddr == "" {
+		t.Errorf("Unexpected connect event %+v", connected)
+	}
+	if failed.Type != AuditConnectFailed || failed.Status != 516 || failed.UUID != "" || !strings.Contains(failed.Reason, "down") {
+		t.Errorf("Unexpected connect_failed event %+v", failed)
+	}
+	if disconnected.Type != AuditDisconnect || disconnected.UUID != uuid || disconnected.TargetHost != "desktop-1" ||
+		disconnected.Reason != "killed: Session ended by an administrator." {
+		t.Errorf("Unexpected disconnect event %+v", disconnected)
+	}
+}
+
+func TestAuditSchema_CoversAuditEvent(t *testing.T) {
+	schema, ok := LookupEventSchema("audit", EventSchemaVersion)
+	if !ok {
+		t.Fatal("Expected an audit schema for the current version")
+	}
+	var document struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(schema.Schema, &document); err != nil {
+		t.Fatal(err)
+	}
+	eventType := reflect.TypeOf(AuditEvent{})
+	for i := 0; i < eventType.NumField(); i++ {
+		name := strings.Split(eventType.Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := document.Properties[name]; !ok {
+			t.Errorf("Field %q of AuditEvent is missing from the schema", name)
+		}
+	}
+}
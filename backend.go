@@ -0,0 +1,176 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ContextDialer opens network connections. *net.Dialer, *Dialer and *SSHJumpDialer all
+// satisfy it.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Backend is a guacd instance and the means of reaching it
+type Backend struct {
+	// Address is the host:port guacd listens on, as seen from the end of Dialer
+	Address string
+	// Dialer connects to Address, a default Dialer if nil
+	Dialer ContextDialer
+
+	// Retries is the number of times a failed dial or handshake is retried
+	Retries int
+	// RetryBackoff is the delay before the first retry, DefaultRetryBackoff if zero
+	RetryBackoff time.Duration
+	// Budget limits retries, DefaultRetryBudget if nil
+	Budget *RetryBudget
+
+	// ReadTimeout bounds how long reading from guacd may wait for data, after which the
+	// tunnel fails rather than hanging on a stalled guacd, SocketTimeout if zero. guacd sends
+	// sync instructions continually, so a healthy connection is never idle for long.
+	// Negative disables the deadline.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long writing to guacd may wait for it to accept the data,
+	// SocketTimeout if zero. Negative disables the deadline.
+	WriteTimeout time.Duration
+
+	// Secrets optionally resolves the connection parameters referring to secrets, made with
+	// SecretRef, during the handshake
+	Secrets SecretsProvider
+	// Targets optionally limits the hosts connections may reach, checked before guacd is
+	// dialed
+	Targets *TargetPolicy
+	// Metrics optionally counts failed attempts to dial guacd, and the outcome of the health
+	// checks of a BackendSet the backend is in
+	Metrics Metrics
+	// Schemas optionally validates the parameters of connections against the schema of their
+	// protocol before guacd is dialed, as with DefaultParameterSchemas
+	Schemas ParameterSchemas
+}
+
+// Dial connects to the backend's guacd
+func (b *Backend) Dial(ctx context.Context) (conn net.Conn, err error) {
+	err = retry(ctx, b.Budget, b.Retries, b.RetryBackoff, isTransient, func() (e error) {
+		conn, e = b.dial(ctx)
+		return
+	})
+	return
+}
+
+// Connect connects to the backend's guacd and performs the handshake, retrying both together
+// if guacd cannot be reached or drops the connection during the handshake
+//
+// Connecting is traced as part of the span ctx carries, if any.
+func (b *Backend) Connect(ctx context.Context, config *Config) (stream *Stream, err error) {
+	RecordAuditTarget(ctx, config)
+	recordSensitive(ctx, sensitiveValues(config))
+	ctx, span := tracer(ctx, nil).Start(ctx, "guac.guacd.connect", trace.WithAttributes(
+		AttributeGuacdAddress.String(b.Address), AttributeProtocol.String(config.Protocol)))
+	defer func() {
+		if stream != nil {
+			span.SetAttributes(AttributeConnectionID.String(stream.ConnectionID))
+		}
+		endSpan(span, err)
+	}()
+	if err = b.check(ctx, config); err != nil {
+		return nil, err
+	}
+	checked := b.checkComputed(config)
+	err = retry(ctx, b.Budget, b.Retries, b.RetryBackoff, isTransient, func() error {
+		conn, e := b.dial(ctx)
+		if e != nil {
+			return e
+		}
+		stream = NewStream(conn, SocketTimeout)
+		stream.SetTimeouts(socketTimeout(b.ReadTimeout), socketTimeout(b.WriteTimeout))
+		if e = stream.HandshakeContext(ctx, checked, b.Secrets); e != nil {
+			_ = stream.Close()
+			stream = nil
+			return e
+		}
+		return nil
+	})
+	// guacd and connect callbacks may echo parameters back in their errors
+	err = redactError(err, config)
+	return
+}
+
+// check validates the parameters of config with Schemas and checks its targets with Targets
+func (b *Backend) check(ctx context.Context, config *Config) error {
+	if b.Schemas != nil {
+		if err := b.Schemas.Validate(config); err != nil {
+			return err
+		}
+	}
+	if b.Targets != nil {
+		if err := b.Targets.Check(ctx, config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkComputed returns config with its ParameterFunc, if any, checking the parameters with
+// the values it computes during the handshake, as the parameters of config are checked before
+// guacd is dialed. Otherwise computed values could reach hosts or take values the backend
+// refuses.
+func (b *Backend) checkComputed(config *Config) *Config {
+	compute := config.ParameterFunc
+	if compute == nil || (b.Schemas == nil && b.Targets == nil) {
+		return config
+	}
+	checked := *config
+	checked.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+		values, err := compute(ctx, args)
+		if err != nil || len(values) == 0 {
+			return values, err
+		}
+		final := *config
+		final.Parameters = make(map[string]string, len(config.Parameters)+len(values))
+		for name, value := range config.Parameters {
+			final.Parameters[name] = value
+		}
+		// as in the handshake, values of arguments guacd didn't request are ignored
+		for _, arg := range args {
+			if value, ok := values[arg]; ok {
+				final.Parameters[arg] = value
+			}
+		}
+		if err = b.check(ctx, &final); err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	return &checked
+}
+
+// socketTimeout returns the timeout of a socket operation given the option, SocketTimeout if
+// zero
+func socketTimeout(option time.Duration) time.Duration {
+	if option == 0 {
+		return SocketTimeout
+	}
+	return option
+}
+
+func (b *Backend) dial(ctx context.Context) (net.Conn, error) {
+	dialer := b.Dialer
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	ctx, span := tracer(ctx, nil).Start(ctx, "guac.guacd.dial", trace.WithAttributes(AttributeGuacdAddress.String(b.Address)))
+	conn, err := dialer.DialContext(ctx, "tcp", b.Address)
+	if err != nil && b.Metrics != nil {
+		b.Metrics.DialFailed(b.Address)
+	}
+	endSpan(span, err)
+	return conn, err
+}
+
+// String returns the address of the backend
+func (b *Backend) String() string {
+	return b.Address
+}
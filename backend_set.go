@@ -0,0 +1,256 @@
+package guac
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// BackendLoad is a backend of a BackendSet along with the number of sessions it carries
+type BackendLoad struct {
+	Backend *Backend
+	// Sessions counts the tunnels opened through the set which are still open
+	Sessions int
+}
+
+// BackendStrategy decides which backend of a BackendSet carries a new session
+type BackendStrategy interface {
+	// Order returns the backends to try for a session with the given configuration, best
+	// first. Backends left out are not tried.
+	Order(backends []BackendLoad, config *Config) []*Backend
+}
+
+// RoundRobin hands sessions to each backend in turn
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+// Order starts with the backend after the one which started the last order
+func (r *RoundRobin) Order(backends []BackendLoad, _ *Config) []*Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	start := int((r.next.Add(1) - 1) % uint64(len(backends)))
+	ordered := make([]*Backend, 0, len(backends))
+	for i := range backends {
+		ordered = append(ordered, backends[(start+i)%len(backends)].Backend)
+	}
+	return ordered
+}
+
+// LeastConnections hands sessions to the backend carrying the fewest, in the order of the set
+// between backends carrying as many
+type LeastConnections struct{}
+
+// Order orders the backends by the number of sessions they carry
+func (LeastConnections) Order(backends []BackendLoad, _ *Config) []*Backend {
+	sorted := append([]BackendLoad(nil), backends...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Sessions < sorted[j].Sessions
+	})
+	ordered := make([]*Backend, 0, len(sorted))
+	for _, load := range sorted {
+		ordered = append(ordered, load.Backend)
+	}
+	return ordered
+}
+
+// ConsistentHash hands sessions with the same key to the same backend, moving only the keys
+// of a backend which is added or removed, using rendezvous hashing. Sessions without a key are
+// handed out by LeastConnections.
+type ConsistentHash struct {
+	// Key returns the key of a session, by default the ID of the connection it joins or, for
+	// new connections, the "hostname" parameter, so sessions of one remote desktop meet on
+	// one guacd
+	Key func(config *Config) string
+}
+
+// Order orders the backends by the hash of each with the key of the session
+func (h *ConsistentHash) Order(backends []BackendLoad, config *Config) []*Backend {
+	key := h.key(config)
+	if key == "" {
+		return LeastConnections{}.Order(backends, config)
+	}
+	weights := make(map[*Backend]uint64, len(backends))
+	ordered := make([]*Backend, 0, len(backends))
+	for _, load := range backends {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key))
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(load.Backend.Address))
+		weights[load.Backend] = hash.Sum64()
+		ordered = append(ordered, load.Backend)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return weights[ordered[i]] > weights[ordered[j]]
+	})
+	return ordered
+}
+
+func (h *ConsistentHash) key(config *Config) string {
+	if h.Key != nil {
+		return h.Key(config)
+	}
+	if config.ConnectionID != "" {
+		return config.ConnectionID
+	}
+	return config.Parameters["hostname"]
+}
+
+// BackendSet spreads sessions across a farm of guacd instances. Each session is connected to
+// the first backend its Strategy picks which can be reached, moving on to the next if one
+// cannot. Joins of a connection opened through the set always go to the backend carrying it,
+// as no other guacd knows the connection.
+//
+//	backends := &guac.BackendSet{
+//		Backends: []*guac.Backend{{Address: "guacd-1:4822"}, {Address: "guacd-2:4822"}},
+//		Strategy: guac.LeastConnections{},
+//	}
+//	tunnel, err := backends.Connect(r.Context(), config)
+type BackendSet struct {
+	// Backends are the guacd instances sessions are spread across
+	Backends []*Backend
+	// Strategy picks the backend of each session, a RoundRobin if nil
+	Strategy BackendStrategy
+	// HealthCheck optionally probes the backends, leaving those which fail out of rotation.
+	// If every backend fails, all are tried. Checks start as the set is first used.
+	HealthCheck *HealthCheck
+
+	sync.Mutex
+	sessions map[*Backend]int
+	// connections routes the IDs of the connections with sessions open through the set
+	connections map[string]*connectionRoute
+	// health holds the outcome of the health checks of each backend
+	health     map[*Backend]*BackendHealth
+	roundRobin RoundRobin
+}
+
+// connectionRoute is the backend carrying a connection, and the number of its sessions open
+// through the set
+type connectionRoute struct {
+	backend  *Backend
+	sessions int
+}
+
+// Loads returns each backend with the number of sessions it carries
+func (s *BackendSet) Loads() []BackendLoad {
+	s.Lock()
+	defer s.Unlock()
+	loads := make([]BackendLoad, 0, len(s.Backends))
+	for _, backend := range s.Backends {
+		loads = append(loads, BackendLoad{Backend: backend, Sessions: s.sessions[backend]})
+	}
+	return loads
+}
+
+// rotation returns the loads of the backends in rotation, all of them if none are
+func (s *BackendSet) rotation() []BackendLoad {
+	loads := s.Loads()
+	s.Lock()
+	defer s.Unlock()
+	var healthy []BackendLoad
+	for _, load := range loads {
+		if s.healthy(load.Backend) {
+			healthy = append(healthy, load)
+		}
+	}
+	if len(healthy) == 0 {
+		return loads
+	}
+	return healthy
+}
+
+// order returns the backends to try for a session with the given configuration
+func (s *BackendSet) order(config *Config) []*Backend {
+	if config.ConnectionID != "" {
+		s.Lock()
+		route, ok := s.connections[config.ConnectionID]
+		s.Unlock()
+		if ok {
+			return []*Backend{route.backend}
+		}
+	}
+	strategy := s.Strategy
+	if strategy == nil {
+		strategy = &s.roundRobin
+	}
+	return strategy.Order(s.rotation(), config)
+}
+
+// Connect connects to a backend and performs the handshake with config, returning a tunnel
+// which counts towards the sessions of the backend until it is closed
+func (s *BackendSet) Connect(ctx context.Context, config *Config) (Tunnel, error) {
+	if s.HealthCheck != nil {
+		s.HealthCheck.start(s)
+	}
+	backends := s.order(config)
+	if len(backends) == 0 {
+		return nil, ErrUpstreamUnavailable.NewError("No guacd backends.")
+	}
+	var err error
+	for _, backend := range backends {
+		var stream *Stream
+		if stream, err = backend.Connect(ctx, config); err == nil {
+			return s.track(backend, NewSimpleTunnel(stream)), nil
+		}
+		if !isTransient(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		transportLog.Warnf("Unable to connect to guacd at %v, trying the next backend: %v", backend, err)
+	}
+	return nil, err
+}
+
+// track counts the tunnel towards the sessions of backend until it is closed
+func (s *BackendSet) track(backend *Backend, tunnel Tunnel) Tunnel {
+	id := tunnel.ConnectionID()
+	s.Lock()
+	if s.sessions == nil {
+		s.sessions = map[*Backend]int{}
+		s.connections = map[string]*connectionRoute{}
+	}
+	s.sessions[backend]++
+	if id != "" {
+		route, ok := s.connections[id]
+		if !ok {
+			route = &connectionRoute{backend: backend}
+			s.connections[id] = route
+		}
+		route.sessions++
+	}
+	s.Unlock()
+	return &backendTunnel{DelegatingTunnel: NewDelegatingTunnel(tunnel), set: s, backend: backend}
+}
+
+// release stops counting a closed tunnel
+func (s *BackendSet) release(backend *Backend, connectionID string) {
+	s.Lock()
+	s.sessions[backend]--
+	if s.sessions[backend] <= 0 {
+		delete(s.sessions, backend)
+	}
+	if route, ok := s.connections[connectionID]; ok {
+		if route.sessions--; route.sessions <= 0 {
+			delete(s.connections, connectionID)
+		}
+	}
+	s.Unlock()
+}
+
+// backendTunnel is a tunnel connected through a BackendSet
+type backendTunnel struct {
+	*DelegatingTunnel
+	set     *BackendSet
+	backend *Backend
+	closed  sync.Once
+}
+
+// Close closes the tunnel and releases its place on the backend
+func (t *backendTunnel) Close() error {
+	t.closed.Do(func() {
+		t.set.release(t.backend, t.ConnectionID())
+	})
+	return t.DelegatingTunnel.Close()
+}
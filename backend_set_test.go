@@ -0,0 +1,132 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// farmDialer connects to fake guacd instances, each giving its connections the ID of its address,
+// except those which are down
+type farmDialer struct {
+	sync.Mutex
+	down  map[string]bool
+	dials []string
+}
+
+func (d *farmDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.dials = append(d.dials, address)
+	if d.down[address] {
+		return nil, ErrUpstreamUnavailable.NewError("refused")
+	}
+	return &fakeConn{
+		ToRead: []byte(NewInstruction(OpcodeArgs, "VERSION_1_5_0").String() + NewInstruction(OpcodeReady, "$"+address).String()),
+	}, nil
+}
+
+func newFarm(dialer *farmDialer, strategy BackendStrategy, addresses ...string) *BackendSet {
+	set := &BackendSet{Strategy: strategy}
+	for _, address := range addresses {
+		set.Backends = append(set.Backends, &Backend{Address: address, Dialer: dialer})
+	}
+	return set
+}
+
+func TestBackendSet_LeastConnections(t *testing.T) {
+	dialer := &farmDialer{}
+	set := newFarm(dialer, LeastConnections{}, "a", "b")
+	ctx := context.Background()
+
+	first, err := set.Connect(ctx, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := set.Connect(ctx, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ConnectionID() != "$a" || second.ConnectionID() != "$b" {
+		t.Error("Expected sessions on both backends, got", first.ConnectionID(), second.ConnectionID())
+	}
+
+	_ = first.Close()
+	_ = first.Close()
+	third, err := set.Connect(ctx, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.ConnectionID() != "$a" {
+		t.Error("Expected the emptied backend to be picked, got", third.ConnectionID())
+	}
+	for _, load := range set.Loads() {
+		if load.Sessions != 1 {
+			t.Errorf("Expected one session on %v, got %v", load.Backend, load.Sessions)
+		}
+	}
+
+	// joins go to the backend carrying the connection
+	joined, err := set.Connect(ctx, NewJoinConfiguration("$b", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.dials[len(dialer.dials)-1] != "b" {
+		t.Error("Expected the join to go to b, dialed", dialer.dials)
+	}
+	_ = joined.Close()
+}
+
+func TestBackendSet_SkipsUnreachable(t *testing.T) {
+	dialer := &farmDialer{down: map[string]bool{"a": true}}
+	set := newFarm(dialer, nil, "a", "b")
+	for i := 0; i < 2; i++ {
+		tunnel, err := set.Connect(context.Background(), NewGuacamoleConfiguration())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tunnel.ConnectionID() != "$b" {
+			t.Error("Expected the reachable backend, got", tunnel.ConnectionID())
+		}
+	}
+
+	dialer.down["b"] = true
+	if _, err := set.Connect(context.Background(), NewGuacamoleConfiguration()); err == nil {
+		t.Error("Expected connecting to fail with every backend down")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := []BackendLoad{{Backend: &Backend{Address: "a"}}, {Backend: &Backend{Address: "b"}}, {Backend: &Backend{Address: "c"}}}
+	var strategy RoundRobin
+	var firsts string
+	for i := 0; i < 4; i++ {
+		firsts += strategy.Order(backends, nil)[0].Address
+	}
+	if firsts != "abca" {
+		t.Error("Expected backends in turn, got", firsts)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := []BackendLoad{{Backend: &Backend{Address: "a"}}, {Backend: &Backend{Address: "b"}}, {Backend: &Backend{Address: "c"}}}
+	strategy := &ConsistentHash{}
+	config := NewGuacamoleConfiguration()
+	config.Parameters["hostname"] = "desktop-1"
+	picked := strategy.Order(backends, config)[0]
+	if strategy.Order(backends, config)[0] != picked {
+		t.Error("Expected the same key to pick the same backend")
+	}
+
+	// removing another backend leaves the key where it was
+	var remaining []BackendLoad
+	for _, load := range backends {
+		if load.Backend == picked || len(remaining) == 0 {
+			remaining = append(remaining, load)
+		}
+	}
+	if strategy.Order(remaining, config)[0] != picked {
+		t.Error("Expected the key to stay on its backend")
+	}
+}
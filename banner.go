@@ -0,0 +1,122 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+const (
+	// bannerLayer and bannerStream are the layer and stream drawn banners use, chosen well
+	// above the indexes guacd allocates
+	bannerLayer  = 32767
+	bannerStream = 32767
+
+	// bannerScale is the size in pixels of each dot of the banner font
+	bannerScale = 2
+	// bannerPadding is the space in pixels around the banner text
+	bannerPadding = 6
+	// bannerBlob bounds the base64 data of each blob of a banner image
+	bannerBlob = 6144
+)
+
+var (
+	bannerBackground = color.RGBA{R: 0xb0, G: 0x5a, A: 0xff}
+	bannerForeground = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+// bannerFont is a 5x7 dot font. Each glyph is five columns, the lowest bit being the top row.
+var bannerFont = map[rune][5]byte{
+	' ': {0x00, 0x00, 0x00, 0x00, 0x00}, '!': {0x00, 0x00, 0x5f, 0x00, 0x00},
+	'\'': {0x00, 0x05, 0x03, 0x00, 0x00}, '(': {0x00, 0x1c, 0x22, 0x41, 0x00},
+	')': {0x00, 0x41, 0x22, 0x1c, 0x00}, ',': {0x00, 0x50, 0x30, 0x00, 0x00},
+	'-': {0x08, 0x08, 0x08, 0x08, 0x08}, '.': {0x00, 0x60, 0x60, 0x00, 0x00},
+	'/': {0x20, 0x10, 0x08, 0x04, 0x02}, ':': {0x00, 0x36, 0x36, 0x00, 0x00},
+	'?': {0x02, 0x01, 0x51, 0x09, 0x06},
+	'0': {0x3e, 0x51, 0x49, 0x45, 0x3e}, '1': {0x00, 0x42, 0x7f, 0x40, 0x00},
+	'2': {0x42, 0x61, 0x51, 0x49, 0x46}, '3': {0x21, 0x41, 0x45, 0x4b, 0x31},
+	'4': {0x18, 0x14, 0x12, 0x7f, 0x10}, '5': {0x27, 0x45, 0x45, 0x45, 0x39},
+	'6': {0x3c, 0x4a, 0x49, 0x49, 0x30}, '7': {0x01, 0x71, 0x09, 0x05, 0x03},
+	'8': {0x36, 0x49, 0x49, 0x49, 0x36}, '9': {0x06, 0x49, 0x49, 0x29, 0x1e},
+	'A': {0x7c, 0x12, 0x11, 0x12, 0x7c}, 'B': {0x7f, 0x49, 0x49, 0x49, 0x36},
+	'C': {0x3e, 0x41, 0x41, 0x41, 0x22}, 'D': {0x7f, 0x41, 0x41, 0x22, 0x1c},
+	'E': {0x7f, 0x49, 0x49, 0x49, 0x41}, 'F': {0x7f, 0x09, 0x09, 0x09, 0x01},
+	'G': {0x3e, 0x41, 0x49, 0x49, 0x7a}, 'H': {0x7f, 0x08, 0x08, 0x08, 0x7f},
+	'I': {0x00, 0x41, 0x7f, 0x41, 0x00}, 'J': {0x20, 0x40, 0x41, 0x3f, 0x01},
+	'K': {0x7f, 0x08, 0x14, 0x22, 0x41}, 'L': {0x7f, 0x40, 0x40, 0x40, 0x40},
+	'M': {0x7f, 0x02, 0x0c, 0x02, 0x7f}, 'N': {0x7f, 0x04, 0x08, 0x10, 0x7f},
+	'O': {0x3e, 0x41, 0x41, 0x41, 0x3e}, 'P': {0x7f, 0x09, 0x09, 0x09, 0x06},
+	'Q': {0x3e, 0x41, 0x51, 0x21, 0x5e}, 'R': {0x7f, 0x09, 0x19, 0x29, 0x46},
+	'S': {0x46, 0x49, 0x49, 0x49, 0x31}, 'T': {0x01, 0x01, 0x7f, 0x01, 0x01},
+	'U': {0x3f, 0x40, 0x40, 0x40, 0x3f}, 'V': {0x1f, 0x20, 0x40, 0x20, 0x1f},
+	'W': {0x3f, 0x40, 0x38, 0x40, 0x3f}, 'X': {0x63, 0x14, 0x08, 0x14, 0x63},
+	'Y': {0x07, 0x08, 0x70, 0x08, 0x07}, 'Z': {0x61, 0x51, 0x49, 0x45, 0x43},
+}
+
+// renderBanner draws the message in white on amber, in capitals as the font has no lower
+// case. Characters the font lacks are drawn as '?'.
+func renderBanner(message string) *image.RGBA {
+	glyphs := []rune(strings.ToUpper(message))
+	width := 2*bannerPadding + len(glyphs)*6*bannerScale
+	height := 2*bannerPadding + 7*bannerScale
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: bannerBackground}, image.Point{}, draw.Src)
+	for i, r := range glyphs {
+		glyph, ok := bannerFont[r]
+		if !ok {
+			glyph = bannerFont['?']
+		}
+		left := bannerPadding + i*6*bannerScale
+		for column, bits := range glyph {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<row) == 0 {
+					continue
+				}
+				for dx := 0; dx < bannerScale; dx++ {
+					for dy := 0; dy < bannerScale; dy++ {
+						img.SetRGBA(left+column*bannerScale+dx, bannerPadding+row*bannerScale+dy, bannerForeground)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+// drawBanner returns the instructions drawing the message on a layer above the display, for
+// clients which don't support msg. An empty message removes the banner.
+func drawBanner(message string) []*Instruction {
+	layer := strconv.Itoa(bannerLayer)
+	if message == "" {
+		return []*Instruction{NewInstruction(OpcodeDispose, layer)}
+	}
+
+	img := renderBanner(message)
+	data := &bytes.Buffer{}
+	// encoding an in-memory image can't fail
+	_ = png.Encode(data, img)
+	encoded := base64.StdEncoding.EncodeToString(data.Bytes())
+
+	stream := strconv.Itoa(bannerStream)
+	instructions := []*Instruction{
+		NewInstruction(OpcodeSize, layer, strconv.Itoa(img.Bounds().Dx()), strconv.Itoa(img.Bounds().Dy())),
+		NewInstruction(OpcodeMove, layer, "0", "0", "0", strconv.Itoa(bannerLayer)),
+		// mask 12 replaces what is on the layer
+		NewInstruction(OpcodeImg, stream, "12", layer, "image/png", "0", "0"),
+	}
+	for len(encoded) > 0 {
+		n := bannerBlob
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		instructions = append(instructions, NewInstruction(OpcodeBlob, stream, encoded[:n]))
+		encoded = encoded[n:]
+	}
+	return append(instructions, NewInstruction(OpcodeEnd, stream))
+}
@@ -0,0 +1,158 @@
+package guac
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionEvent is an event published on an EventBus. It is one of *TunnelOpened,
+// *TunnelClosed, *ReadError, *WriteError or *QuotaExceeded, or a type added later, so
+// subscribers switch on the type and ignore those they don't know.
+type SessionEvent interface {
+	// Session describes the session the event happened on
+	Session() *EventSession
+}
+
+// EventSession describes the session an event happened on
+type EventSession struct {
+	// UUID and ConnectionID are those of the tunnel, empty if it never opened
+	UUID         string
+	ConnectionID string
+	// Identity is the authenticated user, nil without an Authorizer
+	Identity *Identity
+	// Time is when the event happened
+	Time time.Time
+}
+
+// Session returns s
+func (s *EventSession) Session() *EventSession {
+	return s
+}
+
+// TunnelOpened is published once a tunnel has connected
+type TunnelOpened struct {
+	EventSession
+	// Transport is "http" or "websocket"
+	Transport string
+}
+
+// TunnelClosed is published once a tunnel has closed
+type TunnelClosed struct {
+	EventSession
+	// Cause is the error which ended the tunnel, nil if it was closed without one
+	Cause error
+	// Duration is how long the tunnel was open
+	Duration time.Duration
+}
+
+// ReadError is published when reading from guacd fails other than by guacd ending the session
+type ReadError struct {
+	EventSession
+	Err error
+}
+
+// WriteError is published when writing to guacd fails
+type WriteError struct {
+	EventSession
+	Err error
+}
+
+// QuotaExceeded is published when a connect request is refused by a SessionQuota
+type QuotaExceeded struct {
+	EventSession
+	// Key is what the quota counts tunnels under, such as the user
+	Key string
+	Err error
+}
+
+// sessionOf describes the session of tunnel, as of now
+func sessionOf(tunnel Tunnel) EventSession {
+	session := EventSession{UUID: tunnel.GetUUID(), ConnectionID: tunnel.ConnectionID(), Time: time.Now()}
+	if registered, ok := tunnel.(*LastAccessedTunnel); ok {
+		session.Identity = registered.Identity()
+	}
+	return session
+}
+
+/*
+EventBus publishes the events of sessions to every subscriber, so metrics, webhooks, audit
+logs and the like can observe tunnels without each wrapping them. It is set on the servers
+whose tunnels are observed, and may be shared between them:
+
+	bus := &guac.EventBus{}
+	server.Events = bus
+	unsubscribe := bus.Subscribe(func(event guac.SessionEvent) {
+		if closed, ok := event.(*guac.TunnelClosed); ok {
+			log.Printf("%v closed after %v", closed.UUID, closed.Duration)
+		}
+	})
+
+The zero value is ready to use.
+*/
+type EventBus struct {
+	sync.RWMutex
+	subscribers map[int]func(event SessionEvent)
+	next        int
+	// dropped counts the events channel subscribers were too slow to receive
+	dropped atomic.Int64
+}
+
+// Subscribe calls fn with every event published until the returned function is called. fn is
+// called synchronously by the goroutine publishing, so it must not block, nor subscribe or
+// unsubscribe; subscribers doing slow work should use SubscribeChan.
+func (b *EventBus) Subscribe(fn func(event SessionEvent)) (unsubscribe func()) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = map[int]func(event SessionEvent){}
+	}
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// SubscribeChan returns a channel receiving every event published, buffering up to size
+// events, until the returned function is called, which closes the channel. Events published
+// while the buffer is full are dropped rather than holding up the tunnel, and counted by
+// Dropped.
+func (b *EventBus) SubscribeChan(size int) (events <-chan SessionEvent, unsubscribe func()) {
+	ch := make(chan SessionEvent, size)
+	var once sync.Once
+	stop := b.Subscribe(func(event SessionEvent) {
+		select {
+		case ch <- event:
+		default:
+			b.dropped.Add(1)
+		}
+	})
+	return ch, func() {
+		once.Do(func() {
+			// unsubscribing takes the lock publishing holds, so no send is in progress
+			stop()
+			close(ch)
+		})
+	}
+}
+
+// Dropped returns the number of events channel subscribers have missed
+func (b *EventBus) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Publish passes event to every subscriber
+func (b *EventBus) Publish(event SessionEvent) {
+	if session := event.Session(); session.Time.IsZero() {
+		session.Time = time.Now()
+	}
+	b.RLock()
+	defer b.RUnlock()
+	for _, fn := range b.subscribers {
+		fn(event)
+	}
+}
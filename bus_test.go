@@ -0,0 +1,132 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventBus_Server(t *testing.T) {
+	bus := &EventBus{}
+	var lock sync.Mutex
+	var events []SessionEvent
+	unsubscribe := bus.Subscribe(func(event SessionEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.Events = bus
+	server.Quota = &SessionQuota{Max: 1, Key: func(*http.Request, *Identity) string { return "alice" }}
+	connect := func() string {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/?connect", bytes.NewReader(nil)))
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+	uuid := connect()
+	connect()
+	if err := server.KillTunnel(uuid, "done"); err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe()
+	connect()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 3 {
+		t.Fatal("Expected three events, got", events)
+	}
+	if opened, ok := events[0].(*TunnelOpened); !ok || opened.UUID != uuid || opened.ConnectionID != "asdf" || opened.Transport != "http" || opened.Time.IsZero() {
+		t.Errorf("Unexpected first event %#v", events[0])
+	}
+	if exceeded, ok := events[1].(*QuotaExceeded); !ok || exceeded.Key != "alice" || exceeded.Err == nil {
+		t.Errorf("Unexpected second event %#v", events[1])
+	}
+	if closed, ok := events[2].(*TunnelClosed); !ok || closed.UUID != uuid || closed.Duration <= 0 {
+		t.Errorf("Unexpected third event %#v", events[2])
+	}
+}
+
+func TestEventBus_SubscribeChan(t *testing.T) {
+	bus := &EventBus{}
+	events, unsubscribe := bus.SubscribeChan(1)
+	bus.Publish(&TunnelOpened{EventSession: EventSession{UUID: "1"}})
+	bus.Publish(&TunnelClosed{EventSession: EventSession{UUID: "1"}})
+	if bus.Dropped() != 1 {
+		t.Error("Expected the event over the buffer to be dropped, got", bus.Dropped())
+	}
+	unsubscribe()
+	unsubscribe()
+	bus.Publish(&TunnelOpened{EventSession: EventSession{UUID: "2"}})
+
+	var received []SessionEvent
+	for event := range events {
+		received = append(received, event)
+	}
+	if len(received) != 1 || received[0].Session().UUID != "1" || received[0].Session().Time.IsZero() {
+		t.Errorf("Unexpected events %#v", received)
+	}
+}
+
+func TestEventBus_WebsocketClientGone(t *testing.T) {
+	bus := &EventBus{}
+	var lock sync.Mutex
+	var events []SessionEvent
+	bus.Subscribe(func(event SessionEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	wsServer.Events = bus
+	httpServer := httptest.NewServer(wsServer)
+	defer httpServer.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = guacd.Write([]byte("4.sync,1.1;"))
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		n := len(events)
+		lock.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the tunnel to close")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	for _, event := range events {
+		if _, ok := event.(*ReadError); ok {
+			t.Errorf("Expected the client leaving not to publish a read error, got %#v", event)
+		}
+	}
+}
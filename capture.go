@@ -0,0 +1,131 @@
+package guac
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureSink receives the instructions recorded by a Capture. Capture is called from the
+// goroutines moving data through the tunnel, so a slow sink slows the tunnel down.
+type CaptureSink interface {
+	Capture(at time.Time, direction Direction, instruction *Instruction)
+}
+
+// CaptureSinkFunc adapts an ordinary function to the CaptureSink interface
+type CaptureSinkFunc func(at time.Time, direction Direction, instruction *Instruction)
+
+// Capture calls f(at, direction, instruction)
+func (f CaptureSinkFunc) Capture(at time.Time, direction Direction, instruction *Instruction) {
+	f(at, direction, instruction)
+}
+
+// Capture records the instructions passing through a tunnel, for debugging the protocol
+// without a network sniffer. Instructions are seen as they pass the capture's filters, so
+// starting a capture before installing other filters records what guacd sends and what the
+// client sends, before either is changed. Instructions injected with WriteInstruction or
+// WriteToClient are not recorded.
+type Capture struct {
+	sink    CaptureSink
+	stopped atomic.Bool
+}
+
+// StartCapture installs a capture on the tunnel which records to sink until stopped
+func StartCapture(tunnel *FilteredTunnel, sink CaptureSink) *Capture {
+	c := &Capture{sink: sink}
+	tunnel.AddReadFilter(&captureFilter{capture: c, direction: FromGuacd})
+	tunnel.AddWriteFilter(&captureFilter{capture: c, direction: FromClient})
+	return c
+}
+
+// Stop stops recording. The capture's filters stay installed but pass everything through.
+func (c *Capture) Stop() {
+	c.stopped.Store(true)
+}
+
+type captureFilter struct {
+	capture   *Capture
+	direction Direction
+}
+
+func (f *captureFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	if !f.capture.stopped.Load() {
+		f.capture.sink.Capture(time.Now(), f.direction, instruction)
+	}
+	return instruction, nil
+}
+
+// NewCaptureWriter returns a sink writing one line per instruction to w, holding the time,
+// the direction and the instruction as sent on the wire:
+//
+//	2024-05-01T12:00:00.123456789Z guacd 4.sync,13.1714564800123;
+func NewCaptureWriter(w io.Writer) CaptureSink {
+	return &captureWriter{writer: w}
+}
+
+type captureWriter struct {
+	sync.Mutex
+	writer io.Writer
+}
+
+func (c *captureWriter) Capture(at time.Time, direction Direction, instruction *Instruction) {
+	c.Lock()
+	defer c.Unlock()
+	if _, err := fmt.Fprintf(c.writer, "%v %v %v\n", at.UTC().Format(time.RFC3339Nano), direction, instruction); err != nil {
+		filtersLog.Debug("Failed to write captured instruction: ", err)
+	}
+}
+
+// CapturedInstruction is an instruction recorded by a Capture
+type CapturedInstruction struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Opcode    string    `json:"opcode"`
+	Args      []string  `json:"args"`
+}
+
+// DefaultCaptureBufferSize is the number of instructions a CaptureBuffer keeps when created
+// with a size of zero
+const DefaultCaptureBufferSize = 1000
+
+// CaptureBuffer is a sink keeping the most recent instructions captured
+type CaptureBuffer struct {
+	sync.Mutex
+	entries []CapturedInstruction
+	next    int
+	full    bool
+}
+
+// NewCaptureBuffer creates a buffer holding up to size instructions
+func NewCaptureBuffer(size int) *CaptureBuffer {
+	if size <= 0 {
+		size = DefaultCaptureBufferSize
+	}
+	return &CaptureBuffer{entries: make([]CapturedInstruction, size)}
+}
+
+// Capture records the instruction, replacing the oldest if the buffer is full
+func (b *CaptureBuffer) Capture(at time.Time, direction Direction, instruction *Instruction) {
+	b.Lock()
+	b.entries[b.next] = CapturedInstruction{
+		Time:      at,
+		Direction: direction.String(),
+		Opcode:    instruction.Opcode,
+		Args:      instruction.Args,
+	}
+	b.next = (b.next + 1) % len(b.entries)
+	b.full = b.full || b.next == 0
+	b.Unlock()
+}
+
+// Instructions returns the buffered instructions, oldest first
+func (b *CaptureBuffer) Instructions() []CapturedInstruction {
+	b.Lock()
+	defer b.Unlock()
+	if !b.full {
+		return append([]CapturedInstruction(nil), b.entries[:b.next]...)
+	}
+	return append(append([]CapturedInstruction(nil), b.entries[b.next:]...), b.entries[:b.next]...)
+}
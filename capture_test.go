@@ -0,0 +1,47 @@
+package guac
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	conn := &fakeConn{
+		ToRead: []byte("4.sync,1.1;"),
+	}
+	tunnel := NewFilteredTunnel(&fakeTunnel{reader: NewStream(conn, time.Minute), writer: &bytes.Buffer{}})
+
+	out := &bytes.Buffer{}
+	capture := StartCapture(tunnel, NewCaptureWriter(out))
+
+	reader := tunnel.AcquireReader()
+	if _, err := reader.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseReader()
+
+	writer := tunnel.AcquireWriter()
+	if _, err := writer.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	capture.Stop()
+	if _, err := writer.Write([]byte("3.nop;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", out.String())
+	}
+	for i, want := range []string{" guacd 4.sync,1.1;", " client 4.sync,1.1;"} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("Line %v: got %q, want suffix %q", i, lines[i], want)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, strings.Fields(lines[i])[0]); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ClipboardHook is called with the complete contents of each clipboard update passing through
+// a ClipboardFilter. It returns the contents to forward in place of the original, which may
+// simply be data itself. Returning a nil reader drops the update; returning an error fails the
+// tunnel read or write that completed the update.
+type ClipboardHook func(direction Direction, mimetype string, data io.Reader) (io.Reader, error)
+
+// ClipboardFilter intercepts clipboard streams travelling in one direction. Each stream is held
+// back until it ends, then the hook is given its decoded contents and whatever it returns is
+// sent on as a single new clipboard stream with the same index. Install one filter for each
+// direction to be intercepted:
+//
+//	tunnel.AddReadFilter(guac.NewClipboardFilter(guac.FromGuacd, hook))
+//	tunnel.AddWriteFilter(guac.NewClipboardFilter(guac.FromClient, hook))
+type ClipboardFilter struct {
+	direction Direction
+	hook      ClipboardHook
+
+	// MaxSize is the most bytes of each clipboard update held back for the hook,
+	// DefaultClipboardMaxSize if zero. Longer updates are truncated.
+	MaxSize int
+
+	sync.Mutex
+	streams map[string]*clipboardStream
+}
+
+// DefaultClipboardMaxSize is the most bytes of a clipboard update a ClipboardFilter holds back
+// when its MaxSize is zero
+const DefaultClipboardMaxSize = 1 << 20
+
+type clipboardStream struct {
+	mimetype string
+	data     bytes.Buffer
+	// truncated is true once the stream has exceeded the MaxSize of the filter
+	truncated bool
+}
+
+func (f *ClipboardFilter) maxSize() int {
+	if f.MaxSize <= 0 {
+		return DefaultClipboardMaxSize
+	}
+	return f.MaxSize
+}
+
+// NewClipboardFilter creates a filter for clipboard streams travelling in the given direction
+func NewClipboardFilter(direction Direction, hook ClipboardHook) *ClipboardFilter {
+	return &ClipboardFilter{
+		direction: direction,
+		hook:      hook,
+		streams:   map[string]*clipboardStream{},
+	}
+}
+
+// Filter implements Filter for callers which only need single instructions; clipboard updates
+// are dropped rather than replayed.
+func (f *ClipboardFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	instructions, err := f.FilterAll(instruction)
+	if err != nil || len(instructions) != 1 {
+		return nil, err
+	}
+	return instructions[0], nil
+}
+
+// FilterAll holds back clipboard streams and replays them through the hook once they end
+func (f *ClipboardFilter) FilterAll(instruction *Instruction) ([]*Instruction, error) {
+	if len(instruction.Args) == 0 {
+		return []*Instruction{instruction}, nil
+	}
+	index := instruction.Args[0]
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch instruction.Opcode {
+	case OpcodeClipboard:
+		if len(instruction.Args) < 2 {
+			return nil, f.malformed("Malformed clipboard instruction")
+		}
+		f.streams[index] = &clipboardStream{mimetype: instruction.Args[1]}
+		return nil, nil
+
+	case OpcodeBlob:
+		stream, ok := f.streams[index]
+		if !ok {
+			break
+		}
+		if len(instruction.Args) < 2 {
+			return nil, f.malformed("Malformed blob instruction")
+		}
+		data, err := base64.StdEncoding.DecodeString(instruction.Args[1])
+		if err != nil {
+			return nil, f.malformed("Invalid clipboard blob:", err.Error())
+		}
+		if stream.truncated {
+			return nil, nil
+		}
+		if room := f.maxSize() - stream.data.Len(); len(data) > room {
+			data = truncateClipboard(data, room, stream.mimetype)
+			stream.truncated = true
+		}
+		stream.data.Write(data)
+		return nil, nil
+
+	case OpcodeEnd:
+		stream, ok := f.streams[index]
+		if !ok {
+			break
+		}
+		delete(f.streams, index)
+		return f.release(index, stream)
+	}
+
+	return []*Instruction{instruction}, nil
+}
+
+// truncateClipboard cuts data to at most size bytes, without splitting a character of text
+func truncateClipboard(data []byte, size int, mimetype string) []byte {
+	if strings.HasPrefix(mimetype, "text/") {
+		for size > 0 && !utf8.RuneStart(data[size]) {
+			size--
+		}
+	}
+	return data[:size]
+}
+
+// release runs a completed stream through the hook and builds the instructions replacing it
+func (f *ClipboardFilter) release(index string, stream *clipboardStream) ([]*Instruction, error) {
+	data, err := f.hook(f.direction, stream.mimetype, &stream.data)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	blobs := &instructionCollector{}
+	if err = writeBlobs(blobs, index, data); err != nil {
+		return nil, err
+	}
+
+	instructions := make([]*Instruction, 0, len(blobs.instructions)+2)
+	instructions = append(instructions, NewInstruction(OpcodeClipboard, index, stream.mimetype))
+	instructions = append(instructions, blobs.instructions...)
+	instructions = append(instructions, NewInstruction(OpcodeEnd, index))
+	return instructions, nil
+}
+
+// malformed returns an error blaming whichever side sent the instruction
+func (f *ClipboardFilter) malformed(args ...string) error {
+	if f.direction == FromClient {
+		return ErrClient.NewError(args...)
+	}
+	return ErrServer.NewError(args...)
+}
+
+// WriteClipboard sets the clipboard of the remote session by sending data to guacd as a
+// clipboard stream.
+func WriteClipboard(writer StreamWriter, mimetype string, data io.Reader) error {
+	return writer.WriteStream("clipboard", data, mimetype)
+}
+
+// instructionCollector is an InstructionWriter which records the instructions written to it
+type instructionCollector struct {
+	instructions []*Instruction
+}
+
+// WriteInstruction records the instruction
+func (c *instructionCollector) WriteInstruction(instruction *Instruction) error {
+	c.instructions = append(c.instructions, instruction)
+	return nil
+}
@@ -0,0 +1,135 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestClipboardFilter(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+
+	var seen []string
+	tunnel.AddWriteFilter(NewClipboardFilter(FromClient, func(direction Direction, mimetype string, data io.Reader) (io.Reader, error) {
+		b, _ := io.ReadAll(data)
+		seen = append(seen, direction.String()+" "+mimetype+" "+string(b))
+		if strings.Contains(string(b), "secret") {
+			return nil, nil
+		}
+		return strings.NewReader(strings.ToUpper(string(b))), nil
+	}))
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	// "hello" split across two blobs
+	if _, err := writer.Write([]byte("9.clipboard,1.0,10.text/plain;4.blob,1.0,4.aGVs;5.mouse,1.1,1.1;4.blob,1.0,4.bG8=;3.end,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	want := "5.mouse,1.1,1.1;9.clipboard,1.0,10.text/plain;4.blob,1.0,8.SEVMTE8=;3.end,1.0;"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if _, err := writer.Write([]byte("9.clipboard,1.1,10.text/plain;4.blob,1.1,8.c2VjcmV0;3.end,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected blocked clipboard to be dropped, got %q", out.String())
+	}
+
+	if len(seen) != 2 || seen[0] != "client text/plain hello" {
+		t.Errorf("unexpected hook calls %q", seen)
+	}
+}
+
+func TestWriteClipboard(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+
+	if err := WriteClipboard(tunnel, "text/plain", strings.NewReader("hi")); err != nil {
+		t.Fatal(err)
+	}
+	want := "9.clipboard,2.63,10.text/plain;4.blob,2.63,4.aGk=;3.end,2.63;"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	if tunnel.streams.owns(NewInstruction("ack", "63", "OK", "0")) {
+		t.Error("expected ack after the server stream ended to be forwarded")
+	}
+}
+
+func TestClipboardFilter_MaxSize(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	var seen string
+	filter := NewClipboardFilter(FromClient, func(direction Direction, mimetype string, data io.Reader) (io.Reader, error) {
+		b, _ := io.ReadAll(data)
+		seen = string(b)
+		return nil, nil
+	})
+	filter.MaxSize = 4
+	tunnel.AddWriteFilter(filter)
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+	// "hello" split across two blobs
+	if _, err := writer.Write([]byte("9.clipboard,1.0,10.text/plain;4.blob,1.0,4.aGVs;4.blob,1.0,4.bG8=;3.end,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "hell" {
+		t.Errorf("Expected the clipboard to be truncated to 4 bytes, got %q", seen)
+	}
+}
+
+func TestClipboardFilter_TruncateText(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	var seen string
+	filter := NewClipboardFilter(FromClient, func(direction Direction, mimetype string, data io.Reader) (io.Reader, error) {
+		b, _ := io.ReadAll(data)
+		seen = string(b)
+		return nil, nil
+	})
+	filter.MaxSize = 4
+	tunnel.AddWriteFilter(filter)
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+	// "aéé" is 5 bytes, and the second é is cut in two at 4 bytes
+	blob := base64.StdEncoding.EncodeToString([]byte("aéé"))
+	if _, err := writer.Write([]byte(NewInstruction(OpcodeClipboard, "0", "text/plain").String() +
+		NewInstruction(OpcodeBlob, "0", blob).String() + NewInstruction(OpcodeBlob, "0", "eA==").String() + "3.end,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "aé" {
+		t.Errorf("Expected the clipboard to be truncated between characters, got %q", seen)
+	}
+}
+
+func TestStreamIndexPool_Reuse(t *testing.T) {
+	pool := &streamIndexPool{}
+	index, _ := pool.next()
+	ack := NewInstruction(OpcodeAck, strconv.Itoa(index), "OK", "0")
+	if !pool.owns(ack) {
+		t.Error("Expected the ack of an open stream to be owned")
+	}
+	pool.free(index)
+	if pool.owns(ack) {
+		t.Error("Expected the ack of an index the client reuses to be forwarded")
+	}
+
+	index, _ = pool.next()
+	if !pool.owns(NewInstruction(OpcodeAck, strconv.Itoa(index), "Closed", "256")) || pool.err(index) == nil {
+		t.Error("Expected the error ack of an open stream to be owned and recorded")
+	}
+	if pool.owns(NewInstruction(OpcodeAck, strconv.Itoa(index), "OK", "0")) {
+		t.Error("Expected acks after guacd closed the stream to be forwarded")
+	}
+}
@@ -0,0 +1,149 @@
+package guac
+
+import (
+	"errors"
+	"syscall"
+)
+
+// CloseReason describes how guacd closed its connection
+type CloseReason int
+
+const (
+	// CloseUnknown is the reason of errors which are not guacd closing the connection
+	CloseUnknown CloseReason = iota
+	// CloseEOF means guacd ended the session with a disconnect or error instruction and then
+	// closed the connection
+	CloseEOF
+	// CloseHalfClose means guacd stopped sending, with a zero-length read, without ending the
+	// session first, possibly part way through an instruction
+	CloseHalfClose
+	// CloseReset means the connection was reset, usually because guacd or the host it runs on
+	// went away
+	CloseReset
+	// CloseIdleTimeout means the server closed the tunnel for going unused for longer than its
+	// idle timeout
+	CloseIdleTimeout
+	// CloseShutdown means the server closed the tunnel as it was still open once a Shutdown
+	// deadline had passed
+	CloseShutdown
+	// ClosePolicyKill means a rule killed the tunnel
+	ClosePolicyKill
+	// CloseReaped means a Reaper closed the tunnel because its client or guacd had gone
+	CloseReaped
+)
+
+// String returns a short name for the reason
+func (r CloseReason) String() string {
+	switch r {
+	case CloseEOF:
+		return "eof"
+	case CloseHalfClose:
+		return "half-close"
+	case CloseReset:
+		return "reset"
+	case CloseIdleTimeout:
+		return "idle-timeout"
+	case CloseShutdown:
+		return "shutdown"
+	case ClosePolicyKill:
+		return "policy"
+	case CloseReaped:
+		return "reaped"
+	}
+	return "unknown"
+}
+
+// Status returns the status reported to the client for the reason
+func (r CloseReason) Status() Status {
+	switch r {
+	case CloseEOF:
+		return SessionClosed
+	case CloseHalfClose:
+		return UpstreamError
+	case CloseReset:
+		return UpstreamUnavailable
+	case CloseIdleTimeout:
+		return SessionTimeout
+	case CloseShutdown, ClosePolicyKill:
+		return SessionClosed
+	}
+	return ServerError
+}
+
+// CloseMessages holds the message sent to the client, as an error instruction carrying the
+// reason's status, when guacd or the server closes the connection for each reason. Reasons guacd
+// closed the connection for without a message close the tunnel without telling the client why,
+// as guacd has usually done so already. The client is always told why the server closed the
+// tunnel, with the default message for reasons without one.
+type CloseMessages map[CloseReason]string
+
+// DefaultCloseMessages are used by servers whose CloseMessages are nil
+var DefaultCloseMessages = CloseMessages{
+	CloseHalfClose:   "The remote desktop server stopped responding.",
+	CloseReset:       "The connection to the remote desktop server was lost.",
+	CloseIdleTimeout: "Session ended: idle timeout.",
+	CloseShutdown:    "Session ended: the server is shutting down.",
+	ClosePolicyKill:  "Session ended by policy.",
+	CloseReaped:      "Session ended: the connection was lost.",
+}
+
+// instruction returns the error instruction telling the client guacd closed the connection,
+// nil if there is nothing to tell
+func (m CloseMessages) instruction(err error) *Instruction {
+	if m == nil {
+		m = DefaultCloseMessages
+	}
+	reason := CloseReasonOf(err)
+	if message := m[reason]; reason != CloseUnknown && message != "" {
+		return NewErrorInstruction(message, reason.Status())
+	}
+	return nil
+}
+
+// closedBy returns the error instruction telling the client the server closed the tunnel for
+// the reason, with the given status
+func (m CloseMessages) closedBy(reason CloseReason, status Status) *Instruction {
+	message := m[reason]
+	if message == "" {
+		message = DefaultCloseMessages[reason]
+	}
+	return NewErrorInstruction(message, status)
+}
+
+// CloseReasonOf returns how guacd closed the connection if err was caused by guacd closing it,
+// CloseUnknown otherwise.
+func CloseReasonOf(err error) CloseReason {
+	var closed *upstreamClosedError
+	if errors.As(err, &closed) {
+		return closed.reason
+	}
+	return CloseUnknown
+}
+
+// upstreamClosedError records why reading from guacd failed
+type upstreamClosedError struct {
+	reason CloseReason
+	err    error
+}
+
+func (e *upstreamClosedError) Error() string {
+	return "Connection to guacd is closed (" + e.reason.String() + "), " + e.err.Error()
+}
+
+func (e *upstreamClosedError) Unwrap() error {
+	return e.err
+}
+
+// newUpstreamClosedError returns the ErrConnectionClosed error for guacd closing the connection
+func newUpstreamClosedError(reason CloseReason, err error) error {
+	return &ErrGuac{
+		error:  &upstreamClosedError{reason: reason, err: err},
+		Status: reason.Status(),
+		Kind:   ErrConnectionClosed,
+	}
+}
+
+// isReset returns true if err is the connection being reset by its peer
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,141 @@
+package guac
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream_CloseReason(t *testing.T) {
+	for data, want := range map[string]CloseReason{
+		"4.sync,1.1;10.disconnect;": CloseEOF,
+		"5.error,4.Gone,3.519;":     CloseEOF,
+		"4.sync,1.1;":               CloseHalfClose,
+		"10.disconnect;4.sync,1.":   CloseHalfClose,
+		"":                          CloseHalfClose,
+	} {
+		stream := NewStream(&fakeConn{ToRead: []byte(data)}, time.Minute)
+		var err error
+		for err == nil {
+			_, err = stream.ReadSome()
+		}
+		if got := CloseReasonOf(err); got != want {
+			t.Errorf("%q: expected %v, got %v (%v)", data, want, got, err)
+		}
+		if kind := asErrGuac(err).Kind; kind != ErrConnectionClosed {
+			t.Errorf("%q: expected ErrConnectionClosed, got %v", data, kind)
+		}
+	}
+}
+
+func TestStream_CloseReasonReset(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		<-dialed
+		// closing with no linger sends RST instead of FIN
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	close(dialed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = NewStream(conn, time.Minute).ReadSome()
+	if got := CloseReasonOf(err); got != CloseReset {
+		t.Errorf("Expected reset, got %v (%v)", got, err)
+	}
+	if status := asErrGuac(err).Status; status != UpstreamUnavailable {
+		t.Errorf("Expected UpstreamUnavailable, got %v", status)
+	}
+}
+
+func TestCloseMessages_instruction(t *testing.T) {
+	halfClosed := newUpstreamClosedError(CloseHalfClose, io.EOF)
+
+	var defaults CloseMessages
+	want := NewErrorInstruction(DefaultCloseMessages[CloseHalfClose], UpstreamError).String()
+	if ins := defaults.instruction(halfClosed); ins == nil || ins.String() != want {
+		t.Errorf("Expected %q, got %v", want, ins)
+	}
+	if ins := defaults.instruction(newUpstreamClosedError(CloseEOF, io.EOF)); ins != nil {
+		t.Error("Expected no message for a clean close, got", ins)
+	}
+	if ins := defaults.instruction(ErrServer.NewError("boom")); ins != nil {
+		t.Error("Expected no message for other errors, got", ins)
+	}
+
+	custom := CloseMessages{CloseEOF: "Bye."}
+	if ins := custom.instruction(halfClosed); ins != nil {
+		t.Error("Expected configured messages to replace the defaults, got", ins)
+	}
+	if ins := custom.instruction(newUpstreamClosedError(CloseEOF, io.EOF)); ins == nil || ins.Args[0] != "Bye." {
+		t.Error("Expected configured message, got", ins)
+	}
+	if ins := custom.closedBy(CloseShutdown, SessionClosed); ins.Args[0] != DefaultCloseMessages[CloseShutdown] {
+		t.Error("Expected the default message for server closes without one, got", ins)
+	}
+}
+
+func TestServer_CloseMessages(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.CloseMessages = CloseMessages{CloseIdleTimeout: "Idle."}
+	registered := server.registerTunnel(tunnel, nil, nil)
+
+	tunnels := server.tunnels.(*TunnelMap)
+	tunnels.SetIdleTimeout(tunnel.GetUUID(), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	tunnels.tunnelTimeoutTaskRun()
+
+	if killed := registered.killedWith(); killed == nil || killed.Args[0] != "Idle." {
+		t.Error("Expected the server's idle timeout message, got", killed)
+	}
+}
+
+func TestServer_IdleTimeoutMessage(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.registerTunnel(tunnel, nil, nil)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// the read waits on guacd, which sends nothing until the tunnel goes idle
+	response, err := http.Get(httpServer.URL + "/tunnel?read:" + tunnel.GetUUID() + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	tunnels := server.tunnels.(*TunnelMap)
+	tunnels.SetIdleTimeout(tunnel.GetUUID(), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	tunnels.tunnelTimeoutTaskRun()
+
+	body, _ := io.ReadAll(response.Body)
+	expected := NewErrorInstruction(DefaultCloseMessages[CloseIdleTimeout], SessionTimeout).String() + "0.;"
+	if !strings.HasSuffix(string(body), expected) {
+		t.Errorf("Expected the client to be told the tunnel timed out, got %q", body)
+	}
+}
@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+const (
+	// TunnelOwnerHeader names the node owning a tunnel in the response to a request for a
+	// tunnel owned by another node, so clients or load balancers can retry there
+	TunnelOwnerHeader = "Guacamole-Tunnel-Owner"
+	// forwardedHeader marks requests forwarded by another node, which are never forwarded again
+	forwardedHeader = "Guacamole-Forwarded-By"
+)
+
+// TunnelLocator is implemented by registries shared by a cluster of servers, such as
+// RedisRegistry, to find which server owns a tunnel this one doesn't have.
+type TunnelLocator interface {
+	// Locate returns the URL of the tunnel endpoint of the node owning the tunnel with the
+	// given UUID, if another node owns it
+	Locate(uuid string) (node string, ok bool)
+}
+
+// routeToOwner handles a read or write request for a tunnel this server doesn't have. If its
+// registry knows another node owns the tunnel, the request is forwarded there when
+// ForwardToOwner is set and true is returned. Otherwise the owner is named in the
+// TunnelOwnerHeader of the error response which follows.
+func (s *Server) routeToOwner(response http.ResponseWriter, request *http.Request, tunnelUUID string) bool {
+	locator, ok := s.tunnels.(TunnelLocator)
+	if !ok {
+		return false
+	}
+	node, ok := locator.Locate(tunnelUUID)
+	if !ok {
+		return false
+	}
+	target, err := url.Parse(node)
+	if err != nil || !s.ForwardToOwner || request.Header.Get(forwardedHeader) != "" {
+		response.Header().Set(TunnelOwnerHeader, node)
+		return false
+	}
+
+	s.log(transportLog, nil).Debugf("Forwarding request for tunnel %v to %v.", tunnelUUID, node)
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.URL.Path = target.Path
+			r.Host = target.Host
+			r.Header.Set(forwardedHeader, "1")
+		},
+		// this node has already set the CORS headers of the response, which browsers refuse
+		// when they appear twice
+		ModifyResponse: func(r *http.Response) error {
+			for name := range r.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					r.Header.Del(name)
+				}
+			}
+			return nil
+		},
+		// reads stream instructions as guacd sends them
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.log(transportLog, nil).Warnf("Unable to forward request for tunnel %v to %v: %v", tunnelUUID, node, err)
+			w.Header().Set(TunnelOwnerHeader, node)
+			s.sendError(w, UpstreamUnavailable, "Tunnel owner unavailable.")
+		},
+	}
+	proxy.ServeHTTP(response, request)
+	return true
+}
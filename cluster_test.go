@@ -0,0 +1,83 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestServer_RouteToOwner(t *testing.T) {
+	redis := newFakeRedis(t)
+	written := make(chanWriter, 1)
+	tunnelUUID := uuid.New().String()
+
+	registryA := NewRedisRegistry(redis.listener.Addr().String(), "")
+	serverA := NewServerWithRegistry(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: written}, uuid: tunnelUUID}, nil
+	}, registryA)
+	httpA := httptest.NewServer(serverA)
+	defer httpA.Close()
+	registryA.Node = httpA.URL + "/tunnel"
+	if err := registryA.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	registryB := NewRedisRegistry(redis.listener.Addr().String(), "")
+	serverB := NewServerWithRegistry(nil, registryB)
+	httpB := httptest.NewServer(serverB)
+	defer httpB.Close()
+	registryB.Node = httpB.URL + "/tunnel"
+	if err := registryB.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.Post(httpA.URL+"/tunnel?connect", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+
+	response, err = http.Post(httpB.URL+"/tunnel?write:"+tunnelUUID, "application/octet-stream", strings.NewReader("4.sync,1.1;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusNotFound || response.Header.Get(TunnelOwnerHeader) != registryA.Node {
+		t.Errorf("Expected a redirect hint to a, got %v %q", response.Status, response.Header.Get(TunnelOwnerHeader))
+	}
+
+	serverB.ForwardToOwner = true
+	cors := &CORSPolicy{AllowedOrigins: OriginAllowlist{"https://app.example.com"}}
+	serverA.CORS, serverB.CORS = cors, cors
+	request, _ := http.NewRequest(http.MethodPost, httpB.URL+"/tunnel?write:"+tunnelUUID, strings.NewReader("4.sync,1.1;"))
+	request.Header.Set("Origin", "https://app.example.com")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected forwarded write to succeed, got %v", response.Status)
+	}
+	if origins := response.Header.Values("Access-Control-Allow-Origin"); len(origins) != 1 {
+		t.Errorf("Expected the forwarded response to allow the origin once, got %q", origins)
+	}
+	select {
+	case data := <-written:
+		if data != "4.sync,1.1;" {
+			t.Errorf("Unexpected data written %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected write to reach the tunnel on a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	serverA.Shutdown(ctx)
+	serverB.Shutdown(ctx)
+}
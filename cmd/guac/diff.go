@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/wwt/guac"
+)
+
+// diffCommand compares two recorded instruction streams, exiting with 1 if they differ and 2
+// if they can't be compared, like diff(1):
+//
+//	guac diff [-context n] [-ignore opcodes] [-timestamps] [-streams] [-no-blobs] a.guac b.guac
+func diffCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	context := flags.Int("context", guac.DefaultDiffContext, "unchanged instructions to show around each change")
+	ignore := flags.String("ignore", strings.Join(guac.DefaultDiffIgnore, ","), "comma separated opcodes to leave out")
+	options := &guac.DiffOptions{}
+	flags.BoolVar(&options.KeepTimestamps, "timestamps", false, "compare sync timestamps")
+	flags.BoolVar(&options.KeepStreamIndexes, "streams", false, "compare stream indexes as sent")
+	flags.BoolVar(&options.IgnoreBlobData, "no-blobs", false, "don't compare the data of blobs")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: guac diff [flags] a b")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	options.Ignore = []string{}
+	for _, opcode := range strings.Split(*ignore, ",") {
+		if opcode = strings.TrimSpace(opcode); opcode != "" {
+			options.Ignore = append(options.Ignore, opcode)
+		}
+	}
+
+	var streams [2][]*guac.Instruction
+	for i, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		streams[i], err = guac.ReadInstructions(file)
+		_ = file.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "%v: %v\n", name, err)
+			return 2
+		}
+	}
+
+	lines := guac.DiffInstructions(streams[0], streams[1], options)
+	for _, line := range lines {
+		if line.Op == guac.DiffEqual {
+			continue
+		}
+		fmt.Fprintf(stdout, "--- %v\n+++ %v\n", flags.Arg(0), flags.Arg(1))
+		if _, err := guac.WriteDiff(stdout, lines, *context); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
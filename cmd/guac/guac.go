@@ -1,26 +1,47 @@
 package main
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"io"
-	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac"
+	"github.com/wwt/guac/metrics"
 )
 
 var (
 	certPath    string
 	certKeyPath string
 	guacdAddr   = "127.0.0.1:4822"
+
+	// resolver caches lookups for both guacd and the target hosts
+	resolver = guac.NewCachingResolver(guac.DefaultResolverTTL)
+	dialer   = &guac.Dialer{Resolver: resolver}
+
+	meters *metrics.Metrics
+
+	// connectionTokens decrypts the connection tokens of connect requests, if configured
+	connectionTokens *guac.ConnectionTokens
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(diffCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	logrus.SetLevel(logrus.DebugLevel)
 
 	if os.Getenv("CERT_PATH") != "" {
@@ -43,8 +64,58 @@ func main() {
 		guacdAddr = os.Getenv("GUACD_ADDRESS")
 	}
 
+	var err error
+	if key := os.Getenv("CONNECTION_TOKEN_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			logrus.Fatal("CONNECTION_TOKEN_KEY must be base64 encoded: ", err)
+		}
+		connectionTokens = &guac.ConnectionTokens{Key: decoded}
+	}
+
+	if meters, err = metrics.New(prometheus.DefaultRegisterer); err != nil {
+		logrus.Fatal(err)
+	}
+
 	servlet := guac.NewServer(DemoDoConnect)
 	wsServer := guac.NewWebsocketServer(DemoDoConnect)
+	servlet.Metrics = meters
+	wsServer.Metrics = meters
+	counters := guac.NewCounters("guac")
+	servlet.Counters = counters
+	wsServer.Counters = counters
+
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		allowed := guac.OriginAllowlist(strings.Split(origins, ","))
+		wsServer.AllowedOrigins = allowed
+		servlet.CORS = &guac.CORSPolicy{AllowedOrigins: allowed, AllowCredentials: true}
+	}
+
+	if allow, deny := os.Getenv("ALLOWED_NETWORKS"), os.Getenv("DENIED_NETWORKS"); allow != "" || deny != "" {
+		filter, err := guac.NewIPFilter(strings.Split(allow, ","), strings.Split(deny, ","))
+		if err != nil {
+			logrus.Fatal("Invalid ALLOWED_NETWORKS or DENIED_NETWORKS: ", err)
+		}
+		if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+			if filter.TrustedProxies, err = strconv.Atoi(proxies); err != nil {
+				logrus.Fatal("Invalid TRUSTED_PROXIES: ", err)
+			}
+			// the forwarded address is only trusted from the proxies themselves
+			for _, network := range strings.Split(os.Getenv("PROXY_NETWORKS"), ",") {
+				prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+				if err != nil {
+					logrus.Fatal("TRUSTED_PROXIES requires PROXY_NETWORKS, the CIDRs of the proxies: ", err)
+				}
+				filter.Proxies = append(filter.Proxies, prefix.Masked())
+			}
+		}
+		servlet.IPFilter = filter
+		wsServer.IPFilter = filter
+	}
+
+	maintenance := &guac.Maintenance{}
+	servlet.Maintenance = maintenance
+	wsServer.Maintenance = maintenance
 
 	sessions := guac.NewMemorySessionStore()
 	wsServer.OnConnect = sessions.Add
@@ -54,6 +125,23 @@ func main() {
 	mux.Handle("/tunnel", servlet)
 	mux.Handle("/tunnel/", servlet)
 	mux.Handle("/websocket-tunnel", wsServer)
+	mux.Handle("/terminal", guac.NewTerminalBridge(DemoDoConnect))
+	// the admin endpoints are only served with a token to authenticate them
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		admin := adminAuthorizer(token)
+		mux.Handle("/admin/log", &guac.LogLevelServer{Authorizer: admin})
+		mux.Handle("/admin/tunnels", &guac.AdminServer{Server: servlet, Authorizer: admin})
+		maintenance.Authorizer = admin
+		mux.Handle("/admin/maintenance", maintenance)
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	probes := &guac.ProbeServer{
+		Servers:  []*guac.Server{servlet},
+		Backends: []*guac.Backend{{Address: guacdAddr, Dialer: dialer}},
+	}
+	mux.Handle("/healthz", probes)
+	mux.Handle("/readyz", probes)
 	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -122,6 +210,17 @@ func main() {
 	}
 }
 
+// adminAuthorizer authenticates admin requests bearing the token
+func adminAuthorizer(token string) guac.Authorizer {
+	return guac.AuthorizerFunc(func(r *http.Request) (*guac.Identity, error) {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			return nil, errors.New("invalid admin token")
+		}
+		return &guac.Identity{Subject: "admin"}, nil
+	})
+}
+
 // DemoDoConnect creates the tunnel to the remote machine (via guacd)
 func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 	config := guac.NewGuacamoleConfiguration()
@@ -135,65 +234,73 @@ func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 			return nil, err
 		}
 		_ = request.Body.Close()
-		queryString := string(data)
-		query, err = url.ParseQuery(queryString)
+		query, err = url.ParseQuery(string(data))
 		if err != nil {
 			logrus.Error("Failed to parse body query ", err)
 			return nil, err
 		}
-		logrus.Debugln("body:", queryString, query)
 	} else {
 		query = request.URL.Query()
 	}
 
-	config.Protocol = query.Get("scheme")
-	config.Parameters = map[string]string{}
-	for k, v := range query {
-		config.Parameters[k] = v[0]
-	}
-
 	var err error
-	if query.Get("width") != "" {
-		config.OptimalScreenHeight, err = strconv.Atoi(query.Get("width"))
-		if err != nil || config.OptimalScreenHeight == 0 {
-			logrus.Error("Invalid height")
-			config.OptimalScreenHeight = 600
+	if connectionTokens != nil {
+		// with a key configured, connections are only defined by tokens, so the client can't
+		// choose its own target or parameters
+		token := query.Get(guac.ConnectionTokenParameter)
+		if token == "" {
+			logrus.Errorln("connect request without a connection token")
+			return nil, guac.ErrUnauthorized.NewError("No connection token.")
 		}
-	}
-	if query.Get("height") != "" {
-		config.OptimalScreenWidth, err = strconv.Atoi(query.Get("height"))
-		if err != nil || config.OptimalScreenWidth == 0 {
-			logrus.Error("Invalid width")
-			config.OptimalScreenWidth = 800
+		if config, err = connectionTokens.Config(token); err != nil {
+			logrus.Errorln("invalid connection token", err)
+			return nil, err
+		}
+	} else {
+		config.Protocol = query.Get("scheme")
+		config.Parameters = map[string]string{}
+		for k, v := range query {
+			config.Parameters[k] = v[0]
 		}
-	}
-	config.AudioMimetypes = []string{"audio/L16", "rate=44100", "channels=2"}
 
-	logrus.Debug("Connecting to guacd")
-	addr, err := net.ResolveTCPAddr("tcp", guacdAddr)
-	if err != nil {
-		logrus.Errorln("error resolving guacd address", err)
-		return nil, err
+		if query.Get("width") != "" {
+			config.OptimalScreenHeight, err = strconv.Atoi(query.Get("width"))
+			if err != nil || config.OptimalScreenHeight == 0 {
+				logrus.Error("Invalid height")
+				config.OptimalScreenHeight = 600
+			}
+		}
+		if query.Get("height") != "" {
+			config.OptimalScreenWidth, err = strconv.Atoi(query.Get("height"))
+			if err != nil || config.OptimalScreenWidth == 0 {
+				logrus.Error("Invalid width")
+				config.OptimalScreenWidth = 800
+			}
+		}
+		config.AudioMimetypes = []string{"audio/L16", "rate=44100", "channels=2"}
 	}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		logrus.Errorln("error while connecting to guacd", err)
+	if err = guac.Preflight(request.Context(), resolver, config); err != nil {
+		logrus.Errorln("target preflight failed", err)
 		return nil, err
 	}
 
-	stream := guac.NewStream(conn, guac.SocketTimeout)
-
-	logrus.Debug("Connected to guacd")
-	if request.URL.Query().Get("uuid") != "" {
-		config.ConnectionID = request.URL.Query().Get("uuid")
+	if uuid := request.URL.Query().Get("uuid"); uuid != "" {
+		if connectionTokens != nil {
+			// only the token may name the session to join
+			logrus.Errorln("connect request joining a session outside its connection token")
+			return nil, guac.ErrUnauthorized.NewError("Sessions may only be joined by connection token.")
+		}
+		config.ConnectionID = uuid
 	}
 
-	sanitisedCfg := config
-	sanitisedCfg.Parameters["password"] = "********"
-	logrus.Debugf("Starting handshake with %#v", sanitisedCfg)
-	err = stream.Handshake(config)
+	logrus.Debugf("Connecting to guacd with protocol %v, connection %v and parameters %v",
+		config.Protocol, config.ConnectionID, guac.RedactParameters(config.Parameters))
+
+	backend := &guac.Backend{Address: guacdAddr, Dialer: dialer, Retries: 2, Metrics: meters}
+	stream, err := backend.Connect(request.Context(), config)
 	if err != nil {
+		logrus.Errorln("error while connecting to guacd", err)
 		return nil, err
 	}
 	logrus.Debug("Socket configured")
@@ -5,22 +5,30 @@ type Config struct {
 	// ConnectionID is used to reconnect to an existing session, otherwise leave blank for a new session.
 	ConnectionID string
 	// Protocol is the protocol of the connection from guacd to the remote (rdp, ssh, etc).
-	Protocol     string
+	Protocol string
 	// Parameters are used to configure protocol specific options like sla for rdp or terminal color schemes.
-	Parameters   map[string]string
+	Parameters map[string]string
 
 	// OptimalScreenWidth is the desired width of the screen
-	OptimalScreenWidth  int
+	OptimalScreenWidth int
 	// OptimalScreenHeight is the desired height of the screen
 	OptimalScreenHeight int
 	// OptimalResolution is the desired resolution of the screen
-	OptimalResolution   int
+	OptimalResolution int
 	// AudioMimetypes is an array of the supported audio types
-	AudioMimetypes      []string
+	AudioMimetypes []string
 	// VideoMimetypes is an array of the supported video types
-	VideoMimetypes      []string
+	VideoMimetypes []string
 	// ImageMimetypes is an array of the supported image types
-	ImageMimetypes      []string
+	ImageMimetypes []string
+
+	// UserName is the name guacd uses to announce the user to others sharing the connection,
+	// sent to guacd 1.5.0 and later
+	UserName string
+
+	// ParameterFunc optionally computes parameters once guacd has said which it needs, taking
+	// precedence over Parameters
+	ParameterFunc ParameterFunc
 }
 
 // NewGuacamoleConfiguration returns a Config with sane defaults
@@ -35,3 +43,21 @@ func NewGuacamoleConfiguration() *Config {
 		ImageMimetypes:      make([]string, 0, 1),
 	}
 }
+
+// NewJoinConfiguration returns a Config with sane defaults which joins the existing connection
+// with the given ID, as returned by Tunnel.ConnectionID, to share its session. Joining users
+// may be limited to watching with readOnly, for protocols which support it.
+func NewJoinConfiguration(connectionID string, readOnly bool) *Config {
+	config := NewGuacamoleConfiguration()
+	config.ConnectionID = connectionID
+	if readOnly {
+		config.Parameters["read-only"] = "true"
+	}
+	return config
+}
+
+// IsConnectionID returns true if id has the form of the IDs guacd gives connections, which
+// begin with "$"
+func IsConnectionID(id string) bool {
+	return len(id) > 1 && id[0] == '$'
+}
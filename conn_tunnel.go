@@ -0,0 +1,39 @@
+package guac
+
+import (
+	"io"
+	"net"
+)
+
+// NewConnTunnel wraps a connection which already speaks the Guacamole protocol as a tunnel,
+// such as one end of a net.Pipe in tests, or a connection to guacd made through a custom
+// transport and handshake. The connection is read and written with SocketTimeout, and closed
+// with the tunnel.
+func NewConnTunnel(conn net.Conn) *SimpleTunnel {
+	return NewSimpleTunnel(NewStream(conn, SocketTimeout))
+}
+
+// NewReadWriterTunnel wraps anything which reads and writes the Guacamole protocol as a
+// tunnel. As a plain io.ReadWriter has no deadlines, its data is copied through a net.Pipe
+// which has, so timeouts and the probes of a Reaper behave as for a network connection.
+// Closing the tunnel closes rw if it is an io.Closer, which must unblock a read in progress
+// for the copy to end.
+func NewReadWriterTunnel(rw io.ReadWriter) *SimpleTunnel {
+	local, remote := net.Pipe()
+	go func() {
+		if _, err := io.Copy(remote, rw); err != nil {
+			transportLog.Debug("Read from tunnel connection failed: ", err)
+		}
+		_ = remote.Close()
+	}()
+	go func() {
+		if _, err := io.Copy(rw, remote); err != nil {
+			transportLog.Debug("Write to tunnel connection failed: ", err)
+		}
+		_ = remote.Close()
+		if closer, ok := rw.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}()
+	return NewConnTunnel(local)
+}
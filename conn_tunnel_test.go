@@ -0,0 +1,41 @@
+package guac
+
+import (
+	"io"
+	"testing"
+)
+
+func TestNewReadWriterTunnel(t *testing.T) {
+	fromGuacd, toTunnel := io.Pipe()
+	fromTunnel, toGuacd := io.Pipe()
+	tunnel := NewReadWriterTunnel(struct {
+		io.Reader
+		io.Writer
+	}{fromGuacd, toGuacd})
+	defer tunnel.Close()
+
+	go func() {
+		_, _ = toTunnel.Write([]byte("4.sync,1.1;"))
+	}()
+	reader := tunnel.AcquireReader()
+	message, err := reader.ReadSome()
+	tunnel.ReleaseReader()
+	if err != nil || string(message) != "4.sync,1.1;" {
+		t.Errorf("Unexpected read %q, %v", message, err)
+	}
+
+	go func() {
+		_, _ = tunnel.AcquireWriter().Write([]byte("3.ack,1.1;"))
+		tunnel.ReleaseWriter()
+	}()
+	written := make([]byte, len("3.ack,1.1;"))
+	if _, err := io.ReadFull(fromTunnel, written); err != nil || string(written) != "3.ack,1.1;" {
+		t.Errorf("Unexpected write %q, %v", written, err)
+	}
+
+	_ = toTunnel.Close()
+	if _, err := tunnel.AcquireReader().ReadSome(); err == nil {
+		t.Error("Expected the tunnel to fail once the connection ends")
+	}
+	tunnel.ReleaseReader()
+}
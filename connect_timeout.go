@@ -0,0 +1,62 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// DefaultConnectTimeout bounds the connect callback, along with the handshake with guacd it
+// performs, when the ConnectTimeout of a server is zero
+const DefaultConnectTimeout = 15 * time.Second
+
+// connectTimeout returns the timeout to apply given the option of a server, zero for none
+func connectTimeout(option time.Duration) time.Duration {
+	switch {
+	case option == 0:
+		return DefaultConnectTimeout
+	case option < 0:
+		return 0
+	default:
+		return option
+	}
+}
+
+// connectWithTimeout calls connect with the request, whose context is cancelled once timeout
+// passes, failing with ErrUpstreamTimeout if connect hasn't returned by then. A tunnel
+// connect returns too late is closed. A timeout of zero waits as long as connect takes.
+func connectWithTimeout(r *http.Request, timeout time.Duration, connect func(*http.Request) (Tunnel, error)) (Tunnel, error) {
+	if timeout <= 0 {
+		return connect(r)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	type connectResult struct {
+		tunnel Tunnel
+		err    error
+	}
+	// buffered so a connect returning too late doesn't block forever
+	results := make(chan connectResult, 1)
+	go func() {
+		tunnel, err := connect(r.WithContext(ctx))
+		results <- connectResult{tunnel: tunnel, err: err}
+	}()
+
+	select {
+	case result := <-results:
+		return result.tunnel, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-results; result.tunnel != nil {
+				transportLog.Debug("Closing tunnel connected after the connect timeout.")
+				_ = result.tunnel.Close()
+			}
+		}()
+		if r.Context().Err() != nil {
+			// the client went away, so no one is told
+			return nil, ErrConnectionClosed.NewError("Client went away while connecting.")
+		}
+		return nil, ErrUpstreamTimeout.NewError("Timed out connecting to guacd.")
+	}
+}
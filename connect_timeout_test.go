@@ -0,0 +1,50 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type closeTrackingTunnel struct {
+	fakeTunnel
+	closed chan struct{}
+}
+
+func (t *closeTrackingTunnel) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func TestServer_ConnectTimeout(t *testing.T) {
+	late := &closeTrackingTunnel{closed: make(chan struct{})}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		// an unresponsive guacd connects once the request gives up
+		<-r.Context().Done()
+		return late, nil
+	})
+	server.ConnectTimeout = 20 * time.Millisecond
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	if code := recorder.Header().Get("Guacamole-Status-Code"); code != strconv.Itoa(UpstreamTimeout.GetGuacamoleStatusCode()) {
+		t.Error("Expected an upstream timeout, got", code, recorder.Body.String())
+	}
+	if server.tunnels.Len() != 0 {
+		t.Error("Expected no tunnel to be registered")
+	}
+
+	select {
+	case <-late.closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the tunnel connected too late to be closed")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	if connectTimeout(0) != DefaultConnectTimeout || connectTimeout(-1) != 0 || connectTimeout(time.Second) != time.Second {
+		t.Error("Unexpected connect timeouts")
+	}
+}
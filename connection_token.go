@@ -0,0 +1,198 @@
+package guac
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ConnectionTokenParameter is the connect request parameter conventionally carrying an
+// encrypted connection token
+const ConnectionTokenParameter = "token"
+
+// DefaultConnectionTokenMaxAge is the longest a connection token may remain valid when
+// ConnectionTokens has no MaxAge
+const DefaultConnectionTokenMaxAge = time.Hour
+
+// ConnectionDefinition is the connection carried by a connection token. Its layout follows
+// guacamole-lite: settings are the connection parameters, and may also hold the width, height
+// and dpi of the display and the audio, video and image mimetypes the client supports.
+type ConnectionDefinition struct {
+	// Type is the protocol, such as "rdp" or "ssh"
+	Type string `json:"type"`
+	// Join optionally names the connection ID of a session to join instead
+	Join string `json:"join,omitempty"`
+	// Settings hold the connection parameters, as strings, numbers or booleans
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// ConnectionToken is the content of an encrypted connection token
+type ConnectionToken struct {
+	Connection ConnectionDefinition `json:"connection"`
+	// Expires is when the token stops being accepted, in seconds since the epoch. Tokens
+	// without an expiry are refused.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// ConnectionTokens encrypts and decrypts connection tokens, which carry the full definition of
+// a connection including its credentials, so a stateless frontend can hand the browser a token
+// rather than connection parameters. Tokens are the URL-safe base64 of a random nonce followed
+// by the AES-GCM encryption of the token's JSON, so they can't be read or forged without the
+// key.
+type ConnectionTokens struct {
+	// Key is the AES key shared with the frontend, of 16, 24 or 32 bytes
+	Key []byte
+	// MaxAge is the longest a token may remain valid, refusing tokens expiring further in
+	// the future; zero means DefaultConnectionTokenMaxAge
+	MaxAge time.Duration
+}
+
+func (c *ConnectionTokens) maxAge() time.Duration {
+	if c.MaxAge > 0 {
+		return c.MaxAge
+	}
+	return DefaultConnectionTokenMaxAge
+}
+
+func (c *ConnectionTokens) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.Key)
+	if err != nil {
+		return nil, ErrServer.NewError("Invalid connection token key: " + err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns the connection token carrying token
+func (c *ConnectionTokens) Encrypt(token *ConnectionToken) (string, error) {
+	aead, err := c.aead()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return "", ErrServer.NewError(err.Error())
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", ErrServer.NewError(err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Decrypt returns the content of a connection token, refusing tokens which can't be decrypted,
+// have no expiry, have expired or expire further ahead than MaxAge with ErrUnauthorized
+func (c *ConnectionTokens) Decrypt(token string) (*ConnectionToken, error) {
+	aead, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrUnauthorized.NewError("Malformed connection token.")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrUnauthorized.NewError("Invalid connection token.")
+	}
+	decrypted := &ConnectionToken{}
+	if err = json.Unmarshal(plaintext, decrypted); err != nil {
+		return nil, ErrUnauthorized.NewError("Malformed connection token.")
+	}
+	now, expires := time.Now(), time.Unix(decrypted.Expires, 0)
+	switch {
+	case decrypted.Expires == 0:
+		return nil, ErrUnauthorized.NewError("Connection token has no expiry.")
+	case !now.Before(expires):
+		return nil, ErrUnauthorized.NewError("Connection token has expired.")
+	case expires.Sub(now) > c.maxAge():
+		return nil, ErrUnauthorized.NewError("Connection token expires too far ahead.")
+	}
+	return decrypted, nil
+}
+
+// Config decrypts a connection token into the configuration of its connection
+func (c *ConnectionTokens) Config(token string) (*Config, error) {
+	decrypted, err := c.Decrypt(token)
+	if err != nil {
+		return nil, err
+	}
+	return decrypted.Connection.Config()
+}
+
+// Config returns the configuration of the connection, with the defaults of
+// NewGuacamoleConfiguration for the display settings it doesn't give
+func (d *ConnectionDefinition) Config() (*Config, error) {
+	if d.Join != "" {
+		return NewJoinConfiguration(d.Join, false), nil
+	}
+	if d.Type == "" {
+		return nil, ErrClient.NewError("Connection token has no connection type.")
+	}
+	config := NewGuacamoleConfiguration()
+	config.Protocol = d.Type
+	for name, value := range d.Settings {
+		var err error
+		switch name {
+		case "width":
+			config.OptimalScreenWidth, err = settingInt(value)
+		case "height":
+			config.OptimalScreenHeight, err = settingInt(value)
+		case "dpi":
+			config.OptimalResolution, err = settingInt(value)
+		case "audio":
+			config.AudioMimetypes, err = settingStrings(value)
+		case "video":
+			config.VideoMimetypes, err = settingStrings(value)
+		case "image":
+			config.ImageMimetypes, err = settingStrings(value)
+		default:
+			config.Parameters[name], err = settingString(value)
+		}
+		if err != nil {
+			return nil, ErrClient.NewError(fmt.Sprintf("Invalid connection setting %v: %v", name, err))
+		}
+	}
+	return config, nil
+}
+
+func settingString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected %T", value)
+}
+
+func settingInt(value interface{}) (int, error) {
+	s, err := settingString(value)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+func settingStrings(value interface{}) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected %T", value)
+	}
+	list := make([]string, len(values))
+	for i, v := range values {
+		var err error
+		if list[i], err = settingString(v); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
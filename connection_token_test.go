@@ -0,0 +1,70 @@
+package guac
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConnectionTokens(t *testing.T) {
+	tokens := &ConnectionTokens{Key: []byte("0123456789abcdef0123456789abcdef")}
+	var token ConnectionToken
+	if err := json.Unmarshal([]byte(`{"connection":{"type":"rdp","settings":{
+		"hostname":"10.0.0.1","port":3389,"password":"hunter2","ignore-cert":true,
+		"width":1280,"height":"720","audio":["audio/L16"]}}}`), &token); err != nil {
+		t.Fatal(err)
+	}
+	token.Expires = time.Now().Add(time.Minute).Unix()
+	encrypted, err := tokens.Encrypt(&token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := tokens.Config(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Protocol != "rdp" || config.OptimalScreenWidth != 1280 || config.OptimalScreenHeight != 720 || config.OptimalResolution != 96 {
+		t.Errorf("Unexpected config %#v", config)
+	}
+	if config.Parameters["hostname"] != "10.0.0.1" || config.Parameters["port"] != "3389" ||
+		config.Parameters["password"] != "hunter2" || config.Parameters["ignore-cert"] != "true" {
+		t.Errorf("Unexpected parameters %v", config.Parameters)
+	}
+	if len(config.AudioMimetypes) != 1 || config.AudioMimetypes[0] != "audio/L16" {
+		t.Error("Unexpected audio mimetypes", config.AudioMimetypes)
+	}
+
+	if _, err = (&ConnectionTokens{Key: []byte("fedcba9876543210fedcba9876543210")}).Config(encrypted); err == nil {
+		t.Error("Expected a token encrypted with another key to be refused")
+	}
+	tampered := []byte(encrypted)
+	tampered[len(tampered)/2] ^= 1
+	if _, err = tokens.Config(string(tampered)); err == nil {
+		t.Error("Expected a tampered token to be refused")
+	}
+
+	token.Expires = time.Now().Add(-time.Second).Unix()
+	encrypted, _ = tokens.Encrypt(&token)
+	if _, err = tokens.Config(encrypted); err == nil {
+		t.Error("Expected an expired token to be refused")
+	}
+	token.Expires = 0
+	encrypted, _ = tokens.Encrypt(&token)
+	if _, err = tokens.Config(encrypted); err == nil {
+		t.Error("Expected a token without an expiry to be refused")
+	}
+	token.Expires = time.Now().Add(2 * DefaultConnectionTokenMaxAge).Unix()
+	encrypted, _ = tokens.Encrypt(&token)
+	if _, err = tokens.Config(encrypted); err == nil {
+		t.Error("Expected a token expiring further ahead than MaxAge to be refused")
+	}
+
+	encrypted, _ = tokens.Encrypt(&ConnectionToken{
+		Connection: ConnectionDefinition{Join: "$abc"},
+		Expires:    time.Now().Add(time.Minute).Unix(),
+	})
+	if config, err = tokens.Config(encrypted); err != nil || config.ConnectionID != "$abc" {
+		t.Errorf("Expected a token joining a connection, got %#v %v", config, err)
+	}
+}
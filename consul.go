@@ -0,0 +1,355 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultConsulAddress is the Consul agent a ConsulRegistry talks to when its Address is
+	// empty
+	DefaultConsulAddress = "http://127.0.0.1:8500"
+	// DefaultConsulPrefix is the KV path under which a ConsulRegistry records tunnels when its
+	// Prefix is empty
+	DefaultConsulPrefix = "guac/tunnels/"
+	// DefaultConsulSessionTTL is the TTL of a ConsulRegistry's session when its TTL is zero.
+	// Consul does not accept TTLs under ten seconds.
+	DefaultConsulSessionTTL = 30 * time.Second
+)
+
+// ConsulRegistrySchema describes the entries a ConsulRegistry keeps in Consul's KV store.
+// Start checks the version recorded under the registry's prefix against it.
+var ConsulRegistrySchema = Schema{Name: "Consul tunnel registry", Version: 1}
+
+// consulSchemaKey is appended to the prefix to form the key recording the schema version
+const consulSchemaKey = "schema-version"
+
+// consulTimeout bounds each request to Consul
+const consulTimeout = 5 * time.Second
+
+/*
+ConsulRegistry is a TunnelRegistry for a cluster of servers like RedisRegistry, recording
+which server owns each tunnel in Consul's KV store. Its entries are held by a Consul session
+with a TTL which the registry keeps renewing, so if the server dies the session lapses and
+Consul deletes every entry it held, without waiting for each to expire.
+
+Node is the URL other servers reach this server's tunnel endpoint at. The exported fields
+must be set before Start is called, and Start before the registry is used.
+*/
+type ConsulRegistry struct {
+	// Node identifies this server, as the URL of its tunnel endpoint
+	Node string
+	// Address is the URL of the Consul agent, DefaultConsulAddress if empty
+	Address string
+	// Prefix is the KV path tunnels are recorded under, DefaultConsulPrefix if empty
+	Prefix string
+	// TTL is the TTL of the session holding the entries, DefaultConsulSessionTTL if zero
+	TTL time.Duration
+	// Token is optionally the ACL token sent with each request
+	Token string
+	// Client makes requests to Consul, http.DefaultClient if nil
+	Client *http.Client
+
+	local   *TunnelMap
+	stop    chan struct{}
+	once    sync.Once
+	started sync.Once
+
+	sessionLock sync.Mutex
+	session     string
+}
+
+// NewConsulRegistry creates a registry recording tunnel ownership in Consul. Its session is
+// created once the first tunnel is registered, and renewed once Start is called.
+func NewConsulRegistry(node string) *ConsulRegistry {
+	return &ConsulRegistry{
+		Node:  node,
+		local: NewTunnelMap(),
+		stop:  make(chan struct{}),
+	}
+}
+
+func (r *ConsulRegistry) key(uuid string) string {
+	if r.Prefix == "" {
+		return DefaultConsulPrefix + uuid
+	}
+	return r.Prefix + uuid
+}
+
+func (r *ConsulRegistry) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return DefaultConsulSessionTTL
+	}
+	return r.TTL
+}
+
+// do makes a request to the Consul HTTP API, returning the response body of a 2xx response
+// and ok false for a 404
+func (r *ConsulRegistry) do(method, path string, body []byte) (data []byte, ok bool, err error) {
+	address := r.Address
+	if address == "" {
+		address = DefaultConsulAddress
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), consulTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(address, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	if r.Token != "" {
+		request.Header.Set("X-Consul-Token", r.Token)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, false, err
+	}
+	defer response.Body.Close()
+	data, err = io.ReadAll(response.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return nil, false, nil
+	case response.StatusCode/100 != 2:
+		return nil, false, fmt.Errorf("consul: %v %v: %v %s", method, path, response.Status, bytes.TrimSpace(data))
+	}
+	return data, true, nil
+}
+
+// CheckHealth returns an error unless the Consul agent knows the leader of its cluster
+func (r *ConsulRegistry) CheckHealth(ctx context.Context) error {
+	leader, _, err := r.do(http.MethodGet, "/v1/status/leader", nil)
+	if err == nil && len(bytes.Trim(bytes.TrimSpace(leader), `"`)) == 0 {
+		err = fmt.Errorf("consul: no cluster leader")
+	}
+	return err
+}
+
+// SchemaVersion returns the schema version recorded in Consul, zero if none is.
+func (r *ConsulRegistry) SchemaVersion(ctx context.Context) (int, error) {
+	data, ok, err := r.do(http.MethodGet, "/v1/kv/"+r.key(consulSchemaKey)+"?raw", nil)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(data)))
+}
+
+// SetSchemaVersion records the schema version in Consul. The entry is not held by the
+// registry's session, so it outlives the server.
+func (r *ConsulRegistry) SetSchemaVersion(ctx context.Context, version int) error {
+	_, _, err := r.do(http.MethodPut, "/v1/kv/"+r.key(consulSchemaKey), []byte(strconv.Itoa(version)))
+	return err
+}
+
+// Start checks the entries in Consul against ConsulRegistrySchema, migrating them if needed,
+// and begins renewing the registry's session. It must be called before the registry is
+// used; an error means the entries were written by an incompatible version and the registry
+// must not be used.
+func (r *ConsulRegistry) Start(ctx context.Context) error {
+	if err := ConsulRegistrySchema.Check(ctx, r); err != nil {
+		return err
+	}
+	r.started.Do(func() {
+		go r.renewTask()
+	})
+	return nil
+}
+
+// currentSession returns the registry's session, creating one if it has none
+func (r *ConsulRegistry) currentSession() (string, error) {
+	r.sessionLock.Lock()
+	defer r.sessionLock.Unlock()
+	if r.session != "" {
+		return r.session, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"Name":      "guac " + r.Node,
+		"TTL":       r.ttl().String(),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+	data, _, err := r.do(http.MethodPut, "/v1/session/create", body)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		ID string
+	}
+	if err = json.Unmarshal(data, &created); err != nil || created.ID == "" {
+		return "", fmt.Errorf("consul: unexpected session %q", data)
+	}
+	r.session = created.ID
+	return r.session, nil
+}
+
+// claim records this node as the owner of the tunnel, held by the registry's session
+func (r *ConsulRegistry) claim(uuid string) error {
+	session, err := r.currentSession()
+	if err != nil {
+		return err
+	}
+	data, _, err := r.do(http.MethodPut, "/v1/kv/"+r.key(uuid)+"?acquire="+url.QueryEscape(session), []byte(r.Node))
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(data)) != "true" {
+		return fmt.Errorf("consul: tunnel %v is held by another session", uuid)
+	}
+	return nil
+}
+
+// release removes the entry of the tunnel if this node still owns it
+func (r *ConsulRegistry) release(uuid string) {
+	owner, ok, err := r.do(http.MethodGet, "/v1/kv/"+r.key(uuid)+"?raw", nil)
+	if err == nil && (!ok || string(owner) != r.Node) {
+		return
+	}
+	if err == nil {
+		_, _, err = r.do(http.MethodDelete, "/v1/kv/"+r.key(uuid), nil)
+	}
+	if err != nil {
+		registryLog.Warnf("Unable to release tunnel %v in Consul: %v", uuid, err)
+	}
+}
+
+// renewTask renews the session every half TTL. If Consul has lost the session, such as after
+// the server was unreachable for longer than the TTL, a new one is created and the tunnels
+// are claimed again.
+func (r *ConsulRegistry) renewTask() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(r.ttl() / 2):
+		}
+
+		r.sessionLock.Lock()
+		session := r.session
+		r.sessionLock.Unlock()
+		if session == "" {
+			continue
+		}
+		_, ok, err := r.do(http.MethodPut, "/v1/session/renew/"+session, nil)
+		if err != nil {
+			registryLog.Warnf("Unable to renew Consul session: %v", err)
+			continue
+		}
+		if ok {
+			continue
+		}
+
+		registryLog.Warn("Consul session expired, claiming tunnels again.")
+		r.sessionLock.Lock()
+		if r.session == session {
+			r.session = ""
+		}
+		r.sessionLock.Unlock()
+		r.local.Range(func(uuid string, _ *LastAccessedTunnel) bool {
+			if err := r.claim(uuid); err != nil {
+				registryLog.Warnf("Unable to claim tunnel %v in Consul: %v", uuid, err)
+				return false
+			}
+			return true
+		})
+	}
+}
+
+// Register registers the tunnel locally and claims it in Consul. A failed claim is logged, leaving
+// the tunnel reachable only through this node.
+func (r *ConsulRegistry) Register(uuid string, tunnel *LastAccessedTunnel) {
+	r.local.Register(uuid, tunnel)
+	if err := r.claim(uuid); err != nil {
+		registryLog.Warnf("Unable to claim tunnel %v in Consul: %v", uuid, err)
+	}
+}
+
+// Get returns the tunnel with the given UUID if this node owns it.
+func (r *ConsulRegistry) Get(uuid string) (*LastAccessedTunnel, bool) {
+	return r.local.Get(uuid)
+}
+
+// Peek returns the tunnel with the given UUID if this node owns it, without recording an
+// access to it.
+func (r *ConsulRegistry) Peek(uuid string) (*LastAccessedTunnel, bool) {
+	return r.local.Peek(uuid)
+}
+
+// Remove deregisters the tunnel and releases its entry.
+func (r *ConsulRegistry) Remove(uuid string) (*LastAccessedTunnel, bool) {
+	tunnel, ok := r.local.Remove(uuid)
+	if ok {
+		r.release(uuid)
+	}
+	return tunnel, ok
+}
+
+// Len returns the number of tunnels owned by this node.
+func (r *ConsulRegistry) Len() int {
+	return r.local.Len()
+}
+
+// Range calls fn for each tunnel owned by this node until fn returns false.
+func (r *ConsulRegistry) Range(fn func(uuid string, tunnel *LastAccessedTunnel) bool) {
+	r.local.Range(fn)
+}
+
+// SetTimeout changes how long tunnels may go unused before they are closed, as with TunnelMap.
+func (r *ConsulRegistry) SetTimeout(timeout time.Duration) {
+	r.local.SetTimeout(timeout)
+}
+
+// SetOnExpire sets the function called with each tunnel closed for having timed out, after
+// its entry is released.
+func (r *ConsulRegistry) SetOnExpire(fn func(uuid string, tunnel *LastAccessedTunnel)) {
+	r.local.SetOnExpire(func(uuid string, tunnel *LastAccessedTunnel) {
+		r.release(uuid)
+		if fn != nil {
+			fn(uuid, tunnel)
+		}
+	})
+}
+
+// Locate returns the node owning the tunnel with the given UUID, if another node owns it.
+func (r *ConsulRegistry) Locate(uuid string) (string, bool) {
+	owner, ok, err := r.do(http.MethodGet, "/v1/kv/"+r.key(uuid)+"?raw", nil)
+	if err != nil {
+		registryLog.Warnf("Unable to look up tunnel %v in Consul: %v", uuid, err)
+		return "", false
+	}
+	return string(owner), ok && string(owner) != r.Node
+}
+
+// Shutdown stops renewing the session and destroys it, which deletes the entries of tunnels
+// still open.
+func (r *ConsulRegistry) Shutdown() {
+	r.once.Do(func() {
+		close(r.stop)
+		r.local.Shutdown()
+		r.sessionLock.Lock()
+		session := r.session
+		r.session = ""
+		r.sessionLock.Unlock()
+		if session == "" {
+			return
+		}
+		if _, _, err := r.do(http.MethodPut, "/v1/session/destroy/"+session, nil); err != nil {
+			registryLog.Warnf("Unable to destroy Consul session: %v", err)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type consulEntry struct {
+	value   string
+	session string
+}
+
+// fakeConsul implements the session and KV endpoints used by ConsulRegistry, deleting the
+// entries of destroyed sessions
+type fakeConsul struct {
+	sync.Mutex
+	sessions map[string]bool
+	kv       map[string]consulEntry
+	next     int
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	switch path := r.URL.Path; {
+	case path == "/v1/session/create":
+		f.next++
+		id := fmt.Sprintf("session-%d", f.next)
+		f.sessions[id] = true
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		if !f.sessions[strings.TrimPrefix(path, "/v1/session/renew/")] {
+			http.NotFound(w, r)
+		}
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		f.destroy(strings.TrimPrefix(path, "/v1/session/destroy/"))
+	case strings.HasPrefix(path, "/v1/kv/"):
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		entry, ok := f.kv[key]
+		switch r.Method {
+		case http.MethodGet:
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(entry.value))
+		case http.MethodPut:
+			session := r.URL.Query().Get("acquire")
+			if session == "" {
+				value, _ := io.ReadAll(r.Body)
+				f.kv[key] = consulEntry{value: string(value)}
+				_, _ = w.Write([]byte("true"))
+				return
+			}
+			if !f.sessions[session] || ok && entry.session != session {
+				_, _ = w.Write([]byte("false"))
+				return
+			}
+			value, _ := io.ReadAll(r.Body)
+			f.kv[key] = consulEntry{value: string(value), session: session}
+			_, _ = w.Write([]byte("true"))
+		case http.MethodDelete:
+			delete(f.kv, key)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) destroy(session string) {
+	delete(f.sessions, session)
+	for key, entry := range f.kv {
+		if entry.session == session {
+			delete(f.kv, key)
+		}
+	}
+}
+
+func (f *fakeConsul) owner(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.kv[key].value
+}
+
+func TestConsulRegistry(t *testing.T) {
+	consul := &fakeConsul{sessions: map[string]bool{}, kv: map[string]consulEntry{}}
+	httpServer := httptest.NewServer(consul)
+	defer httpServer.Close()
+
+	a := NewConsulRegistry("http://a/tunnel")
+	a.Address = httpServer.URL
+	a.TTL = 20 * time.Millisecond
+	defer a.Shutdown()
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b := NewConsulRegistry("http://b/tunnel")
+	b.Address = httpServer.URL
+	defer b.Shutdown()
+
+	a.Register("1", newRegisteredTunnel(&fakeTunnel{}, nil, nil))
+	a.Register("2", newRegisteredTunnel(&fakeTunnel{}, nil, nil))
+	if node, ok := b.Locate("1"); !ok || node != "http://a/tunnel" {
+		t.Fatalf("Expected b to locate the tunnel on a, got %q %v", node, ok)
+	}
+	if _, ok := a.Locate("1"); ok {
+		t.Error("Expected owner not to locate its own tunnel elsewhere")
+	}
+
+	if _, ok := a.Remove("1"); !ok {
+		t.Fatal("Expected a to remove its tunnel")
+	}
+	if _, ok := b.Locate("1"); ok {
+		t.Error("Expected removed tunnel not to be located")
+	}
+
+	// losing the session, as when the server is cut off from Consul, deletes its entries
+	// until the registry notices and claims its tunnels again
+	consul.Lock()
+	consul.destroy("session-1")
+	consul.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for consul.owner(DefaultConsulPrefix+"2") != "http://a/tunnel" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected tunnel to be claimed again with a new session")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	a.Shutdown()
+	if _, ok := b.Locate("2"); ok {
+		t.Error("Expected entries to be deleted with the session")
+	}
+}
+
+func TestConsulRegistry_Schema(t *testing.T) {
+	consul := &fakeConsul{sessions: map[string]bool{}, kv: map[string]consulEntry{}}
+	httpServer := httptest.NewServer(consul)
+	defer httpServer.Close()
+
+	a := NewConsulRegistry("http://a/tunnel")
+	a.Address = httpServer.URL
+	defer a.Shutdown()
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if version := consul.owner(DefaultConsulPrefix + consulSchemaKey); version != strconv.Itoa(ConsulRegistrySchema.Version) {
+		t.Fatalf("Expected fresh state to be stamped with the current version, got %q", version)
+	}
+
+	consul.Lock()
+	consul.kv[DefaultConsulPrefix+consulSchemaKey] = consulEntry{value: strconv.Itoa(ConsulRegistrySchema.Version + 1)}
+	consul.Unlock()
+	b := NewConsulRegistry("http://b/tunnel")
+	b.Address = httpServer.URL
+	defer b.Shutdown()
+	if err := b.Start(context.Background()); err == nil {
+		t.Error("Expected state written by a newer version to be refused")
+	}
+}
@@ -0,0 +1,151 @@
+package guac
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OriginAllowlist lists the origins of the pages allowed to use a tunnel, such as
+// "https://app.example.com". An entry may be "*" to allow any origin, or give a wildcard for
+// subdomains, as in "https://*.example.com". Requests without an Origin header, which browsers
+// always send cross-origin, are allowed.
+type OriginAllowlist []string
+
+// Allows returns true if the origin matches one of the list
+func (l OriginAllowlist) Allows(origin string) bool {
+	return origin == "" || l.anyOrigin() || l.lists(origin)
+}
+
+// anyOrigin returns true if the list has "*"
+func (l OriginAllowlist) anyOrigin() bool {
+	for _, allowed := range l {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// lists returns true if the origin matches an entry of the list other than "*"
+func (l OriginAllowlist) lists(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range l {
+		allowed = strings.ToLower(allowed)
+		if allowed == origin {
+			return true
+		}
+		scheme, domain, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+		if u, err := url.Parse(origin); err == nil && u.Scheme == scheme && strings.HasSuffix(u.Host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin returns ErrSecurity if the origin of the request is not in the list. A nil list
+// only allows the origin of the server itself, as the websocket upgrader does by default.
+func (l OriginAllowlist) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	allowed := l.Allows(origin)
+	if l == nil {
+		allowed = sameOrigin(r)
+	}
+	if allowed {
+		return nil
+	}
+	return ErrSecurity.NewError("Origin not allowed: " + origin)
+}
+
+// sameOrigin returns true if the request has no Origin header or its host is the host the
+// request was made to
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// DefaultCORSHeaders are the request headers allowed from cross-origin pages when the
+// AllowedHeaders of a CORSPolicy are nil
+var DefaultCORSHeaders = []string{"Content-Type", "Authorization", DefaultCSRFHeader, AccessTokenHeader, ResumeTokenHeader, ResumeOffsetHeader}
+
+// DefaultCORSExposedHeaders are the response headers cross-origin pages may read when the
+// ExposedHeaders of a CORSPolicy are nil, covering every header the HTTP tunnel sets
+var DefaultCORSExposedHeaders = []string{
+	"Guacamole-Status-Code", "Guacamole-Error-Message", AccessTokenHeader, ResumeTokenHeader,
+	ReplayOffsetHeader, ReauthenticateHeader, TunnelOwnerHeader, PollDelayHeader, ServerLoadHeader,
+	MaxBlobSizeHeader, MaxClipboardSizeHeader,
+}
+
+// CORSPolicy lets pages from other origins use the HTTP tunnel, answering preflight requests
+// and setting the CORS headers of responses. Requests from origins it doesn't allow are
+// refused with ClientForbidden rather than merely having their responses hidden, as read and
+// write requests act on the tunnel whether or not their response is read. Requests from the
+// origin of the server itself are always allowed.
+type CORSPolicy struct {
+	// AllowedOrigins are the origins of the pages allowed to use the tunnel
+	AllowedOrigins OriginAllowlist
+	// AllowCredentials lets the pages send cookies and HTTP authentication. Only the origins
+	// listed explicitly may: those allowed by "*" are answered with a literal "*" and no
+	// credentials, so any page can't act with the credentials of the user.
+	AllowCredentials bool
+	// AllowedHeaders are the request headers the pages may send, DefaultCORSHeaders if nil
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers the pages may read, DefaultCORSExposedHeaders
+	// if nil
+	ExposedHeaders []string
+	// MaxAge is optionally how long browsers may cache the answer to a preflight request
+	MaxAge time.Duration
+}
+
+// apply sets the CORS headers of the response to a request, returning true if it was a
+// preflight request which has been answered
+func (c *CORSPolicy) apply(w http.ResponseWriter, r *http.Request) (bool, error) {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || sameOrigin(r) {
+		// browsers send the Origin of some same-origin requests too, which need no CORS
+		return false, nil
+	}
+	if !c.AllowedOrigins.Allows(origin) {
+		return false, ErrSecurity.NewError("Origin not allowed: " + origin)
+	}
+	header := w.Header()
+	if c.AllowedOrigins.lists(origin) {
+		header.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		exposed := c.ExposedHeaders
+		if exposed == nil {
+			exposed = DefaultCORSExposedHeaders
+		}
+		header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		return false, nil
+	}
+
+	allowed := c.AllowedHeaders
+	if allowed == nil {
+		allowed = DefaultCORSHeaders
+	}
+	header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	header.Set("Access-Control-Allow-Headers", strings.Join(allowed, ", "))
+	if c.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true, nil
+}
@@ -0,0 +1,139 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowlist_Allows(t *testing.T) {
+	list := OriginAllowlist{"https://app.example.com", "https://*.example.org"}
+	for origin, allowed := range map[string]bool{
+		"":                         true,
+		"https://app.example.com":  true,
+		"HTTPS://APP.EXAMPLE.COM":  true,
+		"http://app.example.com":   false,
+		"https://evil.example.com": false,
+		"https://a.b.example.org":  true,
+		"https://example.org":      false,
+		"http://a.example.org":     false,
+		"https://evilexample.org":  false,
+	} {
+		if list.Allows(origin) != allowed {
+			t.Errorf("Expected origin %q allowed to be %v", origin, allowed)
+		}
+	}
+	if !(OriginAllowlist{"*"}).Allows("https://anywhere.example") {
+		t.Error("Expected * to allow any origin")
+	}
+}
+
+func TestServer_CORS(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.CORS = &CORSPolicy{AllowedOrigins: OriginAllowlist{"https://app.example.com"}, AllowCredentials: true, MaxAge: time.Hour}
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/tunnel?connect", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, preflight)
+	header := recorder.Header()
+	if recorder.Code != http.StatusNoContent || header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		header.Get("Access-Control-Allow-Credentials") != "true" || header.Get("Access-Control-Max-Age") != "3600" ||
+		!strings.Contains(header.Get("Access-Control-Allow-Headers"), DefaultCSRFHeader) {
+		t.Errorf("Unexpected preflight response %v %v", recorder.Code, header)
+	}
+	if server.tunnels.Len() != 0 {
+		t.Error("Expected a preflight request not to connect")
+	}
+
+	request := connectRequest("")
+	request.Header.Set("Origin", "https://app.example.com")
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Header().Get("Access-Control-Expose-Headers"), "Guacamole-Status-Code") {
+		t.Errorf("Unexpected response %v %v", recorder.Code, recorder.Header())
+	}
+
+	request = connectRequest("")
+	request.Header.Set("Origin", "http://"+request.Host)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected a same-origin request to be allowed without CORS, got %v %v", recorder.Code, recorder.Header())
+	}
+
+	request = connectRequest("")
+	request.Header.Set("Origin", "https://evil.example.com")
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected a request from another origin to be refused, got %v %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestServer_CORSAnyOrigin(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.CORS = &CORSPolicy{AllowedOrigins: OriginAllowlist{"*", "https://app.example.com"}, AllowCredentials: true}
+
+	for origin, want := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://evil.example.com": "*",
+	} {
+		request := connectRequest("")
+		request.Header.Set("Origin", origin)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		header := recorder.Header()
+		if header.Get("Access-Control-Allow-Origin") != want || (header.Get("Access-Control-Allow-Credentials") == "true") != (want != "*") {
+			t.Errorf("Unexpected CORS headers for %v: %v", origin, header)
+		}
+	}
+}
+
+func TestWebsocketServer_AllowedOrigins(t *testing.T) {
+	connected := false
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		connected = true
+		return &fakeTunnel{}, nil
+	})
+	server.AllowedOrigins = OriginAllowlist{"https://app.example.com"}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Fatal("Expected the handshake from another origin to be refused, got", err)
+	}
+	if connected {
+		t.Error("Expected the refused handshake not to connect")
+	}
+}
+
+func TestWebsocketServer_SameOrigin(t *testing.T) {
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return nil, ErrUpstreamNotFound.NewError()
+	})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Error("Expected the handshake from another origin to be refused, got", err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {httpServer.URL}})
+	if err != nil {
+		t.Fatal("Expected the handshake from the origin of the server to be allowed, got", err)
+	}
+	_ = ws.Close()
+}
@@ -0,0 +1,103 @@
+package guac
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultCSRFHeader is the header carrying the CSRF token of connect and write requests
+	// when the Header of CSRFProtection is empty
+	DefaultCSRFHeader = "Guacamole-CSRF-Token"
+	// DefaultCSRFCookie is the cookie holding the CSRF token when the Cookie of
+	// CSRFProtection is empty
+	DefaultCSRFCookie = "GUAC_CSRF"
+)
+
+// CSRFProtection defends the connect and write requests of an HTTP tunnel mounted on the same
+// origin as an authenticated web application against cross-site request forgery. They must be
+// POST requests carrying the Header, which a page on another site can't send without passing a
+// CORS preflight. With DoubleSubmit, the header must also repeat the token held in the Cookie,
+// which IssueCookie sets with SameSite=Strict, so a request sent with a user's cookies by
+// another site can't know it.
+type CSRFProtection struct {
+	// Header is the header connect and write requests must carry, DefaultCSRFHeader if empty
+	Header string
+	// DoubleSubmit requires the Header to hold the token of the Cookie
+	DoubleSubmit bool
+	// Cookie is the cookie holding the token, DefaultCSRFCookie if empty
+	Cookie string
+	// Path is optionally the path of the cookie, "/" if empty
+	Path string
+	// Insecure allows the cookie to be sent over plain HTTP, for development
+	Insecure bool
+}
+
+func (c *CSRFProtection) header() string {
+	if c.Header == "" {
+		return DefaultCSRFHeader
+	}
+	return c.Header
+}
+
+func (c *CSRFProtection) cookie() string {
+	if c.Cookie == "" {
+		return DefaultCSRFCookie
+	}
+	return c.Cookie
+}
+
+// IssueCookie sets a new token in the Cookie of the response, returning it for the page to
+// send in the Header. It is meant for the web application's own pages, as the tunnel can't
+// issue the token to the requests it protects.
+func (c *CSRFProtection) IssueCookie(w http.ResponseWriter) (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", ErrServer.NewError(err.Error())
+	}
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	value := hex.EncodeToString(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.cookie(),
+		Value:    value,
+		Path:     path,
+		Secure:   !c.Insecure,
+		HttpOnly: false, // the page reads it to repeat it in the header
+		SameSite: http.SameSiteStrictMode,
+	})
+	return value, nil
+}
+
+// Check returns ErrSecurity unless the request is a POST carrying the Header, holding the
+// token of the Cookie with DoubleSubmit
+func (c *CSRFProtection) Check(r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return ErrSecurity.NewError("Tunnel requests which change state must be POST requests.")
+	}
+	token := r.Header.Get(c.header())
+	if token == "" {
+		return ErrSecurity.NewError("Missing CSRF token.")
+	}
+	if !c.DoubleSubmit {
+		return nil
+	}
+	cookie, err := r.Cookie(c.cookie())
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		return ErrSecurity.NewError("Invalid CSRF token.")
+	}
+	return nil
+}
+
+// checkCSRF applies the CSRF protection of the server, if any, to connect and write requests
+func (s *Server) checkCSRF(request *http.Request, query string) error {
+	if s.CSRF == nil || (query != "connect" && !strings.HasPrefix(query, writePrefix)) {
+		return nil
+	}
+	return s.CSRF.Check(request)
+}
@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtection_Check(t *testing.T) {
+	csrf := &CSRFProtection{}
+	request := httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil)
+	if err := csrf.Check(request); err == nil {
+		t.Error("Expected a request without the header to be refused")
+	}
+	request.Header.Set(DefaultCSRFHeader, "1")
+	if err := csrf.Check(request); err != nil {
+		t.Error("Expected a request with the header to be accepted, got", err)
+	}
+	get := httptest.NewRequest(http.MethodGet, "/tunnel?connect", nil)
+	get.Header.Set(DefaultCSRFHeader, "1")
+	if err := csrf.Check(get); err == nil {
+		t.Error("Expected a GET request to be refused")
+	}
+
+	csrf.DoubleSubmit = true
+	recorder := httptest.NewRecorder()
+	token, err := csrf.IssueCookie(recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+	if cookie.Name != DefaultCSRFCookie || cookie.SameSite != http.SameSiteStrictMode || !cookie.Secure {
+		t.Errorf("Unexpected cookie %+v", cookie)
+	}
+	request.AddCookie(cookie)
+	if err = csrf.Check(request); err == nil {
+		t.Error("Expected a header not repeating the cookie to be refused")
+	}
+	request.Header.Set(DefaultCSRFHeader, token)
+	if err = csrf.Check(request); err != nil {
+		t.Error("Expected a header repeating the cookie to be accepted, got", err)
+	}
+}
+
+func TestServer_CSRF(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.CSRF = &CSRFProtection{}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	if recorder.Code != http.StatusForbidden || server.tunnels.Len() != 0 {
+		t.Error("Expected a forged connect request to be refused, got", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := connectRequest("")
+	request.Header.Set(DefaultCSRFHeader, "1")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Expected a connect request with the header to succeed, got", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?write:"+strings.Repeat("1", uuidLength), strings.NewReader("3.nop;")))
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected a forged write request to be refused, got", recorder.Code)
+	}
+}
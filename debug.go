@@ -0,0 +1,108 @@
+package guac
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// CaptureDebugServer keeps a capture of the recent instructions of each tunnel it is given and
+// serves them as JSON, so support engineers can see what a client and guacd are exchanging:
+//
+//	GET /debug/capture?tunnel=<uuid>
+//
+// responds with an array of {"time", "direction", "opcode", "args"} objects, oldest first. Set
+// it as Server.Captures to capture every HTTP tunnel, or call Capture for other tunnels.
+type CaptureDebugServer struct {
+	// Authorizer authenticates requests, which are all refused without one, as captures
+	// include everything typed into the sessions
+	Authorizer Authorizer
+	// Size is the number of instructions kept per tunnel, DefaultCaptureBufferSize if zero
+	Size int
+
+	sync.Mutex
+	tunnels map[string]*debugCapture
+}
+
+type debugCapture struct {
+	capture *Capture
+	buffer  *CaptureBuffer
+}
+
+// Capture starts capturing the tunnel under the given UUID
+func (d *CaptureDebugServer) Capture(uuid string, tunnel *FilteredTunnel) {
+	buffer := NewCaptureBuffer(d.Size)
+	capture := StartCapture(tunnel, buffer)
+
+	d.Lock()
+	if d.tunnels == nil {
+		d.tunnels = map[string]*debugCapture{}
+	}
+	if previous, ok := d.tunnels[uuid]; ok {
+		previous.capture.Stop()
+	}
+	d.tunnels[uuid] = &debugCapture{capture: capture, buffer: buffer}
+	d.Unlock()
+}
+
+// Forget stops capturing the tunnel with the given UUID and discards its instructions
+func (d *CaptureDebugServer) Forget(uuid string) {
+	d.Lock()
+	if capture, ok := d.tunnels[uuid]; ok {
+		capture.capture.Stop()
+		delete(d.tunnels, uuid)
+	}
+	d.Unlock()
+}
+
+// wrap captures a tunnel registered with the given UUID, wrapping it in a FilteredTunnel if
+// necessary
+func (d *CaptureDebugServer) wrap(uuid string, tunnel Tunnel) Tunnel {
+	filtered, ok := tunnel.(*FilteredTunnel)
+	if !ok {
+		filtered = NewFilteredTunnel(tunnel)
+	}
+	d.Capture(uuid, filtered)
+	return filtered
+}
+
+// prune forgets tunnels no longer in the map, such as those which timed out
+func (d *CaptureDebugServer) prune(tunnels TunnelRegistry) {
+	open := map[string]bool{}
+	tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		open[uuid] = true
+		return true
+	})
+
+	d.Lock()
+	for uuid, capture := range d.tunnels {
+		if !open[uuid] {
+			capture.capture.Stop()
+			delete(d.tunnels, uuid)
+		}
+	}
+	d.Unlock()
+}
+
+func (d *CaptureDebugServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := authorizeAdmin(d.Authorizer, r); err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+
+	uuid := r.URL.Query().Get("tunnel")
+	d.Lock()
+	capture, ok := d.tunnels[uuid]
+	d.Unlock()
+	if !ok {
+		http.Error(w, "No capture for tunnel.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(capture.buffer.Instructions()); err != nil {
+		filtersLog.Debug("Failed to write capture: ", err)
+	}
+}
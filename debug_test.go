@@ -0,0 +1,55 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptureDebugServer(t *testing.T) {
+	debug := &CaptureDebugServer{Size: 2}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{writer: &bytes.Buffer{}}, nil
+	})
+	server.Captures = debug
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil))
+	tunnel, ok := server.tunnels.Get("1")
+	if !ok {
+		t.Fatal("Expected tunnel to be registered")
+	}
+	writer := tunnel.AcquireWriter()
+	if _, err := writer.Write([]byte("3.nop;4.sync,1.1;5.mouse,1.1,1.2,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+
+	recorder := httptest.NewRecorder()
+	debug.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/capture?tunnel=1", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected a server without an Authorizer to refuse, got", recorder.Code)
+	}
+
+	debug.Authorizer = adminAuthorizer
+	recorder = httptest.NewRecorder()
+	debug.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/capture?tunnel=1", nil))
+	var captured []CapturedInstruction
+	if err := json.Unmarshal(recorder.Body.Bytes(), &captured); err != nil {
+		t.Fatal(err, recorder.Body.String())
+	}
+	if len(captured) != 2 || captured[0].Opcode != "sync" || captured[1].Opcode != "mouse" {
+		t.Fatalf("Unexpected capture %+v", captured)
+	}
+	if captured[1].Direction != "client" || len(captured[1].Args) != 3 {
+		t.Errorf("Unexpected instruction %+v", captured[1])
+	}
+
+	debug.Forget("1")
+	recorder = httptest.NewRecorder()
+	debug.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/capture?tunnel=1", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Expected 404, got", recorder.Code)
+	}
+}
@@ -0,0 +1,172 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDuplicateConnectWindow is how long a DuplicateConnectGuard with no Window
+	// remembers a connect request
+	DefaultDuplicateConnectWindow = 2 * time.Second
+
+	// maxConnectKeyBody is the most of a connect request body used by the default key
+	maxConnectKeyBody = 64 * 1024
+)
+
+// ConnectKeyFunc identifies the client and target of a connect request. Requests with the same
+// key are duplicates of each other.
+type ConnectKeyFunc func(r *http.Request, identity *Identity) string
+
+// DuplicateConnectGuard detects a client repeating a connect request for the same target
+// within a short window, such as when a user double-clicks a connection, so the repeat does
+// not open another guacd connection. Repeats are refused with ErrClientTooMany, or given the
+// UUID of the tunnel created by the first request if ReuseTunnel is set.
+type DuplicateConnectGuard struct {
+	// Window is how long after a connect a repeat counts as a duplicate,
+	// DefaultDuplicateConnectWindow if zero. A repeat arriving while the first request is
+	// still connecting is always a duplicate.
+	Window time.Duration
+	// Key identifies requests, by default the identity's subject (or the client address
+	// without an identity) together with the request path and body
+	Key ConnectKeyFunc
+	// ReuseTunnel answers repeats with the UUID of the first request's tunnel instead of an
+	// error, as long as that tunnel is still open. Only repeats from an authenticated user
+	// reuse a tunnel: requests without an identity are told apart by address alone, which
+	// users behind the same NAT share, so their repeats are refused instead.
+	ReuseTunnel bool
+
+	sync.Mutex
+	recent map[string]*recentConnect
+}
+
+type recentConnect struct {
+	// done is closed once the connect completes
+	done chan struct{}
+	// uuid is the tunnel created, empty if the connect failed
+	uuid string
+	at   time.Time
+}
+
+// check returns the UUID of a tunnel to reuse for the request, or a function to call with the
+// UUID of the tunnel the request goes on to create, or the empty string if it fails
+func (g *DuplicateConnectGuard) check(r *http.Request, identity *Identity, tunnels TunnelRegistry) (string, func(uuid string), error) {
+	keyFunc := g.Key
+	if keyFunc == nil {
+		keyFunc = defaultConnectKey
+	}
+	key := keyFunc(r, identity)
+
+	for {
+		g.Lock()
+		g.prune(time.Now())
+		previous, ok := g.recent[key]
+		if !ok {
+			current := &recentConnect{done: make(chan struct{})}
+			if g.recent == nil {
+				g.recent = map[string]*recentConnect{}
+			}
+			g.recent[key] = current
+			g.Unlock()
+			return "", g.finish(key, current), nil
+		}
+		g.Unlock()
+
+		if !g.ReuseTunnel || identity == nil {
+			return "", nil, ErrClientTooMany.NewError("Duplicate connect request.")
+		}
+
+		// wait for the first request to connect, giving up with the client
+		select {
+		case <-previous.done:
+		case <-r.Context().Done():
+			return "", nil, ErrClientTimeout.NewError("Connect request cancelled.")
+		}
+		if previous.uuid == "" {
+			// the first request failed, so try again as a new connect
+			continue
+		}
+		if _, ok := tunnels.Peek(previous.uuid); ok {
+			registryLog.Debugf("Reusing tunnel %v for duplicate connect request.", previous.uuid)
+			return previous.uuid, nil, nil
+		}
+
+		// the tunnel has already closed again
+		g.Lock()
+		if g.recent[key] == previous {
+			delete(g.recent, key)
+		}
+		g.Unlock()
+	}
+}
+
+// finish returns a function recording the outcome of a connect
+func (g *DuplicateConnectGuard) finish(key string, current *recentConnect) func(string) {
+	return func(uuid string) {
+		g.Lock()
+		current.uuid = uuid
+		current.at = time.Now()
+		if uuid == "" && g.recent[key] == current {
+			delete(g.recent, key)
+		}
+		g.Unlock()
+		close(current.done)
+	}
+}
+
+// prune forgets completed connects older than the window
+func (g *DuplicateConnectGuard) prune(now time.Time) {
+	window := g.Window
+	if window == 0 {
+		window = DefaultDuplicateConnectWindow
+	}
+	for key, recent := range g.recent {
+		select {
+		case <-recent.done:
+			if now.Sub(recent.at) >= window {
+				delete(g.recent, key)
+			}
+		default:
+		}
+	}
+}
+
+// defaultConnectKey combines the client with the path and body of the request, restoring the
+// body for the connect callback
+func defaultConnectKey(r *http.Request, identity *Identity) string {
+	client := ""
+	if identity != nil {
+		client = "identity:" + identity.Subject
+	} else if host, _, err := net.SplitHostPort(clientAddress(r)); err == nil {
+		client = "address:" + host
+	} else {
+		client = "address:" + clientAddress(r)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, _ = io.ReadAll(io.LimitReader(r.Body, maxConnectKeyBody))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	}
+	return client + "\x00" + r.URL.Path + "\x00" + string(body)
+}
+
+// connectGuarded runs connect unless the request is a duplicate, returning the UUID of the
+// tunnel to give the client
+func (s *Server) connectGuarded(r *http.Request, identity *Identity, connect func() (string, error)) (uuid string, err error) {
+	if s.DuplicateConnects == nil {
+		return connect()
+	}
+	uuid, finish, err := s.DuplicateConnects.check(r, identity, s.tunnels)
+	if err != nil || uuid != "" {
+		return uuid, err
+	}
+	defer func() {
+		finish(uuid)
+	}()
+	return connect()
+}
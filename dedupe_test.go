@@ -0,0 +1,115 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func connectRequest(body string) *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/tunnel?connect", strings.NewReader(body))
+}
+
+func TestDuplicateConnectGuard_Refuse(t *testing.T) {
+	var connects int32
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		atomic.AddInt32(&connects, 1)
+		return &fakeTunnel{}, nil
+	})
+	server.DuplicateConnects = &DuplicateConnectGuard{Window: time.Minute}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest("id=a"))
+	if recorder.Body.String() != "1" {
+		t.Fatal("Expected tunnel UUID, got", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest("id=a"))
+	if got := recorder.Header().Get("Guacamole-Status-Code"); got != "797" {
+		t.Error("Expected ClientTooMany, got", got)
+	}
+
+	// a different target is not a duplicate
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest("id=b"))
+	if recorder.Body.String() != "1" {
+		t.Error("Expected tunnel UUID, got", recorder.Body.String())
+	}
+	if connects != 2 {
+		t.Error("Expected 2 connects, got", connects)
+	}
+}
+
+func TestDuplicateConnectGuard_Reuse(t *testing.T) {
+	var connects int32
+	release := make(chan struct{})
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		atomic.AddInt32(&connects, 1)
+		<-release
+		return &fakeTunnel{}, nil
+	})
+	server.Authorizer = userAuthorizer
+	server.DuplicateConnects = &DuplicateConnectGuard{ReuseTunnel: true}
+	connectAs := func(user string) *httptest.ResponseRecorder {
+		request := connectRequest("id=a")
+		request.Header.Set("Authorization", user)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// the repeat arrives while the first request is still connecting
+	var wg sync.WaitGroup
+	bodies := make([]string, 2)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = connectAs("alice").Body.String()
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if connects != 1 {
+		t.Error("Expected 1 connect, got", connects)
+	}
+	for _, body := range bodies {
+		if body != "1" {
+			t.Error("Expected tunnel UUID, got", body)
+		}
+	}
+
+	// once the tunnel is gone a repeat connects again
+	server.tunnels.Remove("1")
+	recorder := connectAs("alice")
+	if recorder.Body.String() != "1" || connects != 2 {
+		t.Error("Expected a new connect", recorder.Body.String(), connects)
+	}
+}
+
+func TestDuplicateConnectGuard_ReuseAnonymous(t *testing.T) {
+	var connects int32
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		atomic.AddInt32(&connects, 1)
+		return &fakeTunnel{}, nil
+	})
+	server.DuplicateConnects = &DuplicateConnectGuard{ReuseTunnel: true}
+
+	server.ServeHTTP(httptest.NewRecorder(), connectRequest("id=a"))
+	// another user behind the same address must not be handed the first user's tunnel
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest("id=a"))
+	if got := recorder.Header().Get("Guacamole-Status-Code"); got != "797" || recorder.Body.String() == "1" {
+		t.Error("Expected an anonymous repeat to be refused, got", got, recorder.Body.String())
+	}
+	if connects != 1 {
+		t.Error("Expected 1 connect, got", connects)
+	}
+}
@@ -0,0 +1,111 @@
+package guac
+
+import (
+	"context"
+	"io"
+	"reflect"
+)
+
+// DelegatingTunnel forwards every method of Tunnel to the tunnel it wraps, along with the
+// optional interfaces of the package's tunnels such as InstructionContextWriter and
+// StatsProvider, so a decorator only has to change what it decorates. Decorators either embed
+// a DelegatingTunnel and override methods, keeping the acquire and release semantics of the
+// wrapped tunnel, or set WrapReader and WrapWriter:
+//
+//	audited := guac.NewDelegatingTunnel(tunnel)
+//	audited.WrapWriter = func(w io.Writer) io.Writer { return io.MultiWriter(w, auditLog) }
+type DelegatingTunnel struct {
+	Tunnel
+
+	// WrapReader optionally wraps the reader each time it is acquired
+	WrapReader func(InstructionReader) InstructionReader
+	// WrapWriter optionally wraps the writer each time it is acquired. Instructions sent with
+	// WriteInstruction bypass it, as they bypass the write filters of a FilteredTunnel.
+	WrapWriter func(io.Writer) io.Writer
+}
+
+// NewDelegatingTunnel wraps the given tunnel, forwarding everything to it
+func NewDelegatingTunnel(tunnel Tunnel) *DelegatingTunnel {
+	return &DelegatingTunnel{Tunnel: tunnel}
+}
+
+// Unwrap returns the wrapped tunnel
+func (t *DelegatingTunnel) Unwrap() Tunnel {
+	return t.Tunnel
+}
+
+// AcquireReader acquires the wrapped tunnel's reader, wrapped by WrapReader if set
+func (t *DelegatingTunnel) AcquireReader() InstructionReader {
+	reader := t.Tunnel.AcquireReader()
+	if t.WrapReader != nil {
+		return t.WrapReader(reader)
+	}
+	return reader
+}
+
+// AcquireWriter acquires the wrapped tunnel's writer, wrapped by WrapWriter if set
+func (t *DelegatingTunnel) AcquireWriter() io.Writer {
+	writer := t.Tunnel.AcquireWriter()
+	if t.WrapWriter != nil {
+		return t.WrapWriter(writer)
+	}
+	return writer
+}
+
+// WriteInstruction sends an instruction through the wrapped tunnel, failing if its turn takes
+// longer than DefaultWriteTimeout to come.
+func (t *DelegatingTunnel) WriteInstruction(instruction *Instruction) error {
+	return writeWithTimeout(t, instruction)
+}
+
+// WriteInstructionContext sends an instruction through the wrapped tunnel.
+func (t *DelegatingTunnel) WriteInstructionContext(ctx context.Context, instruction *Instruction) error {
+	return WriteInstruction(ctx, t.Tunnel, instruction)
+}
+
+// Stats returns the statistics of the wrapped tunnel, if it keeps any
+func (t *DelegatingTunnel) Stats() TunnelStats {
+	if provider, ok := t.Tunnel.(StatsProvider); ok {
+		return provider.Stats()
+	}
+	return TunnelStats{}
+}
+
+// Unwrap returns the tunnel wrapped by the filters
+func (t *FilteredTunnel) Unwrap() Tunnel {
+	return t.Tunnel
+}
+
+// Unwrap returns the registered tunnel
+func (t *LastAccessedTunnel) Unwrap() Tunnel {
+	return t.Tunnel
+}
+
+// AsTunnel finds the first tunnel in the chain of decorators starting at tunnel which is
+// assignable to the value target points to, sets target to it and returns true, much as
+// errors.As finds errors. Decorators are unwrapped with their Unwrap method. It returns false
+// if no tunnel matches.
+//
+//	var filtered *guac.FilteredTunnel
+//	if guac.AsTunnel(tunnel, &filtered) {
+//		filtered.AddReadFilter(filter)
+//	}
+func AsTunnel(tunnel Tunnel, target interface{}) bool {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		panic("guac: AsTunnel target must be a non-nil pointer")
+	}
+	want := value.Type().Elem()
+	for tunnel != nil {
+		if reflect.TypeOf(tunnel).AssignableTo(want) {
+			value.Elem().Set(reflect.ValueOf(tunnel))
+			return true
+		}
+		wrapper, ok := tunnel.(interface{ Unwrap() Tunnel })
+		if !ok {
+			return false
+		}
+		tunnel = wrapper.Unwrap()
+	}
+	return false
+}
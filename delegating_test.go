@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// countingReader counts the instructions read through it
+type countingReader struct {
+	InstructionReader
+	count *int
+}
+
+func (r countingReader) ReadSome() ([]byte, error) {
+	*r.count++
+	return r.InstructionReader.ReadSome()
+}
+
+func TestDelegatingTunnel(t *testing.T) {
+	written := &bytes.Buffer{}
+	audit := &bytes.Buffer{}
+	inner := NewFilteredTunnel(&fakeTunnel{
+		reader: NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;")}, time.Minute),
+		writer: written,
+	})
+	reads := 0
+	tunnel := NewDelegatingTunnel(inner)
+	tunnel.WrapReader = func(reader InstructionReader) InstructionReader {
+		return countingReader{InstructionReader: reader, count: &reads}
+	}
+	tunnel.WrapWriter = func(writer io.Writer) io.Writer {
+		return io.MultiWriter(writer, audit)
+	}
+
+	reader := tunnel.AcquireReader()
+	if data, err := reader.ReadSome(); err != nil || string(data) != "4.sync,1.1;" || reads != 1 {
+		t.Errorf("Unexpected read %q %v %v", data, err, reads)
+	}
+	tunnel.ReleaseReader()
+
+	writer := tunnel.AcquireWriter()
+	_, _ = writer.Write([]byte("3.nop;"))
+	tunnel.ReleaseWriter()
+	if err := tunnel.WriteInstructionContext(context.Background(), NewSyncInstruction(1)); err != nil {
+		t.Fatal(err)
+	}
+	if written.String() != "3.nop;4.sync,1.1;" || audit.String() != "3.nop;" {
+		t.Errorf("Unexpected writes %q, audited %q", written.String(), audit.String())
+	}
+	if stats := tunnel.Stats(); stats.InstructionsOut != 1 || stats.InstructionsIn != 1 {
+		t.Errorf("Expected the wrapped tunnel's stats, got %+v", stats)
+	}
+}
+
+func TestAsTunnel(t *testing.T) {
+	filtered := NewFilteredTunnel(&fakeTunnel{})
+	registered := newRegisteredTunnel(NewDelegatingTunnel(filtered), nil, nil)
+
+	var found *FilteredTunnel
+	if !AsTunnel(registered, &found) || found != filtered {
+		t.Error("Expected the filtered tunnel to be found through the decorators")
+	}
+	var simple *SimpleTunnel
+	if AsTunnel(registered, &simple) {
+		t.Error("Expected no simple tunnel to be found")
+	}
+	var provider StatsProvider
+	if !AsTunnel(registered, &provider) || provider != StatsProvider(registered) {
+		t.Error("Expected an interface target to match the outermost tunnel")
+	}
+}
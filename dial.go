@@ -0,0 +1,220 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// DefaultDialTimeout bounds connecting to guacd when Dialer.Timeout is zero
+const DefaultDialTimeout = 15 * time.Second
+
+// DefaultFallbackDelay is how long Dialer waits for the preferred address family of a
+// dual-stack host before also trying the other, as recommended by RFC 8305
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// Dialer connects to guacd, resolving its hostname with a pluggable Resolver. Hosts with both
+// IPv6 and IPv4 addresses are dialed as in RFC 8305 ("Happy Eyeballs"): the family of the
+// first address is tried first and the other family joins in after FallbackDelay, or as soon
+// as the first fails, and the first connection made wins.
+type Dialer struct {
+	// Resolver looks up the guacd host, the system resolver if nil
+	Resolver Resolver
+	// Timeout bounds the whole dial including name resolution, DefaultDialTimeout if zero
+	Timeout time.Duration
+	// FamilyTimeout optionally bounds the attempts on each address family, so that an
+	// unreachable family cannot use up the whole Timeout
+	FamilyTimeout time.Duration
+	// FallbackDelay is how long to wait for the preferred address family before also trying
+	// the other, DefaultFallbackDelay if zero. If negative, addresses are tried one at a time.
+	FallbackDelay time.Duration
+	// KeepAlive is the interval between TCP keepalive probes on connections to guacd, which
+	// let the operating system notice a guacd host which vanished without closing them. Go's
+	// default of 15 seconds is used if zero, and keepalives are disabled if negative.
+	KeepAlive time.Duration
+
+	// dial replaces net.Dialer in tests
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext connects to the guacd at address, trying each resolved address in turn
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if !strings.HasPrefix(network, "tcp") {
+		// unix sockets and the like have no addresses to resolve
+		return d.wrap(d.dialOne(ctx, network, address))
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, ErrServer.NewError("Invalid guacd address.", err.Error())
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, ErrUpstreamNotFound.NewError("Unable to resolve guacd address.", err.Error())
+	}
+
+	primary, fallback := partitionAddrs(network, addrs)
+	if len(primary) == 0 {
+		return d.wrap(nil, &net.AddrError{Err: "no suitable address", Addr: host})
+	}
+	return d.wrap(d.dialParallel(ctx, network, port, primary, fallback))
+}
+
+// dialParallel races the primary addresses against the fallback addresses, started after the
+// fallback delay or as soon as the primary addresses fail
+func (d *Dialer) dialParallel(ctx context.Context, network, port string, primary, fallback []string) (net.Conn, error) {
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+	if len(fallback) == 0 || delay < 0 {
+		return d.dialSerial(ctx, network, port, append(primary, fallback...))
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	start := func(addrs []string, primary bool) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, port, addrs)
+			results <- dialResult{conn: conn, err: err, primary: primary}
+		}()
+	}
+
+	start(primary, true)
+	pending, fallbackStarted := 1, false
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				start(fallback, false)
+				fallbackStarted = true
+				pending++
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// the losing attempt may still connect, which must not leak
+				go func(n int) {
+					for ; n > 0; n-- {
+						if lost := <-results; lost.conn != nil {
+							_ = lost.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if result.primary {
+				primaryErr = result.err
+			} else {
+				fallbackErr = result.err
+			}
+			if !fallbackStarted {
+				start(fallback, false)
+				fallbackStarted = true
+				pending++
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// dialSerial tries each address in turn, within FamilyTimeout if set
+func (d *Dialer) dialSerial(ctx context.Context, network, port string, addrs []string) (conn net.Conn, err error) {
+	if d.FamilyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.FamilyTimeout)
+		defer cancel()
+	}
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			break
+		}
+		if conn, err = d.dialOne(ctx, network, net.JoinHostPort(addr, port)); err == nil {
+			return conn, nil
+		}
+		transportLog.Debugf("Dialing guacd at %v failed: %v", net.JoinHostPort(addr, port), err)
+	}
+	if err == nil {
+		if err = ctx.Err(); err == nil {
+			err = &net.AddrError{Err: "no addresses"}
+		}
+	}
+	return nil, err
+}
+
+func (d *Dialer) dialOne(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.dial != nil {
+		return d.dial(ctx, network, address)
+	}
+	dialer := &net.Dialer{KeepAlive: d.KeepAlive}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// partitionAddrs splits addresses into those of the family of the first address and those of
+// the other family, keeping their order and dropping those the network cannot reach
+func partitionAddrs(network string, addrs []string) (primary, fallback []string) {
+	var primaryIs4 bool
+	for _, addr := range addrs {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			continue
+		}
+		is4 := ip.Unmap().Is4()
+		if (network == "tcp4" && !is4) || (network == "tcp6" && is4) {
+			continue
+		}
+		if len(primary) == 0 {
+			primaryIs4 = is4
+		}
+		if is4 == primaryIs4 {
+			primary = append(primary, addr)
+		} else {
+			fallback = append(fallback, addr)
+		}
+	}
+	return
+}
+
+// Dial connects to the guacd at address
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// wrap converts dial errors to the matching ErrGuac
+func (d *Dialer) wrap(conn net.Conn, err error) (net.Conn, error) {
+	if err == nil {
+		return conn, nil
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, ErrUpstreamTimeout.NewError("Timed out connecting to guacd.", err.Error())
+	}
+	return nil, ErrUpstreamUnavailable.NewError("Unable to connect to guacd.", err.Error())
+}
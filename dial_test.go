@@ -0,0 +1,85 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialer_Resolver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	dialer := &Dialer{Resolver: &fakeResolver{addrs: map[string][]string{"guacd": {"127.0.0.1"}}}}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("guacd", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	if _, err = dialer.Dial("tcp", net.JoinHostPort("nowhere", port)); err == nil || asErrGuac(err).Status != UpstreamNotFound {
+		t.Errorf("expected UpstreamNotFound, got %v", err)
+	}
+}
+
+func TestDialer_DualStack(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	var dialed []string
+	var lock sync.Mutex
+	dialer := &Dialer{
+		Resolver:      &fakeResolver{addrs: map[string][]string{"guacd": {"2001:db8::1", "2001:db8::2", "127.0.0.1"}}},
+		FamilyTimeout: 50 * time.Millisecond,
+		FallbackDelay: time.Hour,
+	}
+	dialer.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		lock.Lock()
+		dialed = append(dialed, address)
+		lock.Unlock()
+		if strings.HasPrefix(address, "[") {
+			// an unreachable family hangs until its timeout
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("guacd", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected IPv4 fallback after the IPv6 family timed out, took %v", elapsed)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"[2001:db8::1]:" + port, "127.0.0.1:" + port}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("Expected dials %v, got %v", want, dialed)
+	}
+}
+
+func TestPartitionAddrs(t *testing.T) {
+	addrs := []string{"::1", "10.0.0.1", "fe80::1%eth0", "::ffff:10.0.0.2"}
+	primary, fallback := partitionAddrs("tcp", addrs)
+	if !reflect.DeepEqual(primary, []string{"::1", "fe80::1%eth0"}) || !reflect.DeepEqual(fallback, []string{"10.0.0.1", "::ffff:10.0.0.2"}) {
+		t.Errorf("Unexpected partition %v %v", primary, fallback)
+	}
+	if primary, fallback = partitionAddrs("tcp4", addrs); !reflect.DeepEqual(primary, []string{"10.0.0.1", "::ffff:10.0.0.2"}) || fallback != nil {
+		t.Errorf("Unexpected IPv4 only partition %v %v", primary, fallback)
+	}
+}
@@ -0,0 +1,427 @@
+package guac
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DefaultDiffContext is the number of unchanged instructions WriteDiff shows around each change
+// when given a negative context
+const DefaultDiffContext = 3
+
+// DefaultDiffIgnore lists the opcodes left out of a diff when DiffOptions.Ignore is nil: nop
+// and log instructions, and internal instructions, which don't affect what is rendered
+var DefaultDiffIgnore = []string{OpcodeNop, OpcodeLog, InternalDataOpcode}
+
+// streamArgs gives the position of the stream index among the arguments of instructions
+// naming a stream
+var streamArgs = map[string]int{
+	OpcodeAck:       0,
+	OpcodeArgv:      0,
+	OpcodeAudio:     0,
+	OpcodeBlob:      0,
+	OpcodeBody:      1,
+	OpcodeClipboard: 0,
+	OpcodeEnd:       0,
+	OpcodeFile:      0,
+	OpcodeImg:       0,
+	OpcodePipe:      0,
+	OpcodePut:       1,
+	OpcodeVideo:     0,
+}
+
+// DiffOptions controls how recorded instruction streams are normalized before they are
+// compared. By default, the differences expected between two runs of the same scenario are
+// normalized away: sync timestamps, the indexes guacd picks for streams, and the encoding of
+// blobs is reduced to a digest.
+type DiffOptions struct {
+	// Ignore lists the opcodes left out of the comparison, DefaultDiffIgnore if nil
+	Ignore []string
+	// KeepTimestamps compares the timestamps of sync instructions, which differ on every run
+	KeepTimestamps bool
+	// KeepStreamIndexes compares stream indexes as sent, rather than numbered in order of
+	// first use
+	KeepStreamIndexes bool
+	// IgnoreBlobData compares blobs by stream alone, for encoders which aren't deterministic
+	IgnoreBlobData bool
+}
+
+// DiffOp says whether a DiffLine is in both streams or only one of them
+type DiffOp int
+
+// Kinds of DiffLine
+const (
+	DiffEqual DiffOp = iota
+	DiffDelete
+	DiffInsert
+)
+
+func (op DiffOp) String() string {
+	switch op {
+	case DiffDelete:
+		return "-"
+	case DiffInsert:
+		return "+"
+	default:
+		return " "
+	}
+}
+
+// DiffLine is a normalized instruction in the diff of two streams
+type DiffLine struct {
+	Op DiffOp
+	// A and B are the positions of the instruction in each stream, counting from one and
+	// including ignored instructions, or zero if it isn't in that stream
+	A, B int
+	// Instruction is the normalized instruction
+	Instruction *Instruction
+}
+
+// ReadInstructions reads a recorded instruction stream: either Guacamole protocol as written
+// to a session recording, or the lines written by a capture sink from NewCaptureWriter.
+func ReadInstructions(r io.Reader) ([]*Instruction, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// instructions start with the length of their opcode, capture lines with a time
+	trimmed := bytes.TrimSpace(data)
+	if digits := bytes.IndexFunc(trimmed, func(r rune) bool { return r < '0' || r > '9' }); digits >= 0 && trimmed[digits] != '.' {
+		return readCaptureLines(trimmed)
+	}
+
+	var instructions []*Instruction
+	for len(data) > 0 {
+		if data = bytes.TrimLeft(data, "\r\n"); len(data) == 0 {
+			break
+		}
+		parser := &Stream{buffer: data, end: len(data)}
+		end, err := parser.parse()
+		if err != nil {
+			return nil, fmt.Errorf("after instruction %v: %w", len(instructions), err)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("after instruction %v: incomplete instruction", len(instructions))
+		}
+		instruction, err := Parse(data[:end])
+		if err != nil {
+			return nil, fmt.Errorf("instruction %v: %w", len(instructions)+1, err)
+		}
+		instructions = append(instructions, instruction)
+		data = data[end:]
+	}
+	return instructions, nil
+}
+
+// readCaptureLines parses the instructions of lines written by NewCaptureWriter
+func readCaptureLines(data []byte) ([]*Instruction, error) {
+	var instructions []*Instruction
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxStreamBuffer)
+	for line := 1; scanner.Scan(); line++ {
+		fields := bytes.SplitN(bytes.TrimSpace(scanner.Bytes()), []byte(" "), 3)
+		if len(fields) == 1 && len(fields[0]) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %v: expected time, direction and instruction", line)
+		}
+		instruction, err := Parse(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		instructions = append(instructions, instruction)
+	}
+	return instructions, scanner.Err()
+}
+
+// diffNormalizer rewrites the instructions of one stream for comparison
+type diffNormalizer struct {
+	options *DiffOptions
+	ignore  map[string]bool
+	// streams numbers the stream indexes of the stream in order of first use
+	streams map[string]string
+}
+
+func newDiffNormalizer(options *DiffOptions) *diffNormalizer {
+	ignore := options.Ignore
+	if ignore == nil {
+		ignore = DefaultDiffIgnore
+	}
+	n := &diffNormalizer{options: options, ignore: map[string]bool{}, streams: map[string]string{}}
+	for _, opcode := range ignore {
+		n.ignore[opcode] = true
+	}
+	return n
+}
+
+// normalize returns the instruction to compare, or nil if it is ignored
+func (n *diffNormalizer) normalize(instruction *Instruction) *Instruction {
+	if n.ignore[instruction.Opcode] {
+		return nil
+	}
+	args := append([]string(nil), instruction.Args...)
+
+	if instruction.Opcode == OpcodeSync && !n.options.KeepTimestamps && len(args) > 0 {
+		args[0] = "*"
+	}
+	if position, ok := streamArgs[instruction.Opcode]; ok && !n.options.KeepStreamIndexes && position < len(args) {
+		// the handshake's audio and video instructions list mimetypes rather than a stream
+		if _, err := strconv.Atoi(args[position]); err == nil {
+			index, ok := n.streams[args[position]]
+			if !ok {
+				index = "s" + strconv.Itoa(len(n.streams))
+				n.streams[args[position]] = index
+			}
+			args[position] = index
+		}
+	}
+	if instruction.Opcode == OpcodeBlob && len(args) > 1 {
+		if n.options.IgnoreBlobData {
+			args = args[:1]
+		} else {
+			digest := sha256.Sum256([]byte(args[1]))
+			args[1] = "sha256:" + hex.EncodeToString(digest[:8])
+		}
+	}
+	return NewInstruction(instruction.Opcode, args...)
+}
+
+// diffEntry is a normalized instruction and its position in the original stream
+type diffEntry struct {
+	position    int
+	instruction *Instruction
+}
+
+func normalizeStream(instructions []*Instruction, options *DiffOptions) []diffEntry {
+	normalizer := newDiffNormalizer(options)
+	entries := make([]diffEntry, 0, len(instructions))
+	for i, instruction := range instructions {
+		if normalized := normalizer.normalize(instruction); normalized != nil {
+			entries = append(entries, diffEntry{position: i + 1, instruction: normalized})
+		}
+	}
+	return entries
+}
+
+// DiffInstructions compares two recorded instruction streams, such as the same scenario run
+// against two versions of guacd, after normalizing them as set by options, which may be nil.
+// The result is the shortest edit script turning a into b, and is the same for the same
+// input.
+func DiffInstructions(a, b []*Instruction, options *DiffOptions) []DiffLine {
+	if options == nil {
+		options = &DiffOptions{}
+	}
+	x, y := normalizeStream(a, options), normalizeStream(b, options)
+	xs, ys := make([]string, len(x)), make([]string, len(y))
+	for i, entry := range x {
+		xs[i] = entry.instruction.String()
+	}
+	for i, entry := range y {
+		ys[i] = entry.instruction.String()
+	}
+
+	var lines []DiffLine
+	i, j := 0, 0
+	for _, op := range myersDiff(xs, ys) {
+		switch op {
+		case DiffEqual:
+			lines = append(lines, DiffLine{Op: op, A: x[i].position, B: y[j].position, Instruction: x[i].instruction})
+			i++
+			j++
+		case DiffDelete:
+			lines = append(lines, DiffLine{Op: op, A: x[i].position, Instruction: x[i].instruction})
+			i++
+		case DiffInsert:
+			lines = append(lines, DiffLine{Op: op, B: y[j].position, Instruction: y[j].instruction})
+			j++
+		}
+	}
+	return lines
+}
+
+// myersDiff returns the shortest edit script turning a into b, preferring deletions before
+// insertions. It uses the linear space variant of Myers' algorithm, splitting the edit graph
+// at the middle snake of an optimal path, so long recordings don't need memory quadratic in
+// the number of changes.
+func myersDiff(a, b []string) []DiffOp {
+	ops := myersSplit(a, b, make([]DiffOp, 0, len(a)+len(b)))
+
+	// within each run of changes, list the deletions first
+	for i := 0; i < len(ops); {
+		if ops[i] == DiffEqual {
+			i++
+			continue
+		}
+		j, deletions := i, 0
+		for ; j < len(ops) && ops[j] != DiffEqual; j++ {
+			if ops[j] == DiffDelete {
+				deletions++
+			}
+		}
+		for k := i; k < j; k++ {
+			if k-i < deletions {
+				ops[k] = DiffDelete
+			} else {
+				ops[k] = DiffInsert
+			}
+		}
+		i = j
+	}
+	return ops
+}
+
+// myersSplit appends the edit script turning a into b to ops
+func myersSplit(a, b []string, ops []DiffOp) []DiffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, DiffEqual)
+	}
+
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	switch {
+	case len(a) == 0:
+		for range b {
+			ops = append(ops, DiffInsert)
+		}
+	case len(b) == 0:
+		for range a {
+			ops = append(ops, DiffDelete)
+		}
+	default:
+		x, y, u, v := myersMiddleSnake(a, b)
+		ops = myersSplit(a[:x], b[:y], ops)
+		for i := x; i < u; i++ {
+			ops = append(ops, DiffEqual)
+		}
+		ops = myersSplit(a[u:], b[v:], ops)
+	}
+
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, DiffEqual)
+	}
+	return ops
+}
+
+// myersMiddleSnake searches for the shortest edit script from both ends of the edit graph at
+// once, returning the snake from (x, y) to (u, v) where the searches meet. a and b must not
+// be empty, nor start or end with the same string.
+func myersMiddleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+	offset := max + 1
+	// forward[offset+k] is the furthest x reached on diagonal k = x-y from the start, and
+	// backward[offset+c] the furthest distance reached on diagonal c from the end
+	forward := make([]int, 2*max+3)
+	backward := make([]int, 2*max+3)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && u+backward[offset+c] >= n {
+				return x, y, u, v
+			}
+		}
+
+		for c := -d; c <= d; c += 2 {
+			var rx int
+			if c == -d || (c != d && backward[offset+c-1] < backward[offset+c+1]) {
+				rx = backward[offset+c+1]
+			} else {
+				rx = backward[offset+c-1] + 1
+			}
+			ry := rx - c
+			sx, sy := rx, ry
+			for rx < n && ry < m && a[n-1-rx] == b[m-1-ry] {
+				rx++
+				ry++
+			}
+			backward[offset+c] = rx
+			if k := delta - c; !odd && k >= -d && k <= d && forward[offset+k]+rx >= n {
+				return n - rx, m - ry, n - sx, m - sy
+			}
+		}
+	}
+	// unreachable: the searches meet within half the sum of the lengths
+	return 0, 0, 0, 0
+}
+
+// WriteDiff writes the changes of a diff in a unified format, with the given number of
+// unchanged instructions around each change, DefaultDiffContext if negative. Each hunk starts
+// with the positions of its first instruction in each stream. It returns the number of
+// instructions which differ.
+func WriteDiff(w io.Writer, lines []DiffLine, context int) (int, error) {
+	if context < 0 {
+		context = DefaultDiffContext
+	}
+	// show marks the lines within context of a change
+	show := make([]bool, len(lines))
+	changes := 0
+	for i, line := range lines {
+		if line.Op == DiffEqual {
+			continue
+		}
+		changes++
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(lines) {
+				show[j] = true
+			}
+		}
+	}
+
+	for i, line := range lines {
+		if !show[i] {
+			continue
+		}
+		if i == 0 || !show[i-1] {
+			a, b := hunkStart(lines, i)
+			if _, err := fmt.Fprintf(w, "@@ -%v +%v @@\n", a, b); err != nil {
+				return changes, err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%v%v\n", line.Op, line.Instruction); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// hunkStart returns the positions in each stream of the first instructions of the hunk
+// starting at the given line
+func hunkStart(lines []DiffLine, start int) (int, int) {
+	a, b := 0, 0
+	for i := start; i < len(lines) && (a == 0 || b == 0); i++ {
+		if a == 0 {
+			a = lines[i].A
+		}
+		if b == 0 {
+			b = lines[i].B
+		}
+	}
+	return a, b
+}
@@ -0,0 +1,152 @@
+package guac
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadInstructions(t *testing.T) {
+	recording := "4.sync,3.100;3.img,1.3,2.12,1.0,9.image/png,1.0,1.0;\n4.blob,1.3,4.AAAA;"
+	instructions, err := ReadInstructions(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instructions) != 3 || instructions[2].Opcode != OpcodeBlob {
+		t.Errorf("Unexpected instructions %v", instructions)
+	}
+
+	captured := "2024-05-01T12:00:00Z guacd 4.sync,3.100;\n2024-05-01T12:00:01Z client 4.sync,3.100;\n"
+	if instructions, err = ReadInstructions(strings.NewReader(captured)); err != nil || len(instructions) != 2 {
+		t.Errorf("Unexpected captured instructions %v %v", instructions, err)
+	}
+
+	if _, err = ReadInstructions(strings.NewReader("4.sync,3.100")); err == nil {
+		t.Error("Expected an incomplete instruction to fail")
+	}
+}
+
+func TestDiffInstructions(t *testing.T) {
+	a := []*Instruction{
+		NewInstruction(OpcodeImg, "3", "12", "0", "image/png", "0", "0"),
+		NewInstruction(OpcodeBlob, "3", "AAAA"),
+		NewInstruction(OpcodeEnd, "3"),
+		NewSyncInstruction(100),
+		NewInstruction("rect", "0", "0", "0", "10", "10"),
+		NewSyncInstruction(200),
+	}
+	b := []*Instruction{
+		NewInstruction(OpcodeImg, "7", "12", "0", "image/png", "0", "0"),
+		NewInstruction(OpcodeBlob, "7", "AAAA"),
+		NewNopInstruction(),
+		NewInstruction(OpcodeEnd, "7"),
+		NewSyncInstruction(150),
+		NewInstruction("rect", "0", "0", "0", "20", "10"),
+		NewSyncInstruction(250),
+	}
+
+	lines := DiffInstructions(a, b, nil)
+	var changed []string
+	for _, line := range lines {
+		if line.Op != DiffEqual {
+			changed = append(changed, line.Op.String()+line.Instruction.String())
+		}
+	}
+	expected := []string{"-4.rect,1.0,1.0,1.0,2.10,2.10;", "+4.rect,1.0,1.0,1.0,2.20,2.10;"}
+	if strings.Join(changed, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected only the rect to differ, got %v", changed)
+	}
+	if last := lines[len(lines)-1]; last.A != 6 || last.B != 7 {
+		t.Errorf("Expected positions in the original streams, got %v %v", last.A, last.B)
+	}
+
+	lines = DiffInstructions(a, b, &DiffOptions{KeepStreamIndexes: true, KeepTimestamps: true})
+	changes := 0
+	for _, line := range lines {
+		if line.Op != DiffEqual {
+			changes++
+		}
+	}
+	if changes != 12 {
+		t.Errorf("Expected stream indexes and timestamps to differ, got %v changes", changes)
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	var a, b []*Instruction
+	for i := 0; i < 20; i++ {
+		a = append(a, NewInstruction(OpcodeDispose, strconv.Itoa(i)))
+		b = append(b, NewInstruction(OpcodeDispose, strconv.Itoa(i)))
+	}
+	b[10] = NewInstruction("cfill", "14", "0", "0", "0", "0", "255")
+
+	var out strings.Builder
+	changes, err := WriteDiff(&out, DiffInstructions(a, b, nil), 1)
+	if err != nil || changes != 2 {
+		t.Fatalf("Unexpected changes %v %v", changes, err)
+	}
+	expected := "@@ -10 +10 @@\n" +
+		" 7.dispose,1.9;\n" +
+		"-7.dispose,2.10;\n" +
+		"+5.cfill,2.14,1.0,1.0,1.0,1.0,3.255;\n" +
+		" 7.dispose,2.11;\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected diff:\n%v", out.String())
+	}
+}
+
+func TestMyersDiff(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		a, b := make([]string, random.Intn(30)), make([]string, random.Intn(30))
+		for i := range a {
+			a[i] = strconv.Itoa(random.Intn(4))
+		}
+		for i := range b {
+			b[i] = strconv.Itoa(random.Intn(4))
+		}
+
+		ops := myersDiff(a, b)
+		var x, y, edits int
+		for _, op := range ops {
+			switch op {
+			case DiffEqual:
+				if x >= len(a) || y >= len(b) || a[x] != b[y] {
+					t.Fatalf("%v %v: invalid script %v", a, b, ops)
+				}
+				x++
+				y++
+			case DiffDelete:
+				x++
+				edits++
+			case DiffInsert:
+				y++
+				edits++
+			}
+		}
+		if x != len(a) || y != len(b) {
+			t.Fatalf("%v %v: script %v doesn't cover both", a, b, ops)
+		}
+
+		// the shortest script keeps the longest common subsequence
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] > lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		if shortest := len(a) + len(b) - 2*lcs[0][0]; edits != shortest {
+			t.Fatalf("%v %v: expected %v edits, got %v", a, b, shortest, edits)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package guac
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEchoWindow is how long an EchoSuppressor with no Window remembers input
+	DefaultEchoWindow = 500 * time.Millisecond
+
+	// echoHistory is the most recent pointer positions an EchoSuppressor remembers
+	echoHistory = 32
+)
+
+// EchoSuppressor drops the cursor updates guacd sends a participant of a shared session which
+// only repeat that participant's own recent mouse input. Input is remembered by participant, so
+// an update is only dropped when the participant it is sent to was the last to move the
+// pointer to that position; other participants' cursors are left alone even when they cross
+// the same spot. The participants of a session share one suppressor, each installing it on
+// their own tunnel:
+//
+//	echoes := guac.NewEchoSuppressor(0)
+//	echoes.Install(tunnel)
+type EchoSuppressor struct {
+	// Window is how long after the participant moves the pointer to a position an update
+	// reporting that position is treated as an echo, DefaultEchoWindow if zero
+	Window time.Duration
+
+	sync.Mutex
+	sent [echoHistory]sentPosition
+	next int
+}
+
+type sentPosition struct {
+	// participant is the UUID of the tunnel the input was sent on
+	participant string
+	x, y        string
+	at          time.Time
+	// echoed is set once the participant has been spared the echo of the input
+	echoed bool
+}
+
+// NewEchoSuppressor creates a suppressor treating updates within window of the input as echoes
+func NewEchoSuppressor(window time.Duration) *EchoSuppressor {
+	return &EchoSuppressor{Window: window}
+}
+
+// Install adds the suppressor's filters to the tunnel of a participant, who is identified by
+// the UUID of the tunnel
+func (e *EchoSuppressor) Install(tunnel *FilteredTunnel) {
+	participant := tunnel.GetUUID()
+	tunnel.AddReadFilter(FilterFunc(func(instruction *Instruction) (*Instruction, error) {
+		return e.filterRead(participant, instruction)
+	}))
+	tunnel.AddWriteFilter(FilterFunc(func(instruction *Instruction) (*Instruction, error) {
+		return e.filterWrite(participant, instruction)
+	}))
+}
+
+// filterWrite remembers where the participant moved the pointer
+func (e *EchoSuppressor) filterWrite(participant string, instruction *Instruction) (*Instruction, error) {
+	if instruction.Opcode != OpcodeMouse || len(instruction.Args) < 2 {
+		return instruction, nil
+	}
+	e.Lock()
+	e.sent[e.next] = sentPosition{participant: participant, x: instruction.Args[0], y: instruction.Args[1], at: time.Now()}
+	e.next = (e.next + 1) % echoHistory
+	e.Unlock()
+	return instruction, nil
+}
+
+// filterRead drops cursor updates for a position the participant was the last to move to
+func (e *EchoSuppressor) filterRead(participant string, instruction *Instruction) (*Instruction, error) {
+	if instruction.Opcode != OpcodeMouse || len(instruction.Args) < 2 {
+		return instruction, nil
+	}
+	window := e.Window
+	if window == 0 {
+		window = DefaultEchoWindow
+	}
+	now := time.Now()
+
+	e.Lock()
+	defer e.Unlock()
+	var latest *sentPosition
+	for i := range e.sent {
+		sent := &e.sent[i]
+		if sent.x == instruction.Args[0] && sent.y == instruction.Args[1] && now.Sub(sent.at) <= window &&
+			(latest == nil || sent.at.After(latest.at)) {
+			latest = sent
+		}
+	}
+	// each input is echoed at most once, but stays the latest at its position for the others
+	if latest == nil || latest.participant != participant || latest.echoed {
+		return instruction, nil
+	}
+	latest.echoed = true
+	return nil, nil
+}
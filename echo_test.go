@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEchoSuppressor(t *testing.T) {
+	conn := &fakeConn{
+		// the participant's own position, then another participant's
+		ToRead: []byte("5.mouse,2.10,2.20,1.0,3.100;5.mouse,2.50,2.60,1.0,3.101;5.mouse,2.10,2.20,1.0,3.102;"),
+	}
+	tunnel := NewFilteredTunnel(&fakeTunnel{reader: NewStream(conn, time.Minute), writer: &bytes.Buffer{}})
+	NewEchoSuppressor(time.Minute).Install(tunnel)
+
+	writer := tunnel.AcquireWriter()
+	if _, err := writer.Write([]byte("5.mouse,2.10,2.20,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+
+	reader := tunnel.AcquireReader()
+	defer tunnel.ReleaseReader()
+	for _, want := range []string{"5.mouse,2.50,2.60,1.0,3.101;", "5.mouse,2.10,2.20,1.0,3.102;"} {
+		ins, err := reader.ReadSome()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ins) != want {
+			t.Errorf("got %q, want %q", ins, want)
+		}
+	}
+}
+
+func TestEchoSuppressor_Participants(t *testing.T) {
+	echoes := NewEchoSuppressor(time.Minute)
+	participant := func(id, updates string) *FilteredTunnel {
+		conn := &fakeConn{ToRead: []byte(updates)}
+		tunnel := NewFilteredTunnel(&uuidTunnel{fakeTunnel: fakeTunnel{reader: NewStream(conn, time.Minute), writer: &bytes.Buffer{}}, uuid: id})
+		echoes.Install(tunnel)
+		return tunnel
+	}
+	update := "5.mouse,2.10,2.20,1.0,3.100;4.sync,1.1;"
+	alice := participant("alice", update)
+	bob := participant("bob", update)
+
+	// both move to the same spot, bob last
+	for _, tunnel := range []*FilteredTunnel{alice, bob} {
+		writer := tunnel.AcquireWriter()
+		if _, err := writer.Write([]byte("5.mouse,2.10,2.20,1.0;")); err != nil {
+			t.Fatal(err)
+		}
+		tunnel.ReleaseWriter()
+		time.Sleep(time.Millisecond)
+	}
+
+	// the update is bob's echo, but alice sees bob's cursor
+	for _, test := range []struct {
+		tunnel *FilteredTunnel
+		want   string
+	}{{bob, "4.sync,1.1;"}, {alice, "5.mouse,2.10,2.20,1.0,3.100;"}} {
+		tunnel, want := test.tunnel, test.want
+		reader := tunnel.AcquireReader()
+		ins, err := reader.ReadSome()
+		tunnel.ReleaseReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ins) != want {
+			t.Errorf("%v: got %q, want %q", tunnel.GetUUID(), ins, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package guac
+
+import (
+	"context"
+	"sync"
+)
+
+// EmbedOptions configures the layers of an EmbeddedTunnel, which are those the HTTP and
+// WebSocket servers install on their tunnels
+type EmbedOptions struct {
+	// StreamLimits bounds the streams and instructions sent by the application, none if nil
+	StreamLimits *StreamLimits
+	// Capture records the instructions of the session, none if nil
+	Capture CaptureSink
+	// Journal keeps the log and error instructions guacd sends, also logged with LogGuacd, if
+	// set
+	Journal *Journal
+	// ReadFilters and WriteFilters are installed after the layers above
+	ReadFilters  []Filter
+	WriteFilters []Filter
+}
+
+// EmbeddedTunnel drives a tunnel in process rather than over HTTP, for applications which
+// carry the Guacamole protocol over a transport of their own, such as Electron IPC or an SSH
+// subsystem. The application plays the part of the client: what it sends passes through the
+// write filters and what it receives through the read filters, as with the servers.
+//
+//	tunnel, err := guac.Embed(ctx, backend, config, guac.EmbedOptions{})
+//	...
+//	for instruction := range tunnel.Instructions(ctx) {
+//		// forward instruction to the client
+//	}
+//	if err := tunnel.Err(); err != nil { ... }
+type EmbeddedTunnel struct {
+	*FilteredTunnel
+
+	capture *Capture
+
+	sync.Mutex
+	reading bool
+	err     error
+}
+
+// Embed connects to guacd through backend, performs the handshake with config and returns the
+// tunnel ready to be driven in process
+func Embed(ctx context.Context, backend *Backend, config *Config, options EmbedOptions) (*EmbeddedTunnel, error) {
+	stream, err := backend.Connect(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewEmbeddedTunnel(NewSimpleTunnel(stream), options), nil
+}
+
+// NewEmbeddedTunnel installs the layers configured by options on a tunnel which has already
+// completed its handshake, such as one from NewConnTunnel
+func NewEmbeddedTunnel(tunnel Tunnel, options EmbedOptions) *EmbeddedTunnel {
+	if options.StreamLimits != nil {
+		tunnel = options.StreamLimits.wrap(tunnel)
+	}
+	filtered, ok := tunnel.(*FilteredTunnel)
+	if !ok {
+		filtered = NewFilteredTunnel(tunnel)
+	}
+
+	t := &EmbeddedTunnel{FilteredTunnel: filtered}
+	if options.Capture != nil {
+		t.capture = StartCapture(filtered, options.Capture)
+	}
+	if options.Journal != nil {
+		filtered.AddReadFilter(NewGuacdLogFilter(filtered.GetUUID(), options.Journal))
+	}
+	for _, filter := range options.ReadFilters {
+		filtered.AddReadFilter(filter)
+	}
+	for _, filter := range options.WriteFilters {
+		filtered.AddWriteFilter(filter)
+	}
+	return t
+}
+
+// Instructions starts reading the instructions guacd sends, after the read filters, returning
+// the channel they are delivered on. The channel is closed once guacd ends the session with a
+// disconnect or error instruction, which is delivered first, once reading fails, or once ctx
+// is done; Err tells which. Only one reader may be started.
+func (t *EmbeddedTunnel) Instructions(ctx context.Context) <-chan *Instruction {
+	instructions := make(chan *Instruction)
+
+	t.Lock()
+	if t.reading {
+		t.Unlock()
+		close(instructions)
+		return instructions
+	}
+	t.reading = true
+	t.Unlock()
+
+	go func() {
+		defer close(instructions)
+		t.setErr(t.read(ctx, instructions))
+	}()
+	return instructions
+}
+
+// read delivers instructions until the session ends
+func (t *EmbeddedTunnel) read(ctx context.Context, instructions chan<- *Instruction) error {
+	reader, err := AcquireReader(ctx, t.FilteredTunnel)
+	if err != nil {
+		return err
+	}
+	defer t.ReleaseReader()
+
+	for {
+		message, err := reader.ReadSome()
+		if err != nil {
+			return err
+		}
+		// filters may return several instructions at once
+		for len(message) > 0 {
+			end, err := instructionEnd(message, InstructionLimits{})
+			if err != nil || end < 0 {
+				return ErrServer.NewError("Incomplete instruction read from tunnel.")
+			}
+			instruction, err := Parse(message[:end])
+			if err != nil {
+				return ErrServer.NewError(err.Error())
+			}
+			message = message[end:]
+
+			select {
+			case instructions <- instruction:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if instruction.Opcode == OpcodeDisconnect || instruction.Opcode == OpcodeError {
+				return nil
+			}
+		}
+	}
+}
+
+func (t *EmbeddedTunnel) setErr(err error) {
+	t.Lock()
+	t.err = err
+	t.Unlock()
+}
+
+// Err returns the error which ended reading, nil if guacd ended the session or reading is
+// still in progress
+func (t *EmbeddedTunnel) Err() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.err
+}
+
+// Send sends an instruction to guacd as the client would, through the write filters
+func (t *EmbeddedTunnel) Send(instruction *Instruction) error {
+	writer := t.AcquireWriter()
+	defer t.ReleaseWriter()
+	_, err := writer.Write(instruction.Byte())
+	return err
+}
+
+// Close stops any capture and closes the tunnel, ending reading
+func (t *EmbeddedTunnel) Close() error {
+	if t.capture != nil {
+		t.capture.Stop()
+	}
+	return t.FilteredTunnel.Close()
+}
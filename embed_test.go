@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedTunnel(t *testing.T) {
+	local, guacd := net.Pipe()
+	defer guacd.Close()
+
+	var captured []string
+	tunnel := NewEmbeddedTunnel(NewConnTunnel(local), EmbedOptions{
+		Capture: CaptureSinkFunc(func(_ time.Time, direction Direction, instruction *Instruction) {
+			captured = append(captured, direction.String()+" "+instruction.Opcode)
+		}),
+		WriteFilters: []Filter{FilterFunc(func(instruction *Instruction) (*Instruction, error) {
+			if instruction.Opcode == "mouse" {
+				return nil, nil
+			}
+			return instruction, nil
+		})},
+	})
+	defer tunnel.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_, _ = guacd.Write([]byte("4.sync,1.1;4.sync,1.2;10.disconnect;"))
+	}()
+	var opcodes []string
+	for instruction := range tunnel.Instructions(ctx) {
+		opcodes = append(opcodes, instruction.Opcode)
+	}
+	if err := tunnel.Err(); err != nil {
+		t.Error("Expected guacd ending the session not to be an error, got", err)
+	}
+	if len(opcodes) != 3 || opcodes[2] != OpcodeDisconnect {
+		t.Error("Unexpected instructions", opcodes)
+	}
+
+	go func() {
+		_ = tunnel.Send(NewInstruction("mouse", "1", "1"))
+		_ = tunnel.Send(NewInstruction("sync", "2"))
+	}()
+	written := make([]byte, len("4.sync,1.2;"))
+	if _, err := io.ReadFull(guacd, written); err != nil || string(written) != "4.sync,1.2;" {
+		t.Errorf("Expected the write filter to drop the mouse instruction, got %q, %v", written, err)
+	}
+
+	if len(captured) != 5 {
+		t.Error("Expected the capture to record every instruction, got", captured)
+	}
+}
+
+func TestEmbeddedTunnel_ReadFails(t *testing.T) {
+	local, guacd := net.Pipe()
+	tunnel := NewEmbeddedTunnel(NewConnTunnel(local), EmbedOptions{})
+	defer tunnel.Close()
+
+	instructions := tunnel.Instructions(context.Background())
+	_ = guacd.Close()
+	for range instructions {
+	}
+	if tunnel.Err() == nil {
+		t.Error("Expected the connection closing to end reading with an error")
+	}
+}
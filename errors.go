@@ -1,6 +1,7 @@
 package guac
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -89,6 +90,30 @@ func (e ErrKind) Status() (state Status) {
 	return
 }
 
+// isClientError returns true if the error was caused by the client, in which case its message
+// is safe to report back to the client
+func (e ErrKind) isClientError() bool {
+	switch e {
+	case ErrClientBadType, ErrClient, ErrClientOverrun, ErrClientTimeout, ErrClientTooMany, ErrSecurity, ErrUnauthorized:
+		return true
+	}
+	return false
+}
+
+// asErrGuac returns err as an *ErrGuac, wrapping errors of other types as ErrServer
+func asErrGuac(err error) *ErrGuac {
+	var guacErr *ErrGuac
+	if errors.As(err, &guacErr) {
+		return guacErr
+	}
+	return ErrServer.NewError(err.Error()).(*ErrGuac)
+}
+
+// Unwrap returns the underlying error
+func (e *ErrGuac) Unwrap() error {
+	return e.error
+}
+
 // NewError creates a new error struct instance with Kind and included message
 func (e ErrKind) NewError(args ...string) error {
 	return &ErrGuac{
@@ -0,0 +1,120 @@
+package guac
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// EventSchemaVersion is the version of the JSON schemas of the events the package emits to
+// external consumers, such as rule webhooks, carried by each event in its schema_version
+// field.
+//
+// Within a version, changes are only ever additive: new optional fields and new event types
+// may appear, but fields are never removed, renamed or given another type, and the meaning
+// of existing values does not change. Consumers must ignore fields they don't know. Any
+// other change bumps the version, and the schemas of earlier versions stay available from
+// EventSchemas so pipelines can be checked against both.
+const EventSchemaVersion = 1
+
+// EventSchema is the JSON Schema document of one version of a kind of event
+type EventSchema struct {
+	// Name is the kind of event, such as "event" for the events of a RuleEngine
+	Name    string          `json:"name"`
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// eventSchemas holds the schemas of every kind and version of event emitted
+var eventSchemas = []EventSchema{
+	{Name: "event", Version: 1, Schema: json.RawMessage(eventSchemaV1)},
+	{Name: "audit", Version: 1, Schema: json.RawMessage(auditSchemaV1)},
+}
+
+// eventSchemaV1 describes Event
+const eventSchemaV1 = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "https://github.com/wwt/guac/schemas/event/v1.json",
+  "title": "Tunnel event",
+  "type": "object",
+  "required": ["schema_version", "type", "time", "uuid"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "type": {"type": "string", "description": "connect, disconnect, or a type added later"},
+    "time": {"type": "string", "format": "date-time"},
+    "uuid": {"type": "string", "description": "UUID of the tunnel"},
+    "fields": {
+      "type": "object",
+      "additionalProperties": {"type": "string"},
+      "description": "details of the event, such as connection_id and user"
+    }
+  },
+  "additionalProperties": true
+}`
+
+// EventSchemas returns the schemas of every kind and version of event emitted, ordered by
+// name and version
+func EventSchemas() []EventSchema {
+	schemas := append([]EventSchema(nil), eventSchemas...)
+	sort.Slice(schemas, func(i, j int) bool {
+		if schemas[i].Name != schemas[j].Name {
+			return schemas[i].Name < schemas[j].Name
+		}
+		return schemas[i].Version < schemas[j].Version
+	})
+	return schemas
+}
+
+// LookupEventSchema returns the schema of the given kind and version of event
+func LookupEventSchema(name string, version int) (EventSchema, bool) {
+	for _, schema := range eventSchemas {
+		if schema.Name == name && schema.Version == version {
+			return schema, true
+		}
+	}
+	return EventSchema{}, false
+}
+
+// EventSchemaServer publishes the schemas of events, so consumers can validate what they
+// receive:
+//
+//	GET /schemas
+//
+// responds with the JSON array of every EventSchema, and
+//
+//	GET /schemas?name=<name>&version=<version>
+//
+// with the JSON Schema document of one of them.
+type EventSchemaServer struct{}
+
+func (EventSchemaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(EventSchemas()); err != nil {
+			transportLog.Debug("Failed to write event schemas: ", err)
+		}
+		return
+	}
+
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		version = EventSchemaVersion
+	}
+	schema, ok := LookupEventSchema(name, version)
+	if !ok {
+		http.Error(w, "No such event schema.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	if _, err := w.Write(schema.Schema); err != nil {
+		transportLog.Debug("Failed to write event schema: ", err)
+	}
+}
@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventSchema_CoversEvent(t *testing.T) {
+	schema, ok := LookupEventSchema("event", EventSchemaVersion)
+	if !ok {
+		t.Fatal("Expected a schema for the current version")
+	}
+	var document struct {
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(schema.Schema, &document); err != nil {
+		t.Fatal(err)
+	}
+
+	// every field emitted must be described, so consumers are never surprised
+	eventType := reflect.TypeOf(Event{})
+	for i := 0; i < eventType.NumField(); i++ {
+		name := strings.Split(eventType.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if _, ok := document.Properties[name]; !ok {
+			t.Errorf("Field %q of Event is missing from the schema", name)
+		}
+	}
+
+	event := &Event{Type: EventConnect, UUID: "1"}
+	engine, _ := NewRuleEngine(nil)
+	engine.Fire(event)
+	data, _ := json.Marshal(event)
+	var emitted map[string]interface{}
+	_ = json.Unmarshal(data, &emitted)
+	for _, name := range document.Required {
+		if _, ok := emitted[name]; !ok {
+			t.Errorf("Required field %q is not emitted: %s", name, data)
+		}
+	}
+}
+
+func TestEventSchemaServer(t *testing.T) {
+	server := EventSchemaServer{}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/schemas", nil))
+	var schemas []EventSchema
+	if err := json.NewDecoder(recorder.Body).Decode(&schemas); err != nil || len(schemas) == 0 {
+		t.Fatal("Unexpected schemas", schemas, err)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/schemas?name=event&version=1", nil))
+	if recorder.Header().Get("Content-Type") != "application/schema+json" || !json.Valid(recorder.Body.Bytes()) {
+		t.Error("Unexpected schema response", recorder.Header(), recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/schemas?name=event&version=99", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Expected 404 for an unknown version, got", recorder.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package guac
+
+import (
+	"expvar"
+)
+
+/*
+Counters publishes basic counters about tunnels through expvar, for deployments too small to
+run Prometheus. They are published as a map under the name given to NewCounters, and served
+as JSON with the rest of the process's variables by expvar.Handler:
+
+	counters := guac.NewCounters("guac")
+	server.Counters = counters
+	mux.Handle("/debug/vars", expvar.Handler())
+
+The map holds:
+
+	tunnels         tunnels open
+	connects        tunnels connected
+	connect_errors  failed connect requests, by the name of their Guacamole status
+	bytes_in        bytes sent by clients to guacd
+	bytes_out       bytes sent by guacd to clients
+*/
+type Counters struct {
+	tunnels, connects, bytesIn, bytesOut expvar.Int
+	connectErrors                        expvar.Map
+}
+
+// NewCounters creates counters and publishes them under name. Like expvar.Publish, it panics
+// if the name is already in use.
+func NewCounters(name string) *Counters {
+	c := &Counters{}
+	vars := expvar.NewMap(name)
+	vars.Set("tunnels", &c.tunnels)
+	vars.Set("connects", &c.connects)
+	vars.Set("connect_errors", &c.connectErrors)
+	vars.Set("bytes_in", &c.bytesIn)
+	vars.Set("bytes_out", &c.bytesOut)
+	return c
+}
+
+// connected counts a tunnel connecting, returning it wrapped to count its bytes
+func (c *Counters) connected(tunnel Tunnel) Tunnel {
+	c.connects.Add(1)
+	return newCountingTunnel(tunnel, c.bytesIn.Add, c.bytesOut.Add)
+}
+
+// connectFailed counts a connect request failing with err
+func (c *Counters) connectFailed(err error) {
+	c.connectErrors.Add(asErrGuac(err).Status.String(), 1)
+}
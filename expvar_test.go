@@ -0,0 +1,54 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer_Counters(t *testing.T) {
+	counters := NewCounters("guac_test_server_counters")
+	fail := false
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		if fail {
+			return nil, ErrUpstreamUnavailable.NewError("down")
+		}
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: &bytes.Buffer{}}, uuid: "2b7e7a5e-3c5f-4a4e-9d3e-5b4e2f7a9c01"}, nil
+	})
+	server.Counters = counters
+
+	request := func(method, query string, body []byte) string {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(method, "/?"+query, bytes.NewReader(body)))
+		data, _ := io.ReadAll(response.Body)
+		return string(data)
+	}
+	uuid := request(http.MethodPost, "connect", nil)
+	request(http.MethodPost, "write:"+uuid, []byte("3.key,2.65,1.1;"))
+	fail = true
+	request(http.MethodPost, "connect", nil)
+
+	var vars struct {
+		Tunnels       int64            `json:"tunnels"`
+		Connects      int64            `json:"connects"`
+		ConnectErrors map[string]int64 `json:"connect_errors"`
+		BytesIn       int64            `json:"bytes_in"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("guac_test_server_counters").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Tunnels != 1 || vars.Connects != 1 || vars.BytesIn != 15 || vars.ConnectErrors["RESOURCE_NOT_FOUND"] != 1 {
+		t.Errorf("Unexpected counters %+v", vars)
+	}
+
+	if err := server.KillTunnel(uuid, "done"); err != nil {
+		t.Fatal(err)
+	}
+	if got := counters.tunnels.Value(); got != 0 {
+		t.Error("Expected no tunnels once killed, got", got)
+	}
+}
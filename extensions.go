@@ -0,0 +1,167 @@
+package guac
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// builtinOpcodes are the opcodes of the Guacamole protocol which extensions may not redefine
+var builtinOpcodes = map[string]bool{
+	OpcodeArgs: true, OpcodeAudio: true, OpcodeConnect: true, OpcodeImage: true, OpcodeName: true,
+	OpcodeReady: true, OpcodeSelect: true, OpcodeSize: true, OpcodeVideo: true,
+	OpcodeDisconnect: true, OpcodeError: true, OpcodeNop: true, OpcodeRequired: true,
+	OpcodeSync: true, OpcodeLog: true, OpcodeMsg: true,
+	OpcodeDispose: true, OpcodeMove: true,
+	OpcodeKey: true, OpcodeMouse: true, OpcodeTouch: true,
+	OpcodeAck: true, OpcodeArgv: true, OpcodeBlob: true, OpcodeBody: true, OpcodeClipboard: true,
+	OpcodeEnd: true, OpcodeFile: true, OpcodeImg: true, OpcodeNest: true, OpcodePipe: true,
+	OpcodePut: true,
+}
+
+// OpcodeHandler handles an instruction with a registered custom opcode. Like a Filter, it
+// returns the instruction to forward, possibly modified, nil to drop it, or an error to abort
+// the read or write in progress.
+type OpcodeHandler func(direction Direction, instruction *Instruction) (*Instruction, error)
+
+// OpcodeSpec describes a custom instruction added by a vendor extension of guacd or the client
+type OpcodeSpec struct {
+	// Opcode is the opcode of the instruction
+	Opcode string
+	// Args names the arguments of the instruction, in order
+	Args []string
+	// Variadic allows arguments beyond those named
+	Variadic bool
+	// Directions limits which ways the instruction may travel, both if empty
+	Directions []Direction
+	// Handler optionally handles each instruction with the opcode
+	Handler OpcodeHandler
+}
+
+// allows returns true if the instruction may travel in the given direction
+func (s *OpcodeSpec) allows(direction Direction) bool {
+	if len(s.Directions) == 0 {
+		return true
+	}
+	for _, d := range s.Directions {
+		if d == direction {
+			return true
+		}
+	}
+	return false
+}
+
+// OpcodeRegistry knows the custom opcodes of vendor extensions, so their instructions can be
+// validated, decoded and routed to handlers rather than passed along as opaque traffic. Its
+// Filter checks instructions travelling through a FilteredTunnel. It is safe for concurrent
+// use.
+type OpcodeRegistry struct {
+	sync.RWMutex
+	specs map[string]*OpcodeSpec
+}
+
+// NewOpcodeRegistry creates an empty registry
+func NewOpcodeRegistry() *OpcodeRegistry {
+	return &OpcodeRegistry{
+		specs: map[string]*OpcodeSpec{},
+	}
+}
+
+// Register adds a custom opcode. Opcodes of the Guacamole protocol and opcodes already
+// registered are refused.
+func (r *OpcodeRegistry) Register(spec OpcodeSpec) error {
+	if spec.Opcode == "" {
+		return fmt.Errorf("custom opcode must not be empty")
+	}
+	if builtinOpcodes[spec.Opcode] {
+		return fmt.Errorf("opcode %q is part of the Guacamole protocol", spec.Opcode)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.specs[spec.Opcode]; ok {
+		return fmt.Errorf("opcode %q is already registered", spec.Opcode)
+	}
+	r.specs[spec.Opcode] = &spec
+	return nil
+}
+
+// Lookup returns the spec of a registered opcode
+func (r *OpcodeRegistry) Lookup(opcode string) (*OpcodeSpec, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	spec, ok := r.specs[opcode]
+	return spec, ok
+}
+
+// Opcodes returns the registered opcodes, sorted
+func (r *OpcodeRegistry) Opcodes() []string {
+	r.RLock()
+	opcodes := make([]string, 0, len(r.specs))
+	for opcode := range r.specs {
+		opcodes = append(opcodes, opcode)
+	}
+	r.RUnlock()
+	sort.Strings(opcodes)
+	return opcodes
+}
+
+// Validate checks an instruction with a registered opcode has the arguments its spec requires.
+// Instructions with other opcodes are valid.
+func (r *OpcodeRegistry) Validate(instruction *Instruction) error {
+	spec, ok := r.Lookup(instruction.Opcode)
+	if !ok {
+		return nil
+	}
+	if len(instruction.Args) < len(spec.Args) || (!spec.Variadic && len(instruction.Args) > len(spec.Args)) {
+		return fmt.Errorf("instruction %q has %v arguments, expected %v", instruction.Opcode, len(instruction.Args), len(spec.Args))
+	}
+	return nil
+}
+
+// Decode returns the arguments of an instruction with a registered opcode by name. Arguments
+// beyond those named are left out.
+func (r *OpcodeRegistry) Decode(instruction *Instruction) (map[string]string, error) {
+	spec, ok := r.Lookup(instruction.Opcode)
+	if !ok {
+		return nil, fmt.Errorf("opcode %q is not registered", instruction.Opcode)
+	}
+	if err := r.Validate(instruction); err != nil {
+		return nil, err
+	}
+	args := make(map[string]string, len(spec.Args))
+	for i, name := range spec.Args {
+		args[name] = instruction.Args[i]
+	}
+	return args, nil
+}
+
+// Filter returns a Filter for instructions travelling in the given direction. Instructions
+// with registered opcodes which are malformed or travel the wrong way abort the read or write,
+// valid ones are passed to their spec's Handler, and other instructions pass unchanged.
+func (r *OpcodeRegistry) Filter(direction Direction) Filter {
+	return FilterFunc(func(instruction *Instruction) (*Instruction, error) {
+		spec, ok := r.Lookup(instruction.Opcode)
+		if !ok {
+			return instruction, nil
+		}
+		if err := r.Validate(instruction); err != nil {
+			return nil, opcodeError(direction, err.Error())
+		}
+		if !spec.allows(direction) {
+			return nil, opcodeError(direction, fmt.Sprintf("instruction %q may not be sent by the %v", instruction.Opcode, direction))
+		}
+		if spec.Handler == nil {
+			return instruction, nil
+		}
+		return spec.Handler(direction, instruction)
+	})
+}
+
+// opcodeError blames whichever side sent an invalid instruction
+func opcodeError(direction Direction, message string) error {
+	if direction == FromClient {
+		return ErrClient.NewError(message)
+	}
+	return ErrUpstream.NewError(message)
+}
@@ -0,0 +1,82 @@
+package guac
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpcodeRegistry_Register(t *testing.T) {
+	registry := NewOpcodeRegistry()
+	if err := registry.Register(OpcodeSpec{Opcode: "acme-beep", Args: []string{"pitch"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []OpcodeSpec{{}, {Opcode: OpcodeSync}, {Opcode: "acme-beep"}} {
+		if err := registry.Register(spec); err == nil {
+			t.Errorf("Expected %q to be refused", spec.Opcode)
+		}
+	}
+	if opcodes := registry.Opcodes(); !reflect.DeepEqual(opcodes, []string{"acme-beep"}) {
+		t.Errorf("Unexpected opcodes %v", opcodes)
+	}
+}
+
+func TestOpcodeRegistry_Decode(t *testing.T) {
+	registry := NewOpcodeRegistry()
+	_ = registry.Register(OpcodeSpec{Opcode: "acme-beep", Args: []string{"pitch", "length"}})
+	_ = registry.Register(OpcodeSpec{Opcode: "acme-log", Args: []string{"level"}, Variadic: true})
+
+	args, err := registry.Decode(NewInstruction("acme-beep", "440", "100"))
+	if err != nil || !reflect.DeepEqual(args, map[string]string{"pitch": "440", "length": "100"}) {
+		t.Errorf("Unexpected arguments %v %v", args, err)
+	}
+	if _, err = registry.Decode(NewInstruction("acme-beep", "440")); err == nil {
+		t.Error("Expected missing argument to be refused")
+	}
+	if _, err = registry.Decode(NewInstruction("acme-beep", "440", "100", "1")); err == nil {
+		t.Error("Expected extra argument to be refused")
+	}
+	if _, err = registry.Decode(NewInstruction("acme-log", "info", "a", "b")); err != nil {
+		t.Error("Expected variadic arguments to be allowed, got", err)
+	}
+	if _, err = registry.Decode(NewSyncInstruction(1)); err == nil {
+		t.Error("Expected unregistered opcode to be refused")
+	}
+}
+
+func TestOpcodeRegistry_Filter(t *testing.T) {
+	var handled []string
+	registry := NewOpcodeRegistry()
+	_ = registry.Register(OpcodeSpec{
+		Opcode:     "acme-beep",
+		Args:       []string{"pitch"},
+		Directions: []Direction{FromGuacd},
+		Handler: func(direction Direction, instruction *Instruction) (*Instruction, error) {
+			handled = append(handled, instruction.Args[0])
+			return nil, nil
+		},
+	})
+
+	conn := &fakeConn{ToRead: []byte("9.acme-beep,3.440;4.sync,1.1;")}
+	tunnel := NewFilteredTunnel(&fakeTunnel{reader: NewStream(conn, time.Minute), writer: &bytes.Buffer{}})
+	tunnel.AddReadFilter(registry.Filter(FromGuacd))
+	tunnel.AddWriteFilter(registry.Filter(FromClient))
+
+	reader := tunnel.AcquireReader()
+	ins, err := reader.ReadSome()
+	tunnel.ReleaseReader()
+	if err != nil || string(ins) != "4.sync,1.1;" {
+		t.Errorf("Expected handled instruction to be dropped, got %q %v", ins, err)
+	}
+	if !reflect.DeepEqual(handled, []string{"440"}) {
+		t.Errorf("Expected handler to be called, got %v", handled)
+	}
+
+	writer := tunnel.AcquireWriter()
+	_, err = writer.Write([]byte("9.acme-beep,3.440;"))
+	tunnel.ReleaseWriter()
+	if err == nil || asErrGuac(err).Kind != ErrClient {
+		t.Error("Expected client sending a guacd instruction to be refused, got", err)
+	}
+}
@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// fairLock is a mutex granted in the order goroutines ask for it, which they may give up
+// waiting for. Like CountedLock, it counts the goroutines holding or waiting for it.
+type fairLock struct {
+	mu   sync.Mutex
+	held bool
+	// waiters holds a channel for each goroutine waiting, closed when it is granted the lock
+	waiters list.List
+	count   atomic.Int32
+}
+
+// Lock waits for the lock
+func (l *fairLock) Lock() {
+	_ = l.lockContext(context.Background())
+}
+
+// lockContext waits for the lock until ctx is done, returning ctx's error if it gave up
+func (l *fairLock) lockContext(ctx context.Context) error {
+	l.count.Add(1)
+	l.mu.Lock()
+	if !l.held {
+		l.held = true
+		l.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{})
+	waiting := l.waiters.PushBack(granted)
+	l.mu.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	select {
+	case <-granted:
+		// granted while giving up, so it passes to the next in line
+		l.mu.Unlock()
+		l.Unlock()
+	default:
+		l.waiters.Remove(waiting)
+		l.mu.Unlock()
+		l.count.Add(-1)
+	}
+	return ctx.Err()
+}
+
+// Unlock hands the lock to the goroutine which has waited longest, if any
+func (l *fairLock) Unlock() {
+	l.count.Add(-1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next := l.waiters.Front(); next != nil {
+		l.waiters.Remove(next)
+		close(next.Value.(chan struct{}))
+		return
+	}
+	l.held = false
+}
+
+// HasQueued returns true if a goroutine is waiting on the lock
+func (l *fairLock) HasQueued() bool {
+	return l.count.Load() > 1
+}
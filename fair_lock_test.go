@@ -0,0 +1,57 @@
+package guac
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFairLock_Order(t *testing.T) {
+	var lock fairLock
+	lock.Lock()
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			lock.Lock()
+			order <- i
+			lock.Unlock()
+		}(i)
+		// each goroutine queues before the next starts
+		for lock.count.Load() != int32(i+2) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if !lock.HasQueued() {
+		t.Error("Expected waiting goroutines to be counted")
+	}
+
+	lock.Unlock()
+	for i := 0; i < 3; i++ {
+		if got := <-order; got != i {
+			t.Fatalf("Expected goroutine %v to get the lock, got %v", i, got)
+		}
+	}
+	if lock.HasQueued() {
+		t.Error("Expected nobody to be waiting")
+	}
+}
+
+func TestFairLock_GiveUp(t *testing.T) {
+	var lock fairLock
+	lock.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lock.lockContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected waiting to time out, got %v", err)
+	}
+	if lock.HasQueued() {
+		t.Error("Expected the goroutine which gave up not to be counted")
+	}
+
+	lock.Unlock()
+	if err := lock.lockContext(context.Background()); err != nil {
+		t.Errorf("Expected the lock to be free, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package guac
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// FileTransfer describes a file passing through a tunnel
+type FileTransfer struct {
+	// Direction is FromClient for uploads and FromGuacd for downloads
+	Direction Direction `json:"direction"`
+	// Stream is the index of the stream carrying the file
+	Stream string `json:"stream"`
+	// Mimetype is the type of the file as declared by the sender
+	Mimetype string `json:"mimetype"`
+	// Filename is the name of the file as declared by the sender
+	Filename string `json:"filename"`
+	// Transferred is the number of bytes received so far
+	Transferred int64 `json:"transferred"`
+	// SHA256 is the hex encoded SHA-256 of the file, set once the transfer completes
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// FileOpenFunc is called when a file transfer starts and returns a writer which receives the
+// contents of the file as they pass through the tunnel, or nil to let the transfer through
+// without one. The writer is closed when the transfer ends. If the writer returns an error, or
+// FileOpenFunc itself does, the transfer is aborted.
+type FileOpenFunc func(transfer *FileTransfer) (io.WriteCloser, error)
+
+// FileFilter assembles the file, put and body streams of uploads and downloads into Go
+// writers, so file contents can be scanned or stored elsewhere as they are transferred. The
+// SHA-256 of every transfer is computed as it streams past, for matching transfers against
+// known files, and reported with the transfer in the tunnel's Stats, AuditFileTransfer events
+// and EventFileTransfer rule events.
+// Aborted transfers are cancelled on both ends, although the receiver may be left with the
+// part of the file that was transferred before the abort.
+//
+//	files := guac.NewFileFilter(tunnel, open)
+//	tunnel.AddReadFilter(files.ReadFilter())
+//	tunnel.AddWriteFilter(files.WriteFilter())
+type FileFilter struct {
+	tunnel *FilteredTunnel
+	open   FileOpenFunc
+
+	// Progress is optionally called after every blob of a transfer is received
+	Progress func(transfer *FileTransfer)
+	// OnComplete is optionally called when a transfer ends, with the error that aborted it if
+	// it did not complete. SHA256 is only set for completed transfers.
+	OnComplete func(transfer *FileTransfer, err error)
+	// Audit optionally receives an AuditFileTransfer event for every transfer which ends
+	Audit AuditSink
+	// Transport is the transport reported in audit events, "http" or "websocket"
+	Transport string
+	// Rules optionally has an EventFileTransfer fired for every transfer which ends, so rules
+	// can post transfers and their hashes to webhooks
+	Rules *RuleEngine
+
+	sync.Mutex
+	streams map[Direction]map[string]*fileStream
+}
+
+type fileStream struct {
+	transfer FileTransfer
+	writer   io.WriteCloser
+	hash     hash.Hash
+}
+
+// NewFileFilter creates a file filter for the given tunnel. Its read and write filters must
+// both be installed on the tunnel. open may be nil if only the hashes are of interest.
+func NewFileFilter(tunnel *FilteredTunnel, open FileOpenFunc) *FileFilter {
+	return &FileFilter{
+		tunnel: tunnel,
+		open:   open,
+		streams: map[Direction]map[string]*fileStream{
+			FromClient: {},
+			FromGuacd:  {},
+		},
+	}
+}
+
+// ReadFilter returns the filter handling downloads, to be installed with AddReadFilter
+func (f *FileFilter) ReadFilter() MultiFilter {
+	return &fileDirectionFilter{files: f, direction: FromGuacd}
+}
+
+// WriteFilter returns the filter handling uploads, to be installed with AddWriteFilter
+func (f *FileFilter) WriteFilter() MultiFilter {
+	return &fileDirectionFilter{files: f, direction: FromClient}
+}
+
+// WriteFile uploads a file into the remote session as if the client had sent it
+func WriteFile(writer StreamWriter, mimetype, filename string, data io.Reader) error {
+	return writer.WriteStream("file", data, mimetype, filename)
+}
+
+type fileDirectionFilter struct {
+	files     *FileFilter
+	direction Direction
+}
+
+func (d *fileDirectionFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	instructions, err := d.FilterAll(instruction)
+	if err != nil || len(instructions) == 0 {
+		return nil, err
+	}
+	return instructions[0], nil
+}
+
+func (d *fileDirectionFilter) FilterAll(instruction *Instruction) ([]*Instruction, error) {
+	f := d.files
+	args := instruction.Args
+
+	switch instruction.Opcode {
+	case OpcodeFile:
+		if len(args) >= 3 {
+			return f.start(d.direction, instruction, args[0], args[1], args[2])
+		}
+	case OpcodePut:
+		if d.direction == FromClient && len(args) >= 4 {
+			return f.start(d.direction, instruction, args[1], args[2], args[3])
+		}
+	case OpcodeBody:
+		if d.direction == FromGuacd && len(args) >= 4 {
+			return f.start(d.direction, instruction, args[1], args[2], args[3])
+		}
+	case OpcodeBlob:
+		if len(args) >= 2 {
+			return f.blob(d.direction, instruction, args[0], args[1])
+		}
+	case OpcodeEnd:
+		if len(args) >= 1 {
+			f.end(d.direction, args[0], nil)
+		}
+	case OpcodeAck:
+		// the receiver of a transfer travelling the other way has given up on it
+		if len(args) >= 3 && args[2] != "0" {
+			f.end(d.opposite(), args[0], fmt.Errorf("transfer rejected: %v", args[1]))
+		}
+	}
+	return []*Instruction{instruction}, nil
+}
+
+func (d *fileDirectionFilter) opposite() Direction {
+	if d.direction == FromClient {
+		return FromGuacd
+	}
+	return FromClient
+}
+
+// start begins tracking a new transfer
+func (f *FileFilter) start(direction Direction, instruction *Instruction, index, mimetype, filename string) ([]*Instruction, error) {
+	stream := &fileStream{
+		transfer: FileTransfer{
+			Direction: direction,
+			Stream:    index,
+			Mimetype:  mimetype,
+			Filename:  filename,
+		},
+		hash: sha256.New(),
+	}
+
+	if f.open != nil {
+		writer, err := f.open(&stream.transfer)
+		if err != nil {
+			f.reject(direction, index, err)
+			return nil, nil
+		}
+		stream.writer = writer
+	}
+
+	f.Lock()
+	f.streams[direction][index] = stream
+	f.Unlock()
+	return []*Instruction{instruction}, nil
+}
+
+// blob passes the contents of a blob to the transfer's writer, aborting the transfer on error
+func (f *FileFilter) blob(direction Direction, instruction *Instruction, index, blob string) ([]*Instruction, error) {
+	f.Lock()
+	stream, ok := f.streams[direction][index]
+	f.Unlock()
+	if !ok {
+		return []*Instruction{instruction}, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err == nil && stream.writer != nil {
+		_, err = stream.writer.Write(data)
+	}
+	if err != nil {
+		f.end(direction, index, err)
+		f.reject(direction, index, err)
+
+		// tell the receiver the stream is over
+		return []*Instruction{NewInstruction(OpcodeEnd, index)}, nil
+	}
+
+	stream.hash.Write(data)
+	stream.transfer.Transferred += int64(len(data))
+	if f.Progress != nil {
+		f.Progress(&stream.transfer)
+	}
+	return []*Instruction{instruction}, nil
+}
+
+// end stops tracking a transfer and closes its writer, with an error if the transfer failed
+func (f *FileFilter) end(direction Direction, index string, cause error) {
+	f.Lock()
+	stream, ok := f.streams[direction][index]
+	delete(f.streams[direction], index)
+	f.Unlock()
+	if !ok {
+		return
+	}
+
+	if cause == nil {
+		stream.transfer.SHA256 = hex.EncodeToString(stream.hash.Sum(nil))
+		filtersLog.Infof("File transfer %q on stream %v from %v complete: %v bytes, SHA-256 %v",
+			stream.transfer.Filename, index, direction, stream.transfer.Transferred, stream.transfer.SHA256)
+	}
+	if f.OnComplete != nil {
+		f.OnComplete(&stream.transfer, cause)
+	}
+	f.report(&stream.transfer, cause)
+
+	if stream.writer == nil {
+		return
+	}
+	var err error
+	if closer, ok := stream.writer.(interface{ CloseWithError(error) error }); ok && cause != nil {
+		err = closer.CloseWithError(cause)
+	} else {
+		err = stream.writer.Close()
+	}
+	if err != nil {
+		filtersLog.Debugf("Error closing file transfer %q: %v", stream.transfer.Filename, err)
+	}
+}
+
+// report records a transfer which ended in the stats of the tunnel, if it completed, and
+// passes it to the audit sink and rules, if any
+func (f *FileFilter) report(transfer *FileTransfer, cause error) {
+	if cause == nil {
+		f.tunnel.files.add(*transfer)
+	}
+	reason := ""
+	if cause != nil {
+		reason = cause.Error()
+	}
+	if f.Audit != nil {
+		emitAudit(f.Audit, &AuditEvent{
+			Type:         AuditFileTransfer,
+			Transport:    f.Transport,
+			UUID:         f.tunnel.GetUUID(),
+			ConnectionID: f.tunnel.ConnectionID(),
+			Reason:       reason,
+			File:         transfer,
+		})
+	}
+	if f.Rules != nil {
+		fields := map[string]string{
+			"direction": transfer.Direction.String(),
+			"filename":  transfer.Filename,
+			"mimetype":  transfer.Mimetype,
+			"size":      strconv.FormatInt(transfer.Transferred, 10),
+		}
+		if transfer.SHA256 != "" {
+			fields["sha256"] = transfer.SHA256
+		}
+		if reason != "" {
+			fields["reason"] = reason
+		}
+		f.Rules.Fire(&Event{Type: EventFileTransfer, UUID: f.tunnel.GetUUID(), Fields: fields, Tunnel: f.tunnel})
+	}
+}
+
+// reject tells the sender of a transfer that it has been refused
+func (f *FileFilter) reject(direction Direction, index string, cause error) {
+	filtersLog.Infof("File transfer on stream %v from %v aborted: %v", index, direction, cause)
+
+	ack := NewAckInstruction(index, "File transfer aborted.", ClientForbidden)
+	if direction == FromClient {
+		f.tunnel.WriteToClient(ack)
+		return
+	}
+	if err := f.tunnel.WriteInstruction(ack); err != nil {
+		filtersLog.Debug("Failed to abort download", err)
+	}
+}
+
+// FileReaderFunc adapts a function consuming a transfer as an io.Reader into a FileOpenFunc.
+// The function runs in its own goroutine and the tunnel blocks while it is not reading, so it
+// must read until EOF or an error.
+func FileReaderFunc(fn func(transfer *FileTransfer, data io.Reader) error) FileOpenFunc {
+	return func(transfer *FileTransfer) (io.WriteCloser, error) {
+		reader, writer := io.Pipe()
+		copied := *transfer
+		go func() {
+			_ = reader.CloseWithError(fn(&copied, reader))
+		}()
+		return writer, nil
+	}
+}
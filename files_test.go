@@ -0,0 +1,172 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+type fileSink struct {
+	bytes.Buffer
+	closed bool
+	fail   bool
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	if s.fail {
+		return 0, errors.New("blocked")
+	}
+	return s.Buffer.Write(p)
+}
+
+func (s *fileSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFileFilter_Upload(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+
+	sink := &fileSink{}
+	var opened *FileTransfer
+	var progress []int64
+	files := NewFileFilter(tunnel, func(transfer *FileTransfer) (io.WriteCloser, error) {
+		opened = transfer
+		return sink, nil
+	})
+	files.Progress = func(transfer *FileTransfer) {
+		progress = append(progress, transfer.Transferred)
+	}
+	tunnel.AddWriteFilter(files.WriteFilter())
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	in := "4.file,1.0,10.text/plain,5.a.txt;4.blob,1.0,4.aGVs;4.blob,1.0,4.bG8=;3.end,1.0;"
+	if _, err := writer.Write([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != in {
+		t.Errorf("expected upload to pass through, got %q", out.String())
+	}
+	if opened == nil || opened.Filename != "a.txt" || opened.Direction != FromClient {
+		t.Errorf("unexpected transfer %+v", opened)
+	}
+	if sink.String() != "hello" || !sink.closed {
+		t.Errorf("unexpected sink contents %q (closed %v)", sink.String(), sink.closed)
+	}
+	if len(progress) != 2 || progress[1] != 5 {
+		t.Errorf("unexpected progress %v", progress)
+	}
+}
+
+func TestFileFilter_AbortUpload(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+
+	files := NewFileFilter(tunnel, func(transfer *FileTransfer) (io.WriteCloser, error) {
+		return &fileSink{fail: true}, nil
+	})
+	tunnel.AddWriteFilter(files.WriteFilter())
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	if _, err := writer.Write([]byte("4.file,1.0,10.text/plain,5.a.txt;4.blob,1.0,4.aGVs;")); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "4.file,1.0,10.text/plain,5.a.txt;3.end,1.0;"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if want := "3.ack,1.0,22.File transfer aborted.,3.771;"; string(tunnel.takePending()) != want {
+		t.Errorf("expected client to be sent %q", want)
+	}
+}
+
+func TestFileReaderFunc(t *testing.T) {
+	done := make(chan string)
+	open := FileReaderFunc(func(transfer *FileTransfer, data io.Reader) error {
+		b, err := io.ReadAll(data)
+		done <- transfer.Filename + ":" + string(b)
+		return err
+	})
+
+	writer, err := open(&FileTransfer{Filename: "a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = writer.Write([]byte("hello"))
+	_ = writer.Close()
+
+	if got := <-done; got != "a.txt:hello" {
+		t.Errorf("unexpected %q", got)
+	}
+}
+
+func TestFileFilter_Hash(t *testing.T) {
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: &bytes.Buffer{}})
+
+	var completed []*FileTransfer
+	files := NewFileFilter(tunnel, nil)
+	files.OnComplete = func(transfer *FileTransfer, err error) {
+		if err != nil {
+			t.Error("unexpected error", err)
+		}
+		completed = append(completed, transfer)
+	}
+	tunnel.AddWriteFilter(files.WriteFilter())
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	in := "4.file,1.0,10.text/plain,5.a.txt;4.blob,1.0,4.aGVs;4.blob,1.0,4.bG8=;3.end,1.0;"
+	if _, err := writer.Write([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256("hello")
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if len(completed) != 1 || completed[0].SHA256 != want || completed[0].Transferred != 5 {
+		t.Errorf("unexpected completed transfers %+v", completed)
+	}
+}
+
+func TestFileFilter_Report(t *testing.T) {
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: &bytes.Buffer{}})
+
+	var events []*AuditEvent
+	files := NewFileFilter(tunnel, nil)
+	files.Transport = "websocket"
+	files.Audit = AuditSinkFunc(func(event *AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	tunnel.AddWriteFilter(files.WriteFilter())
+
+	writer := tunnel.AcquireWriter()
+	if _, err := writer.Write([]byte("4.file,1.0,10.text/plain,5.a.txt;4.blob,1.0,8.aGVsbG8=;3.end,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if len(events) != 1 || events[0].Type != AuditFileTransfer || events[0].File == nil || events[0].File.SHA256 != want {
+		t.Fatalf("Expected the transfer and its hash to be audited, got %+v", events)
+	}
+	encoded, err := json.Marshal(events[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), `"file":{"direction":"client","stream":"0","mimetype":"text/plain","filename":"a.txt","transferred":5,"sha256":"`+want+`"}`) {
+		t.Error("Unexpected audit event", string(encoded))
+	}
+	if stats := tunnel.Stats(); len(stats.Files) != 1 || stats.Files[0].SHA256 != want {
+		t.Errorf("Expected the transfer in the stats, got %+v", stats.Files)
+	}
+}
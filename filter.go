@@ -0,0 +1,496 @@
+package guac
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Filter intercepts instructions passing through a FilteredTunnel. Returning a nil
+// instruction drops it, returning an error aborts the read or write in progress.
+type Filter interface {
+	Filter(instruction *Instruction) (*Instruction, error)
+}
+
+// FilterFunc adapts an ordinary function to the Filter interface.
+type FilterFunc func(*Instruction) (*Instruction, error)
+
+// Filter calls f(instruction)
+func (f FilterFunc) Filter(instruction *Instruction) (*Instruction, error) {
+	return f(instruction)
+}
+
+// MultiFilter is a Filter which may replace a single instruction with any number of
+// instructions, for example to release instructions it held back earlier. FilteredTunnel uses
+// FilterAll in preference to Filter when a filter implements both.
+type MultiFilter interface {
+	Filter
+	FilterAll(instruction *Instruction) ([]*Instruction, error)
+}
+
+// Direction identifies which way an instruction is travelling through a tunnel
+type Direction int
+
+const (
+	// FromClient marks instructions sent by the client to guacd
+	FromClient Direction = iota
+	// FromGuacd marks instructions sent by guacd to the client
+	FromGuacd
+)
+
+// String returns a short name for the direction
+func (d Direction) String() string {
+	if d == FromClient {
+		return "client"
+	}
+	return "guacd"
+}
+
+// MarshalText encodes the direction as its String
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// InstructionWriter sends complete instructions to guacd without interleaving them with
+// other writers.
+type InstructionWriter interface {
+	WriteInstruction(instruction *Instruction) error
+}
+
+// FilteredTunnel wraps a Tunnel, passing every instruction read from guacd through the read
+// filters and every instruction written by the client through the write filters.
+//
+// Writes are only forwarded once a complete instruction has been received, so instructions
+// injected with WriteInstruction are never interleaved with partial client instructions.
+type FilteredTunnel struct {
+	Tunnel
+
+	filterLock   sync.RWMutex
+	readFilters  []namedFilter
+	writeFilters []namedFilter
+
+	// writerLock provides the exclusive client writer semantics of AcquireWriter while the
+	// wrapped tunnel's writer is only held for the duration of a single flush.
+	writerLock CountedLock
+	writer     filteredWriter
+	flushLock  fairLock
+	limits     InstructionLimits
+
+	// streams allocates indices for streams opened by WriteStream
+	streams streamIndexPool
+
+	// counters counts the instructions passing through
+	counters tunnelCounters
+	// files keeps the latest file transfers completed through a FileFilter
+	files recentFiles
+
+	// pending holds instructions queued by WriteToClient
+	pendingLock sync.Mutex
+	pending     []byte
+}
+
+// NewFilteredTunnel wraps the given tunnel with no filters installed.
+func NewFilteredTunnel(tunnel Tunnel) *FilteredTunnel {
+	t := &FilteredTunnel{
+		Tunnel: tunnel,
+		limits: DefaultInstructionLimits,
+	}
+	t.counters.created = time.Now()
+	t.writer.tunnel = t
+	return t
+}
+
+// namedFilter is an installed filter along with the name it was added under, if any
+type namedFilter struct {
+	filter Filter
+	name   string
+}
+
+// AddReadFilter appends a filter applied to instructions sent from guacd to the client.
+func (t *FilteredTunnel) AddReadFilter(filter Filter) {
+	t.filterLock.Lock()
+	t.readFilters = append(t.readFilters, namedFilter{filter: filter})
+	t.filterLock.Unlock()
+}
+
+// AddWriteFilter appends a filter applied to instructions sent from the client to guacd.
+func (t *FilteredTunnel) AddWriteFilter(filter Filter) {
+	t.filterLock.Lock()
+	t.writeFilters = append(t.writeFilters, namedFilter{filter: filter})
+	t.filterLock.Unlock()
+}
+
+// AddFilters appends read and write filters together under a name, replacing any filters
+// already added under it, so they can later be taken out with RemoveFilters. Filters may be
+// added and removed while the tunnel is in use: each instruction passes through the filters
+// installed when it was received, so changes take effect between instructions.
+func (t *FilteredTunnel) AddFilters(name string, read, write []Filter) {
+	t.filterLock.Lock()
+	defer t.filterLock.Unlock()
+	t.readFilters = withoutFilters(t.readFilters, name)
+	t.writeFilters = withoutFilters(t.writeFilters, name)
+	for _, filter := range read {
+		t.readFilters = append(t.readFilters, namedFilter{filter: filter, name: name})
+	}
+	for _, filter := range write {
+		t.writeFilters = append(t.writeFilters, namedFilter{filter: filter, name: name})
+	}
+}
+
+// RemoveFilters removes the filters added under name, returning false if there were none.
+// Filters tracking streams, such as a FileFilter, stop doing so for streams in progress.
+func (t *FilteredTunnel) RemoveFilters(name string) bool {
+	t.filterLock.Lock()
+	defer t.filterLock.Unlock()
+	read, write := len(t.readFilters), len(t.writeFilters)
+	t.readFilters = withoutFilters(t.readFilters, name)
+	t.writeFilters = withoutFilters(t.writeFilters, name)
+	return len(t.readFilters) != read || len(t.writeFilters) != write
+}
+
+// FilterNames returns the names filters were added under with AddFilters, in order.
+func (t *FilteredTunnel) FilterNames() []string {
+	t.filterLock.RLock()
+	defer t.filterLock.RUnlock()
+	var names []string
+	seen := map[string]bool{}
+	for _, filters := range [][]namedFilter{t.readFilters, t.writeFilters} {
+		for _, filter := range filters {
+			if filter.name != "" && !seen[filter.name] {
+				seen[filter.name] = true
+				names = append(names, filter.name)
+			}
+		}
+	}
+	return names
+}
+
+// withoutFilters returns a copy of filters without those named name, leaving the original for
+// instructions being filtered
+func withoutFilters(filters []namedFilter, name string) []namedFilter {
+	kept := make([]namedFilter, 0, len(filters))
+	for _, filter := range filters {
+		if filter.name != name || name == "" {
+			kept = append(kept, filter)
+		}
+	}
+	return kept
+}
+
+// SetInstructionLimits replaces the limits on the size of instructions written by the client,
+// which are DefaultInstructionLimits unless changed. It must be called before the tunnel is
+// used.
+func (t *FilteredTunnel) SetInstructionLimits(limits InstructionLimits) {
+	t.limits = limits
+}
+
+// AcquireReader acquires the wrapped reader and applies the read filters to it
+func (t *FilteredTunnel) AcquireReader() InstructionReader {
+	return &filteredReader{
+		reader: t.Tunnel.AcquireReader(),
+		tunnel: t,
+	}
+}
+
+// AcquireWriter returns a writer which applies the write filters
+func (t *FilteredTunnel) AcquireWriter() io.Writer {
+	t.writerLock.Lock()
+	return &t.writer
+}
+
+// ReleaseWriter releases the writer lock
+func (t *FilteredTunnel) ReleaseWriter() {
+	t.writerLock.Unlock()
+}
+
+// HasQueuedWriterThreads returns true if more than one goroutine is trying to write
+func (t *FilteredTunnel) HasQueuedWriterThreads() bool {
+	return t.writerLock.HasQueued()
+}
+
+// WriteInstruction sends an instruction to guacd, bypassing the write filters, failing if its
+// turn takes longer than DefaultWriteTimeout to come.
+func (t *FilteredTunnel) WriteInstruction(instruction *Instruction) error {
+	return writeWithTimeout(t, instruction)
+}
+
+// WriteInstructionContext sends an instruction to guacd, bypassing the write filters, once the
+// writers ahead of it are done, failing if ctx is done first.
+func (t *FilteredTunnel) WriteInstructionContext(ctx context.Context, instruction *Instruction) error {
+	return t.flushContext(ctx, instruction.Byte())
+}
+
+// WriteToClient queues an instruction for the client. It is sent ahead of the next instruction
+// read from guacd, or immediately if a reader is waiting for buffered data.
+func (t *FilteredTunnel) WriteToClient(instruction *Instruction) {
+	t.pendingLock.Lock()
+	t.pending = append(t.pending, instruction.Byte()...)
+	t.pendingLock.Unlock()
+}
+
+// takePending returns and clears the instructions queued by WriteToClient
+func (t *FilteredTunnel) takePending() (pending []byte) {
+	t.pendingLock.Lock()
+	pending, t.pending = t.pending, nil
+	t.pendingLock.Unlock()
+	return
+}
+
+func (t *FilteredTunnel) hasPending() bool {
+	t.pendingLock.Lock()
+	defer t.pendingLock.Unlock()
+	return len(t.pending) > 0
+}
+
+func (t *FilteredTunnel) flush(data []byte) error {
+	return t.flushContext(context.Background(), data)
+}
+
+func (t *FilteredTunnel) flushContext(ctx context.Context, data []byte) (err error) {
+	if err = t.flushLock.lockContext(ctx); err != nil {
+		return writeWaitError(err)
+	}
+	defer t.flushLock.Unlock()
+
+	if writer, ok := t.Tunnel.(interface {
+		writeContext(context.Context, []byte) error
+	}); ok {
+		return writer.writeContext(ctx, data)
+	}
+	writer := t.Tunnel.AcquireWriter()
+	defer t.Tunnel.ReleaseWriter()
+
+	_, err = writer.Write(data)
+	return
+}
+
+func (t *FilteredTunnel) filter(direction Direction, instruction *Instruction) ([]*Instruction, error) {
+	t.filterLock.RLock()
+	defer t.filterLock.RUnlock()
+
+	filters := t.writeFilters
+	if direction == FromGuacd {
+		filters = t.readFilters
+	}
+
+	instructions := []*Instruction{instruction}
+	for _, named := range filters {
+		f := named.filter
+		var filtered []*Instruction
+		for _, ins := range instructions {
+			if multi, ok := f.(MultiFilter); ok {
+				out, err := multi.FilterAll(ins)
+				if err != nil {
+					return nil, err
+				}
+				filtered = append(filtered, out...)
+				continue
+			}
+
+			out, err := f.Filter(ins)
+			if err != nil {
+				return nil, err
+			}
+			if out != nil {
+				filtered = append(filtered, out)
+			}
+		}
+		if instructions = filtered; len(instructions) == 0 {
+			return nil, nil
+		}
+	}
+	return instructions, nil
+}
+
+func (t *FilteredTunnel) filterRead(instruction *Instruction) ([]*Instruction, error) {
+	if t.streams.owns(instruction) {
+		// acknowledgements of streams opened by WriteStream are not meant for the client
+		return nil, nil
+	}
+	if instruction.Opcode == OpcodeSync {
+		t.counters.latency.sent(instruction, time.Now())
+	}
+	return t.filter(FromGuacd, instruction)
+}
+
+func (t *FilteredTunnel) filterWrite(instruction *Instruction) ([]*Instruction, error) {
+	if instruction.Opcode == OpcodeSync {
+		t.counters.latency.replied(instruction, time.Now())
+	}
+	return t.filter(FromClient, instruction)
+}
+
+// filteredReader parses each instruction read from guacd and runs it through the read filters
+type filteredReader struct {
+	reader InstructionReader
+	tunnel *FilteredTunnel
+}
+
+// probe checks the connection of the underlying reader, if it can
+func (r *filteredReader) probe(wait time.Duration) error {
+	if p, ok := r.reader.(prober); ok {
+		return p.probe(wait)
+	}
+	return nil
+}
+
+// ReadSome returns the next instruction that was not dropped by a filter, preceded by any
+// instructions queued for the client
+func (r *filteredReader) ReadSome() ([]byte, error) {
+	if pending := r.tunnel.takePending(); len(pending) > 0 {
+		return pending, nil
+	}
+
+	for {
+		message, err := r.reader.ReadSome()
+		if err != nil {
+			return nil, err
+		}
+
+		instruction, err := Parse(message)
+		if err != nil {
+			return nil, ErrServer.NewError(err.Error())
+		}
+		r.tunnel.counters.counted(FromGuacd, len(message), instruction)
+
+		instructions, err := r.tunnel.filterRead(instruction)
+		if err != nil {
+			return nil, err
+		}
+
+		// instructions queued while filtering or while blocked on guacd go first
+		out := r.tunnel.takePending()
+		for _, ins := range instructions {
+			out = append(out, ins.Byte()...)
+		}
+		if len(out) > 0 {
+			return out, nil
+		}
+	}
+}
+
+// Available returns true if the wrapped reader has buffered data or instructions are queued
+// for the client
+func (r *filteredReader) Available() bool {
+	return r.reader.Available() || r.tunnel.hasPending()
+}
+
+// Flush flushes the wrapped reader
+func (r *filteredReader) Flush() {
+	r.reader.Flush()
+}
+
+// filteredWriter buffers client data until complete instructions are available, then filters
+// and forwards them
+type filteredWriter struct {
+	tunnel *FilteredTunnel
+	buffer []byte
+}
+
+// Write buffers data, forwarding any complete instructions through the write filters
+func (w *filteredWriter) Write(data []byte) (int, error) {
+	w.buffer = append(w.buffer, data...)
+
+	var out []byte
+	start := 0
+	for {
+		end, err := instructionEnd(w.buffer[start:], w.tunnel.limits)
+		if err != nil {
+			w.buffer = w.buffer[:0]
+			return 0, err
+		}
+		if end < 0 {
+			break
+		}
+
+		instruction, err := Parse(w.buffer[start : start+end])
+		if err != nil {
+			w.buffer = w.buffer[:0]
+			return 0, ErrClient.NewError(err.Error())
+		}
+		start += end
+		w.tunnel.counters.counted(FromClient, end, instruction)
+
+		instructions, err := w.tunnel.filterWrite(instruction)
+		if err != nil {
+			w.buffer = w.buffer[:0]
+			return 0, err
+		}
+		for _, ins := range instructions {
+			out = append(out, ins.Byte()...)
+		}
+	}
+
+	// keep any partial instruction for the next write
+	w.buffer = append(w.buffer[:0], w.buffer[start:]...)
+
+	if len(out) > 0 {
+		if err := w.tunnel.flush(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// instructionEnd returns the index just past the first complete instruction in buf, or -1 if
+// buf does not yet contain a complete instruction. Element lengths are counted in runes. An
+// instruction exceeding limits fails as soon as enough of it has been received to tell.
+func instructionEnd(buf []byte, limits InstructionLimits) (int, error) {
+	i := 0
+	runes := 0
+	elements := 0
+	for i < len(buf) {
+		elements++
+		if err := limits.checkElements(elements); err != nil {
+			return 0, err
+		}
+
+		// Parse element length
+		length := 0
+		digits := 0
+		for ; i < len(buf) && buf[i] != '.'; i++ {
+			if buf[i] < '0' || buf[i] > '9' {
+				return 0, ErrClient.NewError("Non-numeric character in element length:", string(buf[i]))
+			}
+			length = length*10 + int(buf[i]-'0')
+			digits++
+
+			// digits, length and terminators so far, plus the declared element
+			if err := limits.checkLength(runes + digits + length + 2); err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(buf) {
+			return -1, nil
+		}
+		if digits == 0 {
+			return 0, ErrClient.NewError("Missing element length")
+		}
+		i++
+		runes += digits + length + 2
+
+		// Skip element value
+		for ; length > 0; length-- {
+			if !utf8.FullRune(buf[i:]) {
+				return -1, nil
+			}
+			_, size := utf8.DecodeRune(buf[i:])
+			i += size
+		}
+		if i >= len(buf) {
+			return -1, nil
+		}
+
+		switch buf[i] {
+		case ';':
+			return i + 1, nil
+		case ',':
+			i++
+		default:
+			return 0, ErrClient.NewError("Element terminator of instruction was not ';' nor ','")
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,120 @@
+package guac
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestInstructionEnd(t *testing.T) {
+	tests := []struct {
+		in  string
+		end int
+	}{
+		{"4.copy,2.ab;", 12},
+		{"4.copy,2.ab;4.copy", 12},
+		{"4.copy,2.ab", -1},
+		{"4.copy,1.🚀;", 14},
+		{"4.copy,1.\xf0\x9f", -1},
+		{"0.;", 3},
+		{"", -1},
+	}
+	for _, test := range tests {
+		end, err := instructionEnd([]byte(test.in), InstructionLimits{})
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.in, err)
+		} else if end != test.end {
+			t.Errorf("%q: got %v, want %v", test.in, end, test.end)
+		}
+	}
+
+	if _, err := instructionEnd([]byte("4.copy*2.ab;"), InstructionLimits{}); err == nil {
+		t.Error("expected error for bad terminator")
+	}
+	if _, err := instructionEnd([]byte("x.copy;"), InstructionLimits{}); err == nil {
+		t.Error("expected error for bad length")
+	}
+}
+
+func TestFilteredTunnel_Write(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	tunnel.AddWriteFilter(FilterFunc(func(ins *Instruction) (*Instruction, error) {
+		if ins.Opcode == "key" {
+			return nil, nil
+		}
+		return ins, nil
+	}))
+
+	writer := tunnel.AcquireWriter()
+	if _, err := writer.Write([]byte("5.mouse,1.1,1.2;3.key,2.65,1.1;5.mou")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "5.mouse,1.1,1.2;"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if err := tunnel.WriteInstruction(NewInstruction("nop")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("se,1.3,1.4;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+
+	if got, want := out.String(), "5.mouse,1.1,1.2;3.nop;5.mouse,1.3,1.4;"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFilteredTunnel_Read(t *testing.T) {
+	conn := &fakeConn{
+		ToRead: []byte("4.sync,1.1;4.copy,2.ab;4.sync,1.2;"),
+	}
+	tunnel := NewFilteredTunnel(&fakeTunnel{reader: NewStream(conn, time.Minute)})
+	tunnel.AddReadFilter(FilterFunc(func(ins *Instruction) (*Instruction, error) {
+		if ins.Opcode == "copy" {
+			return nil, nil
+		}
+		return ins, nil
+	}))
+
+	reader := tunnel.AcquireReader()
+	defer tunnel.ReleaseReader()
+
+	for _, want := range []string{"4.sync,1.1;", "4.sync,1.2;"} {
+		ins, err := reader.ReadSome()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ins) != want {
+			t.Errorf("got %q, want %q", ins, want)
+		}
+	}
+}
+
+func TestFilteredTunnel_RemoveFilters(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	drop := FilterFunc(func(*Instruction) (*Instruction, error) { return nil, nil })
+	tunnel.AddFilters("drop", nil, []Filter{drop})
+	tunnel.AddFilters("drop", nil, []Filter{drop})
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+	if _, err := writer.Write([]byte("3.nop;")); err != nil {
+		t.Fatal(err)
+	}
+	if names := tunnel.FilterNames(); len(names) != 1 || names[0] != "drop" {
+		t.Errorf("Unexpected filters %v", names)
+	}
+	if !tunnel.RemoveFilters("drop") || tunnel.RemoveFilters("drop") {
+		t.Error("Expected filters to be removed once")
+	}
+	if _, err := writer.Write([]byte("3.nop;")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "3.nop;" {
+		t.Errorf("Expected only the write after removal to pass, got %q", out.String())
+	}
+}
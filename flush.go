@@ -0,0 +1,51 @@
+package guac
+
+import (
+	"net/http"
+	"time"
+)
+
+// flushPacer spaces out the flushes of a read stream, so a session drawing many frames a
+// second doesn't spend its CPU flushing each one. Instructions arriving in the meantime are
+// sent with the next flush. The first flush of a stream is never delayed.
+type flushPacer struct {
+	// min is the shortest time between flushes, none if zero
+	min time.Duration
+	// last is when the stream was last flushed, zero if it hasn't been
+	last time.Time
+}
+
+// wait sleeps until the next flush is due, if the stream has been flushed before
+func (p *flushPacer) wait() {
+	if p == nil || p.min <= 0 || p.last.IsZero() {
+		return
+	}
+	if since := time.Since(p.last); since < p.min {
+		time.Sleep(p.min - since)
+	}
+}
+
+// flushed records that the stream was just flushed
+func (p *flushPacer) flushed() {
+	if p != nil && p.min > 0 {
+		p.last = time.Now()
+	}
+}
+
+// flushed counts a flush of the tunnel's read stream, if it keeps statistics
+func flushed(tunnel Tunnel) {
+	switch v := tunnel.(type) {
+	case *LastAccessedTunnel:
+		v.counters.flushes.Add(1)
+	case *FilteredTunnel:
+		v.counters.flushes.Add(1)
+	}
+}
+
+// flushResponse flushes a read response to the client, counting the flush against the tunnel
+func flushResponse(response http.ResponseWriter, tunnel Tunnel) {
+	if v, ok := response.(http.Flusher); ok {
+		v.Flush()
+		flushed(tunnel)
+	}
+}
@@ -0,0 +1,56 @@
+package guac
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlushPacer(t *testing.T) {
+	pacer := &flushPacer{min: 20 * time.Millisecond}
+	start := time.Now()
+	pacer.wait()
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Expected the first flush not to wait, took %v", elapsed)
+	}
+	for i := 0; i < 3; i++ {
+		pacer.wait()
+		pacer.flushed()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected flushes to be spaced out, took %v", elapsed)
+	}
+
+	var unpaced *flushPacer
+	start = time.Now()
+	unpaced.wait()
+	if time.Since(start) > 10*time.Millisecond {
+		t.Error("Expected no pacer not to wait")
+	}
+}
+
+func TestServer_MinFlushInterval(t *testing.T) {
+	client, guacd := net.Pipe()
+	server := NewServer(nil)
+	server.MinFlushInterval = 20 * time.Millisecond
+	registered := server.registerTunnel(NewSimpleTunnel(NewStream(client, time.Minute)), nil, nil)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			_, _ = guacd.Write(NewSyncInstruction(int64(i)).Byte())
+		}
+		_ = guacd.Close()
+	}()
+	start := time.Now()
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/tunnel?read:"+registered.GetUUID()+":0", nil))
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected the three frames to be paced, took %v", elapsed)
+	}
+	// the response is flushed before streaming, after the frames and at the end
+	if stats := registered.Stats(); stats.Flushes < 3 {
+		t.Errorf("Unexpected flushes %v", stats.Flushes)
+	}
+}
@@ -0,0 +1,137 @@
+package guac
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ResumeTokenHeader carries the token which lets a client move a tunnel to another
+	// connection or transport. It is set on the connect response of a Server with a
+	// ReplayBuffer, and sent by the client on a connect request to resume the tunnel rather
+	// than open a new one.
+	ResumeTokenHeader = "Guacamole-Resume-Token"
+	// ResumeOpcode is the argument of the internal instruction giving a websocket client its
+	// resume token, as in 0.,6.resume,64.<token>;
+	ResumeOpcode = "resume"
+)
+
+// resumeKeepAliveInterval is how often a tunnel carried by a websocket is marked as accessed,
+// so the Server holding it doesn't time it out
+const resumeKeepAliveInterval = time.Second
+
+// newResumeToken returns a random token identifying a tunnel to resume
+func newResumeToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// resumeTunnel finds the tunnel holding the given resume token, which must have been opened
+// for the same user, and detaches it from the connection carrying it so far.
+func (s *Server) resumeTunnel(token string, identity *Identity) (*LastAccessedTunnel, error) {
+	var found *LastAccessedTunnel
+	s.tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		if tunnel.resumeToken != "" && subtle.ConstantTimeCompare([]byte(tunnel.resumeToken), []byte(token)) == 1 {
+			found = tunnel
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return nil, ErrResourceNotFound.NewError("No tunnel to resume.")
+	}
+	if owner := found.Identity(); owner != nil && (identity == nil || identity.Subject != owner.Subject) {
+		return nil, ErrUnauthorized.NewError("Tunnel belongs to another user.")
+	}
+	found.Access()
+	found.attach(nil)
+	s.log(registryLog, found).Debugf("Resuming tunnel %v.", found.GetUUID())
+	return found, nil
+}
+
+// attach records how to detach the tunnel from the connection now carrying it, detaching it
+// from the previous one. It returns an ID to pass to detached once that connection ends.
+func (t *LastAccessedTunnel) attach(detach func()) int64 {
+	t.Lock()
+	previous := t.detach
+	t.detach = detach
+	t.attachments++
+	id := t.attachments
+	t.Unlock()
+	if previous != nil {
+		previous()
+	}
+	return id
+}
+
+// detached forgets how to detach the connection with the given ID, if it is still attached
+func (t *LastAccessedTunnel) detached(id int64) {
+	t.Lock()
+	if t.attachments == id {
+		t.detach = nil
+	}
+	t.Unlock()
+}
+
+// keepAccessed marks the tunnel as accessed until ctx is done
+func keepAccessed(ctx context.Context, tunnel *LastAccessedTunnel) {
+	ticker := time.NewTicker(resumeKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tunnel.Access()
+		}
+	}
+}
+
+// resumeWebsocket finds the tunnel a websocket client asks to resume with the resume and
+// offset query parameters, returning it with what the client missed
+func (s *Server) resumeWebsocket(token, offset string, identity *Identity) (*LastAccessedTunnel, []byte, error) {
+	tunnel, err := s.resumeTunnel(token, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	position, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || position < 0 {
+		return nil, nil, ErrClient.NewError("Invalid resume offset:", offset)
+	}
+	missed, ok := tunnel.replay.since(position)
+	if !ok {
+		return nil, nil, ErrResourceConflict.NewError("Unable to resume tunnel from offset", offset)
+	}
+	return tunnel, missed, nil
+}
+
+// sendResumeToken tells a websocket client the UUID of its tunnel, as the Java websocket
+// tunnel does, and the token to resume it with
+func sendResumeToken(ws MessageWriter, tunnel *LastAccessedTunnel) error {
+	data := append(NewInstruction(InternalDataOpcode, tunnel.GetUUID()).Byte(),
+		NewInstruction(InternalDataOpcode, ResumeOpcode, tunnel.resumeToken).Byte()...)
+	return ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// replayWriter records the messages sent to a websocket in the tunnel's replay buffer
+type replayWriter struct {
+	MessageWriter
+	replay *replayBuffer
+}
+
+func (w *replayWriter) WriteMessage(messageType int, data []byte) error {
+	if err := w.MessageWriter.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	w.replay.write(data)
+	return nil
+}
@@ -0,0 +1,223 @@
+package guac
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_Resumable(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	server := NewServer(nil)
+	server.ReplayBuffer = 1024
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	wsServer.Resumable = server
+	mux := http.NewServeMux()
+	mux.Handle("/websocket-tunnel", wsServer)
+	mux.Handle("/tunnel", server)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/websocket-tunnel"
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := regexp.MustCompile(`^0\.,36\.([0-9a-f-]{36});0\.,6\.resume,64\.([0-9a-f]{64});$`).FindStringSubmatch(string(data))
+	if match == nil {
+		t.Fatalf("Expected the tunnel UUID and resume token, got %q", data)
+	}
+	tunnelUUID, token := match[1], match[2]
+
+	_, _ = guacd.Write([]byte("4.sync,1.1;"))
+	if _, data, err = ws.ReadMessage(); err != nil || string(data) != "4.sync,1.1;" {
+		t.Fatalf("Unexpected message %q %v", data, err)
+	}
+
+	// the laptop changes networks: the websocket is lost, and the client resumes over HTTP
+	// without having received what guacd sent next
+	_ = ws.Close()
+	request, _ := http.NewRequest(http.MethodPost, httpServer.URL+"/tunnel?connect", nil)
+	request.Header.Set(ResumeTokenHeader, token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if string(body) != tunnelUUID {
+		t.Fatalf("Expected resuming to return the tunnel's UUID, got %v %q", response.Status, body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ = http.NewRequestWithContext(ctx, http.MethodGet, httpServer.URL+"/tunnel?read:"+tunnelUUID+":0", nil)
+	request.Header.Set(ResumeOffsetHeader, "0")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = guacd.Write([]byte("4.sync,1.2;"))
+	read := make([]byte, 22)
+	_, err = io.ReadFull(response.Body, read)
+	cancel()
+	_ = response.Body.Close()
+	if err != nil || string(read) != "4.sync,1.1;4.sync,1.2;" {
+		t.Fatalf("Expected replay followed by guacd's next instruction, got %q %v", read, err)
+	}
+
+	// and back to a websocket, having received everything
+	ws, _, err = websocket.DefaultDialer.Dial(wsURL+"?resume="+token+"&offset=22", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_, _ = guacd.Write([]byte("4.sync,1.3;"))
+	if _, data, err = ws.ReadMessage(); err != nil || string(data) != "4.sync,1.3;" {
+		t.Fatalf("Unexpected message after resuming over websocket %q %v", data, err)
+	}
+
+	other, _, err := websocket.DefaultDialer.Dial(wsURL+"?resume=nope&offset=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, _, err = other.ReadMessage(); !websocket.IsCloseError(err, ResourceNotFound.GetWebSocketCode()) {
+		t.Errorf("Expected unknown token to be refused, got %v", err)
+	}
+}
+
+func TestWebsocketServer_ResumableQuota(t *testing.T) {
+	client, guacd := net.Pipe()
+	server := NewServer(nil)
+	server.ReplayBuffer = 1024
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	wsServer.Resumable = server
+	wsServer.Quota = &SessionQuota{Max: 1, Key: func(*http.Request, *Identity) string { return "user" }}
+	httpServer := httptest.NewServer(wsServer)
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := regexp.MustCompile(`resume,64\.([0-9a-f]{64});`).FindStringSubmatch(string(data))[1]
+
+	// the tunnel outlives its websocket, and keeps holding the quota
+	_ = ws.Close()
+	time.Sleep(20 * time.Millisecond)
+	if held := wsServer.Quota.Held("user"); held != 1 {
+		t.Fatalf("Expected the detached tunnel to hold the quota, held %v", held)
+	}
+
+	ws, _, err = websocket.DefaultDialer.Dial(wsURL+"?resume="+token+"&offset=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_, _ = guacd.Write([]byte("4.sync,1.1;"))
+	if _, data, err = ws.ReadMessage(); err != nil || string(data) != "4.sync,1.1;" {
+		t.Fatalf("Expected resuming not to count against the quota, got %q %v", data, err)
+	}
+
+	_ = guacd.Close()
+	deadline := time.Now().Add(time.Second)
+	for wsServer.Quota.Held("user") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the quota to be released once the tunnel closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebsocketServer_ResumableAudit(t *testing.T) {
+	client, guacd := net.Pipe()
+	server := NewServer(nil)
+	server.ReplayBuffer = 1024
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	wsServer.Resumable = server
+	var lock sync.Mutex
+	var events []*AuditEvent
+	wsServer.Audit = AuditSinkFunc(func(event *AuditEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+		return nil
+	})
+	audited := func() []*AuditEvent {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]*AuditEvent(nil), events...)
+	}
+	httpServer := httptest.NewServer(wsServer)
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := regexp.MustCompile(`resume,64\.([0-9a-f]{64});`).FindStringSubmatch(string(data))[1]
+	_, _ = guacd.Write([]byte("4.sync,1.1;"))
+	if _, data, err = ws.ReadMessage(); err != nil || string(data) != "4.sync,1.1;" {
+		t.Fatalf("Unexpected message %q %v", data, err)
+	}
+
+	// losing the websocket doesn't end the tunnel
+	_ = ws.Close()
+	time.Sleep(20 * time.Millisecond)
+	if got := audited(); len(got) != 1 || got[0].Type != AuditConnect {
+		t.Fatalf("Expected only the connect to be audited, got %+v", got)
+	}
+
+	ws, _, err = websocket.DefaultDialer.Dial(wsURL+"?resume="+token+"&offset=11", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_, _ = guacd.Write([]byte("4.sync,1.2;"))
+	if _, data, err = ws.ReadMessage(); err != nil || string(data) != "4.sync,1.2;" {
+		t.Fatalf("Unexpected message after resuming %q %v", data, err)
+	}
+
+	_ = guacd.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(audited()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the disconnect to be audited once the tunnel closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := audited()
+	if len(got) != 2 || got[1].Type != AuditDisconnect || got[1].BytesOut != 22 {
+		t.Errorf("Expected one disconnect counting both websockets, got %+v", got[1:])
+	}
+}
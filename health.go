@@ -0,0 +1,214 @@
+package guac
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthCheckInterval is how often a HealthCheck probes each backend when its
+	// Interval is zero
+	DefaultHealthCheckInterval = 10 * time.Second
+	// DefaultHealthCheckTimeout bounds each probe when the Timeout of a HealthCheck is zero
+	DefaultHealthCheckTimeout = 5 * time.Second
+	// DefaultHealthCheckProtocol is the protocol probes select when the Protocol of a
+	// HealthCheck is empty
+	DefaultHealthCheckProtocol = "vnc"
+)
+
+// HealthCheck probes the backends of a BackendSet, taking those which fail out of rotation
+// until they pass again. A probe connects to guacd, selects a protocol, waits for guacd to
+// answer with its arguments and disconnects, so no remote connection is ever made.
+type HealthCheck struct {
+	// Interval is how often each backend is probed, DefaultHealthCheckInterval if zero
+	Interval time.Duration
+	// Timeout bounds each probe, DefaultHealthCheckTimeout if zero
+	Timeout time.Duration
+	// Protocol is the protocol probes select, DefaultHealthCheckProtocol if empty. guacd must
+	// support it.
+	Protocol string
+	// Failures is the number of probes in a row a backend must fail to be taken out of
+	// rotation, one if zero. A single probe passing puts it back.
+	Failures int
+	// OnChange is an optional callback run as a backend is taken out of or put back in
+	// rotation, with the error of the probe which failed
+	OnChange func(backend *Backend, healthy bool, err error)
+
+	startOnce, stopOnce sync.Once
+	stop                chan struct{}
+}
+
+// BackendHealth describes a backend of a BackendSet to operators
+type BackendHealth struct {
+	Address string `json:"address"`
+	// Healthy is false while the backend is out of rotation
+	Healthy bool `json:"healthy"`
+	// Sessions counts the tunnels opened on the backend through the set which are still open
+	Sessions int `json:"sessions"`
+	// LastCheck is when the backend was last probed, zero if it hasn't been
+	LastCheck time.Time `json:"last_check,omitempty"`
+	// LastError is why the last probe failed, empty if it passed
+	LastError string `json:"last_error,omitempty"`
+	// Checks and Failures count the probes made and failed
+	Checks   int64 `json:"checks"`
+	Failures int64 `json:"failures"`
+
+	// failing counts the probes failed in a row
+	failing int
+}
+
+// start probes the backends of the set every Interval until stopped. It is called as the set
+// is used, and only starts once.
+func (h *HealthCheck) start(s *BackendSet) {
+	h.startOnce.Do(func() {
+		h.stop = make(chan struct{})
+		interval := h.Interval
+		if interval <= 0 {
+			interval = DefaultHealthCheckInterval
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				h.checkAll(s)
+				select {
+				case <-h.stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
+
+// Stop stops probing
+func (h *HealthCheck) Stop() {
+	h.startOnce.Do(func() {
+		h.stop = make(chan struct{})
+	})
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+// checkAll probes every backend of the set at once
+func (h *HealthCheck) checkAll(s *BackendSet) {
+	var wg sync.WaitGroup
+	for _, backend := range s.Backends {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			s.recordCheck(h, backend, h.probe(backend))
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// probe checks guacd at the backend answers a select instruction
+func (h *HealthCheck) probe(backend *Backend) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	protocol := h.Protocol
+	if protocol == "" {
+		protocol = DefaultHealthCheckProtocol
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := backend.dial(ctx)
+	if err != nil {
+		return err
+	}
+	stream := NewStream(conn, timeout)
+	defer func() {
+		_ = stream.Close()
+	}()
+	if _, err = stream.Write(NewInstruction(OpcodeSelect, protocol).Byte()); err != nil {
+		return err
+	}
+	if _, err = stream.AssertOpcode(OpcodeArgs); err != nil {
+		return err
+	}
+	_, _ = stream.Write(NewInstruction(OpcodeDisconnect).Byte())
+	return nil
+}
+
+// recordCheck records the outcome of a probe of backend, taking it out of or putting it back
+// in rotation
+func (s *BackendSet) recordCheck(h *HealthCheck, backend *Backend, err error) {
+	threshold := h.Failures
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	s.Lock()
+	if s.health == nil {
+		s.health = map[*Backend]*BackendHealth{}
+	}
+	health, ok := s.health[backend]
+	if !ok {
+		health = &BackendHealth{Healthy: true}
+		s.health[backend] = health
+	}
+	wasHealthy := health.Healthy
+	health.LastCheck = time.Now()
+	health.Checks++
+	if err == nil {
+		health.LastError = ""
+		health.failing = 0
+		health.Healthy = true
+	} else {
+		health.LastError = err.Error()
+		health.Failures++
+		health.failing++
+		if health.failing >= threshold {
+			health.Healthy = false
+		}
+	}
+	healthy := health.Healthy
+	s.Unlock()
+
+	if backend.Metrics != nil {
+		backend.Metrics.BackendChecked(backend.Address, healthy)
+	}
+	if healthy == wasHealthy {
+		return
+	}
+	if healthy {
+		transportLog.Infof("guacd at %v passed its health check, putting it back in rotation.", backend)
+	} else {
+		transportLog.Warnf("guacd at %v failed its health check, taking it out of rotation: %v", backend, err)
+	}
+	if h.OnChange != nil {
+		h.OnChange(backend, healthy, err)
+	}
+}
+
+// healthy returns false if backend has been taken out of rotation. The lock must be held.
+func (s *BackendSet) healthy(backend *Backend) bool {
+	health, ok := s.health[backend]
+	return !ok || health.Healthy
+}
+
+// Health returns the health of each backend, starting health checks if they aren't running
+func (s *BackendSet) Health() []BackendHealth {
+	if s.HealthCheck != nil {
+		s.HealthCheck.start(s)
+	}
+	s.Lock()
+	defer s.Unlock()
+	healths := make([]BackendHealth, 0, len(s.Backends))
+	for _, backend := range s.Backends {
+		health := BackendHealth{Healthy: true}
+		if h, ok := s.health[backend]; ok {
+			health = *h
+		}
+		health.Address = backend.Address
+		health.Sessions = s.sessions[backend]
+		healths = append(healths, health)
+	}
+	return healths
+}
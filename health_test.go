@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	dialer := &farmDialer{down: map[string]bool{"a": true}}
+	var changes []string
+	check := &HealthCheck{
+		Failures: 2,
+		OnChange: func(backend *Backend, healthy bool, err error) {
+			if healthy {
+				changes = append(changes, backend.Address+" up")
+			} else {
+				changes = append(changes, backend.Address+" down")
+			}
+		},
+	}
+	// checks are run by hand rather than started by the set
+	set := newFarm(dialer, LeastConnections{}, "a", "b")
+	metrics := &recordedMetrics{}
+	for _, backend := range set.Backends {
+		backend.Metrics = metrics
+	}
+
+	// a single failure leaves a backend in rotation
+	check.checkAll(set)
+	if order := set.order(NewGuacamoleConfiguration()); len(order) != 2 {
+		t.Error("Expected both backends in rotation, got", order)
+	}
+	check.checkAll(set)
+	if order := set.order(NewGuacamoleConfiguration()); len(order) != 1 || order[0].Address != "b" {
+		t.Error("Expected only b in rotation, got", order)
+	}
+	if healthy, ok := metrics.checks["a"]; !ok || healthy || !metrics.checks["b"] {
+		t.Error("Expected the health of both backends to be measured, got", metrics.checks)
+	}
+
+	admin := &AdminServer{Server: NewServer(nil), Backends: set, Authorizer: adminAuthorizer}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/tunnels?backends", nil))
+	var healths []BackendHealth
+	if err := json.NewDecoder(recorder.Body).Decode(&healths); err != nil {
+		t.Fatal(err)
+	}
+	if len(healths) != 2 || healths[0].Healthy || healths[0].Failures != 2 || !healths[1].Healthy || healths[1].Checks != 2 {
+		t.Errorf("Unexpected health %+v", healths)
+	}
+
+	dialer.Lock()
+	dialer.down["a"] = false
+	dialer.Unlock()
+	check.checkAll(set)
+	if strings.Join(changes, ",") != "a down,a up" {
+		t.Error("Unexpected changes", changes)
+	}
+}
+
+func TestBackendSet_AllUnhealthy(t *testing.T) {
+	dialer := &farmDialer{down: map[string]bool{"a": true, "b": true}}
+	set := newFarm(dialer, nil, "a", "b")
+	check := &HealthCheck{}
+	check.checkAll(set)
+	if order := set.order(NewGuacamoleConfiguration()); len(order) != 2 {
+		t.Error("Expected every backend to be tried once all are unhealthy, got", order)
+	}
+}
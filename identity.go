@@ -0,0 +1,110 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Identity is the authenticated user behind a tunnel, independent of how they authenticated
+// (SAML, OIDC, a session cookie, ...). It is produced by an Authorizer and shared by every
+// identity-aware feature.
+type Identity struct {
+	// Subject uniquely and stably identifies the user
+	Subject string `json:"subject"`
+	// DisplayName is a human readable name for the user
+	DisplayName string `json:"display_name,omitempty"`
+	// Groups lists the groups or roles the user belongs to
+	Groups []string `json:"groups,omitempty"`
+	// Expiry is when the authentication behind the identity lapses, zero for never
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// Expired returns true if the identity has an expiry which is not after now
+func (i *Identity) Expired(now time.Time) bool {
+	return !i.Expiry.IsZero() && !now.Before(i.Expiry)
+}
+
+// InGroup returns true if the identity belongs to the given group
+func (i *Identity) InGroup(group string) bool {
+	for _, g := range i.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the display name of the identity, or its subject if it has none
+func (i *Identity) String() string {
+	if i.DisplayName != "" {
+		return i.DisplayName
+	}
+	return i.Subject
+}
+
+// Authorizer authenticates connect requests, returning the identity of the user making them.
+// Errors which are not an ErrGuac are reported to the client as ClientUnauthorized.
+type Authorizer interface {
+	Authorize(r *http.Request) (*Identity, error)
+}
+
+// AuthorizerFunc adapts an ordinary function to the Authorizer interface
+type AuthorizerFunc func(r *http.Request) (*Identity, error)
+
+// Authorize calls f(r)
+func (f AuthorizerFunc) Authorize(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity carried by ctx, or nil
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// IdentityFromRequest returns the identity the servers' Authorizer attached to the request, so
+// connect callbacks can use it
+func IdentityFromRequest(r *http.Request) *Identity {
+	return IdentityFromContext(r.Context())
+}
+
+// authorize runs the authorizer, if any, returning the request with the identity attached
+func authorize(authorizer Authorizer, r *http.Request) (*http.Request, *Identity, error) {
+	if authorizer == nil {
+		return r, nil, nil
+	}
+
+	identity, err := authorizer.Authorize(r)
+	if err != nil {
+		var guacErr *ErrGuac
+		if errors.As(err, &guacErr) {
+			return r, nil, err
+		}
+		return r, nil, ErrUnauthorized.NewError(err.Error())
+	}
+	if identity == nil {
+		return r, nil, ErrUnauthorized.NewError("Not authenticated.")
+	}
+	if identity.Expired(time.Now()) {
+		return r, nil, ErrUnauthorized.NewError("Authentication has expired.")
+	}
+	return r.WithContext(WithIdentity(r.Context(), identity)), identity, nil
+}
+
+// authorizeAdmin is authorize for admin endpoints, which refuse every request when they have no
+// Authorizer rather than being open to anyone who can reach them
+func authorizeAdmin(authorizer Authorizer, r *http.Request) (*http.Request, *Identity, error) {
+	if authorizer == nil {
+		return r, nil, ErrSecurity.NewError("Admin endpoint has no Authorizer.")
+	}
+	return authorize(authorizer, r)
+}
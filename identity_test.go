@@ -0,0 +1,77 @@
+package guac
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdentity(t *testing.T) {
+	now := time.Now()
+	identity := &Identity{Subject: "u123", Groups: []string{"admins"}}
+
+	if identity.Expired(now) {
+		t.Error("expected identity without expiry not to expire")
+	}
+	identity.Expiry = now
+	if !identity.Expired(now) {
+		t.Error("expected identity to expire at its expiry")
+	}
+	if !identity.InGroup("admins") || identity.InGroup("users") {
+		t.Error("unexpected group membership")
+	}
+	if identity.String() != "u123" {
+		t.Error("expected subject when there is no display name")
+	}
+	identity.DisplayName = "Ada"
+	if identity.String() != "Ada" {
+		t.Error("expected display name")
+	}
+}
+
+func TestServer_Authorizer(t *testing.T) {
+	var connected *Identity
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		connected = IdentityFromRequest(r)
+		return &fakeTunnel{}, nil
+	})
+	server.Authorizer = AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+		if r.Header.Get("Authorization") == "" {
+			return nil, errors.New("missing credentials")
+		}
+		return &Identity{Subject: "u123"}, nil
+	})
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected unauthenticated connect to be refused, got %v", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil)
+	request.Header.Set("Authorization", "Bearer x")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected connect to succeed, got %v", recorder.Code)
+	}
+	if connected == nil || connected.Subject != "u123" {
+		t.Errorf("expected identity in connect callback, got %v", connected)
+	}
+	if tunnel, ok := server.tunnels.Get("1"); !ok || tunnel.Identity() != connected {
+		t.Error("expected identity in the registry")
+	}
+}
+
+func TestAuthorize_WrappedErrGuac(t *testing.T) {
+	authorizer := AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+		return nil, fmt.Errorf("identity provider: %w", ErrUpstreamUnavailable.NewError("IdP down."))
+	})
+	_, _, err := authorize(authorizer, httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil))
+	if guacErr := asErrGuac(err); guacErr.Kind != ErrUpstreamUnavailable {
+		t.Errorf("Expected a wrapped ErrGuac to keep its kind, got %v", guacErr.Kind)
+	}
+}
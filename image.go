@@ -0,0 +1,163 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sync"
+)
+
+// ImageStream describes an image sent by guacd with the img instruction
+type ImageStream struct {
+	Stream   string
+	Mask     string
+	Layer    string
+	Mimetype string
+	X        string
+	Y        string
+}
+
+// ImageHook is given each complete image passing through an ImageFilter and returns the image
+// to forward in its place, which may use a different mimetype. Returning a nil reader drops
+// the image; returning an error fails the tunnel read.
+type ImageHook func(image *ImageStream, data io.Reader) (mimetype string, out io.Reader, err error)
+
+// ImageFilter is a read Filter which holds back img streams until they end, passes each
+// image to a hook which may re-encode it, and forwards the result to the client.
+type ImageFilter struct {
+	hook ImageHook
+
+	sync.Mutex
+	streams map[string]*heldImage
+}
+
+type heldImage struct {
+	image ImageStream
+	data  bytes.Buffer
+}
+
+// NewImageFilter creates a filter passing images to the given hook
+func NewImageFilter(hook ImageHook) *ImageFilter {
+	return &ImageFilter{
+		hook:    hook,
+		streams: map[string]*heldImage{},
+	}
+}
+
+// Filter implements Filter; images are only forwarded through FilterAll
+func (f *ImageFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	instructions, err := f.FilterAll(instruction)
+	if err != nil || len(instructions) != 1 {
+		return nil, err
+	}
+	return instructions[0], nil
+}
+
+// FilterAll holds back img streams and replays them through the hook once they end
+func (f *ImageFilter) FilterAll(instruction *Instruction) ([]*Instruction, error) {
+	args := instruction.Args
+	if len(args) == 0 {
+		return []*Instruction{instruction}, nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch instruction.Opcode {
+	case OpcodeImg:
+		if len(args) < 6 {
+			return nil, ErrServer.NewError("Malformed img instruction")
+		}
+		f.streams[args[0]] = &heldImage{image: ImageStream{
+			Stream:   args[0],
+			Mask:     args[1],
+			Layer:    args[2],
+			Mimetype: args[3],
+			X:        args[4],
+			Y:        args[5],
+		}}
+		return nil, nil
+
+	case OpcodeBlob:
+		held, ok := f.streams[args[0]]
+		if !ok {
+			break
+		}
+		if len(args) < 2 {
+			return nil, ErrServer.NewError("Malformed blob instruction")
+		}
+		data, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return nil, ErrServer.NewError("Invalid image blob:", err.Error())
+		}
+		held.data.Write(data)
+		return nil, nil
+
+	case OpcodeEnd:
+		held, ok := f.streams[args[0]]
+		if !ok {
+			break
+		}
+		delete(f.streams, args[0])
+		return f.release(held)
+	}
+
+	return []*Instruction{instruction}, nil
+}
+
+// release runs a complete image through the hook and builds the instructions replacing it
+func (f *ImageFilter) release(held *heldImage) ([]*Instruction, error) {
+	mimetype, data, err := f.hook(&held.image, &held.data)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	img := held.image
+	blobs := &instructionCollector{}
+	if err = writeBlobs(blobs, img.Stream, data); err != nil {
+		return nil, err
+	}
+
+	instructions := make([]*Instruction, 0, len(blobs.instructions)+2)
+	instructions = append(instructions, NewInstruction(OpcodeImg, img.Stream, img.Mask, img.Layer, mimetype, img.X, img.Y))
+	instructions = append(instructions, blobs.instructions...)
+	instructions = append(instructions, NewInstruction(OpcodeEnd, img.Stream))
+	return instructions, nil
+}
+
+// NewJPEGReencoder returns an ImageHook which recompresses opaque PNG images as JPEG with the
+// given quality, trading fidelity for bandwidth. Images with transparency, other formats and
+// images which would not get smaller are forwarded unchanged.
+func NewJPEGReencoder(quality int) ImageHook {
+	return func(img *ImageStream, data io.Reader) (string, io.Reader, error) {
+		original, err := io.ReadAll(data)
+		if err != nil {
+			return "", nil, err
+		}
+		if img.Mimetype != "image/png" {
+			return img.Mimetype, bytes.NewReader(original), nil
+		}
+
+		decoded, err := png.Decode(bytes.NewReader(original))
+		if err != nil || !isOpaque(decoded) {
+			return img.Mimetype, bytes.NewReader(original), nil
+		}
+
+		var out bytes.Buffer
+		if err = jpeg.Encode(&out, decoded, &jpeg.Options{Quality: quality}); err != nil || out.Len() >= len(original) {
+			return img.Mimetype, bytes.NewReader(original), nil
+		}
+		return "image/jpeg", &out, nil
+	}
+}
+
+// isOpaque returns true if the image has no transparent pixels
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
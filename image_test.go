@@ -0,0 +1,85 @@
+package guac
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestImageFilter(t *testing.T) {
+	var seen *ImageStream
+	filter := NewImageFilter(func(img *ImageStream, data io.Reader) (string, io.Reader, error) {
+		seen = img
+		b, _ := io.ReadAll(data)
+		return "image/webp", strings.NewReader(strings.ToUpper(string(b))), nil
+	})
+
+	var out []string
+	for _, ins := range []*Instruction{
+		NewInstruction("img", "3", "12", "0", "image/png", "10", "20"),
+		NewInstruction("blob", "3", "aGVs"),
+		NewInstruction("sync", "1"),
+		NewInstruction("blob", "3", "bG8="),
+		NewInstruction("end", "3"),
+	} {
+		instructions, err := filter.FilterAll(ins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range instructions {
+			out = append(out, i.String())
+		}
+	}
+
+	want := "4.sync,1.1;3.img,1.3,2.12,1.0,10.image/webp,2.10,2.20;4.blob,1.3,8.SEVMTE8=;3.end,1.3;"
+	if got := strings.Join(out, ""); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if seen == nil || seen.Mimetype != "image/png" || seen.X != "10" {
+		t.Errorf("unexpected image %+v", seen)
+	}
+}
+
+func TestJPEGReencoder(t *testing.T) {
+	// noisy opaque image, which compresses poorly as PNG
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	random := rand.New(rand.NewSource(1))
+	random.Read(img.Pix)
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			c := img.RGBAAt(x, y)
+			c.A = 255
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := NewJPEGReencoder(50)
+	mimetype, out, err := hook(&ImageStream{Mimetype: "image/png"}, bytes.NewReader(encoded.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimetype != "image/jpeg" {
+		t.Errorf("expected image/jpeg, got %v", mimetype)
+	}
+	if b, _ := io.ReadAll(out); len(b) >= encoded.Len() {
+		t.Error("expected re-encoded image to be smaller")
+	}
+
+	// transparent images are left alone
+	img.SetRGBA(0, 0, color.RGBA{})
+	encoded.Reset()
+	_ = png.Encode(&encoded, img)
+	if mimetype, _, _ = hook(&ImageStream{Mimetype: "image/png"}, bytes.NewReader(encoded.Bytes())); mimetype != "image/png" {
+		t.Errorf("expected transparent image to stay PNG, got %v", mimetype)
+	}
+
+}
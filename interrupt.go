@@ -0,0 +1,109 @@
+package guac
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// streamOf returns the guacd stream beneath the wrappers of a tunnel, nil if it has none.
+// Decorators are unwrapped with their Unwrap method, as with AsTunnel.
+func streamOf(tunnel Tunnel) *Stream {
+	for tunnel != nil {
+		switch t := tunnel.(type) {
+		case *SimpleTunnel:
+			return t.stream
+		case *ReconnectingTunnel:
+			return t.current()
+		}
+		wrapper, ok := tunnel.(interface{ Unwrap() Tunnel })
+		if !ok {
+			return nil
+		}
+		tunnel = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// interrupt makes reads from guacd, and writes if writes is set, fail at once with a timeout
+// until resume is called, whether they are already blocked or start later. Data already read
+// stays buffered for the next read.
+func (s *Stream) interrupt(writes bool) {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	now := time.Now()
+	s.readsInterrupted = true
+	_ = s.conn.SetReadDeadline(now)
+	if writes {
+		s.writesInterrupted = true
+		_ = s.conn.SetWriteDeadline(now)
+	}
+}
+
+// resume lets the reads, and writes if writes is set, stopped by interrupt wait again
+func (s *Stream) resume(writes bool) {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	s.readsInterrupted = false
+	if writes {
+		s.writesInterrupted = false
+	}
+}
+
+// setReadDeadline sets the deadline of the next read, unless reads are interrupted
+func (s *Stream) setReadDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	if s.readsInterrupted {
+		t = time.Now()
+	}
+	return s.conn.SetReadDeadline(t)
+}
+
+// setWriteDeadline sets the deadline of the next write, unless writes are interrupted
+func (s *Stream) setWriteDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	if s.writesInterrupted {
+		t = time.Now()
+	}
+	return s.conn.SetWriteDeadline(t)
+}
+
+// interruptOnDone interrupts the guacd stream of the tunnel once any of the contexts is done,
+// so a read or write blocked on a slow guacd doesn't outlive the request or tunnel it is for.
+// The returned function must be called once the read or write is over, while the caller still
+// holds the tunnel's reader or writer.
+func interruptOnDone(tunnel Tunnel, writes bool, contexts ...context.Context) (stop func()) {
+	stream := streamOf(tunnel)
+	if stream == nil {
+		return func() {}
+	}
+
+	var lock sync.Mutex
+	stopped, interrupted := false, false
+	done := make(chan struct{})
+	for _, ctx := range contexts {
+		go func(ctx context.Context) {
+			select {
+			case <-ctx.Done():
+				lock.Lock()
+				if !stopped {
+					stream.interrupt(writes)
+					interrupted = true
+				}
+				lock.Unlock()
+			case <-done:
+			}
+		}(ctx)
+	}
+	return func() {
+		lock.Lock()
+		stopped = true
+		if interrupted {
+			stream.resume(writes)
+		}
+		lock.Unlock()
+		close(done)
+	}
+}
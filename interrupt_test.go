@@ -0,0 +1,98 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_ReadAbandoned(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.registerTunnel(tunnel, nil, nil)
+
+	// guacd is silent until the client has given up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		request := httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":0", nil).WithContext(ctx)
+		server.ServeHTTP(httptest.NewRecorder(), request)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the read to be abandoned with the request")
+	}
+
+	registered, ok := server.tunnels.Get(tunnel.GetUUID())
+	if !ok {
+		t.Fatal("Expected the tunnel to stay open for the next read")
+	}
+
+	go func() {
+		_, _ = guacd.Write([]byte("4.sync,1.1;"))
+		_ = guacd.Close()
+	}()
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":1", nil))
+	if got := recorder.Body.String(); got[:11] != "4.sync,1.1;" {
+		t.Errorf("Expected the next read to continue, got %q", got)
+	}
+
+	select {
+	case <-registered.Context().Done():
+	default:
+		t.Error("Expected the tunnel's context to be cancelled once closed")
+	}
+}
+
+func TestInterruptOnDone_BeforeRead(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := interruptOnDone(tunnel, false, ctx)
+	cancel()
+	// let the interruption happen before the read sets its own deadline
+	time.Sleep(10 * time.Millisecond)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := tunnel.stream.ReadSome()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("Expected the interrupted read to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a read started after the interruption to fail at once")
+	}
+
+	stop()
+	go func() { _, _ = guacd.Write([]byte("4.sync,1.1;")) }()
+	if instruction, err := tunnel.stream.ReadSome(); err != nil || string(instruction) != "4.sync,1.1;" {
+		t.Errorf("Expected reads to wait again once stopped, got %q %v", instruction, err)
+	}
+}
+
+func TestStreamOf(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	simple := NewSimpleTunnel(NewStream(client, time.Minute))
+	wrapped := newCountingTunnel(NewDelegatingTunnel(NewFilteredTunnel(simple)), func(int64) {}, func(int64) {})
+	if stream := streamOf(newRegisteredTunnel(wrapped, nil, nil)); stream != simple.stream {
+		t.Error("Expected the stream beneath the decorators to be found")
+	}
+	if stream := streamOf(&fakeTunnel{}); stream != nil {
+		t.Error("Expected no stream for a tunnel without one")
+	}
+}
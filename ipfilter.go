@@ -0,0 +1,153 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// AuditAddressRejected is emitted when an IPFilter refuses a request
+const AuditAddressRejected = "address_rejected"
+
+// IPFilter refuses requests by the address of the client, before they reach the connect
+// callback. Addresses in Deny are always refused; when Allow is not empty, only addresses in
+// it are accepted.
+type IPFilter struct {
+	// Allow lists the networks clients may connect from, any if empty
+	Allow []netip.Prefix
+	// Deny lists the networks clients may not connect from
+	Deny []netip.Prefix
+	// TrustedProxies is the number of reverse proxies in front of the server whose
+	// X-Forwarded-For entries are trusted. The client address is taken from that many entries
+	// from the right of the header, so clients can't claim another address by sending their
+	// own. If zero, the address of the connection is used and the header is ignored.
+	TrustedProxies int
+	// Proxies lists the networks of the reverse proxies. The X-Forwarded-For header is only
+	// read from connections made from them, so clients reaching the server directly can't
+	// claim another address; it is always ignored if empty.
+	Proxies []netip.Prefix
+}
+
+// NewIPFilter creates a filter from the CIDRs, or single addresses, of the networks to allow
+// and deny
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	var err error
+	if f.Allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if f.Deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(network)
+			if addrErr != nil {
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientAddress returns the address of the client making the request, taken from the
+// X-Forwarded-For header when there are TrustedProxies and the connection is from one of the
+// Proxies
+func (f *IPFilter) ClientAddress(r *http.Request) (netip.Addr, bool) {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	remote, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	remote = remote.Unmap()
+	if f.TrustedProxies == 0 || !containsAddr(f.Proxies, remote) {
+		return remote, true
+	}
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(entry))
+		}
+	}
+	if len(forwarded) < f.TrustedProxies {
+		// the request came through fewer proxies than expected, so no entry can be trusted
+		return remote, true
+	}
+	addr, err := netip.ParseAddr(forwarded[len(forwarded)-f.TrustedProxies])
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if clients at the address may connect
+func (f *IPFilter) Allows(addr netip.Addr) bool {
+	if containsAddr(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsAddr(f.Allow, addr)
+}
+
+// check returns ErrSecurity if the client making the request may not connect, emitting an
+// AuditAddressRejected event to audit, if any. Clients whose address can't be determined are
+// refused, and logged to log. The request is returned carrying the address checked, which the
+// audit log and connect deduplication then use as the address of the client.
+func (f *IPFilter) check(r *http.Request, transport string, audit AuditSink, log *subsystemLogger) (*http.Request, error) {
+	addr, ok := f.ClientAddress(r)
+	if ok && f.Allows(addr) {
+		return r.WithContext(context.WithValue(r.Context(), clientAddressKey{}, addr.String())), nil
+	}
+	err := ErrSecurity.NewError("Address not allowed.")
+	address := r.RemoteAddr
+	if ok {
+		address = addr.String()
+	}
+	log.Warnf("Refused %v request from %v.", transport, address)
+	if audit != nil {
+		emitAudit(audit, &AuditEvent{
+			Type:       AuditAddressRejected,
+			Transport:  transport,
+			RemoteAddr: address,
+			Status:     ClientForbidden.GetGuacamoleStatusCode(),
+			Reason:     err.Error(),
+		})
+	}
+	return r, err
+}
+
+type clientAddressKey struct{}
+
+// clientAddress returns the address of the client making the request: the one an IPFilter
+// checked, if any, or else the address of the connection
+func clientAddress(r *http.Request) string {
+	if address, ok := r.Context().Value(clientAddressKey{}).(string); ok {
+		return address
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,105 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPFilter_Allows(t *testing.T) {
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.7"}, []string{"10.9.0.0/16", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, allowed := range map[string]bool{
+		"10.1.2.3":        true,
+		"10.9.1.1":        false,
+		"192.168.1.7":     true,
+		"192.168.1.8":     false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"172.16.0.1":      false,
+		"::ffff:10.1.2.3": true,
+	} {
+		if filter.Allows(netip.MustParseAddr(address).Unmap()) != allowed {
+			t.Errorf("Expected %v allowed to be %v", address, allowed)
+		}
+	}
+	if _, err = NewIPFilter([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("Expected an invalid network to be refused")
+	}
+}
+
+func TestIPFilter_ClientAddress(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Add("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+	request.Header.Add("X-Forwarded-For", "10.0.0.2")
+
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	for trusted, want := range map[int]string{0: "10.0.0.1", 1: "10.0.0.2", 2: "1.2.3.4", 3: "6.6.6.6", 5: "10.0.0.1"} {
+		filter := &IPFilter{TrustedProxies: trusted, Proxies: proxies}
+		if addr, ok := filter.ClientAddress(request); !ok || addr.String() != want {
+			t.Errorf("Expected the client address with %v trusted proxies to be %v, got %v", trusted, want, addr)
+		}
+	}
+
+	request.RemoteAddr = "192.0.2.1:1234"
+	filter := &IPFilter{TrustedProxies: 1, Proxies: proxies}
+	if addr, ok := filter.ClientAddress(request); !ok || addr.String() != "192.0.2.1" {
+		t.Error("Expected the header to be ignored from a connection which isn't from a proxy, got", addr)
+	}
+}
+
+func TestServer_IPFilter(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		t.Error("Expected the connect callback not to be called")
+		return &fakeTunnel{}, nil
+	})
+	server.IPFilter, _ = NewIPFilter(nil, []string{"192.0.2.0/24"})
+	var events []*AuditEvent
+	server.Audit = AuditSinkFunc(func(event *AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	request := connectRequest("")
+	request.RemoteAddr = "192.0.2.10:4321"
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected the denied address to be refused, got", recorder.Code)
+	}
+	if len(events) != 1 || events[0].Type != AuditAddressRejected || events[0].RemoteAddr != "192.0.2.10" || events[0].Transport != "http" {
+		t.Errorf("Expected an address rejection to be audited, got %+v", events)
+	}
+}
+
+func TestServer_IPFilterAuditsClientAddress(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.IPFilter = &IPFilter{TrustedProxies: 1, Proxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}}
+	var events []*AuditEvent
+	server.Audit = AuditSinkFunc(func(event *AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	request := connectRequest("")
+	request.RemoteAddr = "10.0.0.1:4321"
+	request.Header.Set("X-Forwarded-For", "198.51.100.7")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+	if len(events) == 0 || events[0].RemoteAddr != "198.51.100.7" {
+		t.Errorf("Expected the checked address to be audited, got %+v", events)
+	}
+	checked, err := server.IPFilter.check(request, "http", nil, transportLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := defaultConnectKey(checked, nil); !strings.HasPrefix(key, "address:198.51.100.7\x00") {
+		t.Errorf("Expected the checked address to key connects, got %q", key)
+	}
+}
@@ -0,0 +1,133 @@
+package guac
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultJournalSize is the number of entries a Journal keeps when created with a size of zero
+const DefaultJournalSize = 100
+
+// JournalEntry is a diagnostic guacd sent about a tunnel
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	// Level is the logrus level the entry was logged at
+	Level string `json:"level"`
+	// Opcode is the instruction the entry came from, log or error
+	Opcode  string `json:"opcode"`
+	Message string `json:"message"`
+	// Status is the Guacamole status code of an error instruction
+	Status int `json:"status,omitempty"`
+}
+
+// Journal keeps the most recent diagnostics of a tunnel, so operators can see why a session
+// failed after the client has gone
+type Journal struct {
+	sync.Mutex
+	size    int
+	entries []JournalEntry
+	// dropped counts the entries pushed out by newer ones
+	dropped int64
+}
+
+// NewJournal creates a journal keeping the given number of entries, DefaultJournalSize if zero
+func NewJournal(size int) *Journal {
+	if size <= 0 {
+		size = DefaultJournalSize
+	}
+	return &Journal{size: size}
+}
+
+// Add appends an entry, dropping the oldest once the journal is full
+func (j *Journal) Add(entry JournalEntry) {
+	j.Lock()
+	defer j.Unlock()
+	if len(j.entries) >= j.size {
+		copy(j.entries, j.entries[1:])
+		j.entries = j.entries[:len(j.entries)-1]
+		j.dropped++
+	}
+	j.entries = append(j.entries, entry)
+}
+
+// Entries returns the entries kept, oldest first, and how many older ones were dropped
+func (j *Journal) Entries() ([]JournalEntry, int64) {
+	j.Lock()
+	defer j.Unlock()
+	return append([]JournalEntry(nil), j.entries...), j.dropped
+}
+
+// NewGuacdLogFilter creates a read filter passing the log and error instructions guacd sends
+// on the tunnel with the given UUID to the guacd subsystem logger and the journal, which may
+// be nil. Log instructions are logged at debug level. Errors are logged at error level for
+// server failures, and warning level for errors guacd blames on the client. The instructions
+// are still forwarded to the client.
+func NewGuacdLogFilter(uuid string, journal *Journal) Filter {
+	return FilterFunc(func(instruction *Instruction) (*Instruction, error) {
+		var entry JournalEntry
+		switch instruction.Opcode {
+		case OpcodeLog:
+			entry = JournalEntry{Level: logrus.DebugLevel.String()}
+		case OpcodeError:
+			entry = JournalEntry{Level: errorLevel(instruction).String()}
+			if len(instruction.Args) > 1 {
+				entry.Status, _ = strconv.Atoi(instruction.Args[1])
+			}
+		default:
+			return instruction, nil
+		}
+		entry.Time = time.Now()
+		entry.Opcode = instruction.Opcode
+		if len(instruction.Args) > 0 {
+			entry.Message = instruction.Args[0]
+		}
+
+		level, _ := logrus.ParseLevel(entry.Level)
+		if guacdLog.enabled(level) {
+			fields := LogFields{"tunnel": uuid}
+			if entry.Status != 0 {
+				fields["status"] = FromGuacamoleStatusCode(entry.Status).String()
+			}
+			guacdLog.with(nil, fields).emit(level, entry.Message)
+		}
+		if journal != nil {
+			journal.Add(entry)
+		}
+		return instruction, nil
+	})
+}
+
+// errorLevel returns the level to log an error instruction at, given its status code
+func errorLevel(instruction *Instruction) logrus.Level {
+	if len(instruction.Args) < 2 {
+		return logrus.ErrorLevel
+	}
+	code, err := strconv.Atoi(instruction.Args[1])
+	switch {
+	case err != nil:
+		return logrus.ErrorLevel
+	case code == 0:
+		return logrus.InfoLevel
+	case code >= 0x0300:
+		return logrus.WarnLevel
+	default:
+		return logrus.ErrorLevel
+	}
+}
+
+// TunnelJournal returns the diagnostics guacd sent about the tunnel with the given UUID, and
+// how many older ones were dropped, if the server has GuacdLogs set
+func (s *Server) TunnelJournal(tunnelUUID string) ([]JournalEntry, int64, error) {
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return nil, 0, ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	if tunnel.journal == nil {
+		return nil, 0, ErrUnsupported.NewError("Tunnel has no journal.")
+	}
+	entries, dropped := tunnel.journal.Entries()
+	return entries, dropped, nil
+}
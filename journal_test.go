@@ -0,0 +1,110 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestJournal(t *testing.T) {
+	journal := NewJournal(2)
+	for _, message := range []string{"a", "b", "c"} {
+		journal.Add(JournalEntry{Message: message})
+	}
+	entries, dropped := journal.Entries()
+	if len(entries) != 2 || entries[0].Message != "b" || entries[1].Message != "c" || dropped != 1 {
+		t.Errorf("Unexpected entries %+v, %v dropped", entries, dropped)
+	}
+}
+
+func TestGuacdLogFilter(t *testing.T) {
+	out := &bytes.Buffer{}
+	std := logrus.StandardLogger()
+	oldOut, oldLevel := std.Out, std.Level
+	std.SetOutput(out)
+	std.SetLevel(logrus.InfoLevel)
+	defer func() {
+		std.SetOutput(oldOut)
+		std.SetLevel(oldLevel)
+	}()
+
+	journal := NewJournal(0)
+	filter := NewGuacdLogFilter("1", journal)
+	for _, instruction := range []*Instruction{
+		NewInstruction(OpcodeLog, "keyboard layout unknown"),
+		NewErrorInstruction("Bad credentials", ClientUnauthorized),
+		NewErrorInstruction("Connection failed", UpstreamError),
+		NewInstruction(OpcodeSync, "1"),
+	} {
+		if filtered, err := filter.Filter(instruction); filtered != instruction || err != nil {
+			t.Errorf("Expected %v to be forwarded, got %v, %v", instruction, filtered, err)
+		}
+	}
+
+	entries, _ := journal.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+	for i, level := range []string{"debug", "warning", "error"} {
+		if entries[i].Level != level {
+			t.Errorf("Entry %v: expected level %v, got %v", i, level, entries[i].Level)
+		}
+	}
+	if entries[2].Status != UpstreamError.GetGuacamoleStatusCode() || entries[2].Message != "Connection failed" {
+		t.Errorf("Unexpected entry %+v", entries[2])
+	}
+
+	logged := out.String()
+	if strings.Contains(logged, "keyboard layout") {
+		t.Error("Expected log instructions at debug level:", logged)
+	}
+	if !strings.Contains(logged, "Connection failed") || !strings.Contains(logged, "subsystem=guacd") || !strings.Contains(logged, "status=UPSTREAM_ERROR") || !strings.Contains(logged, "tunnel=1") {
+		t.Error("Unexpected log output:", logged)
+	}
+}
+
+func TestServer_GuacdLogs(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		reader := NewStream(&fakeConn{ToRead: []byte("3.log,5.hello;5.error,4.oops,3.519;")}, time.Minute)
+		return &uuidTunnel{fakeTunnel: fakeTunnel{reader: reader}, uuid: uuid.New().String()}, nil
+	})
+	server.GuacdLogs = true
+	closed := make(chan *TunnelInfo, 1)
+	server.OnClose = func(info *TunnelInfo) {
+		closed <- info
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	id := recorder.Body.String()
+
+	admin := &AdminServer{Server: server, Authorizer: adminAuthorizer}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/tunnels?tunnel="+id+"&journal", nil))
+	var journal JournalResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&journal); err != nil {
+		t.Fatal(err)
+	}
+	if journal.Entries == nil || len(journal.Entries) != 0 {
+		t.Errorf("Expected an empty journal, got %+v", journal)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+id+":0", nil))
+	if !strings.Contains(recorder.Body.String(), "5.error,4.oops,3.519;") {
+		t.Error("Expected the error to reach the client:", recorder.Body.String())
+	}
+
+	info := <-closed
+	entries, _ := info.Journal.Entries()
+	if len(entries) != 2 || entries[0].Message != "hello" || entries[1].Status != 519 {
+		t.Errorf("Unexpected journal %+v", entries)
+	}
+}
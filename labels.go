@@ -0,0 +1,33 @@
+package guac
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Roles of the long-lived goroutines serving a tunnel, as shown by the "guac.role" pprof label
+const (
+	roleWsToGuacd = "ws-to-guacd"
+	roleGuacdToWs = "guacd-to-ws"
+	roleHTTPRead  = "http-read"
+	roleHTTPWrite = "http-write"
+)
+
+// runLabeled runs fn with pprof labels naming the tunnel and the goroutine's role in serving
+// it, so CPU and goroutine profiles of gateways carrying thousands of sessions can be broken
+// down per tunnel. If lockThread is set the goroutine is wired to its OS thread for the
+// duration, keeping latency-critical streaming off the shared scheduler threads.
+func runLabeled(ctx context.Context, tunnel Tunnel, role string, lockThread bool, fn func(context.Context)) {
+	if lockThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	labels := pprof.Labels(
+		"guac.tunnel", tunnel.GetUUID(),
+		"guac.connection", tunnel.ConnectionID(),
+		"guac.role", role,
+	)
+	pprof.Do(ctx, labels, fn)
+}
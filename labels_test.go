@@ -0,0 +1,22 @@
+package guac
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+)
+
+func TestRunLabeled(t *testing.T) {
+	ran := false
+	runLabeled(context.Background(), &fakeTunnel{}, roleHTTPRead, true, func(ctx context.Context) {
+		ran = true
+		for key, want := range map[string]string{"guac.tunnel": "1", "guac.connection": "asdf", "guac.role": roleHTTPRead} {
+			if got, _ := pprof.Label(ctx, key); got != want {
+				t.Errorf("label %v = %q, want %q", key, got, want)
+			}
+		}
+	})
+	if !ran {
+		t.Error("expected fn to run")
+	}
+}
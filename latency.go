@@ -0,0 +1,124 @@
+package guac
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of a latencyHistogram, doubling from a
+// millisecond to about a minute
+var latencyBuckets = func() []time.Duration {
+	buckets := make([]time.Duration, 17)
+	for i := range buckets {
+		buckets[i] = time.Millisecond << i
+	}
+	return buckets
+}()
+
+// PercentileStats summarises a distribution of durations. Percentiles are estimated as the
+// upper bound of the histogram bucket they fall in, so are at most twice the true value.
+type PercentileStats struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	// Max is the largest duration observed
+	Max time.Duration `json:"max"`
+	// Samples is the number of durations observed
+	Samples int64 `json:"samples"`
+}
+
+// RequestLatencyStats summarises how long the HTTP tunnel requests of a server take. Read is
+// the time from a read request arriving to its first bytes being flushed to the client, which
+// a proxy buffering responses inflates, and Write the time taken copying the body of a write
+// request to guacd.
+type RequestLatencyStats struct {
+	Read  PercentileStats `json:"read"`
+	Write PercentileStats `json:"write"`
+}
+
+// latencyHistogram counts durations into the latencyBuckets, and those over the last bucket
+// into one more
+type latencyHistogram struct {
+	sync.Mutex
+	counts  []int64
+	samples int64
+	max     time.Duration
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets)+1)
+	}
+	h.counts[i]++
+	h.samples++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *latencyHistogram) snapshot() PercentileStats {
+	h.Lock()
+	defer h.Unlock()
+	return PercentileStats{
+		P50:     h.percentile(0.5),
+		P90:     h.percentile(0.9),
+		P99:     h.percentile(0.99),
+		Max:     h.max,
+		Samples: h.samples,
+	}
+}
+
+// percentile estimates the duration under which the fraction p of observations fell. The
+// lock must be held.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.samples == 0 {
+		return 0
+	}
+	rank := int64(p*float64(h.samples-1)) + 1
+	var seen int64
+	for i, count := range h.counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		if i == len(latencyBuckets) || latencyBuckets[i] > h.max {
+			return h.max
+		}
+		return latencyBuckets[i]
+	}
+	return h.max
+}
+
+// RequestLatency returns the latency of the server's read and write requests, across every
+// tunnel. The latency of each tunnel's requests is part of its TunnelStats.
+func (s *Server) RequestLatency() RequestLatencyStats {
+	return RequestLatencyStats{Read: s.readLatency.snapshot(), Write: s.writeLatency.snapshot()}
+}
+
+// observeRead records a read request on tunnel flushing its first bytes d after it arrived
+func (s *Server) observeRead(tunnel Tunnel, d time.Duration) {
+	s.readLatency.observe(d)
+	if v, ok := tunnel.(*LastAccessedTunnel); ok {
+		v.readLatency.observe(d)
+	}
+	if s.Metrics != nil {
+		s.Metrics.ReadFirstByte(d)
+	}
+}
+
+// observeWrite records a write request on tunnel taking d to copy its body to guacd
+func (s *Server) observeWrite(tunnel Tunnel, d time.Duration) {
+	s.writeLatency.observe(d)
+	if v, ok := tunnel.(*LastAccessedTunnel); ok {
+		v.writeLatency.observe(d)
+	}
+	if s.Metrics != nil {
+		s.Metrics.WriteCopied(d)
+	}
+}
@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	histogram := &latencyHistogram{}
+	if stats := histogram.snapshot(); stats != (PercentileStats{}) {
+		t.Error("Expected no samples, got", stats)
+	}
+	for i := 0; i < 98; i++ {
+		histogram.observe(3 * time.Millisecond)
+	}
+	histogram.observe(100 * time.Millisecond)
+	histogram.observe(2 * time.Minute)
+
+	stats := histogram.snapshot()
+	if stats.P50 != 4*time.Millisecond || stats.P90 != 4*time.Millisecond || stats.P99 != 128*time.Millisecond {
+		t.Errorf("Unexpected percentiles %+v", stats)
+	}
+	if stats.Max != 2*time.Minute || stats.Samples != 100 {
+		t.Errorf("Unexpected max or samples %+v", stats)
+	}
+
+	histogram = &latencyHistogram{}
+	histogram.observe(time.Minute + time.Second)
+	if stats = histogram.snapshot(); stats.P50 != time.Minute+time.Second {
+		t.Error("Expected percentiles past the last bucket to be the max, got", stats.P50)
+	}
+}
+
+func TestServer_RequestLatency(t *testing.T) {
+	const uuid = "6f1c2d3e-4b5a-4c7d-8e9f-0a1b2c3d4e5f"
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{
+			fakeTunnel: fakeTunnel{reader: NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;")}, time.Minute), writer: &bytes.Buffer{}},
+			uuid:       uuid,
+		}, nil
+	})
+	request := func(method, query string, body []byte) string {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(method, "/?"+query, bytes.NewReader(body)))
+		data, _ := io.ReadAll(response.Body)
+		return string(data)
+	}
+	request(http.MethodPost, "connect", nil)
+	registered, ok := server.tunnels.Get(uuid)
+	if !ok {
+		t.Fatal("Expected the tunnel to be registered")
+	}
+	request(http.MethodPost, "write:"+uuid, []byte("3.key,2.65,1.1;"))
+	if got := request(http.MethodGet, "read:"+uuid+":0", nil); !strings.HasPrefix(got, "4.sync,1.1;") {
+		t.Fatal("Unexpected read", got)
+	}
+
+	latency := server.RequestLatency()
+	if latency.Read.Samples != 1 || latency.Write.Samples != 1 {
+		t.Errorf("Expected a read and a write to be measured, got %+v", latency)
+	}
+	stats := registered.Stats()
+	if stats.ReadLatency.Samples != 1 || stats.WriteLatency.Samples != 1 || stats.ReadLatency.Max <= 0 {
+		t.Errorf("Expected the tunnel's requests to be measured, got %+v %+v", stats.ReadLatency, stats.WriteLatency)
+	}
+}
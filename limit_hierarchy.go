@@ -0,0 +1,235 @@
+package guac
+
+import (
+	"time"
+)
+
+// Limits holds the limits enforced on a session at one level of a LimitHierarchy. A zero field
+// inherits the value of the level above it, and a negative one lifts the limit inherited. In
+// the effective limits of a session, zero means no limit.
+type Limits struct {
+	// MaxBlobSize is the largest decoded blob accepted from the client
+	MaxBlobSize int `json:"max_blob_size,omitempty"`
+	// MaxClipboardSize is the largest complete clipboard update accepted from the client
+	MaxClipboardSize int `json:"max_clipboard_size,omitempty"`
+	// MaxInstructionLength is the longest client instruction accepted, in runes
+	MaxInstructionLength int `json:"max_instruction_length,omitempty"`
+	// MaxInstructionElements is the most elements a client instruction may have
+	MaxInstructionElements int `json:"max_instruction_elements,omitempty"`
+	// MaxSessions is the number of tunnels a user may hold, enforced by the Quota of a server
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// IdleTimeout is how long a tunnel may go without read or write requests
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+	// MinFlushInterval is the shortest time between flushes of instructions to the client
+	MinFlushInterval time.Duration `json:"min_flush_interval,omitempty"`
+	// MaxReadWait is how long a read request waits for the read requests ahead of it
+	MaxReadWait time.Duration `json:"max_read_wait,omitempty"`
+}
+
+// inherit returns the limits with the zero fields of l taken from parent
+func (l Limits) inherit(parent Limits) Limits {
+	inheritInt := func(v, p int) int {
+		if v == 0 {
+			return p
+		}
+		return v
+	}
+	inheritDuration := func(v, p time.Duration) time.Duration {
+		if v == 0 {
+			return p
+		}
+		return v
+	}
+	return Limits{
+		MaxBlobSize:            inheritInt(l.MaxBlobSize, parent.MaxBlobSize),
+		MaxClipboardSize:       inheritInt(l.MaxClipboardSize, parent.MaxClipboardSize),
+		MaxInstructionLength:   inheritInt(l.MaxInstructionLength, parent.MaxInstructionLength),
+		MaxInstructionElements: inheritInt(l.MaxInstructionElements, parent.MaxInstructionElements),
+		MaxSessions:            inheritInt(l.MaxSessions, parent.MaxSessions),
+		IdleTimeout:            inheritDuration(l.IdleTimeout, parent.IdleTimeout),
+		MinFlushInterval:       inheritDuration(l.MinFlushInterval, parent.MinFlushInterval),
+		MaxReadWait:            inheritDuration(l.MaxReadWait, parent.MaxReadWait),
+	}
+}
+
+// effective returns the limits with the lifted ones, which are negative, as zero
+func (l Limits) effective() Limits {
+	positiveInt := func(v int) int {
+		if v < 0 {
+			return 0
+		}
+		return v
+	}
+	positiveDuration := func(v time.Duration) time.Duration {
+		if v < 0 {
+			return 0
+		}
+		return v
+	}
+	return Limits{
+		MaxBlobSize:            positiveInt(l.MaxBlobSize),
+		MaxClipboardSize:       positiveInt(l.MaxClipboardSize),
+		MaxInstructionLength:   positiveInt(l.MaxInstructionLength),
+		MaxInstructionElements: positiveInt(l.MaxInstructionElements),
+		MaxSessions:            positiveInt(l.MaxSessions),
+		IdleTimeout:            positiveDuration(l.IdleTimeout),
+		MinFlushInterval:       positiveDuration(l.MinFlushInterval),
+		MaxReadWait:            positiveDuration(l.MaxReadWait),
+	}
+}
+
+// streamLimits returns the stream and instruction limits to install on a tunnel, nil if there
+// are none. As with StreamLimits, instruction limits replace DefaultInstructionLimits.
+func (l Limits) streamLimits() *StreamLimits {
+	limits := &StreamLimits{
+		MaxBlobSize:      l.MaxBlobSize,
+		MaxClipboardSize: l.MaxClipboardSize,
+		Instructions: InstructionLimits{
+			MaxLength:   l.MaxInstructionLength,
+			MaxElements: l.MaxInstructionElements,
+		},
+	}
+	if *limits == (StreamLimits{}) {
+		return nil
+	}
+	return limits
+}
+
+// LimitHierarchy resolves the limits of each session from layers, the most specific of which
+// wins: the options of the server, Global, the tenant of the session, the identity of its user
+// and finally the session itself, set with SetTunnelLimits. Each layer only sets the limits it
+// changes, inheriting the rest.
+//
+// The limits of a session are resolved when it connects. Changing the limits of a session
+// afterwards applies at once to its IdleTimeout, MinFlushInterval and MaxReadWait, while its
+// stream and instruction limits stay as they were when it connected. MaxSessions is resolved
+// before connecting, when the metadata of the session is not yet known, so its tenant comes
+// from the identity alone.
+type LimitHierarchy struct {
+	// Global applies to every session
+	Global Limits
+	// Tenants holds the limits of the sessions of each tenant
+	Tenants map[string]Limits
+	// Identities holds the limits of the sessions of each user, keyed by identity Subject
+	Identities map[string]Limits
+	// Tenant optionally returns the tenant of a session, from its identity or the metadata
+	// attached by the connect callback, either of which may be nil. The metadata value
+	// "tenant" is used if nil.
+	Tenant func(identity *Identity, metadata *Metadata) string
+}
+
+// tenant returns the tenant of a session
+func (h *LimitHierarchy) tenant(identity *Identity, metadata *Metadata) string {
+	if h.Tenant != nil {
+		return h.Tenant(identity, metadata)
+	}
+	if metadata == nil {
+		return ""
+	}
+	return metadata.String("tenant")
+}
+
+// Resolve returns the limits of a session of the given user and metadata, either of which may
+// be nil, before any limits of the session itself, with base beneath the global limits.
+// Lifted limits are returned as zero.
+func (h *LimitHierarchy) Resolve(base Limits, identity *Identity, metadata *Metadata) Limits {
+	return h.resolve(base, identity, metadata).effective()
+}
+
+// resolve returns the limits of a session keeping the lifted limits negative, so they still
+// lift the limits of the levels above once the session's own limits are applied
+func (h *LimitHierarchy) resolve(base Limits, identity *Identity, metadata *Metadata) Limits {
+	limits := h.Global.inherit(base)
+	if tenant := h.tenant(identity, metadata); tenant != "" {
+		limits = h.Tenants[tenant].inherit(limits)
+	}
+	if identity != nil {
+		limits = h.Identities[identity.Subject].inherit(limits)
+	}
+	return limits
+}
+
+// optionLimits returns the limits set by the StreamLimits and Quota options of a server
+func optionLimits(streamLimits *StreamLimits, quota *SessionQuota) Limits {
+	var limits Limits
+	if streamLimits != nil {
+		limits.MaxBlobSize = streamLimits.MaxBlobSize
+		limits.MaxClipboardSize = streamLimits.MaxClipboardSize
+		limits.MaxInstructionLength = streamLimits.Instructions.MaxLength
+		limits.MaxInstructionElements = streamLimits.Instructions.MaxElements
+	}
+	if quota != nil {
+		limits.MaxSessions = quota.Max
+	}
+	return limits
+}
+
+// baseLimits returns the limits set by the options of the server
+func (s *Server) baseLimits() Limits {
+	limits := optionLimits(s.StreamLimits, s.Quota)
+	limits.IdleTimeout = s.IdleTimeout
+	limits.MinFlushInterval = s.MinFlushInterval
+	limits.MaxReadWait = s.MaxReadWait
+	return limits
+}
+
+// baseLimits returns the limits set by the options of the websocket server
+func (s *WebsocketServer) baseLimits() Limits {
+	limits := optionLimits(s.StreamLimits, s.Quota)
+	limits.MinFlushInterval = s.MinFlushInterval
+	return limits
+}
+
+// maxSessions returns the number of tunnels the user may hold according to the server's
+// LimitHierarchy, zero for no limit, or -1 if it has none
+func (s *Server) maxSessions(identity *Identity) int {
+	if s.Limits == nil {
+		return -1
+	}
+	return s.Limits.Resolve(s.baseLimits(), identity, nil).MaxSessions
+}
+
+// sessionLimits returns the limits of a registered tunnel: those it was resolved to when it
+// connected, overridden by its own
+func (t *LastAccessedTunnel) sessionLimits() Limits {
+	t.RLock()
+	defer t.RUnlock()
+	return t.ownLimits.inherit(t.limits).effective()
+}
+
+// tunnelLimits returns the limits of a tunnel in use, the options of the server for tunnels
+// registered without a LimitHierarchy
+func (s *Server) tunnelLimits(tunnel Tunnel) Limits {
+	if v, ok := tunnel.(*LastAccessedTunnel); ok && s.Limits != nil {
+		return v.sessionLimits()
+	}
+	return s.baseLimits().effective()
+}
+
+// EffectiveLimits returns the limits in force on the tunnel with the given UUID. Zero means no
+// limit.
+func (s *Server) EffectiveLimits(tunnelUUID string) (Limits, error) {
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return Limits{}, ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	return s.tunnelLimits(tunnel), nil
+}
+
+// SetTunnelLimits sets the limits of the session of the tunnel with the given UUID, the most
+// specific level of the server's LimitHierarchy, replacing any set before. Only IdleTimeout,
+// MinFlushInterval and MaxReadWait take effect on a tunnel in use.
+func (s *Server) SetTunnelLimits(tunnelUUID string, limits Limits) error {
+	if s.Limits == nil {
+		return ErrUnsupported.NewError("Server has no limit hierarchy.")
+	}
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	tunnel.Lock()
+	tunnel.ownLimits = limits
+	tunnel.Unlock()
+	tunnel.setIdleTimeout(tunnel.sessionLimits().IdleTimeout)
+	return nil
+}
@@ -0,0 +1,109 @@
+package guac
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestLimitHierarchy_Resolve(t *testing.T) {
+	hierarchy := &LimitHierarchy{
+		Global:     Limits{IdleTimeout: time.Minute},
+		Tenants:    map[string]Limits{"acme": {MaxBlobSize: 200}},
+		Identities: map[string]Limits{"alice": {MaxBlobSize: -1, MinFlushInterval: time.Millisecond}},
+	}
+	base := Limits{MaxBlobSize: 100, IdleTimeout: time.Hour}
+	acme := &Metadata{}
+	acme.Set("tenant", "acme")
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		metadata *Metadata
+		expected Limits
+	}{
+		{"global", nil, nil, Limits{MaxBlobSize: 100, IdleTimeout: time.Minute}},
+		{"tenant", &Identity{Subject: "bob"}, acme, Limits{MaxBlobSize: 200, IdleTimeout: time.Minute}},
+		{"identity lifts tenant", &Identity{Subject: "alice"}, acme, Limits{IdleTimeout: time.Minute, MinFlushInterval: time.Millisecond}},
+	}
+	for _, test := range tests {
+		if limits := hierarchy.Resolve(base, test.identity, test.metadata); limits != test.expected {
+			t.Errorf("%v: expected %+v, got %+v", test.name, test.expected, limits)
+		}
+	}
+}
+
+func TestServer_Limits(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		MetadataFromRequest(r).Set("tenant", "acme")
+		return &uuidTunnel{fakeTunnel: fakeTunnel{}, uuid: uuid.New().String()}, nil
+	})
+	server.Quota = &SessionQuota{Max: 5, Key: func(*http.Request, *Identity) string { return "user" }}
+	server.Limits = &LimitHierarchy{
+		Global:  Limits{MaxSessions: 1},
+		Tenants: map[string]Limits{"acme": {MaxBlobSize: 1024}},
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	id := recorder.Body.String()
+	if recorder.Header().Get(MaxBlobSizeHeader) != "1024" {
+		t.Error("Expected the tenant's blob limit to be advertised, got", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	if recorder.Code != ClientTooMany.GetHTTPStatusCode() {
+		t.Error("Expected the global session limit to replace the quota's, got", recorder.Code)
+	}
+
+	if err := server.SetTunnelLimits(id, Limits{IdleTimeout: time.Second, MaxBlobSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	admin := &AdminServer{Server: server, Authorizer: adminAuthorizer}
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/tunnels?tunnel="+id+"&limits", nil))
+	var limits Limits
+	if err := json.NewDecoder(recorder.Body).Decode(&limits); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Limits{MaxSessions: 1, IdleTimeout: time.Second}); limits != expected {
+		t.Errorf("Expected %+v, got %+v", expected, limits)
+	}
+	if tunnel, _ := server.tunnels.Get(id); tunnel.IdleTimeout() != time.Second {
+		t.Error("Expected the session's idle timeout to apply, got", tunnel.IdleTimeout())
+	}
+}
+
+func TestWebsocketServer_LimitsFromMetadata(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		MetadataFromRequest(r).Set("tenant", "acme")
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	wsServer.Limits = &LimitHierarchy{
+		Tenants: map[string]Limits{"acme": {MaxInstructionLength: 16}},
+	}
+	httpServer := httptest.NewServer(wsServer)
+	defer httpServer.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.WriteMessage(websocket.TextMessage, []byte("4.name,32."+strings.Repeat("x", 32)+";"))
+
+	_ = guacd.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := guacd.Read(make([]byte, 64)); n > 0 {
+		t.Error("Expected the tenant's instruction limit to apply")
+	}
+}
@@ -0,0 +1,241 @@
+package guac
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// MaxBlobSizeHeader advertises StreamLimits.MaxBlobSize in connect responses
+	MaxBlobSizeHeader = "Guacamole-Max-Blob-Size"
+	// MaxClipboardSizeHeader advertises StreamLimits.MaxClipboardSize in connect responses
+	MaxClipboardSizeHeader = "Guacamole-Max-Clipboard-Size"
+
+	// DefaultMaxInstructionLength is the longest instruction, in runes, a FilteredTunnel
+	// accepts from the client unless configured otherwise
+	DefaultMaxInstructionLength = 8192
+	// DefaultMaxInstructionElements is the most elements, opcode included, a FilteredTunnel
+	// accepts in a client instruction unless configured otherwise
+	DefaultMaxInstructionElements = 64
+)
+
+// InstructionLimits bounds the size of single instructions parsed from the client, so a
+// client cannot make the gateway buffer an instruction which never ends. A client exceeding
+// them fails with ErrClient.
+type InstructionLimits struct {
+	// MaxLength is the longest instruction accepted, in runes, zero for no limit.
+	MaxLength int `json:"max_length,omitempty"`
+	// MaxElements is the most elements an instruction may have, zero for no limit.
+	MaxElements int `json:"max_elements,omitempty"`
+}
+
+// DefaultInstructionLimits are the limits a FilteredTunnel starts with
+var DefaultInstructionLimits = InstructionLimits{
+	MaxLength:   DefaultMaxInstructionLength,
+	MaxElements: DefaultMaxInstructionElements,
+}
+
+// checkLength fails if an instruction of the given length in runes is too long
+func (l InstructionLimits) checkLength(length int) error {
+	if l.MaxLength > 0 && length > l.MaxLength {
+		return ErrClient.NewError(fmt.Sprintf("Instruction exceeds maximum length of %v.", l.MaxLength))
+	}
+	return nil
+}
+
+// checkElements fails if an instruction with the given number of elements has too many
+func (l InstructionLimits) checkElements(elements int) error {
+	if l.MaxElements > 0 && elements > l.MaxElements {
+		return ErrClient.NewError(fmt.Sprintf("Instruction exceeds maximum of %v elements.", l.MaxElements))
+	}
+	return nil
+}
+
+// StreamLimits bounds the size of streams the client may send. The limits are advertised to
+// the client in the connect response headers of both the HTTP and WebSocket servers, and a
+// client exceeding them fails with ClientOverrun.
+type StreamLimits struct {
+	// MaxBlobSize is the largest decoded blob accepted on any stream, zero for no limit.
+	MaxBlobSize int `json:"max_blob_size,omitempty"`
+	// MaxClipboardSize is the largest complete clipboard update accepted, zero for no limit.
+	MaxClipboardSize int `json:"max_clipboard_size,omitempty"`
+	// Instructions replaces DefaultInstructionLimits for client instructions, if set.
+	Instructions InstructionLimits `json:"instructions"`
+}
+
+// setHeaders advertises the limits in the given response headers
+func (l *StreamLimits) setHeaders(header http.Header) {
+	if l.MaxBlobSize > 0 {
+		header.Set(MaxBlobSizeHeader, strconv.Itoa(l.MaxBlobSize))
+	}
+	if l.MaxClipboardSize > 0 {
+		header.Set(MaxClipboardSizeHeader, strconv.Itoa(l.MaxClipboardSize))
+	}
+}
+
+// Filter returns a new write Filter enforcing the limits. Each tunnel needs its own filter.
+func (l *StreamLimits) Filter() Filter {
+	return &streamLimitFilter{
+		limits:    *l,
+		clipboard: map[string]int{},
+	}
+}
+
+// wrap installs the limits on the given tunnel, wrapping it in a FilteredTunnel if necessary
+func (l *StreamLimits) wrap(tunnel Tunnel) Tunnel {
+	filtered, ok := tunnel.(*FilteredTunnel)
+	if !ok {
+		filtered = NewFilteredTunnel(tunnel)
+	}
+	if l.Instructions != (InstructionLimits{}) {
+		filtered.SetInstructionLimits(l.Instructions)
+	}
+	filtered.AddWriteFilter(l.Filter())
+	return filtered
+}
+
+// instructionLimits returns the limits on client instructions, DefaultInstructionLimits if
+// none are set
+func (l *StreamLimits) instructionLimits() InstructionLimits {
+	if l == nil || l.Instructions == (InstructionLimits{}) {
+		return DefaultInstructionLimits
+	}
+	return l.Instructions
+}
+
+// maxMessageSize returns the largest WebSocket message accepted from the client, which carries
+// one instruction per message. Messages stay bounded by DefaultMaxInstructionLength when
+// instruction length is not limited.
+func (l *StreamLimits) maxMessageSize() int64 {
+	length := l.instructionLimits().MaxLength
+	if length <= 0 {
+		length = DefaultMaxInstructionLength
+	}
+	return int64(length * utf8.UTFMax)
+}
+
+// instructionLimiter checks the instructions written by the client against InstructionLimits
+// at the transport, whatever the type of the tunnel they are written to. A partial instruction
+// is kept until the rest arrives, so the limits can't be escaped by splitting an instruction
+// across writes.
+type instructionLimiter struct {
+	limits  InstructionLimits
+	pending []byte
+}
+
+// check passes the instructions the data completes to counted, if any, failing if one exceeds
+// the limits, or the data starts one which already does
+func (l *instructionLimiter) check(data []byte, counted func(complete []byte)) error {
+	l.pending = append(l.pending, data...)
+	start := 0
+	for start < len(l.pending) {
+		end, err := instructionEnd(l.pending[start:], l.limits)
+		if err != nil {
+			l.pending = l.pending[:0]
+			return err
+		}
+		if end < 0 {
+			break
+		}
+		start += end
+	}
+	if counted != nil && start > 0 {
+		counted(l.pending[:start])
+	}
+	l.pending = append(l.pending[:0], l.pending[start:]...)
+	return nil
+}
+
+// limitedWriter writes to the tunnel only what passes its instructionLimiter, counting what it
+// writes in counters, if any
+type limitedWriter struct {
+	io.Writer
+	limiter  *instructionLimiter
+	counters *tunnelCounters
+}
+
+func (w *limitedWriter) Write(data []byte) (int, error) {
+	var instructions int64
+	var counted func([]byte)
+	if w.counters != nil {
+		counted = func(complete []byte) {
+			instructions, _ = w.counters.scan(FromClient, complete)
+		}
+	}
+	if err := w.limiter.check(data, counted); err != nil {
+		return 0, err
+	}
+	n, err := w.Writer.Write(data)
+	if w.counters != nil {
+		w.counters.count(FromClient, int64(n), instructions, 0)
+	}
+	return n, err
+}
+
+// limitWriter returns the writer of the tunnel checking what the client writes against the
+// instruction limits of the tunnel. The limiter of a registered tunnel carries partial
+// instructions from one write request to the next, so its writer must be held.
+func (s *Server) limitWriter(tunnel Tunnel, writer io.Writer) io.Writer {
+	v, ok := tunnel.(*LastAccessedTunnel)
+	if ok && v.limiter != nil {
+		return &limitedWriter{Writer: writer, limiter: v.limiter, counters: &v.counters}
+	}
+	limiter := &instructionLimiter{limits: s.tunnelLimits(tunnel).streamLimits().instructionLimits()}
+	if ok {
+		v.limiter = limiter
+	}
+	return &limitedWriter{Writer: writer, limiter: limiter, counters: countersOf(tunnel)}
+}
+
+// streamLimitFilter tracks the size of client streams, failing once a limit is exceeded
+type streamLimitFilter struct {
+	limits StreamLimits
+
+	sync.Mutex
+	// clipboard holds the bytes received so far for each open clipboard stream
+	clipboard map[string]int
+}
+
+func (f *streamLimitFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	if len(instruction.Args) == 0 {
+		return instruction, nil
+	}
+	index := instruction.Args[0]
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch instruction.Opcode {
+	case OpcodeClipboard:
+		f.clipboard[index] = 0
+	case OpcodeBlob:
+		if len(instruction.Args) < 2 {
+			break
+		}
+		size := decodedLength(instruction.Args[1])
+		if f.limits.MaxBlobSize > 0 && size > f.limits.MaxBlobSize {
+			return nil, ErrClientOverrun.NewError(fmt.Sprintf("Blob exceeds maximum size of %v bytes.", f.limits.MaxBlobSize))
+		}
+		if total, ok := f.clipboard[index]; ok {
+			total += size
+			if f.limits.MaxClipboardSize > 0 && total > f.limits.MaxClipboardSize {
+				return nil, ErrClientOverrun.NewError(fmt.Sprintf("Clipboard exceeds maximum size of %v bytes.", f.limits.MaxClipboardSize))
+			}
+			f.clipboard[index] = total
+		}
+	case OpcodeEnd:
+		delete(f.clipboard, index)
+	}
+	return instruction, nil
+}
+
+// decodedLength returns the number of bytes a base64 blob decodes to
+func decodedLength(blob string) int {
+	return base64.StdEncoding.DecodedLen(len(blob)) - (len(blob) - len(strings.TrimRight(blob, "=")))
+}
@@ -0,0 +1,149 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+func TestStreamLimits_Filter(t *testing.T) {
+	limits := &StreamLimits{MaxBlobSize: 4, MaxClipboardSize: 6}
+	tunnel := limits.wrap(&fakeTunnel{writer: &bytes.Buffer{}}).(*FilteredTunnel)
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	// 3 + 3 bytes of clipboard is within both limits
+	if _, err := writer.Write([]byte("9.clipboard,1.0,10.text/plain;4.blob,1.0,4.YWJj;4.blob,1.0,4.YWJj;3.end,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a 5 byte blob exceeds the blob limit
+	_, err := writer.Write([]byte("4.file,1.1,10.text/plain,5.a.txt;4.blob,1.1,8.YWJjZGU=;"))
+	if err == nil || asErrGuac(err).Status != ClientOverrun {
+		t.Fatalf("expected ClientOverrun, got %v", err)
+	}
+
+	// 3 + 3 + 3 bytes of clipboard exceeds the clipboard limit
+	_, err = writer.Write([]byte("9.clipboard,1.2,10.text/plain;4.blob,1.2,4.YWJj;4.blob,1.2,4.YWJj;4.blob,1.2,4.YWJj;"))
+	if err == nil || asErrGuac(err).Status != ClientOverrun {
+		t.Fatalf("expected ClientOverrun, got %v", err)
+	}
+}
+
+func TestDecodedLength(t *testing.T) {
+	for blob, want := range map[string]int{"": 0, "YQ==": 1, "YWI=": 2, "YWJj": 3, "YWJjZA==": 4} {
+		if got := decodedLength(blob); got != want {
+			t.Errorf("%q: got %v, want %v", blob, got, want)
+		}
+	}
+}
+
+func TestServer_ConnectAdvertisesLimits(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.StreamLimits = &StreamLimits{MaxBlobSize: 4096, MaxClipboardSize: 1 << 20}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil))
+
+	if got := recorder.Header().Get(MaxBlobSizeHeader); got != "4096" {
+		t.Errorf("%v = %q", MaxBlobSizeHeader, got)
+	}
+	if got := recorder.Header().Get(MaxClipboardSizeHeader); got != "1048576" {
+		t.Errorf("%v = %q", MaxClipboardSizeHeader, got)
+	}
+	if _, ok := server.tunnels.Get("1"); !ok {
+		t.Error("expected tunnel to be registered")
+	}
+}
+
+func TestInstructionLimits(t *testing.T) {
+	limits := &StreamLimits{Instructions: InstructionLimits{MaxLength: 32, MaxElements: 4}}
+	tunnel := limits.wrap(&fakeTunnel{writer: &bytes.Buffer{}}).(*FilteredTunnel)
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	if _, err := writer.Write([]byte("5.mouse,2.10,2.20,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+
+	// too many elements fails before the instruction is complete
+	_, err := writer.Write([]byte("5.mouse,2.10,2.20,1.0,1.0"))
+	if err == nil || asErrGuac(err).Status != ClientBadRequest {
+		t.Fatalf("expected ClientBadRequest, got %v", err)
+	}
+
+	// so does a declared element length which cannot fit
+	_, err = writer.Write([]byte("4.blob,1.0,99999999"))
+	if err == nil || asErrGuac(err).Status != ClientBadRequest {
+		t.Fatalf("expected ClientBadRequest, got %v", err)
+	}
+}
+
+func TestInstructionLimits_Default(t *testing.T) {
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: &bytes.Buffer{}})
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	_, err := writer.Write([]byte("4.blob,1.0,100000."))
+	if err == nil || asErrGuac(err).Status != ClientBadRequest {
+		t.Fatalf("expected ClientBadRequest, got %v", err)
+	}
+}
+
+func TestServer_InstructionLimits(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	written := &strings.Builder{}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: written}, uuid: tunnelUUID}, nil
+	})
+	// without StreamLimits the tunnel is not filtered, but the default limits still apply
+	server.ServeHTTP(httptest.NewRecorder(), connectRequest(""))
+
+	write := func(body string) int {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader(body)))
+		return recorder.Code
+	}
+	if code := write("4.sync,1.1;4.blob,1.0,"); code != http.StatusOK {
+		t.Fatal("Expected instructions within the limits to be written, got", code)
+	}
+	// the rest of the blob is checked with the start sent in the previous request
+	write("100000.")
+	if strings.Contains(written.String(), "100000.") {
+		t.Errorf("Expected the instruction exceeding the limits not to reach the tunnel, got %q", written.String())
+	}
+	if server.tunnels.Len() != 0 {
+		t.Error("Expected the tunnel to be closed once the limits are exceeded")
+	}
+}
+
+func TestStreamLimits_MaxMessageSize(t *testing.T) {
+	var limits *StreamLimits
+	if limits.maxMessageSize() != DefaultMaxInstructionLength*utf8.UTFMax {
+		t.Error("Expected websocket messages to be bounded without limits, got", limits.maxMessageSize())
+	}
+	limits = &StreamLimits{Instructions: InstructionLimits{MaxElements: 4}}
+	if limits.maxMessageSize() != DefaultMaxInstructionLength*utf8.UTFMax {
+		t.Error("Expected websocket messages to be bounded without a length limit, got", limits.maxMessageSize())
+	}
+}
+
+func TestStreamLimits_JSON(t *testing.T) {
+	var limits StreamLimits
+	data := `{"max_blob_size":1024,"max_clipboard_size":4096,"instructions":{"max_length":512,"max_elements":8}}`
+	if err := json.Unmarshal([]byte(data), &limits); err != nil {
+		t.Fatal(err)
+	}
+	want := StreamLimits{MaxBlobSize: 1024, MaxClipboardSize: 4096, Instructions: InstructionLimits{MaxLength: 512, MaxElements: 8}}
+	if limits != want {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+}
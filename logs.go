@@ -0,0 +1,366 @@
+package guac
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subsystems whose log level can be changed independently with SetLogLevel
+const (
+	// LogTransport covers moving data between clients and guacd, and connecting to guacd
+	LogTransport = "transport"
+	// LogHandshake covers the Guacamole protocol handshake
+	LogHandshake = "handshake"
+	// LogFilters covers instruction filters and the stream handling built on them
+	LogFilters = "filters"
+	// LogRegistry covers tracking tunnels, their expiry and shutdown
+	LogRegistry = "registry"
+	// LogGuacd covers the log and error instructions guacd sends about tunnels, when a Server
+	// has GuacdLogs set
+	LogGuacd = "guacd"
+
+	// LogDefault names the level of the standard logrus logger, which subsystems without a
+	// level of their own follow
+	LogDefault = "default"
+)
+
+var (
+	transportLog = newSubsystemLogger(LogTransport)
+	handshakeLog = newSubsystemLogger(LogHandshake)
+	filtersLog   = newSubsystemLogger(LogFilters)
+	registryLog  = newSubsystemLogger(LogRegistry)
+	guacdLog     = newSubsystemLogger(LogGuacd)
+
+	subsystemLoggers = map[string]*subsystemLogger{
+		LogTransport: transportLog,
+		LogHandshake: handshakeLog,
+		LogFilters:   filtersLog,
+		LogRegistry:  registryLog,
+		LogGuacd:     guacdLog,
+	}
+)
+
+// Level is the severity of a log message
+type Level uint32
+
+// Levels of log messages, from the most to the least severe
+const (
+	LevelError = Level(logrus.ErrorLevel)
+	LevelWarn  = Level(logrus.WarnLevel)
+	LevelInfo  = Level(logrus.InfoLevel)
+	LevelDebug = Level(logrus.DebugLevel)
+	LevelTrace = Level(logrus.TraceLevel)
+)
+
+// String returns the name of the level, such as "warning"
+func (l Level) String() string {
+	return logrus.Level(l).String()
+}
+
+// LogFields are the structured fields of a log message
+type LogFields map[string]interface{}
+
+// Logger receives the package's log messages in place of the standard logrus logger, so
+// embedders using zap, slog or the like can send them to the logging stack they already have.
+// Messages carry their subsystem in the "subsystem" field, and messages about a tunnel its
+// UUID in "tunnel" and the ID of its connection in "connection_id".
+type Logger interface {
+	// Enabled returns true if messages of the given level are wanted. The levels set for
+	// subsystems with SetLogLevel take precedence.
+	Enabled(level Level) bool
+	// Log handles a message
+	Log(level Level, message string, fields LogFields)
+}
+
+// packageLogger is the Logger set with SetLogger, if any
+var packageLogger atomic.Pointer[Logger]
+
+// SetLogger sends the package's log messages to logger, or back to the standard logrus logger
+// if nil. Servers with a Logger of their own send the messages about their requests and
+// tunnels to it instead.
+func SetLogger(logger Logger) {
+	if logger == nil {
+		packageLogger.Store(nil)
+		return
+	}
+	packageLogger.Store(&logger)
+}
+
+// SetLogLevel changes the level of a subsystem at runtime, or of the standard logrus logger
+// for LogDefault. An empty level makes the subsystem follow the standard logger again.
+func SetLogLevel(subsystem, level string) error {
+	if subsystem == LogDefault {
+		parsed, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(parsed)
+		return nil
+	}
+
+	logger, ok := subsystemLoggers[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem %q", subsystem)
+	}
+	if level == "" {
+		logger.override.Store(levelInherit)
+		return nil
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.override.Store(int32(parsed))
+	return nil
+}
+
+// LogLevels returns the level of LogDefault and every subsystem with a level of its own
+func LogLevels() map[string]string {
+	levels := map[string]string{
+		LogDefault: logrus.GetLevel().String(),
+	}
+	for name, logger := range subsystemLoggers {
+		if override := logger.override.Load(); override != levelInherit {
+			levels[name] = logrus.Level(override).String()
+		}
+	}
+	return levels
+}
+
+// LogLevelServer is an admin endpoint reporting log levels on GET and changing them on PUT or
+// POST, given a JSON object mapping subsystems to levels:
+//
+//	curl -X PUT -d '{"transport": "trace", "filters": ""}' http://localhost:4567/admin/log
+type LogLevelServer struct {
+	// Authorizer authenticates requests, which are all refused without one
+	Authorizer Authorizer
+}
+
+func (s *LogLevelServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := authorizeAdmin(s.Authorizer, r); err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var levels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// apply subsystems in a stable order so a failure leaves a predictable state
+		names := make([]string, 0, len(levels))
+		for name := range levels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := SetLogLevel(name, levels[name]); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			registryLog.Infof("Log level of %v set to %q.", name, levels[name])
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(LogLevels())
+}
+
+// levelInherit marks a subsystem following the level of the standard logger
+const levelInherit = -1
+
+// subsystemLogger logs through the package's Logger, or the standard logrus logger if there
+// is none, tagging entries with the subsystem, at a level which may differ from the standard
+// logger's
+type subsystemLogger struct {
+	name     string
+	override atomic.Int32
+	entry    *logrus.Entry
+
+	// root is the logger of the subsystem whose level is followed, itself unless made by with
+	root *subsystemLogger
+	// logger optionally replaces the package's Logger, and fields are added to every message
+	logger Logger
+	fields LogFields
+}
+
+func newSubsystemLogger(name string) *subsystemLogger {
+	l := &subsystemLogger{
+		name:  name,
+		entry: logrus.NewEntry(forwardingLogger).WithField("subsystem", name),
+	}
+	l.root = l
+	l.override.Store(levelInherit)
+	return l
+}
+
+// with returns a logger for the same subsystem which logs to logger, if not nil, adding the
+// given fields to every message
+func (l *subsystemLogger) with(logger Logger, fields LogFields) *subsystemLogger {
+	if logger == nil && len(fields) == 0 {
+		return l
+	}
+	if logger == nil {
+		logger = l.logger
+	}
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for name, value := range l.fields {
+		merged[name] = value
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return &subsystemLogger{
+		name:   l.name,
+		entry:  l.entry.WithFields(logrus.Fields(fields)),
+		root:   l.root,
+		logger: logger,
+		fields: merged,
+	}
+}
+
+// output returns the Logger messages go to, nil for the standard logrus logger
+func (l *subsystemLogger) output() Logger {
+	if l.logger != nil {
+		return l.logger
+	}
+	if logger := packageLogger.Load(); logger != nil {
+		return *logger
+	}
+	return nil
+}
+
+func (l *subsystemLogger) enabled(level logrus.Level) bool {
+	if override := l.root.override.Load(); override != levelInherit {
+		return level <= logrus.Level(override)
+	}
+	if logger := l.output(); logger != nil {
+		return logger.Enabled(Level(level))
+	}
+	return logrus.IsLevelEnabled(level)
+}
+
+// emit sends an enabled message to the output
+func (l *subsystemLogger) emit(level logrus.Level, message string) {
+	logger := l.output()
+	if logger == nil {
+		l.entry.Log(level, message)
+		return
+	}
+	fields := make(LogFields, len(l.fields)+1)
+	for name, value := range l.fields {
+		fields[name] = value
+	}
+	fields["subsystem"] = l.name
+	logger.Log(Level(level), message, fields)
+}
+
+func (l *subsystemLogger) log(level logrus.Level, args ...interface{}) {
+	if l.enabled(level) {
+		l.emit(level, fmt.Sprint(args...))
+	}
+}
+
+func (l *subsystemLogger) logf(level logrus.Level, format string, args ...interface{}) {
+	if l.enabled(level) {
+		l.emit(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *subsystemLogger) logln(level logrus.Level, args ...interface{}) {
+	if l.enabled(level) {
+		l.emit(level, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+	}
+}
+
+// tunnelLogFields returns the fields identifying tunnel in log messages, none if it is nil
+func tunnelLogFields(tunnel Tunnel) LogFields {
+	if tunnel == nil {
+		return nil
+	}
+	return LogFields{"tunnel": tunnel.GetUUID(), "connection_id": tunnel.ConnectionID()}
+}
+
+func (l *subsystemLogger) Trace(args ...interface{})   { l.log(logrus.TraceLevel, args...) }
+func (l *subsystemLogger) Traceln(args ...interface{}) { l.logln(logrus.TraceLevel, args...) }
+func (l *subsystemLogger) Debug(args ...interface{})   { l.log(logrus.DebugLevel, args...) }
+func (l *subsystemLogger) Debugln(args ...interface{}) { l.logln(logrus.DebugLevel, args...) }
+func (l *subsystemLogger) Info(args ...interface{})    { l.log(logrus.InfoLevel, args...) }
+func (l *subsystemLogger) Warn(args ...interface{})    { l.log(logrus.WarnLevel, args...) }
+func (l *subsystemLogger) Error(args ...interface{})   { l.log(logrus.ErrorLevel, args...) }
+
+func (l *subsystemLogger) Tracef(format string, args ...interface{}) {
+	l.logf(logrus.TraceLevel, format, args...)
+}
+
+func (l *subsystemLogger) Debugf(format string, args ...interface{}) {
+	l.logf(logrus.DebugLevel, format, args...)
+}
+
+func (l *subsystemLogger) Infof(format string, args ...interface{}) {
+	l.logf(logrus.InfoLevel, format, args...)
+}
+
+func (l *subsystemLogger) Warnf(format string, args ...interface{}) {
+	l.logf(logrus.WarnLevel, format, args...)
+}
+
+func (l *subsystemLogger) Errorf(format string, args ...interface{}) {
+	l.logf(logrus.ErrorLevel, format, args...)
+}
+
+// forwardingLogger accepts every level, leaving the decision to subsystemLogger, and hands
+// entries to the output, formatter and hooks of the standard logger as configured at the time
+var forwardingLogger = &logrus.Logger{
+	Out:       standardOutput{},
+	Formatter: standardFormatter{},
+	Hooks:     logrus.LevelHooks{},
+	Level:     logrus.TraceLevel,
+	ExitFunc:  os.Exit,
+}
+
+func init() {
+	forwardingLogger.AddHook(standardHooks{})
+}
+
+type standardOutput struct{}
+
+func (standardOutput) Write(p []byte) (int, error) {
+	return logrus.StandardLogger().Out.Write(p)
+}
+
+type standardFormatter struct{}
+
+func (standardFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return logrus.StandardLogger().Formatter.Format(entry)
+}
+
+type standardHooks struct{}
+
+func (standardHooks) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (standardHooks) Fire(entry *logrus.Entry) error {
+	for _, hook := range logrus.StandardLogger().Hooks[entry.Level] {
+		if err := hook.Fire(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package guac
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSubsystemLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	std := logrus.StandardLogger()
+	oldOut, oldLevel := std.Out, std.Level
+	std.SetOutput(out)
+	std.SetLevel(logrus.InfoLevel)
+	defer func() {
+		std.SetOutput(oldOut)
+		std.SetLevel(oldLevel)
+		_ = SetLogLevel(LogFilters, "")
+	}()
+
+	filtersLog.Debug("hidden")
+	if out.Len() != 0 {
+		t.Error("Expected debug to follow the standard level:", out.String())
+	}
+
+	if err := SetLogLevel(LogFilters, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	filtersLog.Debug("shown")
+	registryLog.Debug("hidden")
+	if !strings.Contains(out.String(), "shown") || !strings.Contains(out.String(), "subsystem=filters") {
+		t.Error("Expected filters debug output:", out.String())
+	}
+	if strings.Contains(out.String(), "hidden") {
+		t.Error("Unexpected registry debug output:", out.String())
+	}
+
+	if err := SetLogLevel("nope", "debug"); err == nil {
+		t.Error("Expected unknown subsystem error")
+	}
+}
+
+func TestLogLevelServer(t *testing.T) {
+	defer func() {
+		_ = SetLogLevel(LogTransport, "")
+	}()
+	server := &LogLevelServer{}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"transport": "trace"}`)))
+	if recorder.Code != http.StatusForbidden {
+		t.Error("Expected a server without an Authorizer to refuse, got", recorder.Code)
+	}
+
+	server.Authorizer = adminAuthorizer
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"transport": "trace"}`)))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"transport":"trace"`) {
+		t.Error("Unexpected response", recorder.Code, recorder.Body.String())
+	}
+	if !transportLog.enabled(logrus.TraceLevel) {
+		t.Error("Expected transport trace to be enabled")
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"transport": "loud"}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Expected bad request, got", recorder.Code)
+	}
+}
+
+// adminAuthorizer authenticates every request as an admin
+var adminAuthorizer = AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+	return &Identity{Subject: "admin"}, nil
+})
+
+// recordingLogger keeps the messages it is given
+type recordingLogger struct {
+	sync.Mutex
+	level    Level
+	messages []string
+	fields   []LogFields
+}
+
+func (l *recordingLogger) Enabled(level Level) bool {
+	return level <= l.level
+}
+
+func (l *recordingLogger) Log(level Level, message string, fields LogFields) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, level.String()+": "+message)
+	l.fields = append(l.fields, fields)
+}
+
+func TestSetLogger(t *testing.T) {
+	logger := &recordingLogger{level: LevelInfo}
+	SetLogger(logger)
+	defer SetLogger(nil)
+
+	registryLog.Debug("hidden")
+	registryLog.Infof("shown %v", 1)
+	if len(logger.messages) != 1 || logger.messages[0] != "info: shown 1" || logger.fields[0]["subsystem"] != LogRegistry {
+		t.Fatal("Unexpected messages", logger.messages, logger.fields)
+	}
+
+	// levels set for subsystems still take precedence
+	if err := SetLogLevel(LogRegistry, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = SetLogLevel(LogRegistry, "")
+	}()
+	registryLog.with(nil, LogFields{"tunnel": "1"}).Debugln("now", "shown")
+	if len(logger.messages) != 2 || logger.messages[1] != "debug: now shown" || logger.fields[1]["tunnel"] != "1" {
+		t.Error("Unexpected messages", logger.messages, logger.fields)
+	}
+}
+
+func TestServer_Logger(t *testing.T) {
+	logger := &recordingLogger{level: LevelDebug}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{uuid: "tunnel-1"}, nil
+	})
+	server.Logger = logger
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?connect", strings.NewReader("")))
+
+	logger.Lock()
+	defer logger.Unlock()
+	for i, message := range logger.messages {
+		if strings.Contains(message, "Registered tunnel") {
+			if logger.fields[i]["tunnel"] != "tunnel-1" || logger.fields[i]["connection_id"] != "asdf" {
+				t.Error("Expected the tunnel's fields, got", logger.fields[i])
+			}
+			return
+		}
+	}
+	t.Error("Expected the registration to be logged, got", logger.messages)
+}
+
+func TestServer_LoggerRefusals(t *testing.T) {
+	logger := &recordingLogger{level: LevelDebug}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{uuid: uuid.NewString()}, nil
+	})
+	server.Logger = logger
+	server.IPFilter, _ = NewIPFilter(nil, []string{"192.0.2.0/24"})
+	server.Quota = &SessionQuota{Max: 1, Key: func(*http.Request, *Identity) string { return "everyone" }}
+
+	for _, address := range []string{"192.0.2.10:1234", "198.51.100.1:1234", "198.51.100.1:1234"} {
+		request := connectRequest("")
+		request.RemoteAddr = address
+		server.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	logged := strings.Join(logger.messages, "\n")
+	if !strings.Contains(logged, "Refused http request from 192.0.2.10") || !strings.Contains(logged, "everyone holds 1 tunnels") {
+		t.Error("Expected refusals to be logged to the server's logger, got", logger.messages)
+	}
+}
@@ -0,0 +1,134 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// MsgMaintenance is the msg code of maintenance banners. Its argument is the banner's message,
+// empty when the banner is removed. Guacamole's own codes are below 0x0100.
+const MsgMaintenance = 0x0100
+
+// Maintenance overlays a banner, for example announcing upcoming maintenance, on every session
+// of the servers it is set on without interrupting them. Clients speaking protocol 1.5.0 or
+// later are sent the banner with a msg instruction for the application to display; older
+// clients, which ignore msg, have it drawn on a layer above the display. As an http.Handler it
+// is the admin API for the banner:
+//
+//	GET /admin/maintenance
+//	PUT /admin/maintenance {"banner": "Maintenance at 18:00 UTC"}
+//	DELETE /admin/maintenance
+type Maintenance struct {
+	// Authorizer authenticates admin requests, which are all refused without one
+	Authorizer Authorizer
+
+	banner atomic.Pointer[maintenanceBanner]
+}
+
+type maintenanceBanner struct {
+	message string
+	// version increases with each change, so sessions can tell they are out of date
+	version int64
+}
+
+// SetBanner shows message in every session, replacing any banner already shown. An empty
+// message removes the banner.
+func (m *Maintenance) SetBanner(message string) {
+	for {
+		current := m.banner.Load()
+		next := &maintenanceBanner{message: message, version: 1}
+		if current != nil {
+			next.version = current.version + 1
+		}
+		if m.banner.CompareAndSwap(current, next) {
+			registryLog.Infof("Maintenance banner set to %q.", message)
+			return
+		}
+	}
+}
+
+// Banner returns the banner shown in every session, empty if none
+func (m *Maintenance) Banner() string {
+	if banner := m.banner.Load(); banner != nil {
+		return banner.message
+	}
+	return ""
+}
+
+// reader returns a reader sending the banner ahead of guacd's next instruction whenever it
+// has changed since version, which records what the tunnel was last sent. The banner is
+// drawn rather than sent with msg if draw is set.
+func (m *Maintenance) reader(guacd InstructionReader, version *int64, draw bool) InstructionReader {
+	return &maintenanceReader{InstructionReader: guacd, maintenance: m, version: version, draw: draw}
+}
+
+type maintenanceReader struct {
+	InstructionReader
+	maintenance *Maintenance
+	version     *int64
+	draw        bool
+}
+
+func (r *maintenanceReader) ReadSome() ([]byte, error) {
+	banner := r.maintenance.banner.Load()
+	if banner == nil || banner.version == *r.version {
+		return r.InstructionReader.ReadSome()
+	}
+	// a session opened after a banner was removed has nothing to remove
+	first := *r.version == 0
+	*r.version = banner.version
+	if first && banner.message == "" {
+		return r.InstructionReader.ReadSome()
+	}
+
+	instructions := []*Instruction{(&Msg{Code: MsgMaintenance, Args: []string{banner.message}}).Instruction()}
+	if r.draw {
+		instructions = drawBanner(banner.message)
+	}
+	out := &bytes.Buffer{}
+	for _, instruction := range instructions {
+		out.Write(instruction.Byte())
+	}
+	return out.Bytes(), nil
+}
+
+// speaksMsg returns true unless the tunnel's connection to guacd is known to use a protocol
+// version older than msg
+func speaksMsg(tunnel Tunnel) bool {
+	stream := streamOf(tunnel)
+	return stream == nil || compareProtocolVersions(stream.ProtocolVersion, msgVersion) >= 0
+}
+
+type maintenanceState struct {
+	Banner string `json:"banner"`
+}
+
+func (m *Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := authorizeAdmin(m.Authorizer, r); err != nil {
+		guacErr := asErrGuac(err)
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		state := &maintenanceState{}
+		if err := json.NewDecoder(r.Body).Decode(state); err != nil {
+			http.Error(w, "Invalid maintenance state.", http.StatusBadRequest)
+			return
+		}
+		m.SetBanner(state.Banner)
+	case http.MethodDelete:
+		m.SetBanner("")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&maintenanceState{Banner: m.Banner()})
+}
@@ -0,0 +1,82 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func maintenanceRead(t *testing.T, maintenance *Maintenance, version string) string {
+	stream := NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;10.disconnect;")}, time.Minute)
+	stream.ProtocolVersion = version
+	tunnel := NewSimpleTunnel(stream)
+	server := NewServer(nil)
+	server.Maintenance = maintenance
+	server.registerTunnel(tunnel, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":0", nil))
+	return recorder.Body.String()
+}
+
+func TestMaintenance_Msg(t *testing.T) {
+	maintenance := &Maintenance{}
+	if got := maintenanceRead(t, maintenance, ProtocolVersion); got != "4.sync,1.1;10.disconnect;0.;" {
+		t.Errorf("Expected no banner, got %q", got)
+	}
+
+	maintenance.SetBanner("Maintenance at 18:00")
+	if got := maintenanceRead(t, maintenance, ProtocolVersion); got != "3.msg,3.256,20.Maintenance at 18:00;4.sync,1.1;10.disconnect;0.;" {
+		t.Errorf("Expected banner before guacd's instructions, got %q", got)
+	}
+
+	// sessions which never saw the banner have nothing to remove
+	maintenance.SetBanner("")
+	if got := maintenanceRead(t, maintenance, ProtocolVersion); got != "4.sync,1.1;10.disconnect;0.;" {
+		t.Errorf("Expected no banner, got %q", got)
+	}
+}
+
+func TestMaintenance_Drawn(t *testing.T) {
+	maintenance := &Maintenance{}
+	maintenance.SetBanner("Back soon!")
+	got := maintenanceRead(t, maintenance, "VERSION_1_3_0")
+	for _, want := range []string{"4.size,5.32767,3.132,2.26;", "4.move,5.32767,1.0,1.0,1.0,5.32767;", "3.img,5.32767,2.12,5.32767,9.image/png,1.0,1.0;", "3.end,5.32767;4.sync,1.1;"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in %q", want, got)
+		}
+	}
+
+	version := int64(1)
+	reader := maintenance.reader(NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;")}, time.Minute), &version, true)
+	maintenance.SetBanner("")
+	if ins, _ := reader.ReadSome(); string(ins) != "7.dispose,5.32767;" {
+		t.Errorf("Expected banner layer to be disposed, got %q", ins)
+	}
+}
+
+func TestMaintenance_ServeHTTP(t *testing.T) {
+	maintenance := &Maintenance{}
+	recorder := httptest.NewRecorder()
+	maintenance.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/admin/maintenance", strings.NewReader(`{"banner": "Hacked"}`)))
+	if recorder.Code != http.StatusForbidden || maintenance.Banner() != "" {
+		t.Error("Expected a banner without an Authorizer to be refused, got", recorder.Code)
+	}
+
+	maintenance.Authorizer = adminAuthorizer
+	for _, test := range []struct {
+		method, body, want string
+	}{
+		{http.MethodPut, `{"banner": "Maintenance tonight"}`, `{"banner":"Maintenance tonight"}`},
+		{http.MethodGet, "", `{"banner":"Maintenance tonight"}`},
+		{http.MethodDelete, "", `{"banner":""}`},
+	} {
+		recorder := httptest.NewRecorder()
+		maintenance.ServeHTTP(recorder, httptest.NewRequest(test.method, "/admin/maintenance", strings.NewReader(test.body)))
+		if got := strings.TrimSpace(recorder.Body.String()); got != test.want {
+			t.Errorf("%v: expected %v, got %v", test.method, test.want, got)
+		}
+	}
+}
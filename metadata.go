@@ -0,0 +1,88 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Metadata holds values an application attaches to a tunnel, such as the user ID, connection
+// name or tenant it belongs to, so they can be looked up by the tunnel's UUID later instead of
+// keeping a map of tunnels alongside the server. Values keep their type, so callers assert
+// them back as with context values. Metadata is safe for concurrent use.
+type Metadata struct {
+	sync.RWMutex
+	values map[string]interface{}
+}
+
+// Get returns the value stored under key
+func (m *Metadata) Get(key string) (interface{}, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	value, ok := m.values[key]
+	return value, ok
+}
+
+// String returns the value stored under key if it is a string, or the empty string
+func (m *Metadata) String(key string) string {
+	value, _ := m.Get(key)
+	s, _ := value.(string)
+	return s
+}
+
+// Set stores value under key, replacing any previous value
+func (m *Metadata) Set(key string, value interface{}) {
+	m.Lock()
+	defer m.Unlock()
+	if m.values == nil {
+		m.values = map[string]interface{}{}
+	}
+	m.values[key] = value
+}
+
+// Delete removes the value stored under key
+func (m *Metadata) Delete(key string) {
+	m.Lock()
+	delete(m.values, key)
+	m.Unlock()
+}
+
+// Keys returns the keys which have values, sorted
+func (m *Metadata) Keys() []string {
+	m.RLock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	m.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+type metadataKey struct{}
+
+// withMetadata returns a copy of the request carrying new, empty metadata for its tunnel
+func withMetadata(r *http.Request) (*http.Request, *Metadata) {
+	metadata := &Metadata{}
+	return r.WithContext(context.WithValue(r.Context(), metadataKey{}, metadata)), metadata
+}
+
+// MetadataFromRequest returns the metadata of the tunnel a connect request creates, so the
+// connect callback can attach values to it. It returns nil for requests not made through a
+// Server or WebsocketServer.
+func MetadataFromRequest(r *http.Request) *Metadata {
+	metadata, _ := r.Context().Value(metadataKey{}).(*Metadata)
+	return metadata
+}
+
+// MarshalJSON encodes the metadata as an object of its values
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	if m.values == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(m.values)
+}
@@ -0,0 +1,53 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	metadata := &Metadata{}
+	if _, ok := metadata.Get("tenant"); ok {
+		t.Error("Expected empty metadata")
+	}
+	metadata.Set("tenant", "acme")
+	metadata.Set("user", 42)
+	if got := metadata.String("tenant"); got != "acme" {
+		t.Errorf("Expected tenant, got %q", got)
+	}
+	if got, _ := metadata.Get("user"); got != 42 {
+		t.Errorf("Expected typed value, got %v", got)
+	}
+	if got := metadata.String("user"); got != "" {
+		t.Errorf("Expected no string for an int, got %q", got)
+	}
+	metadata.Delete("user")
+	if keys := metadata.Keys(); !reflect.DeepEqual(keys, []string{"tenant"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+}
+
+func TestServer_Metadata(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		MetadataFromRequest(r).Set("tenant", "acme")
+		return &fakeTunnel{}, nil
+	})
+	var connected *TunnelInfo
+	server.OnConnect = func(info *TunnelInfo) {
+		connected = info
+	}
+
+	server.ServeHTTP(httptest.NewRecorder(), connectRequest(""))
+	if connected == nil || connected.Metadata.String("tenant") != "acme" {
+		t.Fatalf("Expected metadata in OnConnect, got %+v", connected)
+	}
+	metadata, ok := server.TunnelMetadata("1")
+	if !ok || metadata != connected.Metadata {
+		t.Error("Expected metadata to be found by UUID")
+	}
+	if _, ok = server.TunnelMetadata("2"); ok {
+		t.Error("Expected no metadata for an unknown tunnel")
+	}
+}
@@ -0,0 +1,110 @@
+package guac
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics receives measurements of tunnels and the connections to guacd behind them. It is set
+// on the servers and backends to measure, and implemented with Prometheus collectors by the
+// metrics package, which keeps Prometheus out of the dependencies of this one:
+//
+//	m, err := metrics.New(prometheus.DefaultRegisterer)
+//	server.Metrics = m
+//	backend.Metrics = m
+//
+// "In" is what clients sent to guacd and "out" what guacd sent to clients.
+type Metrics interface {
+	// TunnelOpened and TunnelClosed are called as tunnels are opened and closed
+	TunnelOpened()
+	TunnelClosed()
+	// Connected is called with each tunnel connected
+	Connected()
+	// ConnectFailed is called with the status of each connect request which failed
+	ConnectFailed(status Status)
+	// DialFailed is called with the address of guacd for each failed attempt to connect to it
+	DialFailed(address string)
+	// BackendChecked is called after each health check of a backend of a BackendSet, with
+	// the address of its guacd and whether it is in rotation
+	BackendChecked(address string, healthy bool)
+	// ReadOut is called with each read from guacd, with the bytes and complete instructions
+	// read and how long the read waited for them
+	ReadOut(bytes, instructions int, wait time.Duration)
+	// WrittenIn is called with each write to guacd, with the bytes and complete instructions
+	// written and how long the write took
+	WrittenIn(bytes, instructions int, took time.Duration)
+	// ReadFirstByte is called with the time from each HTTP tunnel read request arriving to its
+	// first bytes being flushed
+	ReadFirstByte(d time.Duration)
+	// WriteCopied is called with the time taken copying the body of each HTTP tunnel write
+	// request to guacd
+	WriteCopied(d time.Duration)
+}
+
+// connectedTunnel records a tunnel connecting, returning it wrapped to measure its traffic
+func connectedTunnel(metrics Metrics, tunnel Tunnel) Tunnel {
+	metrics.Connected()
+	return newMeteredTunnel(tunnel, metrics)
+}
+
+// connectFailed records a connect request failing with err
+func connectFailed(metrics Metrics, err error) {
+	metrics.ConnectFailed(asErrGuac(err).Status)
+}
+
+// meteredTunnel measures the traffic of the tunnel it wraps
+type meteredTunnel struct {
+	*DelegatingTunnel
+	metrics Metrics
+}
+
+func newMeteredTunnel(tunnel Tunnel, metrics Metrics) *meteredTunnel {
+	t := &meteredTunnel{DelegatingTunnel: NewDelegatingTunnel(tunnel), metrics: metrics}
+	t.WrapReader = func(reader InstructionReader) InstructionReader {
+		return &meteredReader{InstructionReader: reader, metrics: metrics}
+	}
+	t.WrapWriter = func(writer io.Writer) io.Writer {
+		return meteredWriter{writer: writer, metrics: metrics}
+	}
+	return t
+}
+
+// meteredReader measures the instructions read from guacd
+type meteredReader struct {
+	InstructionReader
+	metrics Metrics
+}
+
+func (r *meteredReader) ReadSome() ([]byte, error) {
+	start := time.Now()
+	data, err := r.InstructionReader.ReadSome()
+	r.metrics.ReadOut(len(data), countInstructions(data), time.Since(start))
+	return data, err
+}
+
+// meteredWriter measures the instructions written to guacd
+type meteredWriter struct {
+	writer  io.Writer
+	metrics Metrics
+}
+
+func (w meteredWriter) Write(data []byte) (int, error) {
+	start := time.Now()
+	n, err := w.writer.Write(data)
+	w.metrics.WrittenIn(n, countInstructions(data[:n]), time.Since(start))
+	return n, err
+}
+
+// countInstructions returns the number of complete instructions in data
+func countInstructions(data []byte) int {
+	count := 0
+	for len(data) > 0 {
+		end, err := instructionEnd(data, InstructionLimits{})
+		if err != nil || end <= 0 {
+			break
+		}
+		count++
+		data = data[end:]
+	}
+	return count
+}
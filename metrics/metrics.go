@@ -0,0 +1,175 @@
+// Package metrics collects Prometheus metrics about the tunnels of guac servers and the
+// connections to guacd behind them.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wwt/guac"
+)
+
+// namespace prefixes the names of the metrics of the package
+const namespace = "guac"
+
+// Metrics is the guac.Metrics of Prometheus collectors. It is created for a
+// prometheus.Registerer and set on the servers and backends to measure:
+//
+//	m, err := metrics.New(prometheus.DefaultRegisterer)
+//	server.Metrics = m
+//	backend.Metrics = m
+//
+// Connects per second and instruction rates are the rate() of the counters. "In" counts what
+// clients sent to guacd and "out" what guacd sent to clients.
+type Metrics struct {
+	activeTunnels   prometheus.Gauge
+	connects        prometheus.Counter
+	connectFailures *prometheus.CounterVec
+	bytes           *prometheus.CounterVec
+	instructions    *prometheus.CounterVec
+	readLatency     prometheus.Histogram
+	writeLatency    prometheus.Histogram
+	dialErrors      *prometheus.CounterVec
+	backendHealthy  *prometheus.GaugeVec
+	readFirstByte   prometheus.Histogram
+	writeCopy       prometheus.Histogram
+}
+
+var _ guac.Metrics = (*Metrics)(nil)
+
+// New creates the metrics and registers them on registerer
+func New(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		activeTunnels: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_tunnels",
+			Help:      "Number of tunnels open.",
+		}),
+		connects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connects_total",
+			Help:      "Number of tunnels connected.",
+		}),
+		connectFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connect_failures_total",
+			Help:      "Number of connect requests which failed, by Guacamole status code.",
+		}, []string{"status"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Bytes of instructions carried by tunnels, by direction.",
+		}, []string{"direction"}),
+		instructions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "instructions_total",
+			Help:      "Instructions carried by tunnels, by direction.",
+		}, []string{"direction"}),
+		readLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "guacd_read_seconds",
+			Help:      "Time reads from guacd waited for an instruction.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}),
+		writeLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "guacd_write_seconds",
+			Help:      "Time writes to guacd took.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "guacd_dial_errors_total",
+			Help:      "Number of failed attempts to connect to guacd, by backend address.",
+		}, []string{"backend"}),
+		backendHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backend_healthy",
+			Help:      "Whether each guacd backend passed its last health check and is in rotation, by backend address.",
+		}, []string{"backend"}),
+		readFirstByte: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "read_first_byte_seconds",
+			Help:      "Time from an HTTP tunnel read request arriving to its first bytes being flushed.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		writeCopy: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "write_copy_seconds",
+			Help:      "Time taken copying the body of an HTTP tunnel write request to guacd.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+	}
+	for _, collector := range []prometheus.Collector{
+		m.activeTunnels, m.connects, m.connectFailures, m.bytes, m.instructions,
+		m.readLatency, m.writeLatency, m.dialErrors, m.backendHealthy, m.readFirstByte, m.writeCopy,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// TunnelOpened counts a tunnel as open
+func (m *Metrics) TunnelOpened() {
+	m.activeTunnels.Inc()
+}
+
+// TunnelClosed stops counting a tunnel as open
+func (m *Metrics) TunnelClosed() {
+	m.activeTunnels.Dec()
+}
+
+// Connected counts a tunnel connecting
+func (m *Metrics) Connected() {
+	m.connects.Inc()
+}
+
+// ConnectFailed counts a connect request failing with status
+func (m *Metrics) ConnectFailed(status guac.Status) {
+	m.connectFailures.WithLabelValues(strconv.Itoa(status.GetGuacamoleStatusCode())).Inc()
+}
+
+// DialFailed counts a failed attempt to connect to the guacd at address
+func (m *Metrics) DialFailed(address string) {
+	m.dialErrors.WithLabelValues(address).Inc()
+}
+
+// BackendChecked records whether the guacd at address is in rotation
+func (m *Metrics) BackendChecked(address string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	m.backendHealthy.WithLabelValues(address).Set(value)
+}
+
+// ReadOut measures a read from guacd
+func (m *Metrics) ReadOut(bytes, instructions int, wait time.Duration) {
+	m.readLatency.Observe(wait.Seconds())
+	if bytes > 0 {
+		m.bytes.WithLabelValues("out").Add(float64(bytes))
+		m.instructions.WithLabelValues("out").Add(float64(instructions))
+	}
+}
+
+// WrittenIn measures a write to guacd
+func (m *Metrics) WrittenIn(bytes, instructions int, took time.Duration) {
+	m.writeLatency.Observe(took.Seconds())
+	if bytes > 0 {
+		m.bytes.WithLabelValues("in").Add(float64(bytes))
+		m.instructions.WithLabelValues("in").Add(float64(instructions))
+	}
+}
+
+// ReadFirstByte measures the time to the first bytes of an HTTP tunnel read request
+func (m *Metrics) ReadFirstByte(d time.Duration) {
+	m.readFirstByte.Observe(d.Seconds())
+}
+
+// WriteCopied measures the time copying the body of an HTTP tunnel write request
+func (m *Metrics) WriteCopied(d time.Duration) {
+	m.writeCopy.Observe(d.Seconds())
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wwt/guac"
+)
+
+// gathered returns the value of the metric with the given name and labels, summing the
+// samples of a histogram
+func gathered(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				return metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := New(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(registry); err == nil {
+		t.Error("Expected registering twice to fail")
+	}
+
+	m.TunnelOpened()
+	m.TunnelOpened()
+	m.TunnelClosed()
+	m.Connected()
+	m.ConnectFailed(guac.FromGuacamoleStatusCode(516))
+	m.DialFailed("guacd:4822")
+	m.BackendChecked("guacd-1:4822", true)
+	m.BackendChecked("guacd-2:4822", false)
+	m.ReadOut(22, 2, time.Millisecond)
+	m.WrittenIn(15, 1, time.Millisecond)
+	m.ReadFirstByte(time.Millisecond)
+	m.WriteCopied(time.Millisecond)
+
+	for _, test := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"guac_active_tunnels", nil, 1},
+		{"guac_connects_total", nil, 1},
+		{"guac_connect_failures_total", map[string]string{"status": "516"}, 1},
+		{"guac_guacd_dial_errors_total", map[string]string{"backend": "guacd:4822"}, 1},
+		{"guac_backend_healthy", map[string]string{"backend": "guacd-1:4822"}, 1},
+		{"guac_backend_healthy", map[string]string{"backend": "guacd-2:4822"}, 0},
+		{"guac_bytes_total", map[string]string{"direction": "out"}, 22},
+		{"guac_instructions_total", map[string]string{"direction": "out"}, 2},
+		{"guac_bytes_total", map[string]string{"direction": "in"}, 15},
+		{"guac_instructions_total", map[string]string{"direction": "in"}, 1},
+		{"guac_guacd_read_seconds", nil, 1},
+		{"guac_guacd_write_seconds", nil, 1},
+		{"guac_read_first_byte_seconds", nil, 1},
+		{"guac_write_copy_seconds", nil, 1},
+	} {
+		if got := gathered(t, registry, test.name, test.labels); got != test.want {
+			t.Errorf("Expected %v%v to be %v, got %v", test.name, test.labels, test.want, got)
+		}
+	}
+}
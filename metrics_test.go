@@ -0,0 +1,162 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedMetrics records what it measures
+type recordedMetrics struct {
+	sync.Mutex
+	open, connects            int
+	failures                  []Status
+	dialFailures              []string
+	checks                    map[string]bool
+	bytesOut, instructionsOut int
+	bytesIn, instructionsIn   int
+	reads, writes, firstBytes int
+	copies                    int
+}
+
+func (m *recordedMetrics) TunnelOpened() {
+	m.Lock()
+	defer m.Unlock()
+	m.open++
+}
+
+func (m *recordedMetrics) TunnelClosed() {
+	m.Lock()
+	defer m.Unlock()
+	m.open--
+}
+
+func (m *recordedMetrics) Connected() {
+	m.Lock()
+	defer m.Unlock()
+	m.connects++
+}
+
+func (m *recordedMetrics) ConnectFailed(status Status) {
+	m.Lock()
+	defer m.Unlock()
+	m.failures = append(m.failures, status)
+}
+
+func (m *recordedMetrics) DialFailed(address string) {
+	m.Lock()
+	defer m.Unlock()
+	m.dialFailures = append(m.dialFailures, address)
+}
+
+func (m *recordedMetrics) BackendChecked(address string, healthy bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.checks == nil {
+		m.checks = map[string]bool{}
+	}
+	m.checks[address] = healthy
+}
+
+func (m *recordedMetrics) ReadOut(bytes, instructions int, _ time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.reads++
+	m.bytesOut += bytes
+	m.instructionsOut += instructions
+}
+
+func (m *recordedMetrics) WrittenIn(bytes, instructions int, _ time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.writes++
+	m.bytesIn += bytes
+	m.instructionsIn += instructions
+}
+
+func (m *recordedMetrics) ReadFirstByte(time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.firstBytes++
+}
+
+func (m *recordedMetrics) WriteCopied(time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.copies++
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &recordedMetrics{}
+
+	guacd := &fakeTunnel{reader: &scriptedReader{chunks: [][]byte{[]byte("4.sync,1.1;4.sync,1.2;")}}}
+	tunnel := connectedTunnel(metrics, guacd)
+	reader := tunnel.AcquireReader()
+	if _, err := reader.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseReader()
+	writer := tunnel.AcquireWriter()
+	if _, err := writer.Write([]byte("3.key,2.65,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+
+	if metrics.connects != 1 || metrics.reads != 1 || metrics.writes != 1 {
+		t.Errorf("Expected a connect, read and write, got %v, %v and %v", metrics.connects, metrics.reads, metrics.writes)
+	}
+	if metrics.bytesOut != 22 || metrics.instructionsOut != 2 {
+		t.Errorf("Expected 22 bytes and 2 instructions out, got %v and %v", metrics.bytesOut, metrics.instructionsOut)
+	}
+	if metrics.bytesIn != 15 || metrics.instructionsIn != 1 {
+		t.Errorf("Expected 15 bytes and 1 instruction in, got %v and %v", metrics.bytesIn, metrics.instructionsIn)
+	}
+
+	backend := &Backend{Address: "guacd:4822", Dialer: &farmDialer{down: map[string]bool{"guacd:4822": true}}, Metrics: metrics}
+	if _, err := backend.Connect(context.Background(), NewGuacamoleConfiguration()); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+	if len(metrics.dialFailures) != 1 || metrics.dialFailures[0] != "guacd:4822" {
+		t.Error("Expected a dial error to be measured, got", metrics.dialFailures)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	metrics := &recordedMetrics{}
+	fail := false
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		if fail {
+			return nil, ErrUpstreamUnavailable.NewError("down")
+		}
+		return &fakeTunnel{}, nil
+	})
+	server.Metrics = metrics
+
+	connect := func() string {
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/?connect", bytes.NewReader(nil)))
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+	uuid := connect()
+	if metrics.open != 1 {
+		t.Error("Expected one open tunnel, got", metrics.open)
+	}
+	fail = true
+	connect()
+	if len(metrics.failures) != 1 || metrics.failures[0].GetGuacamoleStatusCode() != 516 {
+		t.Error("Expected a failure to be measured, got", metrics.failures)
+	}
+
+	if err := server.KillTunnel(uuid, "done"); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.open != 0 {
+		t.Error("Expected no open tunnels, got", metrics.open)
+	}
+}
@@ -0,0 +1,69 @@
+package guac
+
+import (
+	"strconv"
+)
+
+// Message codes of the msg instruction, introduced in protocol version 1.5.0
+const (
+	// MsgUserJoined announces that a user joined the connection. Its argument is their name.
+	MsgUserJoined = 0x0001
+	// MsgUserLeft announces that a user left the connection. Its argument is their name.
+	MsgUserLeft = 0x0002
+)
+
+// msgVersion is the first protocol version supporting the msg and name instructions
+const msgVersion = "VERSION_1_5_0"
+
+// Msg is a notification for the users of a connection, sent with the msg instruction
+type Msg struct {
+	// Code says what the message is about, for example MsgUserJoined
+	Code int
+	// Args are the code specific arguments of the message
+	Args []string
+}
+
+// ParseMsg decodes a msg instruction
+func ParseMsg(instruction *Instruction) (*Msg, error) {
+	if instruction.Opcode != OpcodeMsg || len(instruction.Args) == 0 {
+		return nil, ErrServer.NewError("Not a msg instruction")
+	}
+	code, err := strconv.ParseInt(instruction.Args[0], 0, 32)
+	if err != nil {
+		return nil, ErrServer.NewError("Invalid msg code:", instruction.Args[0])
+	}
+	return &Msg{Code: int(code), Args: instruction.Args[1:]}, nil
+}
+
+// Instruction encodes the message as a msg instruction
+func (m *Msg) Instruction() *Instruction {
+	return NewInstruction(OpcodeMsg, append([]string{strconv.Itoa(m.Code)}, m.Args...)...)
+}
+
+// MsgFilter is a read Filter which reports the msg instructions sent by guacd, such as users
+// joining and leaving a shared connection, and passes them on to the client.
+type MsgFilter struct {
+	onMsg func(*Msg)
+}
+
+// NewMsgFilter creates a filter calling onMsg for every msg instruction from guacd
+func NewMsgFilter(onMsg func(*Msg)) *MsgFilter {
+	return &MsgFilter{onMsg: onMsg}
+}
+
+// Filter reports msg instructions
+func (f *MsgFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	if instruction.Opcode == OpcodeMsg {
+		if msg, err := ParseMsg(instruction); err == nil {
+			f.onMsg(msg)
+		}
+	}
+	return instruction, nil
+}
+
+// SendMsg sends a message to the client of a tunnel. Clients older than 1.5.0 ignore it.
+// Codes other than the ones defined by Guacamole can be used to carry application messages,
+// such as chat, to clients which handle them.
+func SendMsg(tunnel *FilteredTunnel, code int, args ...string) {
+	tunnel.WriteToClient((&Msg{Code: code, Args: args}).Instruction())
+}
@@ -0,0 +1,105 @@
+package guac
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMsg(t *testing.T) {
+	msg, err := ParseMsg(NewInstruction("msg", "1", "ada"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Code != MsgUserJoined || len(msg.Args) != 1 || msg.Args[0] != "ada" {
+		t.Errorf("unexpected msg %+v", msg)
+	}
+	if msg.Instruction().String() != "3.msg,1.1,3.ada;" {
+		t.Errorf("unexpected encoding %v", msg.Instruction())
+	}
+
+	if _, err = ParseMsg(NewInstruction("msg", "x")); err == nil {
+		t.Error("expected invalid code to fail")
+	}
+}
+
+func TestMsgFilter(t *testing.T) {
+	var got []*Msg
+	filter := NewMsgFilter(func(msg *Msg) {
+		got = append(got, msg)
+	})
+
+	for _, ins := range []*Instruction{NewInstruction("msg", "2", "ada"), NewInstruction("sync", "1")} {
+		if forwarded, _ := filter.Filter(ins); forwarded != ins {
+			t.Errorf("expected %v to be forwarded", ins)
+		}
+	}
+	if len(got) != 1 || got[0].Code != MsgUserLeft {
+		t.Errorf("unexpected messages %v", got)
+	}
+
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: &bytes.Buffer{}})
+	SendMsg(tunnel, MsgUserJoined, "ada")
+	if pending := string(tunnel.takePending()); pending != "3.msg,1.1,3.ada;" {
+		t.Errorf("unexpected pending instructions %q", pending)
+	}
+}
+
+func TestStream_HandshakeName(t *testing.T) {
+	for version, sent := range map[string]bool{"VERSION_1_5_0": true, "VERSION_1_1_0": false} {
+		conn := &fakeConn{
+			ToRead: []byte(NewInstruction("args", version, "hostname").String() + "5.ready,4.$abc;"),
+		}
+		stream := NewStream(conn, time.Minute)
+		config := NewGuacamoleConfiguration()
+		config.UserName = "ada"
+		if err := stream.Handshake(config); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.Contains(string(conn.Written), "4.name,3.ada;"); got != sent {
+			t.Errorf("%v: name sent = %v", version, got)
+		}
+		if stream.ProtocolVersion != version {
+			t.Errorf("unexpected protocol version %v", stream.ProtocolVersion)
+		}
+		if connect := NewInstruction(OpcodeConnect, version, "").String(); !strings.Contains(string(conn.Written), connect) {
+			t.Errorf("%v: expected %q to be sent, sent %q", version, connect, conn.Written)
+		}
+		if stream.ConnectionID != "$abc" {
+			t.Errorf("unexpected connection ID %v", stream.ConnectionID)
+		}
+	}
+}
+
+func TestStream_HandshakeJoin(t *testing.T) {
+	conn := &fakeConn{
+		ToRead: []byte(NewInstruction("args", "VERSION_1_5_0", "read-only").String() + "5.ready,4.$abc;"),
+	}
+	stream := NewStream(conn, time.Minute)
+	if err := stream.Handshake(NewJoinConfiguration("$abc", true)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(conn.Written), "6.select,4.$abc;") {
+		t.Errorf("Expected the connection to be selected, sent %q", conn.Written)
+	}
+	if !strings.Contains(string(conn.Written), "7.connect,13.VERSION_1_5_0,4.true;") {
+		t.Errorf("Expected to join read-only, sent %q", conn.Written)
+	}
+	if !stream.Joined || stream.ConnectionID != "$abc" {
+		t.Errorf("Expected to have joined $abc, got %v %v", stream.Joined, stream.ConnectionID)
+	}
+
+	// guacd hangs up on joins of connections which do not exist
+	stream = NewStream(&fakeConn{}, time.Minute)
+	err := stream.Handshake(NewJoinConfiguration("$gone", false))
+	if err == nil || asErrGuac(err).Kind != ErrUpstreamNotFound {
+		t.Errorf("Expected ErrUpstreamNotFound, got %v", err)
+	}
+
+	err = NewStream(&fakeConn{}, time.Minute).Handshake(NewJoinConfiguration("abc", false))
+	if err == nil || asErrGuac(err).Kind != ErrClient {
+		t.Errorf("Expected invalid connection ID to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package guac
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultMaxObservers is the number of observers each connection may have when
+// Observers.Max is zero
+const DefaultMaxObservers = 5
+
+// Observers attaches view-only clients to connections in progress, for example so support
+// staff can watch a user's session. Observers join the connection in guacd's read-only mode,
+// and their input is also dropped by a ReadOnlyFilter, so it holds even for a modified client.
+type Observers struct {
+	// Backend is the guacd the observed connections run on
+	Backend *Backend
+	// Max limits the number of observers of each connection, DefaultMaxObservers if zero and
+	// unlimited if negative
+	Max int
+
+	sync.Mutex
+	counts map[string]int
+}
+
+// ObserveTunnel joins the connection with the given ID in view-only mode. The display size
+// and supported formats are taken from config, which may be nil for the defaults. ObserveTunnel
+// fails with ClientTooMany if the connection already has as many observers as allowed.
+func (o *Observers) ObserveTunnel(ctx context.Context, connectionID string, config *Config) (Tunnel, error) {
+	if !o.reserve(connectionID) {
+		return nil, ErrClientTooMany.NewError("Too many observers of connection", connectionID)
+	}
+
+	join := NewJoinConfiguration(connectionID, true)
+	if config != nil {
+		copied := *config
+		copied.ConnectionID = connectionID
+		copied.Parameters = map[string]string{}
+		for name, value := range config.Parameters {
+			copied.Parameters[name] = value
+		}
+		copied.Parameters["read-only"] = "true"
+		join = &copied
+	}
+
+	stream, err := o.Backend.Connect(ctx, join)
+	if err != nil {
+		o.release(connectionID)
+		return nil, err
+	}
+	registryLog.Debugf("Observer joined connection %v.", connectionID)
+	return &observerTunnel{
+		FilteredTunnel: MakeReadOnly(NewSimpleTunnel(stream)),
+		observers:      o,
+		connectionID:   connectionID,
+	}, nil
+}
+
+// Count returns the number of observers of the connection with the given ID
+func (o *Observers) Count(connectionID string) int {
+	o.Lock()
+	defer o.Unlock()
+	return o.counts[connectionID]
+}
+
+func (o *Observers) reserve(connectionID string) bool {
+	max := o.Max
+	if max == 0 {
+		max = DefaultMaxObservers
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	if max > 0 && o.counts[connectionID] >= max {
+		return false
+	}
+	if o.counts == nil {
+		o.counts = map[string]int{}
+	}
+	o.counts[connectionID]++
+	return true
+}
+
+func (o *Observers) release(connectionID string) {
+	o.Lock()
+	defer o.Unlock()
+	if o.counts[connectionID]--; o.counts[connectionID] <= 0 {
+		delete(o.counts, connectionID)
+	}
+}
+
+// observerTunnel gives up its place among the observers of the connection when closed
+type observerTunnel struct {
+	*FilteredTunnel
+	observers    *Observers
+	connectionID string
+	once         sync.Once
+}
+
+func (t *observerTunnel) Close() error {
+	t.once.Do(func() {
+		t.observers.release(t.connectionID)
+	})
+	return t.FilteredTunnel.Close()
+}
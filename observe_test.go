@@ -0,0 +1,67 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// joinDialer connects to a fake guacd which accepts every join
+type joinDialer struct {
+	conns []*fakeConn
+}
+
+func (d *joinDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn := &fakeConn{
+		ToRead: []byte(NewInstruction(OpcodeArgs, "VERSION_1_5_0", "read-only").String() + "5.ready,4.$abc;"),
+	}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+func TestObservers_ObserveTunnel(t *testing.T) {
+	dialer := &joinDialer{}
+	observers := &Observers{Backend: &Backend{Dialer: dialer}, Max: 1}
+	config := NewGuacamoleConfiguration()
+	config.Parameters["color-depth"] = "16"
+
+	tunnel, err := observers.ObserveTunnel(context.Background(), "$abc", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := string(dialer.conns[0].Written)
+	if !strings.HasPrefix(written, "6.select,4.$abc;") || !strings.Contains(written, "7.connect,13.VERSION_1_5_0,4.true;") {
+		t.Errorf("Expected a read-only join, sent %q", written)
+	}
+	if _, ok := config.Parameters["read-only"]; ok {
+		t.Error("Expected the given config to be left unchanged")
+	}
+
+	// input from the observer never reaches guacd
+	writer := tunnel.AcquireWriter()
+	if _, err = writer.Write(NewKeyInstruction(65, true).Byte()); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseWriter()
+	if string(dialer.conns[0].Written) != written {
+		t.Errorf("Expected observer input to be dropped, sent %q", dialer.conns[0].Written)
+	}
+
+	if _, err = observers.ObserveTunnel(context.Background(), "$abc", nil); err == nil || asErrGuac(err).Kind != ErrClientTooMany {
+		t.Errorf("Expected ClientTooMany, got %v", err)
+	}
+	if len(dialer.conns) != 1 {
+		t.Error("Expected refused observer not to connect")
+	}
+
+	_ = tunnel.Close()
+	_ = tunnel.Close()
+	if count := observers.Count("$abc"); count != 0 {
+		t.Error("Expected no observers once closed, got", count)
+	}
+	if tunnel, err = observers.ObserveTunnel(context.Background(), "$abc", nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = tunnel.Close()
+}
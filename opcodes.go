@@ -0,0 +1,119 @@
+package guac
+
+import (
+	"encoding/base64"
+	"strconv"
+)
+
+// Opcodes of the Guacamole protocol instructions
+const (
+	// Handshake
+	OpcodeArgs    = "args"
+	OpcodeAudio   = "audio"
+	OpcodeConnect = "connect"
+	OpcodeImage   = "image"
+	OpcodeName    = "name"
+	OpcodeReady   = "ready"
+	OpcodeSelect  = "select"
+	OpcodeSize    = "size"
+	OpcodeVideo   = "video"
+
+	// Control
+	OpcodeDisconnect = "disconnect"
+	OpcodeError      = "error"
+	OpcodeNop        = "nop"
+	OpcodeRequired   = "required"
+	OpcodeSync       = "sync"
+	OpcodeLog        = "log"
+	OpcodeMsg        = "msg"
+
+	// Drawing
+	OpcodeDispose = "dispose"
+	OpcodeMove    = "move"
+
+	// Input
+	OpcodeKey   = "key"
+	OpcodeMouse = "mouse"
+	OpcodeTouch = "touch"
+
+	// Streams
+	OpcodeAck       = "ack"
+	OpcodeArgv      = "argv"
+	OpcodeBlob      = "blob"
+	OpcodeBody      = "body"
+	OpcodeClipboard = "clipboard"
+	OpcodeEnd       = "end"
+	OpcodeFile      = "file"
+	OpcodeImg       = "img"
+	OpcodeNest      = "nest"
+	OpcodePipe      = "pipe"
+	OpcodePut       = "put"
+)
+
+// Mouse button mask bits of a mouse instruction
+const (
+	MouseLeft = 1 << iota
+	MouseMiddle
+	MouseRight
+	MouseScrollUp
+	MouseScrollDown
+)
+
+// NewKeyInstruction creates a key instruction pressing or releasing the key with the given
+// X11 keysym
+func NewKeyInstruction(keysym int, pressed bool) *Instruction {
+	return NewInstruction(OpcodeKey, strconv.Itoa(keysym), formatBool(pressed))
+}
+
+// NewMouseInstruction creates a mouse instruction moving the pointer to x, y with the buttons
+// in mask held down, see MouseLeft and friends
+func NewMouseInstruction(x, y, mask int) *Instruction {
+	return NewInstruction(OpcodeMouse, strconv.Itoa(x), strconv.Itoa(y), strconv.Itoa(mask))
+}
+
+// NewSizeInstruction creates a size instruction, as sent by a client to resize its display
+func NewSizeInstruction(width, height int) *Instruction {
+	return NewInstruction(OpcodeSize, strconv.Itoa(width), strconv.Itoa(height))
+}
+
+// NewSyncInstruction creates a sync instruction for the given timestamp in milliseconds
+func NewSyncInstruction(timestamp int64) *Instruction {
+	return NewInstruction(OpcodeSync, strconv.FormatInt(timestamp, 10))
+}
+
+// NewNopInstruction creates a nop instruction
+func NewNopInstruction() *Instruction {
+	return NewInstruction(OpcodeNop)
+}
+
+// NewDisconnectInstruction creates a disconnect instruction
+func NewDisconnectInstruction() *Instruction {
+	return NewInstruction(OpcodeDisconnect)
+}
+
+// NewErrorInstruction creates an error instruction with the given message and status
+func NewErrorInstruction(message string, status Status) *Instruction {
+	return NewInstruction(OpcodeError, message, strconv.Itoa(status.GetGuacamoleStatusCode()))
+}
+
+// NewAckInstruction creates an ack instruction for a stream with the given message and status
+func NewAckInstruction(stream, message string, status Status) *Instruction {
+	return NewInstruction(OpcodeAck, stream, message, strconv.Itoa(status.GetGuacamoleStatusCode()))
+}
+
+// NewBlobInstruction creates a blob instruction carrying data on a stream
+func NewBlobInstruction(stream string, data []byte) *Instruction {
+	return NewInstruction(OpcodeBlob, stream, base64.StdEncoding.EncodeToString(data))
+}
+
+// NewEndInstruction creates an end instruction closing a stream
+func NewEndInstruction(stream string) *Instruction {
+	return NewInstruction(OpcodeEnd, stream)
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
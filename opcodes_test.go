@@ -0,0 +1,27 @@
+package guac
+
+import "testing"
+
+func TestTypedInstructions(t *testing.T) {
+	tests := []struct {
+		instruction *Instruction
+		expected    string
+	}{
+		{NewKeyInstruction(0xff0d, true), "3.key,5.65293,1.1;"},
+		{NewKeyInstruction(97, false), "3.key,2.97,1.0;"},
+		{NewMouseInstruction(10, 20, MouseLeft|MouseRight), "5.mouse,2.10,2.20,1.5;"},
+		{NewSizeInstruction(1024, 768), "4.size,4.1024,3.768;"},
+		{NewSyncInstruction(1234), "4.sync,4.1234;"},
+		{NewNopInstruction(), "3.nop;"},
+		{NewDisconnectInstruction(), "10.disconnect;"},
+		{NewErrorInstruction("Bye.", SessionClosed), "5.error,4.Bye.,3.523;"},
+		{NewAckInstruction("3", "OK", Success), "3.ack,1.3,2.OK,1.0;"},
+		{NewBlobInstruction("3", []byte("hi")), "4.blob,1.3,4.aGk=;"},
+		{NewEndInstruction("3"), "3.end,1.3;"},
+	}
+	for _, test := range tests {
+		if actual := test.instruction.String(); actual != test.expected {
+			t.Errorf("Expected %v got %v", test.expected, actual)
+		}
+	}
+}
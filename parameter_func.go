@@ -0,0 +1,45 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ParameterFunc computes connection parameters lazily during the handshake. It is called
+// with the names of the arguments guacd requested for the protocol selected, and returns the
+// values of any it wants to set, which may refer to secrets as with SecretRef. This suits
+// values which should only be made when actually needed, such as a one-time RDP password
+// minted for the connection:
+//
+//	config.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+//		password, err := vault.MintPassword(ctx, user)
+//		return map[string]string{"password": password}, err
+//	}
+//
+// Values returned for arguments guacd didn't request are ignored.
+type ParameterFunc func(ctx context.Context, args []string) (map[string]string, error)
+
+// computeParameters calls f, if set, with the arguments guacd requested, leaving out the
+// protocol version it sends first
+func computeParameters(ctx context.Context, f ParameterFunc, args []string) (map[string]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "VERSION_") {
+			names = append(names, arg)
+		}
+	}
+	values, err := f(ctx, names)
+	if err != nil {
+		var guacErr *ErrGuac
+		if errors.As(err, &guacErr) {
+			return nil, err
+		}
+		handshakeLog.Warnf("Unable to compute connection parameters: %v", err)
+		return nil, ErrServer.NewError("Unable to compute connection parameters.")
+	}
+	return values, nil
+}
@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfig_ParameterFunc(t *testing.T) {
+	dialer := &argsDialer{args: []string{"hostname", "password", "username"}}
+	backend := &Backend{Dialer: dialer}
+	config := NewGuacamoleConfiguration()
+	config.Parameters["hostname"] = "desktop-1"
+	config.Parameters["password"] = "stale"
+	var requested []string
+	config.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+		requested = args
+		return map[string]string{"password": "one-time", "domain": "ignored"}, nil
+	}
+
+	if _, err := backend.Connect(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(requested, []string{"hostname", "password", "username"}) {
+		t.Error("Unexpected arguments", requested)
+	}
+	connect := NewInstruction(OpcodeConnect, ProtocolVersion, "desktop-1", "one-time", "").String()
+	if !strings.HasSuffix(string(dialer.conn.Written), connect) {
+		t.Errorf("Expected %q to be sent, got %q", connect, dialer.conn.Written)
+	}
+
+	config.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+		return nil, errors.New("vault sealed")
+	}
+	if _, err := backend.Connect(context.Background(), config); err == nil || strings.Contains(err.Error(), "vault") {
+		t.Error("Expected the failure to be reported without its details, got", err)
+	}
+}
+
+func TestBackend_ParameterFuncChecked(t *testing.T) {
+	dialer := &argsDialer{args: []string{"hostname", "port"}}
+	backend := &Backend{
+		Dialer:  dialer,
+		Schemas: DefaultParameterSchemas,
+		Targets: &TargetPolicy{Deny: []string{"169.254.0.0/16"}},
+	}
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+	config.Parameters["hostname"] = "10.0.0.1"
+	for name, values := range map[string]map[string]string{
+		"denied target": {"hostname": "169.254.169.254"},
+		"invalid value": {"port": "none"},
+	} {
+		values := values
+		config.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+			return values, nil
+		}
+		if _, err := backend.Connect(context.Background(), config); err == nil {
+			t.Errorf("%v: expected the computed parameters to be refused", name)
+		}
+	}
+
+	config.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+		return map[string]string{"hostname": "10.0.0.2"}, nil
+	}
+	if _, err := backend.Connect(context.Background(), config); err != nil {
+		t.Error("Expected allowed computed parameters to pass, got", err)
+	}
+}
@@ -0,0 +1,358 @@
+package guac
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParameterType is the type of value a connection parameter takes
+type ParameterType int
+
+const (
+	// ParameterText takes any text
+	ParameterText ParameterType = iota
+	// ParameterInteger takes a decimal integer
+	ParameterInteger
+	// ParameterBoolean takes "true" or "false"
+	ParameterBoolean
+	// ParameterPort takes a TCP or UDP port number
+	ParameterPort
+	// ParameterHost takes a hostname or an IP address
+	ParameterHost
+	// ParameterEnum takes one of a fixed set of values
+	ParameterEnum
+)
+
+// ParameterSpec describes the values a connection parameter takes. Empty values are always
+// valid, as guacd uses its default for them.
+type ParameterSpec struct {
+	Type ParameterType
+	// Values lists the values of an enum
+	Values []string
+	// Min and Max bound integers, Max being ignored if zero
+	Min, Max int
+}
+
+// ParameterSchema maps the names of the parameters of a protocol to their specs
+type ParameterSchema map[string]ParameterSpec
+
+// ParameterSchemas maps protocols to the schemas of their parameters
+type ParameterSchemas map[string]ParameterSchema
+
+var (
+	paramText    = ParameterSpec{Type: ParameterText}
+	paramInteger = ParameterSpec{Type: ParameterInteger}
+	paramBoolean = ParameterSpec{Type: ParameterBoolean}
+	paramPort    = ParameterSpec{Type: ParameterPort}
+	paramHost    = ParameterSpec{Type: ParameterHost}
+)
+
+func paramEnum(values ...string) ParameterSpec {
+	return ParameterSpec{Type: ParameterEnum, Values: values}
+}
+
+func paramBounded(min, max int) ParameterSpec {
+	return ParameterSpec{Type: ParameterInteger, Min: min, Max: max}
+}
+
+// mergeSchemas returns a schema with the parameters of all of schemas
+func mergeSchemas(schemas ...ParameterSchema) ParameterSchema {
+	merged := ParameterSchema{}
+	for _, schema := range schemas {
+		for name, spec := range schema {
+			merged[name] = spec
+		}
+	}
+	return merged
+}
+
+// parameter groups shared by several protocols
+var (
+	recordingParameters = ParameterSchema{
+		"recording-path":           paramText,
+		"recording-name":           paramText,
+		"create-recording-path":    paramBoolean,
+		"recording-exclude-output": paramBoolean,
+		"recording-exclude-mouse":  paramBoolean,
+		"recording-exclude-touch":  paramBoolean,
+		"recording-include-keys":   paramBoolean,
+		"recording-write-existing": paramBoolean,
+	}
+	sftpParameters = ParameterSchema{
+		"enable-sftp":                paramBoolean,
+		"sftp-hostname":              paramHost,
+		"sftp-host-key":              paramText,
+		"sftp-port":                  paramPort,
+		"sftp-username":              paramText,
+		"sftp-password":              paramText,
+		"sftp-private-key":           paramText,
+		"sftp-passphrase":            paramText,
+		"sftp-public-key":            paramText,
+		"sftp-directory":             paramText,
+		"sftp-root-directory":        paramText,
+		"sftp-server-alive-interval": paramInteger,
+		"sftp-disable-download":      paramBoolean,
+		"sftp-disable-upload":        paramBoolean,
+	}
+	wolParameters = ParameterSchema{
+		"wol-send-packet":    paramBoolean,
+		"wol-mac-addr":       paramText,
+		"wol-broadcast-addr": paramHost,
+		"wol-udp-port":       paramPort,
+		"wol-wait-time":      paramInteger,
+	}
+	clipboardParameters = ParameterSchema{
+		"disable-copy":  paramBoolean,
+		"disable-paste": paramBoolean,
+	}
+	terminalParameters = ParameterSchema{
+		"color-scheme":           paramText,
+		"font-name":              paramText,
+		"font-size":              paramBounded(1, 0),
+		"scrollback":             paramInteger,
+		"backspace":              paramBounded(0, 255),
+		"terminal-type":          paramText,
+		"read-only":              paramBoolean,
+		"typescript-path":        paramText,
+		"typescript-name":        paramText,
+		"create-typescript-path": paramBoolean,
+	}
+)
+
+// DefaultParameterSchemas holds the schemas of the parameters of the protocols guacd supports
+var DefaultParameterSchemas = ParameterSchemas{
+	"rdp": mergeSchemas(recordingParameters, sftpParameters, wolParameters, clipboardParameters, ParameterSchema{
+		"hostname":                   paramHost,
+		"port":                       paramPort,
+		"username":                   paramText,
+		"password":                   paramText,
+		"domain":                     paramText,
+		"security":                   paramEnum("any", "nla", "nla-ext", "tls", "vmconnect", "rdp"),
+		"ignore-cert":                paramBoolean,
+		"cert-tofu":                  paramBoolean,
+		"cert-fingerprints":          paramText,
+		"disable-auth":               paramBoolean,
+		"initial-program":            paramText,
+		"client-name":                paramText,
+		"server-layout":              paramText,
+		"timezone":                   paramText,
+		"enable-touch":               paramBoolean,
+		"console":                    paramBoolean,
+		"console-audio":              paramBoolean,
+		"width":                      paramBounded(1, 0),
+		"height":                     paramBounded(1, 0),
+		"dpi":                        paramBounded(1, 0),
+		"color-depth":                paramEnum("8", "16", "24", "32"),
+		"resize-method":              paramEnum("display-update", "reconnect"),
+		"force-lossless":             paramBoolean,
+		"read-only":                  paramBoolean,
+		"normalize-clipboard":        paramEnum("preserve", "unix", "windows"),
+		"disable-audio":              paramBoolean,
+		"enable-audio-input":         paramBoolean,
+		"enable-printing":            paramBoolean,
+		"printer-name":               paramText,
+		"enable-drive":               paramBoolean,
+		"drive-name":                 paramText,
+		"drive-path":                 paramText,
+		"create-drive-path":          paramBoolean,
+		"disable-download":           paramBoolean,
+		"disable-upload":             paramBoolean,
+		"static-channels":            paramText,
+		"enable-wallpaper":           paramBoolean,
+		"enable-theming":             paramBoolean,
+		"enable-font-smoothing":      paramBoolean,
+		"enable-full-window-drag":    paramBoolean,
+		"enable-desktop-composition": paramBoolean,
+		"enable-menu-animations":     paramBoolean,
+		"disable-bitmap-caching":     paramBoolean,
+		"disable-offscreen-caching":  paramBoolean,
+		"disable-glyph-caching":      paramBoolean,
+		"disable-gfx":                paramBoolean,
+		"preconnection-id":           paramInteger,
+		"preconnection-blob":         paramText,
+		"gateway-hostname":           paramHost,
+		"gateway-port":               paramPort,
+		"gateway-domain":             paramText,
+		"gateway-username":           paramText,
+		"gateway-password":           paramText,
+		"load-balance-info":          paramText,
+		"remote-app":                 paramText,
+		"remote-app-dir":             paramText,
+		"remote-app-args":            paramText,
+	}),
+	"vnc": mergeSchemas(recordingParameters, sftpParameters, wolParameters, clipboardParameters, ParameterSchema{
+		"hostname":               paramHost,
+		"port":                   paramPort,
+		"username":               paramText,
+		"password":               paramText,
+		"autoretry":              paramInteger,
+		"color-depth":            paramEnum("8", "16", "24", "32"),
+		"swap-red-blue":          paramBoolean,
+		"cursor":                 paramEnum("local", "remote"),
+		"encodings":              paramText,
+		"read-only":              paramBoolean,
+		"force-lossless":         paramBoolean,
+		"compress-level":         paramBounded(0, 9),
+		"quality-level":          paramBounded(0, 9),
+		"disable-server-input":   paramBoolean,
+		"disable-display-resize": paramBoolean,
+		"dest-host":              paramHost,
+		"dest-port":              paramPort,
+		"enable-audio":           paramBoolean,
+		"audio-servername":       paramText,
+		"clipboard-encoding":     paramEnum("ISO8859-1", "UTF-8", "UTF-16", "CP1252"),
+		"reverse-connect":        paramBoolean,
+		"listen-timeout":         paramInteger,
+	}),
+	"ssh": mergeSchemas(recordingParameters, wolParameters, clipboardParameters, terminalParameters, ParameterSchema{
+		"hostname":              paramHost,
+		"port":                  paramPort,
+		"host-key":              paramText,
+		"username":              paramText,
+		"password":              paramText,
+		"private-key":           paramText,
+		"passphrase":            paramText,
+		"public-key":            paramText,
+		"command":               paramText,
+		"locale":                paramText,
+		"timezone":              paramText,
+		"server-alive-interval": paramInteger,
+		"enable-sftp":           paramBoolean,
+		"sftp-root-directory":   paramText,
+		"sftp-disable-download": paramBoolean,
+		"sftp-disable-upload":   paramBoolean,
+	}),
+	"telnet": mergeSchemas(recordingParameters, wolParameters, clipboardParameters, terminalParameters, ParameterSchema{
+		"hostname":            paramHost,
+		"port":                paramPort,
+		"username":            paramText,
+		"username-regex":      paramText,
+		"password":            paramText,
+		"password-regex":      paramText,
+		"login-success-regex": paramText,
+		"login-failure-regex": paramText,
+	}),
+	"kubernetes": mergeSchemas(recordingParameters, clipboardParameters, terminalParameters, ParameterSchema{
+		"hostname":     paramHost,
+		"port":         paramPort,
+		"namespace":    paramText,
+		"pod":          paramText,
+		"container":    paramText,
+		"exec-command": paramText,
+		"use-ssl":      paramBoolean,
+		"client-cert":  paramText,
+		"client-key":   paramText,
+		"ca-cert":      paramText,
+		"ignore-cert":  paramBoolean,
+	}),
+}
+
+// Validate checks the parameters of config against the schema of its protocol, so mistakes
+// are reported to the client rather than failing opaquely inside guacd. Unknown protocols and
+// parameters and malformed values are refused with ErrClient, whose message lists every
+// problem found. Values referring to secrets are not checked, as they are only resolved
+// during the handshake. Joins pass, as guacd uses the parameters of the connection joined.
+func (s ParameterSchemas) Validate(config *Config) error {
+	if config.ConnectionID != "" {
+		return nil
+	}
+	protocol := strings.ToLower(config.Protocol)
+	schema, ok := s[protocol]
+	if !ok {
+		return ErrClient.NewError("Unsupported protocol:", config.Protocol)
+	}
+
+	names := make([]string, 0, len(config.Parameters))
+	for name := range config.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		spec, ok := schema[name]
+		if !ok {
+			problems = append(problems, "unknown parameter "+name)
+			continue
+		}
+		value := config.Parameters[name]
+		if _, isSecret := secretKey(value); isSecret {
+			continue
+		}
+		if problem := spec.check(value); problem != "" {
+			if IsSensitiveParameter(name) {
+				problem = redactText(problem, []string{value})
+			}
+			problems = append(problems, "parameter "+name+" "+problem)
+		}
+	}
+	if len(problems) > 0 {
+		return ErrClient.NewError("Invalid "+protocol+" connection parameters:", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// check returns why value does not match the spec, or an empty string if it does
+func (p ParameterSpec) check(value string) string {
+	if value == "" {
+		return ""
+	}
+	switch p.Type {
+	case ParameterInteger:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return "must be an integer, got " + strconv.Quote(value)
+		}
+		if number < p.Min || (p.Max != 0 && number > p.Max) {
+			bounds := "at least " + strconv.Itoa(p.Min)
+			if p.Max != 0 {
+				bounds = "between " + strconv.Itoa(p.Min) + " and " + strconv.Itoa(p.Max)
+			}
+			return "must be " + bounds + ", got " + value
+		}
+	case ParameterBoolean:
+		if value != "true" && value != "false" {
+			return "must be true or false, got " + strconv.Quote(value)
+		}
+	case ParameterPort:
+		if number, err := strconv.Atoi(value); err != nil || number < 1 || number > 65535 {
+			return "must be a port number, got " + strconv.Quote(value)
+		}
+	case ParameterHost:
+		if !validHost(value) {
+			return "must be a hostname or IP address, got " + strconv.Quote(value)
+		}
+	case ParameterEnum:
+		for _, allowed := range p.Values {
+			if value == allowed {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(p.Values, ", ") + ", got " + strconv.Quote(value)
+	}
+	return ""
+}
+
+// validHost returns true if host is an IP address, optionally in brackets, or a hostname made
+// of letters, digits, hyphens, underscores and dots
+func validHost(host string) bool {
+	if _, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); err == nil {
+		return true
+	}
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParameterSchemas_Validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		protocol   string
+		parameters map[string]string
+		problem    string
+	}{
+		{"valid", "RDP", map[string]string{"hostname": "desktop-1.example.com", "port": "3389", "security": "nla", "ignore-cert": "true", "width": "1024", "enable-sftp": "true"}, ""},
+		{"rdp graphics", "rdp", map[string]string{"disable-gfx": "true", "recording-write-existing": "true"}, ""},
+		{"vnc compression", "vnc", map[string]string{"compress-level": "9", "quality-level": "0", "disable-server-input": "true", "disable-display-resize": "true"}, ""},
+		{"compression bounds", "vnc", map[string]string{"compress-level": "10"}, "parameter compress-level must be between 0 and 9"},
+		{"empty values", "vnc", map[string]string{"port": "", "color-depth": ""}, ""},
+		{"ipv6", "ssh", map[string]string{"hostname": "[2001:db8::1]", "font-size": "12"}, ""},
+		{"secret", "ssh", map[string]string{"hostname": "jump", "port": SecretRef("jump/port")}, ""},
+		{"unknown protocol", "x11", map[string]string{}, "Unsupported protocol"},
+		{"unknown parameter", "ssh", map[string]string{"security": "nla"}, "unknown parameter security"},
+		{"integer", "rdp", map[string]string{"width": "wide"}, "parameter width must be an integer"},
+		{"bounds", "telnet", map[string]string{"backspace": "300"}, "parameter backspace must be between 0 and 255"},
+		{"boolean", "kubernetes", map[string]string{"use-ssl": "yes"}, "parameter use-ssl must be true or false"},
+		{"port", "vnc", map[string]string{"port": "70000"}, "parameter port must be a port number"},
+		{"host", "rdp", map[string]string{"hostname": "desktop 1"}, "parameter hostname must be a hostname or IP address"},
+		{"enum", "vnc", map[string]string{"cursor": "both"}, "parameter cursor must be one of local, remote"},
+	}
+	for _, test := range tests {
+		config := NewGuacamoleConfiguration()
+		config.Protocol = test.protocol
+		config.Parameters = test.parameters
+		err := DefaultParameterSchemas.Validate(config)
+		if test.problem == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || asErrGuac(err).Kind != ErrClient || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%v: expected %q, got %v", test.name, test.problem, err)
+		}
+	}
+
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+	config.Parameters = map[string]string{"port": "x", "dpi": "0"}
+	if err := DefaultParameterSchemas.Validate(config); err == nil || !strings.Contains(err.Error(), "dpi must be at least 1, got 0; parameter port") {
+		t.Error("Expected every problem to be reported, got", err)
+	}
+
+	if err := DefaultParameterSchemas.Validate(&Config{ConnectionID: "$abc"}); err != nil {
+		t.Error("Expected joins to pass, got", err)
+	}
+}
+
+func TestBackend_Schemas(t *testing.T) {
+	dialer := &argsDialer{}
+	backend := &Backend{Dialer: dialer, Schemas: DefaultParameterSchemas}
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "vnc"
+	config.Parameters = map[string]string{"port": "vnc"}
+	if _, err := backend.Connect(context.Background(), config); err == nil {
+		t.Fatal("Expected the parameters to be refused")
+	}
+	if dialer.conn != nil {
+		t.Error("Expected guacd not to be dialed")
+	}
+}
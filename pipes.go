@@ -0,0 +1,153 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// PipeHandler consumes a named pipe opened by guacd. It runs in its own goroutine and must read
+// data until EOF or an error, since the tunnel blocks while the pipe is not being read.
+type PipeHandler func(mimetype string, data io.Reader)
+
+// Pipes gives Go code access to the named pipes of a tunnel's session, such as the STDIN pipe
+// of SSH connections or the static virtual channels of RDP connections. Pipes opened by guacd
+// are only intercepted if a handler is registered for their name; all others reach the client
+// as usual.
+//
+//	pipes := guac.NewPipes(tunnel)
+//	tunnel.AddReadFilter(pipes)
+type Pipes struct {
+	tunnel *FilteredTunnel
+
+	sync.Mutex
+	handlers map[string]PipeHandler
+	inbound  streamTaps
+}
+
+// NewPipes creates the pipe support for a tunnel. It must be installed as a read filter.
+func NewPipes(tunnel *FilteredTunnel) *Pipes {
+	return &Pipes{
+		tunnel:   tunnel,
+		handlers: map[string]PipeHandler{},
+	}
+}
+
+// Handle registers a handler for pipes with the given name opened by guacd
+func (p *Pipes) Handle(name string, handler PipeHandler) {
+	p.Lock()
+	p.handlers[name] = handler
+	p.Unlock()
+}
+
+// Open opens a named pipe to guacd. Data written is sent as it is written, and closing the
+// writer ends the pipe.
+func (p *Pipes) Open(name, mimetype string) (io.WriteCloser, error) {
+	index, err := p.tunnel.streams.next()
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &pipeWriter{tunnel: p.tunnel, index: index, stream: strconv.Itoa(index)}
+	if err = p.tunnel.WriteInstruction(NewInstruction(OpcodePipe, writer.stream, mimetype, name)); err != nil {
+		p.tunnel.streams.free(index)
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Filter intercepts pipes from guacd which have a registered handler
+func (p *Pipes) Filter(instruction *Instruction) (*Instruction, error) {
+	args := instruction.Args
+
+	switch instruction.Opcode {
+	case OpcodePipe:
+		if len(args) < 3 {
+			break
+		}
+		p.Lock()
+		handler, ok := p.handlers[args[2]]
+		p.Unlock()
+		if ok {
+			mimetype := args[1]
+			p.inbound.open(args[0], func(data io.Reader) {
+				handler(mimetype, data)
+			})
+			return nil, nil
+		}
+
+	case OpcodeBlob:
+		if len(args) < 2 {
+			break
+		}
+		ok, err := p.inbound.write(args[0], args[1])
+		if !ok {
+			break
+		}
+
+		status := Success
+		if err != nil {
+			filtersLog.Debugf("Pipe on stream %v failed: %v", args[0], err)
+			status = ClientBadType
+		}
+		return nil, p.ack(args[0], status)
+
+	case OpcodeEnd:
+		if len(args) < 1 {
+			break
+		}
+		if p.inbound.close(args[0]) {
+			return nil, nil
+		}
+	}
+
+	return instruction, nil
+}
+
+// ack acknowledges a blob received on an inbound pipe, as the client would have
+func (p *Pipes) ack(index string, status Status) error {
+	message := "OK"
+	if status != Success {
+		message = "Pipe closed."
+	}
+	return p.tunnel.WriteInstruction(NewAckInstruction(index, message, status))
+}
+
+// pipeWriter sends data written to it on an outbound pipe stream
+type pipeWriter struct {
+	tunnel *FilteredTunnel
+	index  int
+	stream string
+
+	sync.Mutex
+	closed bool
+}
+
+// Write sends data to guacd as one or more blobs
+func (w *pipeWriter) Write(data []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := w.tunnel.streams.err(w.index); err != nil {
+		return 0, err
+	}
+	if err := writeBlobs(w.tunnel, w.stream, bytes.NewReader(data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Close ends the pipe
+func (w *pipeWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.tunnel.streams.free(w.index)
+	return w.tunnel.WriteInstruction(NewInstruction(OpcodeEnd, w.stream))
+}
@@ -0,0 +1,87 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPipes_Open(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	pipes := NewPipes(tunnel)
+
+	stdin, err := pipes.Open("STDIN", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stdin.Write([]byte("ls\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "4.pipe,2.63,10.text/plain,5.STDIN;4.blob,2.63,4.bHMK;3.end,2.63;"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if _, err = stdin.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("expected ErrClosedPipe, got %v", err)
+	}
+}
+
+func TestPipes_OpenRejected(t *testing.T) {
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: &bytes.Buffer{}})
+	pipes := NewPipes(tunnel)
+
+	stdin, err := pipes.Open("STDIN", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tunnel.streams.owns(NewInstruction("ack", "63", "No such pipe", "256")) {
+		t.Fatal("expected ack to be owned by the tunnel")
+	}
+	if _, err = stdin.Write([]byte("x")); err == nil || asErrGuac(err).Status != Unsupported {
+		t.Errorf("expected Unsupported, got %v", err)
+	}
+}
+
+func TestPipes_Handle(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	pipes := NewPipes(tunnel)
+
+	received := make(chan string)
+	pipes.Handle("svc", func(mimetype string, data io.Reader) {
+		b, _ := io.ReadAll(data)
+		received <- mimetype + ":" + string(b)
+	})
+
+	for _, ins := range []*Instruction{
+		NewInstruction("pipe", "3", "application/octet-stream", "svc"),
+		NewInstruction("blob", "3", "aGk="),
+		NewInstruction("end", "3"),
+	} {
+		if forwarded, err := pipes.Filter(ins); err != nil || forwarded != nil {
+			t.Fatalf("expected %v to be intercepted, got %v %v", ins, forwarded, err)
+		}
+	}
+
+	select {
+	case got := <-received:
+		if got != "application/octet-stream:hi" {
+			t.Errorf("unexpected pipe contents %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not receive pipe")
+	}
+	if want := "3.ack,1.3,2.OK,1.0;"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	if forwarded, _ := pipes.Filter(NewInstruction("pipe", "4", "text/plain", "other")); forwarded == nil {
+		t.Error("expected unhandled pipe to reach the client")
+	}
+}
@@ -0,0 +1,218 @@
+package guac
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPlaybackAuditWindow is how long a PlaybackServer without an AuditWindow goes without
+// auditing a viewer fetching the same recording again
+const DefaultPlaybackAuditWindow = 5 * time.Minute
+
+// Ways a PlaybackServer may grant access to a recording, as reported in PlaybackAudit
+const (
+	PlaybackByOwner = "owner"
+	PlaybackByAdmin = "admin"
+	PlaybackByLink  = "link"
+)
+
+// PlaybackAudit records a recording being watched
+type PlaybackAudit struct {
+	// Recording is the name of the recording served
+	Recording string
+	// Identity is the viewer, nil for share links
+	Identity *Identity
+	// Access is how access was granted, one of PlaybackByOwner, PlaybackByAdmin or PlaybackByLink
+	Access string
+	// RemoteAddr is the address of the viewer
+	RemoteAddr string
+	// Time is when playback started
+	Time time.Time
+}
+
+// PlaybackServer serves session recordings from a directory to viewers allowed to watch them:
+// the recording's owner, members of the admin group, or anyone holding an unexpired share link
+// created with ShareLink. The recording name is the last element of the request path.
+//
+//	playback := &guac.PlaybackServer{Dir: "/var/lib/guacamole/recordings", Authorizer: auth}
+//	http.Handle("/recordings/", http.StripPrefix("/recordings/", playback))
+type PlaybackServer struct {
+	// Dir is the directory recordings are read from
+	Dir string
+	// Authorizer identifies viewers. Without one only share links are accepted.
+	Authorizer Authorizer
+	// Owner returns the subject of the identity which owns a recording, or the empty string
+	// if it has no owner
+	Owner func(recording string) (string, error)
+	// AdminGroup is the group whose members may watch any recording
+	AdminGroup string
+	// LinkKey signs share links, which are refused if it is empty
+	LinkKey []byte
+	// OnPlayback is an optional callback given an audit record of every playback. A player
+	// fetches a recording with many Range requests, so each viewer of a recording is audited
+	// once per AuditWindow whatever ranges it requests.
+	OnPlayback func(*PlaybackAudit)
+	// AuditWindow is how long fetches of a recording by the same viewer count as one
+	// playback, DefaultPlaybackAuditWindow if zero
+	AuditWindow time.Duration
+
+	lock    sync.Mutex
+	audited map[string]time.Time
+}
+
+// ShareLink returns the query string granting access to a recording until expires, to be
+// appended to the recording's URL
+func (s *PlaybackServer) ShareLink(recording string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"expires":   {expiry},
+		"signature": {s.sign(recording, expiry)},
+	}.Encode()
+}
+
+func (s *PlaybackServer) sign(recording, expiry string) string {
+	mac := hmac.New(sha256.New, s.LinkKey)
+	_, _ = fmt.Fprintf(mac, "%s\n%s", recording, expiry)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *PlaybackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(filepath.Clean("/" + r.URL.Path))
+	if name == "/" || name == "." {
+		s.sendError(w, ErrResourceNotFound.NewError("No recording requested."))
+		return
+	}
+
+	audit, err := s.authorizePlayback(r, name)
+	if err != nil {
+		transportLog.Warnf("Playback of recording %q refused: %v", name, err)
+		s.sendError(w, err)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(s.Dir, name))
+	if err != nil {
+		s.sendError(w, ErrResourceNotFound.NewError("No such recording."))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		s.sendError(w, ErrResourceNotFound.NewError("No such recording."))
+		return
+	}
+
+	if r.Method != http.MethodHead && s.startsPlayback(r, audit) {
+		transportLog.Infof("Recording %q watched by %v (%v) from %v.", name, audit.Identity, audit.Access, audit.RemoteAddr)
+		if s.OnPlayback != nil {
+			s.OnPlayback(audit)
+		}
+	} else {
+		transportLog.Debugf("Recording %q fetched by %v (%v) from %v.", name, audit.Identity, audit.Access, audit.RemoteAddr)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// startsPlayback returns true if the viewer of the request hasn't fetched the recording
+// within the AuditWindow, rather than continuing a playback already under way. Whatever ranges
+// the request asks for, it is the first fetch of the window which is audited.
+func (s *PlaybackServer) startsPlayback(r *http.Request, audit *PlaybackAudit) bool {
+	window := s.AuditWindow
+	if window <= 0 {
+		window = DefaultPlaybackAuditWindow
+	}
+	viewer := "address:" + audit.RemoteAddr
+	if host, _, err := net.SplitHostPort(audit.RemoteAddr); err == nil {
+		viewer = "address:" + host
+	}
+	if audit.Identity != nil {
+		viewer = "identity:" + audit.Identity.Subject
+	}
+	key := viewer + "\x00" + audit.Recording
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, at := range s.audited {
+		if audit.Time.Sub(at) >= window {
+			delete(s.audited, k)
+		}
+	}
+	if _, ok := s.audited[key]; ok {
+		return false
+	}
+	if s.audited == nil {
+		s.audited = map[string]time.Time{}
+	}
+	s.audited[key] = audit.Time
+	return true
+}
+
+// authorizePlayback decides whether the request may watch the recording
+func (s *PlaybackServer) authorizePlayback(r *http.Request, name string) (*PlaybackAudit, error) {
+	audit := &PlaybackAudit{
+		Recording:  name,
+		RemoteAddr: r.RemoteAddr,
+		Time:       time.Now(),
+	}
+
+	query := r.URL.Query()
+	if signature := query.Get("signature"); signature != "" {
+		if len(s.LinkKey) == 0 {
+			return nil, ErrUnauthorized.NewError("Share links are not enabled.")
+		}
+		expiry := query.Get("expires")
+		if !hmac.Equal([]byte(signature), []byte(s.sign(name, expiry))) {
+			return nil, ErrUnauthorized.NewError("Invalid share link.")
+		}
+		expires, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil || audit.Time.After(time.Unix(expires, 0)) {
+			return nil, ErrUnauthorized.NewError("Share link has expired.")
+		}
+		audit.Access = PlaybackByLink
+		return audit, nil
+	}
+
+	if s.Authorizer == nil {
+		return nil, ErrUnauthorized.NewError("Not authenticated.")
+	}
+	_, identity, err := authorize(s.Authorizer, r)
+	if err != nil {
+		return nil, err
+	}
+	audit.Identity = identity
+
+	if s.AdminGroup != "" && identity.InGroup(s.AdminGroup) {
+		audit.Access = PlaybackByAdmin
+		return audit, nil
+	}
+	if s.Owner != nil {
+		owner, err := s.Owner(name)
+		if err != nil {
+			return nil, ErrResourceNotFound.NewError("No such recording.")
+		}
+		if owner != "" && owner == identity.Subject {
+			audit.Access = PlaybackByOwner
+			return audit, nil
+		}
+	}
+	return nil, ErrSecurity.NewError("Not allowed to watch this recording.")
+}
+
+func (s *PlaybackServer) sendError(w http.ResponseWriter, err error) {
+	guacErr := asErrGuac(err)
+	w.Header().Set("Guacamole-Status-Code", strconv.Itoa(guacErr.Status.GetGuacamoleStatusCode()))
+	http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+}
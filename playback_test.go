@@ -0,0 +1,151 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newPlaybackServer(t *testing.T) *PlaybackServer {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "session-1"), []byte("4.sync,1.0;"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &PlaybackServer{
+		Dir: dir,
+		Authorizer: AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+			if user := r.Header.Get("X-User"); user != "" {
+				return &Identity{Subject: user, Groups: []string{r.Header.Get("X-Group")}}, nil
+			}
+			return nil, nil
+		}),
+		Owner: func(recording string) (string, error) {
+			return "alice", nil
+		},
+		AdminGroup: "admins",
+		LinkKey:    []byte("secret"),
+	}
+}
+
+func playbackStatus(recorder *httptest.ResponseRecorder) Status {
+	code, err := strconv.Atoi(recorder.Header().Get("Guacamole-Status-Code"))
+	if err != nil {
+		return Success
+	}
+	return FromGuacamoleStatusCode(code)
+}
+
+func TestPlaybackServer_Access(t *testing.T) {
+	server := newPlaybackServer(t)
+	var audits []*PlaybackAudit
+	server.OnPlayback = func(audit *PlaybackAudit) {
+		audits = append(audits, audit)
+	}
+
+	tests := []struct {
+		user, group string
+		status      Status
+	}{
+		{"alice", "", Success},
+		{"bob", "admins", Success},
+		{"bob", "", ClientForbidden},
+		{"", "", ClientUnauthorized},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/session-1", nil)
+		request.Header.Set("X-User", test.user)
+		request.Header.Set("X-Group", test.group)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		if got := playbackStatus(recorder); got != test.status {
+			t.Errorf("%v/%v: expected %v got %v", test.user, test.group, test.status, got)
+		}
+	}
+
+	if len(audits) != 2 || audits[0].Access != PlaybackByOwner || audits[1].Access != PlaybackByAdmin {
+		t.Error("Unexpected audit records", audits)
+	}
+}
+
+func TestPlaybackServer_ShareLink(t *testing.T) {
+	server := newPlaybackServer(t)
+
+	recorder := httptest.NewRecorder()
+	link := server.ShareLink("session-1", time.Now().Add(time.Hour))
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/session-1?"+link, nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "4.sync,1.0;" {
+		t.Error("Expected recording, got", recorder.Code, recorder.Body.String())
+	}
+
+	// a link is only valid for its own recording
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/session-2?"+link, nil))
+	if got := playbackStatus(recorder); got != ClientUnauthorized {
+		t.Error("Expected ClientUnauthorized, got", got)
+	}
+
+	recorder = httptest.NewRecorder()
+	expired := server.ShareLink("session-1", time.Now().Add(-time.Minute))
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/session-1?"+expired, nil))
+	if got := playbackStatus(recorder); got != ClientUnauthorized {
+		t.Error("Expected ClientUnauthorized, got", got)
+	}
+}
+
+func TestPlaybackServer_AuditOncePerViewing(t *testing.T) {
+	server := newPlaybackServer(t)
+	var audits []*PlaybackAudit
+	server.OnPlayback = func(audit *PlaybackAudit) {
+		audits = append(audits, audit)
+	}
+
+	for _, ranges := range []string{"bytes=0-", "bytes=4-7", "bytes=8-"} {
+		request := httptest.NewRequest(http.MethodGet, "/session-1", nil)
+		request.Header.Set("X-User", "alice")
+		request.Header.Set("Range", ranges)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusPartialContent {
+			t.Errorf("Expected partial content for %v, got %v", ranges, recorder.Code)
+		}
+	}
+	if len(audits) != 1 {
+		t.Error("Expected one audit record for the viewing, got", len(audits))
+	}
+}
+
+func TestPlaybackServer_AuditWhateverRange(t *testing.T) {
+	server := newPlaybackServer(t)
+	server.AuditWindow = 50 * time.Millisecond
+	var audits []*PlaybackAudit
+	server.OnPlayback = func(audit *PlaybackAudit) {
+		audits = append(audits, audit)
+	}
+	fetch := func(user, group, ranges string) {
+		request := httptest.NewRequest(http.MethodGet, "/session-1", nil)
+		request.Header.Set("X-User", user)
+		request.Header.Set("X-Group", group)
+		request.Header.Set("Range", ranges)
+		server.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	for _, ranges := range []string{"bytes=-4", "bytes=1-", "bytes=0-1,4-", ""} {
+		audits = nil
+		time.Sleep(60 * time.Millisecond)
+		fetch("alice", "", ranges)
+		if len(audits) != 1 {
+			t.Errorf("Expected a fetch of %q to be audited, got %v records", ranges, len(audits))
+		}
+	}
+
+	audits = nil
+	fetch("alice", "", "bytes=0-")
+	fetch("carol", "admins", "bytes=0-")
+	if len(audits) != 1 || audits[0].Identity.Subject != "carol" {
+		t.Errorf("Expected only the new viewer to be audited within the window, got %v", audits)
+	}
+}
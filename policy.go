@@ -0,0 +1,289 @@
+package guac
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPolicyRefresh is how often a PolicyLoader reloads its bundle when Interval is zero
+const DefaultPolicyRefresh = 5 * time.Minute
+
+// Names of the built-in filters a Policy may install
+const (
+	PolicyNoClipboardUpload   = "no-clipboard-upload"
+	PolicyNoClipboardDownload = "no-clipboard-download"
+	PolicyNoFileUpload        = "no-file-upload"
+	PolicyNoFileDownload      = "no-file-download"
+)
+
+// Policy is a centrally managed set of rules applied to every connection
+type Policy struct {
+	// Serial increases with every published bundle; older bundles are refused
+	Serial int64 `json:"serial"`
+	// AllowedProtocols lists the protocols connections may use, all if empty
+	AllowedProtocols []string `json:"allowed_protocols,omitempty"`
+	// Targets optionally limits the hosts and ports connections may reach
+	Targets *TargetPolicy `json:"targets,omitempty"`
+	// Filters names the built-in filters installed on every tunnel
+	Filters []string `json:"filters,omitempty"`
+	// Limits bounds the size of client streams
+	Limits StreamLimits `json:"limits"`
+	// RecordingPath, if set, makes guacd record every session into this directory
+	RecordingPath string `json:"recording_path,omitempty"`
+	// Rules replace those of the RuleEngine given to the PolicyLoader
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// PolicyBundle is the signed form in which a Policy is distributed
+type PolicyBundle struct {
+	// Policy is the JSON encoded Policy
+	Policy json.RawMessage `json:"policy"`
+	// Signature is the ed25519 signature of Policy
+	Signature []byte `json:"signature"`
+}
+
+// SignPolicy creates a bundle for the policy signed with the given key
+func SignPolicy(policy *Policy, key ed25519.PrivateKey) ([]byte, error) {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&PolicyBundle{
+		Policy:    data,
+		Signature: ed25519.Sign(key, data),
+	})
+}
+
+// ParsePolicyBundle verifies a bundle against the given public keys and returns its policy
+func ParsePolicyBundle(data []byte, keys ...ed25519.PublicKey) (*Policy, error) {
+	var bundle PolicyBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid policy bundle: %w", err)
+	}
+
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, bundle.Policy, bundle.Signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("policy bundle signature is invalid")
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(bundle.Policy, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	for _, name := range policy.Filters {
+		if _, ok := policyFilters[name]; !ok {
+			return nil, fmt.Errorf("unknown policy filter %q", name)
+		}
+	}
+	if err := validateRules(policy.Rules); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if policy.Targets != nil {
+		if err := policy.Targets.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy: %w", err)
+		}
+	}
+	return policy, nil
+}
+
+// Apply checks a connection configuration against the policy before the handshake, and makes
+// guacd record the session if the policy requires it
+func (p *Policy) Apply(config *Config) error {
+	if len(p.AllowedProtocols) > 0 && len(config.ConnectionID) == 0 {
+		allowed := false
+		for _, protocol := range p.AllowedProtocols {
+			if strings.EqualFold(protocol, config.Protocol) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrSecurity.NewError("Protocol not allowed by policy:", config.Protocol)
+		}
+	}
+
+	if p.Targets != nil {
+		if err := p.Targets.Check(context.Background(), config); err != nil {
+			return err
+		}
+	}
+
+	if p.RecordingPath != "" {
+		if config.Parameters == nil {
+			config.Parameters = map[string]string{}
+		}
+		config.Parameters["recording-path"] = p.RecordingPath
+		config.Parameters["create-recording-path"] = "true"
+	}
+	return nil
+}
+
+// Install adds the policy's filters and limits to a tunnel
+func (p *Policy) Install(tunnel *FilteredTunnel) {
+	for _, name := range p.Filters {
+		installPolicyFilter(tunnel, name)
+	}
+	if p.Limits.MaxBlobSize > 0 || p.Limits.MaxClipboardSize > 0 {
+		tunnel.AddWriteFilter(p.Limits.Filter())
+	}
+}
+
+func dropClipboard(Direction, string, io.Reader) (io.Reader, error) {
+	return nil, nil
+}
+
+func refuseFile(direction Direction) FileOpenFunc {
+	return func(transfer *FileTransfer) (io.WriteCloser, error) {
+		if transfer.Direction == direction {
+			return nil, errors.New("file transfer blocked by policy")
+		}
+		return nil, nil
+	}
+}
+
+// policyFilters creates the read and write filters of each of the built-in filters
+var policyFilters = map[string]func(*FilteredTunnel) (read, write []Filter){
+	PolicyNoClipboardUpload: func(t *FilteredTunnel) ([]Filter, []Filter) {
+		return nil, []Filter{NewClipboardFilter(FromClient, dropClipboard)}
+	},
+	PolicyNoClipboardDownload: func(t *FilteredTunnel) ([]Filter, []Filter) {
+		return []Filter{NewClipboardFilter(FromGuacd, dropClipboard)}, nil
+	},
+	PolicyNoFileUpload: func(t *FilteredTunnel) ([]Filter, []Filter) {
+		files := NewFileFilter(t, refuseFile(FromClient))
+		return []Filter{files.ReadFilter()}, []Filter{files.WriteFilter()}
+	},
+	PolicyNoFileDownload: func(t *FilteredTunnel) ([]Filter, []Filter) {
+		files := NewFileFilter(t, refuseFile(FromGuacd))
+		return []Filter{files.ReadFilter()}, []Filter{files.WriteFilter()}
+	},
+}
+
+// installPolicyFilter adds the built-in filter with the given name to the tunnel under that
+// name, returning false if there is no such filter
+func installPolicyFilter(tunnel *FilteredTunnel, name string) bool {
+	filters, ok := policyFilters[name]
+	if ok {
+		read, write := filters(tunnel)
+		tunnel.AddFilters(name, read, write)
+	}
+	return ok
+}
+
+// PolicyLoader loads a signed policy bundle from a file or URL and keeps it up to date.
+// Readers always see a complete policy: a bundle which fails to load or verify leaves the
+// previous policy in place.
+type PolicyLoader struct {
+	// Source is a file path or an http(s) URL
+	Source string
+	// Keys are the public keys bundles may be signed with
+	Keys []ed25519.PublicKey
+	// Interval is the time between reloads made by Run, DefaultPolicyRefresh if zero
+	Interval time.Duration
+	// Client fetches URL sources, http.DefaultClient if nil
+	Client *http.Client
+	// Rules optionally evaluates the Rules of each policy loaded, such as the RuleEngine of
+	// the servers the policy applies to
+	Rules *RuleEngine
+
+	current atomic.Pointer[Policy]
+}
+
+// NewPolicyLoader creates a loader for the bundle at source, signed by one of keys
+func NewPolicyLoader(source string, keys ...ed25519.PublicKey) *PolicyLoader {
+	return &PolicyLoader{
+		Source: source,
+		Keys:   keys,
+	}
+}
+
+// Policy returns the current policy, nil until a bundle has been loaded
+func (l *PolicyLoader) Policy() *Policy {
+	return l.current.Load()
+}
+
+// Load fetches and verifies the bundle, replacing the current policy if it is newer
+func (l *PolicyLoader) Load(ctx context.Context) error {
+	data, err := l.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := ParsePolicyBundle(data, l.Keys...)
+	if err != nil {
+		return err
+	}
+
+	for {
+		current := l.current.Load()
+		if current != nil && policy.Serial < current.Serial {
+			return fmt.Errorf("policy serial %v is older than current serial %v", policy.Serial, current.Serial)
+		}
+		if l.current.CompareAndSwap(current, policy) {
+			if l.Rules != nil {
+				return l.Rules.SetRules(policy.Rules)
+			}
+			return nil
+		}
+	}
+}
+
+// Run reloads the bundle periodically until ctx is done
+func (l *PolicyLoader) Run(ctx context.Context) {
+	interval := l.Interval
+	if interval == 0 {
+		interval = DefaultPolicyRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Load(ctx); err != nil {
+				filtersLog.Warn("Failed to reload policy bundle: ", err)
+			}
+		}
+	}
+}
+
+func (l *PolicyLoader) fetch(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(l.Source, "http://") && !strings.HasPrefix(l.Source, "https://") {
+		return os.ReadFile(l.Source)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, l.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching policy bundle: %v", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
@@ -0,0 +1,154 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPolicyLoader(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "policy.json")
+
+	write := func(policy *Policy, key ed25519.PrivateKey) {
+		data, err := SignPolicy(policy, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loader := NewPolicyLoader(path, public)
+	write(&Policy{Serial: 2, AllowedProtocols: []string{"rdp"}}, private)
+	if err = loader.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if policy := loader.Policy(); policy == nil || policy.Serial != 2 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+
+	// older bundles, bad signatures and unknown filters leave the policy in place
+	write(&Policy{Serial: 1}, private)
+	if err = loader.Load(ctx); err == nil {
+		t.Error("expected older bundle to be refused")
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	write(&Policy{Serial: 3}, otherKey)
+	if err = loader.Load(ctx); err == nil {
+		t.Error("expected bad signature to be refused")
+	}
+	write(&Policy{Serial: 3, Filters: []string{"nope"}}, private)
+	if err = loader.Load(ctx); err == nil {
+		t.Error("expected unknown filter to be refused")
+	}
+	if loader.Policy().Serial != 2 {
+		t.Error("expected policy to be unchanged")
+	}
+
+	write(&Policy{Serial: 4}, private)
+	data, _ := os.ReadFile(path)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	loader.Source = server.URL
+	if err = loader.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if loader.Policy().Serial != 4 {
+		t.Error("expected policy from URL")
+	}
+}
+
+func TestPolicyLoader_Rules(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "policy.json")
+	data, err := SignPolicy(&Policy{Serial: 1, Rules: []Rule{{Name: "notify", On: EventConnect, Do: "notify"}}}, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := NewRuleEngine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fired := make(chan string, 1)
+	engine.Handle("notify", func(_ context.Context, rule *Rule, event *Event) error {
+		fired <- rule.Name
+		return nil
+	})
+	loader := NewPolicyLoader(path, public)
+	loader.Rules = engine
+	if err = loader.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	engine.Fire(&Event{Type: EventConnect, UUID: "1"})
+	select {
+	case name := <-fired:
+		if name != "notify" {
+			t.Errorf("unexpected rule %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the policy's rule to be evaluated")
+	}
+}
+
+func TestPolicy_Apply(t *testing.T) {
+	policy := &Policy{AllowedProtocols: []string{"rdp", "ssh"}, RecordingPath: "/recordings"}
+
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "vnc"
+	if err := policy.Apply(config); err == nil || asErrGuac(err).Status != ClientForbidden {
+		t.Errorf("expected ClientForbidden, got %v", err)
+	}
+
+	config.Protocol = "SSH"
+	if err := policy.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Parameters["recording-path"] != "/recordings" {
+		t.Error("expected recording to be enabled")
+	}
+
+	policy.Targets = &TargetPolicy{Deny: []string{"169.254.0.0/16"}}
+	config.Parameters["hostname"] = "169.254.169.254"
+	if err := policy.Apply(config); err == nil || asErrGuac(err).Kind != ErrSecurity {
+		t.Errorf("expected the target to be refused, got %v", err)
+	}
+}
+
+func TestPolicy_Install(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := NewFilteredTunnel(&fakeTunnel{writer: out})
+	policy := &Policy{Filters: []string{PolicyNoClipboardUpload}}
+	policy.Install(tunnel)
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+	if _, err := writer.Write([]byte("9.clipboard,1.0,10.text/plain;4.blob,1.0,4.aGk=;3.end,1.0;4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "4.sync,1.1;" {
+		t.Errorf("expected clipboard to be blocked, got %q", out.String())
+	}
+}
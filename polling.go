@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// PollDelayHeader is the header of read responses suggesting how many milliseconds the
+	// client should wait before its next read request
+	PollDelayHeader = "Guacamole-Poll-Delay"
+	// ServerLoadHeader is the header of read responses giving the load of the server, from 0
+	// when idle to 1 when at capacity
+	ServerLoadHeader = "Guacamole-Server-Load"
+
+	// DefaultMaxPollDelay is the delay suggested at full load when PollHints.MaxDelay is zero
+	DefaultMaxPollDelay = 2 * time.Second
+)
+
+// PollHints adds headers to read responses telling HTTP long-poll clients how busy the server
+// is, so a client which understands them can back off under load instead of polling at a
+// fixed rate. Clients which don't understand them ignore the headers.
+type PollHints struct {
+	// MinDelay is the delay suggested when the server is idle
+	MinDelay time.Duration
+	// MaxDelay is the delay suggested at full load, DefaultMaxPollDelay if zero
+	MaxDelay time.Duration
+	// Load optionally measures the load of the server between 0 and 1. By default it is the
+	// share of the server's MaxTunnels which are open, or 0 without a limit.
+	Load func() float64
+}
+
+// Delay returns the suggested delay between polls at the given load
+func (h *PollHints) Delay(load float64) time.Duration {
+	max := h.MaxDelay
+	if max == 0 {
+		max = DefaultMaxPollDelay
+	}
+	if max < h.MinDelay {
+		max = h.MinDelay
+	}
+	return h.MinDelay + time.Duration(float64(max-h.MinDelay)*clampLoad(load))
+}
+
+// set adds the hints to the headers of a read response
+func (h *PollHints) set(header http.Header, load float64) {
+	load = clampLoad(load)
+	header.Set(PollDelayHeader, strconv.FormatInt(h.Delay(load).Milliseconds(), 10))
+	header.Set(ServerLoadHeader, strconv.FormatFloat(load, 'f', 2, 64))
+}
+
+func clampLoad(load float64) float64 {
+	if load < 0 || load != load {
+		return 0
+	}
+	if load > 1 {
+		return 1
+	}
+	return load
+}
+
+// load returns the load reported in poll hints
+func (s *Server) load() float64 {
+	if s.PollHints.Load != nil {
+		return s.PollHints.Load()
+	}
+	if s.MaxTunnels <= 0 {
+		return 0
+	}
+	return float64(s.tunnels.Len()) / float64(s.MaxTunnels)
+}
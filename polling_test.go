@@ -0,0 +1,49 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPollHints_Delay(t *testing.T) {
+	hints := &PollHints{MinDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	for load, want := range map[float64]time.Duration{
+		-1:  100 * time.Millisecond,
+		0:   100 * time.Millisecond,
+		0.5: 200 * time.Millisecond,
+		1:   300 * time.Millisecond,
+		2:   300 * time.Millisecond,
+	} {
+		if got := hints.Delay(load); got != want {
+			t.Errorf("Expected %v at load %v, got %v", want, load, got)
+		}
+	}
+	if got := (&PollHints{}).Delay(1); got != DefaultMaxPollDelay {
+		t.Errorf("Expected default max delay, got %v", got)
+	}
+}
+
+func TestServer_PollHints(t *testing.T) {
+	server := NewServer(nil)
+	server.MaxTunnels = 4
+	server.PollHints = &PollHints{}
+
+	id := uuid.New().String()
+	server.registerTunnel(&uuidTunnel{
+		fakeTunnel: fakeTunnel{reader: NewStream(&fakeConn{ToRead: []byte("10.disconnect;")}, time.Minute)},
+		uuid:       id,
+	}, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+id+":0", nil))
+	if got := recorder.Header().Get(ServerLoadHeader); got != "0.25" {
+		t.Errorf("Expected load of 0.25, got %q", got)
+	}
+	if got := recorder.Header().Get(PollDelayHeader); got != "500" {
+		t.Errorf("Expected delay of 500ms, got %q", got)
+	}
+}
@@ -0,0 +1,188 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProbeTimeout bounds the checks of a ProbeServer when its Timeout is zero
+const DefaultProbeTimeout = 3 * time.Second
+
+// HealthChecker is implemented by tunnel registries backed by an external store, such as
+// RedisRegistry and ConsulRegistry, which can report whether the store is reachable
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// ProbeCheck is the outcome of one check of a probe
+type ProbeCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Error is why the check failed, empty if it passed
+	Error string `json:"error,omitempty"`
+}
+
+// ProbeReport is the response of a ProbeServer
+type ProbeReport struct {
+	// Status is "ok", or "unavailable" if the gateway should not be sent new sessions
+	Status string       `json:"status"`
+	Checks []ProbeCheck `json:"checks"`
+}
+
+/*
+ProbeServer serves the liveness and readiness endpoints Kubernetes probes and load balancers
+use to manage the gateway:
+
+	probes := &guac.ProbeServer{Servers: []*guac.Server{servlet}, Backends: []*guac.Backend{backend}}
+	mux.Handle("/healthz", probes)
+	mux.Handle("/readyz", probes)
+
+Requests to a path ending in /readyz are answered 503 Service Unavailable while any of the
+Servers is shutting down, the registry of any of them reports it is unhealthy, or no guacd
+is reachable, so no new sessions are sent to the gateway. Other paths are liveness probes,
+which run the same checks but are always answered 200 OK while the process serves requests,
+so a gateway draining its sessions or waiting on guacd is not restarted. Both respond with a
+ProbeReport.
+*/
+type ProbeServer struct {
+	// Servers are the HTTP tunnel servers of the gateway
+	Servers []*Server
+	// Backends are guacd instances of which at least one must answer a probe
+	Backends []*Backend
+	// BackendSets are sets of which at least one backend must be healthy. Sets with a
+	// HealthCheck report its latest outcome, others are probed.
+	BackendSets []*BackendSet
+	// Checks optionally adds named checks, such as of an identity provider
+	Checks map[string]func(ctx context.Context) error
+	// Timeout bounds the checks, DefaultProbeTimeout if zero
+	Timeout time.Duration
+}
+
+// ServeHTTP answers a liveness or readiness probe
+func (p *ProbeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := p.Check(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" && strings.HasSuffix(r.URL.Path, "/readyz") {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		registryLog.Debugln("Unable to write probe report", err)
+	}
+}
+
+// Check runs the checks of the probes at once, returning their outcome
+func (p *ProbeServer) Check(ctx context.Context) *ProbeReport {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	checks := map[string]func(ctx context.Context) error{}
+	for name, check := range p.Checks {
+		checks[name] = check
+	}
+	for i, server := range p.Servers {
+		server := server
+		checks[indexed("server", i, len(p.Servers))] = func(context.Context) error {
+			if server.ShuttingDown() {
+				return ErrServer.NewError("Shutting down.")
+			}
+			return nil
+		}
+		if checker, ok := server.tunnels.(HealthChecker); ok {
+			checks[indexed("registry", i, len(p.Servers))] = checker.CheckHealth
+		}
+	}
+	if len(p.Backends) > 0 || len(p.BackendSets) > 0 {
+		checks["guacd"] = p.checkGuacd
+	}
+
+	report := &ProbeReport{Status: "ok", Checks: make([]ProbeCheck, 0, len(checks))}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			err := check(ctx)
+			lock.Lock()
+			defer lock.Unlock()
+			result := ProbeCheck{Name: name, OK: err == nil}
+			if err != nil {
+				result.Error = err.Error()
+				report.Status = "unavailable"
+			}
+			report.Checks = append(report.Checks, result)
+		}(name, check)
+	}
+	wg.Wait()
+	sort.Slice(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Name < report.Checks[j].Name
+	})
+	return report
+}
+
+// checkGuacd returns nil if any backend answers a probe or any set has a healthy backend
+func (p *ProbeServer) checkGuacd(ctx context.Context) error {
+	backends := append([]*Backend(nil), p.Backends...)
+	for _, set := range p.BackendSets {
+		if set.HealthCheck == nil {
+			backends = append(backends, set.Backends...)
+			continue
+		}
+		for _, health := range set.Health() {
+			if health.Healthy {
+				return nil
+			}
+		}
+	}
+
+	errs := make(chan error, len(backends))
+	for _, backend := range backends {
+		go func(backend *Backend) {
+			errs <- probeBackend(ctx, backend)
+		}(backend)
+	}
+	var last error = ErrUpstreamUnavailable.NewError("No guacd is healthy.")
+	for range backends {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		last = err
+	}
+	return last
+}
+
+// probeBackend checks guacd at backend answers a select instruction before ctx is done
+func probeBackend(ctx context.Context, backend *Backend) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultProbeTimeout)
+	}
+	check := &HealthCheck{Timeout: time.Until(deadline)}
+	return check.probe(backend)
+}
+
+// indexed names the check of the i'th of n components, omitting the index if there is one
+func indexed(name string, i, n int) string {
+	if n == 1 {
+		return name
+	}
+	return name + "-" + strconv.Itoa(i)
+}
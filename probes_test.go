@@ -0,0 +1,72 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// unhealthyRegistry is a registry whose store is unreachable
+type unhealthyRegistry struct {
+	*TunnelMap
+}
+
+func (unhealthyRegistry) CheckHealth(context.Context) error {
+	return errors.New("store unreachable")
+}
+
+func probeRequest(t *testing.T, probes *ProbeServer, path string) (int, *ProbeReport) {
+	recorder := httptest.NewRecorder()
+	probes.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	report := &ProbeReport{}
+	if err := json.NewDecoder(recorder.Body).Decode(report); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, report
+}
+
+func TestProbeServer(t *testing.T) {
+	dialer := &farmDialer{down: map[string]bool{}}
+	server := NewServer(nil)
+	probes := &ProbeServer{
+		Servers:  []*Server{server},
+		Backends: []*Backend{{Address: "a", Dialer: dialer}, {Address: "b", Dialer: dialer}},
+	}
+
+	code, report := probeRequest(t, probes, "/readyz")
+	if code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 2 {
+		t.Errorf("Expected to be ready, got %v %+v", code, report)
+	}
+
+	dialer.Lock()
+	dialer.down["a"] = true
+	dialer.Unlock()
+	if code, _ = probeRequest(t, probes, "/readyz"); code != http.StatusOK {
+		t.Error("Expected one reachable guacd to be enough, got", code)
+	}
+	dialer.Lock()
+	dialer.down["b"] = true
+	dialer.Unlock()
+	if code, report = probeRequest(t, probes, "/readyz"); code != http.StatusServiceUnavailable || report.Checks[0].Name != "guacd" || report.Checks[0].OK {
+		t.Errorf("Expected not to be ready without guacd, got %v %+v", code, report)
+	}
+	if code, report = probeRequest(t, probes, "/healthz"); code != http.StatusOK || report.Status != "unavailable" {
+		t.Errorf("Expected to be live while reporting guacd down, got %v %+v", code, report)
+	}
+
+	dialer.Lock()
+	dialer.down = map[string]bool{}
+	dialer.Unlock()
+	server.Shutdown(context.Background())
+	if code, report = probeRequest(t, probes, "/readyz"); code != http.StatusServiceUnavailable || report.Checks[1].OK {
+		t.Errorf("Expected not to be ready while shutting down, got %v %+v", code, report)
+	}
+
+	probes = &ProbeServer{Servers: []*Server{NewServerWithRegistry(nil, unhealthyRegistry{NewTunnelMap()})}}
+	if code, report = probeRequest(t, probes, "/readyz"); code != http.StatusServiceUnavailable || report.Checks[0].Name != "registry" || report.Checks[0].Error != "store unreachable" {
+		t.Errorf("Expected not to be ready with the registry down, got %v %+v", code, report)
+	}
+}
@@ -0,0 +1,133 @@
+package guac
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// SessionQuota limits how many tunnels each user may hold open at once. Tunnels are counted
+// under a key extracted from the connect request, and connects beyond the limit of their key
+// are refused with ClientTooMany, the status Guacamole uses when a user has too many
+// connections.
+type SessionQuota struct {
+	// Key returns the key a connect request is counted under, the Subject of its identity if
+	// nil. Requests with an empty key are not limited.
+	Key func(r *http.Request, identity *Identity) string
+	// Max is the number of tunnels a key may hold, zero for no limit
+	Max int
+	// Limit optionally returns the number of tunnels the given key may hold, overriding Max.
+	// A limit of zero allows the key no tunnels, and one below zero means no limit.
+	Limit func(key string) int
+
+	sync.Mutex
+	// held counts the tunnels held under each key, and tunnels maps the UUIDs of registered
+	// tunnels to their keys
+	held    map[string]int
+	tunnels map[string]string
+}
+
+// NewSessionQuota creates a quota allowing each user max tunnels, keyed by identity Subject
+func NewSessionQuota(max int) *SessionQuota {
+	return &SessionQuota{Max: max}
+}
+
+// Held returns the number of tunnels held under the given key
+func (q *SessionQuota) Held(key string) int {
+	q.Lock()
+	defer q.Unlock()
+	return q.held[key]
+}
+
+// key returns the key of a connect request
+func (q *SessionQuota) key(r *http.Request, identity *Identity) string {
+	if q.Key != nil {
+		return q.Key(r, identity)
+	}
+	if identity == nil {
+		return ""
+	}
+	return identity.Subject
+}
+
+// limit returns the number of tunnels the given key may hold, below zero for no limit
+func (q *SessionQuota) limit(key string) int {
+	if q.Limit != nil {
+		return q.Limit(key)
+	}
+	return unlimitedIfZero(q.Max)
+}
+
+// unlimitedIfZero returns max, or -1 for no limit if it is zero
+func unlimitedIfZero(max int) int {
+	if max == 0 {
+		return -1
+	}
+	return max
+}
+
+// acquire counts a tunnel under the key of the connect request, failing if the key holds as
+// many as it may, in which case the key is returned along with the error. Otherwise the key
+// returned must be released if the tunnel is not opened, or bound to it if it is. A max of
+// zero or more, resolved from a LimitHierarchy, replaces the quota's own limit unless it has
+// a Limit function, zero meaning no limit. Refusals are logged to log.
+func (q *SessionQuota) acquire(r *http.Request, identity *Identity, max int, log *subsystemLogger) (string, error) {
+	key := q.key(r, identity)
+	if key == "" {
+		return "", nil
+	}
+	limit := q.limit(key)
+	if max >= 0 && q.Limit == nil {
+		limit = unlimitedIfZero(max)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if limit >= 0 && q.held[key] >= limit {
+		log.Warnf("Refusing connect request, %v holds %v tunnels.", key, q.held[key])
+		return key, ErrClientTooMany.NewError(fmt.Sprintf("Too many connections, at most %v are allowed.", limit))
+	}
+	if q.held == nil {
+		q.held = map[string]int{}
+	}
+	q.held[key]++
+	return key, nil
+}
+
+// release stops counting a tunnel under the given key
+func (q *SessionQuota) release(key string) {
+	if key == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.held[key] <= 1 {
+		delete(q.held, key)
+	} else {
+		q.held[key]--
+	}
+}
+
+// bind records the key a registered tunnel is counted under, to release once it closes
+func (q *SessionQuota) bind(uuid, key string) {
+	if key == "" {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.tunnels == nil {
+		q.tunnels = map[string]string{}
+	}
+	q.tunnels[uuid] = key
+}
+
+// closed releases the key a registered tunnel was counted under, if it hasn't been already
+func (q *SessionQuota) closed(uuid string) {
+	q.Lock()
+	key, ok := q.tunnels[uuid]
+	delete(q.tunnels, uuid)
+	q.Unlock()
+	if ok {
+		q.release(key)
+	}
+}
@@ -0,0 +1,66 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestServer_Quota(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{uuid: uuid.NewString()}, nil
+	})
+	server.Authorizer = AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+		return &Identity{Subject: r.Header.Get("User")}, nil
+	})
+	server.Quota = NewSessionQuota(1)
+	server.Quota.Limit = func(key string) int {
+		switch key {
+		case "admin":
+			return -1
+		case "suspended":
+			return 0
+		}
+		return server.Quota.Max
+	}
+
+	connect := func(user string) *httptest.ResponseRecorder {
+		request := connectRequest("")
+		request.Header.Set("User", user)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	first := connect("alice")
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected first connect to succeed, got %v", first.Code)
+	}
+	if recorder := connect("alice"); recorder.Code != ClientTooMany.GetHTTPStatusCode() ||
+		recorder.Header().Get("Guacamole-Status-Code") != "797" {
+		t.Errorf("Expected second connect to be refused, got %v %v", recorder.Code, recorder.Header())
+	}
+	if recorder := connect("bob"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected another user to connect, got %v", recorder.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if recorder := connect("admin"); recorder.Code != http.StatusOK {
+			t.Errorf("Expected unlimited user to connect, got %v", recorder.Code)
+		}
+	}
+	if recorder := connect("suspended"); recorder.Code != ClientTooMany.GetHTTPStatusCode() {
+		t.Errorf("Expected a user with a limit of zero to be refused, got %v", recorder.Code)
+	}
+
+	if err := server.KillTunnel(first.Body.String(), "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if held := server.Quota.Held("alice"); held != 0 {
+		t.Errorf("Expected closed tunnel to be released, %v held", held)
+	}
+	if recorder := connect("alice"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected connect after closing to succeed, got %v", recorder.Code)
+	}
+}
@@ -0,0 +1,76 @@
+package guac
+
+import (
+	"context"
+	"time"
+)
+
+// ReaderContextAcquirer is implemented by tunnels whose reader can be waited for until a
+// context is done. Read requests get the reader in the order they asked for it.
+type ReaderContextAcquirer interface {
+	AcquireReaderContext(ctx context.Context) (InstructionReader, error)
+}
+
+// AcquireReader acquires the reader of any tunnel, waiting for the turn of the caller until
+// ctx is done, at which point it fails with ServerBusy, unless the tunnel can only wait
+// indefinitely. A reader acquired must be released with ReleaseReader.
+func AcquireReader(ctx context.Context, tunnel Tunnel) (InstructionReader, error) {
+	if acquirer, ok := tunnel.(ReaderContextAcquirer); ok {
+		return acquirer.AcquireReaderContext(ctx)
+	}
+	return tunnel.AcquireReader(), nil
+}
+
+// readWaitError is the error of a read which gave up waiting for its turn
+func readWaitError(err error) error {
+	return ErrServerBusy.NewError("Gave up waiting to read from tunnel:", err.Error())
+}
+
+// AcquireReaderContext acquires the reader once the read requests ahead of it are done,
+// failing if ctx is done first.
+func (t *SimpleTunnel) AcquireReaderContext(ctx context.Context) (InstructionReader, error) {
+	if err := t.readerLock.lockContext(ctx); err != nil {
+		return nil, readWaitError(err)
+	}
+	return t.stream, nil
+}
+
+// AcquireReaderContext acquires the wrapped reader, failing if ctx is done first, and applies
+// the read filters to it
+func (t *FilteredTunnel) AcquireReaderContext(ctx context.Context) (InstructionReader, error) {
+	reader, err := AcquireReader(ctx, t.Tunnel)
+	if err != nil {
+		return nil, err
+	}
+	return &filteredReader{reader: reader, tunnel: t}, nil
+}
+
+// AcquireReaderContext acquires the wrapped tunnel's reader, failing if ctx is done first,
+// wrapped by WrapReader if set
+func (t *DelegatingTunnel) AcquireReaderContext(ctx context.Context) (InstructionReader, error) {
+	reader, err := AcquireReader(ctx, t.Tunnel)
+	if err != nil {
+		return nil, err
+	}
+	if t.WrapReader != nil {
+		return t.WrapReader(reader), nil
+	}
+	return reader, nil
+}
+
+// AcquireReaderContext acquires the reader of the registered tunnel, recording that a client
+// is reading, failing if ctx is done first
+func (t *LastAccessedTunnel) AcquireReaderContext(ctx context.Context) (InstructionReader, error) {
+	t.Lock()
+	t.readers++
+	t.lastRead = time.Now()
+	t.Unlock()
+	reader, err := AcquireReader(ctx, t.Tunnel)
+	if err != nil {
+		t.Lock()
+		t.readers--
+		t.Unlock()
+		return nil, err
+	}
+	return reader, nil
+}
@@ -0,0 +1,117 @@
+package guac
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimpleTunnel_AcquireReaderContext(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+
+	tunnel.AcquireReader()
+	order := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			if _, err := AcquireReader(context.Background(), tunnel); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			tunnel.ReleaseReader()
+		}(i)
+		for tunnel.readerLock.count.Load() != int32(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := AcquireReader(ctx, tunnel); asErrGuac(err).Status != ServerBusy {
+		t.Error("Expected a read waiting too long to fail with ServerBusy, got", err)
+	}
+
+	tunnel.ReleaseReader()
+	for expected := 1; expected <= 3; expected++ {
+		if i := <-order; i != expected {
+			t.Errorf("Expected reader %v to go next, got %v", expected, i)
+		}
+	}
+}
+
+func TestServer_MaxReadWait(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.MaxReadWait = 10 * time.Millisecond
+	server.registerTunnel(tunnel, nil, nil)
+
+	tunnel.AcquireReader()
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":0", nil))
+	if recorder.Code != ServerBusy.GetHTTPStatusCode() {
+		t.Error("Expected the read to be refused, got", recorder.Code)
+	}
+	if _, ok := server.tunnels.Get(tunnel.GetUUID()); !ok {
+		t.Error("Expected the tunnel to stay open")
+	}
+	tunnel.ReleaseReader()
+}
+
+func TestServer_OverlappingReads(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.registerTunnel(tunnel, nil, nil)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	read := func() *http.Response {
+		response, err := http.Get(httpServer.URL + "/tunnel?read:" + tunnel.GetUUID() + ":0")
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return response
+	}
+	first := read()
+	if first == nil {
+		t.FailNow()
+	}
+	defer first.Body.Close()
+	second := make(chan *http.Response, 1)
+	go func() {
+		second <- read()
+	}()
+	for !tunnel.HasQueuedReaderThreads() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first read hands over to the second once it has sent what guacd sent
+	_, _ = guacd.Write([]byte("4.sync,1.1;"))
+	body, _ := io.ReadAll(first.Body)
+	if string(body) != "4.sync,1.1;0.;" {
+		t.Errorf("Unexpected first read %q", body)
+	}
+
+	response := <-second
+	if response == nil {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+	_, _ = guacd.Write([]byte("4.sync,1.2;"))
+	line, _ := bufio.NewReader(response.Body).ReadString(';')
+	if !strings.HasSuffix(line, "4.sync,1.2;") {
+		t.Errorf("Unexpected second read %q", line)
+	}
+}
@@ -0,0 +1,76 @@
+package guac
+
+import "sync"
+
+// readOnlyStreams maps the opcodes of client instructions opening input streams to the
+// position of the stream index in their arguments
+var readOnlyStreams = map[string]int{
+	OpcodeArgv:      0,
+	OpcodeAudio:     0,
+	OpcodeClipboard: 0,
+	OpcodeFile:      0,
+	OpcodePipe:      0,
+	OpcodePut:       1,
+}
+
+// readOnlyInput are the client instructions affecting the remote session directly
+var readOnlyInput = map[string]bool{
+	OpcodeKey:   true,
+	OpcodeMouse: true,
+	OpcodeSize:  true,
+	OpcodeTouch: true,
+}
+
+// ReadOnlyFilter is a write Filter dropping every client instruction which could affect the
+// remote session: input events, display resizes, and clipboard, file, pipe, audio and argv
+// streams. Unlike guacd's own read-only mode, it is enforced by the gateway and so holds
+// even for a modified client.
+type ReadOnlyFilter struct {
+	sync.Mutex
+	// dropped holds the indices of streams whose blobs are being dropped
+	dropped map[string]bool
+}
+
+// NewReadOnlyFilter creates a read-only filter
+func NewReadOnlyFilter() *ReadOnlyFilter {
+	return &ReadOnlyFilter{dropped: map[string]bool{}}
+}
+
+// MakeReadOnly wraps a tunnel, if it is not already a FilteredTunnel, and makes it read-only
+func MakeReadOnly(tunnel Tunnel) *FilteredTunnel {
+	filtered, ok := tunnel.(*FilteredTunnel)
+	if !ok {
+		filtered = NewFilteredTunnel(tunnel)
+	}
+	filtered.AddWriteFilter(NewReadOnlyFilter())
+	return filtered
+}
+
+// Filter drops input instructions and the streams opened by the client
+func (f *ReadOnlyFilter) Filter(instruction *Instruction) (*Instruction, error) {
+	if readOnlyInput[instruction.Opcode] {
+		return nil, nil
+	}
+
+	if position, ok := readOnlyStreams[instruction.Opcode]; ok {
+		if position < len(instruction.Args) {
+			f.Lock()
+			f.dropped[instruction.Args[position]] = true
+			f.Unlock()
+		}
+		filtersLog.Debugf("Dropped %v stream from read-only client.", instruction.Opcode)
+		return nil, nil
+	}
+
+	if (instruction.Opcode == OpcodeBlob || instruction.Opcode == OpcodeEnd) && len(instruction.Args) > 0 {
+		f.Lock()
+		defer f.Unlock()
+		if f.dropped[instruction.Args[0]] {
+			if instruction.Opcode == OpcodeEnd {
+				delete(f.dropped, instruction.Args[0])
+			}
+			return nil, nil
+		}
+	}
+	return instruction, nil
+}
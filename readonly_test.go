@@ -0,0 +1,25 @@
+package guac
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadOnlyFilter(t *testing.T) {
+	out := &bytes.Buffer{}
+	tunnel := MakeReadOnly(&fakeTunnel{writer: out})
+
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+
+	in := "5.mouse,1.1,1.2,1.1;3.key,2.65,1.1;4.size,4.1024,3.768;" +
+		"9.clipboard,1.0,10.text/plain;4.blob,1.0,4.YWJj;3.end,1.0;" +
+		"3.put,1.1,1.2,10.text/plain,5.a.txt;4.blob,1.2,4.YWJj;3.end,1.2;" +
+		"4.sync,1.5;3.ack,1.3,2.OK,1.0;10.disconnect;"
+	if _, err := writer.Write([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "4.sync,1.5;3.ack,1.3,2.OK,1.0;10.disconnect;"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package guac
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultReaderTimeout is how long a tunnel may go without a read request before a Reaper
+	// closes it, when its ReaderTimeout is zero
+	DefaultReaderTimeout = 30 * time.Second
+	// DefaultReapInterval is how often a Reaper checks tunnels when its Interval is zero
+	DefaultReapInterval = 5 * time.Second
+)
+
+// reaperProbeTimeout is how long a probe waits to tell a quiet guacd from a dead one
+const reaperProbeTimeout = 10 * time.Millisecond
+
+// Reaper closes the tunnels of a Server whose transports have died, rather than waiting for
+// the next read or write to fail. A tunnel is dead once no read request has held its reader
+// for ReaderTimeout, meaning the client has gone, or once its connection to guacd has
+// failed. The connection of a tunnel nobody is reading is probed without consuming what
+// guacd has sent, which is kept for the next read. A read request arriving during a probe
+// waits for it, briefly.
+//
+// Unlike the idle timeout of a TunnelMap, a client which keeps writing without reading is
+// still considered gone.
+type Reaper struct {
+	// ReaderTimeout is how long a tunnel may go without a read request, DefaultReaderTimeout
+	// if zero
+	ReaderTimeout time.Duration
+	// Interval is how often tunnels are checked, DefaultReapInterval if zero
+	Interval time.Duration
+	// OnReap is an optional callback run with each tunnel reaped and why
+	OnReap func(uuid string, cause error)
+
+	initOnce, startOnce, stopOnce sync.Once
+	stop                          chan struct{}
+	reaped                        atomic.Int64
+}
+
+// Reaped returns the number of tunnels reaped so far
+func (r *Reaper) Reaped() int64 {
+	return r.reaped.Load()
+}
+
+// Stop stops checking tunnels
+func (r *Reaper) Stop() {
+	r.init()
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+func (r *Reaper) init() {
+	r.initOnce.Do(func() {
+		r.stop = make(chan struct{})
+	})
+}
+
+// start checks the tunnels of the server every Interval until stopped. It is called as each
+// tunnel is registered, and only starts once.
+func (r *Reaper) start(s *Server) {
+	r.init()
+	r.startOnce.Do(func() {
+		interval := r.Interval
+		if interval <= 0 {
+			interval = DefaultReapInterval
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-r.stop:
+					return
+				case <-ticker.C:
+					r.reap(s)
+				}
+			}
+		}()
+	})
+}
+
+// reap closes the dead tunnels of the server, returning how many it closed
+func (r *Reaper) reap(s *Server) int {
+	timeout := r.ReaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultReaderTimeout
+	}
+	now := time.Now()
+
+	reaped := 0
+	s.tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		reading, lastRead := tunnel.readState()
+		if reading {
+			return true
+		}
+		var cause error
+		if now.Sub(lastRead) > timeout {
+			cause = ErrClientTimeout.NewError("No read request for", now.Sub(lastRead).Round(time.Second).String())
+		} else {
+			cause = probe(tunnel)
+		}
+		if cause == nil {
+			return true
+		}
+
+		registryLog.Infof("Reaping dead tunnel %v: %v", uuid, cause)
+		tunnel.setKilled(tunnel.closedBy(CloseReaped, asErrGuac(cause).Status))
+		s.deregisterTunnel(tunnel, cause)
+		if err := tunnel.Close(); err != nil {
+			registryLog.Debug("Unable to close reaped tunnel.", err)
+		}
+		r.reaped.Add(1)
+		reaped++
+		if r.OnReap != nil {
+			r.OnReap(uuid, cause)
+		}
+		return true
+	})
+	return reaped
+}
+
+// AcquireReader acquires the reader of the tunnel, recording that a client is reading
+func (t *LastAccessedTunnel) AcquireReader() InstructionReader {
+	t.Lock()
+	t.readers++
+	t.lastRead = time.Now()
+	t.Unlock()
+	return t.Tunnel.AcquireReader()
+}
+
+// ReleaseReader releases the reader of the tunnel
+func (t *LastAccessedTunnel) ReleaseReader() {
+	t.Tunnel.ReleaseReader()
+	t.Lock()
+	t.readers--
+	t.lastRead = time.Now()
+	t.Unlock()
+}
+
+// readState returns whether a client is reading the tunnel, and when one last did. A tunnel
+// never read counts as read when it was registered.
+func (t *LastAccessedTunnel) readState() (bool, time.Time) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.lastRead.IsZero() {
+		return t.readers > 0, t.created
+	}
+	return t.readers > 0, t.lastRead
+}
+
+// prober is implemented by readers which can check their connection to guacd
+type prober interface {
+	// probe returns an error if the connection has failed, reading whatever has arrived into
+	// the reader's buffer. It waits at most the given time for guacd.
+	probe(wait time.Duration) error
+}
+
+// probe checks the connection to guacd of a tunnel nobody is reading, returning nil if it is
+// alive or can't be checked
+func probe(tunnel *LastAccessedTunnel) error {
+	// the reaper isn't a read request, so it takes the reader of the underlying tunnel
+	reader := tunnel.Tunnel.AcquireReader()
+	defer tunnel.Tunnel.ReleaseReader()
+	if p, ok := reader.(prober); ok {
+		return p.probe(reaperProbeTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package guac
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReaper(t *testing.T) {
+	server := NewServer(nil)
+	var reaped []string
+	reaper := &Reaper{ReaderTimeout: time.Hour, OnReap: func(uuid string, cause error) {
+		reaped = append(reaped, uuid)
+	}}
+	server.Reaper = reaper
+	defer reaper.Stop()
+
+	register := func() (Tunnel, net.Conn) {
+		client, guacd := net.Pipe()
+		tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+		server.registerTunnel(tunnel, nil, nil)
+		return tunnel, guacd
+	}
+
+	alive, aliveGuacd := register()
+	defer aliveGuacd.Close()
+	go func() {
+		_, _ = aliveGuacd.Write([]byte("4.sync,1.1;"))
+	}()
+	dead, deadGuacd := register()
+	_ = deadGuacd.Close()
+
+	if n := reaper.reap(server); n != 1 || len(reaped) != 1 || reaped[0] != dead.GetUUID() {
+		t.Fatalf("Expected the tunnel whose guacd closed to be reaped, reaped %v %v", n, reaped)
+	}
+	if _, ok := server.tunnels.Get(alive.GetUUID()); !ok {
+		t.Fatal("Expected the live tunnel to be kept")
+	}
+
+	// what the probe read from guacd is kept for the client
+	recorder := httptest.NewRecorder()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = aliveGuacd.Close()
+	}()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+alive.GetUUID()+":0", nil))
+	if body := recorder.Body.String(); len(body) < 11 || body[:11] != "4.sync,1.1;" {
+		t.Errorf("Expected the probed instruction to be read, got %q", body)
+	}
+}
+
+func TestReaper_ReaderTimeout(t *testing.T) {
+	server := NewServer(nil)
+	reaper := &Reaper{ReaderTimeout: time.Millisecond}
+	server.Reaper = reaper
+	defer reaper.Stop()
+
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	registered := server.registerTunnel(tunnel, nil, nil)
+
+	registered.AcquireReader()
+	time.Sleep(5 * time.Millisecond)
+	if n := reaper.reap(server); n != 0 {
+		t.Fatal("Expected a tunnel being read not to be reaped")
+	}
+	registered.ReleaseReader()
+
+	time.Sleep(5 * time.Millisecond)
+	if n := reaper.reap(server); n != 1 || reaper.Reaped() != 1 {
+		t.Fatalf("Expected the tunnel nobody read to be reaped, reaped %v", n)
+	}
+	if _, ok := server.tunnels.Get(tunnel.GetUUID()); ok {
+		t.Error("Expected the reaped tunnel to be deregistered")
+	}
+}
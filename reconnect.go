@@ -0,0 +1,253 @@
+package guac
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultReconnectRetries is the number of attempts a ReconnectingTunnel makes to rejoin its
+// connection when its Retries is zero
+const DefaultReconnectRetries = 5
+
+// ReconnectingTunnel is a tunnel which rejoins its connection when the socket to guacd drops
+// mid-session, rather than failing. As guacd keeps a connection open for as long as any user
+// is joined, and for a short while after the last leaves, the session carries on from where
+// it was, with guacd sending the client the state of the display again. Attempts to rejoin
+// are spaced with exponential backoff and the error is only returned once they are used up.
+//
+// Only the loss of the socket is recovered from: once guacd ends the session with a
+// disconnect or error instruction, the tunnel ends as any other. Instructions written while
+// the socket is down fail.
+type ReconnectingTunnel struct {
+	backend *Backend
+	config  Config
+	uuid    uuid.UUID
+
+	// Retries is the number of attempts to rejoin after each drop, DefaultReconnectRetries if
+	// zero
+	Retries int
+	// Backoff is the delay before the second attempt, doubling with each further attempt,
+	// DefaultRetryBackoff if zero. The first attempt is made at once.
+	Backoff time.Duration
+	// Budget limits attempts, DefaultRetryBudget if nil
+	Budget *RetryBudget
+	// OnReconnect is an optional callback run once the connection has been rejoined
+	OnReconnect func(connectionID string)
+
+	readerLock fairLock
+	writerLock fairLock
+
+	sync.Mutex
+	stream *Stream
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewReconnectingTunnel connects to guacd through backend with config, returning a tunnel
+// which rejoins the connection through backend if the socket drops
+func NewReconnectingTunnel(ctx context.Context, backend *Backend, config *Config) (*ReconnectingTunnel, error) {
+	stream, err := backend.Connect(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	t := &ReconnectingTunnel{
+		backend: backend,
+		config:  *config,
+		uuid:    uuid.New(),
+		stream:  stream,
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t, nil
+}
+
+// current returns the stream in use
+func (t *ReconnectingTunnel) current() *Stream {
+	t.Lock()
+	defer t.Unlock()
+	return t.stream
+}
+
+// AcquireReader acquires the reader lock
+func (t *ReconnectingTunnel) AcquireReader() InstructionReader {
+	t.readerLock.Lock()
+	return &reconnectingReader{tunnel: t}
+}
+
+// AcquireReaderContext acquires the reader once the read requests ahead of it are done,
+// failing if ctx is done first
+func (t *ReconnectingTunnel) AcquireReaderContext(ctx context.Context) (InstructionReader, error) {
+	if err := t.readerLock.lockContext(ctx); err != nil {
+		return nil, readWaitError(err)
+	}
+	return &reconnectingReader{tunnel: t}, nil
+}
+
+// ReleaseReader releases the reader
+func (t *ReconnectingTunnel) ReleaseReader() {
+	t.readerLock.Unlock()
+}
+
+// HasQueuedReaderThreads returns true if more than one goroutine is trying to read
+func (t *ReconnectingTunnel) HasQueuedReaderThreads() bool {
+	return t.readerLock.HasQueued()
+}
+
+// AcquireWriter locks the writer lock
+func (t *ReconnectingTunnel) AcquireWriter() io.Writer {
+	t.writerLock.Lock()
+	return reconnectingWriter{tunnel: t}
+}
+
+// ReleaseWriter releases the writer lock
+func (t *ReconnectingTunnel) ReleaseWriter() {
+	t.writerLock.Unlock()
+}
+
+// HasQueuedWriterThreads returns true if more than one goroutine is trying to write
+func (t *ReconnectingTunnel) HasQueuedWriterThreads() bool {
+	return t.writerLock.HasQueued()
+}
+
+// WriteInstruction sends an instruction to guacd once the writers ahead of it are done,
+// failing if that takes longer than DefaultWriteTimeout.
+func (t *ReconnectingTunnel) WriteInstruction(instruction *Instruction) error {
+	return writeWithTimeout(t, instruction)
+}
+
+// WriteInstructionContext sends an instruction to guacd once the writers ahead of it are done,
+// failing if ctx is done first.
+func (t *ReconnectingTunnel) WriteInstructionContext(ctx context.Context, instruction *Instruction) error {
+	if err := t.writerLock.lockContext(ctx); err != nil {
+		return writeWaitError(err)
+	}
+	defer t.writerLock.Unlock()
+	_, err := t.current().Write(instruction.Byte())
+	return err
+}
+
+// ConnectionID returns the ID of the connection, which stays the same across reconnects
+func (t *ReconnectingTunnel) ConnectionID() string {
+	return t.current().ConnectionID
+}
+
+// GetUUID returns the tunnel's UUID
+func (t *ReconnectingTunnel) GetUUID() string {
+	return t.uuid.String()
+}
+
+// Close closes the socket to guacd and stops any attempt to rejoin
+func (t *ReconnectingTunnel) Close() error {
+	t.Lock()
+	t.closed = true
+	stream := t.stream
+	t.Unlock()
+	t.cancel()
+	return stream.Close()
+}
+
+// shouldReconnect returns true if reading from stream failed with err because the socket
+// dropped rather than because guacd ended the session
+func shouldReconnect(stream *Stream, err error) bool {
+	return !stream.ended && CloseReasonOf(err) != CloseEOF && isTransient(err)
+}
+
+// reconnect rejoins the connection of the dropped stream, unless it was already replaced.
+// Writers are held off meanwhile, so nothing is written to either socket half way.
+func (t *ReconnectingTunnel) reconnect(dropped *Stream, cause error) error {
+	t.writerLock.Lock()
+	defer t.writerLock.Unlock()
+
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return cause
+	}
+	if t.stream != dropped {
+		t.Unlock()
+		return nil
+	}
+	t.Unlock()
+	_ = dropped.Close()
+
+	join := t.config
+	join.ConnectionID = dropped.ConnectionID
+	retries := t.Retries
+	if retries == 0 {
+		retries = DefaultReconnectRetries
+	}
+	transportLog.Warnf("Connection to guacd for %v dropped, rejoining: %v", dropped.ConnectionID, cause)
+
+	var stream *Stream
+	err := retry(t.ctx, t.Budget, retries-1, t.Backoff, isTransient, func() (e error) {
+		stream, e = t.backend.Connect(t.ctx, &join)
+		return
+	})
+	if err != nil {
+		transportLog.Warnf("Unable to rejoin connection %v: %v", dropped.ConnectionID, err)
+		return cause
+	}
+
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		_ = stream.Close()
+		return cause
+	}
+	t.stream = stream
+	t.Unlock()
+	transportLog.Infof("Rejoined connection %v.", stream.ConnectionID)
+	if t.OnReconnect != nil {
+		t.OnReconnect(stream.ConnectionID)
+	}
+	return nil
+}
+
+// reconnectingReader reads from the current stream of its tunnel, rejoining the connection
+// if the socket drops
+type reconnectingReader struct {
+	tunnel *ReconnectingTunnel
+}
+
+// ReadSome returns the next instruction from guacd, rejoining and reading from the new socket
+// if the current one drops
+func (r *reconnectingReader) ReadSome() ([]byte, error) {
+	for {
+		stream := r.tunnel.current()
+		message, err := stream.ReadSome()
+		if err == nil || !shouldReconnect(stream, err) {
+			return message, err
+		}
+		if err = r.tunnel.reconnect(stream, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Available returns true if the current stream has buffered data
+func (r *reconnectingReader) Available() bool {
+	return r.tunnel.current().Available()
+}
+
+// Flush flushes the current stream
+func (r *reconnectingReader) Flush() {
+	r.tunnel.current().Flush()
+}
+
+// probe checks the connection of the current stream
+func (r *reconnectingReader) probe(wait time.Duration) error {
+	return r.tunnel.current().probe(wait)
+}
+
+// reconnectingWriter writes to the current stream of its tunnel
+type reconnectingWriter struct {
+	tunnel *ReconnectingTunnel
+}
+
+func (w reconnectingWriter) Write(data []byte) (int, error) {
+	return w.tunnel.current().Write(data)
+}
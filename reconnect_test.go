@@ -0,0 +1,79 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// droppingDialer connects to a fake guacd which sends one sync instruction on each connection
+// before the socket drops, refusing connections once it runs out
+type droppingDialer struct {
+	syncs []string
+	conns []*fakeConn
+}
+
+func (d *droppingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if len(d.conns) >= len(d.syncs) {
+		return nil, ErrUpstreamUnavailable.NewError("refused")
+	}
+	conn := &fakeConn{
+		ToRead: []byte(NewInstruction(OpcodeArgs, "VERSION_1_5_0").String() +
+			NewInstruction(OpcodeReady, "$abc").String() +
+			NewInstruction(OpcodeSync, d.syncs[len(d.conns)]).String()),
+	}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+func TestReconnectingTunnel(t *testing.T) {
+	dialer := &droppingDialer{syncs: []string{"1", "2"}}
+	backend := &Backend{Dialer: dialer}
+	tunnel, err := NewReconnectingTunnel(context.Background(), backend, NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	tunnel.Retries = 2
+	tunnel.Backoff = 1
+	tunnel.Budget = NewRetryBudget(0, 10)
+	var rejoined string
+	tunnel.OnReconnect = func(connectionID string) {
+		rejoined = connectionID
+	}
+
+	reader := tunnel.AcquireReader()
+	for _, want := range []string{"4.sync,1.1;", "4.sync,1.2;"} {
+		message, err := reader.ReadSome()
+		if err != nil || string(message) != want {
+			t.Fatalf("Expected %q, got %q, %v", want, message, err)
+		}
+	}
+	if rejoined != "$abc" || !strings.HasPrefix(string(dialer.conns[1].Written), "6.select,4.$abc;") {
+		t.Errorf("Expected the connection to be rejoined, got %q, sent %q", rejoined, dialer.conns[1].Written)
+	}
+	if !dialer.conns[0].Closed {
+		t.Error("Expected the dropped socket to be closed")
+	}
+
+	// once rejoining fails the drop is returned
+	if _, err = reader.ReadSome(); err == nil || asErrGuac(err).Kind != ErrConnectionClosed {
+		t.Error("Expected the connection to be closed, got", err)
+	}
+	tunnel.ReleaseReader()
+	if tunnel.ConnectionID() != "$abc" {
+		t.Error("Unexpected connection ID", tunnel.ConnectionID())
+	}
+}
+
+func TestReconnectingTunnel_Ended(t *testing.T) {
+	stream := NewStream(&fakeConn{ToRead: []byte("10.disconnect;")}, SocketTimeout)
+	if _, err := stream.ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := stream.ReadSome()
+	if shouldReconnect(stream, err) {
+		t.Error("Expected a session ended by guacd not to be rejoined")
+	}
+}
@@ -0,0 +1,169 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedValue replaces the values of sensitive parameters wherever they are formatted
+const RedactedValue = "********"
+
+// SensitiveParameters lists fragments of the names of connection parameters whose values are
+// never logged or reported, such as "password" for both password and sftp-password. It may be
+// added to before connections are made.
+var SensitiveParameters = []string{"password", "passphrase", "private-key", "client-key", "token", "secret"}
+
+// IsSensitiveParameter returns true if the value of the named parameter must be redacted
+func IsSensitiveParameter(name string) bool {
+	name = strings.ToLower(name)
+	for _, fragment := range SensitiveParameters {
+		if strings.Contains(name, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactParameters returns a copy of parameters with the values of sensitive parameters
+// replaced by RedactedValue. References to secrets are kept, as they reveal nothing.
+func RedactParameters(parameters map[string]string) map[string]string {
+	redacted := make(map[string]string, len(parameters))
+	for name, value := range parameters {
+		if _, isSecret := secretKey(value); value != "" && !isSecret && IsSensitiveParameter(name) {
+			value = RedactedValue
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+// String formats the config with the values of sensitive parameters redacted, so a Config can
+// be logged as it is
+func (c *Config) String() string {
+	return c.GoString()
+}
+
+// GoString formats the config for %#v with the values of sensitive parameters redacted
+func (c *Config) GoString() string {
+	if c == nil {
+		return "<nil>"
+	}
+	parameters := RedactParameters(c.Parameters)
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%v:%q", name, parameters[name])
+	}
+	return fmt.Sprintf("&guac.Config{ConnectionID:%q, Protocol:%q, Parameters:map[%v], OptimalScreenWidth:%v, OptimalScreenHeight:%v, OptimalResolution:%v, AudioMimetypes:%q, VideoMimetypes:%q, ImageMimetypes:%q, UserName:%q}",
+		c.ConnectionID, c.Protocol, strings.Join(pairs, " "), c.OptimalScreenWidth, c.OptimalScreenHeight,
+		c.OptimalResolution, c.AudioMimetypes, c.VideoMimetypes, c.ImageMimetypes, c.UserName)
+}
+
+// sensitiveValues returns the values of the sensitive parameters of config
+func sensitiveValues(config *Config) []string {
+	var values []string
+	for name, value := range config.Parameters {
+		if _, isSecret := secretKey(value); value != "" && !isSecret && IsSensitiveParameter(name) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// minRedactedLength is the length under which values are not redacted from text, as they
+// would match all over it
+const minRedactedLength = 3
+
+// redactText replaces each of values in text with RedactedValue
+func redactText(text string, values []string) string {
+	for _, value := range values {
+		if len(value) >= minRedactedLength {
+			text = strings.ReplaceAll(text, value, RedactedValue)
+		}
+	}
+	return text
+}
+
+// redactedError is an error whose message has had sensitive values removed
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+// Unwrap returns the original error
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with the values of the sensitive parameters of config removed from
+// its message, keeping its kind and status
+func redactError(err error, config *Config) error {
+	return redactValues(err, sensitiveValues(config))
+}
+
+// redactValues returns err with values removed from its message, keeping its kind and status
+func redactValues(err error, values []string) error {
+	if err == nil {
+		return nil
+	}
+	message := redactText(err.Error(), values)
+	if message == err.Error() {
+		return err
+	}
+	var guacErr *ErrGuac
+	if errors.As(err, &guacErr) {
+		return &ErrGuac{
+			error:  &redactedError{message: redactText(guacErr.Error(), values), err: err},
+			Status: guacErr.Status,
+			Kind:   guacErr.Kind,
+		}
+	}
+	return &redactedError{message: message, err: err}
+}
+
+// redaction gathers the sensitive values of the connections made for a connect request, so
+// they can be removed from the errors reported to its client however the connect callback
+// came to include them
+type redaction struct {
+	sync.Mutex
+	values []string
+}
+
+type redactionKey struct{}
+
+// withRedaction returns a copy of the connect request carrying a new redaction
+func withRedaction(r *http.Request) (*http.Request, *redaction) {
+	gathered := &redaction{}
+	return r.WithContext(context.WithValue(r.Context(), redactionKey{}, gathered)), gathered
+}
+
+// recordSensitive records values as sensitive for the connect request of ctx, if any
+func recordSensitive(ctx context.Context, values []string) {
+	gathered, ok := ctx.Value(redactionKey{}).(*redaction)
+	if !ok || len(values) == 0 {
+		return
+	}
+	gathered.Lock()
+	defer gathered.Unlock()
+	gathered.values = append(gathered.values, values...)
+}
+
+// redact returns err with the sensitive values recorded removed from its message
+func (r *redaction) redact(err error) error {
+	r.Lock()
+	defer r.Unlock()
+	return redactValues(err, r.values)
+}
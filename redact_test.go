@@ -0,0 +1,114 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfig_String(t *testing.T) {
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "ssh"
+	config.Parameters = map[string]string{
+		"hostname":    "jump",
+		"password":    "hunter22",
+		"private-key": "-----BEGIN KEY-----",
+		"passphrase":  SecretRef("jump/passphrase"),
+	}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		formatted := fmt.Sprintf(format, config)
+		if strings.Contains(formatted, "hunter22") || strings.Contains(formatted, "BEGIN KEY") {
+			t.Errorf("%v leaked a sensitive value: %v", format, formatted)
+		}
+		if !strings.Contains(formatted, `hostname:"jump"`) || !strings.Contains(formatted, SecretRef("jump/passphrase")) {
+			t.Errorf("%v redacted too much: %v", format, formatted)
+		}
+	}
+	if config.Parameters["password"] != "hunter22" {
+		t.Error("Expected the config itself to be left alone")
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	config := NewGuacamoleConfiguration()
+	config.Parameters = map[string]string{"password": "hunter22", "hostname": "desktop-1"}
+
+	cause := ErrUpstream.NewError("login to desktop-1 as bob with hunter22 failed")
+	err := redactError(cause, config)
+	if err.Error() != "login to desktop-1 as bob with ******** failed" {
+		t.Error("Unexpected message", err)
+	}
+	if guacErr := asErrGuac(err); guacErr.Kind != ErrUpstream || strings.Contains(guacErr.Error(), "hunter22") {
+		t.Error("Expected the kind to be kept and the message redacted, got", guacErr.Kind, guacErr)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("Expected the original error to be wrapped")
+	}
+	if plain := errors.New("unrelated"); redactError(plain, config) != plain {
+		t.Error("Expected errors without sensitive values to be returned as they are")
+	}
+}
+
+func TestBackend_RedactsErrors(t *testing.T) {
+	schemas := ParameterSchemas{"ssh": {"password": {Type: ParameterInteger}}}
+	backend := &Backend{Dialer: &argsDialer{}, Schemas: schemas}
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "ssh"
+	config.Parameters = map[string]string{"password": "hunter22"}
+	_, err := backend.Connect(context.Background(), config)
+	if err == nil || strings.Contains(err.Error(), "hunter22") {
+		t.Error("Expected the value to be redacted from the problem, got", err)
+	}
+}
+
+func TestServer_RedactsConnectErrors(t *testing.T) {
+	secrets := SecretsProviderFunc(func(ctx context.Context, key string) (string, error) {
+		return "vault-hunter22", nil
+	})
+	for name, configure := range map[string]func(config *Config){
+		"parameter": func(config *Config) {
+			config.Parameters["password"] = "plain-hunter22"
+		},
+		"secret": func(config *Config) {
+			config.Parameters["password"] = SecretRef("rdp/password")
+		},
+		"computed": func(config *Config) {
+			config.ParameterFunc = func(ctx context.Context, args []string) (map[string]string, error) {
+				return map[string]string{"password": "minted-hunter22"}, nil
+			}
+		},
+	} {
+		configure := configure
+		var sent string
+		server := NewServer(func(r *http.Request) (Tunnel, error) {
+			config := NewGuacamoleConfiguration()
+			configure(config)
+			dialer := &argsDialer{args: []string{"password"}}
+			backend := &Backend{Dialer: dialer, Secrets: secrets}
+			stream, err := backend.Connect(r.Context(), config)
+			if err != nil {
+				return nil, err
+			}
+			_ = stream.Close()
+			// the callback gives up, echoing what was sent to guacd
+			sent = string(dialer.conn.Written)
+			return nil, ErrClient.NewError("Unable to use connection:", sent)
+		})
+		var reason string
+		server.Audit = AuditSinkFunc(func(event *AuditEvent) error {
+			reason = event.Reason
+			return nil
+		})
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?connect", nil))
+		if !strings.Contains(sent, "hunter22") {
+			t.Fatalf("%v: expected the password to be sent, sent %q", name, sent)
+		}
+		if reason == "" || strings.Contains(reason, "hunter22") {
+			t.Errorf("%v: expected the password to be redacted from the error, got %q", name, reason)
+		}
+	}
+}
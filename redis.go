@@ -0,0 +1,357 @@
+package guac
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRedisPrefix is prepended to tunnel UUIDs to form the keys of a RedisRegistry when
+	// its Prefix is empty
+	DefaultRedisPrefix = "guac:tunnel:"
+	// DefaultRedisOwnershipTTL is how long a RedisRegistry's claim on a tunnel lasts without
+	// being refreshed when its TTL is zero
+	DefaultRedisOwnershipTTL = 30 * time.Second
+)
+
+// redisTimeout bounds each round trip to Redis
+const redisTimeout = 2 * time.Second
+
+// RedisRegistrySchema describes the keys a RedisRegistry keeps in Redis. Start checks the
+// version recorded under the registry's prefix against it.
+var RedisRegistrySchema = Schema{Name: "Redis tunnel registry", Version: 1}
+
+// redisSchemaKey is appended to the prefix to form the key recording the schema version
+const redisSchemaKey = "schema-version"
+
+// redisReleaseScript deletes a claim only if it is still held by the node given, in one step so
+// a claim taken over by another node in between is never deleted
+const redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// errRedisNil is returned for a nil reply, such as from GET of a missing key
+var errRedisNil = errors.New("redis: nil")
+
+/*
+RedisRegistry is a TunnelRegistry for a cluster of servers behind a load balancer which does
+not keep each client on one server. Tunnels are kept in a local TunnelMap, as a tunnel's
+connection to guacd can only be used by the server which opened it, while Redis records which
+server owns each tunnel so the others can route requests for it there. Claims are refreshed
+while the tunnel is open and expire if the owner goes away without removing them.
+
+Node is the URL other servers reach this server's tunnel endpoint at, for example
+"http://10.0.0.2:4567/tunnel". The exported fields must be set before Start is called, and
+Start before the registry is used.
+*/
+type RedisRegistry struct {
+	// Node identifies this server, as the URL of its tunnel endpoint
+	Node string
+	// Prefix is prepended to tunnel UUIDs to form keys, DefaultRedisPrefix if empty
+	Prefix string
+	// TTL is how long claims last without being refreshed, DefaultRedisOwnershipTTL if zero
+	TTL time.Duration
+	// Password optionally authenticates to Redis
+	Password string
+	// DB optionally selects the Redis database
+	DB int
+
+	local   *TunnelMap
+	client  *redisClient
+	stop    chan struct{}
+	once    sync.Once
+	started sync.Once
+}
+
+// NewRedisRegistry creates a registry recording tunnel ownership in the Redis server at addr.
+// Claims are refreshed once Start is called.
+func NewRedisRegistry(addr, node string) *RedisRegistry {
+	r := &RedisRegistry{
+		Node:  node,
+		local: NewTunnelMap(),
+		stop:  make(chan struct{}),
+	}
+	r.client = &redisClient{addr: addr, registry: r}
+	return r
+}
+
+func (r *RedisRegistry) key(uuid string) string {
+	if r.Prefix == "" {
+		return DefaultRedisPrefix + uuid
+	}
+	return r.Prefix + uuid
+}
+
+func (r *RedisRegistry) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return DefaultRedisOwnershipTTL
+	}
+	return r.TTL
+}
+
+// claim records this node as the owner of the tunnel for another TTL
+func (r *RedisRegistry) claim(uuid string) error {
+	_, err := r.client.do("SET", r.key(uuid), r.Node, "PX", strconv.FormatInt(r.ttl().Milliseconds(), 10))
+	return err
+}
+
+// release removes the claim on the tunnel if this node still holds it
+func (r *RedisRegistry) release(uuid string) {
+	if _, err := r.client.do("EVAL", redisReleaseScript, "1", r.key(uuid), r.Node); err != nil {
+		registryLog.Warnf("Unable to release tunnel %v in Redis: %v", uuid, err)
+	}
+}
+
+// CheckHealth returns an error unless Redis answers a PING
+func (r *RedisRegistry) CheckHealth(ctx context.Context) error {
+	_, err := r.client.do("PING")
+	return err
+}
+
+// SchemaVersion returns the schema version recorded in Redis, zero if none is.
+func (r *RedisRegistry) SchemaVersion(ctx context.Context) (int, error) {
+	value, err := r.client.do("GET", r.key(redisSchemaKey))
+	if err == errRedisNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// SetSchemaVersion records the schema version in Redis.
+func (r *RedisRegistry) SetSchemaVersion(ctx context.Context, version int) error {
+	_, err := r.client.do("SET", r.key(redisSchemaKey), strconv.Itoa(version))
+	return err
+}
+
+// Start checks the keys in Redis against RedisRegistrySchema, migrating them if needed, and
+// begins refreshing claims. It must be called before the registry is used; an error means
+// the keys were written by an incompatible version and the registry must not be used.
+func (r *RedisRegistry) Start(ctx context.Context) error {
+	if err := RedisRegistrySchema.Check(ctx, r); err != nil {
+		return err
+	}
+	r.started.Do(func() {
+		go r.refreshTask()
+	})
+	return nil
+}
+
+func (r *RedisRegistry) refreshTask() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(r.ttl() / 3):
+		}
+		r.refresh()
+	}
+}
+
+// refresh claims every tunnel of this node for another TTL. A failed claim is logged and the
+// others still refreshed, so one error doesn't let every claim expire.
+func (r *RedisRegistry) refresh() {
+	r.local.Range(func(uuid string, _ *LastAccessedTunnel) bool {
+		if err := r.claim(uuid); err != nil {
+			registryLog.Warnf("Unable to refresh tunnel %v in Redis: %v", uuid, err)
+		}
+		return true
+	})
+}
+
+// Register registers the tunnel locally and claims it in Redis. A failed claim is logged, leaving
+// the tunnel reachable only through this node until the next refresh.
+func (r *RedisRegistry) Register(uuid string, tunnel *LastAccessedTunnel) {
+	r.local.Register(uuid, tunnel)
+	if err := r.claim(uuid); err != nil {
+		registryLog.Warnf("Unable to claim tunnel %v in Redis: %v", uuid, err)
+	}
+}
+
+// Get returns the tunnel with the given UUID if this node owns it.
+func (r *RedisRegistry) Get(uuid string) (*LastAccessedTunnel, bool) {
+	return r.local.Get(uuid)
+}
+
+// Peek returns the tunnel with the given UUID if this node owns it, without recording an
+// access to it.
+func (r *RedisRegistry) Peek(uuid string) (*LastAccessedTunnel, bool) {
+	return r.local.Peek(uuid)
+}
+
+// Remove deregisters the tunnel and releases its claim.
+func (r *RedisRegistry) Remove(uuid string) (*LastAccessedTunnel, bool) {
+	tunnel, ok := r.local.Remove(uuid)
+	if ok {
+		r.release(uuid)
+	}
+	return tunnel, ok
+}
+
+// Len returns the number of tunnels owned by this node.
+func (r *RedisRegistry) Len() int {
+	return r.local.Len()
+}
+
+// Range calls fn for each tunnel owned by this node until fn returns false.
+func (r *RedisRegistry) Range(fn func(uuid string, tunnel *LastAccessedTunnel) bool) {
+	r.local.Range(fn)
+}
+
+// SetTimeout changes how long tunnels may go unused before they are closed, as with TunnelMap.
+func (r *RedisRegistry) SetTimeout(timeout time.Duration) {
+	r.local.SetTimeout(timeout)
+}
+
+// SetOnExpire sets the function called with each tunnel closed for having timed out, after
+// its claim is released.
+func (r *RedisRegistry) SetOnExpire(fn func(uuid string, tunnel *LastAccessedTunnel)) {
+	r.local.SetOnExpire(func(uuid string, tunnel *LastAccessedTunnel) {
+		r.release(uuid)
+		if fn != nil {
+			fn(uuid, tunnel)
+		}
+	})
+}
+
+// Locate returns the node owning the tunnel with the given UUID, if another node owns it.
+func (r *RedisRegistry) Locate(uuid string) (string, bool) {
+	owner, err := r.client.do("GET", r.key(uuid))
+	if err != nil {
+		if err != errRedisNil {
+			registryLog.Warnf("Unable to look up tunnel %v in Redis: %v", uuid, err)
+		}
+		return "", false
+	}
+	return owner, owner != r.Node
+}
+
+// Shutdown stops refreshing claims and closes the connection to Redis. Claims on tunnels
+// still open expire by themselves.
+func (r *RedisRegistry) Shutdown() {
+	r.once.Do(func() {
+		close(r.stop)
+		r.local.Shutdown()
+		r.client.close()
+	})
+}
+
+// redisClient sends commands to Redis one at a time over a single connection, reconnecting
+// after an error. Only the replies RedisRegistry needs are supported.
+type redisClient struct {
+	addr     string
+	registry *RedisRegistry
+
+	sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command and returns its reply as a string
+func (c *redisClient) do(args ...string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return "", err
+		}
+	}
+	reply, err := c.roundTrip(args)
+	if err != nil && err != errRedisNil && !isRedisError(err) {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *redisClient) dial() (err error) {
+	c.conn, err = net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.reader = bufio.NewReader(c.conn)
+	if c.registry.Password != "" {
+		_, err = c.roundTrip([]string{"AUTH", c.registry.Password})
+	}
+	if err == nil && c.registry.DB != 0 {
+		_, err = c.roundTrip([]string{"SELECT", strconv.Itoa(c.registry.DB)})
+	}
+	if err != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *redisClient) roundTrip(args []string) (string, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	command := make([]byte, 0, 64)
+	command = append(command, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		command = append(command, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := c.conn.Write(command); err != nil {
+		return "", err
+	}
+	return readRedisReply(c.reader)
+}
+
+func (c *redisClient) close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// redisError is an error reply from Redis, after which the connection is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func isRedisError(err error) bool {
+	_, ok := err.(redisError)
+	return ok
+}
+
+// readRedisReply reads a simple string, error, integer or bulk string reply
+func readRedisReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	value := line[1 : len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return value, nil
+	case '-':
+		return "", redisError(value)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if size < 0 {
+			return "", errRedisNil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return string(data[:size]), nil
+	}
+	return "", fmt.Errorf("redis: unsupported reply %q", line)
+}
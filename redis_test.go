@@ -0,0 +1,206 @@
+package guac
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis answers the commands used by RedisRegistry from a map, ignoring expiry
+type fakeRedis struct {
+	listener net.Listener
+	sync.Mutex
+	values   map[string]string
+	commands []string
+	// failing lists the keys SET fails for
+	failing map[string]bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, values: map[string]string{}}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			line, _ = r.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			data := make([]byte, size+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+		_, _ = conn.Write([]byte(f.handle(args)))
+	}
+}
+
+func (f *fakeRedis) handle(args []string) string {
+	f.Lock()
+	defer f.Unlock()
+	f.commands = append(f.commands, args[0])
+	switch args[0] {
+	case "AUTH":
+		if args[1] != "secret" {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "SET":
+		if f.failing[args[1]] {
+			return "-ERR failing\r\n"
+		}
+		f.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "DEL":
+		_, ok := f.values[args[1]]
+		delete(f.values, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EVAL":
+		if args[1] != redisReleaseScript {
+			return "-ERR unknown script\r\n"
+		}
+		if f.values[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		delete(f.values, args[3])
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRedis) get(key string) (string, bool) {
+	f.Lock()
+	defer f.Unlock()
+	value, ok := f.values[key]
+	return value, ok
+}
+
+func TestRedisRegistry(t *testing.T) {
+	redis := newFakeRedis(t)
+	a := NewRedisRegistry(redis.listener.Addr().String(), "http://a/tunnel")
+	a.Password = "secret"
+	defer a.Shutdown()
+	b := NewRedisRegistry(redis.listener.Addr().String(), "http://b/tunnel")
+	b.Password = "secret"
+	defer b.Shutdown()
+
+	a.Register("1", newRegisteredTunnel(&fakeTunnel{}, nil, nil))
+	if owner, _ := redis.get(DefaultRedisPrefix + "1"); owner != "http://a/tunnel" {
+		t.Fatalf("Expected tunnel to be claimed by a, got %q", owner)
+	}
+	if _, ok := b.Get("1"); ok {
+		t.Error("Expected tunnel to be local to its owner")
+	}
+	if node, ok := b.Locate("1"); !ok || node != "http://a/tunnel" {
+		t.Errorf("Expected b to locate the tunnel on a, got %q %v", node, ok)
+	}
+	if _, ok := a.Locate("1"); ok {
+		t.Error("Expected owner not to locate its own tunnel elsewhere")
+	}
+
+	if _, ok := b.Remove("1"); ok {
+		t.Error("Expected b not to remove a's tunnel")
+	}
+	if _, ok := a.Remove("1"); !ok || a.Len() != 0 {
+		t.Fatal("Expected a to remove its tunnel")
+	}
+	if _, ok := redis.get(DefaultRedisPrefix + "1"); ok {
+		t.Error("Expected claim to be released")
+	}
+	if _, ok := b.Locate("1"); ok {
+		t.Error("Expected removed tunnel not to be located")
+	}
+
+	wrong := NewRedisRegistry(redis.listener.Addr().String(), "http://c/tunnel")
+	wrong.Password = "wrong"
+	defer wrong.Shutdown()
+	if err := wrong.claim("2"); err == nil {
+		t.Error("Expected claim with the wrong password to fail")
+	}
+}
+
+func TestRedisRegistry_ReleaseAndRefresh(t *testing.T) {
+	redis := newFakeRedis(t)
+	a := NewRedisRegistry(redis.listener.Addr().String(), "http://a/tunnel")
+	defer a.Shutdown()
+	for _, uuid := range []string{"1", "2", "3"} {
+		a.Register(uuid, newRegisteredTunnel(&fakeTunnel{}, nil, nil))
+	}
+
+	// a claim taken over by another node is left to it
+	redis.Lock()
+	redis.values[DefaultRedisPrefix+"3"] = "http://b/tunnel"
+	redis.Unlock()
+	a.Remove("3")
+	if owner, _ := redis.get(DefaultRedisPrefix + "3"); owner != "http://b/tunnel" {
+		t.Errorf("Expected the claim of another node to be kept, got %q", owner)
+	}
+
+	redis.Lock()
+	redis.failing = map[string]bool{DefaultRedisPrefix + "1": true}
+	delete(redis.values, DefaultRedisPrefix+"2")
+	redis.Unlock()
+	a.refresh()
+	if owner, _ := redis.get(DefaultRedisPrefix + "2"); owner != "http://a/tunnel" {
+		t.Error("Expected a failed refresh not to stop the others, got", owner)
+	}
+}
+
+func TestRedisRegistry_Schema(t *testing.T) {
+	redis := newFakeRedis(t)
+	a := NewRedisRegistry(redis.listener.Addr().String(), "http://a/tunnel")
+	defer a.Shutdown()
+	if err := a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := redis.get(DefaultRedisPrefix + redisSchemaKey); version != strconv.Itoa(RedisRegistrySchema.Version) {
+		t.Fatalf("Expected fresh state to be stamped with the current version, got %q", version)
+	}
+
+	redis.Lock()
+	redis.values[DefaultRedisPrefix+redisSchemaKey] = strconv.Itoa(RedisRegistrySchema.Version + 1)
+	redis.Unlock()
+	b := NewRedisRegistry(redis.listener.Addr().String(), "http://b/tunnel")
+	defer b.Shutdown()
+	if err := b.Start(context.Background()); err == nil {
+		t.Error("Expected state written by a newer version to be refused")
+	}
+}
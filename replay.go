@@ -0,0 +1,94 @@
+package guac
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// ReplayOffsetHeader gives the offset, in bytes sent through the tunnel, of the start of a
+	// read response, for tunnels of a Server with a ReplayBuffer
+	ReplayOffsetHeader = "Guacamole-Replay-Offset"
+	// ResumeOffsetHeader is sent by a client reattaching to a tunnel with the offset up to which
+	// it received the tunnel's instructions, so the read starts by replaying what it missed
+	ResumeOffsetHeader = "Guacamole-Resume-Offset"
+)
+
+// replayBuffer keeps the most recent instructions sent to the client of a tunnel, so a client
+// which lost some of them can resume. It is only written while holding the tunnel's reader.
+type replayBuffer struct {
+	sync.Mutex
+	ring []byte
+	// end is the number of bytes ever written, the offset just past the newest byte
+	end int64
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{ring: make([]byte, size)}
+}
+
+// write appends data, replacing the oldest bytes once the buffer is full
+func (b *replayBuffer) write(data []byte) {
+	b.Lock()
+	defer b.Unlock()
+	if len(data) > len(b.ring) {
+		b.end += int64(len(data) - len(b.ring))
+		data = data[len(data)-len(b.ring):]
+	}
+	for len(data) > 0 {
+		n := copy(b.ring[b.end%int64(len(b.ring)):], data)
+		b.end += int64(n)
+		data = data[n:]
+	}
+}
+
+// offset returns the offset just past the newest byte written
+func (b *replayBuffer) offset() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.end
+}
+
+// since returns the bytes written from offset on, or false if the buffer no longer holds them
+func (b *replayBuffer) since(offset int64) ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if offset > b.end || b.end-offset > int64(len(b.ring)) {
+		return nil, false
+	}
+	data := make([]byte, 0, b.end-offset)
+	for position := offset; position < b.end; {
+		start := position % int64(len(b.ring))
+		stop := int64(len(b.ring))
+		if remaining := b.end - position; stop-start > remaining {
+			stop = start + remaining
+		}
+		data = append(data, b.ring[start:stop]...)
+		position += stop - start
+	}
+	return data, true
+}
+
+// replayFor returns what a read request resuming from the offset in its ResumeOffsetHeader
+// missed, along with the offset the response starts at. Without the header nothing is
+// replayed. A client which missed more than the buffer holds can't resume, and fails with
+// ErrResourceConflict.
+func replayFor(request *http.Request, buffer *replayBuffer) ([]byte, int64, error) {
+	header := request.Header.Get(ResumeOffsetHeader)
+	if header == "" {
+		return nil, buffer.offset(), nil
+	}
+	offset, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || offset < 0 {
+		return nil, 0, ErrClient.NewError("Invalid resume offset:", header)
+	}
+	missed, ok := buffer.since(offset)
+	if !ok {
+		return nil, 0, ErrResourceConflict.NewError("Unable to resume tunnel from offset", header)
+	}
+	if len(missed) > 0 {
+		transportLog.Debugf("Replaying %v bytes to resumed client.", len(missed))
+	}
+	return missed, offset, nil
+}
@@ -0,0 +1,84 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	buffer := newReplayBuffer(8)
+	buffer.write([]byte("abcdef"))
+	if data, ok := buffer.since(2); !ok || string(data) != "cdef" {
+		t.Errorf("Unexpected replay %q %v", data, ok)
+	}
+
+	buffer.write([]byte("ghij"))
+	if data, ok := buffer.since(2); !ok || string(data) != "cdefghij" {
+		t.Errorf("Unexpected replay across the end of the ring %q %v", data, ok)
+	}
+	if _, ok := buffer.since(1); ok {
+		t.Error("Expected bytes no longer held not to be replayed")
+	}
+	if _, ok := buffer.since(11); ok {
+		t.Error("Expected bytes not yet written not to be replayed")
+	}
+
+	buffer.write([]byte("0123456789"))
+	if data, ok := buffer.since(12); !ok || string(data) != "23456789" || buffer.offset() != 20 {
+		t.Errorf("Unexpected replay after a write larger than the buffer %q %v", data, ok)
+	}
+}
+
+func TestServer_ReplayBuffer(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.ReplayBuffer = 64
+	server.registerTunnel(tunnel, nil, nil)
+
+	// read sends guacd's instruction through a read request, which the client then abandons
+	read := func(resume string, instruction string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		request := httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":0", nil).WithContext(ctx)
+		if resume != "" {
+			request.Header.Set(ResumeOffsetHeader, resume)
+		}
+		go func() {
+			_, _ = guacd.Write([]byte(instruction))
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := read("", "4.sync,1.1;")
+	if recorder.Body.String() != "4.sync,1.1;" || recorder.Header().Get(ReplayOffsetHeader) != "0" {
+		t.Fatalf("Unexpected first read %q %v", recorder.Body.String(), recorder.Header())
+	}
+
+	// the client lost the first response, so it resumes from the start
+	recorder = read("0", "4.sync,1.2;")
+	if recorder.Body.String() != "4.sync,1.1;4.sync,1.2;" || recorder.Header().Get(ReplayOffsetHeader) != "0" {
+		t.Fatalf("Expected the missed instruction to be replayed, got %q %v", recorder.Body.String(), recorder.Header())
+	}
+
+	recorder = read("", "4.sync,1.3;")
+	if recorder.Header().Get(ReplayOffsetHeader) != "22" {
+		t.Errorf("Expected read to start after the replayed instructions, got %v", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":0", nil)
+	request.Header.Set(ResumeOffsetHeader, "100")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != ErrResourceConflict.Status().GetHTTPStatusCode() {
+		t.Errorf("Expected resuming from an unknown offset to fail, got %v", recorder.Code)
+	}
+}
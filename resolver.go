@@ -0,0 +1,126 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultResolverTTL is how long a CachingResolver keeps successful lookups by default
+	DefaultResolverTTL = time.Minute
+	// DefaultLookupTimeout bounds a single lookup made by a CachingResolver by default
+	DefaultLookupTimeout = 5 * time.Second
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver satisfies this interface.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// CachingResolver wraps another Resolver, caching its answers. Go's resolver does not report
+// record TTLs, so every answer is kept for TTL regardless of what DNS said.
+type CachingResolver struct {
+	// Resolver performs uncached lookups, net.DefaultResolver if nil
+	Resolver Resolver
+	// TTL caps how long an answer is cached, DefaultResolverTTL if zero
+	TTL time.Duration
+	// Timeout bounds each uncached lookup, DefaultLookupTimeout if zero
+	Timeout time.Duration
+	// StaleOnError returns expired answers when a fresh lookup fails, riding out flaky DNS
+	StaleOnError bool
+
+	sync.Mutex
+	cache map[string]resolverEntry
+}
+
+type resolverEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewCachingResolver creates a caching resolver with the given TTL in front of net.DefaultResolver
+func NewCachingResolver(ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		TTL: ttl,
+	}
+}
+
+// LookupHost returns the cached addresses of host, looking them up if missing or expired
+func (r *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	// literals, including IPv6 addresses with a zone, need no lookup
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{host}, nil
+	}
+
+	now := time.Now()
+	r.Lock()
+	entry, ok := r.cache[host]
+	r.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultLookupTimeout
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var resolver Resolver = net.DefaultResolver
+	if r.Resolver != nil {
+		resolver = r.Resolver
+	}
+	addrs, err := resolver.LookupHost(lookupCtx, host)
+	if err != nil {
+		if ok && r.StaleOnError {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = DefaultResolverTTL
+	}
+	r.Lock()
+	if r.cache == nil {
+		r.cache = map[string]resolverEntry{}
+	}
+	r.cache[host] = resolverEntry{addrs: addrs, expires: now.Add(ttl)}
+	r.Unlock()
+	return addrs, nil
+}
+
+// Forget removes any cached answer for host
+func (r *CachingResolver) Forget(host string) {
+	r.Lock()
+	delete(r.cache, host)
+	r.Unlock()
+}
+
+// Preflight checks that the target host of a connection resolves before guacd is asked to
+// connect to it, since guacd only reports a generic failure once the handshake is done.
+// Configurations without a "hostname" parameter pass. IPv6 literals given in brackets, as in
+// URLs, have the brackets removed since guacd cannot resolve them.
+func Preflight(ctx context.Context, resolver Resolver, config *Config) error {
+	host := config.Parameters["hostname"]
+	if host == "" {
+		return nil
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+		config.Parameters["hostname"] = host
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if _, err := resolver.LookupHost(ctx, host); err != nil {
+		return ErrUpstreamNotFound.NewError("Unable to resolve target host.", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	addrs   map[string][]string
+	lookups int
+	fail    bool
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	f.lookups++
+	if f.fail {
+		return nil, errors.New("lookup failed")
+	}
+	addrs, ok := f.addrs[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	upstream := &fakeResolver{addrs: map[string][]string{"guacd": {"10.0.0.1"}}}
+	resolver := &CachingResolver{Resolver: upstream, TTL: time.Hour}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		addrs, err := resolver.LookupHost(ctx, "guacd")
+		if err != nil || len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Fatalf("unexpected lookup result %v %v", addrs, err)
+		}
+	}
+	if upstream.lookups != 1 {
+		t.Errorf("expected 1 upstream lookup, got %v", upstream.lookups)
+	}
+
+	if addrs, _ := resolver.LookupHost(ctx, "::1"); len(addrs) != 1 || upstream.lookups != 1 {
+		t.Error("expected IP literals not to be looked up")
+	}
+
+	// expired entries are looked up again and served stale if that fails
+	resolver.TTL = -time.Second
+	resolver.Forget("guacd")
+	if _, err := resolver.LookupHost(ctx, "guacd"); err != nil {
+		t.Fatal(err)
+	}
+	upstream.fail = true
+	if _, err := resolver.LookupHost(ctx, "guacd"); err == nil {
+		t.Error("expected error without StaleOnError")
+	}
+	resolver.StaleOnError = true
+	if addrs, err := resolver.LookupHost(ctx, "guacd"); err != nil || addrs[0] != "10.0.0.1" {
+		t.Errorf("expected stale answer, got %v %v", addrs, err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	resolver := &fakeResolver{addrs: map[string][]string{"desktop": {"10.0.0.2"}}}
+	config := NewGuacamoleConfiguration()
+
+	if err := Preflight(context.Background(), resolver, config); err != nil {
+		t.Error("expected config without hostname to pass", err)
+	}
+
+	config.Parameters["hostname"] = "desktop"
+	if err := Preflight(context.Background(), resolver, config); err != nil {
+		t.Error(err)
+	}
+
+	config.Parameters["hostname"] = "[2001:db8::2]"
+	if err := Preflight(context.Background(), NewCachingResolver(time.Minute), config); err != nil {
+		t.Error(err)
+	}
+	if host := config.Parameters["hostname"]; host != "2001:db8::2" {
+		t.Errorf("expected brackets to be removed, got %v", host)
+	}
+
+	config.Parameters["hostname"] = "nowhere"
+	if err := Preflight(context.Background(), resolver, config); err == nil || asErrGuac(err).Status != UpstreamNotFound {
+		t.Errorf("expected UpstreamNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package guac
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRetryRatio is the share of first attempts DefaultRetryBudget allows to be retried
+	DefaultRetryRatio = 0.2
+	// DefaultMinRetriesPerSecond is the rate of retries DefaultRetryBudget always allows,
+	// however little traffic there is
+	DefaultMinRetriesPerSecond = 1.0
+	// DefaultRetryBackoff is the delay before the first retry, doubling with each retry
+	DefaultRetryBackoff = 100 * time.Millisecond
+
+	// retryBudgetSeconds is how many seconds of the minimum retry rate a budget may save up
+	retryBudgetSeconds = 10
+)
+
+// DefaultRetryBudget is shared by everything retrying without a budget of its own, so that
+// during an outage retries in one place leave less room for retries in another rather than
+// multiplying the load on guacd.
+var DefaultRetryBudget = NewRetryBudget(DefaultRetryRatio, DefaultMinRetriesPerSecond)
+
+// RetryBudget bounds retries to a fraction of first attempts, plus a small steady rate. Each
+// first attempt deposits a fraction of a token and each retry withdraws a whole one, so when
+// most attempts are failing the budget runs dry and failures are returned immediately.
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond float64
+
+	sync.Mutex
+	tokens float64
+	last   time.Time
+
+	retries   atomic.Int64
+	exhausted atomic.Int64
+}
+
+// RetryBudgetStats counts how a RetryBudget has been used
+type RetryBudgetStats struct {
+	// Retries is the number of retries allowed
+	Retries int64
+	// Exhausted is the number of retries refused because the budget was empty
+	Exhausted int64
+	// Tokens is the number of retries currently available
+	Tokens float64
+}
+
+// NewRetryBudget creates a budget allowing ratio retries per first attempt, plus minPerSecond
+// retries each second regardless of traffic
+func NewRetryBudget(ratio, minPerSecond float64) *RetryBudget {
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: minPerSecond,
+		tokens:       minPerSecond * retryBudgetSeconds,
+		last:         time.Now(),
+	}
+}
+
+// Attempt records a first attempt, adding to the budget
+func (b *RetryBudget) Attempt() {
+	b.Lock()
+	b.refill(time.Now())
+	b.tokens += b.ratio
+	b.cap()
+	b.Unlock()
+}
+
+// Retry withdraws a retry from the budget, returning false if it is empty
+func (b *RetryBudget) Retry() bool {
+	b.Lock()
+	b.refill(time.Now())
+	ok := b.tokens >= 1
+	if ok {
+		b.tokens--
+	}
+	b.Unlock()
+
+	if !ok {
+		if b.exhausted.Add(1) == 1 {
+			registryLog.Warn("Retry budget exhausted, failing without retrying.")
+		}
+		return false
+	}
+	b.retries.Add(1)
+	return true
+}
+
+// Stats returns the use made of the budget so far
+func (b *RetryBudget) Stats() RetryBudgetStats {
+	b.Lock()
+	b.refill(time.Now())
+	tokens := b.tokens
+	b.Unlock()
+	return RetryBudgetStats{
+		Retries:   b.retries.Load(),
+		Exhausted: b.exhausted.Load(),
+		Tokens:    tokens,
+	}
+}
+
+func (b *RetryBudget) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.minPerSecond
+	b.last = now
+	b.cap()
+}
+
+// cap keeps the budget from saving up more than a burst of retries during quiet periods
+func (b *RetryBudget) cap() {
+	limit := b.minPerSecond * retryBudgetSeconds
+	if limit < 1 {
+		limit = 1
+	}
+	if b.tokens > limit {
+		b.tokens = limit
+	}
+}
+
+// retry calls fn, then retries it while it fails with an error for which retryable returns
+// true, up to retries times and only as far as the budget allows. The delay between attempts
+// starts at backoff, DefaultRetryBackoff if zero, and doubles each time.
+func retry(ctx context.Context, budget *RetryBudget, retries int, backoff time.Duration, retryable func(error) bool, fn func() error) error {
+	if budget == nil {
+		budget = DefaultRetryBudget
+	}
+	if backoff == 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	budget.Attempt()
+	err := fn()
+	for attempt := 0; err != nil && attempt < retries && retryable(err); attempt++ {
+		if !budget.Retry() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// isTransient returns true for errors which retrying may fix, those where guacd could not be
+// reached or went away
+func isTransient(err error) bool {
+	guacErr, ok := err.(*ErrGuac)
+	if !ok {
+		return false
+	}
+	switch guacErr.Kind {
+	case ErrUpstreamTimeout, ErrUpstreamUnavailable, ErrConnectionClosed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	// no steady rate, so retries only come from attempts
+	budget := NewRetryBudget(0.5, 0)
+	budget.tokens = 0
+
+	if budget.Retry() {
+		t.Error("Expected an empty budget to refuse a retry")
+	}
+	budget.Attempt()
+	budget.Attempt()
+	if !budget.Retry() {
+		t.Error("Expected two attempts to allow a retry")
+	}
+	if budget.Retry() {
+		t.Error("Expected the budget to be empty again")
+	}
+
+	stats := budget.Stats()
+	if stats.Retries != 1 || stats.Exhausted != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+type flakyDialer struct {
+	failures int
+	dials    int
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials++
+	if d.dials <= d.failures {
+		return nil, ErrUpstreamUnavailable.NewError("refused")
+	}
+	return &fakeConn{}, nil
+}
+
+func TestBackend_DialRetries(t *testing.T) {
+	dialer := &flakyDialer{failures: 2}
+	backend := &Backend{
+		Dialer:       dialer,
+		Retries:      2,
+		RetryBackoff: 1,
+		Budget:       NewRetryBudget(0, 10),
+	}
+	if _, err := backend.Dial(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dialer.dials != 3 {
+		t.Error("Expected 3 dials, got", dialer.dials)
+	}
+
+	// an empty budget fails without retrying
+	dialer = &flakyDialer{failures: 2}
+	backend.Dialer = dialer
+	backend.Budget = NewRetryBudget(0, 0)
+	backend.Budget.tokens = 0
+	if _, err := backend.Dial(context.Background()); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if dialer.dials != 1 {
+		t.Error("Expected 1 dial, got", dialer.dials)
+	}
+}
+
+func TestRetry_NotRetryable(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), NewRetryBudget(1, 10), 3, 1, isTransient, func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	if err == nil || calls != 1 {
+		t.Error("Expected a single failed call, got", calls, err)
+	}
+}
@@ -0,0 +1,249 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the events a Server passes to its RuleEngine
+const (
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	// EventFileTransfer is fired by a FileFilter given the RuleEngine when a transfer ends
+	EventFileTransfer = "file_transfer"
+)
+
+// Names of the built-in rule actions
+const (
+	// RuleKill closes the tunnel the event happened on
+	RuleKill = "kill"
+	// RuleWebhook posts the event as JSON to the rule's Target URL
+	RuleWebhook = "webhook"
+	// RuleRecord captures the instructions of the tunnel to a file in the rule's Target
+	// directory until it disconnects
+	RuleRecord = "record"
+)
+
+// ruleWebhookTimeout bounds each webhook request
+const ruleWebhookTimeout = 10 * time.Second
+
+// Event is something which happened on a tunnel, passed to a RuleEngine
+type Event struct {
+	// SchemaVersion is the EventSchemaVersion the event conforms to, set by Fire
+	SchemaVersion int `json:"schema_version"`
+
+	Type   string            `json:"type"`
+	Time   time.Time         `json:"time"`
+	UUID   string            `json:"uuid"`
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// Tunnel is the tunnel the event happened on, if it is still open
+	Tunnel Tunnel `json:"-"`
+}
+
+// Rule performs an action whenever an event of type On happens where every field named in
+// Where matches its pattern, as in path.Match. Rules are usually distributed as part of a
+// Policy:
+//
+//	{"name": "no-root", "on": "connect", "where": {"user": "root"}, "do": "kill"}
+type Rule struct {
+	Name  string            `json:"name"`
+	On    string            `json:"on"`
+	Where map[string]string `json:"where,omitempty"`
+	Do    string            `json:"do"`
+	// Target is the URL of a webhook or the directory of recordings
+	Target string `json:"target,omitempty"`
+}
+
+// matches returns true if the rule applies to the event
+func (r *Rule) matches(event *Event) bool {
+	if r.On != event.Type {
+		return false
+	}
+	for field, pattern := range r.Where {
+		value, ok := event.Fields[field]
+		if !ok {
+			return false
+		}
+		if matched, err := path.Match(pattern, value); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// RuleAction performs the action of a rule for an event
+type RuleAction func(ctx context.Context, rule *Rule, event *Event) error
+
+// RuleEngine evaluates rules in-process against the events of a server, so simple automation
+// needs no external glue. Actions run in their own goroutines and their failures are logged.
+type RuleEngine struct {
+	rules   atomic.Pointer[[]Rule]
+	actions map[string]RuleAction
+
+	// recordings holds the captures started by RuleRecord, by tunnel UUID
+	recordingsLock sync.Mutex
+	recordings     map[string]*ruleRecording
+}
+
+type ruleRecording struct {
+	capture *Capture
+	file    *os.File
+}
+
+// NewRuleEngine creates an engine evaluating the given rules, with the built-in actions
+func NewRuleEngine(rules []Rule) (*RuleEngine, error) {
+	e := &RuleEngine{
+		recordings: map[string]*ruleRecording{},
+	}
+	e.actions = map[string]RuleAction{
+		RuleKill:    ruleKill,
+		RuleWebhook: ruleWebhook,
+		RuleRecord:  e.record,
+	}
+	if err := e.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetRules replaces the rules evaluated by the engine, such as with those of a newly loaded
+// Policy. Events already being evaluated keep the previous rules.
+func (e *RuleEngine) SetRules(rules []Rule) error {
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+	e.rules.Store(&rules)
+	return nil
+}
+
+// validateRules checks every rule names an event and an action and has valid patterns. The
+// actions themselves are checked when they run, as they may be set after the rules are loaded.
+func validateRules(rules []Rule) error {
+	for _, rule := range rules {
+		if rule.On == "" || rule.Do == "" {
+			return fmt.Errorf("rule %q needs both an event and an action", rule.Name)
+		}
+		for field, pattern := range rule.Where {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %q has invalid pattern for %q: %w", rule.Name, field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Handle sets an action which rules may name in Do, replacing any built-in action of the same
+// name. It must be called before events are passed to the engine.
+func (e *RuleEngine) Handle(name string, action RuleAction) {
+	e.actions[name] = action
+}
+
+// Fire evaluates the rules against an event, starting the actions of those which match
+func (e *RuleEngine) Fire(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.SchemaVersion = EventSchemaVersion
+	rules := *e.rules.Load()
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(event) {
+			continue
+		}
+		action, ok := e.actions[rule.Do]
+		if !ok {
+			registryLog.Warnf("Rule %q has unknown action %q.", rule.Name, rule.Do)
+			continue
+		}
+		registryLog.Debugf("Rule %q matched %v event on tunnel %v.", rule.Name, event.Type, event.UUID)
+		go func() {
+			if err := action(context.Background(), rule, event); err != nil {
+				registryLog.Warnf("Rule %q failed on tunnel %v: %v", rule.Name, event.UUID, err)
+			}
+		}()
+	}
+
+	if event.Type == EventDisconnect {
+		e.stopRecording(event.UUID)
+	}
+}
+
+func ruleKill(_ context.Context, rule *Rule, event *Event) error {
+	if event.Tunnel == nil {
+		return fmt.Errorf("tunnel is not open")
+	}
+	// tunnels of a Server are told why they were closed
+	if registered, ok := event.Tunnel.(*LastAccessedTunnel); ok {
+		return registered.kill(registered.closedBy(ClosePolicyKill, SessionClosed))
+	}
+	return event.Tunnel.Close()
+}
+
+func ruleWebhook(ctx context.Context, rule *Rule, event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, ruleWebhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, rule.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", response.Status)
+	}
+	return nil
+}
+
+func (e *RuleEngine) record(_ context.Context, rule *Rule, event *Event) error {
+	var tunnel *FilteredTunnel
+	if !AsTunnel(event.Tunnel, &tunnel) {
+		return fmt.Errorf("tunnel cannot be recorded")
+	}
+
+	e.recordingsLock.Lock()
+	defer e.recordingsLock.Unlock()
+	if _, ok := e.recordings[event.UUID]; ok {
+		return nil
+	}
+	file, err := os.Create(filepath.Join(rule.Target, filepath.Base(event.UUID)+".capture"))
+	if err != nil {
+		return err
+	}
+	e.recordings[event.UUID] = &ruleRecording{
+		capture: StartCapture(tunnel, NewCaptureWriter(file)),
+		file:    file,
+	}
+	return nil
+}
+
+func (e *RuleEngine) stopRecording(uuid string) {
+	e.recordingsLock.Lock()
+	recording, ok := e.recordings[uuid]
+	delete(e.recordings, uuid)
+	e.recordingsLock.Unlock()
+
+	if ok {
+		recording.capture.Stop()
+		if err := recording.file.Close(); err != nil {
+			registryLog.Warnf("Closing recording of tunnel %v failed: %v", uuid, err)
+		}
+	}
+}
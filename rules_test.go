@@ -0,0 +1,132 @@
+package guac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeTunnel is a fakeTunnel reporting when it is closed
+type closeTunnel struct {
+	fakeTunnel
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (t *closeTunnel) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+func TestRule_matches(t *testing.T) {
+	rule := &Rule{On: EventConnect, Where: map[string]string{"user": "adm*"}}
+	for event, want := range map[*Event]bool{
+		{Type: EventConnect, Fields: map[string]string{"user": "admin"}}: true,
+		{Type: EventConnect, Fields: map[string]string{"user": "alice"}}: false,
+		{Type: EventConnect}: false,
+		{Type: EventDisconnect, Fields: map[string]string{"user": "admin"}}: false,
+	} {
+		if got := rule.matches(event); got != want {
+			t.Errorf("%+v: expected %v, got %v", event, want, got)
+		}
+	}
+}
+
+func TestRuleEngine_Kill(t *testing.T) {
+	engine, err := NewRuleEngine([]Rule{{Name: "no-root", On: EventConnect, Where: map[string]string{"user": "root"}, Do: RuleKill}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &closeTunnel{closed: make(chan struct{})}, nil
+	})
+	server.Rules = engine
+
+	allowed := &closeTunnel{closed: make(chan struct{})}
+	server.registerTunnel(allowed, &Identity{Subject: "alice"}, nil)
+	killed := &closeTunnel{closed: make(chan struct{})}
+	server.registerTunnel(killed, &Identity{Subject: "root"}, nil)
+
+	select {
+	case <-killed.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected root's tunnel to be killed")
+	}
+	select {
+	case <-allowed.closed:
+		t.Error("Expected alice's tunnel to stay open")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRuleEngine_Webhook(t *testing.T) {
+	received := make(chan *Event, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &Event{}
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer hook.Close()
+
+	engine, err := NewRuleEngine([]Rule{{On: EventDisconnect, Do: RuleWebhook, Target: hook.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Fire(&Event{Type: EventDisconnect, UUID: "1"})
+
+	select {
+	case event := <-received:
+		if event.Type != EventDisconnect || event.UUID != "1" || event.Time.IsZero() {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected webhook to be called")
+	}
+}
+
+func TestRuleEngine_Record(t *testing.T) {
+	dir := t.TempDir()
+	engine, err := NewRuleEngine([]Rule{{On: EventConnect, Do: RuleRecord, Target: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewFilteredTunnel(&fakeTunnel{})
+	if err = engine.record(context.Background(), &(*engine.rules.Load())[0], &Event{Type: EventConnect, UUID: "1", Tunnel: tunnel}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tunnel.filterRead(NewSyncInstruction(1)); err != nil {
+		t.Fatal(err)
+	}
+	engine.Fire(&Event{Type: EventDisconnect, UUID: "1"})
+
+	data, err := os.ReadFile(filepath.Join(dir, "1.capture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), " guacd 4.sync,1.1;\n") {
+		t.Errorf("Unexpected recording %q", data)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{On: EventConnect}},
+		{{Do: RuleKill}},
+		{{On: EventConnect, Do: RuleKill, Where: map[string]string{"user": "["}}},
+	} {
+		if _, err := NewRuleEngine(rules); err == nil {
+			t.Errorf("Expected %+v to be invalid", rules)
+		}
+	}
+}
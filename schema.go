@@ -0,0 +1,89 @@
+package guac
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// SchemaStore is implemented by persistence features, such as shared tunnel registries, to
+// record the version of the layout of the state they keep across restarts.
+type SchemaStore interface {
+	// SchemaVersion returns the version of the persisted state, zero if nothing was persisted
+	SchemaVersion(ctx context.Context) (int, error)
+	// SetSchemaVersion records that the persisted state now has the given version
+	SetSchemaVersion(ctx context.Context, version int) error
+}
+
+// Migration upgrades persisted state from Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(ctx context.Context) error
+}
+
+// Schema describes the persisted state of one feature: the version this build reads and
+// writes, and the migrations from each earlier version.
+type Schema struct {
+	// Name identifies the feature in errors and logs
+	Name       string
+	Version    int
+	Migrations []Migration
+}
+
+// Check must be called at startup before the state in store is used. Fresh state is stamped
+// with the current version and older state is migrated one version at a time, recording each
+// step so an interrupted upgrade resumes where it stopped. Unknown versions, newer than this
+// build or without a migration path, are refused with an error rather than risking silent
+// corruption.
+func (s Schema) Check(ctx context.Context, store SchemaStore) error {
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return ErrServer.NewError(fmt.Sprintf("Reading schema version of %v failed.", s.Name), err.Error())
+	}
+
+	switch {
+	case version == s.Version:
+		return nil
+	case version == 0:
+		registryLog.Infof("Initializing %v state at schema version %v.", s.Name, s.Version)
+		return s.setVersion(ctx, store, s.Version)
+	case version > s.Version || version < 0:
+		return ErrServer.NewError(fmt.Sprintf("State of %v has unknown schema version %v, this build supports up to %v; refusing to start.",
+			s.Name, version, s.Version))
+	}
+
+	migrations := append([]Migration(nil), s.Migrations...)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	// check the whole path exists before changing anything
+	byVersion := map[int]Migration{}
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+	for v := version + 1; v <= s.Version; v++ {
+		if _, ok := byVersion[v]; !ok {
+			return ErrServer.NewError(fmt.Sprintf("No migration of %v state from schema version %v to %v; refusing to start.",
+				s.Name, v-1, v))
+		}
+	}
+
+	for v := version + 1; v <= s.Version; v++ {
+		migration := byVersion[v]
+		registryLog.Infof("Migrating %v state to schema version %v: %v", s.Name, v, migration.Description)
+		if err = migration.Migrate(ctx); err != nil {
+			return ErrServer.NewError(fmt.Sprintf("Migrating %v state to schema version %v failed.", s.Name, v), err.Error())
+		}
+		if err = s.setVersion(ctx, store, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Schema) setVersion(ctx context.Context, store SchemaStore, version int) error {
+	if err := store.SetSchemaVersion(ctx, version); err != nil {
+		return ErrServer.NewError(fmt.Sprintf("Recording schema version %v of %v failed.", version, s.Name), err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type memorySchemaStore struct {
+	version int
+	history []int
+}
+
+func (m *memorySchemaStore) SchemaVersion(context.Context) (int, error) {
+	return m.version, nil
+}
+
+func (m *memorySchemaStore) SetSchemaVersion(_ context.Context, version int) error {
+	m.version = version
+	m.history = append(m.history, version)
+	return nil
+}
+
+func TestSchema_Check(t *testing.T) {
+	var ran []int
+	step := func(version int) Migration {
+		return Migration{Version: version, Migrate: func(context.Context) error {
+			ran = append(ran, version)
+			return nil
+		}}
+	}
+	schema := Schema{Name: "test", Version: 3, Migrations: []Migration{step(3), step(2)}}
+	ctx := context.Background()
+
+	fresh := &memorySchemaStore{}
+	if err := schema.Check(ctx, fresh); err != nil || fresh.version != 3 || len(ran) != 0 {
+		t.Errorf("Expected fresh state to be stamped, got %v %v %v", err, fresh.version, ran)
+	}
+
+	old := &memorySchemaStore{version: 1}
+	if err := schema.Check(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []int{2, 3}) || !reflect.DeepEqual(old.history, []int{2, 3}) {
+		t.Errorf("Expected migrations 2 and 3 in order, ran %v recorded %v", ran, old.history)
+	}
+
+	newer := &memorySchemaStore{version: 4}
+	if err := schema.Check(ctx, newer); err == nil || newer.version != 4 {
+		t.Error("Expected newer state to be refused untouched, got", err)
+	}
+
+	ran = nil
+	gap := &memorySchemaStore{version: 1}
+	if err := (Schema{Name: "gap", Version: 3, Migrations: []Migration{step(3)}}).Check(ctx, gap); err == nil || len(ran) != 0 {
+		t.Errorf("Expected missing migration to be refused before migrating, got %v %v", err, ran)
+	}
+}
+
+func TestSchema_CheckFailedMigration(t *testing.T) {
+	schema := Schema{Name: "test", Version: 3, Migrations: []Migration{
+		{Version: 2, Migrate: func(context.Context) error { return nil }},
+		{Version: 3, Migrate: func(context.Context) error { return errors.New("boom") }},
+	}}
+	store := &memorySchemaStore{version: 1}
+	if err := schema.Check(context.Background(), store); err == nil {
+		t.Fatal("Expected failed migration to be reported")
+	}
+	// the completed step is kept so the next start resumes from it
+	if store.version != 2 {
+		t.Error("Expected version 2 to be recorded, got", store.version)
+	}
+}
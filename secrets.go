@@ -0,0 +1,60 @@
+package guac
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	secretRefPrefix = "${secret:"
+	secretRefSuffix = "}"
+)
+
+// SecretsProvider looks up the secrets connection parameters refer to, such as RDP and SSH
+// passwords kept in a vault, so they never need to be held in a Config or show up in logs.
+type SecretsProvider interface {
+	// Get returns the secret stored under key
+	Get(ctx context.Context, key string) (string, error)
+}
+
+// SecretsProviderFunc adapts an ordinary function to the SecretsProvider interface
+type SecretsProviderFunc func(ctx context.Context, key string) (string, error)
+
+// Get calls f(ctx, key)
+func (f SecretsProviderFunc) Get(ctx context.Context, key string) (string, error) {
+	return f(ctx, key)
+}
+
+// SecretRef returns the parameter value referring to the secret stored under key, which is
+// replaced with the secret during the handshake with guacd:
+//
+//	config.Parameters["password"] = guac.SecretRef("rdp/desktop-1/password")
+func SecretRef(key string) string {
+	return secretRefPrefix + key + secretRefSuffix
+}
+
+// secretKey returns the key of the secret a parameter value refers to, if it refers to one
+func secretKey(value string) (string, bool) {
+	if !strings.HasPrefix(value, secretRefPrefix) || !strings.HasSuffix(value, secretRefSuffix) {
+		return "", false
+	}
+	return value[len(secretRefPrefix) : len(value)-len(secretRefSuffix)], true
+}
+
+// resolveParameter returns the value of a parameter, looking up the secret it refers to if it
+// refers to one
+func resolveParameter(ctx context.Context, secrets SecretsProvider, name, value string) (string, error) {
+	key, ok := secretKey(value)
+	if !ok {
+		return value, nil
+	}
+	if secrets == nil {
+		return "", ErrServer.NewError("Parameter " + name + " refers to a secret but there is no secrets provider.")
+	}
+	secret, err := secrets.Get(ctx, key)
+	if err != nil {
+		handshakeLog.Warnf("Unable to look up the secret of parameter %v: %v", name, err)
+		return "", ErrServer.NewError("Unable to look up the secret of parameter " + name + ".")
+	}
+	return secret, nil
+}
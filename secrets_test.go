@@ -0,0 +1,62 @@
+package guac
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// argsDialer connects to a fake guacd which asks for the given arguments
+type argsDialer struct {
+	args []string
+	conn *fakeConn
+}
+
+func (d *argsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.conn = &fakeConn{
+		ToRead: []byte(NewInstruction(OpcodeArgs, append([]string{"VERSION_1_5_0"}, d.args...)...).String() + "5.ready,4.$abc;"),
+	}
+	return d.conn, nil
+}
+
+func TestBackend_Secrets(t *testing.T) {
+	dialer := &argsDialer{args: []string{"hostname", "password"}}
+	var keys []string
+	backend := &Backend{
+		Dialer: dialer,
+		Secrets: SecretsProviderFunc(func(ctx context.Context, key string) (string, error) {
+			keys = append(keys, key)
+			return "hunter2", nil
+		}),
+	}
+	config := NewGuacamoleConfiguration()
+	config.Parameters["hostname"] = "desktop-1"
+	config.Parameters["password"] = SecretRef("rdp/desktop-1")
+	config.Parameters["private-key"] = SecretRef("unused")
+
+	if _, err := backend.Connect(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dialer.conn.Written), "7.connect,13.VERSION_1_5_0,9.desktop-1,7.hunter2;") {
+		t.Errorf("Expected the secret to be sent, sent %q", dialer.conn.Written)
+	}
+	if len(keys) != 1 || keys[0] != "rdp/desktop-1" {
+		t.Error("Expected only the secrets guacd asked for to be looked up, got", keys)
+	}
+	if config.Parameters["password"] != SecretRef("rdp/desktop-1") {
+		t.Error("Expected the config to keep the reference")
+	}
+
+	backend.Secrets = SecretsProviderFunc(func(ctx context.Context, key string) (string, error) {
+		return "", errors.New("vault sealed")
+	})
+	if _, err := backend.Connect(context.Background(), config); err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Error("Expected a failed lookup to fail the handshake, got", err)
+	}
+	backend.Secrets = nil
+	if _, err := backend.Connect(context.Background(), config); err == nil {
+		t.Error("Expected a reference without a provider to fail")
+	}
+}
@@ -0,0 +1,105 @@
+package guac
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// SequenceOpcode is the opcode of the instructions numbered by NewSequenceInstruction
+const SequenceOpcode = "seq"
+
+// NewSequenceInstruction returns an instruction carrying the sequence number n, for tests
+// which check instructions keep their order end to end. Clients ignore opcodes they don't
+// know, so these may be mixed into a real session.
+func NewSequenceInstruction(n int64) *Instruction {
+	return NewInstruction(SequenceOpcode, strconv.FormatInt(n, 10))
+}
+
+// SequenceVerifier checks that the instructions made by NewSequenceInstruction arrive numbered
+// 0, 1, 2, ... without gaps, repeats or reordering. It is a test hook: write whatever a
+// transport delivers to it, in the order delivered and split anywhere, then check Err once
+// the stream is done. Instructions with other opcodes are ignored. It is safe for concurrent
+// use, although only one goroutine should write to it at a time for the order to mean anything.
+type SequenceVerifier struct {
+	sync.Mutex
+	pending []byte
+	next    int64
+	errs    []error
+}
+
+// Write feeds the verifier the next part of the stream of instructions
+func (v *SequenceVerifier) Write(p []byte) (int, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.pending = append(v.pending, p...)
+	for len(v.pending) > 0 {
+		parser := &Stream{buffer: v.pending, end: len(v.pending)}
+		end, err := parser.parse()
+		if err != nil {
+			v.errs = append(v.errs, fmt.Errorf("after instruction %v: %w", v.next-1, err))
+			v.pending = nil
+			break
+		}
+		if end == 0 {
+			break
+		}
+		instruction, err := Parse(v.pending[:end])
+		if err == nil {
+			v.verify(instruction)
+		}
+		v.pending = v.pending[end:]
+	}
+	return len(p), nil
+}
+
+// Verify checks a single instruction
+func (v *SequenceVerifier) Verify(instruction *Instruction) {
+	v.Lock()
+	v.verify(instruction)
+	v.Unlock()
+}
+
+func (v *SequenceVerifier) verify(instruction *Instruction) {
+	if instruction.Opcode != SequenceOpcode {
+		return
+	}
+	if len(instruction.Args) == 0 {
+		v.errs = append(v.errs, fmt.Errorf("instruction %v is not numbered", v.next))
+		return
+	}
+	n, err := strconv.ParseInt(instruction.Args[0], 10, 64)
+	switch {
+	case err != nil:
+		v.errs = append(v.errs, fmt.Errorf("instruction %v has sequence number %q", v.next, instruction.Args[0]))
+		return
+	case n < v.next:
+		v.errs = append(v.errs, fmt.Errorf("instruction %v repeated or reordered after %v", n, v.next-1))
+		return
+	case n > v.next:
+		v.errs = append(v.errs, fmt.Errorf("instructions %v to %v missing or reordered", v.next, n-1))
+	}
+	v.next = n + 1
+}
+
+// Count returns the number of numbered instructions expected so far, one more than the last
+// seen
+func (v *SequenceVerifier) Count() int64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.next
+}
+
+// Err returns the order violations seen, or nil if there were none. A partial instruction
+// left at the end of the stream is also an error.
+func (v *SequenceVerifier) Err() error {
+	v.Lock()
+	defer v.Unlock()
+	errs := v.errs
+	if len(v.pending) > 0 {
+		errs = append(errs[:len(errs):len(errs)], fmt.Errorf("stream ends with a partial instruction %q", v.pending))
+	}
+	return errors.Join(errs...)
+}
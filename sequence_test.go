@@ -0,0 +1,133 @@
+package guac
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSequenceVerifier(t *testing.T) {
+	verifier := &SequenceVerifier{}
+	stream := string(NewSequenceInstruction(0).Byte()) + "3.nop;" + string(NewSequenceInstruction(1).Byte())
+	for i := range stream {
+		_, _ = verifier.Write([]byte(stream[i : i+1]))
+	}
+	if err := verifier.Err(); err != nil || verifier.Count() != 2 {
+		t.Errorf("Expected 2 instructions in order, got %v %v", verifier.Count(), err)
+	}
+
+	_, _ = verifier.Write(NewSequenceInstruction(3).Byte())
+	_, _ = verifier.Write(NewSequenceInstruction(2).Byte())
+	_, _ = verifier.Write([]byte("3.seq,1"))
+	err := verifier.Err()
+	if err == nil {
+		t.Fatal("Expected violations")
+	}
+	for _, want := range []string{"instructions 2 to 2 missing", "instruction 2 repeated", "partial instruction"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %v", want, err)
+		}
+	}
+}
+
+// numberedGuacd sends count numbered instructions followed by a disconnect
+func numberedGuacd(count int64) *Stream {
+	client, guacd := net.Pipe()
+	go func() {
+		defer guacd.Close()
+		for n := int64(0); n < count; n++ {
+			if _, err := guacd.Write(NewSequenceInstruction(n).Byte()); err != nil {
+				return
+			}
+		}
+		_, _ = guacd.Write(NewInstruction(OpcodeDisconnect).Byte())
+	}()
+	return NewStream(client, time.Minute)
+}
+
+func TestSequence_HTTPReaderHandoff(t *testing.T) {
+	const count = 2000
+	server := NewServer(nil)
+	tunnel := NewSimpleTunnel(numberedGuacd(count))
+	server.registerTunnel(tunnel, nil, nil)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	read := func(n int) chan *http.Response {
+		done := make(chan *http.Response, 1)
+		go func() {
+			response, err := http.Get(httpServer.URL + "/tunnel?read:" + tunnel.GetUUID() + ":" + strconv.Itoa(n))
+			if err != nil {
+				t.Error(err)
+			}
+			done <- response
+		}()
+		return done
+	}
+
+	// like the JavaScript client, each read starts once the previous one is streaming, so the
+	// server hands the stream from one request to the next
+	verifier := &SequenceVerifier{}
+	response := <-read(0)
+	for n := 1; response != nil && response.StatusCode == http.StatusOK; n++ {
+		next := read(n)
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		_, _ = verifier.Write(body)
+		response = <-next
+	}
+	if response != nil {
+		_ = response.Body.Close()
+	}
+
+	if err := verifier.Err(); err != nil {
+		t.Error(err)
+	}
+	if verifier.Count() != count {
+		t.Errorf("Expected %v instructions, got %v", count, verifier.Count())
+	}
+}
+
+func TestSequence_HTTPWrites(t *testing.T) {
+	verifier := &SequenceVerifier{}
+	server := NewServer(nil)
+	tunnel := &uuidTunnel{fakeTunnel: fakeTunnel{writer: verifier}, uuid: "00000000-0000-0000-0000-000000000001"}
+	server.registerTunnel(tunnel, nil, nil)
+
+	for n := int64(0); n < 100; n += 4 {
+		body := &strings.Builder{}
+		for i := n; i < n+4; i++ {
+			body.Write(NewSequenceInstruction(i).Byte())
+		}
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnel.uuid, strings.NewReader(body.String())))
+	}
+	if err := verifier.Err(); err != nil || verifier.Count() != 100 {
+		t.Errorf("Expected 100 instructions in order, got %v %v", verifier.Count(), err)
+	}
+}
+
+type sequenceMessageWriter struct {
+	*SequenceVerifier
+}
+
+func (w sequenceMessageWriter) WriteMessage(_ int, data []byte) error {
+	_, err := w.Write(data)
+	return err
+}
+
+func TestSequence_Websocket(t *testing.T) {
+	const count = 2000
+	verifier := &SequenceVerifier{}
+	_ = guacdToWs(sequenceMessageWriter{verifier}, numberedGuacd(count))
+	if err := verifier.Err(); err != nil {
+		t.Error(err)
+	}
+	if verifier.Count() != count {
+		t.Errorf("Expected %v instructions, got %v", count, verifier.Count())
+	}
+}
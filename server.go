@@ -1,11 +1,18 @@
 package guac
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	logger "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -18,39 +25,463 @@ const (
 
 // Server uses HTTP requests to talk to guacd (as opposed to WebSockets in ws_server.go)
 type Server struct {
-	tunnels *TunnelMap
+	tunnels TunnelRegistry
 	connect func(*http.Request) (Tunnel, error)
+
+	// Authorizer optionally authenticates connect requests. The identity it returns is
+	// available to the connect callback through IdentityFromRequest.
+	Authorizer Authorizer
+
+	// StreamLimits optionally bounds the size of streams sent by the client.
+	StreamLimits *StreamLimits
+
+	// Captures optionally records the recent instructions of every tunnel for debugging.
+	Captures *CaptureDebugServer
+
+	// DuplicateConnects optionally detects clients repeating a connect request.
+	DuplicateConnects *DuplicateConnectGuard
+
+	// MaxTunnels optionally limits the number of tunnels open at once. Connect requests beyond
+	// the limit are refused with ClientTooMany rather than exhausting guacd or file descriptors.
+	MaxTunnels int
+
+	// Quota optionally limits how many tunnels each user may hold open at once.
+	Quota *SessionQuota
+
+	// Tags optionally returns the tags of a tunnel created by a connect request, such as its
+	// tenant, connection group and protocol, so it can be looked up by them later.
+	Tags func(r *http.Request, tunnel Tunnel) Tags
+
+	// Admission optionally holds connect requests back while the server is overloaded, before
+	// they dial guacd. Utilization is measured against MaxTunnels.
+	Admission *AdmissionController
+
+	// Reaper optionally closes tunnels whose client or connection to guacd has died, without
+	// waiting for a read or write to fail.
+	Reaper *Reaper
+
+	// PollHints optionally adds headers to read responses suggesting how long clients should
+	// wait between polls, based on the load of the server.
+	PollHints *PollHints
+
+	// CloseMessages optionally replaces what clients are told when guacd closes the
+	// connection, DefaultCloseMessages if nil.
+	CloseMessages CloseMessages
+
+	// IdleTimeout is how long a tunnel may go without read or write requests before it is
+	// closed and deregistered, TunnelTimeout if zero.
+	IdleTimeout time.Duration
+
+	// Maintenance optionally overlays a maintenance banner on every tunnel.
+	Maintenance *Maintenance
+
+	// Rules optionally evaluates rules against the connect and disconnect events of tunnels.
+	Rules *RuleEngine
+
+	// OnConnect is an optional callback run when a tunnel is registered.
+	OnConnect func(*TunnelInfo)
+
+	// OnClose is an optional callback run once when a tunnel is deregistered, whether it was
+	// closed by guacd, the client, a timeout or Shutdown.
+	OnClose func(*TunnelInfo)
+
+	// OnError is an optional callback run before OnClose when a tunnel ends because of an
+	// error, rather than guacd ending the session cleanly.
+	OnError func(*TunnelInfo, error)
+
+	// OnShutdown is an optional callback given the report of a completed Shutdown.
+	OnShutdown func(*ShutdownReport)
+
+	// ReplayBuffer is optionally the number of bytes of the most recent instructions kept for
+	// each tunnel, so a client which briefly loses its connection can reattach to the tunnel
+	// and resume from where it was cut off, rather than reconnecting to guacd. Read responses
+	// give their offset in the ReplayOffsetHeader, and a client resumes by sending the offset
+	// it reached in the ResumeOffsetHeader of its next read. It must do so before the tunnel's
+	// IdleTimeout. Clients are also given a token in the ResumeTokenHeader with which they can
+	// move the tunnel to a new connection, even over another transport, as with a
+	// WebsocketServer whose Resumable is this server.
+	ReplayBuffer int
+
+	// LiveFilters wraps every tunnel in a FilteredTunnel, so the built-in filters of a Policy
+	// can be added to and removed from tunnels in use with AddTunnelFilter and
+	// RemoveTunnelFilter.
+	LiveFilters bool
+
+	// StrictIdentity enforces the expiry of the identity a tunnel was opened for on each read
+	// and write request. Once it expires, a request may renew it by carrying credentials the
+	// Authorizer accepts for the same user; otherwise the tunnel is killed and the request
+	// refused with the ReauthenticateHeader set.
+	StrictIdentity bool
+
+	// TunnelAuthorizer optionally decides whether each read and write request may use its
+	// tunnel, so knowing the UUID of a tunnel is not enough to attach to it. OwnerOnly
+	// restricts tunnels to the user they were opened for.
+	TunnelAuthorizer TunnelAuthorizer
+
+	// AccessTokens optionally gives clients a signed token for their tunnel in the
+	// AccessTokenHeader of the connect response, which each read and write request must
+	// present.
+	AccessTokens *AccessTokens
+
+	// IPFilter optionally refuses requests from the addresses it doesn't allow, before they
+	// reach the connect callback.
+	IPFilter *IPFilter
+
+	// CORS optionally lets pages from other origins use the tunnel, refusing requests from
+	// origins it doesn't allow.
+	CORS *CORSPolicy
+
+	// CSRF optionally protects connect and write requests against cross-site request forgery.
+	CSRF *CSRFProtection
+
+	// ReauthenticateURL is optionally where clients refused by StrictIdentity should send
+	// users to authenticate again, given in the ReauthenticateHeader.
+	ReauthenticateURL string
+
+	// ForwardToOwner proxies read and write requests for tunnels owned by another node of a
+	// cluster to that node, when the registry is a TunnelLocator. Otherwise such requests fail
+	// with the owner named in the TunnelOwnerHeader.
+	ForwardToOwner bool
+
+	// MinFlushInterval optionally sets the shortest time between flushes of a read response,
+	// capping how often the client is sent frames. Instructions arriving in between are sent
+	// with the next flush.
+	MinFlushInterval time.Duration
+
+	// ConnectTimeout bounds the connect callback, along with the handshake with guacd it
+	// performs, DefaultConnectTimeout if zero. The callback's request is cancelled once it
+	// passes, and the client is told of an UpstreamTimeout. If negative, connecting may take
+	// as long as it takes.
+	ConnectTimeout time.Duration
+
+	// GuacdLogs passes the log and error instructions guacd sends to the LogGuacd subsystem
+	// logger, and keeps the most recent in a journal for each tunnel, available from
+	// TunnelJournal and to OnClose, as well as forwarding them to the client.
+	GuacdLogs bool
+
+	// Limits optionally resolves the limits of each tunnel from layers for tenants, users and
+	// the tunnel itself, on top of the values of StreamLimits, Quota.Max, IdleTimeout,
+	// MinFlushInterval and MaxReadWait. The StreamLimits wrapper is then installed on tunnels
+	// with stream limits even if StreamLimits is nil.
+	Limits *LimitHierarchy
+
+	// MaxReadWait optionally limits how long a read request waits for the read requests ahead
+	// of it on the same tunnel to hand over, after which it is refused with ServerBusy and the
+	// tunnel stays open. Read requests are handed the tunnel in the order they arrive.
+	MaxReadWait time.Duration
+
+	// LockOSThread wires goroutines streaming read requests to their OS threads for the
+	// duration of the request.
+	LockOSThread bool
+
+	// Metrics optionally measures the server's tunnels.
+	Metrics Metrics
+
+	// Counters optionally counts the server's tunnels, connects and bytes through expvar.
+	Counters *Counters
+
+	// Events optionally publishes the events of the server's tunnels to its subscribers.
+	Events *EventBus
+
+	// SlowClients optionally detects clients whose read responses back up, dropping frames,
+	// throttling or disconnecting them.
+	SlowClients *SlowClientPolicy
+
+	// Audit optionally receives structured audit events as tunnels connect, fail to connect
+	// and close.
+	Audit AuditSink
+
+	// Logger optionally receives the messages about the server's requests and tunnels, in
+	// place of the package's logger. Messages about a tunnel carry its UUID and connection ID.
+	Logger Logger
+
+	// TracerProvider optionally traces requests, continuing the traces clients propagate in
+	// the format of the global propagator. Spans carry the UUID and connection ID of the
+	// tunnel, and a Backend connecting with the context of the connect callback's request
+	// traces dialing and the handshake within them. otel.GetTracerProvider() traces with the
+	// global provider.
+	TracerProvider trace.TracerProvider
+
+	shuttingDown atomic.Bool
+	// requests counts read and write requests in progress
+	requests atomic.Int32
+	// connecting counts connect requests which have reserved a place under MaxTunnels
+	connecting atomic.Int32
+	// ended remembers why tunnels were killed, for their clients' next requests
+	ended endedTunnels
+	// readLatency and writeLatency measure the read and write requests of every tunnel
+	readLatency, writeLatency latencyHistogram
+}
+
+// TunnelInfo describes a tunnel to the lifecycle callbacks of a Server
+type TunnelInfo struct {
+	UUID         string
+	ConnectionID string
+	// Identity is the user the tunnel was opened for, nil without an Authorizer
+	Identity  *Identity
+	Connected time.Time
+	// Metadata holds the values the connect callback attached to the tunnel
+	Metadata *Metadata
+	// Journal keeps the diagnostics guacd sent about the tunnel, nil without GuacdLogs
+	Journal *Journal
+	// Tags label the tunnel, nil without Tags
+	Tags Tags
 }
 
 // NewServer constructor
 func NewServer(connect func(r *http.Request) (Tunnel, error)) *Server {
-	return &Server{
-		tunnels: NewTunnelMap(),
+	return NewServerWithRegistry(connect, NewTunnelMap())
+}
+
+// NewServerWithRegistry creates a server keeping its tunnels in the given registry rather
+// than a TunnelMap.
+func NewServerWithRegistry(connect func(r *http.Request) (Tunnel, error), registry TunnelRegistry) *Server {
+	s := &Server{
+		tunnels: registry,
 		connect: connect,
 	}
+	if expiring, ok := registry.(ExpiringTunnelRegistry); ok {
+		expiring.SetOnExpire(func(uuid string, tunnel *LastAccessedTunnel) {
+			s.tunnelClosed(uuid, tunnel, nil)
+		})
+	}
+	return s
+}
+
+// utilization returns the fraction of MaxTunnels open or being opened, zero without a limit
+func (s *Server) utilization() float64 {
+	if s.MaxTunnels <= 0 {
+		return 0
+	}
+	return float64(s.tunnels.Len()+int(s.connecting.Load())) / float64(s.MaxTunnels)
+}
+
+// reserveTunnel returns true if another tunnel may be opened without exceeding MaxTunnels, in
+// which case the caller must decrement connecting once the tunnel is registered or has failed.
+func (s *Server) reserveTunnel() bool {
+	n := int(s.connecting.Add(1))
+	if s.MaxTunnels > 0 && s.tunnels.Len()+n > s.MaxTunnels {
+		s.connecting.Add(-1)
+		return false
+	}
+	return true
 }
 
 // Registers the given tunnel such that future read/write requests to that tunnel will be properly directed.
-func (s *Server) registerTunnel(tunnel Tunnel) {
-	s.tunnels.Put(tunnel.GetUUID(), tunnel)
-	logger.Debugf("Registered tunnel %v.", tunnel.GetUUID())
+func (s *Server) registerTunnel(tunnel Tunnel, identity *Identity, metadata *Metadata) *LastAccessedTunnel {
+	return s.registerTaggedTunnel(tunnel, identity, metadata, nil)
+}
+
+// registerTaggedTunnel registers the given tunnel along with its tags
+func (s *Server) registerTaggedTunnel(tunnel Tunnel, identity *Identity, metadata *Metadata, tags Tags) *LastAccessedTunnel {
+	registered := newRegisteredTunnel(tunnel, identity, metadata)
+	registered.tags = tags.clone()
+	registered.closeMessages = s.CloseMessages
+	if s.IdleTimeout > 0 {
+		registered.setIdleTimeout(s.IdleTimeout)
+	}
+	if s.ReplayBuffer > 0 {
+		registered.replay = newReplayBuffer(s.ReplayBuffer)
+		registered.resumeToken = newResumeToken()
+	}
+	var filtered *FilteredTunnel
+	if s.GuacdLogs && AsTunnel(tunnel, &filtered) {
+		registered.journal = NewJournal(0)
+		filtered.AddReadFilter(NewGuacdLogFilter(tunnel.GetUUID(), registered.journal))
+	}
+	if s.SlowClients != nil {
+		registered.slow = newSlowClient(s.SlowClients, registered)
+	}
+	s.tunnels.Register(tunnel.GetUUID(), registered)
+	s.log(registryLog, tunnel).Debugf("Registered tunnel %v.", tunnel.GetUUID())
+	if s.Metrics != nil {
+		s.Metrics.TunnelOpened()
+	}
+	if s.Counters != nil {
+		s.Counters.tunnels.Add(1)
+	}
+	if s.Reaper != nil {
+		s.Reaper.start(s)
+	}
+
+	if s.OnConnect != nil {
+		s.OnConnect(tunnelInfo(tunnel.GetUUID(), registered))
+	}
+	if s.Events != nil {
+		s.Events.Publish(&TunnelOpened{EventSession: sessionOf(registered), Transport: "http"})
+	}
+
+	if s.Rules != nil {
+		fields := map[string]string{"connection_id": tunnel.ConnectionID()}
+		if identity != nil {
+			fields["user"] = identity.Subject
+		}
+		s.Rules.Fire(&Event{Type: EventConnect, UUID: tunnel.GetUUID(), Fields: fields, Tunnel: registered})
+	}
+	return registered
 }
 
 // Deregisters the given tunnel such that future read/write requests to that tunnel will be rejected.
-func (s *Server) deregisterTunnel(tunnel Tunnel) {
-	s.tunnels.Remove(tunnel.GetUUID())
-	logger.Debugf("Deregistered tunnel %v.", tunnel.GetUUID())
+// The error which ended the tunnel, if any, is passed to OnError.
+func (s *Server) deregisterTunnel(tunnel Tunnel, cause error) {
+	registered, ok := s.tunnels.Remove(tunnel.GetUUID())
+	if s.Captures != nil {
+		s.Captures.Forget(tunnel.GetUUID())
+	}
+	s.log(registryLog, tunnel).Debugf("Deregistered tunnel %v.", tunnel.GetUUID())
+
+	if ok {
+		s.tunnelClosed(tunnel.GetUUID(), registered, cause)
+	}
+}
+
+// tunnelClosed runs the callbacks and rules for a tunnel which has just been removed
+func (s *Server) tunnelClosed(uuid string, tunnel *LastAccessedTunnel, cause error) {
+	if tunnel.cancel != nil {
+		tunnel.cancel()
+	}
+	if s.Quota != nil {
+		s.Quota.closed(uuid)
+	}
+	if s.Metrics != nil {
+		s.Metrics.TunnelClosed()
+	}
+	if s.Counters != nil {
+		s.Counters.tunnels.Add(-1)
+	}
+	if s.Events != nil {
+		s.Events.Publish(&TunnelClosed{EventSession: sessionOf(tunnel), Cause: cause, Duration: time.Since(tunnel.Created())})
+	}
+	if reason := tunnel.killedWith(); reason != nil {
+		s.ended.add(uuid, tunnel, reason)
+	}
+	tunnel.RLock()
+	record := tunnel.audit
+	tunnel.RUnlock()
+	if record != nil {
+		sink := record.sink
+		if sink == nil {
+			sink = s.Audit
+		}
+		if sink != nil {
+			emitAudit(sink, record.registeredDisconnected(tunnel, cause))
+		}
+	}
+	info := tunnelInfo(uuid, tunnel)
+	if cause != nil && CloseReasonOf(cause) != CloseEOF && s.OnError != nil {
+		s.OnError(info, cause)
+	}
+	if s.OnClose != nil {
+		s.OnClose(info)
+	}
+	if s.Rules != nil {
+		s.Rules.Fire(&Event{Type: EventDisconnect, UUID: uuid})
+	}
 }
 
-// Returns the tunnel with the given UUID.
-func (s *Server) getTunnel(tunnelUUID string) (ret Tunnel, err error) {
-	var ok bool
-	ret, ok = s.tunnels.Get(tunnelUUID)
+// log returns the logger of subsystem for messages about the server's requests, and about
+// tunnel if not nil
+func (s *Server) log(subsystem *subsystemLogger, tunnel Tunnel) *subsystemLogger {
+	return subsystem.with(s.Logger, tunnelLogFields(tunnel))
+}
+
+func tunnelInfo(uuid string, tunnel *LastAccessedTunnel) *TunnelInfo {
+	return &TunnelInfo{
+		UUID:         uuid,
+		ConnectionID: tunnel.ConnectionID(),
+		Identity:     tunnel.Identity(),
+		Connected:    tunnel.Created(),
+		Metadata:     tunnel.Metadata(),
+		Journal:      tunnel.journal,
+		Tags:         tunnel.Tags(),
+	}
+}
+
+// KillTunnel terminates the tunnel with the given UUID immediately: it is deregistered, its
+// connection to guacd is closed, and a read request in progress is sent an error instruction
+// giving the reason, so the client shows it rather than a generic disconnect.
+func (s *Server) KillTunnel(tunnelUUID string, reason string) error {
+	return s.killTunnel(tunnelUUID, NewErrorInstruction(reason, SessionClosed))
+}
 
+// killTunnel terminates the tunnel, sending a read in progress the given error instruction
+func (s *Server) killTunnel(tunnelUUID string, reason *Instruction) error {
+	tunnel, ok := s.tunnels.Remove(tunnelUUID)
 	if !ok {
-		err = ErrResourceNotFound.NewError("No such tunnel.")
+		return ErrResourceNotFound.NewError("No such tunnel.")
 	}
-	return
+	if s.Captures != nil {
+		s.Captures.Forget(tunnelUUID)
+	}
+	s.log(registryLog, tunnel).Infof("Killing tunnel %v: %v", tunnelUUID, reason.Args[0])
+
+	err := tunnel.kill(reason)
+	s.tunnelClosed(tunnelUUID, tunnel, nil)
+	if err != nil {
+		return ErrServer.NewError("Unable to close tunnel.", err.Error())
+	}
+	return nil
+}
+
+// TunnelMetadata returns the metadata of the open tunnel with the given UUID.
+func (s *Server) TunnelMetadata(tunnelUUID string) (*Metadata, bool) {
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return nil, false
+	}
+	return tunnel.Metadata(), true
+}
+
+// SetIdleTimeout changes how long the tunnel with the given UUID may go without read or write
+// requests before it is closed. A timeout of zero restores the server's IdleTimeout.
+func (s *Server) SetIdleTimeout(tunnelUUID string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = s.IdleTimeout
+	}
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	tunnel.setIdleTimeout(timeout)
+	return nil
+}
+
+// ConnectionID returns the guacd connection ID of the tunnel with the given UUID, which other
+// tunnels may join with NewJoinConfiguration to share its session.
+func (s *Server) ConnectionID(tunnelUUID string) (string, error) {
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return "", ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	return tunnel.ConnectionID(), nil
+}
+
+// ConnectionTunnels returns the UUIDs of the open tunnels on the guacd connection with the
+// given ID, the tunnel which opened it along with those which joined it, so sessions can be
+// matched with recordings and other artifacts named after their connection.
+func (s *Server) ConnectionTunnels(connectionID string) []string {
+	var uuids []string
+	s.tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		if tunnel.ConnectionID() == connectionID {
+			uuids = append(uuids, uuid)
+		}
+		return true
+	})
+	sort.Strings(uuids)
+	return uuids
+}
+
+// findTunnel returns the tunnel with the given UUID without recording an access to it, which
+// waits until the request is authorized, or the tunnel killed recently under it along with
+// the reason it was.
+func (s *Server) findTunnel(tunnelUUID string) (*LastAccessedTunnel, *Instruction, error) {
+	if tunnel, ok := s.tunnels.Peek(tunnelUUID); ok {
+		return tunnel, nil, nil
+	}
+	if ended, ok := s.ended.get(tunnelUUID); ok {
+		return ended.tunnel, ended.reason, nil
+	}
+	return nil, nil, ErrResourceNotFound.NewError("No such tunnel.")
 }
 
 func (s *Server) sendError(response http.ResponseWriter, guacStatus Status, message string) {
@@ -60,43 +491,200 @@ func (s *Server) sendError(response http.ResponseWriter, guacStatus Status, mess
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, span := startRequestSpan(s.TracerProvider, r, requestSpanName(r.URL.RawQuery))
 	err := s.handleTunnelRequestCore(w, r)
+	endSpan(span, err)
 	if err == nil {
 		return
 	}
-	guacErr := err.(*ErrGuac)
-	switch guacErr.Kind {
-	case ErrClient:
-		logger.Warn("HTTP tunnel request rejected: ", err.Error())
+	guacErr := asErrGuac(err)
+	switch {
+	case guacErr.Kind.isClientError():
+		s.log(transportLog, nil).Warn("HTTP tunnel request rejected: ", err.Error())
 		s.sendError(w, guacErr.Status, err.Error())
 	default:
-		logger.Error("HTTP tunnel request failed: ", err.Error())
-		logger.Debug("Internal error in HTTP tunnel.", err)
+		s.log(transportLog, nil).Error("HTTP tunnel request failed: ", err.Error())
+		s.log(transportLog, nil).Debug("Internal error in HTTP tunnel.", err)
 		s.sendError(w, guacErr.Status, "Internal server error.")
 	}
 	return
 }
 
 func (s *Server) handleTunnelRequestCore(response http.ResponseWriter, request *http.Request) (err error) {
+	if s.IPFilter != nil {
+		if request, err = s.IPFilter.check(request, "http", s.Audit, s.log(transportLog, nil)); err != nil {
+			return err
+		}
+	}
+	if s.CORS != nil {
+		if preflight, err := s.CORS.apply(response, request); preflight || err != nil {
+			return err
+		}
+	}
+
 	query := request.URL.RawQuery
 	if len(query) == 0 {
 		return ErrClient.NewError("No query string provided.")
 	}
+	if err = s.checkCSRF(request, query); err != nil {
+		return err
+	}
 
 	// Call the supplied connect callback upon HTTP connect request
 	if query == "connect" {
-		tunnel, e := s.connect(request)
+		if s.shuttingDown.Load() {
+			return ErrServerBusy.NewError("Server is shutting down.")
+		}
+
+		request, identity, e := authorize(s.Authorizer, request)
 		if e != nil {
-			err = ErrResourceNotFound.NewError("No tunnel created.", e.Error())
-			return
+			if s.Audit != nil {
+				emitAudit(s.Audit, newAuditRecord(request, "http", nil).failed(e))
+			}
+			return e
 		}
 
-		s.registerTunnel(tunnel)
+		if token := request.Header.Get(ResumeTokenHeader); token != "" {
+			tunnel, e := s.resumeTunnel(token, identity)
+			if e != nil {
+				return e
+			}
+			if e = s.issueAccessToken(response, tunnel.GetUUID(), identity); e != nil {
+				return e
+			}
+			response.Header().Set("Cache-Control", "no-cache")
+			if _, e = response.Write([]byte(tunnel.GetUUID())); e != nil {
+				return ErrServer.NewError(e.Error())
+			}
+			return nil
+		}
+
+		var record *auditRecord
+		uuid, e := s.connectGuarded(request, identity, func() (string, error) {
+			if s.Admission != nil {
+				if e := s.Admission.admit(request.Context(), s.utilization, s.log(transportLog, nil)); e != nil {
+					return "", e
+				}
+			}
+			if !s.reserveTunnel() {
+				s.log(transportLog, nil).Warnf("Refusing connect request, %v tunnels are open.", s.MaxTunnels)
+				return "", ErrClientTooMany.NewError("Too many tunnels are open.")
+			}
+			defer s.connecting.Add(-1)
+
+			var quotaKey string
+			if s.Quota != nil {
+				key, e := s.Quota.acquire(request, identity, s.maxSessions(identity), s.log(transportLog, nil))
+				if e != nil {
+					if s.Events != nil {
+						s.Events.Publish(&QuotaExceeded{EventSession: EventSession{Identity: identity}, Key: key, Err: e})
+					}
+					return "", e
+				}
+				quotaKey = key
+			}
+
+			request, metadata := withMetadata(request)
+			if s.Audit != nil {
+				request, record = withAuditRecord(request, "http", identity)
+			}
+			request, redactions := withRedaction(request)
+			tunnel, e := connectWithTimeout(request, connectTimeout(s.ConnectTimeout), s.connect)
+			if e != nil {
+				// connect callbacks may echo the parameters of their connections in their errors
+				e = redactions.redact(e)
+				if s.Quota != nil {
+					s.Quota.release(quotaKey)
+				}
+				if asErrGuac(e).Kind == ErrUpstreamTimeout {
+					return "", e
+				}
+				return "", ErrResourceNotFound.NewError("No tunnel created.", e.Error())
+			}
+			if s.Metrics != nil {
+				tunnel = connectedTunnel(s.Metrics, tunnel)
+			}
+			if s.Counters != nil {
+				tunnel = s.Counters.connected(tunnel)
+			}
+
+			var limits Limits
+			if s.Limits != nil {
+				limits = s.Limits.resolve(s.baseLimits(), identity, metadata)
+				if streamLimits := limits.effective().streamLimits(); streamLimits != nil {
+					tunnel = streamLimits.wrap(tunnel)
+				}
+			} else if s.StreamLimits != nil {
+				tunnel = s.StreamLimits.wrap(tunnel)
+			}
+			if _, ok := tunnel.(*FilteredTunnel); (s.LiveFilters || s.GuacdLogs) && !ok {
+				tunnel = NewFilteredTunnel(tunnel)
+			}
+			if s.Captures != nil {
+				s.Captures.prune(s.tunnels)
+				tunnel = s.Captures.wrap(tunnel.GetUUID(), tunnel)
+			}
+
+			if s.Quota != nil {
+				s.Quota.bind(tunnel.GetUUID(), quotaKey)
+			}
+			var tags Tags
+			if s.Tags != nil {
+				tags = s.Tags(request, tunnel)
+			}
+			registered := s.registerTaggedTunnel(tunnel, identity, metadata, tags)
+			if record != nil {
+				record.connected = registered.Created()
+				registered.Lock()
+				registered.audit = record
+				registered.Unlock()
+				emitAudit(s.Audit, record.event(AuditConnect, tunnel))
+			}
+			setTunnelAttributes(request.Context(), tunnel)
+			if s.Limits != nil {
+				registered.Lock()
+				registered.limits = limits
+				registered.Unlock()
+				registered.setIdleTimeout(limits.effective().IdleTimeout)
+			}
+			return tunnel.GetUUID(), nil
+		})
+		if e != nil {
+			if s.Metrics != nil {
+				connectFailed(s.Metrics, e)
+			}
+			if s.Counters != nil {
+				s.Counters.connectFailed(e)
+			}
+			if s.Audit != nil {
+				if record == nil {
+					record = newAuditRecord(request, "http", identity)
+				}
+				emitAudit(s.Audit, record.failed(e))
+			}
+			return e
+		}
+
+		if s.Limits != nil {
+			if tunnel, ok := s.tunnels.Peek(uuid); ok {
+				if streamLimits := tunnel.sessionLimits().streamLimits(); streamLimits != nil {
+					streamLimits.setHeaders(response.Header())
+				}
+			}
+		} else if s.StreamLimits != nil {
+			s.StreamLimits.setHeaders(response.Header())
+		}
+		if tunnel, ok := s.tunnels.Peek(uuid); ok && tunnel.resumeToken != "" {
+			response.Header().Set(ResumeTokenHeader, tunnel.resumeToken)
+		}
+		if e = s.issueAccessToken(response, uuid, identity); e != nil {
+			return e
+		}
 
 		// Ensure buggy browsers do not cache response
 		response.Header().Set("Cache-Control", "no-cache")
 
-		_, e = response.Write([]byte(tunnel.GetUUID()))
+		_, e = response.Write([]byte(uuid))
 
 		if e != nil {
 			err = ErrServer.NewError(e.Error())
@@ -106,10 +694,20 @@ func (s *Server) handleTunnelRequestCore(response http.ResponseWriter, request *
 	}
 
 	// Connect has already been called so we use the UUID to do read and writes to the existing session
+	s.requests.Add(1)
+	defer s.requests.Add(-1)
 	if strings.HasPrefix(query, readPrefix) && len(query) >= readPrefixLength+uuidLength {
-		err = s.doRead(response, request, query[readPrefixLength:readPrefixLength+uuidLength])
+		tunnelUUID := query[readPrefixLength : readPrefixLength+uuidLength]
+		if _, ok := s.tunnels.Peek(tunnelUUID); !ok && s.routeToOwner(response, request, tunnelUUID) {
+			return nil
+		}
+		err = s.doRead(response, request, tunnelUUID)
 	} else if strings.HasPrefix(query, writePrefix) && len(query) >= writePrefixLength+uuidLength {
-		err = s.doWrite(response, request, query[writePrefixLength:writePrefixLength+uuidLength])
+		tunnelUUID := query[writePrefixLength : writePrefixLength+uuidLength]
+		if _, ok := s.tunnels.Peek(tunnelUUID); !ok && s.routeToOwner(response, request, tunnelUUID) {
+			return nil
+		}
+		err = s.doWrite(response, request, tunnelUUID)
 	} else {
 		err = ErrClient.NewError("Invalid tunnel operation: " + query)
 	}
@@ -119,59 +717,161 @@ func (s *Server) handleTunnelRequestCore(response http.ResponseWriter, request *
 
 // doRead takes guacd messages and sends them in the response
 func (s *Server) doRead(response http.ResponseWriter, request *http.Request, tunnelUUID string) error {
-	tunnel, err := s.getTunnel(tunnelUUID)
+	arrived := time.Now()
+	tunnel, ended, err := s.findTunnel(tunnelUUID)
 	if err != nil {
 		return err
 	}
+	setTunnelAttributes(request.Context(), tunnel)
+	if err = s.checkAccessToken(response, request, tunnelUUID, tunnel); err != nil {
+		return err
+	}
+	if err = s.authorizeTunnel(request, OperationRead, tunnelUUID, tunnel); err != nil {
+		return err
+	}
+	if ended != nil {
+		s.sendEnded(response, ended, true)
+		return nil
+	}
+	if err = s.checkIdentity(response, request, tunnelUUID, tunnel); err != nil {
+		return err
+	}
+	tunnel.Access()
 
-	reader := tunnel.AcquireReader()
+	ctx := request.Context()
+	if wait := s.tunnelLimits(tunnel).MaxReadWait; wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+	reader, err := AcquireReader(ctx, tunnel)
+	if err != nil {
+		if request.Context().Err() != nil {
+			// the client gave up waiting, and the tunnel stays open for its next read
+			return nil
+		}
+		s.log(transportLog, tunnel).Debugf("Read of tunnel %v gave up waiting for the reader.", tunnelUUID)
+		return err
+	}
 	defer tunnel.ReleaseReader()
+	if s.Maintenance != nil {
+		reader = s.Maintenance.reader(reader, &tunnel.bannerVersion, !speaksMsg(tunnel))
+	}
+
+	var missed []byte
+	if tunnel.replay != nil {
+		var offset int64
+		if missed, offset, err = replayFor(request, tunnel.replay); err != nil {
+			return err
+		}
+		response.Header().Set(ReplayOffsetHeader, strconv.FormatInt(offset, 10))
+	}
 
 	// Note that although we are sending text, Webkit browsers will
 	// buffer 1024 bytes before starting a normal stream if we use
 	// anything but application/octet-stream.
 	response.Header().Set("Content-Type", "application/octet-stream")
 	response.Header().Set("Cache-Control", "no-cache")
+	if s.PollHints != nil {
+		s.PollHints.set(response.Header(), s.load())
+	}
 
-	if v, ok := response.(http.Flusher); ok {
-		v.Flush()
+	// the latency of the read is measured to the first bytes flushed to the client
+	measured := false
+	firstFlush := func() {
+		if !measured {
+			measured = true
+			s.observeRead(tunnel, time.Since(arrived))
+		}
+	}
+	if len(missed) > 0 {
+		if _, e := response.Write(missed); e != nil {
+			return ErrOther.NewError(e.Error())
+		}
+	}
+	flushResponse(response, tunnel)
+	if len(missed) > 0 {
+		firstFlush()
 	}
 
-	err = s.writeSome(response, reader, tunnel)
+	stop := interruptOnDone(tunnel, false, request.Context(), tunnelContext(tunnel))
+	runLabeled(request.Context(), tunnel, roleHTTPRead, s.LockOSThread, func(ctx context.Context) {
+		err = s.writeSome(ctx, response, reader, tunnel, firstFlush)
+	})
+	stop()
 
 	if err == nil {
 		// success
 		return err
 	}
+	if errors.Is(err, errClientGone) {
+		// the tunnel stays open for the client's next read
+		return nil
+	}
 
-	switch err.(*ErrGuac).Kind {
+	// a killed tunnel tells the client why, however closing guacd ended the read
+	if tunnel.killedWith() != nil {
+		_, _ = response.Write(tunnel.killedWith().Byte())
+		_, _ = response.Write([]byte("0.;"))
+		flushResponse(response, tunnel)
+		return nil
+	}
+	if s.Events != nil && CloseReasonOf(err) != CloseEOF {
+		s.Events.Publish(&ReadError{EventSession: sessionOf(tunnel), Err: err})
+	}
+
+	switch asErrGuac(err).Kind {
 	// Send end-of-stream marker and close tunnel if connection is closed
 	case ErrConnectionClosed:
-		s.deregisterTunnel(tunnel)
+		s.deregisterTunnel(tunnel, err)
 		tunnel.Close()
 
+		// guacd closing the connection is expected once Shutdown has disconnected it
+		if ins := s.CloseMessages.instruction(err); ins != nil && !s.shuttingDown.Load() {
+			_, _ = response.Write(ins.Byte())
+		}
+
 		// End-of-instructions marker
 		_, _ = response.Write([]byte("0.;"))
-		if v, ok := response.(http.Flusher); ok {
-			v.Flush()
-		}
+		flushResponse(response, tunnel)
 	default:
-		logger.Debugln("Error writing to output", err)
-		s.deregisterTunnel(tunnel)
+		s.log(transportLog, tunnel).Debugln("Error writing to output", err)
+		s.deregisterTunnel(tunnel, err)
 		tunnel.Close()
 	}
 
 	return err
 }
 
-// writeSome drains the guacd buffer holding instructions into the response
-func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader, tunnel Tunnel) (err error) {
+// errClientGone is returned by writeSome when the client abandons a read request
+var errClientGone = errors.New("client has gone away")
+
+// tunnelContext returns the context of a registered tunnel, which is cancelled once it closes
+func tunnelContext(tunnel Tunnel) context.Context {
+	if v, ok := tunnel.(*LastAccessedTunnel); ok {
+		return v.Context()
+	}
+	return context.Background()
+}
+
+// writeSome drains the guacd buffer holding instructions into the response, calling flushed
+// after each flush
+func (s *Server) writeSome(ctx context.Context, response http.ResponseWriter, guacd InstructionReader, tunnel Tunnel, flushed func()) (err error) {
 	var message []byte
+	pacer := &flushPacer{min: s.tunnelLimits(tunnel).MinFlushInterval}
+	var slow *slowClient
+	if v, ok := tunnel.(*LastAccessedTunnel); ok {
+		slow = v.slow
+	}
 
 	for {
 		message, err = guacd.ReadSome()
+		if err != nil && ctx.Err() != nil && tunnelContext(tunnel).Err() == nil {
+			s.log(transportLog, tunnel).Debugf("Read of tunnel %v abandoned by the client.", tunnel.GetUUID())
+			return errClientGone
+		}
 		if err != nil {
-			s.deregisterTunnel(tunnel)
+			s.deregisterTunnel(tunnel, err)
 			tunnel.Close()
 			return
 		}
@@ -179,16 +879,42 @@ func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader
 		if len(message) == 0 {
 			return
 		}
+		if slow != nil {
+			message = slow.filter(message)
+		}
 
-		_, e := response.Write(message)
+		n, e := response.Write(message)
+		if v, ok := tunnel.(*LastAccessedTunnel); ok {
+			v.counters.countMessage(FromGuacd, message[:n])
+			if v.replay != nil {
+				v.replay.write(message[:n])
+			}
+		}
 		if e != nil {
 			err = ErrOther.NewError(e.Error())
 			return
 		}
 
 		if !guacd.Available() {
-			if v, ok := response.(http.Flusher); ok {
-				v.Flush()
+			pacer.wait()
+			if slow != nil {
+				slow.wait()
+			}
+			start := time.Now()
+			flushResponse(response, tunnel)
+			pacer.flushed()
+			flushed()
+			if slow != nil {
+				if err = slow.observe(time.Since(start)); err != nil {
+					_, _ = response.Write(slow.policy.disconnectInstruction().Byte())
+					_, _ = response.Write([]byte("0.;"))
+					flushResponse(response, tunnel)
+					return
+				}
+			}
+			// a read streaming for longer than the idle timeout is still activity
+			if v, ok := tunnel.(interface{ Access() }); ok {
+				v.Access()
 			}
 		}
 
@@ -199,21 +925,35 @@ func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader
 	}
 
 	// End-of-instructions marker
-	if _, err = response.Write([]byte("0.;")); err != nil {
-		return err
-	}
-	if v, ok := response.(http.Flusher); ok {
-		v.Flush()
+	if _, e := response.Write([]byte("0.;")); e != nil {
+		return ErrOther.NewError(e.Error())
 	}
+	flushResponse(response, tunnel)
+	flushed()
 	return nil
 }
 
 // doWrite takes data from the request and sends it to guacd
 func (s *Server) doWrite(response http.ResponseWriter, request *http.Request, tunnelUUID string) error {
-	tunnel, err := s.getTunnel(tunnelUUID)
+	tunnel, ended, err := s.findTunnel(tunnelUUID)
 	if err != nil {
 		return err
 	}
+	setTunnelAttributes(request.Context(), tunnel)
+	if err = s.checkAccessToken(response, request, tunnelUUID, tunnel); err != nil {
+		return err
+	}
+	if err = s.authorizeTunnel(request, OperationWrite, tunnelUUID, tunnel); err != nil {
+		return err
+	}
+	if ended != nil {
+		s.sendEnded(response, ended, false)
+		return nil
+	}
+	if err = s.checkIdentity(response, request, tunnelUUID, tunnel); err != nil {
+		return err
+	}
+	tunnel.Access()
 
 	// We still need to set the content type to avoid the default of
 	// text/html, as such a content type would cause some browsers to
@@ -226,12 +966,21 @@ func (s *Server) doWrite(response http.ResponseWriter, request *http.Request, tu
 	writer := tunnel.AcquireWriter()
 	defer tunnel.ReleaseWriter()
 
-	_, err = io.Copy(writer, request.Body)
+	stop := interruptOnDone(tunnel, true, request.Context(), tunnelContext(tunnel))
+	runLabeled(request.Context(), tunnel, roleHTTPWrite, false, func(context.Context) {
+		start := time.Now()
+		_, err = io.Copy(s.limitWriter(tunnel, writer), request.Body)
+		s.observeWrite(tunnel, time.Since(start))
+	})
+	stop()
 
 	if err != nil {
-		s.deregisterTunnel(tunnel)
+		if s.Events != nil {
+			s.Events.Publish(&WriteError{EventSession: sessionOf(tunnel), Err: err})
+		}
+		s.deregisterTunnel(tunnel, err)
 		if err = tunnel.Close(); err != nil {
-			logger.Debug("Error closing tunnel")
+			s.log(transportLog, tunnel).Debug("Error closing tunnel")
 		}
 	}
 
@@ -0,0 +1,143 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uuidTunnel is a fakeTunnel with its own UUID
+type uuidTunnel struct {
+	fakeTunnel
+	uuid string
+}
+
+func (t *uuidTunnel) GetUUID() string {
+	return t.uuid
+}
+
+func TestServer_MaxTunnels(t *testing.T) {
+	var connects int32
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		n := atomic.AddInt32(&connects, 1)
+		return &uuidTunnel{uuid: strconv.Itoa(int(n))}, nil
+	})
+	server.MaxTunnels = 2
+
+	for i := 1; i <= 2; i++ {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, connectRequest(""))
+		if recorder.Body.String() != strconv.Itoa(i) {
+			t.Fatal("Expected tunnel UUID, got", recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Error("Expected 429, got", recorder.Code)
+	}
+	if got := recorder.Header().Get("Guacamole-Status-Code"); got != "797" {
+		t.Error("Expected ClientTooMany, got", got)
+	}
+	if connects != 2 {
+		t.Error("Expected the refused request not to connect, got", connects)
+	}
+
+	// closing a tunnel makes room for another
+	server.tunnels.Remove("1")
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	if recorder.Body.String() != "3" {
+		t.Error("Expected tunnel UUID, got", recorder.Body.String())
+	}
+}
+
+func TestServer_LifecycleCallbacks(t *testing.T) {
+	server := NewServer(nil)
+	var connected, closed []string
+	var failed []error
+	server.OnConnect = func(info *TunnelInfo) {
+		connected = append(connected, info.UUID)
+	}
+	server.OnClose = func(info *TunnelInfo) {
+		if info.ConnectionID != "asdf" || info.Connected.IsZero() {
+			t.Errorf("Unexpected tunnel info %+v", info)
+		}
+		closed = append(closed, info.UUID)
+	}
+	server.OnError = func(info *TunnelInfo, err error) {
+		failed = append(failed, err)
+	}
+
+	clean, broken := uuid.New().String(), uuid.New().String()
+	server.registerTunnel(&uuidTunnel{
+		fakeTunnel: fakeTunnel{reader: NewStream(&fakeConn{ToRead: []byte("10.disconnect;")}, time.Minute)},
+		uuid:       clean,
+	}, nil, nil)
+	server.registerTunnel(&uuidTunnel{
+		fakeTunnel: fakeTunnel{reader: NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;")}, time.Minute)},
+		uuid:       broken,
+	}, nil, nil)
+	if len(connected) != 2 {
+		t.Fatal("Expected OnConnect for each tunnel, got", connected)
+	}
+
+	for _, id := range []string{clean, broken} {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/tunnel?read:"+id+":0", nil))
+	}
+	if len(closed) != 2 || closed[0] != clean || closed[1] != broken {
+		t.Error("Expected OnClose once for each tunnel, got", closed)
+	}
+	if len(failed) != 1 || CloseReasonOf(failed[0]) != CloseHalfClose {
+		t.Error("Expected OnError only for the tunnel guacd closed abruptly, got", failed)
+	}
+
+	// a tunnel which times out is closed too
+	tunnels := server.tunnels.(*TunnelMap)
+	tunnels.Shutdown()
+	tunnels.SetTimeout(time.Nanosecond)
+	server.registerTunnel(&uuidTunnel{uuid: "expires"}, nil, nil)
+	time.Sleep(time.Millisecond)
+	tunnels.tunnelTimeoutTaskRun()
+	if len(closed) != 3 || closed[2] != "expires" {
+		t.Error("Expected OnClose for the expired tunnel, got", closed)
+	}
+}
+
+func TestServer_ConnectionTunnels(t *testing.T) {
+	dialer := &joinDialer{}
+	backend := &Backend{Dialer: dialer}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		stream, err := backend.Connect(r.Context(), NewJoinConfiguration("$abc", false))
+		if err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	})
+
+	var uuids []string
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, connectRequest(""))
+		uuids = append(uuids, recorder.Body.String())
+	}
+	// the ID guacd gave in its ready instruction
+	if id, err := server.ConnectionID(uuids[0]); err != nil || id != "$abc" {
+		t.Error("Unexpected connection ID", id, err)
+	}
+	sort.Strings(uuids)
+	if got := server.ConnectionTunnels("$abc"); strings.Join(got, ",") != strings.Join(uuids, ",") {
+		t.Error("Expected both tunnels on the connection, got", got)
+	}
+	if got := server.ConnectionTunnels("$other"); len(got) != 0 {
+		t.Error("Expected no tunnels on another connection, got", got)
+	}
+}
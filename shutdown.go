@@ -0,0 +1,110 @@
+package guac
+
+import (
+	"context"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all tunnels have drained
+const shutdownPollInterval = 100 * time.Millisecond
+
+// ShutdownReport records what a Server shutdown interrupted
+type ShutdownReport struct {
+	// Started is when the shutdown began
+	Started time.Time `json:"started"`
+	// Duration is how long the shutdown took
+	Duration time.Duration `json:"duration"`
+	// Drained is the number of tunnels which ended by themselves during the shutdown
+	Drained int `json:"drained"`
+	// ForceClosed lists the tunnels still open when the shutdown deadline passed
+	ForceClosed []ClosedTunnel `json:"force_closed"`
+	// Errors holds the errors encountered closing tunnels
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ClosedTunnel identifies a tunnel closed by the server
+type ClosedTunnel struct {
+	UUID         string `json:"uuid"`
+	ConnectionID string `json:"connection_id"`
+}
+
+// Shutdown stops the server accepting new connections and sends guacd a disconnect instruction
+// on every open tunnel, so sessions end cleanly rather than mid-instruction. It then waits for
+// the tunnels to end and for read and write requests in progress to complete, until ctx is
+// done, at which point the remaining tunnels are closed. The report is also passed to
+// OnShutdown if set.
+func (s *Server) Shutdown(ctx context.Context) *ShutdownReport {
+	report := &ShutdownReport{
+		Started: time.Now(),
+	}
+	s.shuttingDown.Store(true)
+
+	open := s.tunnels.Len()
+	registryLog.Infof("Shutting down HTTP tunnel server with %v open tunnels.", open)
+
+	s.tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		// a client write in progress holds the writer, which must not delay the shutdown
+		go disconnect(uuid, tunnel.Tunnel)
+		return true
+	})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+drain:
+	for s.tunnels.Len() > 0 || s.requests.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			break drain
+		case <-ticker.C:
+		}
+	}
+
+	s.tunnels.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		report.ForceClosed = append(report.ForceClosed, ClosedTunnel{
+			UUID:         uuid,
+			ConnectionID: tunnel.ConnectionID(),
+		})
+		_, removed := s.tunnels.Remove(uuid)
+		// guacd has already been sent a disconnect
+		tunnel.setKilled(tunnel.closedBy(CloseShutdown, SessionClosed))
+		if err := tunnel.Close(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		if removed {
+			s.tunnelClosed(uuid, tunnel, nil)
+		}
+		return true
+	})
+	if s.Reaper != nil {
+		s.Reaper.Stop()
+	}
+	if v, ok := s.tunnels.(interface{ Shutdown() }); ok {
+		v.Shutdown()
+	}
+
+	report.Drained = open - len(report.ForceClosed)
+	if report.Drained < 0 {
+		report.Drained = 0
+	}
+	report.Duration = time.Since(report.Started)
+
+	registryLog.Infof("HTTP tunnel server shut down in %v: %v drained, %v force closed.",
+		report.Duration, report.Drained, len(report.ForceClosed))
+	if s.OnShutdown != nil {
+		s.OnShutdown(report)
+	}
+	return report
+}
+
+// ShuttingDown returns true once Shutdown has been called
+func (s *Server) ShuttingDown() bool {
+	return s.shuttingDown.Load()
+}
+
+// disconnect asks guacd to end the session of a tunnel
+func disconnect(uuid string, tunnel Tunnel) {
+	if err := WriteInstruction(context.Background(), tunnel, NewDisconnectInstruction()); err != nil {
+		registryLog.Debugf("Unable to disconnect tunnel %v: %v", uuid, err)
+	}
+}
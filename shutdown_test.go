@@ -0,0 +1,80 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	disconnects := make(chanWriter, 2)
+	server.tunnels.Register("drains", newRegisteredTunnel(&fakeTunnel{writer: disconnects}, nil, nil))
+	server.tunnels.Register("lingers", newRegisteredTunnel(&fakeTunnel{writer: disconnects}, nil, nil))
+
+	var emitted *ShutdownReport
+	server.OnShutdown = func(report *ShutdownReport) {
+		emitted = report
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.tunnels.Remove("drains")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	report := server.Shutdown(ctx)
+
+	if report.Drained != 1 {
+		t.Errorf("expected 1 drained tunnel, got %v", report.Drained)
+	}
+	if len(report.ForceClosed) != 1 || report.ForceClosed[0].UUID != "lingers" || report.ForceClosed[0].ConnectionID != "asdf" {
+		t.Errorf("unexpected force closed tunnels %+v", report.ForceClosed)
+	}
+	if server.tunnels.Len() != 0 {
+		t.Error("expected all tunnels to be removed")
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-disconnects; got != "10.disconnect;" {
+			t.Errorf("expected guacd to be sent disconnect, got %q", got)
+		}
+	}
+	if emitted != report {
+		t.Error("expected report to be passed to OnShutdown")
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected connects to be refused, got %v", recorder.Code)
+	}
+}
+
+func TestServer_ShutdownWaitsForRequests(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.requests.Add(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.requests.Add(-1)
+	}()
+
+	report := server.Shutdown(context.Background())
+	if report.Duration < 10*time.Millisecond {
+		t.Errorf("expected shutdown to wait for the request in progress, took %v", report.Duration)
+	}
+}
+
+// chanWriter sends each write to the channel as a string
+type chanWriter chan string
+
+func (c chanWriter) Write(data []byte) (int, error) {
+	c <- string(data)
+	return len(data), nil
+}
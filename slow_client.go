@@ -0,0 +1,226 @@
+package guac
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultSlowClientThreshold is how long a write to a client may block before it counts
+	// as slow when the Threshold of a SlowClientPolicy is zero
+	DefaultSlowClientThreshold = 500 * time.Millisecond
+	// DefaultSlowClientWrites is how many slow writes in a row make a client slow when the
+	// Writes of a SlowClientPolicy is zero
+	DefaultSlowClientWrites = 3
+	// DefaultSlowClientThrottle is the interval between writes to a slow client being
+	// throttled when the Throttle of a SlowClientPolicy is zero
+	DefaultSlowClientThrottle = 250 * time.Millisecond
+	// SlowClientMessage is what clients disconnected for being too slow are told
+	SlowClientMessage = "The connection is too slow to keep up with the session."
+)
+
+// SlowClientAction is what a SlowClientPolicy does with a client found to be slow
+type SlowClientAction int
+
+const (
+	// SlowClientDropFrames drops the drawing instructions sent to the client up to the next
+	// sync, skipping whole frames until its writes stop blocking
+	SlowClientDropFrames SlowClientAction = iota
+	// SlowClientThrottle spaces out the writes to the client, which holds back the sync
+	// instructions guacd paces its frames by, until its writes stop blocking
+	SlowClientThrottle
+	// SlowClientDisconnect ends the client's session with Status
+	SlowClientDisconnect
+)
+
+// SlowClientPolicy detects clients whose responses back up, with writes to them blocking for
+// longer than Threshold several times in a row, and applies Action to them. Writes are the
+// websocket messages or flushes of HTTP read responses sent to the client.
+type SlowClientPolicy struct {
+	// Threshold is how long a write may block before it counts as slow,
+	// DefaultSlowClientThreshold if zero
+	Threshold time.Duration
+	// Writes is how many slow writes in a row make a client slow, DefaultSlowClientWrites if
+	// zero. A single write which doesn't block makes it fast again.
+	Writes int
+	// Action is what is done with slow clients
+	Action SlowClientAction
+	// Throttle is the interval between writes to a client throttled by SlowClientThrottle,
+	// DefaultSlowClientThrottle if zero
+	Throttle time.Duration
+	// Status is what clients disconnected by SlowClientDisconnect are told the session ended
+	// with, ClientTimeout if zero
+	Status Status
+	// OnSlow is an optional callback run as a tunnel's client becomes slow
+	OnSlow func(tunnel Tunnel)
+}
+
+func (p *SlowClientPolicy) threshold() time.Duration {
+	if p.Threshold <= 0 {
+		return DefaultSlowClientThreshold
+	}
+	return p.Threshold
+}
+
+func (p *SlowClientPolicy) writes() int {
+	if p.Writes <= 0 {
+		return DefaultSlowClientWrites
+	}
+	return p.Writes
+}
+
+func (p *SlowClientPolicy) throttle() time.Duration {
+	if p.Throttle <= 0 {
+		return DefaultSlowClientThrottle
+	}
+	return p.Throttle
+}
+
+// disconnectInstruction is the instruction telling a client it was disconnected for being slow
+func (p *SlowClientPolicy) disconnectInstruction() *Instruction {
+	status := p.Status
+	if status == 0 {
+		status = ClientTimeout
+	}
+	return NewErrorInstruction(SlowClientMessage, status)
+}
+
+// errSlowClient is returned writing to a client disconnected for being slow
+var errSlowClient = ErrClientTimeout.NewError(SlowClientMessage)
+
+// slowClient tracks how the writes to the client of a tunnel perform under a policy
+type slowClient struct {
+	sync.Mutex
+	policy *SlowClientPolicy
+	tunnel Tunnel
+	// blocked counts the slow writes in a row
+	blocked int
+	slow    bool
+	// dropping is true while instructions are dropped up to the next sync
+	dropping  bool
+	lastWrite time.Time
+}
+
+func newSlowClient(policy *SlowClientPolicy, tunnel Tunnel) *slowClient {
+	return &slowClient{policy: policy, tunnel: tunnel}
+}
+
+// frameOpcodes are the pure drawing instructions dropped with the frames of a slow client.
+// Every other instruction is kept, as it sets state later frames depend on and can't repair:
+// the layer stack of push, pop and reset, the clipping and transforms of clip, transform and
+// identity, paths begun by start and close, layers copied from, the streams of img and audio
+// instructions, the layers of size and dispose instructions, or the end of the session.
+var frameOpcodes = map[string]bool{
+	"arc": true, "cfill": true, "cstroke": true, "curve": true, "lfill": true, "line": true,
+	"lstroke": true, "rect": true, OpcodeMouse: true, OpcodeNop: true,
+}
+
+// filter returns what of data to write, dropping the drawing instructions of a slow client up
+// to the next sync when the policy drops frames.
+func (c *slowClient) filter(data []byte) []byte {
+	c.Lock()
+	defer c.Unlock()
+	if !c.dropping {
+		return data
+	}
+	var kept []byte
+	for len(data) > 0 {
+		end, err := instructionEnd(data, InstructionLimits{})
+		if err != nil || end <= 0 {
+			// a partial instruction is left for the client to make sense of
+			return append(kept, data...)
+		}
+		raw := data[:end]
+		data = data[end:]
+		if !c.dropping {
+			kept = append(kept, raw...)
+			continue
+		}
+		instruction, err := Parse(raw)
+		if err != nil {
+			kept = append(kept, raw...)
+			continue
+		}
+		if instruction.Opcode == OpcodeSync {
+			// the client answers the sync, so guacd knows it has fallen behind
+			c.dropping = false
+		}
+		if !frameOpcodes[instruction.Opcode] {
+			kept = append(kept, raw...)
+		}
+	}
+	return kept
+}
+
+// wait delays a write to a slow client being throttled
+func (c *slowClient) wait() {
+	c.Lock()
+	var delay time.Duration
+	if c.slow && c.policy.Action == SlowClientThrottle {
+		delay = time.Until(c.lastWrite.Add(c.policy.throttle()))
+	}
+	c.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// observe records a write which blocked for took, returning errSlowClient if the client is
+// to be disconnected
+func (c *slowClient) observe(took time.Duration) error {
+	c.Lock()
+	c.lastWrite = time.Now()
+	if took <= c.policy.threshold() {
+		c.blocked = 0
+		c.slow = false
+		c.Unlock()
+		return nil
+	}
+	c.blocked++
+	if c.blocked < c.policy.writes() {
+		c.Unlock()
+		return nil
+	}
+	became, blocked := !c.slow, c.blocked
+	c.slow = true
+	if c.policy.Action == SlowClientDropFrames {
+		c.dropping = true
+	}
+	c.Unlock()
+
+	if became {
+		transportLog.Warnf("Client of tunnel %v is too slow, %v writes in a row blocked over %v.",
+			c.tunnel.GetUUID(), blocked, c.policy.threshold())
+		if c.policy.OnSlow != nil {
+			c.policy.OnSlow(c.tunnel)
+		}
+	}
+	if c.policy.Action == SlowClientDisconnect {
+		return errSlowClient
+	}
+	return nil
+}
+
+// slowClientWriter applies a SlowClientPolicy to the messages written to a websocket
+type slowClientWriter struct {
+	MessageWriter
+	client *slowClient
+}
+
+func (w *slowClientWriter) WriteMessage(messageType int, data []byte) error {
+	if data = w.client.filter(data); len(data) == 0 {
+		return nil
+	}
+	w.client.wait()
+	start := time.Now()
+	if err := w.MessageWriter.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	if err := w.client.observe(time.Since(start)); err != nil {
+		_ = w.MessageWriter.WriteMessage(websocket.TextMessage, w.client.policy.disconnectInstruction().Byte())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package guac
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingMessageWriter takes delay to write each message
+type blockingMessageWriter struct {
+	delay    time.Duration
+	messages []string
+}
+
+func (w *blockingMessageWriter) WriteMessage(_ int, data []byte) error {
+	time.Sleep(w.delay)
+	w.messages = append(w.messages, string(data))
+	return nil
+}
+
+func TestSlowClient_DropFrames(t *testing.T) {
+	slowTunnels := 0
+	policy := &SlowClientPolicy{Threshold: time.Millisecond, Writes: 2, OnSlow: func(Tunnel) { slowTunnels++ }}
+	ws := &blockingMessageWriter{delay: 3 * time.Millisecond}
+	writer := &slowClientWriter{MessageWriter: ws, client: newSlowClient(policy, &fakeTunnel{})}
+
+	frame := "4.rect,1.0,1.0,1.0,1.1,1.1;4.sync,1.1;"
+	for i := 0; i < 2; i++ {
+		if err := writer.WriteMessage(1, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if slowTunnels != 1 {
+		t.Fatal("Expected the client to be found slow")
+	}
+	ws.delay = 0
+	_ = writer.WriteMessage(1, []byte("4.rect,1.0,1.0,1.0,1.1,1.1;5.error,3.bad,3.512;"))
+	_ = writer.WriteMessage(1, []byte("4.rect,1.0,1.0,1.0,1.1,1.1;4.sync,1.2;4.rect,1.0,1.0,1.0,1.1,1.2;"))
+	_ = writer.WriteMessage(1, []byte(frame))
+
+	want := []string{frame, frame, "5.error,3.bad,3.512;", "4.sync,1.2;4.rect,1.0,1.0,1.0,1.1,1.2;", frame}
+	if strings.Join(ws.messages, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected frames up to the next sync to be dropped, got %q", ws.messages)
+	}
+}
+
+func TestSlowClient_DropFramesKeepsStreams(t *testing.T) {
+	policy := &SlowClientPolicy{Threshold: time.Millisecond, Writes: 1}
+	ws := &blockingMessageWriter{delay: 3 * time.Millisecond}
+	writer := &slowClientWriter{MessageWriter: ws, client: newSlowClient(policy, &fakeTunnel{})}
+	if err := writer.WriteMessage(1, []byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	ws.delay = 0
+
+	// an image streamed across a dropped frame still arrives whole, and the layer state the
+	// next frames build on is kept
+	_ = writer.WriteMessage(1, []byte("4.push,1.0;4.rect,1.0,1.0,1.0,1.1,1.1;3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.1,4.AAAA;"))
+	_ = writer.WriteMessage(1, []byte("4.blob,1.1,4.BBBB;3.end,1.1;4.size,1.1,2.64,2.64;4.clip,1.0;3.pop,1.0;4.sync,1.2;"))
+	_ = writer.WriteMessage(1, []byte("4.blob,1.1,4.CCCC;"))
+
+	want := []string{
+		"4.sync,1.1;",
+		"4.push,1.0;3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.1,4.AAAA;",
+		"4.blob,1.1,4.BBBB;3.end,1.1;4.size,1.1,2.64,2.64;4.clip,1.0;3.pop,1.0;4.sync,1.2;",
+		"4.blob,1.1,4.CCCC;",
+	}
+	if strings.Join(ws.messages, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected only drawing instructions to be dropped, got %q", ws.messages)
+	}
+}
+
+func TestSlowClient_Disconnect(t *testing.T) {
+	policy := &SlowClientPolicy{Threshold: time.Millisecond, Writes: 1, Action: SlowClientDisconnect, Status: ServerBusy}
+	ws := &blockingMessageWriter{delay: 3 * time.Millisecond}
+	writer := &slowClientWriter{MessageWriter: ws, client: newSlowClient(policy, &fakeTunnel{})}
+
+	if err := writer.WriteMessage(1, []byte("4.sync,1.1;")); err != errSlowClient {
+		t.Fatal("Expected the client to be disconnected, got", err)
+	}
+	if len(ws.messages) != 2 || ws.messages[1] != NewErrorInstruction(SlowClientMessage, ServerBusy).String() {
+		t.Errorf("Expected the client to be told why, got %q", ws.messages)
+	}
+}
+
+func TestSlowClient_Throttle(t *testing.T) {
+	policy := &SlowClientPolicy{Threshold: time.Millisecond, Writes: 1, Action: SlowClientThrottle, Throttle: 30 * time.Millisecond}
+	ws := &blockingMessageWriter{delay: 3 * time.Millisecond}
+	writer := &slowClientWriter{MessageWriter: ws, client: newSlowClient(policy, &fakeTunnel{})}
+
+	_ = writer.WriteMessage(1, []byte("4.sync,1.1;"))
+	ws.delay = 0
+	start := time.Now()
+	_ = writer.WriteMessage(1, []byte("4.sync,1.2;"))
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Error("Expected the write to a slow client to be throttled, waited", waited)
+	}
+	start = time.Now()
+	_ = writer.WriteMessage(1, []byte("4.sync,1.3;"))
+	if waited := time.Since(start); waited > 20*time.Millisecond {
+		t.Error("Expected a client keeping up not to be throttled, waited", waited)
+	}
+}
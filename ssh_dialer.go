@@ -0,0 +1,239 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHJumpDialer reaches guacd through an SSH bastion, opening a forwarded channel over a
+// shared SSH connection for every dial. The SSH connection is established on first use and
+// re-established if it breaks.
+//
+//	backend := &guac.Backend{
+//		Address: "guacd.internal:4822",
+//		Dialer:  guac.NewSSHJumpDialer("bastion.example.com:22", sshConfig),
+//	}
+type SSHJumpDialer struct {
+	// Address is the host:port of the bastion's SSH server
+	Address string
+	// Config authenticates to the bastion, see SSHKeyAuth and SSHAgentAuth
+	Config *ssh.ClientConfig
+	// Dialer connects to the bastion itself, a default Dialer if nil
+	Dialer ContextDialer
+	// Budget limits reconnecting to the bastion after a failed dial, DefaultRetryBudget if nil
+	Budget *RetryBudget
+	// KeepAlive is the interval between keepalive requests on the SSH connection, which is
+	// dropped when one fails. Zero disables keepalives.
+	KeepAlive time.Duration
+
+	sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSHJumpDialer creates a dialer tunnelling through the bastion at address
+func NewSSHJumpDialer(address string, config *ssh.ClientConfig) *SSHJumpDialer {
+	return &SSHJumpDialer{
+		Address: address,
+		Config:  config,
+	}
+}
+
+// DialContext opens a channel from the bastion to address
+func (d *SSHJumpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	budget := d.Budget
+	if budget == nil {
+		budget = DefaultRetryBudget
+	}
+	budget.Attempt()
+
+	client, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial(network, address)
+	if err != nil {
+		// the SSH connection may have died since it was last used, so retry once on a new one
+		d.drop(client)
+		if !budget.Retry() {
+			return nil, ErrUpstreamUnavailable.NewError("Unable to reach guacd through SSH bastion.", err.Error())
+		}
+		if client, err = d.connect(ctx); err != nil {
+			return nil, err
+		}
+		if conn, err = client.Dial(network, address); err != nil {
+			return nil, ErrUpstreamUnavailable.NewError("Unable to reach guacd through SSH bastion.", err.Error())
+		}
+	}
+	return &deadlineConn{Conn: conn}, nil
+}
+
+// Close closes the SSH connection to the bastion, if any
+func (d *SSHJumpDialer) Close() error {
+	d.Lock()
+	client := d.client
+	d.client = nil
+	d.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// connect returns the shared SSH client, connecting to the bastion if necessary
+func (d *SSHJumpDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", d.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// bound the SSH handshake by the context as well
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, d.Address, d.Config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, ErrUpstreamUnavailable.NewError("SSH connection to bastion failed.", err.Error())
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	d.client = ssh.NewClient(sshConn, channels, requests)
+	if d.KeepAlive > 0 {
+		go d.keepAlive(d.client)
+	}
+	transportLog.Debugf("Connected to SSH bastion %v.", d.Address)
+	return d.client, nil
+}
+
+// drop discards client if it is still the shared client
+func (d *SSHJumpDialer) drop(client *ssh.Client) {
+	d.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.Unlock()
+	_ = client.Close()
+}
+
+func (d *SSHJumpDialer) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(d.KeepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			transportLog.Debugf("SSH bastion %v keepalive failed: %v", d.Address, err)
+			d.drop(client)
+			return
+		}
+	}
+}
+
+// SSHKeyAuth authenticates with a PEM encoded private key
+func SSHKeyAuth(pemBytes []byte) (ssh.AuthMethod, error) {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// SSHAgentAuth authenticates with the keys held by the SSH agent listening on SSH_AUTH_SOCK.
+// The returned connection to the agent must stay open while the dialer is in use.
+func SSHAgentAuth() (ssh.AuthMethod, net.Conn, error) {
+	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), conn, nil
+}
+
+// deadlineConn adds deadline support to SSH channels, which do not implement it, by closing
+// the channel when a deadline passes during a blocked read or write. Stream relies on
+// deadlines to detect a stalled guacd, after which the connection is discarded anyway.
+type deadlineConn struct {
+	net.Conn
+
+	sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// deadlineError is returned by deadlineConn when a deadline passes
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "i/o timeout" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Lock()
+	deadline := c.readDeadline
+	c.Unlock()
+	return c.withDeadline(deadline, func() (int, error) { return c.Conn.Read(b) })
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Lock()
+	deadline := c.writeDeadline
+	c.Unlock()
+	return c.withDeadline(deadline, func() (int, error) { return c.Conn.Write(b) })
+}
+
+func (c *deadlineConn) withDeadline(deadline time.Time, fn func() (int, error)) (int, error) {
+	if deadline.IsZero() {
+		return fn()
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return 0, deadlineError{}
+	}
+
+	var expired atomic.Bool
+	timer := time.AfterFunc(wait, func() {
+		expired.Store(true)
+		_ = c.Conn.Close()
+	})
+	n, err := fn()
+	if !timer.Stop() && expired.Load() {
+		return n, deadlineError{}
+	}
+	return n, err
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.Unlock()
+	return nil
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	c.readDeadline = t
+	c.Unlock()
+	return nil
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.Lock()
+	c.writeDeadline = t
+	c.Unlock()
+	return nil
+}
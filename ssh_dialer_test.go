@@ -0,0 +1,185 @@
+package guac
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startBastion runs an SSH server on localhost which accepts the given client key and forwards
+// direct-tcpip channels
+func startBastion(t *testing.T, clientKey ssh.PublicKey) string {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveBastion(conn, config)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveBastion(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for request := range channels {
+		if request.ChannelType() != "direct-tcpip" {
+			_ = request.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		data := request.ExtraData()
+		length := binary.BigEndian.Uint32(data)
+		host := string(data[4 : 4+length])
+		port := binary.BigEndian.Uint32(data[4+length:])
+
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			_ = request.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, reqs, err := request.Accept()
+		if err != nil {
+			_ = target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			_, _ = io.Copy(channel, target)
+			_ = channel.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(target, channel)
+			_ = target.Close()
+		}()
+	}
+}
+
+func newSSHClientConfig(t *testing.T) (*ssh.ClientConfig, ssh.PublicKey) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ssh.ClientConfig{
+		User:            "guac",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, signer.PublicKey()
+}
+
+func TestSSHJumpDialer(t *testing.T) {
+	guacd, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guacd.Close()
+	go func() {
+		for {
+			conn, err := guacd.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	config, key := newSSHClientConfig(t)
+	dialer := NewSSHJumpDialer(startBastion(t, key), config)
+	defer dialer.Close()
+	backend := &Backend{Address: guacd.Addr().String(), Dialer: dialer}
+
+	for i := 0; i < 2; i++ {
+		conn, err := backend.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("4.sync;")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 7)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "4.sync;" {
+			t.Error("Unexpected echo", string(buf))
+		}
+		_ = conn.Close()
+	}
+
+	// both connections share one SSH connection
+	first := dialer.client
+
+	// a broken SSH connection is replaced
+	_ = first.Close()
+	conn, err := backend.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if dialer.client == first {
+		t.Error("Expected a new SSH connection")
+	}
+}
+
+func TestSSHJumpDialerAuthFailure(t *testing.T) {
+	config, _ := newSSHClientConfig(t)
+	_, other := newSSHClientConfig(t)
+	dialer := NewSSHJumpDialer(startBastion(t, other), config)
+
+	_, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:4822")
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if guacErr, ok := err.(*ErrGuac); !ok || guacErr.Kind != ErrUpstreamUnavailable {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestDeadlineConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &deadlineConn{Conn: struct{ net.Conn }{client}}
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("Expected a timeout", err)
+	}
+}
@@ -0,0 +1,367 @@
+package guac
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPendingSyncs bounds the sync instructions remembered while waiting for the client's reply
+const maxPendingSyncs = 64
+
+// maxRecentFiles is the number of completed file transfers kept in TunnelStats
+const maxRecentFiles = 16
+
+// RateWindow is the period over which the rates of TunnelStats are averaged
+const RateWindow = 10 * time.Second
+
+// rateBuckets is the number of one second buckets of a rollingRate
+const rateBuckets = int64(RateWindow / time.Second)
+
+// TunnelStats is a snapshot of the statistics of a tunnel. "In" counts what the client sent
+// to guacd and "out" what guacd sent to the client. The tunnels of a server are counted by its
+// transport whatever their type, while a FilteredTunnel used on its own counts what passes
+// through its filters.
+type TunnelStats struct {
+	// Connected is when the tunnel was created or registered
+	Connected time.Time `json:"connected"`
+	// LastActivity is when the tunnel last carried an instruction or request
+	LastActivity time.Time `json:"last_activity"`
+	// BytesIn and BytesOut count the bytes of instructions from and to the client
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// InstructionsIn and InstructionsOut count the instructions from and to the client
+	InstructionsIn  int64 `json:"instructions_in"`
+	InstructionsOut int64 `json:"instructions_out"`
+	// Syncs counts the sync instructions guacd sent, one for each frame
+	Syncs int64 `json:"syncs"`
+	// Flushes counts the flushes of instructions to the client, each a read response being
+	// flushed or a websocket message
+	Flushes int64 `json:"flushes"`
+	// Latency estimates how long the client takes to receive and render a frame, measured
+	// from guacd's sync instructions to the client's replies
+	Latency LatencyStats `json:"latency"`
+	// ReadLatency is the time from a read request of an HTTP tunnel arriving to its first
+	// bytes being flushed, and WriteLatency the time taken copying the body of a write
+	// request to guacd
+	ReadLatency  PercentileStats `json:"read_latency"`
+	WriteLatency PercentileStats `json:"write_latency"`
+	// Rates holds the bandwidth and frame rate of the tunnel over the last RateWindow
+	Rates RateStats `json:"rates"`
+	// Files holds the latest file transfers completed through a FileFilter, with their hashes,
+	// oldest first
+	Files []FileTransfer `json:"files,omitempty"`
+}
+
+// RateStats holds the rates of a tunnel, averaged over the last RateWindow or the life of the
+// tunnel if it is younger. Frame rates are only measured by tunnels which parse instructions.
+type RateStats struct {
+	BytesInPerSecond  float64 `json:"bytes_in_per_second"`
+	BytesOutPerSecond float64 `json:"bytes_out_per_second"`
+	// SyncsPerSecond is the rate guacd sends frames at
+	SyncsPerSecond float64 `json:"syncs_per_second"`
+}
+
+// rollingRate sums what is added to it over the last RateWindow, in one second buckets
+type rollingRate struct {
+	sync.Mutex
+	buckets [rateBuckets]int64
+	// last is the Unix second of the latest bucket
+	last int64
+}
+
+func (r *rollingRate) add(n int64, now time.Time) {
+	second := now.Unix()
+	r.Lock()
+	defer r.Unlock()
+	r.advance(second)
+	r.buckets[second%rateBuckets] += n
+}
+
+// advance clears the buckets of the seconds from the latest to second. The lock must be held.
+func (r *rollingRate) advance(second int64) {
+	if second <= r.last {
+		return
+	}
+	if second-r.last >= rateBuckets {
+		r.buckets = [rateBuckets]int64{}
+	} else {
+		for s := r.last + 1; s <= second; s++ {
+			r.buckets[s%rateBuckets] = 0
+		}
+	}
+	r.last = second
+}
+
+// rate returns the average per second of what was added over the window, or since started
+// if that is more recent
+func (r *rollingRate) rate(now, started time.Time) float64 {
+	r.Lock()
+	defer r.Unlock()
+	r.advance(now.Unix())
+	var sum int64
+	for _, n := range r.buckets {
+		sum += n
+	}
+	window := RateWindow
+	if age := now.Sub(started); age < window {
+		window = age
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	return float64(sum) / window.Seconds()
+}
+
+// tunnelRates measures the rates of a tunnel
+type tunnelRates struct {
+	bytesIn, bytesOut, syncs rollingRate
+}
+
+func (r *tunnelRates) snapshot(now, started time.Time) RateStats {
+	return RateStats{
+		BytesInPerSecond:  r.bytesIn.rate(now, started),
+		BytesOutPerSecond: r.bytesOut.rate(now, started),
+		SyncsPerSecond:    r.syncs.rate(now, started),
+	}
+}
+
+// LatencyStats summarises a series of latency measurements
+type LatencyStats struct {
+	// Last is the most recent measurement
+	Last time.Duration `json:"last"`
+	// Smoothed is a moving average weighting recent measurements more heavily
+	Smoothed time.Duration `json:"smoothed"`
+	// Max is the largest measurement
+	Max time.Duration `json:"max"`
+	// Samples is the number of measurements
+	Samples int64 `json:"samples"`
+}
+
+// StatsProvider is implemented by tunnels which keep statistics
+type StatsProvider interface {
+	Stats() TunnelStats
+}
+
+// tunnelCounters counts the instructions passing through a tunnel
+type tunnelCounters struct {
+	created                         time.Time
+	bytesIn, bytesOut               atomic.Int64
+	instructionsIn, instructionsOut atomic.Int64
+	syncs, flushes                  atomic.Int64
+	// lastActivity is when an instruction last passed, in Unix nanoseconds
+	lastActivity atomic.Int64
+	rates        tunnelRates
+	// latency measures the time taken by the client to answer sync instructions
+	latency syncLatency
+}
+
+// counted records an instruction of the given size passing in the given direction
+func (c *tunnelCounters) counted(direction Direction, size int, instruction *Instruction) {
+	var syncs int64
+	if direction == FromGuacd && instruction.Opcode == OpcodeSync {
+		syncs = 1
+	}
+	c.count(direction, int64(size), 1, syncs)
+}
+
+// countMessage records a message of whole instructions passing in the given direction, as
+// carried by the transport
+func (c *tunnelCounters) countMessage(direction Direction, message []byte) {
+	instructions, syncs := c.scan(direction, message)
+	c.count(direction, int64(len(message)), instructions, syncs)
+}
+
+// scan returns the number of complete instructions in data and the syncs among them, measuring
+// the latency of the client's replies to guacd's syncs
+func (c *tunnelCounters) scan(direction Direction, data []byte) (instructions, syncs int64) {
+	now := time.Now()
+	for len(data) > 0 {
+		end, err := instructionEnd(data, InstructionLimits{})
+		if err != nil || end < 0 {
+			break
+		}
+		instructions++
+		if bytes.HasPrefix(data, []byte("4.sync,")) {
+			if instruction, err := Parse(data[:end]); err == nil {
+				if direction == FromGuacd {
+					syncs++
+					c.latency.sent(instruction, now)
+				} else {
+					c.latency.replied(instruction, now)
+				}
+			}
+		}
+		data = data[end:]
+	}
+	return instructions, syncs
+}
+
+// count records bytes, instructions and the syncs among them passing in the given direction
+func (c *tunnelCounters) count(direction Direction, size, instructions, syncs int64) {
+	now := time.Now()
+	if direction == FromClient {
+		c.bytesIn.Add(size)
+		c.instructionsIn.Add(instructions)
+		c.rates.bytesIn.add(size, now)
+	} else {
+		c.bytesOut.Add(size)
+		c.instructionsOut.Add(instructions)
+		c.rates.bytesOut.add(size, now)
+		if syncs > 0 {
+			c.syncs.Add(syncs)
+			c.rates.syncs.add(syncs, now)
+		}
+	}
+	c.lastActivity.Store(now.UnixNano())
+}
+
+// countersOf returns the counters the transport keeps for a registered tunnel, nil for others
+func countersOf(tunnel Tunnel) *tunnelCounters {
+	if v, ok := tunnel.(*LastAccessedTunnel); ok {
+		return &v.counters
+	}
+	return nil
+}
+
+// snapshot fills in the counts of the given stats
+func (c *tunnelCounters) snapshot(stats *TunnelStats) {
+	stats.Connected = c.created
+	if last := c.lastActivity.Load(); last != 0 {
+		stats.LastActivity = time.Unix(0, last)
+	} else {
+		stats.LastActivity = c.created
+	}
+	stats.BytesIn = c.bytesIn.Load()
+	stats.BytesOut = c.bytesOut.Load()
+	stats.InstructionsIn = c.instructionsIn.Load()
+	stats.InstructionsOut = c.instructionsOut.Load()
+	stats.Syncs = c.syncs.Load()
+	stats.Flushes = c.flushes.Load()
+	stats.Rates = c.rates.snapshot(time.Now(), c.created)
+	stats.Latency = c.latency.snapshot()
+}
+
+// syncLatency measures the time between forwarding a sync instruction to the client and the
+// client replying with the same timestamp, which it does once the frame has been rendered
+type syncLatency struct {
+	sync.Mutex
+	pending []pendingSync
+	stats   LatencyStats
+}
+
+type pendingSync struct {
+	timestamp string
+	sent      time.Time
+}
+
+// sent records a sync instruction forwarded to the client
+func (l *syncLatency) sent(instruction *Instruction, at time.Time) {
+	if len(instruction.Args) == 0 {
+		return
+	}
+	l.Lock()
+	if len(l.pending) == maxPendingSyncs {
+		l.pending = append(l.pending[:0], l.pending[1:]...)
+	}
+	l.pending = append(l.pending, pendingSync{timestamp: instruction.Args[0], sent: at})
+	l.Unlock()
+}
+
+// replied records the client's reply to a sync instruction
+func (l *syncLatency) replied(instruction *Instruction, at time.Time) {
+	if len(instruction.Args) == 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	// replies come in order, so anything older than the reply was never answered
+	for i, pending := range l.pending {
+		if pending.timestamp != instruction.Args[0] {
+			continue
+		}
+		l.pending = append(l.pending[:0], l.pending[i+1:]...)
+		l.record(at.Sub(pending.sent))
+		return
+	}
+}
+
+func (l *syncLatency) record(latency time.Duration) {
+	l.stats.Last = latency
+	if latency > l.stats.Max {
+		l.stats.Max = latency
+	}
+	if l.stats.Samples == 0 {
+		l.stats.Smoothed = latency
+	} else {
+		// the same weighting TCP uses for its smoothed round trip time
+		l.stats.Smoothed += (latency - l.stats.Smoothed) / 8
+	}
+	l.stats.Samples++
+}
+
+func (l *syncLatency) snapshot() LatencyStats {
+	l.Lock()
+	defer l.Unlock()
+	return l.stats
+}
+
+// recentFiles keeps the latest maxRecentFiles completed file transfers
+type recentFiles struct {
+	sync.Mutex
+	files []FileTransfer
+}
+
+func (r *recentFiles) add(transfer FileTransfer) {
+	r.Lock()
+	if len(r.files) == maxRecentFiles {
+		r.files = append(r.files[:0], r.files[1:]...)
+	}
+	r.files = append(r.files, transfer)
+	r.Unlock()
+}
+
+func (r *recentFiles) snapshot() []FileTransfer {
+	r.Lock()
+	defer r.Unlock()
+	return append([]FileTransfer(nil), r.files...)
+}
+
+// Stats returns the statistics of the tunnel
+func (t *FilteredTunnel) Stats() TunnelStats {
+	stats := TunnelStats{
+		Files: t.files.snapshot(),
+	}
+	t.counters.snapshot(&stats)
+	return stats
+}
+
+// Stats returns the statistics of the registered tunnel. Its bytes, instructions, flushes and
+// sync latency are measured by the transport, whatever the type of the tunnel it wraps, which
+// only adds the file transfers it keeps, if any.
+func (t *LastAccessedTunnel) Stats() TunnelStats {
+	var stats TunnelStats
+	if provider, ok := t.Tunnel.(StatsProvider); ok {
+		stats.Files = provider.Stats().Files
+	}
+	t.counters.snapshot(&stats)
+	t.RLock()
+	defer t.RUnlock()
+	if t.lastAccessedTime.After(stats.LastActivity) {
+		stats.LastActivity = t.lastAccessedTime
+	}
+	stats.ReadLatency = t.readLatency.snapshot()
+	stats.WriteLatency = t.writeLatency.snapshot()
+	return stats
+}
+
+// TunnelStats returns the statistics of the registered tunnel with the given UUID
+func (s *Server) TunnelStats(uuid string) (TunnelStats, bool) {
+	tunnel, ok := s.tunnels.Peek(uuid)
+	if !ok {
+		return TunnelStats{}, false
+	}
+	return tunnel.Stats(), true
+}
@@ -0,0 +1,136 @@
+package guac
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSyncLatency(t *testing.T) {
+	var latency syncLatency
+	start := time.Now()
+
+	latency.sent(NewSyncInstruction(1), start)
+	latency.sent(NewSyncInstruction(2), start.Add(10*time.Millisecond))
+	latency.sent(NewSyncInstruction(3), start.Add(20*time.Millisecond))
+
+	// the reply to 1 was lost
+	latency.replied(NewSyncInstruction(2), start.Add(50*time.Millisecond))
+	latency.replied(NewSyncInstruction(3), start.Add(140*time.Millisecond))
+	latency.replied(NewSyncInstruction(1), start.Add(150*time.Millisecond))
+
+	stats := latency.snapshot()
+	if stats.Samples != 2 || stats.Last != 120*time.Millisecond || stats.Max != 120*time.Millisecond {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.Smoothed != 40*time.Millisecond+(80*time.Millisecond)/8 {
+		t.Errorf("Unexpected smoothed latency %v", stats.Smoothed)
+	}
+}
+
+func TestServer_TunnelStats(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{writer: &bytes.Buffer{}}, nil
+	})
+	if _, ok := server.TunnelStats("1"); ok {
+		t.Error("Expected no stats for a missing tunnel")
+	}
+
+	server.StreamLimits = &StreamLimits{}
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil))
+	tunnel, _ := server.tunnels.Get("1")
+	tunnel.counters.latency.record(time.Second)
+
+	stats, ok := server.TunnelStats("1")
+	if !ok || stats.Latency.Last != time.Second {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestServer_TunnelStatsUnfiltered(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	guacd := NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;4.rect,1.0,1.0,1.0,1.1,1.1;4.sync,1.2;")}, time.Minute)
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{reader: guacd, writer: &bytes.Buffer{}}, uuid: tunnelUUID}, nil
+	})
+	server.ServeHTTP(httptest.NewRecorder(), connectRequest(""))
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader("4.sync,1.1;4.sy")))
+	// the read ends the tunnel once guacd has nothing more to send
+	registered, _ := server.tunnels.Get(tunnelUUID)
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnelUUID+":0", nil))
+
+	// the transport counts tunnels which don't parse their instructions
+	stats := registered.Stats()
+	if stats.InstructionsOut != 3 || stats.Syncs != 2 || stats.BytesOut != 49 || stats.Flushes == 0 {
+		t.Errorf("Unexpected counts from guacd %+v", stats)
+	}
+	if stats.InstructionsIn != 1 || stats.BytesIn != 15 {
+		t.Errorf("Expected only complete client instructions to be counted, got %+v", stats)
+	}
+	if stats.Rates.BytesOutPerSecond != 49 || stats.Rates.SyncsPerSecond != 2 {
+		t.Errorf("Unexpected rates %+v", stats.Rates)
+	}
+}
+
+func TestTunnelCounters_Latency(t *testing.T) {
+	var counters tunnelCounters
+	counters.countMessage(FromGuacd, []byte("4.sync,1.1;4.rect,1.0,1.0,1.0,1.1,1.1;"))
+	counters.scan(FromClient, []byte("4.sync,1.1;"))
+	if stats := counters.latency.snapshot(); stats.Samples != 1 {
+		t.Errorf("Expected the reply to the sync to be measured, got %+v", stats)
+	}
+}
+
+func TestFilteredTunnel_Stats(t *testing.T) {
+	guacd := NewStream(&fakeConn{ToRead: []byte("4.sync,1.1;4.rect,1.0,1.0,1.0,1.1,1.1;4.sync,1.2;")}, time.Minute)
+	tunnel := NewFilteredTunnel(&fakeTunnel{reader: guacd, writer: &bytes.Buffer{}})
+
+	reader := tunnel.AcquireReader()
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tunnel.ReleaseReader()
+	writer := tunnel.AcquireWriter()
+	_, _ = writer.Write([]byte("4.sync,1.1;4.sy"))
+	tunnel.ReleaseWriter()
+
+	stats := tunnel.Stats()
+	if stats.InstructionsOut != 3 || stats.Syncs != 2 || stats.BytesOut != 49 {
+		t.Errorf("Unexpected counts from guacd %+v", stats)
+	}
+	if stats.InstructionsIn != 1 || stats.BytesIn != 11 {
+		t.Errorf("Expected only complete client instructions to be counted, got %+v", stats)
+	}
+	if stats.LastActivity.Before(stats.Connected) {
+		t.Errorf("Unexpected activity %+v", stats)
+	}
+	// the tunnel is under a second old, so the rates are what it carried
+	if stats.Rates != (RateStats{BytesInPerSecond: 11, BytesOutPerSecond: 49, SyncsPerSecond: 2}) {
+		t.Errorf("Unexpected rates %+v", stats.Rates)
+	}
+}
+
+func TestRollingRate(t *testing.T) {
+	var rate rollingRate
+	started := time.Unix(1000, 0)
+	for i := int64(0); i < 20; i++ {
+		rate.add(100, started.Add(time.Duration(i)*time.Second))
+	}
+	now := started.Add(19 * time.Second)
+	if got := rate.rate(now, started); got != 100 {
+		t.Error("Expected 100 per second over the window, got", got)
+	}
+	if got := rate.rate(now.Add(5*time.Second), started); got != 50 {
+		t.Error("Expected idle seconds to lower the rate, got", got)
+	}
+	if got := rate.rate(now.Add(time.Minute), started); got != 0 {
+		t.Error("Expected no rate once idle for the window, got", got)
+	}
+}
@@ -1,16 +1,27 @@
 package guac
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	SocketTimeout  = 15 * time.Second
 	MaxGuacMessage = 8192 // TODO is this bytes or runes?
+
+	// ProtocolVersion is the newest Guacamole protocol version this package speaks
+	ProtocolVersion = "VERSION_1_5_0"
 )
 
 // Stream wraps the connection to Guacamole providing timeouts and reading
@@ -21,29 +32,71 @@ type Stream struct {
 
 	// ConnectionID is the ID Guacamole gives and can be used to reconnect or share sessions
 	ConnectionID string
-	timeout      time.Duration
-
-	// if more than a single instruction is read, the rest are buffered here
-	parseStart int
-	buffer     []rune
-	reset      []rune
+	// Joined is true if the handshake joined the existing connection ConnectionID rather than
+	// starting a new one
+	Joined bool
+	// ProtocolVersion is the protocol version agreed with guacd during the handshake, empty
+	// if guacd predates version negotiation (1.0.0 and older)
+	ProtocolVersion string
+
+	// readTimeout and writeTimeout bound each read from and write to guacd
+	readTimeout, writeTimeout time.Duration
+
+	// data read from guacd is buffered here; buffer[start:end] has not been returned yet and
+	// buffer[start:parsed] is the part of the next instruction which has already been parsed
+	buffer []byte
+	start  int
+	parsed int
+	end    int
+
+	// ended is set once guacd has sent a disconnect or error instruction, after which closing
+	// the connection is expected
+	ended bool
+
+	// deadlineLock orders the deadlines set by reads and writes with those set by interrupt,
+	// so an interruption is not undone by a read or write starting at the same moment
+	deadlineLock sync.Mutex
+	// readsInterrupted and writesInterrupted are set from interrupt until resume
+	readsInterrupted, writesInterrupted bool
 }
 
+var (
+	disconnectPrefix = []byte("10." + OpcodeDisconnect + ";")
+	errorPrefix      = []byte("5." + OpcodeError + ",")
+)
+
+// maxStreamBuffer bounds the growth of a Stream's buffer to hold a single long instruction
+const maxStreamBuffer = MaxGuacMessage * 128
+
 // NewStream creates a new stream
 func NewStream(conn net.Conn, timeout time.Duration) (ret *Stream) {
-	buffer := make([]rune, 0, MaxGuacMessage*3)
 	return &Stream{
-		conn:    conn,
-		timeout: timeout,
-		buffer:  buffer,
-		reset:   buffer[:cap(buffer)],
+		conn:         conn,
+		readTimeout:  timeout,
+		writeTimeout: timeout,
+		buffer:       make([]byte, MaxGuacMessage*3),
+	}
+}
+
+// SetTimeouts sets how long each read from guacd may wait for data and each write may wait
+// for guacd to accept it before failing with ErrUpstreamTimeout, so a stalled guacd is noticed
+// within a bounded time. Zero or negative timeouts disable the deadline.
+func (s *Stream) SetTimeouts(read, write time.Duration) {
+	s.readTimeout, s.writeTimeout = read, write
+}
+
+// deadline returns the deadline for an operation bounded by timeout, none if it is not positive
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(timeout)
 }
 
 // Write sends messages to Guacamole with a timeout
 func (s *Stream) Write(data []byte) (n int, err error) {
-	if err = s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
-		logrus.Error(err)
+	if err = s.setWriteDeadline(deadline(s.writeTimeout)); err != nil {
+		transportLog.Error(err)
 		return
 	}
 	return s.conn.Write(data)
@@ -51,112 +104,164 @@ func (s *Stream) Write(data []byte) (n int, err error) {
 
 // Available returns true if there are messages buffered
 func (s *Stream) Available() bool {
-	return len(s.buffer) > 0
+	return s.end > s.start
 }
 
-// Flush resets the internal buffer
+// Flush moves any buffered data to the start of the internal buffer
 func (s *Stream) Flush() {
-	copy(s.reset, s.buffer)
-	s.buffer = s.reset[:len(s.buffer)]
+	n := copy(s.buffer, s.buffer[s.start:s.end])
+	s.parsed -= s.start
+	s.start, s.end = 0, n
 }
 
 // ReadSome takes the next instruction (from the network or from the buffer) and returns it.
 // io.Reader is not implemented because this seems like the right place to maintain a buffer.
+//
+// The returned slice points into the stream's buffer and is only valid until the next call to
+// ReadSome, which lets steady-state reads complete without allocating.
 func (s *Stream) ReadSome() (instruction []byte, err error) {
-	if err = s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
-		logrus.Error(err)
+	if err = s.setReadDeadline(deadline(s.readTimeout)); err != nil {
+		transportLog.Error(err)
 		return
 	}
 
-	buffer := make([]byte, MaxGuacMessage)
-	var n int
-	// While we're blocking, or input is available
 	for {
-		// Length of element
-		var elementLength int
+		var end int
+		if end, err = s.parse(); err != nil || end > 0 {
+			if end > 0 {
+				instruction = s.buffer[s.start:end]
+				s.start, s.parsed = end, end
+				if bytes.HasPrefix(instruction, disconnectPrefix) || bytes.HasPrefix(instruction, errorPrefix) {
+					s.ended = true
+				}
+			}
+			return
+		}
 
-		// Resume where we left off
-		i := s.parseStart
+		if err = s.fill(); err != nil {
+			return
+		}
+	}
+}
 
-	parseLoop:
-		// Parse instruction in buffer
-		for i < len(s.buffer) {
-			// ReadSome character
-			readChar := s.buffer[i]
-			i++
+// probe checks the connection to guacd is still open without consuming any instructions,
+// reading whatever guacd has sent into the buffer. A buffer which is full is left as it is.
+func (s *Stream) probe(wait time.Duration) error {
+	if s.start == 0 && s.end == len(s.buffer) {
+		return nil
+	}
+	if err := s.setReadDeadline(time.Now().Add(wait)); err != nil {
+		return err
+	}
+	err := s.fill()
+	if err != nil && asErrGuac(err).Kind == ErrUpstreamTimeout {
+		return nil
+	}
+	return err
+}
 
-			switch readChar {
-			// If digit, update length
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				elementLength = elementLength*10 + int(readChar-'0')
-
-			// If not digit, check for end-of-length character
-			case '.':
-				if i+elementLength >= len(s.buffer) {
-					// break for i < s.usedLength { ... }
-					// Otherwise, read more data
-					break parseLoop
-				}
-				// Check if element present in buffer
-				terminator := s.buffer[i+elementLength]
-				// Move to character after terminator
-				i += elementLength + 1
-
-				// Reset length
-				elementLength = 0
-
-				// Continue here if necessary
-				s.parseStart = i
-
-				// If terminator is semicolon, we have a full
-				// instruction.
-				switch terminator {
-				case ';':
-					instruction = []byte(string(s.buffer[0:i]))
-					s.parseStart = 0
-					s.buffer = s.buffer[i:]
-					return
-				case ',':
-					// keep going
-				default:
-					err = ErrServer.NewError("Element terminator of instruction was not ';' nor ','")
-					return
-				}
-			default:
-				// Otherwise, parse error
-				err = ErrServer.NewError("Non-numeric character in element length:", string(readChar))
-				return
+// parse continues parsing the instruction at the start of the buffer, returning the index
+// just past it once it is complete or zero if more data is needed
+func (s *Stream) parse() (int, error) {
+	buffer := s.buffer[:s.end]
+	i := s.parsed
+	for i < len(buffer) {
+		// Parse element length
+		elementLength := 0
+		for {
+			if i >= len(buffer) {
+				return 0, nil
 			}
+			readChar := buffer[i]
+			i++
+			if readChar == '.' {
+				break
+			}
+			if readChar < '0' || readChar > '9' {
+				return 0, ErrServer.NewError("Non-numeric character in element length:", string(rune(readChar)))
+			}
+			elementLength = elementLength*10 + int(readChar-'0')
 		}
 
-		n, err = s.conn.Read(buffer)
-		if err != nil && n == 0 {
-			switch err.(type) {
-			case net.Error:
-				ex := err.(net.Error)
-				if ex.Timeout() {
-					err = ErrUpstreamTimeout.NewError("Connection to guacd timed out.", err.Error())
-				} else {
-					err = ErrConnectionClosed.NewError("Connection to guacd is closed.", err.Error())
-				}
-			default:
-				err = ErrServer.NewError(err.Error())
+		// Skip element value, whose length is in runes
+		for ; elementLength > 0; elementLength-- {
+			if i >= len(buffer) {
+				return 0, nil
 			}
-			return
+			if buffer[i] < utf8.RuneSelf {
+				i++
+				continue
+			}
+			if !utf8.FullRune(buffer[i:]) {
+				return 0, nil
+			}
+			_, size := utf8.DecodeRune(buffer[i:])
+			i += size
 		}
-		if n == 0 {
-			err = ErrServer.NewError("read 0 bytes")
+		if i >= len(buffer) {
+			return 0, nil
 		}
-		runes := []rune(string(buffer[:n]))
 
-		if cap(s.buffer)-len(s.buffer) < len(runes) {
+		// Move past terminator, continuing from here next time if necessary
+		terminator := buffer[i]
+		i++
+		s.parsed = i
+
+		switch terminator {
+		case ';':
+			return i, nil
+		case ',':
+			// keep going
+		default:
+			return 0, ErrServer.NewError("Element terminator of instruction was not ';' nor ','")
+		}
+	}
+	return 0, nil
+}
+
+// fill reads more data from guacd into the buffer, making room first if necessary
+func (s *Stream) fill() error {
+	if s.start == s.end {
+		s.start, s.parsed, s.end = 0, 0, 0
+	}
+	if s.end == len(s.buffer) {
+		if s.start > 0 {
 			s.Flush()
+		} else if len(s.buffer) >= maxStreamBuffer {
+			return ErrServer.NewError("Instruction from guacd is too long.")
+		} else {
+			grown := make([]byte, len(s.buffer)*2)
+			copy(grown, s.buffer[:s.end])
+			s.buffer = grown
 		}
+	}
 
-		n = copy(s.buffer[len(s.buffer):cap(s.buffer)], runes)
-		// must reslice so len is changed
-		s.buffer = s.buffer[:len(s.buffer)+n]
+	n, err := s.conn.Read(s.buffer[s.end:])
+	if err != nil && n == 0 {
+		switch err.(type) {
+		case net.Error:
+			ex := err.(net.Error)
+			if ex.Timeout() {
+				err = ErrUpstreamTimeout.NewError("Connection to guacd timed out.", err.Error())
+			} else if isReset(err) {
+				err = newUpstreamClosedError(CloseReset, err)
+			} else {
+				err = ErrConnectionClosed.NewError("Connection to guacd is closed.", err.Error())
+			}
+		default:
+			if err == io.EOF {
+				reason := CloseHalfClose
+				if s.ended && s.start == s.end {
+					reason = CloseEOF
+				}
+				return newUpstreamClosedError(reason, err)
+			}
+			err = ErrServer.NewError(err.Error())
+		}
+		return err
 	}
+	s.end += n
+	return nil
 }
 
 // Close closes the underlying network connection
@@ -166,43 +271,94 @@ func (s *Stream) Close() error {
 
 // Handshake configures the guacd session
 func (s *Stream) Handshake(config *Config) error {
+	return s.HandshakeContext(context.Background(), config, nil)
+}
+
+// HandshakeContext configures the guacd session, resolving parameters which refer to secrets
+// with secrets, which may be nil if there are none. Only the parameters guacd asks for are
+// resolved, and their values are never logged. The secrets resolved and the sensitive values
+// a ParameterFunc computes are removed from the errors returned.
+func (s *Stream) HandshakeContext(ctx context.Context, config *Config, secrets SecretsProvider) error {
+	ctx, span := tracer(ctx, nil).Start(ctx, "guac.handshake", trace.WithAttributes(AttributeProtocol.String(config.Protocol)))
+	var sensitive []string
+	err := s.handshake(ctx, config, secrets, &sensitive)
+	recordSensitive(ctx, sensitive)
+	err = redactValues(err, sensitive)
+	if err == nil {
+		span.SetAttributes(AttributeConnectionID.String(s.ConnectionID), attribute.Bool("guac.joined", s.Joined))
+	}
+	endSpan(span, err)
+	return err
+}
+
+// handshake performs the handshake of HandshakeContext, adding the sensitive values it sends
+// to sensitive
+func (s *Stream) handshake(ctx context.Context, config *Config, secrets SecretsProvider, sensitive *[]string) error {
 	// Get protocol / connection ID
 	selectArg := config.ConnectionID
-	if len(selectArg) == 0 {
+	joining := len(selectArg) > 0
+	if joining && !IsConnectionID(selectArg) {
+		return ErrClient.NewError("Invalid connection ID:", selectArg)
+	}
+	if !joining {
 		selectArg = config.Protocol
 	}
 
 	// Send requested protocol or connection ID
-	_, err := s.Write(NewInstruction("select", selectArg).Byte())
+	handshakeLog.Debugf("Selecting %q.", selectArg)
+	_, err := s.Write(NewInstruction(OpcodeSelect, selectArg).Byte())
 	if err != nil {
 		return err
 	}
 
 	// Wait for server Args
-	args, err := s.AssertOpcode("args")
+	args, err := s.AssertOpcode(OpcodeArgs)
 	if err != nil {
+		// guacd closes the connection rather than answering a join of an unknown connection
+		if joining && CloseReasonOf(err) != CloseUnknown {
+			return ErrUpstreamNotFound.NewError("Connection does not exist:", selectArg)
+		}
 		return err
 	}
 
 	// Build Args list off provided names and config
 	argNameS := args.Args
+	handshakeLog.Tracef("guacd requested arguments %v.", argNameS)
+	computed, err := computeParameters(ctx, config.ParameterFunc, argNameS)
+	if err != nil {
+		return err
+	}
 	argValueS := make([]string, 0, len(argNameS))
 	for _, argName := range argNameS {
 
-		// Retrieve argument name
+		// guacd 1.1.0+ sends its protocol version as the first argument and expects ours back
+		if strings.HasPrefix(argName, "VERSION_") {
+			s.ProtocolVersion = ProtocolVersion
+			if compareProtocolVersions(argName, ProtocolVersion) < 0 {
+				s.ProtocolVersion = argName
+			}
+			argValueS = append(argValueS, s.ProtocolVersion)
+			continue
+		}
 
 		// Get defined value for name
-		value := config.Parameters[argName]
-
-		// If value defined, set that value
-		if len(value) == 0 {
-			value = ""
+		value, ok := computed[argName]
+		if !ok {
+			value = config.Parameters[argName]
+		}
+		_, isSecret := secretKey(value)
+		value, err := resolveParameter(ctx, secrets, argName, value)
+		if err != nil {
+			return err
+		}
+		if value != "" && (isSecret || ok && IsSensitiveParameter(argName)) {
+			*sensitive = append(*sensitive, value)
 		}
 		argValueS = append(argValueS, value)
 	}
 
 	// Send size
-	_, err = s.Write(NewInstruction("size",
+	_, err = s.Write(NewInstruction(OpcodeSize,
 		fmt.Sprintf("%v", config.OptimalScreenWidth),
 		fmt.Sprintf("%v", config.OptimalScreenHeight),
 		fmt.Sprintf("%v", config.OptimalResolution)).Byte(),
@@ -213,31 +369,39 @@ func (s *Stream) Handshake(config *Config) error {
 	}
 
 	// Send supported audio formats
-	_, err = s.Write(NewInstruction("audio", config.AudioMimetypes...).Byte())
+	_, err = s.Write(NewInstruction(OpcodeAudio, config.AudioMimetypes...).Byte())
 	if err != nil {
 		return err
 	}
 
 	// Send supported video formats
-	_, err = s.Write(NewInstruction("video", config.VideoMimetypes...).Byte())
+	_, err = s.Write(NewInstruction(OpcodeVideo, config.VideoMimetypes...).Byte())
 	if err != nil {
 		return err
 	}
 
 	// Send supported image formats
-	_, err = s.Write(NewInstruction("image", config.ImageMimetypes...).Byte())
+	_, err = s.Write(NewInstruction(OpcodeImage, config.ImageMimetypes...).Byte())
 	if err != nil {
 		return err
 	}
 
+	// Send the name of the user, so guacd can announce them to others sharing the connection
+	if len(config.UserName) > 0 && compareProtocolVersions(s.ProtocolVersion, msgVersion) >= 0 {
+		_, err = s.Write(NewInstruction(OpcodeName, config.UserName).Byte())
+		if err != nil {
+			return err
+		}
+	}
+
 	// Send Args
-	_, err = s.Write(NewInstruction("connect", argValueS...).Byte())
+	_, err = s.Write(NewInstruction(OpcodeConnect, argValueS...).Byte())
 	if err != nil {
 		return err
 	}
 
 	// Wait for ready, store ID
-	ready, err := s.AssertOpcode("ready")
+	ready, err := s.AssertOpcode(OpcodeReady)
 	if err != nil {
 		return err
 	}
@@ -250,6 +414,8 @@ func (s *Stream) Handshake(config *Config) error {
 
 	s.Flush()
 	s.ConnectionID = readyArgs[0]
+	s.Joined = joining
+	handshakeLog.Debugf("Connection %v ready, protocol version %q.", s.ConnectionID, s.ProtocolVersion)
 
 	return nil
 }
@@ -272,3 +438,23 @@ func (s *Stream) AssertOpcode(opcode string) (instruction *Instruction, err erro
 	}
 	return
 }
+
+// compareProtocolVersions compares two "VERSION_major_minor_patch" strings, returning a negative
+// number, zero or a positive number as a is older than, equal to or newer than b.
+func compareProtocolVersions(a, b string) int {
+	partsA := strings.Split(strings.TrimPrefix(a, "VERSION_"), "_")
+	partsB := strings.Split(strings.TrimPrefix(b, "VERSION_"), "_")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var na, nb int
+		if i < len(partsA) {
+			na, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			nb, _ = strconv.Atoi(partsB[i])
+		}
+		if na != nb {
+			return na - nb
+		}
+	}
+	return 0
+}
@@ -2,8 +2,12 @@ package guac
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -101,6 +105,7 @@ type fakeConn struct {
 	ToRead  []byte
 	HasRead bool
 	Closed  bool
+	Written []byte
 }
 
 func (f *fakeConn) Read(b []byte) (n int, err error) {
@@ -113,7 +118,8 @@ func (f *fakeConn) Read(b []byte) (n int, err error) {
 }
 
 func (f *fakeConn) Write(b []byte) (n int, err error) {
-	return 0, nil
+	f.Written = append(f.Written, b...)
+	return len(b), nil
 }
 
 func (f *fakeConn) Close() error {
@@ -140,3 +146,135 @@ func (f *fakeConn) SetReadDeadline(t time.Time) error {
 func (f *fakeConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+// loopConn endlessly returns the same data in reads of at most chunk bytes
+type loopConn struct {
+	fakeConn
+	data   []byte
+	offset int
+	chunk  int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	n := 0
+	for n < len(b) {
+		copied := copy(b[n:], c.data[c.offset:])
+		n += copied
+		c.offset = (c.offset + copied) % len(c.data)
+	}
+	return n, nil
+}
+
+func newBenchmarkStream() *Stream {
+	data := []byte("4.sync,10.1234567890;3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;4.blob,1.1,12.aGVsbG8gd29y;3.end,1.1;")
+	// odd sized reads split instructions across reads as a real connection would
+	return NewStream(&loopConn{data: data, chunk: 1397}, time.Minute)
+}
+
+func TestInstructionReader_ReadSome_Long(t *testing.T) {
+	long := "4.blob,1.1," + strconv.Itoa(MaxGuacMessage*4) + "." + strings.Repeat("A", MaxGuacMessage*4) + ";"
+	stream := NewStream(&loopConn{data: []byte(long + "3.end,1.1;"), chunk: 1000}, time.Minute)
+
+	for _, want := range []string{long, "3.end,1.1;", long} {
+		ins, err := stream.ReadSome()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ins) != want {
+			t.Fatalf("Unexpected instruction of length %v", len(ins))
+		}
+	}
+}
+
+func BenchmarkStream_ReadSome(b *testing.B) {
+	stream := newBenchmarkStream()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.ReadSome(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStream_ReadSome_Concurrent reads from thousands of streams at once, as a busy
+// server would
+func BenchmarkStream_ReadSome_Concurrent(b *testing.B) {
+	const tunnels = 4096
+	streams := make(chan *Stream, tunnels)
+	for i := 0; i < tunnels; i++ {
+		streams <- newBenchmarkStream()
+	}
+	b.ReportAllocs()
+	b.SetParallelism(tunnels / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		stream := <-streams
+		for pb.Next() {
+			if _, err := stream.ReadSome(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestStream_SetTimeouts(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := NewStream(client, time.Hour)
+	defer stream.Close()
+	stream.SetTimeouts(20*time.Millisecond, 20*time.Millisecond)
+
+	start := time.Now()
+	if _, err := stream.ReadSome(); err == nil || asErrGuac(err).Kind != ErrUpstreamTimeout {
+		t.Error("Expected the stalled read to time out, got", err)
+	}
+	if _, err := stream.Write([]byte("4.sync,1.0;")); err == nil {
+		t.Error("Expected the stalled write to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Timeouts took", elapsed)
+	}
+}
+
+func TestBackend_ReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		buffer := make([]byte, 1024)
+		_, _ = server.Read(buffer)
+		_, _ = server.Write([]byte("4.args,13.VERSION_1_5_0;"))
+		// read the rest of the handshake, then stall
+		for {
+			n, err := server.Read(buffer)
+			if err != nil || strings.Contains(string(buffer[:n]), "7.connect") {
+				break
+			}
+		}
+		_, _ = server.Write([]byte("5.ready,4.$abc;"))
+	}()
+
+	backend := &Backend{
+		Dialer:      dialerFunc(func() (net.Conn, error) { return client, nil }),
+		ReadTimeout: 20 * time.Millisecond,
+	}
+	stream, err := backend.Connect(context.Background(), NewGuacamoleConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err = stream.ReadSome(); err == nil || asErrGuac(err).Kind != ErrUpstreamTimeout {
+		t.Error("Expected reading from the stalled guacd to time out, got", err)
+	}
+}
+
+// dialerFunc returns the connection made by a function
+type dialerFunc func() (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f()
+}
@@ -0,0 +1,205 @@
+package guac
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	// serverStreamBase is the first of the stream indices reserved for streams opened by this
+	// package on behalf of the client. guacd accepts at most 64 client streams and the
+	// JavaScript client allocates its own indices from zero upwards, so the top of the range
+	// is used.
+	serverStreamBase = 48
+	serverStreamMax  = 64
+
+	// streamBlobSize is the number of raw bytes sent per blob instruction
+	streamBlobSize = 4096
+)
+
+// streamIndexPool hands out stream indices from the range reserved for server-side streams
+type streamIndexPool struct {
+	sync.Mutex
+	used [serverStreamMax - serverStreamBase]bool
+	// opened is true while guacd may acknowledge the stream, from its opening until it ends or
+	// guacd acknowledges it with an error. Acknowledgements arriving later are passed to the
+	// client, which ignores those of streams it has not opened, so an index it reuses is not
+	// taken for one of the pool's.
+	opened [serverStreamMax - serverStreamBase]bool
+	// failed holds the error guacd acknowledged each stream with, if any
+	failed [serverStreamMax - serverStreamBase]error
+}
+
+// next reserves an unused stream index
+func (p *streamIndexPool) next() (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	for i := len(p.used) - 1; i >= 0; i-- {
+		if !p.used[i] {
+			p.used[i] = true
+			p.opened[i] = true
+			p.failed[i] = nil
+			return serverStreamBase + i, nil
+		}
+	}
+	return 0, ErrServerBusy.NewError("No free stream indices")
+}
+
+// free releases a stream index obtained from next
+func (p *streamIndexPool) free(index int) {
+	p.Lock()
+	if isServerStream(index) {
+		p.used[index-serverStreamBase] = false
+		p.opened[index-serverStreamBase] = false
+	}
+	p.Unlock()
+}
+
+// owns returns true if the instruction is guacd acknowledging a stream from this pool,
+// recording the error if the acknowledgement reports one
+func (p *streamIndexPool) owns(instruction *Instruction) bool {
+	if instruction.Opcode != OpcodeAck || len(instruction.Args) == 0 {
+		return false
+	}
+	index, err := strconv.Atoi(instruction.Args[0])
+	if err != nil || !isServerStream(index) {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	if !p.opened[index-serverStreamBase] {
+		return false
+	}
+	if len(instruction.Args) >= 3 && instruction.Args[2] != "0" {
+		// guacd has closed the stream
+		code, _ := strconv.Atoi(instruction.Args[2])
+		p.failed[index-serverStreamBase] = &ErrGuac{
+			error:  errors.New(instruction.Args[1]),
+			Status: FromGuacamoleStatusCode(code),
+			Kind:   ErrUpstream,
+		}
+		p.opened[index-serverStreamBase] = false
+	}
+	return true
+}
+
+// err returns the error guacd reported for an open stream, if any
+func (p *streamIndexPool) err(index int) error {
+	p.Lock()
+	defer p.Unlock()
+	if !isServerStream(index) {
+		return nil
+	}
+	return p.failed[index-serverStreamBase]
+}
+
+func isServerStream(index int) bool {
+	return index >= serverStreamBase && index < serverStreamMax
+}
+
+// StreamWriter sends instructions and complete streams to guacd
+type StreamWriter interface {
+	InstructionWriter
+	// WriteStream opens a stream with the given opcode and arguments, sends data as blobs and
+	// then ends the stream.
+	WriteStream(opcode string, data io.Reader, args ...string) error
+}
+
+// WriteStream sends data to guacd as a stream opened by "opcode,<index>,args...", for example
+// an argv, clipboard or file stream. Acknowledgements for the stream are not passed to the
+// client.
+func (t *FilteredTunnel) WriteStream(opcode string, data io.Reader, args ...string) error {
+	index, err := t.streams.next()
+	if err != nil {
+		return err
+	}
+	defer t.streams.free(index)
+
+	stream := strconv.Itoa(index)
+	if err = t.WriteInstruction(NewInstruction(opcode, append([]string{stream}, args...)...)); err != nil {
+		return err
+	}
+	if err = writeBlobs(t, stream, data); err != nil {
+		return err
+	}
+	return t.WriteInstruction(NewInstruction(OpcodeEnd, stream))
+}
+
+// writeBlobs reads data until EOF, sending it as base64 blobs on the given stream
+func writeBlobs(writer InstructionWriter, stream string, data io.Reader) error {
+	buf := make([]byte, streamBlobSize)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if n > 0 {
+			blob := base64.StdEncoding.EncodeToString(buf[:n])
+			if e := writer.WriteInstruction(NewInstruction(OpcodeBlob, stream, blob)); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// streamTaps feeds the blobs of intercepted guacd streams to readers which are consumed in
+// their own goroutines
+type streamTaps struct {
+	sync.Mutex
+	writers map[string]*io.PipeWriter
+}
+
+// open starts feeding the stream with the given index to consume
+func (s *streamTaps) open(index string, consume func(io.Reader)) {
+	reader, writer := io.Pipe()
+
+	s.Lock()
+	if s.writers == nil {
+		s.writers = map[string]*io.PipeWriter{}
+	}
+	if previous, ok := s.writers[index]; ok {
+		_ = previous.Close()
+	}
+	s.writers[index] = writer
+	s.Unlock()
+
+	go consume(reader)
+}
+
+// write decodes a blob and passes it to the stream's reader, blocking until it is read. It
+// returns false if the stream is not tapped. Streams whose reader fails are closed.
+func (s *streamTaps) write(index, blob string) (bool, error) {
+	s.Lock()
+	writer, ok := s.writers[index]
+	s.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err == nil {
+		_, err = writer.Write(data)
+	}
+	if err != nil {
+		s.close(index)
+	}
+	return true, err
+}
+
+// close ends a tapped stream, returning false if it was not tapped
+func (s *streamTaps) close(index string) bool {
+	s.Lock()
+	writer, ok := s.writers[index]
+	delete(s.writers, index)
+	s.Unlock()
+	if ok {
+		_ = writer.Close()
+	}
+	return ok
+}
@@ -0,0 +1,46 @@
+package guac
+
+import (
+	"net/http"
+	"time"
+)
+
+// ReauthenticateHeader is set on responses refused because the identity behind a tunnel has
+// expired, to the ReauthenticateURL of the server or "true" if it has none
+const ReauthenticateHeader = "Guacamole-Reauthenticate"
+
+// identityExpiredMessage is what clients are told when their identity expires
+const identityExpiredMessage = "Authentication has expired."
+
+// checkIdentity enforces StrictIdentity for a read or write request on the tunnel. An expired
+// identity is renewed if the request itself authenticates the same user; otherwise the tunnel
+// is killed, so a read in progress tells the client why, and ErrUnauthorized is returned.
+func (s *Server) checkIdentity(response http.ResponseWriter, request *http.Request, tunnelUUID string, tunnel Tunnel) error {
+	registered, ok := tunnel.(*LastAccessedTunnel)
+	if !s.StrictIdentity || !ok {
+		return nil
+	}
+	identity := registered.Identity()
+	if identity == nil || !identity.Expired(time.Now()) {
+		return nil
+	}
+
+	if s.Authorizer != nil {
+		if _, renewed, err := authorize(s.Authorizer, request); err == nil && renewed.Subject == identity.Subject {
+			registered.renewIdentity(renewed)
+			s.log(registryLog, tunnel).Debugf("Renewed identity of %v for tunnel %v.", identity, tunnelUUID)
+			return nil
+		}
+	}
+
+	s.log(registryLog, tunnel).Infof("Identity of %v for tunnel %v has expired.", identity, tunnelUUID)
+	if err := s.killTunnel(tunnelUUID, NewErrorInstruction(identityExpiredMessage, ClientUnauthorized)); err != nil {
+		s.log(registryLog, tunnel).Debug("Unable to kill tunnel with expired identity.", err)
+	}
+	hint := s.ReauthenticateURL
+	if hint == "" {
+		hint = "true"
+	}
+	response.Header().Set(ReauthenticateHeader, hint)
+	return ErrUnauthorized.NewError(identityExpiredMessage)
+}
@@ -0,0 +1,118 @@
+package guac
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// expiringAuthorizer authenticates "stale" credentials for a moment and "fresh" ones for an hour
+var expiringAuthorizer = AuthorizerFunc(func(r *http.Request) (*Identity, error) {
+	switch r.Header.Get("Authorization") {
+	case "stale":
+		return &Identity{Subject: "alice", Expiry: time.Now().Add(20 * time.Millisecond)}, nil
+	case "fresh":
+		return &Identity{Subject: "alice", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+	return nil, errors.New("no credentials")
+})
+
+func TestServer_StrictIdentity(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: &strings.Builder{}}, uuid: tunnelUUID}, nil
+	})
+	server.Authorizer = expiringAuthorizer
+	server.StrictIdentity = true
+	server.ReauthenticateURL = "/login"
+
+	write := func(credentials string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader("3.nop;"))
+		request.Header.Set("Authorization", credentials)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	request := connectRequest("")
+	request.Header.Set("Authorization", "stale")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	if recorder := write(""); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected write before expiry to succeed, got %v", recorder.Code)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if recorder := write("fresh"); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected write with fresh credentials to renew the identity, got %v", recorder.Code)
+	}
+	if tunnels := server.Tunnels(); len(tunnels) != 1 || !tunnels[0].Identity.Expiry.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("Expected renewed identity, got %+v", tunnels)
+	}
+
+	registered, _ := server.tunnels.Get(tunnelUUID)
+	registered.renewIdentity(&Identity{Subject: "alice", Expiry: time.Now()})
+	recorder := write("")
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get(ReauthenticateHeader) != "/login" {
+		t.Errorf("Expected expired identity to be refused with a hint, got %v %v", recorder.Code, recorder.Header())
+	}
+	if len(server.Tunnels()) != 0 {
+		t.Error("Expected tunnel with expired identity to be killed")
+	}
+}
+
+func TestServer_StrictIdentityRefusedFirst(t *testing.T) {
+	tunnelUUID := uuid.New().String()
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{fakeTunnel: fakeTunnel{writer: &strings.Builder{}}, uuid: tunnelUUID}, nil
+	})
+	server.Authorizer = expiringAuthorizer
+	server.StrictIdentity = true
+	server.TunnelAuthorizer = OwnerOnly(expiringAuthorizer)
+
+	request := connectRequest("")
+	request.Header.Set("Authorization", "stale")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+	time.Sleep(30 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnelUUID, strings.NewReader("3.nop;")))
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get(ReauthenticateHeader) != "" {
+		t.Errorf("Expected a request the TunnelAuthorizer refuses to be refused, got %v %v", recorder.Code, recorder.Header())
+	}
+	if len(server.Tunnels()) != 1 {
+		t.Error("Expected a refused request not to kill a tunnel with an expired identity")
+	}
+}
+
+func TestWebsocketServer_StrictIdentity(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	server.Authorizer = expiringAuthorizer
+	server.StrictIdentity = true
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), http.Header{"Authorization": {"stale"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != ClientUnauthorized.GetWebSocketCode() || closeErr.Text != identityExpiredMessage {
+		t.Errorf("Expected websocket to be closed once the identity expired, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package guac
+
+import (
+	"strings"
+)
+
+// Common tag keys
+const (
+	TagTenant          = "tenant"
+	TagConnectionGroup = "connection_group"
+	TagProtocol        = "protocol"
+)
+
+// Tags label a tunnel with the values it can be looked up by, such as its tenant, connection
+// group and protocol, so operations can be applied to every tunnel with the same labels.
+type Tags map[string]string
+
+// Matches returns true if the tags hold every key of selector with the same value. An empty
+// selector matches any tags.
+func (t Tags) Matches(selector Tags) bool {
+	for key, value := range selector {
+		if v, ok := t[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// clone returns a copy of the tags, nil if there are none
+func (t Tags) clone() Tags {
+	if len(t) == 0 {
+		return nil
+	}
+	tags := make(Tags, len(t))
+	for key, value := range t {
+		tags[key] = value
+	}
+	return tags
+}
+
+// ParseTagSelector parses selectors of the form "key:value", as given to an AdminServer, into
+// Tags
+func ParseTagSelector(selectors []string) (Tags, error) {
+	tags := Tags{}
+	for _, selector := range selectors {
+		key, value, ok := strings.Cut(selector, ":")
+		if !ok || key == "" {
+			return nil, ErrClient.NewError("Invalid tag selector:", selector)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// Tags returns a copy of the tags of the tunnel
+func (t *LastAccessedTunnel) Tags() Tags {
+	t.RLock()
+	defer t.RUnlock()
+	return t.tags.clone()
+}
+
+func (t *LastAccessedTunnel) setTags(tags Tags) {
+	t.Lock()
+	t.tags = tags.clone()
+	t.Unlock()
+}
+
+// findTagged returns the tunnels of the registry whose tags match selector, by UUID
+func findTagged(registry TunnelRegistry, selector Tags) map[string]*LastAccessedTunnel {
+	found := map[string]*LastAccessedTunnel{}
+	registry.Range(func(uuid string, tunnel *LastAccessedTunnel) bool {
+		if tunnel.Tags().Matches(selector) {
+			found[uuid] = tunnel
+		}
+		return true
+	})
+	return found
+}
+
+// FindTagged returns the tunnels whose tags match selector, by UUID
+func (m *TunnelMap) FindTagged(selector Tags) map[string]*LastAccessedTunnel {
+	return findTagged(m, selector)
+}
+
+// PutWithTags registers a tunnel along with the identity of the user it belongs to and its tags.
+func (m *TunnelMap) PutWithTags(uuid string, tunnel Tunnel, identity *Identity, tags Tags) {
+	registered := newRegisteredTunnel(tunnel, identity, nil)
+	registered.tags = tags.clone()
+	m.Register(uuid, registered)
+}
+
+// TaggedTunnels returns the UUIDs of the open tunnels whose tags match selector
+func (s *Server) TaggedTunnels(selector Tags) []string {
+	var uuids []string
+	for uuid := range findTagged(s.tunnels, selector) {
+		uuids = append(uuids, uuid)
+	}
+	return uuids
+}
+
+// SetTunnelTags replaces the tags of the open tunnel with the given UUID
+func (s *Server) SetTunnelTags(tunnelUUID string, tags Tags) error {
+	tunnel, ok := s.tunnels.Peek(tunnelUUID)
+	if !ok {
+		return ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	tunnel.setTags(tags)
+	return nil
+}
+
+// KillTagged kills every open tunnel whose tags match selector as KillTunnel does, returning
+// the number killed. An empty selector matches no tunnels rather than all of them.
+func (s *Server) KillTagged(selector Tags, reason string) (int, error) {
+	if len(selector) == 0 {
+		return 0, ErrClient.NewError("No tags given.")
+	}
+	killed := 0
+	var err error
+	for uuid := range findTagged(s.tunnels, selector) {
+		e := s.KillTunnel(uuid, reason)
+		if e == nil {
+			killed++
+		} else if asErrGuac(e).Kind != ErrResourceNotFound && err == nil {
+			// tunnels which closed meanwhile are not an error
+			err = e
+		}
+	}
+	return killed, err
+}
@@ -0,0 +1,81 @@
+package guac
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTags_Matches(t *testing.T) {
+	tags := Tags{TagTenant: "acme", TagProtocol: "rdp"}
+	if !tags.Matches(nil) || !tags.Matches(Tags{TagTenant: "acme"}) {
+		t.Error("Expected tags to match a subset of themselves")
+	}
+	if tags.Matches(Tags{TagTenant: "acme", TagProtocol: "ssh"}) || tags.Matches(Tags{TagConnectionGroup: ""}) {
+		t.Error("Expected tags not to match other values or missing keys")
+	}
+}
+
+func TestParseTagSelector(t *testing.T) {
+	tags, err := ParseTagSelector([]string{"tenant:acme", "connection_group:a:b"})
+	if err != nil || tags[TagTenant] != "acme" || tags[TagConnectionGroup] != "a:b" {
+		t.Error("Unexpected selector", tags, err)
+	}
+	if _, err = ParseTagSelector([]string{"tenant"}); err == nil {
+		t.Error("Expected a selector without a value to fail")
+	}
+}
+
+func TestServer_KillTagged(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &uuidTunnel{
+			fakeTunnel: fakeTunnel{writer: &strings.Builder{}},
+			uuid:       uuid.New().String(),
+		}, nil
+	})
+	server.Tags = func(r *http.Request, tunnel Tunnel) Tags {
+		body, _ := io.ReadAll(r.Body)
+		return Tags{TagTenant: string(body), TagProtocol: "rdp"}
+	}
+	connect := func(tenant string) string {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, connectRequest(tenant))
+		return recorder.Body.String()
+	}
+	acme1, acme2, other := connect("acme"), connect("acme"), connect("other")
+
+	admin := &AdminServer{Server: server, Authorizer: adminAuthorizer}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/tunnels?tag=tenant:acme&tag=protocol:rdp", nil))
+	var tunnels []TunnelSummary
+	if err := json.NewDecoder(recorder.Body).Decode(&tunnels); err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 || tunnels[0].Tags[TagTenant] != "acme" {
+		t.Errorf("Expected the tunnels of acme, got %+v", tunnels)
+	}
+
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/admin/tunnels?tag=tenant:acme", nil))
+	var response KillTaggedResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Killed != 2 {
+		t.Error("Expected both tunnels of acme to be killed, got", response, err)
+	}
+	for _, id := range []string{acme1, acme2} {
+		if _, ok := server.tunnels.Get(id); ok {
+			t.Error("Expected tunnel of acme to be gone", id)
+		}
+	}
+	if uuids := server.TaggedTunnels(Tags{TagProtocol: "rdp"}); len(uuids) != 1 || uuids[0] != other {
+		t.Error("Expected only the tunnel of the other tenant to remain, got", uuids)
+	}
+
+	if _, err := server.KillTagged(nil, DefaultKillReason); err == nil {
+		t.Error("Expected killing without tags to fail")
+	}
+}
@@ -0,0 +1,284 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultPorts are the ports guacd connects to for each protocol when no port is given
+var defaultPorts = map[string]int{
+	"rdp":        3389,
+	"vnc":        5900,
+	"ssh":        22,
+	"telnet":     23,
+	"kubernetes": 8080,
+}
+
+const (
+	// defaultSFTPPort is the port of the SFTP server of a connection when no sftp-port is given
+	defaultSFTPPort = 22
+	// defaultGatewayPort is the port of the remote desktop gateway of an RDP connection when
+	// no gateway-port is given
+	defaultGatewayPort = 443
+	// defaultWOLPort is the port Wake-on-LAN packets are sent to when no wol-udp-port is given
+	defaultWOLPort = 9
+)
+
+// TargetPolicy decides which hosts and ports connections may reach, so a compromised frontend
+// cannot use the gateway to reach arbitrary internal hosts. Rules have the form host[:ports]
+// where host is a hostname, a wildcard such as *.corp.example.com matching its subdomains, an
+// IP address or a CIDR prefix, and ports a port or a range such as 5900-5910. IPv6 hosts
+// followed by ports are written in brackets, as in [2001:db8::/32]:22. Rules without ports
+// match any port.
+//
+// A target is refused if it matches a Deny rule, or if there are Allow rules and it matches
+// none. Hostnames are resolved so their addresses are checked against address rules too,
+// every address having to pass; as guacd resolves the name again, DNS answers which change in
+// between are not caught, and policies relying on addresses are best given addresses rather
+// than names. The hostname and port of the connection are checked, along with those of its
+// SFTP server, RDP gateway and VNC repeater destination if it has them, and the address its
+// Wake-on-LAN packets are broadcast to if it sends them. Joins of existing connections have
+// no target and always pass. The rules are parsed once, as the policy is first used.
+type TargetPolicy struct {
+	// Allow lists the targets connections may reach, any if empty
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists the targets connections may never reach
+	Deny []string `json:"deny,omitempty"`
+	// Resolver looks up the addresses of hostnames, the system resolver if nil
+	Resolver Resolver `json:"-"`
+
+	parseOnce   sync.Once
+	allow, deny []targetRule
+	parseErr    error
+}
+
+// targetRule is a parsed rule of a TargetPolicy
+type targetRule struct {
+	// host is a hostname, or a domain prefixed with "." for a wildcard, if prefix is not valid
+	host   string
+	prefix netip.Prefix
+	// low and high bound the ports matched, zero for any
+	low, high int
+}
+
+// parseTargetRule parses a rule of a TargetPolicy
+func parseTargetRule(rule string) (targetRule, error) {
+	invalid := func() (targetRule, error) {
+		return targetRule{}, ErrServer.NewError("Invalid target rule:", rule)
+	}
+	host, ports, hasPorts := rule, "", false
+	if strings.HasPrefix(rule, "[") {
+		end := strings.Index(rule, "]")
+		if end < 0 {
+			return invalid()
+		}
+		host = rule[1:end]
+		ports, hasPorts = strings.CutPrefix(rule[end+1:], ":")
+		if !hasPorts && rule[end+1:] != "" {
+			return invalid()
+		}
+	} else if strings.Count(rule, ":") == 1 {
+		host, ports, hasPorts = strings.Cut(rule, ":")
+	}
+	if host == "" {
+		return invalid()
+	}
+
+	var parsed targetRule
+	if hasPorts {
+		low, high, isRange := strings.Cut(ports, "-")
+		var err error
+		if parsed.low, err = strconv.Atoi(low); err != nil || parsed.low <= 0 {
+			return invalid()
+		}
+		parsed.high = parsed.low
+		if isRange {
+			if parsed.high, err = strconv.Atoi(high); err != nil || parsed.high < parsed.low {
+				return invalid()
+			}
+		}
+	}
+
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		parsed.prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(host); err == nil {
+		parsed.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else if strings.HasPrefix(host, "*.") {
+		parsed.host = strings.ToLower(host[1:])
+	} else {
+		parsed.host = strings.ToLower(host)
+	}
+	return parsed, nil
+}
+
+// matches returns true if the rule matches the target with the given hostname, addresses and
+// port
+func (r targetRule) matches(host string, addrs []netip.Addr, port int) bool {
+	if r.low != 0 && (port < r.low || port > r.high) {
+		return false
+	}
+	if r.prefix.IsValid() {
+		for _, addr := range addrs {
+			if r.prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+	if strings.HasPrefix(r.host, ".") {
+		return strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+// Validate checks the rules of the policy can be parsed
+func (p *TargetPolicy) Validate() error {
+	for _, rule := range append(append([]string(nil), p.Allow...), p.Deny...) {
+		if _, err := parseTargetRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// target is a host and port of a connection, and the port used if it has none
+type target struct {
+	host, port  string
+	defaultPort int
+}
+
+// rules returns the parsed Allow and Deny rules
+func (p *TargetPolicy) rules() (allow, deny []targetRule, err error) {
+	p.parseOnce.Do(func() {
+		parse := func(rules []string) []targetRule {
+			parsed := make([]targetRule, 0, len(rules))
+			for _, rule := range rules {
+				one, err := parseTargetRule(rule)
+				if err != nil {
+					p.parseErr = err
+				}
+				parsed = append(parsed, one)
+			}
+			return parsed
+		}
+		p.allow, p.deny = parse(p.Allow), parse(p.Deny)
+	})
+	return p.allow, p.deny, p.parseErr
+}
+
+// Check refuses a connection configuration whose targets the policy doesn't allow with
+// ErrSecurity
+func (p *TargetPolicy) Check(ctx context.Context, config *Config) error {
+	if config.ConnectionID != "" {
+		return nil
+	}
+	parameters := config.Parameters
+	if err := p.checkTarget(ctx, parameters["hostname"], parameters["port"], defaultPorts[strings.ToLower(config.Protocol)]); err != nil {
+		return err
+	}
+	// the other hosts guacd connects to or sends packets to for the connection
+	others := []target{
+		{parameters["gateway-hostname"], parameters["gateway-port"], defaultGatewayPort},
+		{parameters["dest-host"], parameters["dest-port"], defaultPorts["vnc"]},
+	}
+	if parameters["enable-sftp"] == "true" {
+		others = append(others, target{parameters["sftp-hostname"], parameters["sftp-port"], defaultSFTPPort})
+	}
+	if parameters["wol-send-packet"] == "true" {
+		others = append(others, target{parameters["wol-broadcast-addr"], parameters["wol-udp-port"], defaultWOLPort})
+	}
+	for _, other := range others {
+		if other.host == "" {
+			continue
+		}
+		if err := p.checkTarget(ctx, other.host, other.port, other.defaultPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTarget checks a single host and port, using defaultPort if port is empty
+func (p *TargetPolicy) checkTarget(ctx context.Context, host, port string, defaultPort int) error {
+	allow, deny, err := p.rules()
+	if err != nil {
+		return err
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if host == "" {
+		if len(allow) > 0 {
+			return ErrSecurity.NewError("Connection has no target host.")
+		}
+		return nil
+	}
+	portNumber := defaultPort
+	if port != "" {
+		if portNumber, err = strconv.Atoi(port); err != nil {
+			return ErrSecurity.NewError("Invalid target port:", port)
+		}
+	}
+
+	addrs, err := p.addresses(ctx, host)
+	if err != nil {
+		return err
+	}
+	refuse := func() error {
+		return ErrSecurity.NewError("Target not allowed by policy:", net.JoinHostPort(host, strconv.Itoa(portNumber)))
+	}
+
+	for _, rule := range deny {
+		if rule.matches(host, addrs, portNumber) {
+			return refuse()
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	// every address must be allowed, or a name resolving to one allowed and one denied
+	// address could be used to reach the other
+	for _, addr := range addrs {
+		if !allowed(allow, host, []netip.Addr{addr}, portNumber) {
+			return refuse()
+		}
+	}
+	if len(addrs) == 0 && !allowed(allow, host, nil, portNumber) {
+		return refuse()
+	}
+	return nil
+}
+
+// allowed returns true if one of the Allow rules matches the target, by name or by address
+func allowed(allow []targetRule, host string, addrs []netip.Addr, port int) bool {
+	for _, rule := range allow {
+		if rule.matches(host, addrs, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// addresses returns the addresses of host, resolving it if it is a name
+func (p *TargetPolicy) addresses(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	names, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, ErrUpstreamNotFound.NewError("Unable to resolve target host.", err.Error())
+	}
+	addrs := make([]netip.Addr, 0, len(names))
+	for _, name := range names {
+		if addr, err := netip.ParseAddr(name); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,87 @@
+package guac
+
+import (
+	"context"
+	"testing"
+)
+
+func targetConfig(protocol string, parameters map[string]string) *Config {
+	config := NewGuacamoleConfiguration()
+	config.Protocol = protocol
+	config.Parameters = parameters
+	return config
+}
+
+func TestTargetPolicy_Check(t *testing.T) {
+	policy := &TargetPolicy{
+		Allow: []string{"10.0.0.0/24:5900-5910", "*.desktops.example.com", "10.1.0.0/16:22", "[2001:db8::/32]:3389"},
+		Deny:  []string{"10.0.0.1", "admin.desktops.example.com"},
+		Resolver: &fakeResolver{addrs: map[string][]string{
+			"pc1.desktops.example.com":   {"10.9.9.9"},
+			"admin.desktops.example.com": {"10.9.9.10"},
+			"jump":                       {"10.1.2.3"},
+			"mixed":                      {"10.1.2.3", "192.168.0.1"},
+		}},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		config     *Config
+		shouldFail bool
+	}{
+		{"allowed address", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5"}), false},
+		{"port out of range", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "port": "22"}), true},
+		{"denied address", targetConfig("vnc", map[string]string{"hostname": "10.0.0.1"}), true},
+		{"wildcard", targetConfig("rdp", map[string]string{"hostname": "PC1.desktops.example.com."}), false},
+		{"denied name", targetConfig("rdp", map[string]string{"hostname": "admin.desktops.example.com"}), true},
+		{"resolved address", targetConfig("ssh", map[string]string{"hostname": "jump"}), false},
+		{"partly allowed addresses", targetConfig("ssh", map[string]string{"hostname": "mixed"}), true},
+		{"unresolvable", targetConfig("ssh", map[string]string{"hostname": "nowhere"}), true},
+		{"ipv6", targetConfig("rdp", map[string]string{"hostname": "[2001:db8::1]"}), false},
+		{"no host", targetConfig("rdp", map[string]string{}), true},
+		{"sftp", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "enable-sftp": "true", "sftp-hostname": "192.168.0.1"}), true},
+		{"sftp disabled", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "sftp-hostname": "192.168.0.1"}), false},
+		{"rdp gateway", targetConfig("rdp", map[string]string{"hostname": "[2001:db8::1]", "gateway-hostname": "10.0.0.1"}), true},
+		{"vnc repeater", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "dest-host": "10.0.0.6", "dest-port": "5901"}), false},
+		{"vnc repeater port", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "dest-host": "10.0.0.6", "dest-port": "23"}), true},
+		{"wake-on-lan", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "wol-send-packet": "true", "wol-broadcast-addr": "10.0.0.255"}), true},
+		{"wake-on-lan disabled", targetConfig("vnc", map[string]string{"hostname": "10.0.0.5", "wol-broadcast-addr": "10.0.0.255"}), false},
+		{"join", &Config{ConnectionID: "$abc"}, false},
+	}
+	for _, test := range tests {
+		err := policy.Check(context.Background(), test.config)
+		if (err != nil) != test.shouldFail {
+			t.Errorf("%v: unexpected result %v", test.name, err)
+		}
+	}
+
+	denyOnly := &TargetPolicy{Deny: []string{"169.254.0.0/16"}}
+	if err := denyOnly.Check(context.Background(), targetConfig("rdp", map[string]string{"hostname": "169.254.169.254"})); err == nil || asErrGuac(err).Kind != ErrSecurity {
+		t.Error("Expected the denied target to be refused, got", err)
+	}
+	if err := denyOnly.Check(context.Background(), targetConfig("rdp", map[string]string{"hostname": "10.0.0.1"})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTargetPolicy_Validate(t *testing.T) {
+	for _, rule := range []string{"", "host:", "host:0", "host:22-21", "[::1", "[::1]22", ":22"} {
+		if err := (&TargetPolicy{Allow: []string{rule}}).Validate(); err == nil {
+			t.Errorf("Expected %q to be invalid", rule)
+		}
+	}
+}
+
+func TestBackend_Targets(t *testing.T) {
+	dialer := &argsDialer{}
+	backend := &Backend{Dialer: dialer, Targets: &TargetPolicy{Allow: []string{"10.0.0.0/8"}}}
+	if _, err := backend.Connect(context.Background(), targetConfig("rdp", map[string]string{"hostname": "192.168.0.1"})); err == nil {
+		t.Fatal("Expected the target to be refused")
+	}
+	if dialer.conn != nil {
+		t.Error("Expected guacd not to be dialed")
+	}
+}
@@ -0,0 +1,111 @@
+package guac
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// teardownTimeout bounds how long killing a tunnel waits for guacd to be sent a disconnect
+	teardownTimeout = time.Second
+	// endedTunnelTTL is how long the reason a tunnel was killed is kept for its client's next
+	// request
+	endedTunnelTTL = time.Minute
+)
+
+// setKilled records why the tunnel is being closed, for a read in progress to send the client
+// rather than failing
+func (t *LastAccessedTunnel) setKilled(reason *Instruction) {
+	t.Lock()
+	t.killed = reason
+	t.Unlock()
+}
+
+// closedBy returns the error instruction telling the client the server closed the tunnel for
+// the reason, with the CloseMessages of the server it is registered with
+func (t *LastAccessedTunnel) closedBy(reason CloseReason, status Status) *Instruction {
+	return t.closeMessages.closedBy(reason, status)
+}
+
+// kill records why the tunnel is being closed, asks guacd to end the session and closes the
+// tunnel
+func (t *LastAccessedTunnel) kill(reason *Instruction) error {
+	t.setKilled(reason)
+
+	// a stalled guacd must not hold up closing the tunnel
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		disconnect(t.GetUUID(), t.Tunnel)
+	}()
+	timer := time.NewTimer(teardownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	return t.Close()
+}
+
+// endedTunnels remembers why tunnels were killed, so a client whose request arrives after its
+// tunnel is gone is told why rather than that the tunnel doesn't exist. The tunnel is kept so
+// the request is authorized as it would have been before telling it.
+type endedTunnels struct {
+	sync.Mutex
+	reasons map[string]endedTunnel
+}
+
+type endedTunnel struct {
+	tunnel *LastAccessedTunnel
+	reason *Instruction
+	at     time.Time
+}
+
+// add records the reason a tunnel was killed, forgetting those older than endedTunnelTTL
+func (e *endedTunnels) add(uuid string, tunnel *LastAccessedTunnel, reason *Instruction) {
+	e.Lock()
+	defer e.Unlock()
+	now := time.Now()
+	for id, ended := range e.reasons {
+		if now.Sub(ended.at) > endedTunnelTTL {
+			delete(e.reasons, id)
+		}
+	}
+	if e.reasons == nil {
+		e.reasons = map[string]endedTunnel{}
+	}
+	e.reasons[uuid] = endedTunnel{tunnel: tunnel, reason: reason, at: now}
+}
+
+// get returns the tunnel killed recently under the UUID and the error instruction it was
+// killed with
+func (e *endedTunnels) get(uuid string) (endedTunnel, bool) {
+	e.Lock()
+	defer e.Unlock()
+	if ended, ok := e.reasons[uuid]; ok && time.Since(ended.at) <= endedTunnelTTL {
+		return ended, true
+	}
+	return endedTunnel{}, false
+}
+
+// sendEnded answers a request for a tunnel killed recently with the reason it was. Reads are
+// sent the error instruction, so the client shows it as it would during a read, and writes
+// fail with its status and message.
+func (s *Server) sendEnded(response http.ResponseWriter, reason *Instruction, read bool) {
+	if read {
+		response.Header().Set("Content-Type", "application/octet-stream")
+		response.Header().Set("Cache-Control", "no-cache")
+		_, _ = response.Write(reason.Byte())
+		_, _ = response.Write([]byte("0.;"))
+		return
+	}
+	status := SessionClosed
+	if len(reason.Args) > 1 {
+		if code, err := strconv.Atoi(reason.Args[1]); err == nil {
+			status = FromGuacamoleStatusCode(code)
+		}
+	}
+	s.sendError(response, status, reason.Args[0])
+}
@@ -0,0 +1,97 @@
+package guac
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_KillTunnelDisconnectsGuacd(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.registerTunnel(tunnel, nil, nil)
+
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(guacd).ReadString(';')
+		received <- line
+	}()
+	if err := server.KillTunnel(tunnel.GetUUID(), "Maintenance window"); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-received; line != NewDisconnectInstruction().String() {
+		t.Errorf("Expected guacd to be sent a disconnect, got %q", line)
+	}
+
+	// the client learns why on its next read or write, rather than that the tunnel is gone
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tunnel?read:"+tunnel.GetUUID()+":0", nil))
+	expected := NewErrorInstruction("Maintenance window", SessionClosed).String() + "0.;"
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Errorf("Unexpected read response %v %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnel.GetUUID(), strings.NewReader("4.sync,1.1;")))
+	if code := recorder.Header().Get("Guacamole-Status-Code"); code != strconv.Itoa(SessionClosed.GetGuacamoleStatusCode()) {
+		t.Error("Expected the write to fail with SessionClosed, got", code)
+	}
+	if message := recorder.Header().Get("Guacamole-Error-Message"); message != "Maintenance window" {
+		t.Error("Unexpected error message", message)
+	}
+}
+
+func TestServer_UnauthorizedRequestsDontTouchTunnels(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	go func() {
+		_, _ = bufio.NewReader(guacd).ReadString(';')
+	}()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	server := NewServer(nil)
+	server.TunnelAuthorizer = TunnelAuthorizerFunc(func(r *http.Request, _ TunnelOperation, _ *TunnelInfo) error {
+		if r.Header.Get("Authorization") == "" {
+			return ErrUnauthorized.NewError("No credentials.")
+		}
+		return nil
+	})
+	registered := server.registerTunnel(tunnel, nil, nil)
+	idle := time.Now().Add(-time.Minute)
+	registered.Lock()
+	registered.lastAccessedTime = idle
+	registered.Unlock()
+
+	write := func(credentials string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/tunnel?write:"+tunnel.GetUUID(), strings.NewReader("4.sync,1.1;"))
+		if credentials != "" {
+			request.Header.Set("Authorization", credentials)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := write(""); recorder.Code != http.StatusForbidden {
+		t.Error("Expected an unauthorized write to be refused, got", recorder.Code)
+	}
+	if !registered.GetLastAccessedTime().Equal(idle) {
+		t.Error("Expected an unauthorized write not to record an access")
+	}
+
+	if err := server.KillTunnel(tunnel.GetUUID(), "Maintenance window"); err != nil {
+		t.Fatal(err)
+	}
+	recorder := write("")
+	if message := recorder.Header().Get("Guacamole-Error-Message"); recorder.Code != http.StatusForbidden || message == "Maintenance window" {
+		t.Errorf("Expected an unauthorized write not to learn why the tunnel ended, got %v %q", recorder.Code, message)
+	}
+	if message := write("alice").Header().Get("Guacamole-Error-Message"); message != "Maintenance window" {
+		t.Error("Expected an authorized write to learn why the tunnel ended, got", message)
+	}
+}
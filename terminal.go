@@ -0,0 +1,276 @@
+package guac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultTerminalInputPipe is the pipe guacd's text protocols read keyboard input from
+	DefaultTerminalInputPipe = "STDIN"
+	// DefaultTerminalOutputPipe is the pipe TerminalBridge expects terminal output on
+	DefaultTerminalOutputPipe = "STDOUT"
+
+	// terminalKeepAlive is how often TerminalBridge shows guacd the client is still there,
+	// well within the time guacd waits before disconnecting unresponsive users
+	terminalKeepAlive = 5 * time.Second
+	// terminalChunk is the largest websocket message of terminal output
+	terminalChunk = MaxGuacMessage
+)
+
+// TerminalBridge serves the text protocols of guacd (SSH, telnet and kubernetes) as a plain
+// byte stream over a websocket, as expected by xterm.js and similar terminal emulators, so
+// the authentication, recording and filters of this package can be used for terminal access
+// without guacamole-common-js.
+//
+// Every message received from the websocket is written to the session's STDIN pipe, and every
+// message sent is output read from the pipe the terminal redirects its output to. guacd only
+// redirects output once the remote side prints the escape sequence naming the pipe, so the
+// shell must start with something like
+//
+//	printf '\033]482200;STDOUT\007'
+//
+// for example in its profile or in the "command" parameter of the connection. The rendered
+// display guacd sends as usual is discarded, and the terminal keeps the size given in the
+// connection's configuration.
+type TerminalBridge struct {
+	connect func(*http.Request) (Tunnel, error)
+
+	// Authorizer optionally authenticates requests before the websocket is upgraded. The
+	// identity it returns is available to the connect callback through IdentityFromRequest.
+	Authorizer Authorizer
+
+	// IPFilter optionally refuses websockets from the addresses it doesn't allow.
+	IPFilter *IPFilter
+
+	// AllowedOrigins optionally lists the origins of the pages allowed to open websockets,
+	// refusing the handshakes of others. If nil, only pages from the origin of the server are
+	// allowed.
+	AllowedOrigins OriginAllowlist
+
+	// InputPipe is the name of the pipe input is written to, DefaultTerminalInputPipe if empty.
+	InputPipe string
+	// OutputPipe is the name of the pipe output is read from, DefaultTerminalOutputPipe if
+	// empty.
+	OutputPipe string
+
+	// OnConnect is an optional callback called once the tunnel is connected.
+	OnConnect func(Tunnel, *http.Request)
+	// OnDisconnect is an optional callback called when the websocket disconnects.
+	OnDisconnect func(Tunnel, *http.Request)
+}
+
+// NewTerminalBridge creates a bridge to the tunnels returned by connect. Tunnels which are not
+// already a FilteredTunnel are wrapped in one.
+func NewTerminalBridge(connect func(*http.Request) (Tunnel, error)) *TerminalBridge {
+	return &TerminalBridge{
+		connect: connect,
+	}
+}
+
+func (b *TerminalBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if b.IPFilter != nil {
+		r, err = b.IPFilter.check(r, "terminal", nil, transportLog)
+	}
+	if err == nil {
+		r, _, err = authorize(b.Authorizer, r)
+	}
+	if err == nil {
+		err = b.AllowedOrigins.checkOrigin(r)
+	}
+	if err != nil {
+		transportLog.Warn("Terminal request rejected: ", err.Error())
+		guacErr := asErrGuac(err)
+		w.Header().Set("Guacamole-Status-Code", fmt.Sprintf("%v", guacErr.Status.GetGuacamoleStatusCode()))
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  websocketReadBufferSize,
+		WriteBufferSize: websocketWriteBufferSize,
+		CheckOrigin: func(r *http.Request) bool {
+			// AllowedOrigins was checked before upgrading
+			return true
+		},
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		transportLog.Error("Failed to upgrade websocket", err)
+		return
+	}
+	defer func() {
+		if err = ws.Close(); err != nil {
+			transportLog.Traceln("Error closing websocket", err)
+		}
+	}()
+
+	tunnel, err := b.connect(r)
+	if err != nil {
+		closeWithError(ws, err)
+		return
+	}
+	filtered, ok := tunnel.(*FilteredTunnel)
+	if !ok {
+		filtered = NewFilteredTunnel(tunnel)
+	}
+	defer func() {
+		if err = filtered.Close(); err != nil {
+			transportLog.Traceln("Error closing tunnel", err)
+		}
+	}()
+
+	if b.OnConnect != nil {
+		b.OnConnect(filtered, r)
+	}
+	if b.OnDisconnect != nil {
+		defer b.OnDisconnect(filtered, r)
+	}
+
+	session := &terminalSession{ws: ws, tunnel: filtered}
+	pipes := NewPipes(filtered)
+	pipes.Handle(b.outputPipe(), session.output)
+	filtered.AddReadFilter(pipes)
+	filtered.AddReadFilter(FilterFunc(session.filter))
+
+	input, err := pipes.Open(b.inputPipe(), "text/plain")
+	if err != nil {
+		closeWithError(ws, err)
+		return
+	}
+	defer input.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go session.keepAlive(done)
+	go session.input(input)
+
+	reader := filtered.AcquireReader()
+	defer filtered.ReleaseReader()
+	for {
+		// everything not intercepted by the filters is display output, which is discarded
+		if _, err = reader.ReadSome(); err != nil {
+			transportLog.Traceln("Error reading from guacd", err)
+			if guacErr := asErrGuac(err); guacErr.Kind != ErrConnectionClosed {
+				session.close(err)
+			}
+			return
+		}
+	}
+}
+
+func (b *TerminalBridge) inputPipe() string {
+	if b.InputPipe == "" {
+		return DefaultTerminalInputPipe
+	}
+	return b.InputPipe
+}
+
+func (b *TerminalBridge) outputPipe() string {
+	if b.OutputPipe == "" {
+		return DefaultTerminalOutputPipe
+	}
+	return b.OutputPipe
+}
+
+// terminalSession answers guacd on behalf of the client and copies terminal data between the
+// websocket and the session's pipes
+type terminalSession struct {
+	ws     *websocket.Conn
+	tunnel *FilteredTunnel
+
+	// writeLock serializes data messages to the websocket, which the output pipe, if reopened,
+	// may send from several goroutines
+	writeLock sync.Mutex
+}
+
+// filter answers sync instructions as a client rendering the display would, and closes the
+// websocket when guacd ends the session
+func (s *terminalSession) filter(instruction *Instruction) (*Instruction, error) {
+	switch instruction.Opcode {
+	case OpcodeSync:
+		if err := s.tunnel.WriteInstruction(NewInstruction(OpcodeSync, instruction.Args...)); err != nil {
+			return nil, err
+		}
+	case OpcodeError:
+		if len(instruction.Args) >= 2 {
+			code, _ := strconv.Atoi(instruction.Args[1])
+			s.close(&ErrGuac{
+				error:  errors.New(instruction.Args[0]),
+				Status: FromGuacamoleStatusCode(code),
+				Kind:   ErrUpstream,
+			})
+		}
+	case OpcodeDisconnect:
+		s.close(ErrConnectionClosed.NewError("Session ended."))
+	}
+	return instruction, nil
+}
+
+// output copies the terminal output pipe to the websocket
+func (s *terminalSession) output(_ string, data io.Reader) {
+	buf := make([]byte, terminalChunk)
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			s.writeLock.Lock()
+			werr := s.ws.WriteMessage(websocket.BinaryMessage, buf[:n])
+			s.writeLock.Unlock()
+			if werr != nil {
+				transportLog.Traceln("Failed sending terminal output to ws", werr)
+				// keep reading so the tunnel is not blocked on the pipe
+				_, _ = io.Copy(io.Discard, data)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// input copies messages from the websocket to the terminal input pipe until either fails
+func (s *terminalSession) input(stdin io.Writer) {
+	for {
+		_, data, err := s.ws.ReadMessage()
+		if err != nil {
+			transportLog.Traceln("Error reading message from ws", err)
+			// unblocks the read loop, which ends the session
+			_ = s.tunnel.Close()
+			return
+		}
+		if _, err = stdin.Write(data); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+// keepAlive sends guacd a nop periodically, as it disconnects users it has not heard from
+func (s *terminalSession) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(terminalKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.tunnel.WriteInstruction(NewNopInstruction()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// close closes the websocket with the close code and message matching err
+func (s *terminalSession) close(err error) {
+	closeWithError(s.ws, err)
+}
@@ -0,0 +1,74 @@
+package guac
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTerminalBridge(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	guacd := NewStream(server, time.Minute)
+
+	bridge := NewTerminalBridge(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	httpServer := httptest.NewServer(bridge)
+	defer httpServer.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	expect := func(want string) {
+		t.Helper()
+		ins, err := ReadOne(guacd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ins.String(); got != want {
+			t.Fatalf("guacd received %q, want %q", got, want)
+		}
+	}
+	send := func(ins *Instruction) {
+		t.Helper()
+		if _, err := guacd.Write(ins.Byte()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect("4.pipe,2.63,10.text/plain,5.STDIN;")
+
+	send(NewSyncInstruction(1234))
+	expect("4.sync,4.1234;")
+
+	send(NewInstruction(OpcodePipe, "1", "text/plain", DefaultTerminalOutputPipe))
+	send(NewBlobInstruction("1", []byte("$ ")))
+	expect("3.ack,1.1,2.OK,1.0;")
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "$ " {
+		t.Errorf("Unexpected terminal output %q", data)
+	}
+
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("ls\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("4.blob,2.63,4.bHMK;")
+
+	send(NewErrorInstruction("Connection lost.", UpstreamNotFound))
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, UpstreamNotFound.GetWebSocketCode()) {
+		t.Errorf("Expected websocket to close with %v, got %v", UpstreamNotFound, err)
+	}
+}
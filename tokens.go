@@ -0,0 +1,96 @@
+package guac
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Standard parameter tokens, as defined by Apache Guacamole
+const (
+	TokenUsername       = "GUAC_USERNAME"
+	TokenPassword       = "GUAC_PASSWORD"
+	TokenClientAddress  = "GUAC_CLIENT_ADDRESS"
+	TokenClientHostname = "GUAC_CLIENT_HOSTNAME"
+	TokenDate           = "GUAC_DATE"
+	TokenTime           = "GUAC_TIME"
+)
+
+// tokenPattern matches a token reference, along with the "$" escaping it if it is escaped
+var tokenPattern = regexp.MustCompile(`(\$?)\$\{([A-Za-z0-9_]*)(?::([A-Za-z]*))?\}`)
+
+// Tokens holds the values substituted for the ${NAME} references in connection parameters,
+// as Apache Guacamole does. A reference may apply a modifier, as in ${GUAC_USERNAME:LOWER}
+// or ${GUAC_USERNAME:UPPER}. References to unknown tokens are left as they are, and $${NAME}
+// is replaced with a literal ${NAME}.
+//
+//	tokens := guac.NewTokens(r)
+//	tokens[guac.TokenUsername] = identity.Subject
+//	tokens.Apply(config)
+type Tokens map[string]string
+
+// NewTokens returns the standard tokens describing the request and the current time: the
+// client's address and hostname, and the date and time. As with servlet containers which
+// don't look up the names of clients, the hostname is the address. The username and password
+// tokens are left for the connect callback to set.
+func NewTokens(r *http.Request) Tokens {
+	now := time.Now()
+	tokens := Tokens{
+		TokenDate: now.Format("20060102"),
+		TokenTime: now.Format("150405"),
+	}
+	address := clientAddress(r)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	if address != "" {
+		tokens[TokenClientAddress] = address
+		tokens[TokenClientHostname] = address
+	}
+	return tokens
+}
+
+// Filter returns value with the tokens it refers to substituted. Tokens hold what clients
+// choose, such as their username, so a value they would turn into a SecretRef is replaced
+// with an empty one rather than have a secret looked up for the client.
+func (t Tokens) Filter(value string) string {
+	substituted := false
+	filtered := tokenPattern.ReplaceAllStringFunc(value, func(match string) string {
+		groups := tokenPattern.FindStringSubmatch(match)
+		escape, name, modifier := groups[1], groups[2], groups[3]
+		if escape != "" {
+			return match[len(escape):]
+		}
+		replacement, ok := t[name]
+		if !ok {
+			return match
+		}
+		switch modifier {
+		case "":
+		case "LOWER":
+			replacement = strings.ToLower(replacement)
+		case "UPPER":
+			replacement = strings.ToUpper(replacement)
+		default:
+			return match
+		}
+		substituted = true
+		return replacement
+	})
+	if _, ok := secretKey(filtered); ok && substituted {
+		if _, ok = secretKey(value); !ok {
+			handshakeLog.Warnf("Refusing to substitute tokens making %q refer to a secret.", value)
+			return ""
+		}
+	}
+	return filtered
+}
+
+// Apply substitutes the tokens in every parameter of config
+func (t Tokens) Apply(config *Config) {
+	for name, value := range config.Parameters {
+		config.Parameters[name] = t.Filter(value)
+	}
+}
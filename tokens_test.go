@@ -0,0 +1,59 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokens_Filter(t *testing.T) {
+	tokens := Tokens{TokenUsername: "Alice", TokenClientAddress: "192.0.2.1"}
+	for value, want := range map[string]string{
+		"${GUAC_USERNAME}":                       "Alice",
+		"${GUAC_USERNAME:LOWER}@corp":            "alice@corp",
+		"${GUAC_USERNAME:UPPER}":                 "ALICE",
+		"${GUAC_USERNAME}${GUAC_CLIENT_ADDRESS}": "Alice192.0.2.1",
+		"$${GUAC_USERNAME}":                      "${GUAC_USERNAME}",
+		"${GUAC_PASSWORD}":                       "${GUAC_PASSWORD}",
+		"${GUAC_USERNAME:TITLE}":                 "${GUAC_USERNAME:TITLE}",
+		SecretRef("rdp/password"):                SecretRef("rdp/password"),
+		"plain":                                  "plain",
+	} {
+		if got := tokens.Filter(value); got != want {
+			t.Errorf("Expected %q to become %q, got %q", value, want, got)
+		}
+	}
+}
+
+func TestTokens_FilterSecretInjection(t *testing.T) {
+	tokens := Tokens{TokenUsername: SecretRef("rdp/admin/password"), TokenClientAddress: "secret:x"}
+	for _, value := range []string{"${GUAC_USERNAME}", "${${GUAC_CLIENT_ADDRESS}}"} {
+		if got := tokens.Filter(value); got != "" {
+			t.Errorf("Expected tokens not to turn %q into a secret reference, got %q", value, got)
+		}
+	}
+	if got := tokens.Filter("user ${GUAC_USERNAME}"); got != "user "+SecretRef("rdp/admin/password") {
+		t.Errorf("Expected a value which isn't a reference to be substituted, got %q", got)
+	}
+	if got := (Tokens{}).Filter("$${secret:key}"); got != SecretRef("key") {
+		t.Errorf("Expected an escaped reference from the configuration to be kept, got %q", got)
+	}
+}
+
+func TestTokens_Apply(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil)
+	r.RemoteAddr = "192.0.2.1:51234"
+	tokens := NewTokens(r)
+	tokens[TokenUsername] = "alice"
+	if tokens[TokenClientAddress] != "192.0.2.1" || len(tokens[TokenDate]) != 8 || len(tokens[TokenTime]) != 6 {
+		t.Errorf("Unexpected standard tokens %v", tokens)
+	}
+
+	config := NewGuacamoleConfiguration()
+	config.Parameters["username"] = "${GUAC_USERNAME}"
+	config.Parameters["recording-name"] = "${GUAC_DATE}-${GUAC_USERNAME}"
+	tokens.Apply(config)
+	if config.Parameters["username"] != "alice" || config.Parameters["recording-name"] != tokens[TokenDate]+"-alice" {
+		t.Errorf("Unexpected parameters %v", config.Parameters)
+	}
+}
@@ -0,0 +1,80 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the package's tracer
+const tracerName = "github.com/wwt/guac"
+
+// Attributes of the spans of the package
+const (
+	AttributeTunnelUUID   = attribute.Key("guac.tunnel.uuid")
+	AttributeConnectionID = attribute.Key("guac.connection.id")
+	AttributeProtocol     = attribute.Key("guac.protocol")
+	AttributeGuacdAddress = attribute.Key("guac.guacd.address")
+)
+
+// noopSpan stands in for the span of a request when tracing is off
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// tracer returns the package's tracer from provider, or from the provider of the span ctx
+// carries if provider is nil, so work done for a traced request is traced along with it
+func tracer(ctx context.Context, provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = trace.SpanFromContext(ctx).TracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// startRequestSpan starts the span of a request to a server with provider, continuing the
+// trace the client propagated in its headers. Without a provider the request is not traced.
+func startRequestSpan(provider trace.TracerProvider, r *http.Request, name string) (*http.Request, trace.Span) {
+	if provider == nil {
+		return r, noopSpan
+	}
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer(ctx, provider).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.request.method", r.Method)))
+	return r.WithContext(ctx), span
+}
+
+// requestSpanName names the span of an HTTP tunnel request after its operation
+func requestSpanName(query string) string {
+	switch {
+	case query == "connect":
+		return "guac.connect"
+	case strings.HasPrefix(query, readPrefix):
+		return "guac.read"
+	case strings.HasPrefix(query, writePrefix):
+		return "guac.write"
+	}
+	return "guac.request"
+}
+
+// setTunnelAttributes adds the UUID and connection ID of tunnel to the span ctx carries
+func setTunnelAttributes(ctx context.Context, tunnel Tunnel) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(AttributeTunnelUUID.String(tunnel.GetUUID()), AttributeConnectionID.String(tunnel.ConnectionID()))
+}
+
+// endSpan ends span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
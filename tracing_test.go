@@ -0,0 +1,82 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttribute returns the value of the attribute of span with the given key
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestServer_TracerProvider(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	backend := &Backend{Address: "guacd:4822", Dialer: &farmDialer{}}
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		stream, err := backend.Connect(r.Context(), NewGuacamoleConfiguration())
+		if err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	})
+	server.TracerProvider = provider
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previous)
+
+	request := httptest.NewRequest(http.MethodPost, "/?connect", bytes.NewReader(nil))
+	// the trace the client started is continued
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	connect, ok := spans["guac.connect"]
+	if !ok {
+		t.Fatal("Expected the connect request to be traced, got", recorder.Ended())
+	}
+	if connect.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("Expected the client's trace to be continued, got", connect.SpanContext().TraceID())
+	}
+	if spanAttribute(connect, "guac.connection.id") != "$guacd:4822" || spanAttribute(connect, "guac.tunnel.uuid") == "" {
+		t.Error("Expected the tunnel's IDs, got", connect.Attributes())
+	}
+	for _, name := range []string{"guac.guacd.connect", "guac.guacd.dial", "guac.handshake"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %v span", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != connect.SpanContext().TraceID() {
+			t.Errorf("Expected %v to be part of the request's trace", name)
+		}
+	}
+	if spanAttribute(spans["guac.handshake"], "guac.connection.id") != "$guacd:4822" {
+		t.Error("Expected the handshake to carry the connection ID")
+	}
+}
+
+func TestBackend_Connect_Untraced(t *testing.T) {
+	// without a span in the context nothing is recorded, and nothing fails
+	backend := &Backend{Address: "guacd:4822", Dialer: &farmDialer{}}
+	if _, err := backend.Connect(context.Background(), NewGuacamoleConfiguration()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package guac
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLeadIn is the number of instructions a TriggeredRecorder keeps before it is triggered
+// when created with a lead-in of zero
+const DefaultLeadIn = 500
+
+// RecordTrigger decides whether an instruction passing through a tunnel should start its
+// recording, returning why if it should
+type RecordTrigger func(direction Direction, instruction *Instruction) (reason string, ok bool)
+
+// TriggerOnOpcodes triggers recording on any of the given opcodes, in either direction
+func TriggerOnOpcodes(opcodes ...string) RecordTrigger {
+	set := map[string]bool{}
+	for _, opcode := range opcodes {
+		set[opcode] = true
+	}
+	return func(direction Direction, instruction *Instruction) (string, bool) {
+		if !set[instruction.Opcode] {
+			return "", false
+		}
+		return instruction.Opcode + " from " + direction.String(), true
+	}
+}
+
+// TriggerOnClipboard triggers recording when either side uses the clipboard
+func TriggerOnClipboard() RecordTrigger {
+	return TriggerOnOpcodes(OpcodeClipboard)
+}
+
+// TriggerOnFileTransfer triggers recording when a file transfer starts in either direction
+func TriggerOnFileTransfer() RecordTrigger {
+	return TriggerOnOpcodes(OpcodeFile, OpcodePut)
+}
+
+// TriggeredRecorder is a CaptureSink which records to its sink only once something sensitive
+// happens, so ordinary sessions are not kept while audited ones are. Until triggered it holds
+// the most recent instructions in memory, and when triggered it passes them to the sink
+// before everything which follows, so the recording includes what led up to the trigger.
+//
+// Recording is triggered by any of the recorder's RecordTriggers, or by calling Trigger, for
+// example on connect when the session's target is one which is always recorded.
+type TriggeredRecorder struct {
+	// OnTrigger is called with the reason once recording starts, if set
+	OnTrigger func(reason string)
+
+	sink     CaptureSink
+	triggers []RecordTrigger
+
+	sync.Mutex
+	leadIn    []capturedEntry
+	size      int
+	reason    string
+	triggered bool
+}
+
+type capturedEntry struct {
+	at          time.Time
+	direction   Direction
+	instruction *Instruction
+}
+
+// NewTriggeredRecorder creates a recorder passing instructions to sink once triggered, keeping
+// up to leadIn instructions until then
+func NewTriggeredRecorder(sink CaptureSink, leadIn int, triggers ...RecordTrigger) *TriggeredRecorder {
+	if leadIn <= 0 {
+		leadIn = DefaultLeadIn
+	}
+	return &TriggeredRecorder{
+		sink:     sink,
+		triggers: triggers,
+		size:     leadIn,
+	}
+}
+
+// Capture buffers the instruction, or records it if the recorder has been triggered. The
+// instruction which fires a trigger is recorded after the lead-in.
+func (r *TriggeredRecorder) Capture(at time.Time, direction Direction, instruction *Instruction) {
+	r.Lock()
+	defer r.Unlock()
+	if r.triggered {
+		r.sink.Capture(at, direction, instruction)
+		return
+	}
+
+	for _, trigger := range r.triggers {
+		if reason, ok := trigger(direction, instruction); ok {
+			r.trigger(reason)
+			r.sink.Capture(at, direction, instruction)
+			return
+		}
+	}
+	if len(r.leadIn) == r.size {
+		r.leadIn[0] = capturedEntry{}
+		r.leadIn = r.leadIn[1:]
+	}
+	r.leadIn = append(r.leadIn, capturedEntry{at: at, direction: direction, instruction: instruction})
+}
+
+// Trigger starts recording, flushing the lead-in to the sink. It does nothing if the recorder
+// was already triggered.
+func (r *TriggeredRecorder) Trigger(reason string) {
+	r.Lock()
+	defer r.Unlock()
+	r.trigger(reason)
+}
+
+func (r *TriggeredRecorder) trigger(reason string) {
+	if r.triggered {
+		return
+	}
+	r.triggered = true
+	r.reason = reason
+	filtersLog.Debugf("Recording triggered by %v, with %v instructions of lead-in.", reason, len(r.leadIn))
+	for _, entry := range r.leadIn {
+		r.sink.Capture(entry.at, entry.direction, entry.instruction)
+	}
+	r.leadIn = nil
+	if r.OnTrigger != nil {
+		r.OnTrigger(reason)
+	}
+}
+
+// Triggered returns whether recording has started, and why
+func (r *TriggeredRecorder) Triggered() (reason string, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	return r.reason, r.triggered
+}
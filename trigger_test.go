@@ -0,0 +1,50 @@
+package guac
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTriggeredRecorder(t *testing.T) {
+	sink := NewCaptureBuffer(10)
+	var fired string
+	recorder := NewTriggeredRecorder(sink, 2, TriggerOnClipboard(), TriggerOnFileTransfer())
+	recorder.OnTrigger = func(reason string) { fired = reason }
+
+	for i := 1; i <= 3; i++ {
+		recorder.Capture(time.Now(), FromGuacd, NewSyncInstruction(int64(i)))
+	}
+	if len(sink.Instructions()) != 0 {
+		t.Fatal("Expected nothing recorded before the trigger")
+	}
+
+	recorder.Capture(time.Now(), FromClient, NewInstruction(OpcodeClipboard, "0", "text/plain"))
+	recorder.Capture(time.Now(), FromGuacd, NewSyncInstruction(4))
+
+	captured := sink.Instructions()
+	if len(captured) != 4 {
+		t.Fatalf("Expected lead-in, trigger and following instruction, got %+v", captured)
+	}
+	if captured[0].Args[0] != "2" || captured[2].Opcode != OpcodeClipboard || captured[3].Args[0] != "4" {
+		t.Errorf("Unexpected recording %+v", captured)
+	}
+	if reason, ok := recorder.Triggered(); !ok || reason != "clipboard from client" || fired != reason {
+		t.Errorf("Unexpected trigger %q %v, OnTrigger got %q", reason, ok, fired)
+	}
+}
+
+func TestTriggeredRecorder_Manual(t *testing.T) {
+	sink := NewCaptureBuffer(10)
+	recorder := NewTriggeredRecorder(sink, 0)
+	recorder.Capture(time.Now(), FromGuacd, NewSyncInstruction(1))
+	recorder.Capture(time.Now(), FromClient, NewInstruction(OpcodeFile, "1", "text/plain", "a.txt"))
+	if _, ok := recorder.Triggered(); ok {
+		t.Fatal("Expected recorder without triggers to wait for Trigger")
+	}
+
+	recorder.Trigger("sensitive target")
+	recorder.Trigger("again")
+	if reason, _ := recorder.Triggered(); reason != "sensitive target" || len(sink.Instructions()) != 2 {
+		t.Errorf("Unexpected trigger %q with %+v", reason, sink.Instructions())
+	}
+}
@@ -18,7 +18,8 @@ var internalOpcodeIns = []byte(fmt.Sprint(len(InternalDataOpcode), ".", Internal
 
 // InstructionReader provides reading functionality to a Stream
 type InstructionReader interface {
-	// ReadSome returns the next complete guacd message from the stream
+	// ReadSome returns the next complete guacd message from the stream. The returned slice
+	// may be reused by the reader and is only valid until the next call to ReadSome.
 	ReadSome() ([]byte, error)
 	// Available returns true if there are bytes buffered in the stream
 	Available() bool
@@ -57,9 +58,11 @@ type SimpleTunnel struct {
 	 * corresponding UUID such that tunnel read/write requests can be
 	 * directed to the proper tunnel.
 	 */
-	uuid       uuid.UUID
-	readerLock CountedLock
-	writerLock CountedLock
+	uuid uuid.UUID
+	// readerLock is fair, so read requests get the reader in the order they arrive
+	readerLock fairLock
+	// writerLock is fair, so instructions written with WriteInstruction take their turn
+	writerLock fairLock
 }
 
 // NewSimpleTunnel creates a new tunnel
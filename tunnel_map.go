@@ -1,7 +1,7 @@
 package guac
 
 import (
-	"github.com/sirupsen/logrus"
+	"context"
 	"sync"
 	"time"
 )
@@ -20,6 +20,54 @@ type LastAccessedTunnel struct {
 	sync.RWMutex
 	Tunnel
 	lastAccessedTime time.Time
+	identity         *Identity
+	// created is when the tunnel was registered
+	created  time.Time
+	metadata *Metadata
+	// counters counts what the transport carries between the client and the tunnel
+	counters tunnelCounters
+	// killed is the error instruction telling the client why the tunnel was killed
+	killed *Instruction
+	// closeMessages are the CloseMessages of the server the tunnel is registered with
+	closeMessages CloseMessages
+	// ctx is cancelled when the tunnel is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// limiter checks the instructions written to the tunnel over HTTP, only accessed while
+	// holding the writer
+	limiter *instructionLimiter
+	// bannerVersion is the version of the maintenance banner last sent to the client, only
+	// accessed while holding the reader
+	bannerVersion int64
+	// replay keeps the latest instructions sent to the client, if the server has a ReplayBuffer
+	replay *replayBuffer
+	// resumeToken lets a client move the tunnel to another connection, if the server has a
+	// ReplayBuffer
+	resumeToken string
+	// detach detaches the tunnel from the websocket carrying it, if any, and attachments
+	// counts the connections it has been attached to
+	detach      func()
+	attachments int64
+	// idleTimeout overrides the map's timeout for this tunnel, if not zero
+	idleTimeout time.Duration
+	// readers counts the read requests holding or waiting for the reader, and lastRead is when
+	// one last did
+	readers  int
+	lastRead time.Time
+	// journal keeps the diagnostics guacd sent about the tunnel, if the server has GuacdLogs,
+	// and is set before the tunnel is registered
+	journal *Journal
+	// limits are the limits the tunnel was resolved to when it connected, and ownLimits those
+	// set for the tunnel itself, if the server has a LimitHierarchy
+	limits, ownLimits Limits
+	// tags label the tunnel for lookups by FindTagged and the like
+	tags Tags
+	// audit is the audit record of the tunnel, if the server that connected it has an Audit
+	audit *auditRecord
+	// readLatency and writeLatency measure the tunnel's read and write requests
+	readLatency, writeLatency latencyHistogram
+	// slow tracks how the client keeps up with read responses, if the server has SlowClients
+	slow *slowClient
 }
 
 func NewLastAccessedTunnel(tunnel Tunnel) (ret LastAccessedTunnel) {
@@ -40,19 +88,116 @@ func (t *LastAccessedTunnel) GetLastAccessedTime() time.Time {
 	return t.lastAccessedTime
 }
 
+func (t *LastAccessedTunnel) setIdleTimeout(timeout time.Duration) {
+	t.Lock()
+	t.idleTimeout = timeout
+	t.Unlock()
+}
+
+// IdleTimeout returns how long the tunnel may go unused before it is closed, zero if it uses
+// the timeout of its TunnelMap.
+func (t *LastAccessedTunnel) IdleTimeout() time.Duration {
+	t.RLock()
+	defer t.RUnlock()
+	return t.idleTimeout
+}
+
+// Identity returns the identity of the user the tunnel was registered for, nil if unknown.
+func (t *LastAccessedTunnel) Identity() *Identity {
+	t.RLock()
+	defer t.RUnlock()
+	return t.identity
+}
+
+// renewIdentity replaces the identity of the tunnel with a fresh one for the same user
+func (t *LastAccessedTunnel) renewIdentity(identity *Identity) {
+	t.Lock()
+	t.identity = identity
+	t.Unlock()
+}
+
+// Transferred returns the number of bytes sent to and received from the client through the
+// tunnel.
+func (t *LastAccessedTunnel) Transferred() (sent, received int64) {
+	return t.counters.bytesOut.Load(), t.counters.bytesIn.Load()
+}
+
+// Context returns a context which is cancelled once the tunnel is closed.
+func (t *LastAccessedTunnel) Context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// Close cancels the tunnel's context and closes the tunnel.
+func (t *LastAccessedTunnel) Close() error {
+	if t.cancel != nil {
+		t.cancel()
+	}
+	return t.Tunnel.Close()
+}
+
+// killedWith returns the error instruction the tunnel was killed with, nil if it wasn't
+func (t *LastAccessedTunnel) killedWith() *Instruction {
+	t.RLock()
+	defer t.RUnlock()
+	return t.killed
+}
+
+// Metadata returns the values attached to the tunnel.
+func (t *LastAccessedTunnel) Metadata() *Metadata {
+	return t.metadata
+}
+
+// Created returns when the tunnel was registered.
+func (t *LastAccessedTunnel) Created() time.Time {
+	return t.created
+}
+
+// TunnelRegistry stores the tunnels of a Server by UUID. TunnelMap, which closes tunnels once
+// they go unused for too long, is the default; deployments may supply their own, for example
+// to add metrics or a different eviction policy. Implementations must be safe for concurrent
+// use.
+type TunnelRegistry interface {
+	// Register registers a tunnel under the given UUID
+	Register(uuid string, tunnel *LastAccessedTunnel)
+	// Get returns the tunnel registered under the given UUID, recording an access to it
+	Get(uuid string) (*LastAccessedTunnel, bool)
+	// Peek returns the tunnel registered under the given UUID without recording an access,
+	// for lookups which only observe the tunnel
+	Peek(uuid string) (*LastAccessedTunnel, bool)
+	// Remove deregisters the tunnel with the given UUID, returning it if it was registered
+	Remove(uuid string) (*LastAccessedTunnel, bool)
+	// Len returns the number of registered tunnels
+	Len() int
+	// Range calls fn for each registered tunnel until fn returns false. The registry may be
+	// modified while ranging.
+	Range(fn func(uuid string, tunnel *LastAccessedTunnel) bool)
+}
+
+// ExpiringTunnelRegistry is a TunnelRegistry which closes and removes tunnels by itself, such
+// as when they time out. It tells the Server about each so its callbacks still run.
+type ExpiringTunnelRegistry interface {
+	TunnelRegistry
+	// SetOnExpire sets the function called with each tunnel the registry closed and removed
+	SetOnExpire(fn func(uuid string, tunnel *LastAccessedTunnel))
+}
+
 /*
 TunnelTimeout is the number of seconds to wait between tunnel accesses before timing out.
-Note that this will be enforced only within a factor of 2. If a tunnel
-is unused, it will take between TUNNEL_TIMEOUT and TUNNEL_TIMEOUT*2
-seconds before that tunnel is closed and removed.
+Tunnels are checked every tunnelCheckInterval, so an unused tunnel is closed and removed
+up to a second after its timeout.
 */
 const TunnelTimeout = 15 * time.Second
 
+// tunnelCheckInterval is how often TunnelMap looks for tunnels which have timed out
+const tunnelCheckInterval = time.Second
+
 /*
 TunnelMap tracks in-use HTTP tunnels, automatically removing
-and closing tunnels which have not been used recently. This class is
-intended for use only within the Server implementation,
-and has no real utility outside that implementation.
+and closing tunnels which have not been used recently. It is the
+default TunnelRegistry of a Server.
 */
 type TunnelMap struct {
 	sync.RWMutex
@@ -62,13 +207,16 @@ type TunnelMap struct {
 	tunnelTimeout time.Duration
 
 	// Map of all tunnels that are using HTTP, indexed by tunnel UUID.
-	tunnelMap     map[string]*LastAccessedTunnel
+	tunnelMap map[string]*LastAccessedTunnel
+
+	// onExpire is called with each tunnel closed for having timed out.
+	onExpire func(uuid string, tunnel *LastAccessedTunnel)
 }
 
 // NewTunnelMap creates a new TunnelMap and starts the scheduled job with the default timeout.
 func NewTunnelMap() *TunnelMap {
 	tunnelMap := &TunnelMap{
-		ticker:        time.NewTicker(TunnelTimeout),
+		ticker:        time.NewTicker(tunnelCheckInterval),
 		tunnelMap:     make(map[string]*LastAccessedTunnel),
 		tunnelTimeout: TunnelTimeout,
 	}
@@ -87,60 +235,102 @@ func (m *TunnelMap) tunnelTimeoutTask() {
 }
 
 func (m *TunnelMap) tunnelTimeoutTaskRun() {
-	timeLine := time.Now().Add(0 - m.tunnelTimeout)
-
-	type pair struct {
-		uuid   string
-		tunnel *LastAccessedTunnel
-	}
-	var removeIDs []pair
+	now := time.Now()
 
-	m.RLock()
+	removed := map[string]*LastAccessedTunnel{}
+	m.Lock()
+	onExpire := m.onExpire
 	for uuid, tunnel := range m.tunnelMap {
-		if tunnel.GetLastAccessedTime().Before(timeLine) {
-			removeIDs = append(removeIDs, pair{uuid: uuid, tunnel: tunnel})
+		timeout := tunnel.IdleTimeout()
+		if timeout == 0 {
+			timeout = m.tunnelTimeout
+		}
+		if tunnel.GetLastAccessedTime().Before(now.Add(-timeout)) {
+			registryLog.Debugf("HTTP tunnel \"%v\" has timed out.", uuid)
+			delete(m.tunnelMap, uuid)
+			removed[uuid] = tunnel
 		}
 	}
-	m.RUnlock()
+	m.Unlock()
 
-	m.Lock()
-	for _, double := range removeIDs {
-		logrus.Debugf("HTTP tunnel \"%v\" has timed out.", double.uuid)
-		delete(m.tunnelMap, double.uuid)
-
-		if double.tunnel != nil {
-			err := double.tunnel.Close()
-			if err != nil {
-				logrus.Debug("Unable to close expired HTTP tunnel.", err)
-			}
+	// closing may block on guacd, so it is done without holding the lock
+	for uuid, tunnel := range removed {
+		if err := tunnel.kill(tunnel.closedBy(CloseIdleTimeout, SessionTimeout)); err != nil {
+			registryLog.Debug("Unable to close expired HTTP tunnel.", err)
+		}
+		if onExpire != nil {
+			onExpire(uuid, tunnel)
 		}
 	}
+}
+
+// SetTimeout changes how long tunnels may go without being accessed before they are closed
+// and removed, TunnelTimeout by default.
+func (m *TunnelMap) SetTimeout(timeout time.Duration) {
+	m.Lock()
+	m.tunnelTimeout = timeout
 	m.Unlock()
-	return
+}
+
+// SetIdleTimeout changes the timeout of a single tunnel, returning false if there is no such
+// tunnel. A timeout of zero restores the map's timeout.
+func (m *TunnelMap) SetIdleTimeout(uuid string, timeout time.Duration) bool {
+	tunnel, ok := m.Peek(uuid)
+	if ok {
+		tunnel.setIdleTimeout(timeout)
+	}
+	return ok
 }
 
 // Get returns the Tunnel having the given UUID, wrapped within a LastAccessedTunnel.
 func (m *TunnelMap) Get(uuid string) (tunnel *LastAccessedTunnel, ok bool) {
-	m.RLock()
-	tunnel, ok = m.tunnelMap[uuid]
-	m.RUnlock()
-
-	if ok && tunnel != nil {
+	if tunnel, ok = m.Peek(uuid); ok {
 		tunnel.Access()
-	} else {
-		ok = false
 	}
 	return
 }
 
+// Peek returns the tunnel having the given UUID without recording an access to it.
+func (m *TunnelMap) Peek(uuid string) (tunnel *LastAccessedTunnel, ok bool) {
+	m.RLock()
+	tunnel, ok = m.tunnelMap[uuid]
+	m.RUnlock()
+	return tunnel, ok && tunnel != nil
+}
+
 // Add registers that a new connection has been established using HTTP via the given Tunnel.
 func (m *TunnelMap) Put(uuid string, tunnel Tunnel) {
+	m.Register(uuid, newRegisteredTunnel(tunnel, nil, nil))
+}
+
+// Register registers a tunnel under the given UUID, replacing any tunnel already registered
+// under it.
+func (m *TunnelMap) Register(uuid string, tunnel *LastAccessedTunnel) {
 	m.Lock()
-	one := NewLastAccessedTunnel(tunnel)
-	m.tunnelMap[uuid] = &one
+	m.tunnelMap[uuid] = tunnel
 	m.Unlock()
 }
 
+// PutWithIdentity registers a tunnel along with the identity of the user it belongs to.
+func (m *TunnelMap) PutWithIdentity(uuid string, tunnel Tunnel, identity *Identity) {
+	m.Register(uuid, newRegisteredTunnel(tunnel, identity, nil))
+}
+
+// newRegisteredTunnel wraps a tunnel being registered along with its identity and metadata,
+// which is new if nil.
+func newRegisteredTunnel(tunnel Tunnel, identity *Identity, metadata *Metadata) *LastAccessedTunnel {
+	if metadata == nil {
+		metadata = &Metadata{}
+	}
+	one := NewLastAccessedTunnel(tunnel)
+	one.identity = identity
+	one.metadata = metadata
+	one.ctx, one.cancel = context.WithCancel(context.Background())
+	one.created = one.lastAccessedTime
+	one.counters.created = one.created
+	return &one
+}
+
 // Remove removes the Tunnel having the given UUID, if such a tunnel exists. The original tunnel is returned.
 func (m *TunnelMap) Remove(uuid string) (*LastAccessedTunnel, bool) {
 	m.Lock()
@@ -153,6 +343,37 @@ func (m *TunnelMap) Remove(uuid string) (*LastAccessedTunnel, bool) {
 	return v, ok
 }
 
+// Len returns the number of registered tunnels.
+func (m *TunnelMap) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.tunnelMap)
+}
+
+// Range calls fn for each registered tunnel until fn returns false. The map may be modified
+// while ranging.
+func (m *TunnelMap) Range(fn func(uuid string, tunnel *LastAccessedTunnel) bool) {
+	m.RLock()
+	tunnels := make(map[string]*LastAccessedTunnel, len(m.tunnelMap))
+	for uuid, tunnel := range m.tunnelMap {
+		tunnels[uuid] = tunnel
+	}
+	m.RUnlock()
+
+	for uuid, tunnel := range tunnels {
+		if !fn(uuid, tunnel) {
+			return
+		}
+	}
+}
+
+// SetOnExpire sets the function called with each tunnel closed for having timed out.
+func (m *TunnelMap) SetOnExpire(fn func(uuid string, tunnel *LastAccessedTunnel)) {
+	m.Lock()
+	m.onExpire = fn
+	m.Unlock()
+}
+
 // Shutdown stops the ticker to free up resources.
 func (m *TunnelMap) Shutdown() {
 	m.Lock()
@@ -1,6 +1,11 @@
 package guac
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,3 +44,144 @@ func TestTunnelMap(t *testing.T) {
 		t.Error("Expected tunnel to have been removed but found", tunnel, ok)
 	}
 }
+
+func TestTunnelMap_SetIdleTimeout(t *testing.T) {
+	tmap := TunnelMap{
+		tunnelMap:     make(map[string]*LastAccessedTunnel),
+		tunnelTimeout: time.Hour,
+	}
+
+	if tmap.SetIdleTimeout("1", time.Millisecond) {
+		t.Error("Expected no tunnel to set the timeout of")
+	}
+
+	ft := &fakeTunnel{}
+	tmap.PutWithIdentity("1", ft, nil)
+	tmap.PutWithIdentity("2", &fakeTunnel{}, nil)
+	if !tmap.SetIdleTimeout("1", time.Millisecond) {
+		t.Fatal("Expected to set the timeout of tunnel 1")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	tmap.tunnelTimeoutTaskRun()
+
+	if _, ok := tmap.Get("1"); ok {
+		t.Error("Expected idle tunnel to have been removed")
+	}
+	if _, ok := tmap.Get("2"); !ok {
+		t.Error("Expected tunnel using the default timeout to remain")
+	}
+
+	tmap.SetTimeout(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	tmap.tunnelTimeoutTaskRun()
+	if tmap.Len() != 0 {
+		t.Error("Expected all tunnels to have been removed, found", tmap.Len())
+	}
+}
+
+// mapRegistry is a TunnelRegistry without expiry
+type mapRegistry struct {
+	sync.Mutex
+	tunnels map[string]*LastAccessedTunnel
+	puts    int
+}
+
+func (r *mapRegistry) Register(uuid string, tunnel *LastAccessedTunnel) {
+	r.Lock()
+	defer r.Unlock()
+	r.tunnels[uuid] = tunnel
+	r.puts++
+}
+
+func (r *mapRegistry) Get(uuid string) (*LastAccessedTunnel, bool) {
+	r.Lock()
+	defer r.Unlock()
+	tunnel, ok := r.tunnels[uuid]
+	return tunnel, ok
+}
+
+func (r *mapRegistry) Peek(uuid string) (*LastAccessedTunnel, bool) {
+	return r.Get(uuid)
+}
+
+func (r *mapRegistry) Remove(uuid string) (*LastAccessedTunnel, bool) {
+	r.Lock()
+	defer r.Unlock()
+	tunnel, ok := r.tunnels[uuid]
+	delete(r.tunnels, uuid)
+	return tunnel, ok
+}
+
+func (r *mapRegistry) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.tunnels)
+}
+
+func (r *mapRegistry) Range(fn func(uuid string, tunnel *LastAccessedTunnel) bool) {
+	r.Lock()
+	tunnels := make(map[string]*LastAccessedTunnel, len(r.tunnels))
+	for uuid, tunnel := range r.tunnels {
+		tunnels[uuid] = tunnel
+	}
+	r.Unlock()
+	for uuid, tunnel := range tunnels {
+		if !fn(uuid, tunnel) {
+			return
+		}
+	}
+}
+
+func TestServer_Registry(t *testing.T) {
+	registry := &mapRegistry{tunnels: map[string]*LastAccessedTunnel{}}
+	server := NewServerWithRegistry(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{writer: &strings.Builder{}}, nil
+	}, registry)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, connectRequest(""))
+	if recorder.Body.String() != "1" || registry.puts != 1 {
+		t.Fatalf("Expected tunnel to be put in the registry, got %q", recorder.Body.String())
+	}
+	if tunnels := server.Tunnels(); len(tunnels) != 1 || tunnels[0].ConnectionID != "asdf" {
+		t.Errorf("Expected the registry's tunnels to be listed, got %+v", tunnels)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	server.Shutdown(ctx)
+	if registry.Len() != 0 {
+		t.Error("Expected shutdown to empty the registry")
+	}
+}
+
+func TestServer_ObservingKeepsAccessTime(t *testing.T) {
+	server := NewServer(func(r *http.Request) (Tunnel, error) {
+		return &fakeTunnel{}, nil
+	})
+	server.ServeHTTP(httptest.NewRecorder(), connectRequest(""))
+	var tunnelUUID string
+	var tunnel *LastAccessedTunnel
+	server.tunnels.Range(func(uuid string, registered *LastAccessedTunnel) bool {
+		tunnelUUID, tunnel = uuid, registered
+		return false
+	})
+	if tunnel == nil {
+		t.Fatal("Expected a tunnel")
+	}
+	idle := time.Now().Add(-time.Minute)
+	tunnel.Lock()
+	tunnel.lastAccessedTime = idle
+	tunnel.Unlock()
+
+	server.TunnelStats(tunnelUUID)
+	server.TunnelMetadata(tunnelUUID)
+	_, _ = server.ConnectionID(tunnelUUID)
+	_, _ = server.EffectiveLimits(tunnelUUID)
+	_, _, _ = server.TunnelJournal(tunnelUUID)
+	_, _ = server.filteredTunnel(tunnelUUID)
+	if !tunnel.GetLastAccessedTime().Equal(idle) {
+		t.Error("Expected observing a tunnel not to record an access, got", tunnel.GetLastAccessedTime())
+	}
+}
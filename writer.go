@@ -0,0 +1,89 @@
+package guac
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultWriteTimeout is how long WriteInstruction waits for its turn to write to a tunnel
+const DefaultWriteTimeout = 5 * time.Second
+
+// InstructionContextWriter sends complete instructions to guacd, waiting for the turn of the
+// caller among other writers until ctx is done. Writers get their turns in the order they
+// asked.
+type InstructionContextWriter interface {
+	WriteInstructionContext(ctx context.Context, instruction *Instruction) error
+}
+
+// WriteInstruction sends an instruction to guacd through any tunnel, without interleaving it
+// with other writers, so features injecting instructions from their own goroutines need not
+// coordinate AcquireWriter themselves. It waits for its turn until ctx is done, at which
+// point it fails with ServerBusy, unless the tunnel can only wait indefinitely.
+func WriteInstruction(ctx context.Context, tunnel Tunnel, instruction *Instruction) error {
+	switch writer := tunnel.(type) {
+	case InstructionContextWriter:
+		return writer.WriteInstructionContext(ctx, instruction)
+	case InstructionWriter:
+		return writer.WriteInstruction(instruction)
+	}
+	writer := tunnel.AcquireWriter()
+	defer tunnel.ReleaseWriter()
+	_, err := writer.Write(instruction.Byte())
+	return err
+}
+
+// writeWithTimeout writes an instruction, waiting at most DefaultWriteTimeout for its turn
+func writeWithTimeout(writer InstructionContextWriter, instruction *Instruction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultWriteTimeout)
+	defer cancel()
+	return writer.WriteInstructionContext(ctx, instruction)
+}
+
+// writeWaitError is the error of a write which gave up waiting for its turn
+func writeWaitError(err error) error {
+	return ErrServerBusy.NewError("Gave up waiting to write to tunnel:", err.Error())
+}
+
+// WriteInstruction sends an instruction to guacd once the writers ahead of it are done,
+// failing if that takes longer than DefaultWriteTimeout.
+func (t *SimpleTunnel) WriteInstruction(instruction *Instruction) error {
+	return writeWithTimeout(t, instruction)
+}
+
+// WriteInstructionContext sends an instruction to guacd once the writers ahead of it are done,
+// failing if ctx is done first.
+func (t *SimpleTunnel) WriteInstructionContext(ctx context.Context, instruction *Instruction) error {
+	return t.writeContext(ctx, instruction.Byte())
+}
+
+func (t *SimpleTunnel) writeContext(ctx context.Context, data []byte) error {
+	if err := t.writerLock.lockContext(ctx); err != nil {
+		return writeWaitError(err)
+	}
+	defer t.writerLock.Unlock()
+	_, err := t.stream.Write(data)
+	return err
+}
+
+// WriteInstruction sends an instruction to guacd through the registered tunnel, failing if
+// its turn takes longer than DefaultWriteTimeout to come.
+func (t *LastAccessedTunnel) WriteInstruction(instruction *Instruction) error {
+	return writeWithTimeout(t, instruction)
+}
+
+// WriteInstructionContext sends an instruction to guacd through the registered tunnel.
+func (t *LastAccessedTunnel) WriteInstructionContext(ctx context.Context, instruction *Instruction) error {
+	return WriteInstruction(ctx, t.Tunnel, instruction)
+}
+
+// tunnelWriter writes complete instructions to a tunnel, only holding its writer for each
+// write so instructions from WriteInstruction can be sent in between
+type tunnelWriter struct {
+	tunnel Tunnel
+}
+
+func (w tunnelWriter) Write(data []byte) (int, error) {
+	writer := w.tunnel.AcquireWriter()
+	defer w.tunnel.ReleaseWriter()
+	return writer.Write(data)
+}
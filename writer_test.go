@@ -0,0 +1,53 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSimpleTunnel_WriteInstruction(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+
+	received := make(chan string, 1)
+	go func() {
+		data := make([]byte, 64)
+		n, _ := guacd.Read(data)
+		received <- string(data[:n])
+	}()
+
+	// a client write in progress keeps the instruction waiting until its turn
+	tunnel.AcquireWriter()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tunnel.WriteInstructionContext(ctx, NewNopInstruction()); asErrGuac(err).Status != ServerBusy {
+		t.Errorf("Expected the write to give up, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- WriteInstruction(context.Background(), tunnel, NewSyncInstruction(1))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tunnel.ReleaseWriter()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; data != "4.sync,1.1;" {
+		t.Errorf("Unexpected instruction %q", data)
+	}
+}
+
+func TestWriteInstruction_Writer(t *testing.T) {
+	writer := chanWriter(make(chan string, 1))
+	tunnel := &fakeTunnel{writer: writer}
+	if err := WriteInstruction(context.Background(), tunnel, NewNopInstruction()); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-writer; data != "3.nop;" {
+		t.Errorf("Unexpected instruction %q", data)
+	}
+}
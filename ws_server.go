@@ -2,11 +2,15 @@ package guac
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // WebsocketServer implements a websocket-based connection to guacd.
@@ -25,6 +29,127 @@ type WebsocketServer struct {
 	OnConnectWs func(string, *websocket.Conn, *http.Request)
 	// OnDisconnectWs is an optional callback called when the websocket disconnects.
 	OnDisconnectWs func(string, *websocket.Conn, *http.Request, Tunnel)
+
+	// Authorizer optionally authenticates requests before the websocket is upgraded. The
+	// identity it returns is available to the connect callback through IdentityFromRequest.
+	Authorizer Authorizer
+
+	// IPFilter optionally refuses websockets from the addresses it doesn't allow, before they
+	// reach the connect callback. Refusals are audited as AuditAddressRejected.
+	IPFilter *IPFilter
+
+	// AllowedOrigins optionally lists the origins of the pages allowed to open websockets,
+	// refusing the handshakes of others with ClientForbidden. If nil, only pages from the
+	// origin of the server are allowed.
+	AllowedOrigins OriginAllowlist
+
+	// StreamLimits optionally bounds the size of streams sent by the client.
+	StreamLimits *StreamLimits
+
+	// CloseMessages optionally replaces what clients are told when guacd closes the
+	// connection, DefaultCloseMessages if nil.
+	CloseMessages CloseMessages
+
+	// Maintenance optionally overlays a maintenance banner on every tunnel.
+	Maintenance *Maintenance
+
+	// Quota optionally limits how many websockets each user may hold open at once.
+	Quota *SessionQuota
+
+	// Limits optionally resolves the limits of each websocket from layers for tenants and
+	// users, on top of the values of StreamLimits, Quota.Max and MinFlushInterval. They are
+	// resolved before connecting, so the tenant comes from the identity alone.
+	Limits *LimitHierarchy
+
+	// MinFlushInterval optionally sets the shortest time between messages to the client,
+	// capping how often it is sent frames. Instructions arriving in between are sent with the
+	// next message.
+	MinFlushInterval time.Duration
+
+	// ConnectTimeout bounds the connect callback, along with the handshake with guacd it
+	// performs, DefaultConnectTimeout if zero. The callback's request is cancelled once it
+	// passes, and the client is told of an UpstreamTimeout. If negative, connecting may take
+	// as long as it takes.
+	ConnectTimeout time.Duration
+
+	// Admission optionally holds connects back while the system is overloaded, before they
+	// dial guacd. A websocket server has no tunnel limit, so only the system load is checked.
+	Admission *AdmissionController
+
+	// Resumable optionally registers the tunnels of websockets with a Server, so a client
+	// losing its connection can resume the tunnel, over a websocket or over HTTP through the
+	// Server, rather than reconnecting to guacd. The Server must have a ReplayBuffer. Clients
+	// are sent the internal instruction 0.,6.resume,64.<token>; after the tunnel's UUID, and
+	// resume by connecting with the query parameters resume=<token>&offset=<offset>, where
+	// offset counts the bytes of instructions they received, or by sending the token in the
+	// ResumeTokenHeader of an HTTP connect request. A tunnel whose websocket goes away stays
+	// open until the Server's IdleTimeout.
+	Resumable *Server
+
+	// StrictIdentity closes websockets once the identity they were opened for expires, telling
+	// the client authentication has expired.
+	StrictIdentity bool
+
+	// LockOSThread wires the goroutines streaming each tunnel to their own OS threads, which
+	// can improve tail latency on large NUMA hosts at the cost of one thread per goroutine.
+	LockOSThread bool
+
+	// Metrics optionally measures the websockets' tunnels. Tunnels registered with the
+	// Resumable server are counted as open by its Metrics instead.
+	Metrics Metrics
+
+	// Counters optionally counts the websockets' tunnels, connects and bytes through expvar.
+	// As with Metrics, tunnels registered with the Resumable server are counted as open by
+	// its Counters instead.
+	Counters *Counters
+
+	// SlowClients optionally detects clients whose websockets back up, dropping frames,
+	// throttling or disconnecting them.
+	SlowClients *SlowClientPolicy
+
+	// Events optionally publishes the events of the websockets' tunnels to its subscribers.
+	// Tunnels registered with the Resumable server are opened and closed on its Events
+	// instead.
+	Events *EventBus
+
+	// Audit optionally receives structured audit events as websockets connect, fail to
+	// connect and close. Websockets resuming a tunnel are not audited, so with a Resumable
+	// server the events cover the whole tunnel: it connects with its first websocket and
+	// disconnects once the Resumable server closes it.
+	Audit AuditSink
+
+	// Logger optionally receives the messages about the server's websockets and their
+	// tunnels, in place of the package's logger, as with the Logger of a Server.
+	Logger Logger
+
+	// TracerProvider optionally traces websockets from the request upgraded to their closing,
+	// continuing the traces clients propagate, as with the TracerProvider of a Server.
+	TracerProvider trace.TracerProvider
+
+	// Tags optionally returns the tags of the tunnel of a websocket, so it can be looked up by
+	// them with TaggedTunnels, or with those of the Resumable server.
+	Tags func(r *http.Request, tunnel Tunnel) Tags
+
+	// GuacdLogs passes the log and error instructions guacd sends to the LogGuacd subsystem
+	// logger, and keeps the most recent in a journal for each tunnel, available from
+	// TunnelJournal. Tunnels registered with the Resumable server are journaled by its
+	// GuacdLogs instead.
+	GuacdLogs bool
+
+	// LiveFilters wraps every tunnel in a FilteredTunnel, so the built-in filters of a Policy
+	// can be added to and removed from tunnels in use with AddTunnelFilter and
+	// RemoveTunnelFilter.
+	LiveFilters bool
+
+	// Reaper optionally closes tunnels whose connection to guacd has died. Tunnels registered
+	// with the Resumable server are reaped by its Reaper instead, including once their
+	// websocket has gone.
+	Reaper *Reaper
+
+	// tracked registers the tunnels of websockets which can't be resumed, when needed by Tags,
+	// GuacdLogs, LiveFilters or Reaper
+	trackedOnce sync.Once
+	tracked     *Server
 }
 
 // NewWebsocketServer creates a new server with a simple connect method.
@@ -44,47 +169,251 @@ func NewWebsocketServerWs(connect func(*websocket.Conn, *http.Request) (Tunnel,
 const (
 	websocketReadBufferSize  = MaxGuacMessage
 	websocketWriteBufferSize = MaxGuacMessage * 2
+
+	maxCloseMessage = 123
+	closeTimeout    = time.Second
 )
 
 func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, span := startRequestSpan(s.TracerProvider, r, "guac.websocket")
+	var spanErr error
+	defer func() {
+		endSpan(span, spanErr)
+	}()
+	log := transportLog.with(s.Logger, nil)
+	if s.IPFilter != nil {
+		var err error
+		if r, err = s.IPFilter.check(r, "websocket", s.Audit, log); err != nil {
+			spanErr = err
+			log.Warn("Websocket tunnel request rejected: ", err.Error())
+			w.Header().Set("Guacamole-Status-Code", fmt.Sprintf("%v", ClientForbidden.GetGuacamoleStatusCode()))
+			http.Error(w, err.Error(), ClientForbidden.GetHTTPStatusCode())
+			return
+		}
+	}
+	r, identity, err := authorize(s.Authorizer, r)
+	if err == nil {
+		err = s.AllowedOrigins.checkOrigin(r)
+	}
+	// a resume request continues a tunnel already admitted and audited, but only if the server
+	// supports resuming; otherwise it is an ordinary connect
+	resuming := r.URL.Query().Get("resume") != "" && s.Resumable != nil
+	var record *auditRecord
+	if s.Audit != nil && !resuming {
+		r, record = withAuditRecord(r, "websocket", identity)
+	}
+	streamLimits, maxSessions, flushInterval := s.StreamLimits, -1, s.MinFlushInterval
+	if err == nil && s.Limits != nil {
+		limits := s.Limits.Resolve(s.baseLimits(), identity, nil)
+		streamLimits, maxSessions, flushInterval = limits.streamLimits(), limits.MaxSessions, limits.MinFlushInterval
+	}
+	if err == nil && s.Admission != nil && !resuming {
+		err = s.Admission.admit(r.Context(), func() float64 { return 0 }, log)
+	}
+	// a resumed tunnel still holds the quota it acquired when it connected, and a tunnel
+	// registered with the Resumable server holds it until it closes rather than until the
+	// websocket does
+	var quotaKey string
+	quotaBound := false
+	if err == nil && s.Quota != nil && !resuming {
+		if quotaKey, err = s.Quota.acquire(r, identity, maxSessions, log); err == nil {
+			defer func() {
+				if !quotaBound {
+					s.Quota.release(quotaKey)
+				}
+			}()
+		} else if s.Events != nil {
+			s.Events.Publish(&QuotaExceeded{EventSession: EventSession{Identity: identity}, Key: quotaKey, Err: err})
+		}
+	}
+	if err != nil {
+		spanErr = err
+		if record != nil {
+			emitAudit(s.Audit, record.failed(err))
+		}
+		log.Warn("Websocket tunnel request rejected: ", err.Error())
+		guacErr := asErrGuac(err)
+		w.Header().Set("Guacamole-Status-Code", fmt.Sprintf("%v", guacErr.Status.GetGuacamoleStatusCode()))
+		http.Error(w, guacErr.Error(), guacErr.Status.GetHTTPStatusCode())
+		return
+	}
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  websocketReadBufferSize,
 		WriteBufferSize: websocketWriteBufferSize,
 		CheckOrigin: func(r *http.Request) bool {
-			return true // TODO
+			// AllowedOrigins was checked before upgrading
+			return true
 		},
 	}
 	protocol := r.Header.Get("Sec-Websocket-Protocol")
-	ws, err := upgrader.Upgrade(w, r, http.Header{
+	header := http.Header{
 		"Sec-Websocket-Protocol": {protocol},
-	})
+	}
+	if streamLimits != nil {
+		streamLimits.setHeaders(header)
+	}
+	ws, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
-		logrus.Error("Failed to upgrade websocket", err)
+		log.Error("Failed to upgrade websocket", err)
 		return
 	}
 	defer func() {
 		if err = ws.Close(); err != nil {
-			logrus.Traceln("Error closing websocket", err)
+			log.Traceln("Error closing websocket", err)
 		}
 	}()
 
-	logrus.Debug("Connecting to tunnel")
 	var tunnel Tunnel
-	var e error
-	if s.connect != nil {
-		tunnel, e = s.connect(r)
+	// registered is the tunnel as registered with the Resumable server, if any, and missed is
+	// what a resuming client has yet to receive
+	var registered *LastAccessedTunnel
+	// tracked is the tunnel registered with the websocket server's own server, which ends
+	// with the websocket
+	var tracked *LastAccessedTunnel
+	var missed []byte
+	if resuming {
+		registered, missed, err = s.Resumable.resumeWebsocket(r.URL.Query().Get("resume"), r.URL.Query().Get("offset"), identity)
+		if err != nil {
+			spanErr = err
+			log.Warn("Websocket tunnel resume rejected: ", err.Error())
+			closeWithError(ws, err)
+			return
+		}
+		tunnel = registered
 	} else {
-		tunnel, e = s.connectWs(ws, r)
+		log.Debug("Connecting to tunnel")
+		var metadata *Metadata
+		r, metadata = withMetadata(r)
+		var redactions *redaction
+		r, redactions = withRedaction(r)
+		var e error
+		connect := s.connect
+		if connect == nil {
+			connect = func(r *http.Request) (Tunnel, error) {
+				return s.connectWs(ws, r)
+			}
+		}
+		tunnel, e = connectWithTimeout(r, connectTimeout(s.ConnectTimeout), connect)
+		if e != nil {
+			// connect callbacks may echo the parameters of their connections in their errors
+			e = redactions.redact(e)
+			spanErr = e
+			if s.Metrics != nil {
+				connectFailed(s.Metrics, e)
+			}
+			if s.Counters != nil {
+				s.Counters.connectFailed(e)
+			}
+			if record != nil {
+				emitAudit(s.Audit, record.failed(e))
+			}
+			if asErrGuac(e).Kind == ErrUpstreamTimeout {
+				log.Warn("Websocket tunnel connect timed out.")
+				closeWithError(ws, e)
+			}
+			return
+		}
+		if s.Limits != nil {
+			// the connect callback may have attached the tenant of the session
+			limits := s.Limits.Resolve(s.baseLimits(), identity, metadata)
+			streamLimits, flushInterval = limits.streamLimits(), limits.MinFlushInterval
+		}
+		if s.Metrics != nil {
+			tunnel = connectedTunnel(s.Metrics, tunnel)
+		}
+		if s.Counters != nil {
+			tunnel = s.Counters.connected(tunnel)
+		}
+		if record != nil {
+			tunnel = record.counted(tunnel)
+		}
+		if streamLimits != nil {
+			tunnel = streamLimits.wrap(tunnel)
+		}
+		if _, ok := tunnel.(*FilteredTunnel); (s.LiveFilters || s.GuacdLogs || s.Resumable != nil && (s.Resumable.LiveFilters || s.Resumable.GuacdLogs)) && !ok {
+			tunnel = NewFilteredTunnel(tunnel)
+		}
+		var tags Tags
+		if s.Tags != nil {
+			tags = s.Tags(r, tunnel)
+		}
+		if s.Resumable != nil {
+			registered = s.Resumable.registerTaggedTunnel(tunnel, identity, metadata, tags)
+			tunnel = registered
+			if s.Quota != nil {
+				quotaBound = true
+				go func(closed <-chan struct{}) {
+					<-closed
+					s.Quota.release(quotaKey)
+				}(registered.Context().Done())
+			}
+		} else if s.tracksTunnels() {
+			tracked = s.tunnelServer().registerTaggedTunnel(tunnel, identity, metadata, tags)
+			tunnel = tracked
+		}
 	}
-	if e != nil {
-		return
+	ws.SetReadLimit(streamLimits.maxMessageSize())
+	if registered == nil && s.Metrics != nil {
+		s.Metrics.TunnelOpened()
+		defer s.Metrics.TunnelClosed()
 	}
-	defer func() {
-		if err = tunnel.Close(); err != nil {
-			logrus.Traceln("Error closing tunnel", err)
+	if registered == nil && s.Counters != nil {
+		s.Counters.tunnels.Add(1)
+		defer s.Counters.tunnels.Add(-1)
+	}
+	// closeErr is why the tunnel stopped
+	var closeErr error
+	if registered == nil && s.Events != nil {
+		opened := &TunnelOpened{EventSession: sessionOf(tunnel), Transport: "websocket"}
+		opened.Identity = identity
+		s.Events.Publish(opened)
+		defer func() {
+			closed := &TunnelClosed{EventSession: sessionOf(tunnel), Cause: closeErr, Duration: time.Since(opened.Time)}
+			closed.Identity = identity
+			s.Events.Publish(closed)
+		}()
+	}
+	if tracked != nil {
+		defer func() {
+			s.tunnelServer().deregisterTunnel(tracked, closeErr)
+		}()
+		go keepAccessed(r.Context(), tracked)
+	}
+	if registered == nil {
+		defer func() {
+			if err = tunnel.Close(); err != nil {
+				log.Traceln("Error closing tunnel", err)
+			}
+		}()
+	}
+	log = transportLog.with(s.Logger, tunnelLogFields(tunnel))
+	log.Debug("Connected to tunnel")
+	if record != nil {
+		record.connected = time.Now()
+		emitAudit(s.Audit, record.event(AuditConnect, tunnel))
+		if registered != nil {
+			// the tunnel outlives the websocket, so it is audited as disconnected once the
+			// Resumable server closes it, counting what resumed websockets carried too
+			record.sink = s.Audit
+			registered.Lock()
+			registered.audit = record
+			registered.Unlock()
+		} else {
+			defer func() {
+				emitAudit(s.Audit, record.disconnected(tunnel, closeErr, nil, record.bytesIn.Load(), record.bytesOut.Load()))
+			}()
 		}
-	}()
-	logrus.Debug("Connected to tunnel")
+	}
+	setTunnelAttributes(r.Context(), tunnel)
+	if s.StrictIdentity && identity != nil && !identity.Expiry.IsZero() {
+		expire := time.AfterFunc(time.Until(identity.Expiry), func() {
+			log.Infof("Identity of %v has expired, closing websocket.", identity)
+			closeWithError(ws, ErrUnauthorized.NewError(identityExpiredMessage))
+			_ = ws.Close()
+		})
+		defer expire.Stop()
+	}
 
 	id := tunnel.ConnectionID()
 
@@ -95,8 +424,11 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.OnConnectWs(id, ws, r)
 	}
 
-	writer := tunnel.AcquireWriter()
 	reader := tunnel.AcquireReader()
+	if s.Maintenance != nil {
+		var bannerVersion int64
+		reader = s.Maintenance.reader(reader, &bannerVersion, !speaksMsg(tunnel))
+	}
 
 	if s.OnDisconnect != nil {
 		defer s.OnDisconnect(id, r, tunnel)
@@ -105,11 +437,97 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		defer s.OnDisconnectWs(id, ws, r, tunnel)
 	}
 
-	defer tunnel.ReleaseWriter()
 	defer tunnel.ReleaseReader()
 
-	go wsToGuacd(ws, writer)
-	guacdToWs(ws, reader)
+	// once the client goes away, a read waiting on guacd is abandoned rather than waiting for
+	// guacd's next instruction
+	clientGone, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := interruptOnDone(tunnel, false, clientGone)
+	defer stop()
+
+	// a tunnel registered with the Resumable server outlives the websocket until it times out,
+	// unless guacd closes it, and moves to the next connection resuming it
+	var out MessageWriter = ws
+	if registered != nil {
+		attachment := registered.attach(func() {
+			cancel()
+			_ = ws.Close()
+		})
+		defer registered.detached(attachment)
+		go keepAccessed(clientGone, registered)
+
+		if registered.replay != nil {
+			out = &replayWriter{MessageWriter: ws, replay: registered.replay}
+		}
+		if missed == nil && registered.resumeToken != "" {
+			err = sendResumeToken(ws, registered)
+		} else if len(missed) > 0 {
+			err = ws.WriteMessage(websocket.TextMessage, missed)
+		}
+		if err != nil {
+			log.Traceln("Failed sending message to ws", err)
+			return
+		}
+	}
+
+	// frames dropped for a slow client are left out of the replay buffer, as it never had them
+	if s.SlowClients != nil {
+		out = &slowClientWriter{MessageWriter: out, client: newSlowClient(s.SlowClients, tunnel)}
+	}
+
+	go runLabeled(r.Context(), tunnel, roleWsToGuacd, s.LockOSThread, func(context.Context) {
+		defer cancel()
+		if err := wsToGuacd(ws, &limitedWriter{Writer: tunnelWriter{tunnel}, limiter: &instructionLimiter{limits: streamLimits.instructionLimits()}, counters: countersOf(tunnel)}); err != nil {
+			if s.Events != nil {
+				s.Events.Publish(&WriteError{EventSession: sessionOf(tunnel), Err: err})
+			}
+			closeWithError(ws, err)
+		}
+	})
+	runLabeled(r.Context(), tunnel, roleGuacdToWs, s.LockOSThread, func(context.Context) {
+		// the client is told why the session ended along with the last instructions from guacd
+		final := func(err error) *Instruction {
+			if clientGone.Err() != nil {
+				return nil
+			}
+			if registered != nil && registered.killedWith() != nil {
+				return registered.killedWith()
+			}
+			return s.CloseMessages.instruction(err)
+		}
+		err := finalGuacdToWs(out, reader, &flushPacer{min: flushInterval}, tunnel, final)
+		closeErr = err
+		// reads fail once the client has gone as the tunnel is closed, which is not an error
+		if clientGone.Err() != nil {
+			return
+		}
+		if err != nil && CloseReasonOf(err) != CloseEOF && s.Events != nil {
+			s.Events.Publish(&ReadError{EventSession: sessionOf(tunnel), Err: err})
+		}
+		if registered != nil {
+			s.Resumable.deregisterTunnel(registered, err)
+			_ = registered.Close()
+		}
+	})
+}
+
+// closeWithError closes the websocket with the close code and message matching err
+func closeWithError(ws *websocket.Conn, err error) {
+	guacErr := asErrGuac(err)
+	message := "Internal server error."
+	if guacErr.Kind.isClientError() {
+		message = guacErr.Error()
+	}
+	// control frame payloads are limited to 125 bytes, two of which hold the code
+	if len(message) > maxCloseMessage {
+		message = message[:maxCloseMessage]
+	}
+
+	data := websocket.FormatCloseMessage(guacErr.Status.GetWebSocketCode(), message)
+	if err = ws.WriteControl(websocket.CloseMessage, data, time.Now().Add(closeTimeout)); err != nil {
+		transportLog.Traceln("Failed sending close message to ws", err)
+	}
 }
 
 // MessageReader wraps a websocket connection and only permits Reading
@@ -118,12 +536,14 @@ type MessageReader interface {
 	ReadMessage() (int, []byte, error)
 }
 
-func wsToGuacd(ws MessageReader, guacd io.Writer) {
+// wsToGuacd copies messages from the websocket to guacd until either side fails, returning
+// the error if writing to guacd failed.
+func wsToGuacd(ws MessageReader, guacd io.Writer) error {
 	for {
 		_, data, err := ws.ReadMessage()
 		if err != nil {
-			logrus.Traceln("Error reading message from ws", err)
-			return
+			transportLog.Traceln("Error reading message from ws", err)
+			return nil
 		}
 
 		if bytes.HasPrefix(data, internalOpcodeIns) {
@@ -132,8 +552,8 @@ func wsToGuacd(ws MessageReader, guacd io.Writer) {
 		}
 
 		if _, err = guacd.Write(data); err != nil {
-			logrus.Traceln("Failed writing to guacd", err)
-			return
+			transportLog.Traceln("Failed writing to guacd", err)
+			return err
 		}
 	}
 }
@@ -144,14 +564,43 @@ type MessageWriter interface {
 	WriteMessage(int, []byte) error
 }
 
-func guacdToWs(ws MessageWriter, guacd InstructionReader) {
+// guacdToWs copies instructions from guacd to the websocket until either side fails, returning
+// the error if reading from guacd failed.
+func guacdToWs(ws MessageWriter, guacd InstructionReader) error {
+	return pacedGuacdToWs(ws, guacd, nil, nil)
+}
+
+// pacedGuacdToWs is guacdToWs spacing out messages with the pacer, if any, and counting them
+// as flushes of the tunnel, if any
+func pacedGuacdToWs(ws MessageWriter, guacd InstructionReader, pacer *flushPacer, tunnel Tunnel) error {
+	return finalGuacdToWs(ws, guacd, pacer, tunnel, nil)
+}
+
+// finalHeadroom is the room kept free in each message sent to a websocket, so the instruction
+// telling the client why the session ended always fits in the last one
+const finalHeadroom = 512
+
+// finalGuacdToWs is pacedGuacdToWs ending with the instruction final returns for the error
+// reading from guacd, if final is set and returns one. The instruction is sent in the same
+// message as whatever was read before the error, rather than dropped behind it.
+func finalGuacdToWs(ws MessageWriter, guacd InstructionReader, pacer *flushPacer, tunnel Tunnel, final func(error) *Instruction) error {
 	buf := bytes.NewBuffer(make([]byte, 0, MaxGuacMessage*2))
 
 	for {
 		ins, err := guacd.ReadSome()
 		if err != nil {
-			logrus.Traceln("Error reading from guacd", err)
-			return
+			transportLog.Traceln("Error reading from guacd", err)
+			if final != nil {
+				if ins := final(err); ins != nil {
+					buf.Write(ins.Byte())
+				}
+			}
+			if buf.Len() > 0 {
+				if e := ws.WriteMessage(websocket.TextMessage, buf.Bytes()); e != nil {
+					transportLog.Traceln("Failed sending last message to ws", e)
+				}
+			}
+			return err
 		}
 
 		if bytes.HasPrefix(ins, internalOpcodeIns) {
@@ -160,19 +609,27 @@ func guacdToWs(ws MessageWriter, guacd InstructionReader) {
 		}
 
 		if _, err = buf.Write(ins); err != nil {
-			logrus.Traceln("Failed to buffer guacd to ws", err)
-			return
+			transportLog.Traceln("Failed to buffer guacd to ws", err)
+			return nil
 		}
 
 		// if the buffer has more data in it or we've reached the max buffer size, send the data and reset
-		if !guacd.Available() || buf.Len() >= MaxGuacMessage {
+		if !guacd.Available() || buf.Len() >= MaxGuacMessage-finalHeadroom {
+			if buf.Len() < MaxGuacMessage-finalHeadroom {
+				pacer.wait()
+			}
 			if err = ws.WriteMessage(1, buf.Bytes()); err != nil {
 				if err == websocket.ErrCloseSent {
-					return
+					return nil
 				}
-				logrus.Traceln("Failed sending message to ws", err)
-				return
+				transportLog.Traceln("Failed sending message to ws", err)
+				return nil
+			}
+			if counters := countersOf(tunnel); counters != nil {
+				counters.countMessage(FromGuacd, buf.Bytes())
 			}
+			pacer.flushed()
+			flushed(tunnel)
 			buf.Reset()
 		}
 	}
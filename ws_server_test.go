@@ -67,6 +67,9 @@ func (f *fakeTunnel) HasQueuedReaderThreads() bool {
 }
 
 func (f *fakeTunnel) AcquireWriter() io.Writer {
+	if f.writer == nil {
+		return io.Discard
+	}
 	return f.writer
 }
 
@@ -85,3 +88,46 @@ func (f *fakeTunnel) GetUUID() string {
 func (f *fakeTunnel) Close() error {
 	return nil
 }
+
+// scriptedReader returns each of its chunks in turn, reporting more available until the last,
+// and then fails with err
+type scriptedReader struct {
+	chunks [][]byte
+	err    error
+}
+
+func (r *scriptedReader) ReadSome() ([]byte, error) {
+	if len(r.chunks) == 0 {
+		return nil, r.err
+	}
+	chunk := r.chunks[0]
+	r.chunks = r.chunks[1:]
+	return chunk, nil
+}
+
+func (r *scriptedReader) Available() bool {
+	return true
+}
+
+func (r *scriptedReader) Flush() {}
+
+func TestWebsocketServer_finalGuacdToWs(t *testing.T) {
+	guacd := &scriptedReader{
+		chunks: [][]byte{[]byte("4.sync,1.1;"), []byte(strings.Repeat("3.nop;", (MaxGuacMessage-finalHeadroom)/6-2))},
+		err:    io.EOF,
+	}
+	msgWriter := &fakeMessageWriter{}
+	final := NewErrorInstruction(DefaultCloseMessages[CloseIdleTimeout], SessionTimeout)
+
+	err := finalGuacdToWs(msgWriter, guacd, nil, nil, func(error) *Instruction { return final })
+	if err != io.EOF {
+		t.Error("Expected the read error, got", err)
+	}
+	if len(msgWriter.Messages) != 1 {
+		t.Fatal("Expected 1 message, got", len(msgWriter.Messages))
+	}
+	last := msgWriter.Messages[0]
+	if !bytes.HasPrefix(last, []byte("4.sync,1.1;")) || !bytes.HasSuffix(last, final.Byte()) || len(last) > MaxGuacMessage {
+		t.Errorf("Unexpected last message of %v bytes: %.40q...", len(last), last)
+	}
+}
@@ -0,0 +1,45 @@
+package guac
+
+// tracksTunnels returns whether the websocket server registers the tunnels of websockets which
+// can't be resumed, so they can be looked up by UUID or tags and reaped
+func (s *WebsocketServer) tracksTunnels() bool {
+	return s.Tags != nil || s.GuacdLogs || s.LiveFilters || s.Reaper != nil
+}
+
+// tunnelServer returns the server the tunnels of websockets are registered with: the
+// Resumable server if there is one, otherwise a server of the websocket server's own
+func (s *WebsocketServer) tunnelServer() *Server {
+	if s.Resumable != nil {
+		return s.Resumable
+	}
+	s.trackedOnce.Do(func() {
+		s.tracked = NewServer(nil)
+		s.tracked.GuacdLogs = s.GuacdLogs
+		s.tracked.CloseMessages = s.CloseMessages
+		s.tracked.Reaper = s.Reaper
+	})
+	return s.tracked
+}
+
+// TaggedTunnels returns the UUIDs of the open tunnels of websockets whose tags match selector
+func (s *WebsocketServer) TaggedTunnels(selector Tags) []string {
+	return s.tunnelServer().TaggedTunnels(selector)
+}
+
+// TunnelJournal returns the diagnostics guacd sent about the open tunnel of a websocket with
+// the given UUID, along with the number of entries dropped, as with Server.TunnelJournal.
+func (s *WebsocketServer) TunnelJournal(tunnelUUID string) ([]JournalEntry, int64, error) {
+	return s.tunnelServer().TunnelJournal(tunnelUUID)
+}
+
+// AddTunnelFilter adds the built-in filter with the given name to the open tunnel of a
+// websocket with the given UUID, as with Server.AddTunnelFilter.
+func (s *WebsocketServer) AddTunnelFilter(tunnelUUID, name string) error {
+	return s.tunnelServer().AddTunnelFilter(tunnelUUID, name)
+}
+
+// RemoveTunnelFilter removes the filter with the given name from the open tunnel of a
+// websocket with the given UUID, as with Server.RemoveTunnelFilter.
+func (s *WebsocketServer) RemoveTunnelFilter(tunnelUUID, name string) error {
+	return s.tunnelServer().RemoveTunnelFilter(tunnelUUID, name)
+}
@@ -0,0 +1,58 @@
+package guac
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketServer_TrackedTunnels(t *testing.T) {
+	client, guacd := net.Pipe()
+	defer guacd.Close()
+	wsServer := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	wsServer.Tags = func(r *http.Request, tunnel Tunnel) Tags {
+		return Tags{"tenant": "acme"}
+	}
+	wsServer.GuacdLogs = true
+	wsServer.LiveFilters = true
+	httpServer := httptest.NewServer(wsServer)
+	defer httpServer.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = guacd.Write(NewInstruction(OpcodeLog, "guacd says hello").Byte())
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	uuids := wsServer.TaggedTunnels(Tags{"tenant": "acme"})
+	if len(uuids) != 1 {
+		t.Fatalf("Expected the websocket's tunnel to be found by its tags, got %v", uuids)
+	}
+	if entries, _, err := wsServer.TunnelJournal(uuids[0]); err != nil || len(entries) != 1 {
+		t.Errorf("Expected guacd's log in the journal, got %v %v", entries, err)
+	}
+	if err = wsServer.AddTunnelFilter(uuids[0], PolicyNoClipboardUpload); err != nil {
+		t.Errorf("Expected filters to be added to the live tunnel, got %v", err)
+	}
+
+	_ = guacd.Close()
+	_, _, _ = ws.ReadMessage()
+	_ = ws.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(wsServer.TaggedTunnels(Tags{"tenant": "acme"})) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the tunnel to be deregistered with its websocket")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}